@@ -0,0 +1,348 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// BacksplashConfig contains the configuration fields for the 'backsplash'
+// mode of the shellfish tool.
+type BacksplashConfig struct {
+	rspColumn        int64
+	searchRadiusMult float64
+}
+
+var _ Mode = &BacksplashConfig{}
+
+// ExampleConfig creates an example backsplash.config file.
+func (config *BacksplashConfig) ExampleConfig() string {
+	return `[backsplash.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# RspColumn is the 0-indexed column of the input catalog which contains the
+# splashback radius of each host in cMpc/h. Defaults to 2, which is the R_sp
+# column written by orbit mode. (The R_sp column written by stats mode is 3.)
+#
+# RspColumn = 2
+
+# SearchRadiusMult is the maximum distance between a backsplash halo and its
+# host in units of the host's splashback radius. Defaults to 3.
+#
+# SearchRadiusMult = 3`
+}
+
+// ReadConfig reads in a backsplash.config file into config.
+func (config *BacksplashConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("backsplash.config")
+	vars.Int(&config.rspColumn, "RspColumn", 2)
+	vars.Float(&config.searchRadiusMult, "SearchRadiusMult", 3)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *BacksplashConfig) validate() error {
+	if config.rspColumn < 2 {
+		return fmt.Errorf("The 'RspColumn' variable is set to %d, but "+
+			"columns 0 and 1 are the ID and snapshot.", config.rspColumn)
+	}
+	if config.searchRadiusMult <= 1 {
+		return fmt.Errorf("The 'SearchRadiusMult' variable is set to %g, "+
+			"but it needs to be larger than 1.", config.searchRadiusMult)
+	}
+	return nil
+}
+
+// backsplashCandidate is a halo outside the splashback radius of a host.
+type backsplashCandidate struct {
+	id, snap, host int
+	dist           float64
+}
+
+// Run executes the backsplash mode of the shellfish tool.
+func (config *BacksplashConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+##########################
+## shellfish backsplash ##
+##########################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, floatCols, err := catalog.Parse(
+		stdin, []int{0, 1}, []int{int(config.rspColumn)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	hostIDs, hostSnaps, rsps := intCols[0], intCols[1], floatCols[0]
+	if len(hostIDs) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := getVectorBuffer(
+		e.ParticleCatalog(hostSnaps[0], 0), gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	cands, err := config.findCandidates(
+		hostIDs, hostSnaps, rsps, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Follow every host and candidate back in time.
+	roots := append([]int{}, hostIDs...)
+	for _, c := range cands {
+		roots = append(roots, c.id)
+	}
+	rootSnaps := append([]int{}, hostSnaps...)
+	for _, c := range cands {
+		rootSnaps = append(rootSnaps, c.snap)
+	}
+	pos, rs, L, err := branchPositions(
+		roots, rootSnaps, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, snaps, hosts, periSnaps := []int{}, []int{}, []int{}, []int{}
+	dists, minDists := []float64{}, []float64{}
+	for i, c := range cands {
+		hPos, hRs, cPos := pos[c.host], rs[c.host], pos[len(hostIDs)+i]
+		rsp, r200m := rsps[c.host], hRs[c.snap]
+
+		periSnap, minDist := -1, math.Inf(+1)
+		for snap, x := range cPos {
+			hx, ok := hPos[snap]
+			if !ok || snap >= c.snap {
+				continue
+			}
+			// Scale the splashback radius with the host's R200m.
+			pastRsp := rsp * hRs[snap] / r200m
+			d := periodicSep(x, hx, L) / pastRsp
+			if d < minDist {
+				periSnap, minDist = snap, d
+			}
+		}
+
+		if minDist < 1 {
+			ids = append(ids, c.id)
+			snaps = append(snaps, c.snap)
+			hosts = append(hosts, hostIDs[c.host])
+			periSnaps = append(periSnaps, periSnap)
+			dists = append(dists, c.dist/rsp)
+			minDists = append(minDists, minDist)
+		}
+	}
+
+	order := []int{0, 1, 2, 3, 4, 5}
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps, hosts, periSnaps},
+		[][]float64{dists, minDists}, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot", "HostID", "PericenterSnapshot"},
+		[]string{"R/R_sp", "RMin/R_sp"}, order, []int{1, 1, 1, 1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
+
+// findCandidates returns every halo which is less massive than one of the
+// hosts and is between R_sp and SearchRadiusMult*R_sp from it.
+func (config *BacksplashConfig) findCandidates(
+	hostIDs, hostSnaps []int, rsps []float64, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, gConfig *GlobalConfig,
+) ([]backsplashCandidate, error) {
+	cands := []backsplashCandidate{}
+
+	_, idxBins := binBySnap(hostSnaps, hostIDs)
+	for snap, idxs := range idxBins {
+		if snap == -1 {
+			continue
+		}
+
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		hd := &hds[0]
+
+		rids, err := memo.ReadSortedRockstarIDs(
+			snap, -1, "M200m", vars, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+		_, vals, err := memo.ReadRockstar(
+			snap, []string{"X", "Y", "Z", "M200m"}, rids, vars, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+		xs, ys, zs, ms := vals[0], vals[1], vals[2], vals[3]
+		pucf := halo.UnitConversionFactor(gConfig.HaloPositionUnits, &hd.Cosmo)
+		for i := range xs {
+			xs[i] *= pucf
+			ys[i] *= pucf
+			zs[i] *= pucf
+		}
+
+		mt := halo.NewMatcher(finderCells, hd.TotalWidth, xs, ys, zs, ms)
+		f := newIntFinder(rids)
+		for _, i := range idxs {
+			j, ok := f.find(hostIDs[i])
+			if !ok {
+				return nil, fmt.Errorf("ID %d not in halo list.", hostIDs[i])
+			}
+
+			hostPos := [3]float64{xs[j], ys[j], zs[j]}
+			nIdxs, nDists := mt.Neighbors(
+				hostPos, rsps[i]*config.searchRadiusMult,
+			)
+			for k, n := range nIdxs {
+				if n == j || ms[n] >= ms[j] || nDists[k] <= rsps[i] {
+					continue
+				}
+				cands = append(cands, backsplashCandidate{
+					id: rids[n], snap: snap, host: i, dist: nDists[k],
+				})
+			}
+		}
+	}
+
+	return cands, nil
+}
+
+// branchPositions follows the main branch of each root halo back to SnapMin
+// and returns maps from snapshot to the position and R200m of the branch at
+// that snapshot, along with the width of the box.
+func branchPositions(
+	roots, rootSnaps []int, vars *halo.VarColumns, buf io.VectorBuffer,
+	e *env.Environment, gConfig *GlobalConfig,
+) (pos []map[int][3]float64, rs []map[int]float64, L float64, err error) {
+	pos = make([]map[int][3]float64, len(roots))
+	rs = make([]map[int]float64, len(roots))
+	if len(roots) == 0 {
+		return pos, rs, 0, nil
+	}
+
+	hd, err := snapHeader(rootSnaps[0], buf, e)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	L = hd.TotalWidth
+
+	trees, err := treeFiles(gConfig)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// Skip sentinel rows.
+	validRoots, validIdxs := []int{}, []int{}
+	for i := range roots {
+		if rootSnaps[i] != -1 {
+			validRoots = append(validRoots, roots[i])
+			validIdxs = append(validIdxs, i)
+		}
+	}
+	idSets, snapSets, err := haloHistories(trees, validRoots, gConfig, e)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	ids, snaps, owners := []int{}, []int{}, []int{}
+	for k, i := range validIdxs {
+		for j := range idSets[k] {
+			snap := snapSets[k][j]
+			if snap >= int(gConfig.SnapMin) && snap <= rootSnaps[i] {
+				ids = append(ids, idSets[k][j])
+				snaps = append(snaps, snap)
+				owners = append(owners, i)
+			}
+		}
+	}
+
+	for i := range roots {
+		pos[i], rs[i] = map[int][3]float64{}, map[int]float64{}
+	}
+	if len(ids) == 0 {
+		return pos, rs, L, nil
+	}
+
+	cols, err := readHaloCoords(
+		ids, snaps, []string{"X", "Y", "Z", "R200m"}, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	for k, i := range owners {
+		pos[i][snaps[k]] = [3]float64{cols[0][k], cols[1][k], cols[2][k]}
+		rs[i][snaps[k]] = cols[3][k]
+	}
+
+	return pos, rs, L, nil
+}
+
+// periodicSep returns the distance between two points in a periodic box of
+// width L.
+func periodicSep(x1, x2 [3]float64, L float64) float64 {
+	sum := 0.0
+	for k := 0; k < 3; k++ {
+		dx := math.Abs(x1[k] - x2[k])
+		if dx > L/2 {
+			dx = L - dx
+		}
+		sum += dx * dx
+	}
+	return math.Sqrt(sum)
+}
@@ -0,0 +1,442 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cosmo"
+	"github.com/phil-mansfield/shellfish/lib"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/math/rand"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// BenchmarkConfig contains the configuration fields for the 'benchmark' mode
+// of the shellfish tool.
+type BenchmarkConfig struct {
+	halos             int64
+	particles         int64
+	m200m             float64
+	concentration     float64
+	transitionMult    float64
+	monteCarloSamples int64
+
+	shell *ShellConfig
+}
+
+var _ Mode = &BenchmarkConfig{}
+
+// ExampleConfig creates an example benchmark.config file.
+func (config *BenchmarkConfig) ExampleConfig() string {
+	return `[benchmark.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The benchmark tool generates synthetic halos with a known splashback radius,
+# fits shells to them in the same way as the shell tool, and reports how long
+# each fit took and how far the volume-weighted splashback radius of each shell
+# is from the true one. No snapshots or halo catalogs are read, so it can be
+# used to check a new installation or to compare the speed of different
+# machines. Set RandomSeed in the global config file to generate the same halos
+# every time.
+#
+# Each halo has an NFW profile which is steepened by the transition term of
+# Diemer & Kravtsov (2014), [1 + (r/r_t)^4]^-2, and embedded in their
+# power-law outer profile and the mean density of the universe. Its true
+# splashback radius is the radius where the logarithmic slope of this profile
+# is steepest.
+
+# Halos is the number of synthetic halos. Defaults to 10.
+#
+# Halos = 10
+
+# Particles is the number of particles within R200m of each halo. Defaults to
+# 100000.
+#
+# Particles = 100000
+
+# M200m is the mass of each halo in Msun/h. Since the profile is self-similar,
+# this only sets the scale of the halos. Defaults to 1e14.
+#
+# M200m = 1e14
+
+# Concentration is R200m / r_s of the NFW profile. Defaults to 7.
+#
+# Concentration = 7
+
+# TransitionRadiusMult is r_t, the radius where the profile steepens, in units
+# of R200m. Defaults to 1.3.
+#
+# TransitionRadiusMult = 1.3
+
+# MonteCarloSamples is the number of samples used to measure the volume of
+# each shell. Defaults to 50000.
+#
+# MonteCarloSamples = 50000
+
+# The shells are fit using the variables in the [shell.config] section of this
+# file, or the shell tool's defaults if there isn't one. Only Penna-Dines fits
+# are supported, so Ellipsoid, PercentileProfile, and FitBasis = harmonic can't
+# be used.
+#
+# [shell.config]
+# Spokes = 256
+# Rings = 100`
+}
+
+// ReadConfig reads in a benchmark.config file into config, along with its
+// [shell.config] section.
+func (config *BenchmarkConfig) ReadConfig(
+	fname string, flags []string,
+) error {
+	vars := parse.NewConfigVars("benchmark.config")
+	vars.Int(&config.halos, "Halos", 10)
+	vars.Int(&config.particles, "Particles", 100*1000)
+	vars.Float(&config.m200m, "M200m", 1e14)
+	vars.Float(&config.concentration, "Concentration", 7)
+	vars.Float(&config.transitionMult, "TransitionRadiusMult", 1.3)
+	vars.Int(&config.monteCarloSamples, "MonteCarloSamples", 50*1000)
+
+	config.shell = &ShellConfig{}
+
+	if fname == "" {
+		if err := config.shell.ReadConfig("", nil); err != nil {
+			return err
+		}
+		if len(flags) == 0 {
+			return config.validate()
+		}
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	ok, err := parse.HasSection(fname, "shell.config")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		err = config.shell.ReadConfig("", nil)
+	} else {
+		err = config.shell.ReadConfig(fname, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading the [shell.config] section of "+
+			"%s:\n%s", fname, err.Error())
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *BenchmarkConfig) validate() error {
+	switch {
+	case config.halos <= 0:
+		return fmt.Errorf("The 'Halos' variable is set to %d, but it needs "+
+			"to be positive.", config.halos)
+	case config.particles <= 0:
+		return fmt.Errorf("The 'Particles' variable is set to %d, but it "+
+			"needs to be positive.", config.particles)
+	case config.m200m <= 0:
+		return fmt.Errorf("The 'M200m' variable is set to %g, but it needs "+
+			"to be positive.", config.m200m)
+	case config.concentration <= 0:
+		return fmt.Errorf("The 'Concentration' variable is set to %g, but "+
+			"it needs to be positive.", config.concentration)
+	case config.transitionMult <= 0:
+		return fmt.Errorf("The 'TransitionRadiusMult' variable is set to "+
+			"%g, but it needs to be positive.", config.transitionMult)
+	case config.monteCarloSamples <= 0:
+		return fmt.Errorf("The 'MonteCarloSamples' variable is set to %d, "+
+			"but it needs to be positive.", config.monteCarloSamples)
+	}
+
+	s := config.shell
+	if s.ellipsoid || s.percentileProfile || s.fitBasis == "harmonic" {
+		return fmt.Errorf("The benchmark tool only fits Penna-Dines " +
+			"shells, so Ellipsoid, PercentileProfile, and FitBasis = " +
+			"harmonic can't be used in its [shell.config] section.")
+	}
+	return nil
+}
+
+// Run executes the benchmark mode of the shellfish tool.
+func (config *BenchmarkConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#########################
+## shellfish benchmark ##
+#########################`,
+		)
+		log.Println("RNG Seed is", randSeed)
+	}
+	t := time.Now()
+
+	p, err := config.profile()
+	if err != nil {
+		return nil, err
+	}
+	r200m := p.r200m
+	s := config.shell
+	rspTrue, ok := steepestSlopeRadius(
+		p.slope, s.rMinMult*r200m, s.rMaxMult*r200m,
+	)
+	if !ok {
+		return nil, fmt.Errorf("The synthetic profile's slope is steepest "+
+			"at the edge of the range searched by the shell tool, %g to %g "+
+			"R200m.", s.rMinMult, s.rMaxMult)
+	}
+
+	rOut := (s.rMaxMult + s.rKernelMult) * r200m
+	mp := config.m200m / float64(config.particles)
+	params := s.shellParams(s.shellDefinition == "minimum")
+	samples := int(config.monteCarloSamples)
+
+	n := int(config.halos)
+	ids := make([]int, n)
+	particles := make([]int, n)
+	rsps, times := make([]float64, n), make([]float64, n)
+	for i := range ids {
+		ids[i] = i
+	}
+
+	workers := runtime.NumCPU()
+	if gConfig.Threads > 0 {
+		workers = int(gConfig.Threads)
+	}
+	if workers > n {
+		workers = n
+	}
+
+	lg := NewLockGroup(workers)
+	for w := 0; w < workers; w++ {
+		go func(lock *Lock) {
+			for i := lock.Idx; i < n; i += lock.Workers {
+				seed := haloSeed(randSeed, i, 0)
+				xs, ms := p.particles(rOut, mp, seed)
+				particles[i] = len(xs)
+
+				tFit := time.Now()
+				shell, err := lib.FitShell(
+					xs, ms, [3]float64{}, r200m, 0, seed+1, params,
+				)
+				if err != nil {
+					rsps[i] = math.NaN()
+				} else {
+					vol := shell.Volume(samples)
+					rsps[i] = math.Cbrt(vol / (4 * math.Pi / 3))
+				}
+				times[i] = time.Since(tFit).Seconds()
+
+				if logging.Mode == logging.Debug {
+					log.Printf("Halo %3d: %d particles, R_sp = %.4g, "+
+						"%.3g s", i, len(xs), rsps[i], times[i])
+				}
+			}
+			lock.Unlock()
+		}(lg.Lock(w))
+	}
+	lg.Synchronize()
+
+	lines := benchmarkCatalog(
+		ids, particles, r200m, rspTrue, rsps, times, workers,
+		time.Since(t).Seconds(),
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return lines, nil
+}
+
+// benchmarkCatalog returns the lines of the benchmark tool's output catalog.
+// The header summarizes the accuracy and timing of every fit.
+func benchmarkCatalog(
+	ids, particles []int, r200m, rspTrue float64, rsps, times []float64,
+	threads int, total float64,
+) []string {
+	n := len(ids)
+	r200ms, rspTrues := make([]float64, n), make([]float64, n)
+	errs, absErrs := make([]float64, n), []float64{}
+	fitTime, failed := 0.0, 0
+	for i := range ids {
+		r200ms[i], rspTrues[i] = r200m, rspTrue
+		errs[i] = rsps[i]/rspTrue - 1
+		fitTime += times[i]
+		if math.IsNaN(rsps[i]) {
+			failed++
+		} else {
+			absErrs = append(absErrs, math.Abs(errs[i]))
+		}
+	}
+
+	medianErr := math.NaN()
+	if len(absErrs) > 0 {
+		sort.Float64s(absErrs)
+		medianErr = absErrs[len(absErrs)/2]
+	}
+
+	order := []int{0, 1, 2, 3, 4, 5, 6}
+	lines := catalog.FormatCols(
+		[][]int{ids, particles},
+		[][]float64{r200ms, rspTrues, rsps, errs, times}, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Particles"},
+		[]string{
+			"R200m [cMpc/h]", "R_sp_true [cMpc/h]", "R_sp [cMpc/h]",
+			"R_sp_err", "Time [s]",
+		},
+		order, []int{1, 1, 1, 1, 1, 1, 1},
+	)
+
+	header := []string{
+		catalog.UnitsString(comovingUnits),
+		fmt.Sprintf("# Threads: %d", threads),
+		fmt.Sprintf("# Total time: %.4g s", total),
+		fmt.Sprintf("# Mean fit time: %.4g s", fitTime/float64(n)),
+		fmt.Sprintf("# Median |R_sp_err|: %.4g", medianErr),
+		fmt.Sprintf("# Failed fits: %d", failed),
+		cString,
+	}
+	return append(header, lines...)
+}
+
+// benchmarkProfile is the density profile of the benchmark tool's synthetic
+// halos: an NFW profile which is steepened by the transition term of Diemer &
+// Kravtsov (2014) and added to their outer profile. Radii are comoving and
+// rhoM is the comoving mean density.
+type benchmarkProfile struct {
+	rhoS, rS, rT, beta, gamma float64
+	bE, sE, rhoM, r200m       float64
+}
+
+// benchmarkRMinMult is the smallest radius, in units of R200m, that synthetic
+// particles are placed at. The mass inside it is negligible.
+const benchmarkRMinMult = 1e-4
+
+// profile returns the profile of the synthetic halos described by config,
+// normalized so that the mass within R200m is M200m.
+func (config *BenchmarkConfig) profile() (*benchmarkProfile, error) {
+	// Only the ratios of the cosmological parameters to one another matter,
+	// so typical values are used.
+	rhoM := cosmo.RhoAverage(70, 0.27, 0.73, 0)
+	r200m := math.Cbrt(config.m200m / (200 * rhoM * 4 * math.Pi / 3))
+
+	p := &benchmarkProfile{
+		rhoS: 1, rS: r200m / config.concentration,
+		rT: config.transitionMult * r200m, beta: 4, gamma: 8,
+		bE: 1, sE: 1.5, rhoM: rhoM, r200m: r200m,
+	}
+
+	rs := lib.LogEdges(benchmarkRMinMult*r200m, r200m, 1000)
+	inner, outer := p.enclosedMasses(rs)
+	mIn, mOut := inner[len(rs)-1], outer[len(rs)-1]
+	if mOut >= config.m200m {
+		return nil, fmt.Errorf("The outer profile contains more mass than " +
+			"M200m within R200m.")
+	}
+	p.rhoS = (config.m200m - mOut) / mIn
+	return p, nil
+}
+
+// innerRho returns the steepened NFW term of the profile at r.
+func (p *benchmarkProfile) innerRho(r float64) float64 {
+	x := r / p.rS
+	return p.rhoS / (x * (1 + x) * (1 + x)) *
+		math.Pow(1+math.Pow(r/p.rT, p.beta), -p.gamma/p.beta)
+}
+
+// outerRho returns the outer term of the profile at r.
+func (p *benchmarkProfile) outerRho(r float64) float64 {
+	return p.rhoM * (p.bE*math.Pow(r/(5*p.r200m), -p.sE) + 1)
+}
+
+// rho returns the density of the profile at r.
+func (p *benchmarkProfile) rho(r float64) float64 {
+	return p.innerRho(r) + p.outerRho(r)
+}
+
+// slope returns the logarithmic slope of the profile, dln(rho)/dln(r), at r.
+func (p *benchmarkProfile) slope(r float64) float64 {
+	x, xt := r/p.rS, math.Pow(r/p.rT, p.beta)
+	inner, outer := p.innerRho(r), p.outerRho(r)
+	dInner := inner * (-1 - 2*x/(1+x) - p.gamma*xt/(1+xt))
+	dOuter := -p.sE * (outer - p.rhoM)
+	return (dInner + dOuter) / (inner + outer)
+}
+
+// enclosedMasses returns the mass of the inner and outer terms of the profile
+// between rs[0] and each radius in rs, which must be increasing.
+func (p *benchmarkProfile) enclosedMasses(rs []float64) (inner, outer []float64) {
+	inner, outer = make([]float64, len(rs)), make([]float64, len(rs))
+	for i := 1; i < len(rs); i++ {
+		r0, r1 := rs[i-1], rs[i]
+		dlr := math.Log(r1 / r0)
+		w0 := 4 * math.Pi * r0 * r0 * r0 * dlr / 2
+		w1 := 4 * math.Pi * r1 * r1 * r1 * dlr / 2
+		inner[i] = inner[i-1] + w0*p.innerRho(r0) + w1*p.innerRho(r1)
+		outer[i] = outer[i-1] + w0*p.outerRho(r0) + w1*p.outerRho(r1)
+	}
+	return inner, outer
+}
+
+// particles samples particles of mass mp from the profile out to rOut around
+// the origin. Their number is chosen so that their total mass matches the
+// mass of the profile.
+func (p *benchmarkProfile) particles(
+	rOut, mp float64, seed uint64,
+) ([][3]float32, []float32) {
+	rs := lib.LogEdges(benchmarkRMinMult*p.r200m, rOut, 2000)
+	inner, outer := p.enclosedMasses(rs)
+	cdf := make([]float64, len(rs))
+	for i := range cdf {
+		cdf[i] = inner[i] + outer[i]
+	}
+	mTot := cdf[len(cdf)-1]
+
+	gen := rand.New(rand.Xorshift, seed)
+	n := int(mTot/mp + 0.5)
+	xs, ms := make([][3]float32, n), make([]float32, n)
+	for i := range xs {
+		m := gen.Uniform(0, mTot)
+		j := sort.SearchFloat64s(cdf, m)
+		if j == 0 {
+			j = 1
+		} else if j == len(cdf) {
+			j = len(cdf) - 1
+		}
+		f := (m - cdf[j-1]) / (cdf[j] - cdf[j-1])
+		r := rs[j-1] * math.Pow(rs[j]/rs[j-1], f)
+
+		// Isotropic directions.
+		z := gen.Uniform(-1, +1)
+		phi := gen.Uniform(0, 2*math.Pi)
+		rxy := r * math.Sqrt(1-z*z)
+		xs[i] = [3]float32{
+			float32(rxy * math.Cos(phi)), float32(rxy * math.Sin(phi)),
+			float32(r * z),
+		}
+		ms[i] = float32(mp)
+	}
+	return xs, ms
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/lib"
+)
+
+func TestBenchmarkProfile(t *testing.T) {
+	config := &BenchmarkConfig{
+		m200m: 1e14, concentration: 7, transitionMult: 1.3, particles: 20000,
+	}
+	p, err := config.profile()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	rs := lib.LogEdges(benchmarkRMinMult*p.r200m, p.r200m, 1000)
+	inner, outer := p.enclosedMasses(rs)
+	m := inner[len(rs)-1] + outer[len(rs)-1]
+	if math.Abs(m/config.m200m-1) > 1e-6 {
+		t.Errorf("Expected M(<R200m) = %g, got %g.", config.m200m, m)
+	}
+
+	eps := 1e-5
+	for _, x := range []float64{0.1, 0.5, 1, 2} {
+		r := x * p.r200m
+		num := (math.Log(p.rho(r*(1+eps))) -
+			math.Log(p.rho(r*(1-eps)))) / (2 * eps)
+		if math.Abs(num-p.slope(r)) > 1e-4 {
+			t.Errorf("Expected slope(%g R200m) = %g, got %g.",
+				x, num, p.slope(r))
+		}
+	}
+
+	rsp, ok := steepestSlopeRadius(p.slope, 0.3*p.r200m, 3*p.r200m)
+	if !ok || rsp < p.r200m || rsp > 2*p.r200m {
+		t.Errorf("Expected R_sp between R200m and 2 R200m, got %g R200m.",
+			rsp/p.r200m)
+	}
+
+	mp := config.m200m / float64(config.particles)
+	xs, _ := p.particles(3*p.r200m, mp, 1)
+	n := 0
+	for _, x := range xs {
+		r := math.Sqrt(float64(x[0]*x[0] + x[1]*x[1] + x[2]*x[2]))
+		if r > 3*p.r200m {
+			t.Fatalf("Particle at %g R200m is outside 3 R200m.", r/p.r200m)
+		}
+		if r < p.r200m {
+			n++
+		}
+	}
+	if math.Abs(float64(n)/float64(config.particles)-1) > 0.03 {
+		t.Errorf("Expected %d particles within R200m, got %d.",
+			config.particles, n)
+	}
+}
+
+func TestBenchmarkCatalog(t *testing.T) {
+	lines := benchmarkCatalog(
+		[]int{0, 1, 2}, []int{10, 20, 30}, 1, 2,
+		[]float64{2.2, math.NaN(), 1.9}, []float64{1, 2, 3}, 4, 7,
+	)
+
+	expected := []string{
+		"# Units: cMpc/h",
+		"# Threads: 4",
+		"# Total time: 7 s",
+		"# Mean fit time: 2 s",
+		"# Median |R_sp_err|: 0.1",
+		"# Failed fits: 1",
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("Expected line %d to be %q, got %q.",
+				i, expected[i], lines[i])
+		}
+	}
+	if len(lines) != len(expected)+4 {
+		t.Fatalf("Expected %d lines, got %d.", len(expected)+4, len(lines))
+	}
+	if !strings.Contains(lines[len(expected)], "R_sp_err(5)") {
+		t.Errorf("Expected an R_sp_err column, got %q.", lines[len(expected)])
+	}
+}
+
+func TestBenchmarkConfigRejectsEllipsoids(t *testing.T) {
+	config := &BenchmarkConfig{}
+	if err := config.ReadConfig("", nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	config.shell.ellipsoid = true
+	if err := config.validate(); err == nil {
+		t.Errorf("Expected an error for an ellipsoid fit.")
+	}
+}
@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// CacheConfig contains the configuration fields for the 'cache' mode of the
+// shellfish tool.
+type CacheConfig struct {
+	operation string
+	snaps     []int64
+}
+
+var _ Mode = &CacheConfig{}
+
+// ExampleConfig creates an example cache.config file.
+func (config *CacheConfig) ExampleConfig() string {
+	return `[cache.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The cache tool inspects and cleans up the files that Shellfish has cached in
+# the global config's MemoDir. These are copies of snapshot headers and halo
+# catalogs, and can grow to hundreds of GB for large simulations. Deleting them
+# is always safe: they're recreated the next time they're needed.
+
+# Operation is one of:
+#
+# list  - Prints the number of files and bytes of each kind for every
+#         snapshot in MemoDir. Files which don't belong to any snapshot
+#         (including memo.config) are counted in a row with Snapshot = -1.
+# size  - Prints the same columns, summed over every snapshot.
+# clear - Deletes the cached files of the snapshots in Snaps, and prints the
+#         same columns as list for the deleted files. If Snaps isn't set,
+#         every cached file and memo.config are deleted, so MemoDir can be
+#         used with a different global config file. Files which Shellfish
+#         didn't create are never deleted.
+#
+# Defaults to list.
+#
+# Operation = list
+
+# Snaps restricts list and clear to the given snapshots. Defaults to every
+# snapshot.
+#
+# Snaps = 90, 100`
+}
+
+// ReadConfig reads in a cache.config file into config.
+func (config *CacheConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("cache.config")
+	vars.String(&config.operation, "Operation", "list")
+	vars.Ints(&config.snaps, "Snaps", []int64{})
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *CacheConfig) validate() error {
+	switch config.operation {
+	case "list", "size", "clear":
+	default:
+		return fmt.Errorf("The 'Operation' variable is set to '%s', but "+
+			"the only valid operations are list, size, and clear.",
+			config.operation)
+	}
+	return nil
+}
+
+// Run executes the cache mode of the shellfish tool.
+func (config *CacheConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#####################
+## shellfish cache ##
+#####################`,
+		)
+	}
+
+	files, err := memo.CacheFiles(gConfig.MemoDir)
+	if err != nil {
+		return nil, err
+	}
+	files = config.selectFiles(files)
+
+	if config.operation == "clear" {
+		removed := []memo.CacheFile{}
+		for _, f := range files {
+			if f.Kind != memo.OtherFile || isMemoConfig(f, gConfig.MemoDir) {
+				removed = append(removed, f)
+			} else if logging.Mode != logging.Nil {
+				log.Printf("Leaving %s, which wasn't created by Shellfish.",
+					f.Path)
+			}
+		}
+		if err := memo.RemoveCacheFiles(removed); err != nil {
+			return nil, err
+		}
+		files = removed
+	}
+
+	sizes := cacheSizes(files)
+	if config.operation == "size" {
+		total := &cacheSize{}
+		for _, s := range sizes {
+			total.add(s)
+		}
+		return total.format(gConfig.MemoDir), nil
+	}
+	return formatCacheSizes(gConfig.MemoDir, sizes), nil
+}
+
+// selectFiles returns the files which belong to config's snapshots. If no
+// snapshots are given, every file is returned.
+func (config *CacheConfig) selectFiles(
+	files []memo.CacheFile,
+) []memo.CacheFile {
+	if len(config.snaps) == 0 {
+		return files
+	}
+
+	snaps := map[int]bool{}
+	for _, snap := range config.snaps {
+		snaps[int(snap)] = true
+	}
+	out := []memo.CacheFile{}
+	for _, f := range files {
+		if snaps[f.Snap] {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// isMemoConfig returns true if f is the copy of the global config which
+// Shellfish keeps in memoDir, or its lock file.
+func isMemoConfig(f memo.CacheFile, memoDir string) bool {
+	return memo.BasePath(path.Clean(f.Path)) ==
+		path.Join(memoDir, "memo.config")
+}
+
+// cacheSize is the number of files and bytes of each kind in MemoDir which
+// belong to a single snapshot.
+type cacheSize struct {
+	snap                   int
+	files                  int
+	headers, halos, others int64
+}
+
+// add adds the files and bytes in s to size.
+func (size *cacheSize) add(s *cacheSize) {
+	size.files += s.files
+	size.headers += s.headers
+	size.halos += s.halos
+	size.others += s.others
+}
+
+// total returns the number of bytes of every kind.
+func (size *cacheSize) total() int64 {
+	return size.headers + size.halos + size.others
+}
+
+// cacheSizes returns the size of each snapshot in files, in order.
+func cacheSizes(files []memo.CacheFile) []*cacheSize {
+	bySnap := map[int]*cacheSize{}
+	for _, f := range files {
+		s, ok := bySnap[f.Snap]
+		if !ok {
+			s = &cacheSize{snap: f.Snap}
+			bySnap[f.Snap] = s
+		}
+		s.files++
+		switch f.Kind {
+		case memo.HeaderFile:
+			s.headers += f.Bytes
+		case memo.HaloFile:
+			s.halos += f.Bytes
+		default:
+			s.others += f.Bytes
+		}
+	}
+
+	sizes := []*cacheSize{}
+	for _, s := range bySnap {
+		sizes = append(sizes, s)
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i].snap < sizes[j].snap
+	})
+	return sizes
+}
+
+// cacheColumnNames are the names of the columns written by the cache tool,
+// other than Snapshot.
+var cacheColumnNames = []string{
+	"Files", "Header_Bytes", "Halo_Bytes", "Other_Bytes", "Total_Bytes",
+}
+
+// formatCacheSizes returns the lines of a catalog with one row for each
+// snapshot's size.
+func formatCacheSizes(memoDir string, sizes []*cacheSize) []string {
+	total := &cacheSize{}
+	cols := make([][]int, 1+len(cacheColumnNames))
+	for _, s := range sizes {
+		total.add(s)
+		row := []int{
+			s.snap, s.files, int(s.headers), int(s.halos), int(s.others),
+			int(s.total()),
+		}
+		for k := range cols {
+			cols[k] = append(cols[k], row[k])
+		}
+	}
+
+	order := make([]int, len(cols))
+	colSizes := make([]int, len(cols))
+	for i := range order {
+		order[i], colSizes[i] = i, 1
+	}
+	lines := catalog.FormatCols(cols, [][]float64{}, order)
+	cString := catalog.CommentString(
+		append([]string{"Snapshot"}, cacheColumnNames...), []string{},
+		order, colSizes,
+	)
+	return append([]string{total.summary(memoDir), cString}, lines...)
+}
+
+// format returns the lines of a catalog with a single row containing size.
+func (size *cacheSize) format(memoDir string) []string {
+	row := []int{
+		size.files, int(size.headers), int(size.halos), int(size.others),
+		int(size.total()),
+	}
+	cols := make([][]int, len(row))
+	order := make([]int, len(row))
+	colSizes := make([]int, len(row))
+	for i := range row {
+		cols[i], order[i], colSizes[i] = []int{row[i]}, i, 1
+	}
+
+	lines := catalog.FormatCols(cols, [][]float64{}, order)
+	cString := catalog.CommentString(
+		cacheColumnNames, []string{}, order, colSizes,
+	)
+	return append([]string{size.summary(memoDir), cString}, lines...)
+}
+
+// summary returns a comment line describing the total size in a readable
+// form.
+func (size *cacheSize) summary(memoDir string) string {
+	return fmt.Sprintf("# %s: %d files, %s", memoDir, size.files,
+		formatBytes(size.total()))
+}
+
+// formatBytes returns a number of bytes with a readable unit.
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	x, i := float64(n), 0
+	for x >= 1000 && i < len(units)-1 {
+		x /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.3g %s", x, units[i])
+}
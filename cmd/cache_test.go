@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+)
+
+func TestCacheSizes(t *testing.T) {
+	files := []memo.CacheFile{
+		{Path: "a", Snap: 100, Kind: memo.HaloFile, Bytes: 10},
+		{Path: "b", Snap: -1, Kind: memo.OtherFile, Bytes: 1},
+		{Path: "c", Snap: 90, Kind: memo.HeaderFile, Bytes: 2},
+		{Path: "d", Snap: 100, Kind: memo.HeaderFile, Bytes: 3},
+	}
+	lines := formatCacheSizes("memo", cacheSizes(files))
+	expected := []string{
+		"# memo: 4 files, 16 B",
+		"# Column contents: Snapshot(0) Files(1) Header_Bytes(2) " +
+			"Halo_Bytes(3) Other_Bytes(4) Total_Bytes(5)",
+		" -1 1 0  0 1  1",
+		" 90 1 2  0 0  2",
+		"100 2 3 10 0 13",
+	}
+	if !stringSlicesEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q.", expected, lines)
+	}
+
+	config := &CacheConfig{snaps: []int64{100}}
+	if selected := config.selectFiles(files); len(selected) != 2 ||
+		selected[0].Path != "a" || selected[1].Path != "d" {
+		t.Errorf("Expected files a and d for snapshot 100, got %v.", selected)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0 B"},
+		{999, "999 B"},
+		{1500, "1.5 KB"},
+		{250e9, "250 GB"},
+		{3e15, "3e+03 TB"},
+	}
+	for i := range tests {
+		if s := formatBytes(tests[i].n); s != tests[i].expected {
+			t.Errorf("%d) Expected formatBytes(%d) = %s, got %s.",
+				i, tests[i].n, tests[i].expected, s)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"strconv"
 	"bytes"
+	"regexp"
 	"strings"
 	"runtime"
 )
@@ -49,6 +50,83 @@ func CommentString(
 	return strings.Join(orderedTokens, " ")
 }
 
+// ColumnIndex returns the index of the column with the given name, as listed
+// in a comment line created by CommentString. If there is no such column, -1
+// is returned. Only single-element columns are supported.
+func ColumnIndex(data []byte, name string) int {
+	prefix := []byte("# Column contents:")
+	target := name + "("
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if !bytes.HasPrefix(line, prefix) {
+			continue
+		}
+		for _, tok := range strings.Fields(string(line[len(prefix):])) {
+			if !strings.HasPrefix(tok, target) ||
+				!strings.HasSuffix(tok, ")") {
+				continue
+			}
+			idx, err := strconv.Atoi(tok[len(target) : len(tok)-1])
+			if err == nil {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+// Column is a named group of columns listed in a comment line created by
+// CommentString. It covers the columns from Start to End, inclusive.
+type Column struct {
+	Name       string
+	Start, End int
+}
+
+// columnPattern matches a single column in a "# Column contents:" line.
+// Names can contain spaces, like "R_sp [cMpc/h](2)".
+var columnPattern = regexp.MustCompile(`\s*([^()]+?)\((\d+)(?:-(\d+))?\)`)
+
+// Columns returns every column listed in a comment line created by
+// CommentString, in order. If there is no such line, nil is returned.
+func Columns(data []byte) []Column {
+	prefix := []byte("# Column contents:")
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if !bytes.HasPrefix(line, prefix) {
+			continue
+		}
+
+		cols := []Column{}
+		contents := string(line[len(prefix):])
+		for _, m := range columnPattern.FindAllStringSubmatch(contents, -1) {
+			start, _ := strconv.Atoi(m[2])
+			end := start
+			if m[3] != "" {
+				end, _ = strconv.Atoi(m[3])
+			}
+			cols = append(cols, Column{m[1], start, end})
+		}
+		return cols
+	}
+	return nil
+}
+
+// UnitsString returns a comment line which records the units that the
+// lengths and masses of a catalog are written in.
+func UnitsString(units string) string {
+	return "# Units: " + units
+}
+
+// Units returns the units listed in a comment line created by UnitsString. If
+// there is no such line, "" is returned.
+func Units(data []byte) string {
+	prefix := []byte("# Units:")
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if bytes.HasPrefix(line, prefix) {
+			return strings.TrimSpace(string(line[len(prefix):]))
+		}
+	}
+	return ""
+}
+
 func FormatCols(intCols [][]int, floatCols [][]float64, order []int) []string {
 	if (len(intCols) == 0 && len(floatCols) == 0) ||
 		(len(intCols) > 0 && len(intCols[0]) == 0) ||
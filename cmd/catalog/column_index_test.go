@@ -0,0 +1,34 @@
+package catalog
+
+import (
+	"testing"
+)
+
+func TestColumnIndex(t *testing.T) {
+	data := []byte(`# Column contents: ID(0) Snapshot(1) X [cMpc/h](2) P_ijk(3-10) Seed(11)
+1 100 2.0 0 0 0 0 0 0 0 0 12345
+`)
+	tests := []struct {
+		name string
+		idx  int
+	}{
+		{"ID", 0},
+		{"Snapshot", 1},
+		{"Seed", 11},
+		{"P_ijk", -1},
+		{"Mass", -1},
+		{"Snap", -1},
+	}
+
+	for i, test := range tests {
+		idx := ColumnIndex(data, test.name)
+		if idx != test.idx {
+			t.Errorf("%d) Expected %d for %s, got %d.",
+				i, test.idx, test.name, idx)
+		}
+	}
+
+	if idx := ColumnIndex([]byte("1 100 12345\n"), "Seed"); idx != -1 {
+		t.Errorf("Expected -1 without a header, got %d.", idx)
+	}
+}
@@ -0,0 +1,30 @@
+package catalog
+
+import (
+	"testing"
+)
+
+func TestColumns(t *testing.T) {
+	data := []byte(`# Units: cMpc/h
+# Column contents: ID(0) Snapshot(1) R_sp [cMpc/h](2) P_ijk(3-10) B/A(11)
+1 100 2.0 0 0 0 0 0 0 0 0 0.5
+`)
+	expected := []Column{
+		{"ID", 0, 0}, {"Snapshot", 1, 1}, {"R_sp [cMpc/h]", 2, 2},
+		{"P_ijk", 3, 10}, {"B/A", 11, 11},
+	}
+
+	cols := Columns(data)
+	if len(cols) != len(expected) {
+		t.Fatalf("Expected %v, got %v.", expected, cols)
+	}
+	for i := range cols {
+		if cols[i] != expected[i] {
+			t.Errorf("%d) Expected %v, got %v.", i, expected[i], cols[i])
+		}
+	}
+
+	if cols := Columns([]byte("1 100 2.0\n")); cols != nil {
+		t.Errorf("Expected nil for a catalog without a header, got %v.", cols)
+	}
+}
@@ -0,0 +1,25 @@
+package catalog
+
+import (
+	"testing"
+)
+
+func TestUnits(t *testing.T) {
+	tests := []struct {
+		data  string
+		units string
+	}{
+		{UnitsString("pMpc") + "\n# Column contents: ID(0)\n1\n", "pMpc"},
+		{"# Column contents: ID(0)\n" + UnitsString("cMpc/h") + "\n1\n",
+			"cMpc/h"},
+		{"# Column contents: ID(0)\n1\n", ""},
+		{"", ""},
+	}
+
+	for i, test := range tests {
+		units := Units([]byte(test.data))
+		if units != test.units {
+			t.Errorf("%d) Expected '%s', got '%s'.", i, test.units, units)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/cosmo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/los/geom"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// CausticConfig contains the configuration fields for the 'caustic' mode of
+// the shellfish tool.
+type CausticConfig struct {
+	spokes, radialBins int64
+	rMinMult, rMaxMult float64
+	vrThreshold        float64
+}
+
+var _ Mode = &CausticConfig{}
+
+// ExampleConfig creates an example caustic.config file.
+func (config *CausticConfig) ExampleConfig() string {
+	return `[caustic.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The caustic tool estimates the splashback radius in velocity space. The
+# particles around each halo are split into lines of sight, and along each line
+# of sight the mass-weighted mean radial velocity (including the Hubble flow)
+# is found as a function of radius. Moving outwards, the radius where this
+# profile first drops below VrThreshold marks the edge of the infall region.
+# The splashback radius is the median of this radius over all lines of sight.
+
+# Spokes is the number of lines of sight used for each halo. Defaults to 100.
+#
+# Spokes = 100
+
+# RadialBins is the number of logarithmic radial bins along each line of sight.
+# Defaults to 32.
+#
+# RadialBins = 32
+
+# RMinMult and RMaxMult are the minimum and maximum radii of each line of sight
+# in units of R200m. Default to 0.5 and 3.
+#
+# RMinMult = 0.5
+# RMaxMult = 3
+
+# VrThreshold is the mean radial velocity which marks the edge of the infall
+# region in units of V200m. Defaults to -0.25.
+#
+# VrThreshold = -0.25`
+}
+
+// ReadConfig reads in a caustic.config file into config.
+func (config *CausticConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("caustic.config")
+	vars.Int(&config.spokes, "Spokes", 100)
+	vars.Int(&config.radialBins, "RadialBins", 32)
+	vars.Float(&config.rMinMult, "RMinMult", 0.5)
+	vars.Float(&config.rMaxMult, "RMaxMult", 3)
+	vars.Float(&config.vrThreshold, "VrThreshold", -0.25)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *CausticConfig) validate() error {
+	if config.spokes <= 0 {
+		return fmt.Errorf("The 'Spokes' variable is set to %d, but it "+
+			"needs to be positive.", config.spokes)
+	}
+	if config.radialBins <= 1 {
+		return fmt.Errorf("The 'RadialBins' variable is set to %d, but it "+
+			"needs to be larger than 1.", config.radialBins)
+	}
+	if config.rMinMult <= 0 {
+		return fmt.Errorf("The 'RMinMult' variable is set to %g, but it "+
+			"needs to be positive.", config.rMinMult)
+	}
+	if config.rMaxMult <= config.rMinMult {
+		return fmt.Errorf("The 'RMaxMult' variable is set to %g, but it "+
+			"needs to be larger than 'RMinMult', %g.",
+			config.rMaxMult, config.rMinMult)
+	}
+	return nil
+}
+
+// causticParticles holds the particles around a single halo. Positions are
+// relative to the halo center.
+type causticParticles struct {
+	dxs, vs [][3]float32
+	ms      []float32
+}
+
+// Run executes the caustic mode of the shellfish tool.
+func (config *CausticConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#######################
+## shellfish caustic ##
+#######################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, coords, err := catalog.Parse(
+		stdin, []int{0, 1}, []int{2, 3, 4, 5},
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = readInputUnits(
+		stdin, snaps, coords, repeatKind(lengthUnit, 4), buf, e,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := normVecs(int(config.spokes), randSeed)
+	rsps := make([]float64, len(ids))
+	ratios := make([]float64, len(ids))
+	counts := make([]int, len(ids))
+	for i := range rsps {
+		rsps[i], ratios[i] = math.NaN(), math.NaN()
+	}
+
+	_, idxBins := binBySnap(snaps, ids)
+	for snap, idxs := range idxBins {
+		if snap == -1 {
+			continue
+		}
+
+		spheres := make([]geom.Sphere, len(idxs))
+		for j, i := range idxs {
+			spheres[j] = geom.Sphere{
+				C: [3]float32{
+					float32(coords[0][i]), float32(coords[1][i]),
+					float32(coords[2][i]),
+				},
+				R: float32(coords[3][i] * config.rMaxMult),
+			}
+		}
+		ps, hd, err := causticSphereParticles(snap, spheres, buf, e)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, i := range idxs {
+			r200m := coords[3][i]
+			if r200m <= 0 {
+				continue
+			}
+			rsps[i], counts[i] = config.causticRadius(
+				ps[j], r200m, dirs, &hd.Cosmo,
+			)
+			ratios[i] = rsps[i] / r200m
+		}
+	}
+
+	order := []int{0, 1, 3, 4, 2}
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps, counts}, [][]float64{rsps, ratios}, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot", "Spokes"},
+		[]string{"R_sp [cMpc/h]", "R_sp/R200m"},
+		order, []int{1, 1, 1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
+
+// causticRadius returns the median velocity-space splashback radius of a
+// halo over every line of sight where it could be measured, along with the
+// number of such lines of sight.
+func (config *CausticConfig) causticRadius(
+	ps *causticParticles, r200m float64, dirs [][3]float32,
+	c *io.CosmologyHeader,
+) (float64, int) {
+	a := 1 / (1 + c.Z)
+	hubble := 100 * cosmo.HubbleFrac(c.OmegaM, c.OmegaL, c.Z)
+	v200m := 1000 * math.Sqrt(c.OmegaM*(1+c.Z)) * r200m
+
+	// The bulk velocity is the mean velocity of the particles inside R200m.
+	bulk, mTot := [3]float64{}, 0.0
+	for i, dx := range ps.dxs {
+		r2 := dx[0]*dx[0] + dx[1]*dx[1] + dx[2]*dx[2]
+		if float64(r2) < r200m*r200m {
+			for k := 0; k < 3; k++ {
+				bulk[k] += float64(ps.ms[i] * ps.vs[i][k])
+			}
+			mTot += float64(ps.ms[i])
+		}
+	}
+	if mTot > 0 {
+		for k := 0; k < 3; k++ {
+			bulk[k] /= mTot
+		}
+	}
+
+	rs := make([][]float64, len(dirs))
+	vrs := make([][]float64, len(dirs))
+	ms := make([][]float64, len(dirs))
+	for i, dx := range ps.dxs {
+		r := math.Sqrt(float64(dx[0]*dx[0] + dx[1]*dx[1] + dx[2]*dx[2]))
+		if r == 0 {
+			continue
+		}
+
+		// Assign each particle to the closest line of sight.
+		jMax, dotMax := 0, float32(math.Inf(-1))
+		for j, d := range dirs {
+			dot := dx[0]*d[0] + dx[1]*d[1] + dx[2]*d[2]
+			if dot > dotMax {
+				jMax, dotMax = j, dot
+			}
+		}
+
+		vr := 0.0
+		for k := 0; k < 3; k++ {
+			vr += (float64(ps.vs[i][k]) - bulk[k]) * float64(dx[k]) / r
+		}
+		vr += hubble * a * r
+
+		rs[jMax] = append(rs[jMax], r)
+		vrs[jMax] = append(vrs[jMax], vr)
+		ms[jMax] = append(ms[jMax], float64(ps.ms[i]))
+	}
+
+	radii := []float64{}
+	for j := range dirs {
+		r := halo.CausticRadius(
+			rs[j], vrs[j], ms[j], r200m*config.rMinMult,
+			r200m*config.rMaxMult, int(config.radialBins),
+			config.vrThreshold*v200m,
+		)
+		if !math.IsNaN(r) {
+			radii = append(radii, r)
+		}
+	}
+
+	if len(radii) == 0 {
+		return math.NaN(), 0
+	}
+	return percentile(radii, 50), len(radii)
+}
+
+// causticSphereParticles returns the positions relative to the center,
+// velocities, and masses of the particles inside each sphere in the given
+// snapshot, along with the snapshot's header.
+func causticSphereParticles(
+	snap int, spheres []geom.Sphere, buf io.VectorBuffer, e *env.Environment,
+) ([]*causticParticles, *io.Header, error) {
+	ps := make([]*causticParticles, len(spheres))
+	for i := range ps {
+		ps[i] = &causticParticles{}
+	}
+
+	hds, files, err := memo.ReadHeaders(snap, buf, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, intrIdxs := binSphereIntersections(hds, spheres)
+
+	for i := range hds {
+		if len(intrIdxs[i]) == 0 {
+			continue
+		}
+
+		xs, vs, ms, _, err := buf.Read(files[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		L := float32(hds[i].TotalWidth)
+
+		for _, si := range intrIdxs[i] {
+			s, p := spheres[si], ps[si]
+			r2Max := s.R * s.R
+			for j := range xs {
+				dx := [3]float32{
+					periodicDelta(xs[j][0]-s.C[0], L),
+					periodicDelta(xs[j][1]-s.C[1], L),
+					periodicDelta(xs[j][2]-s.C[2], L),
+				}
+				if dx[0]*dx[0]+dx[1]*dx[1]+dx[2]*dx[2] <= r2Max {
+					p.dxs = append(p.dxs, dx)
+					p.vs = append(p.vs, vs[j])
+					p.ms = append(p.ms, ms[j])
+				}
+			}
+		}
+		buf.Close()
+	}
+
+	return ps, &hds[0], nil
+}
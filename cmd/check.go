@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
 	"math"
 	"os"
+	"strings"
 
 	"github.com/phil-mansfield/shellfish/io"
 	"github.com/phil-mansfield/shellfish/parse"
@@ -19,6 +21,9 @@ type CheckConfig struct {
 	particleMasses []float64
 	particleCount int64
 	exampleHalo []float64
+
+	dryRun bool
+	configs []string
 }
 
 var _ Mode = &CheckConfig{}
@@ -54,6 +59,21 @@ func (config *CheckConfig) ExampleConfig() string {
 # not *unbound* masses.
 # Report position and radius to the highest accuracy that you know.
 # ExampleHalo = 100, 4.68299, 100.552, 80.9536, 2.68893, 1.446e+15
+
+# DryRun replaces the checks above with a quick validation of your setup that
+# doesn't do any computation. It reads every config file in Configs and
+# checks that every particle snapshot between SnapMin and SnapMax exists and
+# has a readable header, that every halo catalog exists and has enough columns
+# for HaloValueColumns, and that TreeDir contains merger trees. A summary is
+# printed and every problem that was found is listed. Run this before
+# submitting long jobs.
+# DryRun = false
+
+# Configs is a list of mode config files (e.g. my.shell.config) that are
+# checked when DryRun is true. The mode of each file is read from its header,
+# and pipeline and serve config files are checked along with every one of
+# their sections.
+# Configs = my.id.config, my.shell.config
 `
 }
 
@@ -68,6 +88,8 @@ func (config *CheckConfig) ReadConfig(fname string, flags []string) error {
 	vars.Floats(&config.particleMasses, "ParticleMasses", []float64{})
 	vars.Int(&config.particleCount, "ParticleCount", -1)
 	vars.Floats(&config.exampleHalo, "ExampleHalo", []float64{})
+	vars.Bool(&config.dryRun, "DryRun", false)
+	vars.Strings(&config.configs, "Configs", []string{})
 
 	if fname == "" {
 		if len(flags) == 0 { return nil }
@@ -91,6 +113,10 @@ func (config *CheckConfig) Run(
 	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
 ) ([]string, error) {
 
+	if config.dryRun {
+		return config.dryRunMain(gConfig, e)
+	}
+
 	failedTests := []string{}
 
 	buf, err := getVectorBuffer(
@@ -124,6 +150,220 @@ func (config *CheckConfig) Run(
 	return nil, nil
 }
 
+// dryRunMain checks that config files can be read and that every input file
+// exists without doing any computation. It returns a summary of the checks.
+func (config *CheckConfig) dryRunMain(
+	gConfig *GlobalConfig, e *env.Environment,
+) ([]string, error) {
+	summary, failedTests := []string{}, []string{}
+
+	summary, failedTests = checkConfigFiles(config.configs, summary, failedTests)
+	summary, failedTests = checkSnapshotFiles(
+		gConfig, e, summary, failedTests,
+	)
+	summary, failedTests = checkHaloFiles(gConfig, e, summary, failedTests)
+
+	if len(failedTests) > 0 {
+		for _, line := range summary {
+			fmt.Println(line)
+		}
+		if len(failedTests) == 1 {
+			fmt.Println("Dry run found 1 problem:")
+		} else {
+			fmt.Printf("Dry run found %d problems:\n", len(failedTests))
+		}
+
+		for _, test := range failedTests {
+			fmt.Println(test)
+		}
+		os.Exit(1)
+	}
+
+	return append(summary, "Dry run found no problems."), nil
+}
+
+// checkConfigFiles reads every mode config file in fnames.
+func checkConfigFiles(
+	fnames []string, summary, failedTests []string,
+) ([]string, []string) {
+	modes := 0
+	for _, fname := range fnames {
+		sections, err := parse.Sections(fname)
+		if err != nil {
+			failedTests = append(failedTests, err.Error())
+			continue
+		}
+
+		// Pipelines and servers read all the sections that they use
+		// themselves.
+		for _, section := range sections {
+			if section == "pipeline.config" || section == "serve.config" {
+				sections = []string{section}
+				break
+			}
+		}
+
+		for _, section := range sections {
+			mode, ok := ModeNames[strings.TrimSuffix(section, ".config")]
+			if !ok || !strings.HasSuffix(section, ".config") {
+				failedTests = append(failedTests, fmt.Sprintf(
+					"The config file %s has the header [%s], which doesn't "+
+						"belong to any mode.", fname, section,
+				))
+				continue
+			}
+
+			if err = mode.ReadConfig(fname, nil); err != nil {
+				failedTests = append(failedTests, err.Error())
+				continue
+			}
+			modes++
+		}
+	}
+
+	summary = append(summary, fmt.Sprintf(
+		"Config files: %d files, %d mode configs read.", len(fnames), modes,
+	))
+	return summary, failedTests
+}
+
+// checkSnapshotFiles checks that every particle snapshot file exists and has
+// a readable header.
+func checkSnapshotFiles(
+	gConfig *GlobalConfig, e *env.Environment, summary, failedTests []string,
+) ([]string, []string) {
+	snapMin, snapMax := int(gConfig.SnapMin), int(gConfig.SnapMax)
+	buf, err := getVectorBuffer(e.ParticleCatalog(snapMax, 0), gConfig)
+	if err != nil {
+		failedTests = append(failedTests, err.Error())
+		return summary, failedTests
+	}
+
+	files, missing := 0, 0
+	for snap := snapMin; snap <= snapMax; snap++ {
+		for b := 0; b < e.Blocks(); b++ {
+			fname := e.ParticleCatalog(snap, b)
+			files++
+
+			// ARTIO "file names" are file numbers.
+			if gConfig.SnapshotType != "ARTIO" {
+				if _, err := os.Stat(fname); err != nil {
+					missing++
+					failedTests = append(failedTests, fmt.Sprintf(
+						"Snapshot %d's particle file %s doesn't exist.",
+						snap, fname,
+					))
+					continue
+				}
+			}
+
+			hd := &io.Header{}
+			if err := buf.ReadHeader(fname, hd); err != nil {
+				missing++
+				failedTests = append(failedTests, fmt.Sprintf(
+					"Could not read the header of snapshot %d's particle "+
+						"file %s: %s", snap, fname, err.Error(),
+				))
+			}
+		}
+	}
+
+	summary = append(summary, fmt.Sprintf(
+		"Particle snapshots: %d snapshots, %d files, %d headers read.",
+		snapMax-snapMin+1, files, files-missing,
+	))
+	return summary, failedTests
+}
+
+// checkHaloFiles checks that every halo catalog exists and has enough columns
+// for HaloValueColumns, and that there are merger tree files.
+func checkHaloFiles(
+	gConfig *GlobalConfig, e *env.Environment, summary, failedTests []string,
+) ([]string, []string) {
+	if gConfig.HaloType == "nil" {
+		return append(summary, "Halo catalogs: HaloType is nil, skipped."),
+			failedTests
+	}
+
+	maxCol := -1
+	for _, col := range gConfig.HaloValueColumns {
+		if int(col) > maxCol {
+			maxCol = int(col)
+		}
+	}
+
+	files, width := 0, -1
+	for snap := int(gConfig.HSnapMin); snap <= int(gConfig.HSnapMax); snap++ {
+		fname := e.HaloCatalog(snap)
+		files++
+		if _, err := os.Stat(fname); err != nil {
+			failedTests = append(failedTests, fmt.Sprintf(
+				"Snapshot %d's halo catalog %s doesn't exist.", snap, fname,
+			))
+			continue
+		}
+		if gConfig.HaloType != "Text" {
+			continue
+		}
+
+		n, err := catalogWidth(fname)
+		if err != nil {
+			failedTests = append(failedTests, err.Error())
+			continue
+		}
+		width = n
+		if maxCol >= n {
+			failedTests = append(failedTests, fmt.Sprintf(
+				"HaloValueColumns contains column %d, but the halo catalog "+
+					"%s only has %d columns.", maxCol, fname, n,
+			))
+		}
+	}
+
+	line := fmt.Sprintf("Halo catalogs: %d files", files)
+	if width != -1 {
+		line += fmt.Sprintf(", %d columns", width)
+	}
+	summary = append(summary, line+".")
+
+	if gConfig.TreeType == "nil" {
+		return append(summary, "Merger trees: TreeType is nil, skipped."),
+			failedTests
+	}
+	trees, err := treeFiles(gConfig)
+	if err != nil {
+		failedTests = append(failedTests, err.Error())
+	}
+	summary = append(summary, fmt.Sprintf("Merger trees: %d files.",
+		len(trees)))
+
+	return summary, failedTests
+}
+
+// catalogWidth returns the number of columns in the first non-comment line
+// of a text catalog.
+func catalogWidth(fname string) (int, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<16), 1<<24)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		return len(strings.Fields(line)), nil
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("The halo catalog %s doesn't have any halos.", fname)
+}
+
 func checkAlmostEq(x, y float64) bool {
 	delta := y / 10
 	return math.Abs(x - y) < delta
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCatalogWidth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_check_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		text  string
+		width int
+		ok    bool
+	}{
+		{"# ID X Y Z\n# Comment\n1 2.0 3.0 4.0\n5 6 7 8\n", 4, true},
+		{"\n  1 2\t3  \n", 3, true},
+		{"# ID X Y Z\n", 0, false},
+	}
+
+	for i, test := range tests {
+		fname := path.Join(dir, "halos.txt")
+		if err = ioutil.WriteFile(fname, []byte(test.text), 0666); err != nil {
+			t.Fatal(err.Error())
+		}
+		width, err := catalogWidth(fname)
+		if (err == nil) != test.ok || width != test.width {
+			t.Errorf("%d) Expected width %d (ok = %v), got %d (err = %v).",
+				i, test.width, test.ok, width, err)
+		}
+	}
+}
+
+func TestCheckConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_check_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"good.gamma.config": "[gamma.config]\nDynamicalTimes = 2\n",
+		"bad.gamma.config":  "[gamma.config]\nDynamicalTimes = -2\n",
+		"meow.config":       "[meow.config]\n",
+	}
+	for name, text := range files {
+		err = ioutil.WriteFile(path.Join(dir, name), []byte(text), 0666)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tests := []struct {
+		fnames   []string
+		failures int
+	}{
+		{[]string{"good.gamma.config"}, 0},
+		{[]string{"good.gamma.config", "bad.gamma.config"}, 1},
+		{[]string{"meow.config", "missing.config"}, 2},
+	}
+
+	for i, test := range tests {
+		fnames := make([]string, len(test.fnames))
+		for j := range fnames {
+			fnames[j] = path.Join(dir, test.fnames[j])
+		}
+		summary, failed := checkConfigFiles(fnames, nil, nil)
+		if len(summary) != 1 || len(failed) != test.failures {
+			t.Errorf("%d) Expected %d failures, got %v (summary %v).",
+				i, test.failures, failed, summary)
+		}
+	}
+}
@@ -4,12 +4,15 @@ package cmd
 
 import (
 	"fmt"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 	
 	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/los/analyze"
 	"github.com/phil-mansfield/shellfish/parse"
 	"github.com/phil-mansfield/shellfish/version"
 )
@@ -24,6 +27,28 @@ var ModeNames map[string]Mode = map[string]Mode{
 	"phase": &PhaseConfig{},
 	"check": &CheckConfig{},
 	"potential": &PotentialConfig{},
+	"crossmatch": &CrossmatchConfig{},
+	"gamma": &GammaConfig{},
+	"trajectory": &TrajectoryConfig{},
+	"orbit": &OrbitConfig{},
+	"backsplash": &BacksplashConfig{},
+	"caustic": &CausticConfig{},
+	"render": &RenderConfig{},
+	"projected": &ProjectedConfig{},
+	"stack": &StackConfig{},
+	"pipeline": &PipelineConfig{},
+	"merge": &MergeConfig{},
+	"serve": &ServeConfig{},
+	"diff": &DiffConfig{},
+	"map": &MapConfig{},
+	"tag": &TagConfig{},
+	"environment": &EnvironmentConfig{},
+	"history": &HistoryConfig{},
+	"massfunc": &MassFuncConfig{},
+	"benchmark": &BenchmarkConfig{},
+	"fit": &FitConfig{},
+	"pairs": &PairsConfig{},
+	"cache": &CacheConfig{},
 }
 
 // Mode represents the interface used by the main binary when interacting with
@@ -54,18 +79,26 @@ type GlobalConfig struct {
 	TreeType          string
 
 	MemoDir           string
+	MemoCompression   bool
 
 	HaloValueNames    []string
 	HaloValueColumns  []int64
 	HaloValueComments []string
 
+	HaloFilter        string
+
+	CompaSOFields     []string
+
 	HaloPositionUnits string
 	HaloRadiusUnits   string
 	HaloMassUnits     string
 
+	Units             string
+
 	Endianness        string
 	ValidateFormats   bool
 	Threads           int64
+	RandomSeed        int64
 
 	Logging           string
 
@@ -97,14 +130,18 @@ func (config *GlobalConfig) ReadConfig(fname string, flags []string) error {
 	vars.String(&config.TreeDir, "TreeDir", "")
 	vars.String(&config.TreeType, "TreeType", "nil")
 	vars.String(&config.MemoDir, "MemoDir", "")
+	vars.Bool(&config.MemoCompression, "MemoCompression", false)
 
 	vars.Strings(&config.HaloValueNames, "HaloValueNames", []string{})
 	vars.Ints(&config.HaloValueColumns, "HaloValueColumns", []int64{})
 	vars.Strings(&config.HaloValueComments, "HaloValueComments", []string{})
+	vars.String(&config.HaloFilter, "HaloFilter", "")
+	vars.Strings(&config.CompaSOFields, "CompaSOFields", []string{})
 
 	vars.String(&config.HaloPositionUnits, "HaloPositionUnits", "")
 	vars.String(&config.HaloRadiusUnits, "HaloRadiusUnits", "")
 	vars.String(&config.HaloMassUnits, "HaloMassUnits", "")
+	vars.String(&config.Units, "Units", "cMpc/h")
 
 	vars.Strings(&config.SnapshotFormatMeanings,
 		"SnapshotFormatMeanings", []string{})
@@ -117,6 +154,7 @@ func (config *GlobalConfig) ReadConfig(fname string, flags []string) error {
 	vars.Bool(&config.ValidateFormats, "ValidateFormats", false)
 
 	vars.Int(&config.Threads, "Threads", -1)
+	vars.Int(&config.RandomSeed, "RandomSeed", -1)
 	vars.String(&config.Logging, "Logging", "nil")
 
 	vars.Ints(&config.GadgetDMTypeIndices,
@@ -139,6 +177,12 @@ func (config *GlobalConfig) ReadConfig(fname string, flags []string) error {
 	}
 	config.HSnapMax = config.SnapMax
 	config.HSnapMin = config.SnapMin
+
+	if config.RandomSeed >= 0 {
+		randSeed = uint64(config.RandomSeed)
+		rand.Seed(config.RandomSeed)
+		analyze.SetMonteCarloSeed(randSeed)
+	}
 	
 	return config.validate()
 }
@@ -172,7 +216,7 @@ func (config *GlobalConfig) validate() error {
 	}
 
 	switch config.HaloType {
-	case "Text", "nil":
+	case "Text", "CompaSO", "nil":
 	case "":
 		return fmt.Errorf("The 'HaloType' variable isn't set.'")
 	default:
@@ -231,7 +275,7 @@ func (config *GlobalConfig) validate() error {
 	}
 	
 	switch config.TreeType {
-	case "consistent-trees", "nil":
+	case "consistent-trees", "consistent-trees-text", "nil":
 	case "":
 		return fmt.Errorf("The 'TreeType variable isn't set.'")
 	default:
@@ -264,6 +308,32 @@ func (config *GlobalConfig) validate() error {
 			config.MemoDir, err.Error())
 	}
 
+	if config.HaloType == "CompaSO" {
+		if len(config.CompaSOFields) != len(config.HaloValueNames) {
+			return fmt.Errorf("len(CompaSOFields) = %d, but "+
+				"len(HaloValueNames) = %d.", len(config.CompaSOFields),
+				len(config.HaloValueNames))
+		}
+		for _, field := range config.CompaSOFields {
+			if err := halo.ParseCompaSOField(field); err != nil {
+				return err
+			}
+		}
+
+		// CompaSO columns are looked up by name, so HaloValueColumns is
+		// just the order of the CompaSOFields.
+		if len(config.HaloValueColumns) != 0 {
+			return fmt.Errorf("The 'HaloValueColumns' variable is set, "+
+				"but HaloType = CompaSO. CompaSO columns are given by "+
+				"'CompaSOFields', so 'HaloValueColumns' must not be set.")
+		}
+		for i := range config.CompaSOFields {
+			config.HaloValueColumns = append(
+				config.HaloValueColumns, int64(i),
+			)
+		}
+	}
+
 	if config.HaloType != "nil" {
 		if len(config.HaloValueNames) == 0 {
 			return fmt.Errorf("The 'HaloValueNames' variable isn't set.")
@@ -297,6 +367,10 @@ func (config *GlobalConfig) validate() error {
 				"'HaloValueNames' does not contain the 'M200m' name.",
 			)
 		}
+
+		if _, err := haloVarColumns(config); err != nil {
+			return err
+		}
 	}
 
 	if config.SnapshotType == "nil" {
@@ -335,6 +409,12 @@ func (config *GlobalConfig) validate() error {
 			"either 'SystemOrder', 'LittleEndian', or 'BigEndian'.")
 	}
 	
+	config.Units = strings.Join(strings.Split(config.Units, " "), "")
+	if err := validateUnits(config.Units); err != nil {
+		return fmt.Errorf("The 'Units' variable is set to '%s', but %s",
+			config.Units, err.Error())
+	}
+
 	if len(config.HaloValueNames) != len(config.HaloValueColumns) {
 		return fmt.Errorf(
 			"len(HaloValueNames) = %d, but len(HaloValueColumns = %d)",
@@ -476,8 +556,12 @@ Version = %s
 #
 # Supported SnapshotTypes: LGadget-2, gotetra, Gadget-2 (experimental),
 # ARTIO (experimental), Bolshoi (experimental), BolshoiP (experiemntal)
-# Supported HaloTypes: Text, nil
-# Supported TreeTypes: consistent-trees, nil
+# Supported HaloTypes: Text, CompaSO (experimental), nil
+# Supported TreeTypes: consistent-trees, consistent-trees-text, nil
+#
+# consistent-trees-text reads the tree_X_Y_Z.dat files in TreeDir directly
+# instead of through the consistent_trees library, so it works for
+# simulations where only the raw trees were kept.
 SnapshotType = LGadget-2
 HaloType = Text
 TreeType = consistent-trees
@@ -494,6 +578,18 @@ HaloValueColumns = 0, 2, 3, 4, 20
 # propagated to output catalogs when relevant.
 HaloValueComments = "int", "cMpc/h", "cMpc/h", "cMpc/h", "Msun/h"
 
+# HaloFilter is an optional expression which is used to throw out rows of your
+# halo catalogs as they are read. Only halos for which the expression is true
+# will be visible to Shellfish. Any name in HaloValueNames can be used (as can
+# radii like R200m which are computed from masses), along with numbers, the
+# comparisons <, <=, >, >=, ==, !=, the logical operators &&, ||, !, the
+# arithmetic operators +, -, *, /, and parentheses. For example:
+#
+# HaloFilter = "M200m > 1e13 && Xoff < 0.07"
+#
+# Changing this variable changes the cached catalogs in MemoDir, so the usual
+# rules about changing this file apply. By default, no halos are removed.
+
 # HaloPositionUnits are the units which your halo catalog reports positions in.
 # Currently supported values are "cMpc/h" and "ckpc/h" (the "c" stands for
 # "comoving") and "pMpc/h" and "pkpc/h" (the "p" stands for "physical"). The
@@ -507,6 +603,14 @@ HaloRadiusUnits = ckpc/h
 # Currently only "Msun/h" is supported.
 HaloMassUnits = Msun/h
 
+# Units are the units which the coord, shell, stats, and prof tools write
+# positions, radii, and masses in. Supported values are "cMpc/h" (comoving
+# Mpc/h and Msun/h), "pMpc" (physical Mpc and Msun), and "pkpc" (physical kpc
+# and Msun). The units are recorded in the header of every output catalog, and
+# tools which read these catalogs convert them back automatically. Defaults to
+# cMpc/h.
+Units = cMpc/h
+
 # These next couple of variables are neccessary evils due to the fact that there
 # are a wide range of directory structures used in different simulations. They
 # will be sufficient to specify the location of snapshots in the vast majority
@@ -553,6 +657,16 @@ TreeDir = path/to/merger/tree/dir/
 # word for caching.)
 MemoDir = path/to/memo/dir/
 
+# MemoCompression compresses the binary files that Shellfish writes to MemoDir.
+# This makes them smaller at the cost of some CPU time when they're written and
+# read. Every file in MemoDir records whether it was compressed, so this
+# variable can be changed without clearing MemoDir. Files are compressed with
+# DEFLATE (the algorithm used by gzip) rather than zstd, since zstd isn't in
+# Go's standard library and Shellfish doesn't otherwise need any compression
+# libraries. Defaults to false.
+#
+# MemoCompression = false
+
 # Endianness of any external binary data files read by Shellfish. It should be
 # set to either SystemOrder, LittleEndian, BigEndian. This variable defaults to
 # SystemOrder.
@@ -568,9 +682,19 @@ Endianness = SystemOrder
 # be set equal to the number of available cores on the current node. All threads
 # will be balanced across available cores. Setting this to a value larger than
 # the number of cores on the node might result in slightly suboptimal
-# performance.
+# performance. The shell, stats, and prof tools split halos between this many
+# workers. Output is always written in the same order as the input.
 Threads = -1
 
+# RandomSeed is the seed used by every random number generator in Shellfish.
+# If it is negative (as it is by default), a seed is chosen from the current
+# time. Setting it makes the output of the shell tool bit-for-bit reproducible
+# between runs, independent of Threads, since every halo's lines of sight and
+# Monte Carlo samples are derived from this seed and the halo's ID and
+# snapshot rather than from the order halos are processed in. The id config
+# file has its own RandomSeed which overrides this one for halo selection.
+RandomSeed = -1
+
 # The logging mode to be used. There are three different logging modes:
 # nil - no logging is performed.
 # performance - runtime and memory consumption logging are written to stderr.
@@ -629,6 +753,24 @@ Logging = nil
 # fail and tell you to change this variable.
 # LGadgetNpartNum = 2
 
+##################################
+## CompaSO (HaloType) variables ##
+##################################
+# CompaSO catalogs (e.g. from AbacusSummit) are stored in ASDF files, so their
+# columns are referred to by name instead of by index. HaloDir should contain
+# one directory per snapshot named after its redshift (e.g. z0.500/), each with
+# a halo_info/ subdirectory. HaloValueColumns must not be set.
+#
+# CompaSOFields gives the ASDF field corresponding to each element of
+# HaloValueNames. A field can be a column name ("id"), a component of a vector
+# column ("x_L2com[0]"), or a column multiplied by the particle mass
+# ("N_L2*mp"), which allows particle counts to be used as masses. Positions
+# are shifted so that they run from 0 to the box width. Only uncompressed,
+# zlib, and bzip2 ASDF blocks can be read: files that use blosc compression
+# must be rewritten first.
+#
+# CompaSOFields = id, x_L2com[0], x_L2com[1], x_L2com[2], N_L2*mp
+
 ##########################################
 ## nil (SnapshotType)-specifc variables ##
 ##########################################
@@ -646,6 +788,33 @@ Logging = nil
 `, version.SourceVersion)
 }
 
+// haloVarColumns creates the VarColumns corresponding to the halo catalog
+// described by gConfig, including its HaloFilter.
+func haloVarColumns(gConfig *GlobalConfig) (*halo.VarColumns, error) {
+	vars := halo.NewVarColumns(
+		gConfig.HaloValueNames, gConfig.HaloValueColumns,
+		gConfig.HaloRadiusUnits,
+	)
+
+	filter, err := halo.ParseFilter(gConfig.HaloFilter)
+	if err != nil {
+		return nil, fmt.Errorf("The 'HaloFilter' variable is invalid. %s",
+			err.Error())
+	}
+	for _, name := range filter.Names() {
+		if _, ok := vars.ColumnLookup[name]; !ok {
+			return nil, fmt.Errorf("The 'HaloFilter' variable uses the "+
+				"value '%s', which isn't in 'HaloValueNames'.", name)
+		}
+	}
+	vars.Filter = filter
+	if gConfig.HaloType == "CompaSO" {
+		vars.Fields = gConfig.CompaSOFields
+	}
+
+	return vars, nil
+}
+
 // Run is a dummy method which allows GlobalConfig to conform to the Mode
 // interface for testing purposes.
 func (config *GlobalConfig) Run(
@@ -656,3 +825,17 @@ func (config *GlobalConfig) Run(
 
 // This needs to be global for debugging purposes.
 var randSeed = uint64(time.Now().UnixNano())
+
+// haloSeed derives the random seed of a single halo from a base seed and the
+// halo's ID and snapshot. The same halo always gets the same seed, regardless
+// of which other halos are being analyzed.
+func haloSeed(base uint64, id, snap int) uint64 {
+	// splitmix64 finalizer.
+	h := base ^ (uint64(id) * 0x9e3779b97f4a7c15) ^ (uint64(snap) << 48)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -13,6 +13,27 @@ func TestExampleFiles(t *testing.T) {
 		&TreeConfig{},
 		&ShellConfig{},
 		&StatsConfig{},
+		&GammaConfig{},
+		&TrajectoryConfig{},
+		&OrbitConfig{},
+		&BacksplashConfig{},
+		&CausticConfig{},
+		&RenderConfig{},
+		&ProjectedConfig{},
+		&StackConfig{},
+		&PipelineConfig{},
+		&MergeConfig{},
+		&ServeConfig{},
+		&DiffConfig{},
+		&MapConfig{},
+		&TagConfig{},
+		&EnvironmentConfig{},
+		&HistoryConfig{},
+		&MassFuncConfig{},
+		&BenchmarkConfig{},
+		&FitConfig{},
+		&PairsConfig{},
+		&CacheConfig{},
 	}
 
 	for i := range tests {
@@ -30,7 +51,7 @@ func TestExampleFiles(t *testing.T) {
 			panic(err.Error())
 		}
 
-		err = mode.ReadConfig(f.Name())
+		err = mode.ReadConfig(f.Name(), nil)
 		if err != nil {
 			t.Errorf("%d) Got error when parsing config file:\n%s",
 				i, err.Error())
@@ -3,19 +3,23 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"math"
 	"time"
 
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
 	"github.com/phil-mansfield/shellfish/cmd/halo"
 	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/cosmo"
 	"github.com/phil-mansfield/shellfish/io"
 	"github.com/phil-mansfield/shellfish/logging"
 	"github.com/phil-mansfield/shellfish/parse"
 )
 
 type CoordConfig struct {
-	values []string
+	values           []string
+	velocities       bool
+	radiusDefinition string
 }
 
 var _ Mode = &CoordConfig{}
@@ -26,26 +30,98 @@ func (config *CoordConfig) ExampleConfig() string {
 # The default order is the one which is needed by Shellfish. Any other order
 # would correspond to a catalog which is for your personal use only.
 Values = X, Y, Z, R200m
+
+# Velocities appends the bulk velocity of each halo, Vx, Vy, and Vz, to the
+# end of Values. These must be included in HaloValueNames and are output in
+# whatever units the halo catalog uses. This gives velocity-space analyses a
+# halo rest frame without needing to read the catalog a second time. Defaults
+# to false.
+# Velocities = false
+
+# RadiusDefinition is the halo radius definition used for the radius column
+# which is passed to shell. Shell scales its line-of-sight search radius by
+# this column, so it should be whichever definition you care about. Any
+# R200m in Values is replaced by this radius. If the catalog doesn't contain
+# the radius directly, the corresponding mass (M200m, M200c, M500c, or Mvir)
+# must be in HaloValueNames. Rvir uses the Bryan & Norman (1998) overdensity.
+# Supported values are R200m, R200c, R500c, and Rvir. Defaults to R200m.
+# RadiusDefinition = R200m
 `
 }
 
 func (config *CoordConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("coord.config")
 	vars.Strings(&config.values, "Values", []string{"X", "Y", "Z", "R200m"})
+	vars.Bool(&config.velocities, "Velocities", false)
+	vars.String(&config.radiusDefinition, "RadiusDefinition", "R200m")
 
 	if fname == "" {
 		if len(flags) == 0 {
 			return nil
 		}
-		return parse.ReadFlags(flags, vars)
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+		return config.setValues()
 	}
 	if err := parse.ReadConfig(fname, vars); err != nil {
 		return err
 	}
-	return parse.ReadFlags(flags, vars)
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+	return config.setValues()
+}
+
+// setValues applies the RadiusDefinition and Velocities variables to
+// config.values.
+func (config *CoordConfig) setValues() error {
+	switch config.radiusDefinition {
+	case "R200m", "R200c", "R500c", "Rvir":
+	default:
+		return fmt.Errorf("The 'RadiusDefinition' variable is set to '%s', "+
+			"but the only supported values are R200m, R200c, R500c, and "+
+			"Rvir.", config.radiusDefinition)
+	}
+	for i := range config.values {
+		if config.values[i] == "R200m" {
+			config.values[i] = config.radiusDefinition
+		}
+	}
+
+	config.addVelocities()
+	return nil
+}
+
+// addVelocities appends the velocity components to config.values if the
+// Velocities variable is set.
+func (config *CoordConfig) addVelocities() {
+	if !config.velocities {
+		return
+	}
+	for _, v := range []string{"Vx", "Vy", "Vz"} {
+		found := false
+		for _, val := range config.values {
+			if val == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			config.values = append(config.values, v)
+		}
+	}
 }
 
 func (config *CoordConfig) validate(vars *halo.VarColumns) error {
+	if config.velocities {
+		for _, v := range []string{"Vx", "Vy", "Vz"} {
+			if _, ok := vars.ColumnLookup[v]; !ok {
+				return fmt.Errorf("The 'Velocities' variable is set, but "+
+					"'%s' isn't in HaloValueNames.", v)
+			}
+		}
+	}
 	for _, val := range config.values {
 		if _, ok := vars.ColumnLookup[val]; !ok {
 			return fmt.Errorf(
@@ -83,10 +159,10 @@ func (config *CoordConfig) Run(
 		return nil, fmt.Errorf("In input IDs.")
 	}
 
-	vars := halo.NewVarColumns(
-		gConfig.HaloValueNames, gConfig.HaloValueColumns,
-		gConfig.HaloRadiusUnits,
-	)
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
 	if err := config.validate(vars); err != nil {
 		return nil, err
 	}
@@ -98,12 +174,48 @@ func (config *CoordConfig) Run(
 		return nil, err
 	}
 
+	// Rows extrapolated by tree mode are read at the snapshot where the halo
+	// was last seen.
+	readSnaps, lastSnaps := snaps, []int(nil)
+	if extCol := catalog.ColumnIndex(stdin, "Extrapolated"); extCol != -1 {
+		extCols, _, err := catalog.Parse(stdin, []int{extCol}, []int{})
+		if err != nil {
+			return nil, err
+		}
+		lastSnaps = extCols[0]
+		readSnaps = make([]int, len(snaps))
+		for i := range readSnaps {
+			readSnaps[i] = snaps[i]
+			if lastSnaps[i] != -1 {
+				readSnaps[i] = lastSnaps[i]
+			}
+		}
+	}
+
 	cols, err := readHaloCoords(
-		ids, snaps, config.values, vars, buf, e, gConfig,
+		ids, readSnaps, config.values, vars, buf, e, gConfig,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if lastSnaps != nil {
+		err = config.extrapolate(
+			ids, snaps, lastSnaps, cols, vars, buf, e, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	kinds := make([]unitKind, len(config.values))
+	for i := range kinds {
+		kinds[i] = coordKind(config.values[i])
+	}
+	uc, err := newUnitConverter(gConfig.Units, snaps, buf, e)
+	if err != nil {
+		return nil, err
+	}
+	uc.convert(snaps, cols, kinds)
 
 	icols := [][]int{ids, snaps}
 	fcols := [][]float64{}
@@ -113,7 +225,7 @@ func (config *CoordConfig) Run(
 	intNum := 0
 	for _, valueName := range config.values {
 		switch valueName {
-		case "R200m", "R200c", "R500c", "R2500c":
+		case "R200m", "R200c", "R500c", "R2500c", "Rvir":
 		default:
 			j := findString(valueName, gConfig.HaloValueNames)
 			comment := gConfig.HaloValueComments[j]
@@ -124,7 +236,7 @@ func (config *CoordConfig) Run(
 	for i, valueName := range config.values {
 		var comment string
 		switch valueName {
-		case "R200m", "R200c", "R500c", "R2500c":
+		case "R200m", "R200c", "R500c", "R2500c", "Rvir":
 			comment = "Mpc/h"
 		default:
 			j := findString(valueName, gConfig.HaloValueNames)
@@ -146,33 +258,164 @@ func (config *CoordConfig) Run(
 	colOrder := append(icolOrder, fcolOrder...)
 	lines := catalog.FormatCols(icols, fcols, colOrder)
 
-	cString := makeCommentString(gConfig, config)
+	// Pass through the root IDs generated by tree mode and the
+	// per-repetition seeds generated by id mode.
+	passNames := []string{}
+	for _, name := range passThroughColumns {
+		col := catalog.ColumnIndex(stdin, name)
+		if col == -1 {
+			continue
+		}
+		passCols, _, err := catalog.Parse(stdin, []int{col}, []int{})
+		if err != nil {
+			return nil, err
+		}
+		passLines := catalog.FormatCols(passCols, nil, []int{0})
+		for i := range lines {
+			lines[i] = lines[i] + " " + passLines[i]
+		}
+		passNames = append(passNames, name)
+	}
+
+	cString := makeCommentString(gConfig, config, passNames)
 
 	if logging.Mode == logging.Performance {
 		log.Printf("Time: %s", time.Since(t).String())
 		log.Printf("Memory:\n%s", logging.MemString())
 	}
 
-	return append([]string{cString}, lines...), nil
+	return append([]string{uc.unitsString(), cString}, lines...), nil
+}
+
+// coordKind returns the kind of unit that the given halo value is measured
+// in. Velocities and other values which aren't converted are dimensionless.
+func coordKind(value string) unitKind {
+	switch value {
+	case "X", "Y", "Z", "R200m", "R200c", "R500c", "R2500c", "Rvir", "Rs":
+		return lengthUnit
+	case "M200m", "M200c", "M500c", "M2500c", "Mvir":
+		return massUnit
+	}
+	return dimensionless
+}
+
+// passThroughColumns are the int columns written by earlier modes which
+// coord copies to its output unchanged.
+var passThroughColumns = []string{"RootID", "Extrapolated", "Seed"}
+
+// extrapolate moves the X, Y, and Z values of every row with a lastSnap other
+// than -1 from the position where the halo was last seen to its position at
+// the row's snapshot, assuming that its peculiar velocity is constant.
+// Velocities are assumed to be in physical km/s. All other values are left
+// at their last known values.
+func (config *CoordConfig) extrapolate(
+	ids, snaps, lastSnaps []int, cols [][]float64, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, gConfig *GlobalConfig,
+) error {
+	posIdx := []int{-1, -1, -1}
+	for i, val := range config.values {
+		switch val {
+		case "X":
+			posIdx[0] = i
+		case "Y":
+			posIdx[1] = i
+		case "Z":
+			posIdx[2] = i
+		}
+	}
+
+	extIDs, extSnaps, extIdxs := []int{}, []int{}, []int{}
+	for i := range lastSnaps {
+		if lastSnaps[i] != -1 {
+			extIDs = append(extIDs, ids[i])
+			extSnaps = append(extSnaps, lastSnaps[i])
+			extIdxs = append(extIdxs, i)
+		}
+	}
+	if len(extIdxs) == 0 {
+		return nil
+	}
+
+	for _, v := range []string{"Vx", "Vy", "Vz"} {
+		if _, ok := vars.ColumnLookup[v]; !ok {
+			return fmt.Errorf("The input contains extrapolated rows, but "+
+				"'%s' isn't in HaloValueNames.", v)
+		}
+	}
+	vs, err := readHaloCoords(
+		extIDs, extSnaps, []string{"Vx", "Vy", "Vz"}, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return err
+	}
+
+	for j, i := range extIdxs {
+		hd0, err := snapHeader(lastSnaps[i], buf, e)
+		if err != nil {
+			return err
+		}
+		hd1, err := snapHeader(snaps[i], buf, e)
+		if err != nil {
+			return err
+		}
+		c := &hd1.Cosmo
+		a0, a1 := 1/(1+hd0.Cosmo.Z), 1/(1+c.Z)
+
+		// Ages are in units of 1/H0 = 1/(100 km/s/(Mpc/h)), and the comoving
+		// displacement is v dt / a.
+		dt := cosmo.Age(c.OmegaM, c.OmegaL, a1) -
+			cosmo.Age(c.OmegaM, c.OmegaL, a0)
+		aMid := (a0 + a1) / 2
+		L := hd1.TotalWidth
+
+		for k := 0; k < 3; k++ {
+			if posIdx[k] == -1 {
+				continue
+			}
+			x := cols[posIdx[k]][i] + vs[k][j]*dt/(100*aMid)
+			cols[posIdx[k]][i] = math.Mod(math.Mod(x, L)+L, L)
+		}
+	}
+
+	return nil
+}
+
+// snapHeader returns the header of the first file in the given snapshot.
+func snapHeader(
+	snap int, buf io.VectorBuffer, e *env.Environment,
+) (*io.Header, error) {
+	hds, _, err := memo.ReadHeaders(snap, buf, e)
+	if err != nil {
+		return nil, err
+	}
+	return &hds[0], nil
 }
 
 func isIntType(comment string) bool {
 	return comment == "int" || comment == "\"int\""
 }
 
-func makeCommentString(gConfig *GlobalConfig, config *CoordConfig) string {
+func makeCommentString(
+	gConfig *GlobalConfig, config *CoordConfig, passNames []string,
+) string {
 	colNames := make([]string, len(config.values))
 	for i := 0; i < len(config.values); i++ {
 		switch config.values[i] {
-		case "R200m", "R200c", "R500c", "Rs":
+		case "R200m", "R200c", "R500c", "Rvir", "Rs":
 			colNames[i] = fmt.Sprintf(
-				"%s [%s]", config.values[i], gConfig.HaloPositionUnits,
+				"%s [%s]", config.values[i],
+				unitLabel(gConfig.Units, lengthUnit),
 			)
 			continue
 		}
 		
 		j := findString(config.values[i], gConfig.HaloValueNames)
-		if gConfig.HaloValueComments[j] == "" ||
+		kind := coordKind(config.values[i])
+		if gConfig.Units != comovingUnits && kind != dimensionless {
+			colNames[i] = fmt.Sprintf(
+				"%s [%s]", config.values[i], unitLabel(gConfig.Units, kind),
+			)
+		} else if gConfig.HaloValueComments[j] == "" ||
 			gConfig.HaloValueComments[j] == "\"\"" ||
 			isIntType(gConfig.HaloValueComments[j]) {
 
@@ -184,8 +427,10 @@ func makeCommentString(gConfig *GlobalConfig, config *CoordConfig) string {
 		}
 	}
 
-	colOrder := make([]int, 2 + len(config.values))
-	colSizes := make([]int, 2 + len(config.values))
+	colNames = append(colNames, passNames...)
+
+	colOrder := make([]int, 2 + len(colNames))
+	colSizes := make([]int, 2 + len(colNames))
 	for i := range colOrder {
 		colOrder[i], colSizes[i] = i, 1
 	}
@@ -222,7 +467,7 @@ func readHaloCoords(
 			continue
 		}
 
-		hds, _, err := memo.ReadHeaders(snaps[0], buf, e)
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
 		if err != nil { return nil, err }
 		cosmo := &hds[0].Cosmo
 
@@ -246,7 +491,7 @@ func readHaloCoords(
 				for j := range scols[i] {
 					scols[i][j] *= ucf
 				}
-			case "R200m", "R200c", "R500c", "Rs" :
+			case "R200m", "R200c", "R500c", "Rvir", "Rs" :
 				ucf := halo.UnitConversionFactor(
 					gConfig.HaloRadiusUnits, cosmo,
 				)
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+func TestReadHaloCoordsRedshifts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_coord_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// The same halo at z = 1 and z = 0, with positions in physical units.
+	haloDir, memoDir := path.Join(dir, "halos"), path.Join(dir, "memo")
+	for _, d := range []string{haloDir, memoDir} {
+		if err := os.Mkdir(d, 0777); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for snap := 0; snap < 2; snap++ {
+		fname := path.Join(haloDir, fmt.Sprintf("halos_%d.list", snap))
+		text := "# ID X Y Z M200m\n7 10 20 30 1e12\n"
+		if err := ioutil.WriteFile(fname, []byte(text), 0666); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	e := &env.Environment{MemoDir: memoDir}
+	err = e.InitNil(&env.ParticleInfo{SnapMin: 0, SnapMax: 1}, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = e.InitTextHalo(&env.HaloInfo{
+		HaloDir: haloDir, HSnapMin: 0, HSnapMax: 1,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	buf, err := io.NewNilBuffer(io.Context{
+		NilOmegaM: 0.27, NilOmegaL: 0.73, NilH100: 0.7,
+		NilScaleFactors: []float64{0.5, 1}, NilTotalWidth: 100,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	gConfig := &GlobalConfig{
+		HaloPositionUnits: "pMpc/h", HaloRadiusUnits: "pMpc/h",
+	}
+	vars := halo.NewVarColumns(
+		[]string{"ID", "X", "Y", "Z", "M200m"},
+		[]int64{0, 1, 2, 3, 4}, "pMpc/h",
+	)
+
+	cols, err := readHaloCoords(
+		[]int{7, 7}, []int{1, 0}, []string{"X"}, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Comoving positions are (1 + z) times larger than physical ones.
+	expected := []float64{10, 20}
+	for i := range expected {
+		if math.Abs(cols[0][i]-expected[i]) > 1e-6 {
+			t.Errorf("Expected X = %v, got %v.", expected, cols[0])
+			break
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// CrossmatchConfig contains the configuration fields for the 'crossmatch'
+// mode of the shellfish tool.
+type CrossmatchConfig struct {
+	catalogFormat   string
+	columns         []int64
+	positionUnits   string
+	matchRadiusMult float64
+	maxMassRatio    float64
+}
+
+var _ Mode = &CrossmatchConfig{}
+
+// ExampleConfig creates an example crossmatch.config file.
+func (config *CrossmatchConfig) ExampleConfig() string {
+	return `[crossmatch.config]
+
+#####################
+## Required Fields ##
+#####################
+
+# CatalogFormat is the location of the text halo catalog that halos should be
+# matched against (e.g. a SUBFIND catalog of the same box as your main,
+# Rockstar, catalog). If it contains a format specifier, it will be formatted
+# with the snapshot index of each input halo. Otherwise, the same catalog is
+# used for every snapshot.
+CatalogFormat = path/to/other/catalogs/halos_%03d.txt
+
+# Columns gives the 0-indexed columns of the ID, X, Y, Z, and M200m values in
+# the catalog, in that order. Masses must be in Msun/h.
+Columns = 0, 1, 2, 3, 4
+
+#####################
+## Optional Fields ##
+#####################
+
+# PositionUnits are the units of X, Y, and Z in the catalog. These support the
+# same values as HaloPositionUnits. Defaults to cMpc/h if not set.
+# PositionUnits = cMpc/h
+
+# MatchRadiusMult is the maximum distance between two matched halos in units
+# of the R200m of the input halo. Defaults to 1 if not set.
+# MatchRadiusMult = 1
+
+# MaxMassRatio is the largest factor by which the masses of two matched halos
+# can differ. Defaults to 2 if not set.
+# MaxMassRatio = 2`
+}
+
+// ReadConfig reads in a crossmatch.config file into config.
+func (config *CrossmatchConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("crossmatch.config")
+	vars.String(&config.catalogFormat, "CatalogFormat", "")
+	vars.Ints(&config.columns, "Columns", []int64{})
+	vars.String(&config.positionUnits, "PositionUnits", "cMpc/h")
+	vars.Float(&config.matchRadiusMult, "MatchRadiusMult", 1)
+	vars.Float(&config.maxMassRatio, "MaxMassRatio", 2)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *CrossmatchConfig) validate() error {
+	if config.catalogFormat == "" {
+		return fmt.Errorf("The 'CatalogFormat' variable isn't set.")
+	}
+
+	if len(config.columns) != 5 {
+		return fmt.Errorf("The 'Columns' variable must have 5 elements "+
+			"(ID, X, Y, Z, and M200m), but it has %d.", len(config.columns))
+	}
+	for i := range config.columns {
+		if config.columns[i] < 0 {
+			return fmt.Errorf("'Columns'[%d] is set to %d.",
+				i, config.columns[i])
+		}
+	}
+
+	config.positionUnits = strings.Join(
+		strings.Split(config.positionUnits, " "), "",
+	)
+	switch config.positionUnits {
+	case "cMpc/h", "ckpc/h", "pMpc/h", "pkpc/h", "cMpc", "ckpc", "pMpc", "pkpc":
+	default:
+		return fmt.Errorf("The 'PositionUnits' variable is set to '%s', "+
+			"which I don't support. Only supported units are ckpc/h, "+
+			"cMpc/h, pkpc/h, pMpc/h, ckpc, cMpc, pkpc, and pMpc",
+			config.positionUnits)
+	}
+
+	if config.matchRadiusMult <= 0 {
+		return fmt.Errorf("The 'MatchRadiusMult' variable is set to %g, "+
+			"but it needs to be positive.", config.matchRadiusMult)
+	}
+	if config.maxMassRatio < 1 {
+		return fmt.Errorf("The 'MaxMassRatio' variable is set to %g, but "+
+			"it can't be smaller than 1.", config.maxMassRatio)
+	}
+
+	return nil
+}
+
+// Run executes the crossmatch mode of the shellfish tool.
+func (config *CrossmatchConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+##########################
+## shellfish crossmatch ##
+##########################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	if config.catalogFormat == "" {
+		return nil, fmt.Errorf("Either no crossmatch.config file was " +
+			"provided or the 'CatalogFormat' variable wasn't set.")
+	}
+
+	intCols, _, err := catalog.Parse(stdin, []int{0, 1}, []int{})
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cols, err := readHaloCoords(
+		ids, snaps, []string{"X", "Y", "Z", "R200m", "M200m"},
+		vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+	xs, ys, zs, rs, ms := cols[0], cols[1], cols[2], cols[3], cols[4]
+
+	matchIDs := make([]int, len(ids))
+	dists, ratios := make([]float64, len(ids)), make([]float64, len(ids))
+	for i := range matchIDs {
+		matchIDs[i], dists[i], ratios[i] = -1, -1, -1
+	}
+
+	snapBins, idxBins := binBySnap(snaps, ids)
+	for snap := range snapBins {
+		if snap == -1 {
+			continue
+		}
+
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		hd := &hds[0]
+
+		cids, cxs, cys, czs, cms, err := config.readCatalog(snap, &hd.Cosmo)
+		if err != nil {
+			return nil, err
+		}
+		if len(cids) == 0 {
+			continue
+		}
+		mt := halo.NewMatcher(finderCells, hd.TotalWidth, cxs, cys, czs, cms)
+
+		for _, i := range idxBins[snap] {
+			pos := [3]float64{xs[i], ys[i], zs[i]}
+			j, dist, ok := mt.Match(
+				pos, rs[i]*config.matchRadiusMult, ms[i], config.maxMassRatio,
+			)
+			if ok {
+				matchIDs[i], dists[i], ratios[i] = cids[j], dist, cms[j]/ms[i]
+			}
+		}
+	}
+
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps, matchIDs}, [][]float64{dists, ratios},
+		[]int{0, 1, 2, 3, 4},
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot", "Match ID"},
+		[]string{"Distance [cMpc/h]", "Mass Ratio"},
+		[]int{0, 1, 2, 3, 4}, []int{1, 1, 1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
+
+// readCatalog reads the IDs, positions (in cMpc/h), and masses of every halo
+// in the catalog that should be matched against at the given snapshot.
+func (config *CrossmatchConfig) readCatalog(
+	snap int, cosmo *io.CosmologyHeader,
+) (ids []int, xs, ys, zs, ms []float64, err error) {
+	fname := config.catalogFormat
+	if strings.Contains(fname, "%") {
+		fname = fmt.Sprintf(fname, snap)
+	}
+
+	colIdxs := make([]int, len(config.columns))
+	for i := range colIdxs {
+		colIdxs[i] = int(config.columns[i])
+	}
+	_, cols, err := catalog.ReadFile(fname, nil, colIdxs)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+
+	ids = make([]int, len(cols[0]))
+	for i := range ids {
+		ids[i] = int(cols[0][i])
+	}
+	xs, ys, zs, ms = cols[1], cols[2], cols[3], cols[4]
+
+	ucf := halo.UnitConversionFactor(config.positionUnits, cosmo)
+	for i := range xs {
+		xs[i] *= ucf
+		ys[i] *= ucf
+		zs[i] *= ucf
+	}
+
+	return ids, xs, ys, zs, ms, nil
+}
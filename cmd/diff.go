@@ -0,0 +1,382 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// DiffConfig contains the configuration fields for the 'diff' mode of the
+// shellfish tool.
+type DiffConfig struct {
+	catalogA, catalogB string
+	columns            []string
+	absolute           bool
+	tolerance          float64
+}
+
+var _ Mode = &DiffConfig{}
+
+// ExampleConfig creates an example diff.config file.
+func (config *DiffConfig) ExampleConfig() string {
+	return `[diff.config]
+
+#####################
+## Required Fields ##
+#####################
+
+# CatalogA and CatalogB are the two catalogs that are compared, e.g. the output
+# of two shellfish versions or of two choices of shell.config parameters. Both
+# must have been written by shellfish, since columns are matched by the names
+# in their headers. Halos are matched by their IDs and snapshots.
+CatalogA = old.stats.txt
+CatalogB = new.stats.txt
+
+#####################
+## Optional Fields ##
+#####################
+
+# Columns is a list of the columns which are compared, named without their
+# units (e.g. R_sp, M_sp, or P_ijk). Defaults to every column that appears in
+# both catalogs, other than ID and Snapshot.
+# Columns = R_sp, M_sp
+
+# Absolute reports the difference, B - A, of each column instead of the
+# relative difference, (B - A) / A. Columns with more than one element (like
+# the shell coefficients, P_ijk) are reported as the length of the difference
+# vector, divided by the length of A's vector unless Absolute is true.
+# Defaults to false.
+# Absolute = false
+
+# Tolerance is the largest difference which is allowed. If it's positive, only
+# halos with at least one difference larger than it are written, and the
+# summary counts how many there were. Defaults to -1, which writes every halo.
+# Tolerance = -1`
+}
+
+// ReadConfig reads in a diff.config file into config.
+func (config *DiffConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("diff.config")
+	vars.String(&config.catalogA, "CatalogA", "")
+	vars.String(&config.catalogB, "CatalogB", "")
+	vars.Strings(&config.columns, "Columns", []string{})
+	vars.Bool(&config.absolute, "Absolute", false)
+	vars.Float(&config.tolerance, "Tolerance", -1)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *DiffConfig) validate() error {
+	if config.catalogA == "" {
+		return fmt.Errorf("The variable 'CatalogA' was not set.")
+	} else if config.catalogB == "" {
+		return fmt.Errorf("The variable 'CatalogB' was not set.")
+	}
+	return nil
+}
+
+// Run executes the diff mode of the shellfish tool.
+func (config *DiffConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+####################
+## shellfish diff ##
+####################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	a, err := readNamedCatalog(config.catalogA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readNamedCatalog(config.catalogB)
+	if err != nil {
+		return nil, err
+	}
+
+	lines, err := diffCatalogs(a, b, config.columns, config.absolute,
+		config.tolerance)
+	if err != nil {
+		return nil, err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return lines, nil
+}
+
+// namedCatalog is a catalog written by shellfish whose columns are looked up
+// by the names in its header.
+type namedCatalog struct {
+	name  string
+	units string
+	cols  []catalog.Column
+	ids   []int
+	snaps []int
+	// vals are the columns of the catalog, indexed by column.
+	vals [][]float64
+}
+
+// readNamedCatalog reads every column of a catalog written by shellfish.
+func readNamedCatalog(fname string) (*namedCatalog, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return parseNamedCatalog(fname, data)
+}
+
+// parseNamedCatalog parses every column of a catalog written by shellfish.
+// The first two columns must be its IDs and snapshots.
+func parseNamedCatalog(name string, data []byte) (*namedCatalog, error) {
+	cols := catalog.Columns(data)
+	if len(cols) < 2 || cols[0].Name != "ID" || cols[1].Name != "Snapshot" {
+		return nil, fmt.Errorf("The catalog %s doesn't have a header "+
+			"listing ID and Snapshot columns, so its columns can't be "+
+			"matched by name.", name)
+	}
+
+	width := cols[len(cols)-1].End + 1
+	floatIdxs := make([]int, width)
+	for i := range floatIdxs {
+		floatIdxs[i] = i
+	}
+	intCols, vals, err := catalog.Parse(data, []int{0, 1}, floatIdxs)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", name, err.Error())
+	}
+
+	return &namedCatalog{
+		name: name, units: catalog.Units(data), cols: cols,
+		ids: intCols[0], snaps: intCols[1], vals: vals,
+	}, nil
+}
+
+// column returns the column of the catalog with the given name, ignoring
+// units.
+func (c *namedCatalog) column(name string) (catalog.Column, bool) {
+	for _, col := range c.cols {
+		if baseColumnName(col.Name) == name {
+			return col, true
+		}
+	}
+	return catalog.Column{}, false
+}
+
+// baseColumnName returns the name of a column without its units.
+func baseColumnName(name string) string {
+	if i := strings.Index(name, " ["); i != -1 {
+		return name[:i]
+	}
+	return name
+}
+
+// diffColumnNames returns the names of the columns which are compared. If
+// names is empty, every column in both catalogs is used.
+func diffColumnNames(a, b *namedCatalog, names []string) ([]string, error) {
+	if len(names) == 0 {
+		for _, col := range a.cols[2:] {
+			name := baseColumnName(col.Name)
+			if _, ok := b.column(name); ok {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("The catalogs %s and %s don't have any "+
+				"columns in common other than ID and Snapshot.",
+				a.name, b.name)
+		}
+		return names, nil
+	}
+
+	for _, name := range names {
+		colA, okA := a.column(name)
+		colB, okB := b.column(name)
+		if !okA || !okB {
+			return nil, fmt.Errorf("The variable 'Columns' contains '%s', "+
+				"which isn't a column of both %s and %s.",
+				name, a.name, b.name)
+		} else if colA.End-colA.Start != colB.End-colB.Start {
+			return nil, fmt.Errorf("The column '%s' has %d elements in %s "+
+				"but %d in %s.", name, colA.End-colA.Start+1, a.name,
+				colB.End-colB.Start+1, b.name)
+		}
+	}
+	return names, nil
+}
+
+// diffCatalogs joins two catalogs on ID and snapshot and returns a catalog of
+// the differences in the named columns, preceded by summary comment lines.
+func diffCatalogs(
+	a, b *namedCatalog, names []string, absolute bool, tolerance float64,
+) ([]string, error) {
+	names, err := diffColumnNames(a, b, names)
+	if err != nil {
+		return nil, err
+	}
+
+	type haloKey struct{ id, snap int }
+	bRows := map[haloKey]int{}
+	for j := range b.ids {
+		key := haloKey{b.ids[j], b.snaps[j]}
+		if _, ok := bRows[key]; !ok {
+			bRows[key] = j
+		}
+	}
+
+	ids, snaps := []int{}, []int{}
+	diffs := make([][]float64, len(names))
+	matched, onlyA, exceeded := map[haloKey]bool{}, 0, 0
+	for i := range a.ids {
+		key := haloKey{a.ids[i], a.snaps[i]}
+		j, ok := bRows[key]
+		if !ok {
+			onlyA++
+			continue
+		} else if matched[key] {
+			continue
+		}
+		matched[key] = true
+
+		row := make([]float64, len(names))
+		over := false
+		for k, name := range names {
+			colA, _ := a.column(name)
+			colB, _ := b.column(name)
+			row[k] = columnDiff(a.vals, i, colA, b.vals, j, colB, absolute)
+			if tolerance > 0 && !(math.Abs(row[k]) <= tolerance) {
+				over = true
+			}
+		}
+		if over {
+			exceeded++
+		} else if tolerance > 0 {
+			continue
+		}
+
+		ids, snaps = append(ids, key.id), append(snaps, key.snap)
+		for k := range row {
+			diffs[k] = append(diffs[k], row[k])
+		}
+	}
+
+	outNames := make([]string, len(names))
+	for k, name := range names {
+		outNames[k] = name + "_rel_diff"
+		if absolute {
+			colA, _ := a.column(name)
+			outNames[k] = name + "_diff" + colA.Name[len(name):]
+		}
+	}
+
+	summary := []string{fmt.Sprintf(
+		"# Matched halos: %d, only in %s: %d, only in %s: %d",
+		len(matched), a.name, onlyA, b.name, len(bRows)-len(matched),
+	)}
+	if tolerance > 0 {
+		summary = append(summary, fmt.Sprintf(
+			"# Halos with differences larger than %g: %d",
+			tolerance, exceeded,
+		))
+	}
+	for k, name := range outNames {
+		mean, max := diffSummary(diffs[k])
+		summary = append(summary, fmt.Sprintf(
+			"# %s: mean |diff| = %.4g, max |diff| = %.4g", name, mean, max,
+		))
+	}
+
+	order := make([]int, 2+len(names))
+	sizes := make([]int, len(order))
+	for i := range order {
+		order[i], sizes[i] = i, 1
+	}
+	header := catalog.CommentString(
+		[]string{"ID", "Snapshot"}, outNames, order, sizes,
+	)
+	lines := catalog.FormatCols([][]int{ids, snaps}, diffs, order)
+
+	return append(append(summary, header), lines...), nil
+}
+
+// columnDiff returns the difference between a column in row i of the
+// catalog valsA and row j of valsB. Multi-element columns are compared by the
+// length of their difference vector.
+func columnDiff(
+	valsA [][]float64, i int, colA catalog.Column,
+	valsB [][]float64, j int, colB catalog.Column, absolute bool,
+) float64 {
+	diff2, norm2 := 0.0, 0.0
+	for k := 0; k <= colA.End-colA.Start; k++ {
+		x, y := valsA[colA.Start+k][i], valsB[colB.Start+k][j]
+		diff2 += (y - x) * (y - x)
+		norm2 += x * x
+	}
+
+	if colA.Start == colA.End {
+		x, y := valsA[colA.Start][i], valsB[colB.Start][j]
+		if absolute {
+			return y - x
+		}
+		return (y - x) / x
+	}
+	if absolute {
+		return math.Sqrt(diff2)
+	}
+	return math.Sqrt(diff2 / norm2)
+}
+
+// diffSummary returns the mean and maximum absolute values of a column of
+// differences, ignoring NaNs.
+func diffSummary(diffs []float64) (mean, max float64) {
+	n := 0
+	for _, d := range diffs {
+		if math.IsNaN(d) {
+			continue
+		}
+		d = math.Abs(d)
+		mean += d
+		if d > max {
+			max = d
+		}
+		n++
+	}
+	if n == 0 {
+		return math.NaN(), math.NaN()
+	}
+	return mean / float64(n), max
+}
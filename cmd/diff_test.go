@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+)
+
+func TestDiffCatalogs(t *testing.T) {
+	a, err := parseNamedCatalog("a.txt", []byte(
+		"# Column contents: ID(0) Snapshot(1) R_sp [cMpc/h](2) P_ijk(3-4)\n"+
+			"1 100 1.0 3 4\n"+
+			"2 100 2.0 1 0\n"+
+			"3 100 4.0 1 0\n",
+	))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	b, err := parseNamedCatalog("b.txt", []byte(
+		"# Column contents: ID(0) Snapshot(1) R_sp [cMpc/h](2) P_ijk(3-4)\n"+
+			"2 100 3.0 1 0\n"+
+			"1 100 1.0 3 4\n"+
+			"4 100 1.0 1 0\n",
+	))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	lines, err := diffCatalogs(a, b, nil, false, -1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := []string{
+		"# Matched halos: 2, only in a.txt: 1, only in b.txt: 1",
+		"# R_sp_rel_diff: mean |diff| = 0.25, max |diff| = 0.5",
+		"# P_ijk_rel_diff: mean |diff| = 0, max |diff| = 0",
+		"# Column contents: ID(0) Snapshot(1) R_sp_rel_diff(2) " +
+			"P_ijk_rel_diff(3)",
+	}
+	if len(lines) != len(expected)+2 {
+		t.Fatalf("Expected %d lines, got %v.", len(expected)+2, lines)
+	}
+	if !stringSlicesEqual(lines[:len(expected)], expected) {
+		t.Errorf("Expected header %v, got %v.", expected, lines[:len(expected)])
+	}
+
+	lines, err = diffCatalogs(a, b, []string{"R_sp"}, true, 0.1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 lines, got %v.", lines)
+	} else if lines[3] != "# Column contents: ID(0) Snapshot(1) "+
+		"R_sp_diff [cMpc/h](2)" {
+		t.Errorf("Got header %s.", lines[3])
+	}
+
+	if _, err = diffCatalogs(a, b, []string{"M_sp"}, false, -1); err == nil {
+		t.Errorf("Expected an error for a missing column.")
+	}
+}
+
+func TestColumnDiff(t *testing.T) {
+	vals := [][]float64{{2}, {3}, {4}}
+	other := [][]float64{{3}, {3}, {7}}
+	scalar := catalog.Column{Name: "R_sp", Start: 0, End: 0}
+	vector := catalog.Column{Name: "P_ijk", Start: 1, End: 2}
+
+	tests := []struct {
+		col      bool
+		absolute bool
+		diff     float64
+	}{
+		{false, false, 0.5},
+		{false, true, 1},
+		{true, false, 0.6},
+		{true, true, 3},
+	}
+
+	for i, test := range tests {
+		col := scalar
+		if test.col {
+			col = vector
+		}
+		diff := columnDiff(vals, 0, col, other, 0, col, test.absolute)
+		if math.Abs(diff-test.diff) > 1e-10 {
+			t.Errorf("%d) Expected %g, got %g.", i, test.diff, diff)
+		}
+	}
+}
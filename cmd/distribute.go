@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/logging"
+)
+
+// dialTimeout is how long a worker keeps trying to reach the coordinator
+// before giving up. Workers are often scheduled before the coordinator.
+const dialTimeout = 5 * time.Minute
+
+// acceptTimeout is how long the coordinator waits for every worker to connect
+// before giving up. Workers are often scheduled after the coordinator.
+const acceptTimeout = 5 * time.Minute
+
+// Distribution describes how a run is split across several nodes. One node,
+// rank 0, is the coordinator: it reads the input catalog, listens on Serve,
+// and waits for Ranks - 1 workers to connect to it. The other nodes are
+// workers, which connect to the coordinator's address, Connect.
+type Distribution struct {
+	Serve, Connect string
+	Ranks          int
+}
+
+// SplitDistributionFlags removes the --Serve, --Ranks, and --Connect flags
+// from a list of command line flags. dist is nil if none of them were given.
+func SplitDistributionFlags(
+	flags []string,
+) (rest []string, dist *Distribution, err error) {
+	rest, serve, err := SplitFlag(flags, "Serve")
+	if err != nil {
+		return nil, nil, err
+	}
+	rest, ranks, err := SplitFlag(rest, "Ranks")
+	if err != nil {
+		return nil, nil, err
+	}
+	rest, connect, err := SplitFlag(rest, "Connect")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if serve == "" && ranks == "" && connect == "" {
+		return rest, nil, nil
+	}
+
+	dist = &Distribution{Serve: serve, Connect: connect, Ranks: 1}
+	if connect != "" {
+		if serve != "" || ranks != "" {
+			return nil, nil, fmt.Errorf("The flag 'Connect' can't be " +
+				"used with the flags 'Serve' or 'Ranks'.")
+		}
+		return rest, dist, nil
+	}
+
+	if serve == "" {
+		return nil, nil, fmt.Errorf("The flag 'Ranks' was set, but " +
+			"'Serve' wasn't.")
+	}
+	if ranks != "" {
+		dist.Ranks, err = strconv.Atoi(ranks)
+		if err != nil || dist.Ranks < 1 {
+			return nil, nil, fmt.Errorf("The flag 'Ranks' was set to '%s', "+
+				"but it must be a positive integer.", ranks)
+		}
+	}
+	return rest, dist, nil
+}
+
+// DistributionHash returns a hash of the given config files and flags. The
+// coordinator and the workers must all have the same hash, so that every
+// node analyzes its halos in the same way.
+func DistributionHash(fnames, flags []string) (string, error) {
+	h := sha1.New()
+	for _, fname := range fnames {
+		text, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return "", err
+		}
+		h.Write(text)
+	}
+	h.Write([]byte(strings.Join(flags, " ")))
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// distTask is the message that the coordinator broadcasts to each worker.
+// Input is the full input catalog, which contains the snapshot index of
+// every halo, and each worker analyzes the rows in shard Rank of Ranks.
+type distTask struct {
+	Rank, Ranks      int
+	Mode, ConfigHash string
+	Input            []byte
+}
+
+// distResult is the message that each worker sends back to the coordinator.
+// Err is "" if the worker succeeded.
+type distResult struct {
+	Lines []string
+	Err   string
+}
+
+// RunCoordinator runs the coordinator of a distributed run. It waits for
+// dist.Ranks - 1 workers to connect, sends each of them the input catalog,
+// analyzes shard 0 itself with run, and gathers every shard's output lines
+// into a single catalog.
+func RunCoordinator(
+	dist *Distribution, mode, configHash string, stdin []byte,
+	run func([]byte) ([]string, error),
+) ([]string, error) {
+	addr, err := net.ResolveTCPAddr("tcp", dist.Serve)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	task := &distTask{
+		Ranks: dist.Ranks, Mode: mode, ConfigHash: configHash, Input: stdin,
+	}
+	return coordinate(ln, task, run, acceptTimeout)
+}
+
+// coordinate runs a coordinator which accepts workers from ln. Workers are
+// given ranks in the order they connect, and an error is returned if they
+// haven't all connected within timeout.
+func coordinate(
+	ln *net.TCPListener, task *distTask, run func([]byte) ([]string, error),
+	timeout time.Duration,
+) ([]string, error) {
+	if err := ln.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	defer ln.SetDeadline(time.Time{})
+
+	conns := make([]net.Conn, task.Ranks)
+	for r := 1; r < task.Ranks; r++ {
+		if logging.Mode != logging.Nil {
+			log.Printf("Waiting for rank %d of %d on %s.",
+				r, task.Ranks, ln.Addr().String())
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, missingRanksError(r, task.Ranks, ln, timeout)
+			}
+			return nil, err
+		}
+		defer conn.Close()
+		conns[r] = conn
+	}
+
+	outs, errs := make([][]string, task.Ranks), make([]error, task.Ranks)
+	wg := &sync.WaitGroup{}
+	for r := 1; r < task.Ranks; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			rTask := *task
+			rTask.Rank = r
+			outs[r], errs[r] = runRemote(conns[r], &rTask)
+		}(r)
+	}
+	outs[0], errs[0] = runShard(task.Input, 0, task.Ranks, run)
+	wg.Wait()
+
+	names := make([]string, task.Ranks)
+	texts := make([][]byte, task.Ranks)
+	for r := range outs {
+		if errs[r] != nil {
+			return nil, fmt.Errorf("Rank %d of %d failed:\n%s",
+				r, task.Ranks, errs[r].Error())
+		}
+		names[r] = fmt.Sprintf("from rank %d", r)
+		texts[r] = pipelineLines(outs[r])
+	}
+
+	return mergeShards(names, texts, true)
+}
+
+// missingRanksError returns the error reported when only ranks 1 to r - 1
+// connected before the timeout.
+func missingRanksError(
+	r, ranks int, ln net.Listener, timeout time.Duration,
+) error {
+	missing := make([]string, 0, ranks-r)
+	for ; r < ranks; r++ {
+		missing = append(missing, fmt.Sprint(r))
+	}
+	return fmt.Errorf("Rank(s) %s of %d never connected to the coordinator "+
+		"at %s within %s.", strings.Join(missing, ", "), ranks,
+		ln.Addr().String(), timeout.String())
+}
+
+// runRemote sends a task to a worker and waits for its output.
+func runRemote(conn net.Conn, task *distTask) ([]string, error) {
+	if err := gob.NewEncoder(conn).Encode(task); err != nil {
+		return nil, err
+	}
+	res := &distResult{}
+	if err := gob.NewDecoder(conn).Decode(res); err != nil {
+		return nil, err
+	}
+	if res.Err != "" {
+		return nil, fmt.Errorf("%s", res.Err)
+	}
+	return res.Lines, nil
+}
+
+// RunWorker runs a worker of a distributed run. It connects to the
+// coordinator at dist.Connect, analyzes its shard of the coordinator's input
+// catalog with run, and sends the output lines back. Its output isn't
+// returned, since the coordinator prints the full catalog.
+func RunWorker(
+	dist *Distribution, mode, configHash string,
+	run func([]byte) ([]string, error),
+) error {
+	conn, err := dialCoordinator(dist.Connect)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	task := &distTask{}
+	if err := gob.NewDecoder(conn).Decode(task); err != nil {
+		return err
+	}
+
+	var lines []string
+	switch {
+	case task.Mode != mode:
+		err = fmt.Errorf("The coordinator is running mode %s, but this "+
+			"worker is running mode %s.", task.Mode, mode)
+	case task.ConfigHash != configHash:
+		err = fmt.Errorf("Rank %d was given different config files or "+
+			"flags than the coordinator.", task.Rank)
+	default:
+		if logging.Mode != logging.Nil {
+			log.Printf("Running rank %d of %d.", task.Rank, task.Ranks)
+		}
+		lines, err = runShard(task.Input, task.Rank, task.Ranks, run)
+	}
+
+	res := &distResult{Lines: lines}
+	if err != nil {
+		res.Err = err.Error()
+	}
+	if encErr := gob.NewEncoder(conn).Encode(res); encErr != nil && err == nil {
+		err = encErr
+	}
+	return err
+}
+
+// runShard runs a mode on shard i of n of an input catalog. Shards without
+// any rows aren't run, in the same way that modes aren't run on empty input.
+func runShard(
+	in []byte, i, n int, run func([]byte) ([]string, error),
+) ([]string, error) {
+	shard := ShardCatalog(in, i, n)
+	if !HasRows(shard) {
+		return []string{}, nil
+	}
+	return run(shard)
+}
+
+// dialCoordinator connects to the coordinator, retrying until dialTimeout
+// has passed.
+func dialCoordinator(addr string) (net.Conn, error) {
+	start := time.Now()
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn, nil
+		} else if time.Since(start) > dialTimeout {
+			return nil, fmt.Errorf("Couldn't connect to the coordinator "+
+				"at %s: %s", addr, err.Error())
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitDistributionFlags(t *testing.T) {
+	tests := []struct {
+		flags []string
+		dist  *Distribution
+		valid bool
+	}{
+		{[]string{"--Snap", "100"}, nil, true},
+		{[]string{"--Serve", ":5000", "--Ranks", "4"},
+			&Distribution{Serve: ":5000", Ranks: 4}, true},
+		{[]string{"--Serve", ":5000"},
+			&Distribution{Serve: ":5000", Ranks: 1}, true},
+		{[]string{"--Connect", "node1:5000"},
+			&Distribution{Connect: "node1:5000", Ranks: 1}, true},
+		{[]string{"--Ranks", "4"}, nil, false},
+		{[]string{"--Serve", ":5000", "--Ranks", "0"}, nil, false},
+		{[]string{"--Connect", "node1:5000", "--Ranks", "4"}, nil, false},
+	}
+
+	for i, test := range tests {
+		_, dist, err := SplitDistributionFlags(test.flags)
+		if (err == nil) != test.valid {
+			t.Errorf("%d) Expected valid = %v, got error %v.",
+				i, test.valid, err)
+		} else if !test.valid {
+			continue
+		} else if (dist == nil) != (test.dist == nil) ||
+			(dist != nil && *dist != *test.dist) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.dist, dist)
+		}
+	}
+}
+
+func TestCoordinate(t *testing.T) {
+	in := "# Column contents: ID(0) Snapshot(1)\n"
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		in += id + " 100\n"
+	}
+	run := func(data []byte) ([]string, error) {
+		lines := []string{"# Column contents: ID(0) Snapshot(1) X(2)"}
+		for _, line := range strings.Split(string(data), "\n") {
+			if len(line) > 0 && line[0] != '#' {
+				lines = append(lines, line+" 1.5")
+			}
+		}
+		return lines, nil
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Couldn't listen on loopback: %s", err.Error())
+	}
+	defer ln.Close()
+
+	ranks := 3
+	errs := make(chan error, ranks-1)
+	for r := 1; r < ranks; r++ {
+		go func() {
+			dist := &Distribution{Connect: ln.Addr().String()}
+			errs <- RunWorker(dist, "stats", "hash", run)
+		}()
+	}
+
+	task := &distTask{Ranks: ranks, Mode: "stats", ConfigHash: "hash",
+		Input: []byte(in)}
+	lines, err := coordinate(ln, task, run, time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for r := 1; r < ranks; r++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Unexpected worker error: %s", err.Error())
+		}
+	}
+
+	if len(lines) != 9 {
+		t.Fatalf("Expected 9 lines, got %d: %v", len(lines), lines)
+	}
+	rows := append([]string{}, lines[1:]...)
+	sort.Strings(rows)
+	for i, row := range rows {
+		expected := string('1'+byte(i)) + " 100 1.5"
+		if row != expected {
+			t.Errorf("Expected row %d to be '%s', got '%s'.",
+				i, expected, row)
+		}
+	}
+
+	// Workers with different config files are rejected.
+	go func() {
+		dist := &Distribution{Connect: ln.Addr().String()}
+		errs <- RunWorker(dist, "stats", "other hash", run)
+	}()
+	task.Ranks = 2
+	if _, err = coordinate(ln, task, run, time.Minute); err == nil {
+		t.Errorf("Expected an error for mismatched config hashes.")
+	}
+	if err = <-errs; err == nil {
+		t.Errorf("Expected the mismatched worker to return an error.")
+	}
+
+	// Coordinators give up on workers which never connect.
+	go func() {
+		dist := &Distribution{Connect: ln.Addr().String()}
+		errs <- RunWorker(dist, "stats", "hash", run)
+	}()
+	task.Ranks = 4
+	_, err = coordinate(ln, task, run, 500*time.Millisecond)
+	if err == nil {
+		t.Errorf("Expected an error when workers never connect.")
+	} else if !strings.Contains(err.Error(), "Rank(s) 2, 3 of 4") {
+		t.Errorf("Expected the error to name ranks 2 and 3, got '%s'.",
+			err.Error())
+	}
+	<-errs
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"math"
+
+	"github.com/phil-mansfield/shellfish/math/optimize"
+)
+
+// dk14Profile is the density profile of Diemer & Kravtsov (2014): an Einasto
+// profile which is steepened by a transition term and added to a power law
+// outer profile. Radii are comoving and rhoM is the comoving mean density.
+type dk14Profile struct {
+	rhoS, rS, alpha, rT, bE, sE float64
+	beta, gamma, rhoM, r200m    float64
+}
+
+// dk14ParamNum is the number of free parameters in a dk14Profile fit.
+const dk14ParamNum = 6
+
+// rho returns the density of the profile at r.
+func (p *dk14Profile) rho(r float64) float64 {
+	inner, _ := p.inner(r)
+	outer, _ := p.outer(r)
+	return inner + outer
+}
+
+// slope returns the logarithmic slope of the profile, dln(rho)/dln(r), at r.
+func (p *dk14Profile) slope(r float64) float64 {
+	inner, dInner := p.inner(r)
+	outer, dOuter := p.outer(r)
+	return (dInner + dOuter) / (inner + outer)
+}
+
+// inner returns the Einasto and transition terms of the profile and their
+// derivative with respect to ln(r).
+func (p *dk14Profile) inner(r float64) (rho, dRho float64) {
+	xs, xt := math.Pow(r/p.rS, p.alpha), math.Pow(r/p.rT, p.beta)
+	rho = p.rhoS * math.Exp(-2/p.alpha*(xs-1)) *
+		math.Pow(1+xt, -p.gamma/p.beta)
+	return rho, rho * (-2*xs - p.gamma*xt/(1+xt))
+}
+
+// outer returns the outer term of the profile and its derivative with
+// respect to ln(r).
+func (p *dk14Profile) outer(r float64) (rho, dRho float64) {
+	x := math.Pow(r/(5*p.r200m), -p.sE)
+	return p.rhoM * (p.bE*x + 1), -p.rhoM * p.sE * p.bE * x
+}
+
+// setParams sets the free parameters of the profile from a vector of
+// ln(rho_s), ln(r_s), ln(alpha), ln(r_t), ln(b_e), and s_e.
+func (p *dk14Profile) setParams(params []float64) {
+	p.rhoS, p.rS = math.Exp(params[0]), math.Exp(params[1])
+	p.alpha, p.rT = math.Exp(params[2]), math.Exp(params[3])
+	p.bE, p.sE = math.Exp(params[4]), params[5]
+}
+
+// splashbackRadius returns the radius in [rMin, rMax] where the profile's
+// logarithmic slope is most negative. ok is false if the minimum is at either
+// end of the range.
+func (p *dk14Profile) splashbackRadius(rMin, rMax float64) (r float64, ok bool) {
+	return steepestSlopeRadius(p.slope, rMin, rMax)
+}
+
+// steepestSlopeRadius returns the radius in [rMin, rMax] where the
+// logarithmic slope of a profile is most negative. ok is false if the minimum
+// is at either end of the range.
+func steepestSlopeRadius(
+	slope func(r float64) float64, rMin, rMax float64,
+) (r float64, ok bool) {
+	n := 1000
+	dlr := (math.Log(rMax) - math.Log(rMin)) / float64(n-1)
+
+	iMin, minSlope := -1, math.Inf(+1)
+	for i := 0; i < n; i++ {
+		s := slope(rMin * math.Exp(dlr*float64(i)))
+		if s < minSlope {
+			iMin, minSlope = i, s
+		}
+	}
+
+	if iMin <= 0 || iMin >= n-1 {
+		return math.NaN(), false
+	}
+	return rMin * math.Exp(dlr*float64(iMin)), true
+}
+
+// fitDK14 fits a DK14 profile to the density profile rhos, measured at radii
+// rs, by minimizing the squared difference in ln(rho). beta and gamma are held
+// fixed. Empty bins are ignored. ok is false if there are too few non-empty
+// bins or if the fit doesn't converge.
+func fitDK14(
+	rs, rhos []float64, r200m, rhoM, beta, gamma float64,
+) (p *dk14Profile, ok bool) {
+	p = &dk14Profile{beta: beta, gamma: gamma, rhoM: rhoM, r200m: r200m}
+
+	fitRs, lnRhos := []float64{}, []float64{}
+	for i := range rs {
+		if rhos[i] > 0 {
+			fitRs = append(fitRs, rs[i])
+			lnRhos = append(lnRhos, math.Log(rhos[i]))
+		}
+	}
+	if len(fitRs) <= dk14ParamNum {
+		return p, false
+	}
+
+	// Start from an Einasto profile with typical parameters which is
+	// normalized to the density at r_s.
+	rS := 0.2 * r200m
+	lnRhoS := lnRhos[0]
+	for i := range fitRs {
+		lnRhoS = lnRhos[i]
+		if fitRs[i] >= rS {
+			break
+		}
+	}
+	p0 := []float64{
+		lnRhoS, math.Log(rS), math.Log(0.2), math.Log(r200m), 0, 1.5,
+	}
+
+	residuals := func(params, out []float64) {
+		p.setParams(params)
+		for i := range fitRs {
+			out[i] = math.Log(p.rho(fitRs[i])) - lnRhos[i]
+		}
+	}
+
+	params, _, ok := optimize.LevenbergMarquardt(
+		residuals, p0, len(fitRs), optimize.MaxIter(2000),
+	)
+	p.setParams(params)
+	return p, ok
+}
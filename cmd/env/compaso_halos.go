@@ -0,0 +1,68 @@
+package env
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// compaSODir is a CompaSO snapshot directory, e.g. "z0.500".
+type compaSODir struct {
+	name string
+	z    float64
+}
+
+type compaSODirs []compaSODir
+
+func (ds compaSODirs) Len() int           { return len(ds) }
+func (ds compaSODirs) Less(i, j int) bool { return ds[i].z > ds[j].z }
+func (ds compaSODirs) Swap(i, j int)      { ds[i], ds[j] = ds[j], ds[i] }
+
+// InitCompaSOHalo initializes h for CompaSO catalogs. These are stored as
+// one directory per snapshot named after the snapshot's redshift (e.g.
+// z0.500/), so the directories are sorted by decreasing redshift rather than
+// alphabetically.
+func (h *Halos) InitCompaSOHalo(info *HaloInfo) error {
+	h.HaloType = CompaSO
+	h.TreeType = ConsistentTrees
+
+	infos, err := ioutil.ReadDir(info.HaloDir)
+	if err != nil {
+		return err
+	}
+
+	dirs := compaSODirs{}
+	for i := range infos {
+		name := infos[i].Name()
+		if !infos[i].IsDir() || len(name) < 2 || name[0] != 'z' {
+			continue
+		}
+		z, err := strconv.ParseFloat(name[1:], 64)
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, compaSODir{name, z})
+	}
+	sort.Sort(dirs)
+
+	h.snapOffset = int(info.HSnapMax) - len(dirs)
+
+	h.snapMin = int(info.HSnapMin)
+	h.names = []string{}
+	for i := range dirs {
+		h.names = append(h.names, path.Join(info.HaloDir, dirs[i].name))
+	}
+
+	if len(h.names) < int(info.HSnapMax-info.HSnapMin)+1 {
+		return fmt.Errorf(
+			"There are %d redshift directories in the 'HaloDir' directory, "+
+				"%s, but 'SnapMin' = %d and 'SnapMax' = %d.",
+			len(h.names), info.HaloDir, info.HSnapMin, info.HSnapMax,
+		)
+	}
+	h.names = h.names[len(h.names)-int(info.HSnapMax-info.HSnapMin+1):]
+
+	return nil
+}
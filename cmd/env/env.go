@@ -28,6 +28,7 @@ const (
 
 	Rockstar HaloType = iota
 	NilHalo
+	CompaSO
 
 	ConsistentTrees TreeType = iota
 	NilTree
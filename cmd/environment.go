@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// EnvironmentConfig contains the configuration fields for the 'environment'
+// mode of the shellfish tool.
+type EnvironmentConfig struct {
+	radii []float64
+	cells int64
+}
+
+var _ Mode = &EnvironmentConfig{}
+
+// ExampleConfig creates an example environment.config file.
+func (config *EnvironmentConfig) ExampleConfig() string {
+	return `[environment.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The environment tool measures the overdensity, delta = rho / rho_mean - 1,
+# within spheres of several radii around each input halo and appends them to
+# the input catalog as new columns. The particles of each snapshot are binned
+# onto a coarse grid, in the same way as the EnvironmentRadius variable of the
+# id tool.
+
+# Radii is the list of smoothing radii in comoving Mpc/h. Each radius should
+# be at least a few times larger than the width of a grid cell. Defaults to
+# 2, 5, 10.
+#
+# Radii = 2, 5, 10
+
+# Cells is the number of grid cells on each side of the box. Defaults to 64.
+#
+# Cells = 64`
+}
+
+// ReadConfig reads in an environment.config file into config.
+func (config *EnvironmentConfig) ReadConfig(
+	fname string, flags []string,
+) error {
+	vars := parse.NewConfigVars("environment.config")
+	vars.Floats(&config.radii, "Radii", []float64{2, 5, 10})
+	vars.Int(&config.cells, "Cells", 64)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *EnvironmentConfig) validate() error {
+	if len(config.radii) == 0 {
+		return fmt.Errorf("The 'Radii' variable is empty.")
+	}
+	for _, r := range config.radii {
+		if r <= 0 {
+			return fmt.Errorf("The 'Radii' variable contains %g, but every "+
+				"radius needs to be positive.", r)
+		}
+	}
+	if config.cells <= 0 {
+		return fmt.Errorf("The 'Cells' variable is set to %d, but it "+
+			"needs to be positive.", config.cells)
+	}
+	return nil
+}
+
+// Run executes the environment mode of the shellfish tool.
+func (config *EnvironmentConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+###########################
+## shellfish environment ##
+###########################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, coords, err := catalog.Parse(
+		stdin, []int{0, 1}, []int{2, 3, 4},
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = readInputUnits(
+		stdin, snaps, coords, repeatKind(lengthUnit, 3), buf, e,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas := make([][]float64, len(config.radii))
+	for k := range deltas {
+		deltas[k] = make([]float64, len(ids))
+	}
+
+	_, idxBins := binBySnap(snaps, ids)
+	for snap, idxs := range idxBins {
+		if snap == -1 {
+			for _, i := range idxs {
+				for k := range deltas {
+					deltas[k][i] = math.NaN()
+				}
+			}
+			continue
+		}
+
+		hds, files, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+
+		g := halo.NewDensityGrid(int(config.cells), hds[0].TotalWidth)
+		for i := range files {
+			xs, _, ms, _, err := buf.Read(files[i])
+			if err != nil {
+				return nil, err
+			}
+			g.Insert(xs, ms)
+			buf.Close()
+		}
+
+		for _, i := range idxs {
+			pos := [3]float64{coords[0][i], coords[1][i], coords[2][i]}
+			for k, r := range config.radii {
+				deltas[k][i] = g.Overdensity(pos, r) - 1
+			}
+		}
+	}
+
+	names := make([]string, len(config.radii))
+	for k, r := range config.radii {
+		names[k] = fmt.Sprintf("delta_%g", r)
+	}
+	lines, err := appendColumns(stdin, names, deltas)
+	if err != nil {
+		return nil, err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return lines, nil
+}
+
+// appendColumns returns the lines of an input catalog with the given columns
+// added to the end of each row. Comment lines are kept, and the new columns
+// are added to the input's "# Column contents:" line. If the input doesn't
+// have one, a line which refers to every input column as "Input" is added.
+func appendColumns(
+	stdin []byte, names []string, cols [][]float64,
+) ([]string, error) {
+	order := make([]int, len(cols))
+	for i := range order {
+		order[i] = i
+	}
+	rows := catalog.FormatCols([][]int{}, cols, order)
+
+	lines, header, width := []string{}, -1, -1
+	j := 0
+	for _, line := range strings.Split(string(stdin), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case len(trimmed) == 0:
+			continue
+		case trimmed[0] == '#':
+			if strings.HasPrefix(trimmed, "# Column contents:") {
+				header = len(lines)
+			}
+			lines = append(lines, trimmed)
+			continue
+		}
+
+		if j >= len(rows) {
+			return nil, fmt.Errorf("The input catalog has more rows " +
+				"than were parsed.")
+		}
+		if width == -1 {
+			width = len(strings.Fields(trimmed))
+		}
+		lines = append(lines, trimmed+" "+rows[j])
+		j++
+	}
+	if j != len(rows) {
+		return nil, fmt.Errorf("The input catalog has %d rows, but %d "+
+			"values were computed.", j, len(rows))
+	}
+
+	if header != -1 {
+		cs := catalog.Columns([]byte(lines[header]))
+		n := 0
+		if len(cs) > 0 {
+			n = cs[len(cs)-1].End + 1
+		}
+		tokens := []string{lines[header]}
+		for k, name := range names {
+			tokens = append(tokens, fmt.Sprintf("%s(%d)", name, n+k))
+		}
+		lines[header] = strings.Join(tokens, " ")
+		return lines, nil
+	}
+
+	sizes := []int{width}
+	cOrder := []int{0}
+	for k := range names {
+		sizes = append(sizes, 1)
+		cOrder = append(cOrder, k+1)
+	}
+	cString := catalog.CommentString(
+		[]string{}, append([]string{"Input"}, names...), cOrder, sizes,
+	)
+
+	// Keep the new header after any other comments, like the units.
+	for i := range lines {
+		if !strings.HasPrefix(lines[i], "#") {
+			return append(
+				append(append([]string{}, lines[:i]...), cString),
+				lines[i:]...,
+			), nil
+		}
+	}
+	return append(lines, cString), nil
+}
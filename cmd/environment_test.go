@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestAppendColumns(t *testing.T) {
+	names := []string{"delta_2", "delta_5"}
+	cols := [][]float64{{1.5, -0.5}, {0.25, 2}}
+
+	tests := []struct {
+		in       string
+		expected []string
+	}{
+		{
+			"# Units: cMpc/h\n# Column contents: ID(0) Snapshot(1) P(2-3)\n" +
+				"1 100 2 3\n\n2 100 4 5\n",
+			[]string{
+				"# Units: cMpc/h",
+				"# Column contents: ID(0) Snapshot(1) P(2-3) delta_2(4) " +
+					"delta_5(5)",
+				"1 100 2 3  1.5 0.25",
+				"2 100 4 5 -0.5    2",
+			},
+		},
+		{
+			"1 100 2\n2 100 4\n",
+			[]string{
+				"# Column contents: Input(0-2) delta_2(3) delta_5(4)",
+				"1 100 2  1.5 0.25",
+				"2 100 4 -0.5    2",
+			},
+		},
+	}
+
+	for i := range tests {
+		lines, err := appendColumns([]byte(tests[i].in), names, cols)
+		if err != nil {
+			t.Errorf("%d) Unexpected error: %s", i, err.Error())
+		} else if !stringSlicesEqual(lines, tests[i].expected) {
+			t.Errorf("%d) Expected %q, got %q.", i, tests[i].expected, lines)
+		}
+	}
+
+	if _, err := appendColumns([]byte("1 100 2\n"), names, cols); err == nil {
+		t.Errorf("Expected an error for mismatched rows.")
+	}
+}
@@ -0,0 +1,375 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/math/optimize"
+	"github.com/phil-mansfield/shellfish/math/rand"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// FitConfig contains the configuration fields for the 'fit' mode of the
+// shellfish tool.
+type FitConfig struct {
+	gammaFile  string
+	quantity   string
+	nuName     string
+	bootstraps int64
+}
+
+var _ Mode = &FitConfig{}
+
+// fitParamNames are the names of the parameters of halo.SplashbackRelation.
+var fitParamNames = []string{"A", "B", "C", "D", "E"}
+
+// ExampleConfig creates an example fit.config file.
+func (config *FitConfig) ExampleConfig() string {
+	return `[fit.config]
+
+#####################
+## Required Fields ##
+#####################
+
+# The fit tool fits the relation
+#
+#     Quantity = A (1 + B Omega_m(z)) (1 + C exp(-Gamma / D)) nu^E
+#
+# to a catalog written by the stats tool, where Gamma is each halo's accretion
+# rate and nu is its peak height. This is the form used by More, Diemer, &
+# Kravtsov (2015), whose fits are the starting point. The fit minimizes the
+# squared difference in ln(Quantity), and the scatter is the standard deviation
+# of these differences around the best fit.
+
+# GammaFile is the name of a file containing the output of shellfish gamma for
+# the input halos. Halos which aren't in it aren't used in the fit.
+GammaFile = gamma.txt
+
+#####################
+## Optional Fields ##
+#####################
+
+# Quantity is the name of the input column that is fit. The stats tool writes
+# R_sp/R200m and M_sp/M200m when NormalizedColumns is true. Defaults to
+# R_sp/R200m.
+#
+# Quantity = R_sp/R200m
+
+# NuName is the name of a halo catalog variable (see HaloValueNames in the
+# global config file) which contains each halo's peak height. If it isn't set,
+# the relation doesn't depend on nu and E isn't fit.
+#
+# NuName = nu
+
+# Bootstraps is the number of times the relation is refit to halos drawn with
+# replacement from the input. The standard deviation of the parameters across
+# these fits is reported as their uncertainty. Defaults to 100.
+#
+# Bootstraps = 100`
+}
+
+// ReadConfig reads in a fit.config file into config.
+func (config *FitConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("fit.config")
+	vars.String(&config.gammaFile, "GammaFile", "")
+	vars.String(&config.quantity, "Quantity", "R_sp/R200m")
+	vars.String(&config.nuName, "NuName", "")
+	vars.Int(&config.bootstraps, "Bootstraps", 100)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *FitConfig) validate() error {
+	if config.gammaFile == "" {
+		return fmt.Errorf("The variable 'GammaFile' was not set.")
+	}
+	if config.quantity == "" {
+		return fmt.Errorf("The 'Quantity' variable is empty.")
+	}
+	if config.bootstraps < 0 {
+		return fmt.Errorf("The 'Bootstraps' variable is set to %d, but it "+
+			"can't be negative.", config.bootstraps)
+	}
+	return nil
+}
+
+// Run executes the fit mode of the shellfish tool.
+func (config *FitConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+###################
+## shellfish fit ##
+###################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, _, err := catalog.Parse(stdin, []int{0, 1}, []int{})
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	ys, err := readQuantity(stdin, config.quantity)
+	if err != nil {
+		return nil, err
+	}
+	gammas, err := readGammas(config.gammaFile, ids, snaps)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+	omegas, err := snapOmegaMs(snaps, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	var nus []float64
+	if config.nuName != "" {
+		vars, err := haloVarColumns(gConfig)
+		if err != nil {
+			return nil, err
+		}
+		cols, err := readHaloCoords(
+			ids, snaps, []string{config.nuName}, vars, buf, e, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+		nus = cols[0]
+	}
+
+	data := newFitData(snaps, ys, gammas, omegas, nus)
+	if len(data.ys) == 0 {
+		return nil, fmt.Errorf("None of the input halos have a valid %s "+
+			"and Gamma.", config.quantity)
+	}
+
+	p0 := append([]float64{}, halo.MoreRspParams...)
+	if baseColumnName(config.quantity) == "M_sp/M200m" {
+		p0 = append([]float64{}, halo.MoreMspParams...)
+	}
+	if nus != nil {
+		p0 = append(p0, 0)
+	}
+
+	params, scatter, ok := data.fit(p0)
+	if !ok {
+		return nil, fmt.Errorf("The fit to %s didn't converge.",
+			config.quantity)
+	}
+	errs := data.bootstrap(params, int(config.bootstraps), randSeed)
+
+	lines := fitCatalog(config.quantity, len(data.ys), params, errs, scatter)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return lines, nil
+}
+
+// readQuantity reads the input column with the given name, ignoring units.
+func readQuantity(stdin []byte, name string) ([]float64, error) {
+	idx := -1
+	for _, col := range catalog.Columns(stdin) {
+		if baseColumnName(col.Name) == baseColumnName(name) &&
+			col.Start == col.End {
+			idx = col.Start
+		}
+	}
+	if idx == -1 {
+		return nil, fmt.Errorf("The input catalog doesn't have a '%s' "+
+			"column.", name)
+	}
+
+	_, cols, err := catalog.Parse(stdin, []int{}, []int{idx})
+	if err != nil {
+		return nil, err
+	}
+	return cols[0], nil
+}
+
+// snapOmegaMs returns Omega_m(z) at the snapshot of each halo. Sentinel
+// snapshots are given NaN.
+func snapOmegaMs(
+	snaps []int, buf io.VectorBuffer, e *env.Environment,
+) ([]float64, error) {
+	omegaMs := map[int]float64{}
+	out := make([]float64, len(snaps))
+	for i, snap := range snaps {
+		if snap == -1 {
+			out[i] = math.NaN()
+			continue
+		}
+		if _, ok := omegaMs[snap]; !ok {
+			hds, _, err := memo.ReadHeaders(snap, buf, e)
+			if err != nil {
+				return nil, err
+			}
+			omegaMs[snap] = halo.OmegaMZ(&hds[0].Cosmo)
+		}
+		out[i] = omegaMs[snap]
+	}
+	return out, nil
+}
+
+// fitData contains the halos which a relation is fit to.
+type fitData struct {
+	ys, gammas, omegas, nus []float64
+}
+
+// newFitData returns the halos which have a positive quantity, a finite
+// accretion rate, and, if nus isn't nil, a positive peak height.
+func newFitData(snaps []int, ys, gammas, omegas, nus []float64) *fitData {
+	d := &fitData{}
+	for i := range ys {
+		switch {
+		case snaps[i] == -1, !(ys[i] > 0), math.IsInf(ys[i], 0),
+			math.IsNaN(gammas[i]), math.IsInf(gammas[i], 0):
+			continue
+		case nus != nil && !(nus[i] > 0):
+			continue
+		}
+
+		d.ys = append(d.ys, ys[i])
+		d.gammas = append(d.gammas, gammas[i])
+		d.omegas = append(d.omegas, omegas[i])
+		if nus != nil {
+			d.nus = append(d.nus, nus[i])
+		} else {
+			d.nus = append(d.nus, 1)
+		}
+	}
+	return d
+}
+
+// residuals writes the difference between ln(y) and the log of the relation
+// with the given parameters to out.
+func (d *fitData) residuals(params, out []float64) {
+	for i := range d.ys {
+		y := halo.SplashbackRelation(
+			params, d.gammas[i], d.omegas[i], d.nus[i],
+		)
+		out[i] = math.Log(d.ys[i]) - math.Log(y)
+	}
+}
+
+// fit fits the relation to the data starting from p0 and returns the best-fit
+// parameters and the standard deviation of the residuals in ln(y).
+func (d *fitData) fit(
+	p0 []float64,
+) (params []float64, scatter float64, ok bool) {
+	if len(d.ys) <= len(p0) {
+		return p0, math.NaN(), false
+	}
+	params, chi2, ok := optimize.LevenbergMarquardt(
+		d.residuals, p0, len(d.ys), optimize.MaxIter(2000),
+	)
+	scatter = math.Sqrt(chi2 / float64(len(d.ys)-len(p0)))
+	return params, scatter, ok
+}
+
+// bootstrap refits the relation n times to halos drawn with replacement,
+// starting from params, and returns the standard deviation of each parameter.
+// Fits which don't converge are skipped.
+func (d *fitData) bootstrap(params []float64, n int, seed uint64) []float64 {
+	samples := make([][]float64, len(params))
+	gen := rand.New(rand.Xorshift, seed)
+	resampled := &fitData{
+		ys: make([]float64, len(d.ys)), gammas: make([]float64, len(d.ys)),
+		omegas: make([]float64, len(d.ys)), nus: make([]float64, len(d.ys)),
+	}
+
+	for b := 0; b < n; b++ {
+		for i := range d.ys {
+			j := gen.UniformInt(0, len(d.ys))
+			resampled.ys[i], resampled.gammas[i] = d.ys[j], d.gammas[j]
+			resampled.omegas[i], resampled.nus[i] = d.omegas[j], d.nus[j]
+		}
+		ps, _, ok := resampled.fit(params)
+		if !ok {
+			continue
+		}
+		for k := range ps {
+			samples[k] = append(samples[k], ps[k])
+		}
+	}
+
+	errs := make([]float64, len(params))
+	for k := range errs {
+		errs[k] = stdDev(samples[k])
+	}
+	return errs
+}
+
+// fitCatalog returns the lines of the fit tool's output catalog, which has a
+// single row.
+func fitCatalog(
+	quantity string, n int, params, errs []float64, scatter float64,
+) []string {
+	floatNames, floatCols := []string{}, [][]float64{}
+	for k := range params {
+		name := fitParamNames[k]
+		floatNames = append(floatNames, name, name+"_err")
+		floatCols = append(floatCols,
+			[]float64{params[k]}, []float64{errs[k]})
+	}
+	floatNames = append(floatNames, "Scatter")
+	floatCols = append(floatCols, []float64{scatter})
+
+	order := make([]int, 1+len(floatCols))
+	sizes := make([]int, len(order))
+	for i := range order {
+		order[i], sizes[i] = i, 1
+	}
+	lines := catalog.FormatCols([][]int{{n}}, floatCols, order)
+	cString := catalog.CommentString(
+		[]string{"N"}, floatNames, order, sizes,
+	)
+
+	model := fmt.Sprintf("# Model: %s = A (1 + B Omega_m(z)) "+
+		"(1 + C exp(-Gamma / D))", quantity)
+	if len(params) > 4 {
+		model += " nu^E"
+	}
+	return append([]string{model, cString}, lines...)
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/math/rand"
+)
+
+func TestNewFitData(t *testing.T) {
+	nan := math.NaN()
+	snaps := []int{100, -1, 100, 100, 100}
+	ys := []float64{1, 1, -1, 1, 1}
+	gammas := []float64{1, 1, 1, nan, 2}
+	omegas := []float64{0.3, 0.3, 0.3, 0.3, 0.3}
+
+	d := newFitData(snaps, ys, gammas, omegas, nil)
+	if len(d.ys) != 2 || d.gammas[1] != 2 || d.nus[1] != 1 {
+		t.Errorf("Expected halos 0 and 4 with nu = 1, got %+v.", d)
+	}
+
+	nus := []float64{1, 1, 1, 1, 0}
+	d = newFitData(snaps, ys, gammas, omegas, nus)
+	if len(d.ys) != 1 {
+		t.Errorf("Expected only halo 0, got %+v.", d)
+	}
+}
+
+func TestFitDataFit(t *testing.T) {
+	truth := []float64{0.6, 0.4, 1.2, 2.5, 0.1}
+	gen := rand.New(rand.Xorshift, 1)
+
+	d := &fitData{}
+	for i := 0; i < 2000; i++ {
+		gamma, omega := gen.Uniform(0, 6), gen.Uniform(0.3, 1)
+		nu := gen.Uniform(0.5, 4)
+		y := halo.SplashbackRelation(truth, gamma, omega, nu)
+		d.ys = append(d.ys, y*math.Exp(gen.Uniform(-0.1, 0.1)))
+		d.gammas = append(d.gammas, gamma)
+		d.omegas = append(d.omegas, omega)
+		d.nus = append(d.nus, nu)
+	}
+
+	p0 := append(append([]float64{}, halo.MoreRspParams...), 0)
+	params, scatter, ok := d.fit(p0)
+	if !ok {
+		t.Fatalf("Fit didn't converge.")
+	}
+
+	// Uniform noise in [-0.1, 0.1] has a standard deviation of 0.1/sqrt(3).
+	if math.Abs(scatter-0.1/math.Sqrt(3)) > 0.005 {
+		t.Errorf("Expected a scatter of %g, got %g.",
+			0.1/math.Sqrt(3), scatter)
+	}
+	for _, x := range []float64{0, 2, 5} {
+		y := halo.SplashbackRelation(truth, x, 0.5, 2)
+		fit := halo.SplashbackRelation(params, x, 0.5, 2)
+		if math.Abs(fit/y-1) > 0.02 {
+			t.Errorf("Expected the fit to be %g at Gamma = %g, got %g.",
+				y, x, fit)
+		}
+	}
+
+	errs := d.bootstrap(params, 10, 2)
+	for k := range errs {
+		if !(errs[k] > 0) || errs[k] > math.Abs(params[k]) {
+			t.Errorf("Expected a small positive error on %s, got %g.",
+				fitParamNames[k], errs[k])
+		}
+	}
+
+	if _, _, ok := (&fitData{ys: d.ys[:3]}).fit(p0); ok {
+		t.Errorf("Expected a fit to fewer halos than parameters to fail.")
+	}
+}
+
+func TestFitCatalog(t *testing.T) {
+	lines := fitCatalog(
+		"R_sp/R200m", 10, []float64{1, 2, 3, 4}, []float64{0.1, 0.2, 0.3, 0.4},
+		0.05,
+	)
+	expected := []string{
+		"# Model: R_sp/R200m = A (1 + B Omega_m(z)) (1 + C exp(-Gamma / D))",
+		"# Column contents: N(0) A(1) A_err(2) B(3) B_err(4) C(5) C_err(6) " +
+			"D(7) D_err(8) Scatter(9)",
+		"10 1 0.1 2 0.2 3 0.3 4 0.4 0.05",
+	}
+	if !stringSlicesEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q.", expected, lines)
+	}
+}
@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/cosmo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// GammaConfig contains the configuration fields for the 'gamma' mode of the
+// shellfish tool.
+type GammaConfig struct {
+	scaleInterval  float64
+	dynamicalTimes float64
+}
+
+var _ Mode = &GammaConfig{}
+
+// ExampleConfig creates an example gamma.config file.
+func (config *GammaConfig) ExampleConfig() string {
+	return `[gamma.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The accretion rate, Gamma = Delta log(M200m) / Delta log(a), is measured
+# between each halo's snapshot and the snapshot of its main progenitor at an
+# earlier time. Only snapshots between SnapMin and SnapMax are used, and the
+# snapshot closest to the target time is chosen.
+
+# ScaleInterval is the difference in scale factor between the two
+# snapshots. If set, DynamicalTimes is ignored.
+#
+# ScaleInterval = 0.2
+
+# DynamicalTimes is the time between the two snapshots in units of the
+# dynamical time, t_dyn = 2 R200m / V200m. Defaults to 1 if not set, which is
+# the definition of Gamma used by Diemer (2017).
+#
+# DynamicalTimes = 1`
+}
+
+// ReadConfig reads in a gamma.config file into config.
+func (config *GammaConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("gamma.config")
+	vars.Float(&config.scaleInterval, "ScaleInterval", -1)
+	vars.Float(&config.dynamicalTimes, "DynamicalTimes", 1)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *GammaConfig) validate() error {
+	if config.scaleInterval != -1 &&
+		(config.scaleInterval <= 0 || config.scaleInterval >= 1) {
+		return fmt.Errorf("The 'ScaleInterval' variable is set to %g, but "+
+			"it must be between 0 and 1.", config.scaleInterval)
+	}
+	if config.dynamicalTimes <= 0 {
+		return fmt.Errorf("The 'DynamicalTimes' variable is set to %g, but "+
+			"it needs to be positive.", config.dynamicalTimes)
+	}
+	return nil
+}
+
+// Run executes the gamma mode of the shellfish tool.
+func (config *GammaConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#####################
+## shellfish gamma ##
+#####################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, _, err := catalog.Parse(stdin, []int{0, 1}, []int{})
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	scales, c, err := snapScales(gConfig, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the snapshot of each halo's progenitor.
+	pastSnaps := make([]int, len(ids))
+	rootIDs := []int{}
+	for i := range ids {
+		pastSnaps[i] = -1
+		if snaps[i] == -1 {
+			continue
+		}
+		a, ok := scales[snaps[i]]
+		if !ok {
+			return nil, fmt.Errorf("Halo %d is in snapshot %d, which is "+
+				"outside the range [SnapMin, SnapMax].", ids[i], snaps[i])
+		}
+		pastSnaps[i] = config.pastSnap(snaps[i], a, scales, c, gConfig)
+		if pastSnaps[i] != -1 {
+			rootIDs = append(rootIDs, ids[i])
+		}
+	}
+
+	trees, err := treeFiles(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	idSets, snapSets, err := haloHistories(trees, rootIDs, gConfig, e)
+	if err != nil {
+		return nil, err
+	}
+
+	pastIDs := make([]int, len(ids))
+	for i, j := 0, 0; i < len(ids); i++ {
+		pastIDs[i] = -1
+		if pastSnaps[i] == -1 {
+			continue
+		}
+		for k := range snapSets[j] {
+			if snapSets[j][k] == pastSnaps[i] {
+				pastIDs[i] = idSets[j][k]
+				break
+			}
+		}
+		if pastIDs[i] == -1 {
+			pastSnaps[i] = -1
+		}
+		j++
+	}
+
+	ms, err := readHaloCoords(
+		ids, snaps, []string{"M200m"}, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+	pastMs, err := readHaloCoords(
+		pastIDs, pastSnaps, []string{"M200m"}, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	gammas := make([]float64, len(ids))
+	for i := range gammas {
+		if pastSnaps[i] == -1 || ms[0][i] <= 0 || pastMs[0][i] <= 0 {
+			gammas[i] = math.NaN()
+			continue
+		}
+		dlogM := math.Log(ms[0][i] / pastMs[0][i])
+		dlogA := math.Log(scales[snaps[i]] / scales[pastSnaps[i]])
+		gammas[i] = dlogM / dlogA
+	}
+
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps}, [][]float64{gammas}, []int{0, 1, 2},
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot"}, []string{"Gamma"},
+		[]int{0, 1, 2}, []int{1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
+
+// snapScales returns the scale factor of every snapshot between SnapMin and
+// SnapMax, along with the simulation's cosmology.
+func snapScales(
+	gConfig *GlobalConfig, buf io.VectorBuffer, e *env.Environment,
+) (map[int]float64, *io.CosmologyHeader, error) {
+	scales := make(map[int]float64)
+	var c *io.CosmologyHeader
+	for snap := int(gConfig.SnapMin); snap <= int(gConfig.SnapMax); snap++ {
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, nil, err
+		}
+		c = &hds[0].Cosmo
+		scales[snap] = 1 / (1 + c.Z)
+	}
+	return scales, c, nil
+}
+
+// pastSnap returns the earlier snapshot closest to the start of the interval
+// that Gamma is measured over for a halo at snapshot snap with scale factor
+// a. If there are no earlier snapshots, -1 is returned.
+func (config *GammaConfig) pastSnap(
+	snap int, a float64, scales map[int]float64,
+	c *io.CosmologyHeader, gConfig *GlobalConfig,
+) int {
+	// Times are in units of 1/H0, which cancel out.
+	omegaM, omegaL := c.OmegaM, c.OmegaL
+	var target float64
+	if config.scaleInterval != -1 {
+		if a <= config.scaleInterval {
+			return -1
+		}
+		target = cosmo.Age(omegaM, omegaL, a-config.scaleInterval)
+	} else {
+		target = cosmo.Age(omegaM, omegaL, a) -
+			config.dynamicalTimes*cosmo.DynamicalTime(omegaM, a)
+	}
+
+	best, bestDist := -1, math.Inf(+1)
+	for s := int(gConfig.SnapMin); s < snap; s++ {
+		dist := math.Abs(cosmo.Age(omegaM, omegaL, scales[s]) - target)
+		if dist < bestDist {
+			best, bestDist = s, dist
+		}
+	}
+	return best
+}
@@ -0,0 +1,48 @@
+package halo
+
+import (
+	"math"
+)
+
+// CausticRadius returns the radius at which the mass-weighted mean radial
+// velocity profile of a set of particles first drops below vThreshold when
+// moving outwards from rMin. The profile is binned logarithmically between
+// rMin and rMax, empty bins are skipped, and the crossing is linearly
+// interpolated between bin centers. NaN is returned if the profile never
+// crosses vThreshold or is already below it in the innermost non-empty bin.
+func CausticRadius(
+	rs, vrs, ms []float64, rMin, rMax float64, bins int, vThreshold float64,
+) float64 {
+	mSums, vSums := make([]float64, bins), make([]float64, bins)
+	lrMin, dlr := math.Log(rMin), math.Log(rMax/rMin)/float64(bins)
+	for i := range rs {
+		if rs[i] < rMin || rs[i] >= rMax {
+			continue
+		}
+		j := int((math.Log(rs[i]) - lrMin) / dlr)
+		if j >= bins {
+			j = bins - 1
+		}
+		mSums[j] += ms[i]
+		vSums[j] += ms[i] * vrs[i]
+	}
+
+	rPrev, vPrev, started := 0.0, 0.0, false
+	for j := 0; j < bins; j++ {
+		if mSums[j] == 0 {
+			continue
+		}
+		r := math.Exp(lrMin + (float64(j)+0.5)*dlr)
+		v := vSums[j] / mSums[j]
+
+		if v < vThreshold {
+			if !started {
+				return math.NaN()
+			}
+			return rPrev + (vThreshold-vPrev)*(r-rPrev)/(v-vPrev)
+		}
+		rPrev, vPrev, started = r, v, true
+	}
+
+	return math.NaN()
+}
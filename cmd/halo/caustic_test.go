@@ -0,0 +1,53 @@
+package halo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCausticRadius(t *testing.T) {
+	rMin, rMax, bins := 1.0, 16.0, 4
+	// Bin centers: 1.414, 2.828, 5.657, 11.31.
+	centers := []float64{math.Sqrt(2), 2 * math.Sqrt(2),
+		4 * math.Sqrt(2), 8 * math.Sqrt(2)}
+
+	tests := []struct {
+		rs, vrs, ms []float64
+		threshold   float64
+		expected    float64
+	}{
+		// Crossing between the second and third bins.
+		{centers, []float64{0, 0, -2, -3}, []float64{1, 1, 1, 1}, -1,
+			(centers[1] + centers[2]) / 2},
+		// Mass-weighted: the third bin averages to -0.75, so the crossing
+		// is between the third and fourth bins.
+		{append(centers, centers[2]), []float64{0, 0, 0, -4, -3},
+			[]float64{1, 1, 3, 1, 1}, -1,
+			centers[2] + (centers[3]-centers[2])*(-1+0.75)/(-4+0.75)},
+		// An empty second bin is skipped.
+		{[]float64{centers[0], centers[2]}, []float64{1, -3},
+			[]float64{1, 1}, -1, centers[0] + (centers[2]-centers[0])/2},
+		// No crossing.
+		{centers, []float64{0, 0, 0, 0}, []float64{1, 1, 1, 1}, -1,
+			math.NaN()},
+		// Already infalling in the first bin.
+		{centers, []float64{-2, -2, -2, -2}, []float64{1, 1, 1, 1}, -1,
+			math.NaN()},
+		// Particles outside [rMin, rMax) are ignored.
+		{[]float64{0.5, centers[0], centers[1], 20}, []float64{-5, 0, -2, -5},
+			[]float64{1, 1, 1, 1}, -1, (centers[0] + centers[1]) / 2},
+	}
+
+	for i, test := range tests {
+		r := CausticRadius(
+			test.rs, test.vrs, test.ms, rMin, rMax, bins, test.threshold,
+		)
+		if math.IsNaN(test.expected) {
+			if !math.IsNaN(r) {
+				t.Errorf("%d) Expected NaN, got %g.", i, r)
+			}
+		} else if math.Abs(r-test.expected) > 1e-10 {
+			t.Errorf("%d) Expected %g, got %g.", i, test.expected, r)
+		}
+	}
+}
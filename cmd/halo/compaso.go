@@ -0,0 +1,468 @@
+package halo
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CompaSO catalogs are the halo catalogs produced by the Abacus N-body code
+// (e.g. for AbacusSummit). Each snapshot is a directory containing a
+// halo_info/ subdirectory, which in turn contains one ASDF file per slab of
+// the simulation. Only the subset of ASDF needed to read these files is
+// implemented here: the YAML tree is scanned for ndarray columns rather than
+// fully parsed, and only uncompressed, zlib, and bzip2 blocks can be read.
+
+const (
+	asdfBlockMagic = "\xd3BLK"
+	// The size of the block header fields which follow header_size.
+	asdfMinBlockHeader = 48
+)
+
+// CompaSOHeader contains the parts of a CompaSO header which Shellfish needs.
+type CompaSOHeader struct {
+	ParticleMass, BoxSize float64
+}
+
+// compaSOField is a parsed field specifier. Specifiers take the form
+// "name", "name[i]", or "name*mp". The first selects a scalar column, the
+// second selects the ith component of a vector column, and the third
+// multiplies a column by the particle mass (e.g. to convert particle counts
+// to masses).
+type compaSOField struct {
+	name      string
+	component int
+	mass      bool
+}
+
+var compaSOFieldRegexp = regexp.MustCompile(
+	`^([A-Za-z_][A-Za-z0-9_]*)(\[([0-9]+)\])?(\*mp)?$`,
+)
+
+// ParseCompaSOField checks whether the given field specifier is valid.
+func ParseCompaSOField(s string) error {
+	_, err := parseCompaSOField(s)
+	return err
+}
+
+func parseCompaSOField(s string) (compaSOField, error) {
+	s = strings.Join(strings.Fields(s), "")
+	m := compaSOFieldRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return compaSOField{}, fmt.Errorf("'%s' is not a valid CompaSO "+
+			"field. Fields look like 'name', 'name[i]', or 'name*mp'.", s)
+	}
+
+	f := compaSOField{name: m[1], component: -1, mass: m[4] != ""}
+	if m[3] != "" {
+		f.component, _ = strconv.Atoi(m[3])
+	}
+	return f, nil
+}
+
+// ReadCompaSO reads the given fields from every halo_info file in the CompaSO
+// catalog directory dir. Fields are described in parseCompaSOField.
+func ReadCompaSO(
+	dir string, fields []string,
+) ([][]float64, *CompaSOHeader, error) {
+	files, err := filepath.Glob(path.Join(dir, "halo_info", "halo_info_*.asdf"))
+	if err != nil {
+		return nil, nil, err
+	} else if len(files) == 0 {
+		return nil, nil, fmt.Errorf("No halo_info/halo_info_*.asdf files "+
+			"in the CompaSO directory %s.", dir)
+	}
+	sort.Strings(files)
+
+	fs := make([]compaSOField, len(fields))
+	for i := range fields {
+		if fs[i], err = parseCompaSOField(fields[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cols := make([][]float64, len(fields))
+	var hd *CompaSOHeader
+	for _, file := range files {
+		fileCols, fileHd, err := readCompaSOFile(file, fs)
+		if err != nil {
+			return nil, nil, err
+		}
+		hd = fileHd
+		for i := range cols {
+			cols[i] = append(cols[i], fileCols[i]...)
+		}
+	}
+
+	return cols, hd, nil
+}
+
+func readCompaSOFile(
+	file string, fields []compaSOField,
+) ([][]float64, *CompaSOHeader, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tree, blocks, err := splitASDF(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read ASDF file %s: %s",
+			file, err.Error())
+	}
+
+	hd, err := parseCompaSOHeader(tree)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read the header of %s: %s",
+			file, err.Error())
+	}
+	arrays := parseASDFColumns(tree)
+
+	cols := make([][]float64, len(fields))
+	for i, f := range fields {
+		arr, ok := arrays[f.name]
+		if !ok {
+			return nil, nil, fmt.Errorf("The ASDF file %s does not have "+
+				"the column '%s'.", file, f.name)
+		}
+		if arr.source < 0 || arr.source >= len(blocks) {
+			return nil, nil, fmt.Errorf("The column '%s' in %s refers to "+
+				"block %d, but there are only %d blocks.",
+				f.name, file, arr.source, len(blocks))
+		}
+
+		raw, err := decompressASDFBlock(blocks[arr.source])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not read column '%s' of "+
+				"%s: %s", f.name, file, err.Error())
+		}
+		cols[i], err = arr.column(raw, f.component)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not read column '%s' of "+
+				"%s: %s", f.name, file, err.Error())
+		}
+
+		if f.mass {
+			for j := range cols[i] {
+				cols[i][j] *= hd.ParticleMass
+			}
+		}
+	}
+
+	return cols, hd, nil
+}
+
+// asdfBlock is a single binary block in an ASDF file.
+type asdfBlock struct {
+	compression string
+	dataSize    int
+	data        []byte
+}
+
+// splitASDF separates an ASDF file into its YAML tree and its binary blocks.
+func splitASDF(data []byte) (string, []asdfBlock, error) {
+	if !bytes.HasPrefix(data, []byte("#ASDF")) {
+		return "", nil, fmt.Errorf("missing '#ASDF' header")
+	}
+
+	end := bytes.Index(data, []byte("\n...\n"))
+	if end == -1 {
+		return "", nil, fmt.Errorf("could not find the end of the YAML tree")
+	}
+	tree := string(data[:end])
+	rest := data[end+5:]
+
+	start := bytes.Index(rest, []byte(asdfBlockMagic))
+	if start == -1 {
+		return tree, nil, nil
+	}
+	rest = rest[start:]
+
+	blocks := []asdfBlock{}
+	for len(rest) >= 6 && string(rest[:4]) == asdfBlockMagic {
+		hdSize := int(binary.BigEndian.Uint16(rest[4:6]))
+		if hdSize < asdfMinBlockHeader || len(rest) < 6+hdSize {
+			return "", nil, fmt.Errorf("block %d has a corrupted header",
+				len(blocks))
+		}
+		hd := rest[6 : 6+hdSize]
+
+		compression := strings.TrimRight(string(hd[4:8]), "\x00")
+		allocated := binary.BigEndian.Uint64(hd[8:16])
+		used := binary.BigEndian.Uint64(hd[16:24])
+		dataSize := binary.BigEndian.Uint64(hd[24:32])
+
+		body := rest[6+hdSize:]
+		if uint64(len(body)) < allocated || used > allocated {
+			return "", nil, fmt.Errorf("block %d is truncated", len(blocks))
+		}
+
+		blocks = append(blocks, asdfBlock{
+			compression, int(dataSize), body[:used],
+		})
+		rest = body[allocated:]
+	}
+
+	return tree, blocks, nil
+}
+
+func decompressASDFBlock(b asdfBlock) ([]byte, error) {
+	switch b.compression {
+	case "":
+		return b.data, nil
+	case "zlib":
+		r, err := zlib.NewReader(bytes.NewReader(b.data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readBlockBody(r.Read, b.dataSize)
+	case "bzp2":
+		return readBlockBody(bzip2.NewReader(bytes.NewReader(b.data)).Read,
+			b.dataSize)
+	case "blsc":
+		return nil, fmt.Errorf("the block uses blosc compression, which " +
+			"Shellfish can't read. Rewrite the file without compression " +
+			"(e.g. with asdftool) first")
+	}
+	return nil, fmt.Errorf("unrecognized block compression '%s'",
+		b.compression)
+}
+
+func readBlockBody(
+	read func([]byte) (int, error), dataSize int,
+) ([]byte, error) {
+	out := make([]byte, dataSize)
+	for n := 0; n < dataSize; {
+		m, err := read(out[n:])
+		n += m
+		if err != nil {
+			if n == dataSize {
+				break
+			}
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// asdfArray describes an ndarray stored in one of an ASDF file's blocks.
+type asdfArray struct {
+	source    int
+	datatype  string
+	byteOrder binary.ByteOrder
+	shape     []int
+}
+
+var (
+	asdfSourceRegexp    = regexp.MustCompile(`source:\s*(-?[0-9]+)`)
+	asdfDatatypeRegexp  = regexp.MustCompile(`datatype:\s*([A-Za-z0-9]+)`)
+	asdfByteOrderRegexp = regexp.MustCompile(`byteorder:\s*([A-Za-z]+)`)
+	asdfShapeRegexp     = regexp.MustCompile(`shape:\s*\[([^\]]*)\]`)
+	asdfNameRegexp      = regexp.MustCompile(`(?m)^\s*name:\s*([^\s,}]+)`)
+	asdfColnamesRegexp  = regexp.MustCompile(`colnames:\s*\[([^\]]*)\]`)
+)
+
+// parseASDFColumns scans the YAML tree of a table for ndarray columns and
+// returns them keyed by column name. Both astropy tables (which store names in
+// a 'colnames' list) and core ASDF tables (which store a 'name' with every
+// column) are supported. Columns which can't be understood are skipped.
+func parseASDFColumns(tree string) map[string]*asdfArray {
+	lines := strings.Split(tree, "\n")
+
+	start := -1
+	for i := range lines {
+		if strings.TrimSpace(lines[i]) == "columns:" {
+			start = i + 1
+			break
+		}
+	}
+	if start == -1 {
+		return map[string]*asdfArray{}
+	}
+
+	// Split the 'columns' list into items.
+	items := []string{}
+	listIndent := -1
+	for _, line := range lines[start:] {
+		trimmed := strings.TrimLeft(line, " ")
+		indent := len(line) - len(trimmed)
+		if len(trimmed) == 0 {
+			continue
+		}
+
+		isItem := strings.HasPrefix(trimmed, "- ") || trimmed == "-"
+		if listIndent == -1 {
+			if !isItem {
+				break
+			}
+			listIndent = indent
+		}
+
+		if indent == listIndent && isItem {
+			items = append(items, trimmed[1:])
+		} else if indent > listIndent {
+			items[len(items)-1] += "\n" + line
+		} else {
+			break
+		}
+	}
+
+	colnames := []string{}
+	if m := asdfColnamesRegexp.FindStringSubmatch(tree); m != nil {
+		for _, name := range strings.Split(m[1], ",") {
+			colnames = append(colnames, strings.Trim(name, " \n'\""))
+		}
+	}
+
+	out := make(map[string]*asdfArray)
+	for i, item := range items {
+		name := ""
+		if m := asdfNameRegexp.FindStringSubmatch(item); m != nil {
+			name = strings.Trim(m[1], "'\"")
+		} else if i < len(colnames) {
+			name = colnames[i]
+		}
+
+		arr, ok := parseASDFArray(item)
+		if name != "" && ok {
+			out[name] = arr
+		}
+	}
+	return out
+}
+
+func parseASDFArray(text string) (*asdfArray, bool) {
+	source := asdfSourceRegexp.FindStringSubmatch(text)
+	datatype := asdfDatatypeRegexp.FindStringSubmatch(text)
+	shape := asdfShapeRegexp.FindStringSubmatch(text)
+	if source == nil || datatype == nil || shape == nil {
+		return nil, false
+	}
+
+	arr := &asdfArray{datatype: datatype[1], byteOrder: binary.LittleEndian}
+	arr.source, _ = strconv.Atoi(source[1])
+	if order := asdfByteOrderRegexp.FindStringSubmatch(text); order != nil &&
+		order[1] == "big" {
+		arr.byteOrder = binary.BigEndian
+	}
+
+	for _, tok := range strings.Split(shape[1], ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(tok))
+		if err != nil {
+			return nil, false
+		}
+		arr.shape = append(arr.shape, n)
+	}
+	if len(arr.shape) == 0 || len(arr.shape) > 2 {
+		return nil, false
+	}
+
+	return arr, true
+}
+
+// column converts the raw bytes of an array into a float64 column. Vector
+// arrays require a component index, scalar arrays require a component of -1.
+func (arr *asdfArray) column(raw []byte, component int) ([]float64, error) {
+	n, width := arr.shape[0], 1
+	if len(arr.shape) == 2 {
+		width = arr.shape[1]
+		if component < 0 || component >= width {
+			return nil, fmt.Errorf("the column has %d components, so a "+
+				"component index from 0 to %d must be given", width, width-1)
+		}
+	} else if component > 0 {
+		return nil, fmt.Errorf("the column has only one component, but "+
+			"component %d was requested", component)
+	} else {
+		component = 0
+	}
+
+	size := 0
+	switch arr.datatype {
+	case "int8", "uint8":
+		size = 1
+	case "int16", "uint16":
+		size = 2
+	case "int32", "uint32", "float32":
+		size = 4
+	case "int64", "uint64", "float64":
+		size = 8
+	default:
+		return nil, fmt.Errorf("unsupported datatype '%s'", arr.datatype)
+	}
+
+	if len(raw) < n*width*size {
+		return nil, fmt.Errorf("expected %d bytes, but the block only has %d",
+			n*width*size, len(raw))
+	}
+
+	out := make([]float64, n)
+	order := arr.byteOrder
+	for i := range out {
+		b := raw[(i*width+component)*size:]
+		switch arr.datatype {
+		case "int8":
+			out[i] = float64(int8(b[0]))
+		case "uint8":
+			out[i] = float64(b[0])
+		case "int16":
+			out[i] = float64(int16(order.Uint16(b)))
+		case "uint16":
+			out[i] = float64(order.Uint16(b))
+		case "int32":
+			out[i] = float64(int32(order.Uint32(b)))
+		case "uint32":
+			out[i] = float64(order.Uint32(b))
+		case "float32":
+			out[i] = float64(math.Float32frombits(order.Uint32(b)))
+		case "int64":
+			out[i] = float64(int64(order.Uint64(b)))
+		case "uint64":
+			out[i] = float64(order.Uint64(b))
+		case "float64":
+			out[i] = math.Float64frombits(order.Uint64(b))
+		}
+	}
+
+	return out, nil
+}
+
+var (
+	compaSOMassRegexp = regexp.MustCompile(
+		`ParticleMassHMsun:\s*([-+0-9.eE]+)`,
+	)
+	compaSOBoxRegexp = regexp.MustCompile(`BoxSizeHMpc:\s*([-+0-9.eE]+)`)
+)
+
+func parseCompaSOHeader(tree string) (*CompaSOHeader, error) {
+	hd := &CompaSOHeader{}
+	m := compaSOMassRegexp.FindStringSubmatch(tree)
+	if m == nil {
+		return nil, fmt.Errorf("no 'ParticleMassHMsun' field")
+	}
+	var err error
+	if hd.ParticleMass, err = strconv.ParseFloat(m[1], 64); err != nil {
+		return nil, err
+	}
+
+	m = compaSOBoxRegexp.FindStringSubmatch(tree)
+	if m == nil {
+		return nil, fmt.Errorf("no 'BoxSizeHMpc' field")
+	}
+	if hd.BoxSize, err = strconv.ParseFloat(m[1], 64); err != nil {
+		return nil, err
+	}
+
+	return hd, nil
+}
@@ -0,0 +1,130 @@
+package halo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func asdfTestBlock(data []byte, compression string) []byte {
+	raw := data
+	if compression == "zlib" {
+		buf := &bytes.Buffer{}
+		w := zlib.NewWriter(buf)
+		w.Write(data)
+		w.Close()
+		raw = buf.Bytes()
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString(asdfBlockMagic)
+	binary.Write(out, binary.BigEndian, uint16(asdfMinBlockHeader))
+	binary.Write(out, binary.BigEndian, uint32(0))
+	comp := make([]byte, 4)
+	copy(comp, compression)
+	out.Write(comp)
+	binary.Write(out, binary.BigEndian, uint64(len(raw))) // allocated
+	binary.Write(out, binary.BigEndian, uint64(len(raw))) // used
+	binary.Write(out, binary.BigEndian, uint64(len(data)))
+	out.Write(make([]byte, 16)) // checksum
+	out.Write(raw)
+	return out.Bytes()
+}
+
+func TestReadCompaSO(t *testing.T) {
+	tree := `#ASDF 1.0.0
+#ASDF_STANDARD 1.5.0
+%YAML 1.1
+--- !core/asdf-1.1.0
+data: !<tag:astropy.org:astropy/table/table-1.0.0>
+  colnames: [id, x_L2com, N_L2]
+  columns:
+  - !core/ndarray-1.0.0
+    source: 0
+    datatype: int64
+    byteorder: little
+    shape: [2]
+  - !core/ndarray-1.0.0
+    source: 1
+    datatype: float32
+    byteorder: big
+    shape: [2, 3]
+  - !core/ndarray-1.0.0
+    source: 2
+    datatype: uint32
+    byteorder: little
+    shape: [2]
+  qtable: false
+header: {BoxSizeHMpc: 100.0, ParticleMassHMsun: 2.5e9}
+...
+`
+	ids := &bytes.Buffer{}
+	binary.Write(ids, binary.LittleEndian, []int64{7, 12})
+	xs := &bytes.Buffer{}
+	binary.Write(xs, binary.BigEndian, []float32{1, 2, 3, -4, -5, -6})
+	ns := &bytes.Buffer{}
+	binary.Write(ns, binary.LittleEndian, []uint32{100, 2000})
+
+	data := []byte(tree)
+	data = append(data, asdfTestBlock(ids.Bytes(), "")...)
+	data = append(data, asdfTestBlock(xs.Bytes(), "")...)
+	data = append(data, asdfTestBlock(ns.Bytes(), "zlib")...)
+
+	dir, err := ioutil.TempDir("", "shellfish_compaso_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(path.Join(dir, "halo_info"), 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"halo_info_000.asdf", "halo_info_001.asdf"} {
+		file := path.Join(dir, "halo_info", name)
+		if err = ioutil.WriteFile(file, data, 0666); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	cols, hd, err := ReadCompaSO(
+		dir, []string{"id", "x_L2com[1]", "x_L2com[2]", "N_L2*mp", "N_L2"},
+	)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if hd.BoxSize != 100 || hd.ParticleMass != 2.5e9 {
+		t.Errorf("Expected header {2.5e9 100}, got %v.", *hd)
+	}
+
+	expected := [][]float64{
+		{7, 12, 7, 12},
+		{2, -5, 2, -5},
+		{3, -6, 3, -6},
+		{2.5e11, 5e12, 2.5e11, 5e12},
+		{100, 2000, 100, 2000},
+	}
+	for i := range expected {
+		if len(cols[i]) != len(expected[i]) {
+			t.Errorf("%d) Expected %v, got %v.", i, expected[i], cols[i])
+			continue
+		}
+		for j := range expected[i] {
+			if cols[i][j] != expected[i][j] {
+				t.Errorf("%d) Expected %v, got %v.", i, expected[i], cols[i])
+				break
+			}
+		}
+	}
+
+	errFields := [][]string{
+		{"x_L2com"}, {"x_L2com[3]"}, {"id[1]"}, {"missing"}, {"id+1"},
+	}
+	for i, fields := range errFields {
+		if _, _, err = ReadCompaSO(dir, fields); err == nil {
+			t.Errorf("%d) Expected error for fields %v.", i, fields)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package halo
+
+import (
+	"math"
+)
+
+// Matcher finds the counterparts of halos in a second halo catalog based on
+// their positions and masses.
+type Matcher struct {
+	g              *Grid
+	xs, ys, zs, ms []float64
+	buf            []int
+}
+
+// NewMatcher creates a Matcher for the halos with the given positions and
+// masses in a periodic box with the given width. cells is the number of grid
+// cells used on each side of the box.
+func NewMatcher(cells int, width float64, xs, ys, zs, ms []float64) *Matcher {
+	g := NewGrid(cells, width, len(xs))
+	g.Insert(xs, ys, zs)
+	return &Matcher{
+		g: g, xs: xs, ys: ys, zs: zs, ms: ms,
+		buf: make([]int, 0, g.MaxLength()),
+	}
+}
+
+// Match returns the index of the closest halo which is within a distance r of
+// pos and which has a mass within a factor of maxRatio of m, along with its
+// distance. If no halo satisfies these criteria, ok is false.
+func (mt *Matcher) Match(
+	pos [3]float64, r, m, maxRatio float64,
+) (idx int, dist float64, ok bool) {
+	b := periodicBounds(mt.g, pos, r)
+	c, L := mt.g.Cells, mt.g.Width
+
+	idx, dist2 := -1, r*r
+	logMaxRatio := math.Abs(math.Log(maxRatio))
+	for dz := 0; dz < b.Span[2]; dz++ {
+		z := (b.Origin[2] + dz) % c
+		for dy := 0; dy < b.Span[1]; dy++ {
+			y := (b.Origin[1] + dy) % c
+			for dx := 0; dx < b.Span[0]; dx++ {
+				x := (b.Origin[0] + dx) % c
+
+				mt.buf = mt.g.ReadIndexes(x+y*c+z*c*c, mt.buf)
+				for _, j := range mt.buf {
+					if math.Abs(math.Log(mt.ms[j]/m)) > logMaxRatio {
+						continue
+					}
+
+					ddx := periodicDist(pos[0]-mt.xs[j], L)
+					ddy := periodicDist(pos[1]-mt.ys[j], L)
+					ddz := periodicDist(pos[2]-mt.zs[j], L)
+					d2 := ddx*ddx + ddy*ddy + ddz*ddz
+					if d2 <= dist2 {
+						idx, dist2 = j, d2
+					}
+				}
+			}
+		}
+	}
+
+	if idx == -1 {
+		return -1, -1, false
+	}
+	return idx, math.Sqrt(dist2), true
+}
+
+// Neighbors returns the indices of every halo within a distance r of pos,
+// along with their distances.
+func (mt *Matcher) Neighbors(
+	pos [3]float64, r float64,
+) (idxs []int, dists []float64) {
+	b := periodicBounds(mt.g, pos, r)
+	c, L := mt.g.Cells, mt.g.Width
+
+	for dz := 0; dz < b.Span[2]; dz++ {
+		z := (b.Origin[2] + dz) % c
+		for dy := 0; dy < b.Span[1]; dy++ {
+			y := (b.Origin[1] + dy) % c
+			for dx := 0; dx < b.Span[0]; dx++ {
+				x := (b.Origin[0] + dx) % c
+
+				mt.buf = mt.g.ReadIndexes(x+y*c+z*c*c, mt.buf)
+				for _, j := range mt.buf {
+					ddx := periodicDist(pos[0]-mt.xs[j], L)
+					ddy := periodicDist(pos[1]-mt.ys[j], L)
+					ddz := periodicDist(pos[2]-mt.zs[j], L)
+					d2 := ddx*ddx + ddy*ddy + ddz*ddz
+					if d2 <= r*r {
+						idxs = append(idxs, j)
+						dists = append(dists, math.Sqrt(d2))
+					}
+				}
+			}
+		}
+	}
+
+	return idxs, dists
+}
+
+// periodicBounds returns the cells of g which overlap with a sphere of radius r
+// centered on pos. Origin is always within the grid, so cells should be
+// indexed with (Origin + d) % Cells.
+func periodicBounds(g *Grid, pos [3]float64, r float64) *Bounds {
+	b := &Bounds{}
+	b.SphereBounds(pos, r, g.cw, g.Width)
+	c := g.Cells
+	for i := range b.Span {
+		// Large search radii can lead to bounding boxes which wrap around
+		// the box more than once.
+		if b.Span[i] > c {
+			b.Origin[i], b.Span[i] = 0, c
+		}
+		b.Origin[i] = ((b.Origin[i] % c) + c) % c
+	}
+	return b
+}
+
+func periodicDist(dx, L float64) float64 {
+	if dx > +L/2 {
+		return dx - L
+	} else if dx < -L/2 {
+		return dx + L
+	}
+	return dx
+}
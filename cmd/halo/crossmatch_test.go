@@ -0,0 +1,85 @@
+package halo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	xs := []float64{10, 10.5, 50, 99.8, 30}
+	ys := []float64{10, 10, 50, 0.1, 30}
+	zs := []float64{10, 10, 50, 50, 30}
+	ms := []float64{1e13, 1e12, 1e14, 5e12, 2e13}
+	mt := NewMatcher(10, 100, xs, ys, zs, ms)
+
+	tests := []struct {
+		pos         [3]float64
+		r, m, ratio float64
+		idx         int
+		dist        float64
+	}{
+		// Exact match.
+		{[3]float64{50, 50, 50}, 1, 1e14, 2, 2, 0},
+		// Closest halo fails the mass cut.
+		{[3]float64{10.4, 10, 10}, 1, 1.2e13, 2, 0, 0.4},
+		{[3]float64{10.4, 10, 10}, 1, 1.2e12, 2, 1, 0.1},
+		// Nothing within the mass cut.
+		{[3]float64{10.4, 10, 10}, 1, 1e15, 2, -1, -1},
+		// Nothing within the radius.
+		{[3]float64{30, 32, 30}, 1, 2e13, 2, -1, -1},
+		// Periodic boundaries.
+		{[3]float64{0.1, 99.9, 50}, 1, 5e12, 2, 3, math.Sqrt(0.3*0.3 + 0.2*0.2)},
+		// Search radius larger than the box.
+		{[3]float64{30, 31, 30}, 500, 2e13, 2, 4, 1},
+	}
+
+	for i, test := range tests {
+		idx, dist, ok := mt.Match(test.pos, test.r, test.m, test.ratio)
+		if ok != (test.idx != -1) || idx != test.idx ||
+			math.Abs(dist-test.dist) > 1e-6 {
+			t.Errorf("%d) Expected (%d, %g), got (%d, %g, %v).",
+				i, test.idx, test.dist, idx, dist, ok)
+		}
+	}
+}
+
+func TestMatcherNeighbors(t *testing.T) {
+	xs := []float64{10, 10.5, 50, 99.8, 30}
+	ys := []float64{10, 10, 50, 0.1, 30}
+	zs := []float64{10, 10, 50, 50, 30}
+	ms := []float64{1e13, 1e12, 1e14, 5e12, 2e13}
+	mt := NewMatcher(10, 100, xs, ys, zs, ms)
+
+	tests := []struct {
+		pos  [3]float64
+		r    float64
+		idxs []int
+	}{
+		{[3]float64{10.2, 10, 10}, 1, []int{0, 1}},
+		{[3]float64{10.2, 10, 10}, 0.1, []int{}},
+		{[3]float64{0.1, 99.9, 50}, 1, []int{3}},
+		{[3]float64{30, 31, 30}, 500, []int{0, 1, 2, 3, 4}},
+	}
+
+	for i, test := range tests {
+		idxs, dists := mt.Neighbors(test.pos, test.r)
+		found := make(map[int]bool)
+		for j, idx := range idxs {
+			found[idx] = true
+			if dists[j] > test.r {
+				t.Errorf("%d) Halo %d is at distance %g, outside %g.",
+					i, idx, dists[j], test.r)
+			}
+		}
+		if len(found) != len(idxs) || len(idxs) != len(test.idxs) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.idxs, idxs)
+			continue
+		}
+		for _, idx := range test.idxs {
+			if !found[idx] {
+				t.Errorf("%d) Expected %v, got %v.", i, test.idxs, idxs)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package halo
+
+import (
+	"math"
+)
+
+// DensityGrid is a coarse mass grid covering a periodic box which is used to
+// estimate the large-scale density around halos.
+type DensityGrid struct {
+	Cells     int
+	Width     float64
+	Mass      []float64
+	cw        float64
+	totalMass float64
+}
+
+// NewDensityGrid creates an empty DensityGrid with the given number of cells
+// on each side of a periodic box with the given width.
+func NewDensityGrid(cells int, width float64) *DensityGrid {
+	return &DensityGrid{
+		Cells: cells, Width: width,
+		Mass: make([]float64, cells*cells*cells),
+		cw:   width / float64(cells),
+	}
+}
+
+// Insert adds the given particles to the grid using nearest grid point
+// assignment.
+func (g *DensityGrid) Insert(xs [][3]float32, ms []float32) {
+	c := g.Cells
+	for i := range xs {
+		idx := 0
+		for k := 2; k >= 0; k-- {
+			j := int(float64(xs[i][k]) / g.cw)
+			j = ((j % c) + c) % c
+			idx = idx*c + j
+		}
+		g.Mass[idx] += float64(ms[i])
+		g.totalMass += float64(ms[i])
+	}
+}
+
+// Overdensity returns the mean density within a distance r of pos in units of
+// the mean density of the box. Cells are included if their centers are within
+// r of pos, so r should be several times larger than the width of a cell.
+func (g *DensityGrid) Overdensity(pos [3]float64, r float64) float64 {
+	if g.totalMass == 0 {
+		return 0
+	}
+
+	c, L := g.Cells, g.Width
+	span := int(math.Ceil(r/g.cw)) + 1
+	if 2*span+1 > c {
+		span = (c - 1) / 2
+	}
+
+	var center [3]int
+	for k := range center {
+		center[k] = int(pos[k] / g.cw)
+	}
+
+	mass, n := 0.0, 0
+	for dz := -span; dz <= span; dz++ {
+		z := center[2] + dz
+		for dy := -span; dy <= span; dy++ {
+			y := center[1] + dy
+			for dx := -span; dx <= span; dx++ {
+				x := center[0] + dx
+
+				ddx := periodicDist((float64(x)+0.5)*g.cw-pos[0], L)
+				ddy := periodicDist((float64(y)+0.5)*g.cw-pos[1], L)
+				ddz := periodicDist((float64(z)+0.5)*g.cw-pos[2], L)
+				if ddx*ddx+ddy*ddy+ddz*ddz > r*r {
+					continue
+				}
+
+				ix, iy, iz := ((x%c)+c)%c, ((y%c)+c)%c, ((z%c)+c)%c
+				mass += g.Mass[ix+iy*c+iz*c*c]
+				n++
+			}
+		}
+	}
+
+	if n == 0 {
+		// The sphere is smaller than a cell, so use the central cell.
+		ix := ((center[0] % c) + c) % c
+		iy := ((center[1] % c) + c) % c
+		iz := ((center[2] % c) + c) % c
+		mass, n = g.Mass[ix+iy*c+iz*c*c], 1
+	}
+
+	meanCellMass := g.totalMass / float64(len(g.Mass))
+	return mass / (float64(n) * meanCellMass)
+}
+
+// Percentiles returns the percentile rank of each element of xs within xs,
+// from 0 (the smallest element) to 100 (the largest).
+func Percentiles(xs []float64) []float64 {
+	out := make([]float64, len(xs))
+	if len(xs) == 1 {
+		out[0] = 50
+	}
+	if len(xs) <= 1 {
+		return out
+	}
+
+	for rank, i := range idxSort(xs) {
+		out[i] = 100 * float64(rank) / float64(len(xs)-1)
+	}
+	return out
+}
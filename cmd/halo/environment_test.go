@@ -0,0 +1,71 @@
+package halo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDensityGridOverdensity(t *testing.T) {
+	g := NewDensityGrid(10, 100)
+
+	// One particle per cell gives a uniform background.
+	xs, ms := [][3]float32{}, []float32{}
+	for z := 0; z < 10; z++ {
+		for y := 0; y < 10; y++ {
+			for x := 0; x < 10; x++ {
+				xs = append(xs, [3]float32{
+					float32(x*10 + 5), float32(y*10 + 5), float32(z*10 + 5),
+				})
+				ms = append(ms, 1)
+			}
+		}
+	}
+	g.Insert(xs, ms)
+
+	// Add an overdense clump which straddles the periodic boundary.
+	g.Insert([][3]float32{{99, 55, 55}, {1, 55, 55}}, []float32{500, 500})
+
+	tests := []struct {
+		pos [3]float64
+		r   float64
+		od  float64
+	}{
+		// The mean cell mass is 2.
+		{[3]float64{55, 55, 55}, 1, 0.5},
+		{[3]float64{95, 55, 55}, 1, 501.0 / 2},
+		{[3]float64{0, 55, 55}, 6, 1002.0 / (2 * 2)},
+		{[3]float64{55, 55, 55}, 0.1, 0.5},
+	}
+
+	for i, test := range tests {
+		od := g.Overdensity(test.pos, test.r)
+		if math.Abs(od-test.od) > 1e-6 {
+			t.Errorf("%d) Expected %g, got %g.", i, test.od, od)
+		}
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	tests := []struct {
+		xs, ps []float64
+	}{
+		{[]float64{}, []float64{}},
+		{[]float64{3}, []float64{50}},
+		{[]float64{3, 1, 2}, []float64{100, 0, 50}},
+		{[]float64{5, 10, 0, 20, 15}, []float64{25, 50, 0, 100, 75}},
+	}
+
+	for i, test := range tests {
+		ps := Percentiles(test.xs)
+		if len(ps) != len(test.ps) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.ps, ps)
+			continue
+		}
+		for j := range ps {
+			if ps[j] != test.ps[j] {
+				t.Errorf("%d) Expected %v, got %v.", i, test.ps, ps)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package halo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filter is a boolean expression over halo catalog columns which can be used
+// to throw out rows while a catalog is being read. Expressions look like
+//
+//	M200m > 1e13 && (Xoff < 0.07 || Spin <= 0.03)
+//
+// and support the comparison operators <, <=, >, >=, ==, and !=, the logical
+// operators &&, ||, and !, the arithmetic operators +, -, *, and /, and
+// parentheses. Variables are the names used in HaloValueNames (plus any
+// radii which can be generated from masses).
+type Filter struct {
+	expr  string
+	root  node
+	names []string
+}
+
+// node is a single term in a parsed Filter expression. Boolean-valued nodes
+// return 1 for true and 0 for false.
+type node interface {
+	eval(cols [][]float64, i int) float64
+}
+
+type (
+	numNode struct{ val float64 }
+	varNode struct{ col int }
+	negNode struct{ x node }
+	notNode struct{ x node }
+	binNode struct {
+		op   string
+		l, r node
+	}
+)
+
+func (n *numNode) eval(cols [][]float64, i int) float64 { return n.val }
+func (n *varNode) eval(cols [][]float64, i int) float64 { return cols[n.col][i] }
+func (n *negNode) eval(cols [][]float64, i int) float64 {
+	return -n.x.eval(cols, i)
+}
+func (n *notNode) eval(cols [][]float64, i int) float64 {
+	return boolVal(n.x.eval(cols, i) == 0)
+}
+
+func (n *binNode) eval(cols [][]float64, i int) float64 {
+	// && and || need to short circuit, so handle them first.
+	switch n.op {
+	case "&&":
+		return boolVal(n.l.eval(cols, i) != 0 && n.r.eval(cols, i) != 0)
+	case "||":
+		return boolVal(n.l.eval(cols, i) != 0 || n.r.eval(cols, i) != 0)
+	}
+
+	l, r := n.l.eval(cols, i), n.r.eval(cols, i)
+	switch n.op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		return l / r
+	case "<":
+		return boolVal(l < r)
+	case "<=":
+		return boolVal(l <= r)
+	case ">":
+		return boolVal(l > r)
+	case ">=":
+		return boolVal(l >= r)
+	case "==":
+		return boolVal(l == r)
+	case "!=":
+		return boolVal(l != r)
+	}
+	panic(fmt.Sprintf("Internal error: unknown operator '%s'.", n.op))
+}
+
+func boolVal(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ParseFilter parses a filter expression. The expression may optionally be
+// wrapped in double quotes. An empty expression corresponds to a nil Filter,
+// which keeps every row.
+func ParseFilter(expr string) (*Filter, error) {
+	expr = strings.Trim(expr, " ")
+	if len(expr) >= 2 && expr[0] == '"' && expr[len(expr)-1] == '"' {
+		expr = strings.Trim(expr[1:len(expr)-1], " ")
+	}
+	if expr == "" {
+		return nil, nil
+	}
+
+	toks, err := tokenize(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse filter '%s': %s",
+			expr, err.Error())
+	}
+
+	p := &filterParser{toks: toks, cols: make(map[string]int)}
+	root, isBool, err := p.parseOr()
+	if err == nil && p.i < len(p.toks) {
+		err = fmt.Errorf("unexpected token '%s'", p.toks[p.i])
+	}
+	if err == nil && !isBool {
+		err = fmt.Errorf("expression is a number, not a true/false condition")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse filter '%s': %s",
+			expr, err.Error())
+	}
+
+	return &Filter{expr: expr, root: root, names: p.names}, nil
+}
+
+// String returns the text of the filter expression.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// Names returns the column names referenced by the filter in the order that
+// Select expects them.
+func (f *Filter) Names() []string {
+	if f == nil {
+		return nil
+	}
+	return f.names
+}
+
+// Select evaluates the filter on every row of the given columns and returns
+// a slice of flags which are true for rows that pass. cols must contain the
+// columns returned by Names(), in the same order. A nil Filter selects every
+// row.
+func (f *Filter) Select(cols [][]float64) []bool {
+	n := 0
+	if len(cols) > 0 {
+		n = len(cols[0])
+	}
+	ok := make([]bool, n)
+	for i := range ok {
+		ok[i] = f == nil || f.root.eval(cols, i) != 0
+	}
+	return ok
+}
+
+// SelectRows returns copies of the given columns which only contain the
+// rows flagged by ok.
+func SelectRows(cols [][]float64, ok []bool) [][]float64 {
+	out := make([][]float64, len(cols))
+	for j := range cols {
+		out[j] = make([]float64, 0, len(ok))
+		for i := range ok {
+			if ok[i] {
+				out[j] = append(out[j], cols[j][i])
+			}
+		}
+	}
+	return out
+}
+
+///////////////////
+// Parsing code. //
+///////////////////
+
+func tokenize(expr string) ([]string, error) {
+	toks := []string{}
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(expr) && (isIdentStart(expr[j]) || isDigit(expr[j])) {
+				j++
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		case isDigit(c) || c == '.':
+			j := i + 1
+			for j < len(expr) {
+				if isDigit(expr[j]) || expr[j] == '.' {
+					j++
+				} else if expr[j] == 'e' || expr[j] == 'E' {
+					j++
+					if j < len(expr) && (expr[j] == '+' || expr[j] == '-') {
+						j++
+					}
+				} else {
+					break
+				}
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		case strings.ContainsRune("()+-*/", rune(c)):
+			toks = append(toks, expr[i:i+1])
+			i++
+		default:
+			if i+1 < len(expr) {
+				switch two := expr[i : i+2]; two {
+				case "&&", "||", "<=", ">=", "==", "!=":
+					toks = append(toks, two)
+					i += 2
+					continue
+				}
+			}
+			if c == '<' || c == '>' || c == '!' {
+				toks = append(toks, expr[i:i+1])
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character '%c'", c)
+		}
+	}
+	return toks, nil
+}
+
+func isIdentStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// filterParser is a recursive descent parser for filter expressions. Each
+// parse method returns the parsed node and whether that node is
+// boolean-valued.
+type filterParser struct {
+	toks  []string
+	i     int
+	names []string
+	cols  map[string]int
+}
+
+func (p *filterParser) peek() string {
+	if p.i >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.i]
+}
+
+func (p *filterParser) parseOr() (node, bool, error) {
+	l, lBool, err := p.parseAnd()
+	if err != nil {
+		return nil, false, err
+	}
+	for p.peek() == "||" {
+		p.i++
+		r, rBool, err := p.parseAnd()
+		if err != nil {
+			return nil, false, err
+		}
+		if !lBool || !rBool {
+			return nil, false, fmt.Errorf("'||' applied to a number")
+		}
+		l = &binNode{"||", l, r}
+	}
+	return l, lBool, nil
+}
+
+func (p *filterParser) parseAnd() (node, bool, error) {
+	l, lBool, err := p.parseNot()
+	if err != nil {
+		return nil, false, err
+	}
+	for p.peek() == "&&" {
+		p.i++
+		r, rBool, err := p.parseNot()
+		if err != nil {
+			return nil, false, err
+		}
+		if !lBool || !rBool {
+			return nil, false, fmt.Errorf("'&&' applied to a number")
+		}
+		l = &binNode{"&&", l, r}
+	}
+	return l, lBool, nil
+}
+
+func (p *filterParser) parseNot() (node, bool, error) {
+	if p.peek() != "!" {
+		return p.parseCmp()
+	}
+	p.i++
+	x, isBool, err := p.parseNot()
+	if err != nil {
+		return nil, false, err
+	}
+	if !isBool {
+		return nil, false, fmt.Errorf("'!' applied to a number")
+	}
+	return &notNode{x}, true, nil
+}
+
+func (p *filterParser) parseCmp() (node, bool, error) {
+	l, lBool, err := p.parseSum()
+	if err != nil {
+		return nil, false, err
+	}
+	switch op := p.peek(); op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		p.i++
+		r, rBool, err := p.parseSum()
+		if err != nil {
+			return nil, false, err
+		}
+		if lBool || rBool {
+			return nil, false, fmt.Errorf("'%s' applied to a condition", op)
+		}
+		return &binNode{op, l, r}, true, nil
+	}
+	return l, lBool, nil
+}
+
+func (p *filterParser) parseSum() (node, bool, error) {
+	l, lBool, err := p.parseProd()
+	if err != nil {
+		return nil, false, err
+	}
+	for op := p.peek(); op == "+" || op == "-"; op = p.peek() {
+		p.i++
+		r, rBool, err := p.parseProd()
+		if err != nil {
+			return nil, false, err
+		}
+		if lBool || rBool {
+			return nil, false, fmt.Errorf("'%s' applied to a condition", op)
+		}
+		l = &binNode{op, l, r}
+	}
+	return l, lBool, nil
+}
+
+func (p *filterParser) parseProd() (node, bool, error) {
+	l, lBool, err := p.parseUnary()
+	if err != nil {
+		return nil, false, err
+	}
+	for op := p.peek(); op == "*" || op == "/"; op = p.peek() {
+		p.i++
+		r, rBool, err := p.parseUnary()
+		if err != nil {
+			return nil, false, err
+		}
+		if lBool || rBool {
+			return nil, false, fmt.Errorf("'%s' applied to a condition", op)
+		}
+		l = &binNode{op, l, r}
+	}
+	return l, lBool, nil
+}
+
+func (p *filterParser) parseUnary() (node, bool, error) {
+	if p.peek() != "-" {
+		return p.parsePrimary()
+	}
+	p.i++
+	x, isBool, err := p.parseUnary()
+	if err != nil {
+		return nil, false, err
+	}
+	if isBool {
+		return nil, false, fmt.Errorf("'-' applied to a condition")
+	}
+	return &negNode{x}, false, nil
+}
+
+func (p *filterParser) parsePrimary() (node, bool, error) {
+	tok := p.peek()
+	switch {
+	case tok == "":
+		return nil, false, fmt.Errorf("expression ended unexpectedly")
+	case tok == "(":
+		p.i++
+		x, isBool, err := p.parseOr()
+		if err != nil {
+			return nil, false, err
+		}
+		if p.peek() != ")" {
+			return nil, false, fmt.Errorf("missing ')'")
+		}
+		p.i++
+		return x, isBool, nil
+	case isIdentStart(tok[0]):
+		p.i++
+		col, ok := p.cols[tok]
+		if !ok {
+			col = len(p.names)
+			p.cols[tok] = col
+			p.names = append(p.names, tok)
+		}
+		return &varNode{col}, false, nil
+	case isDigit(tok[0]) || tok[0] == '.':
+		p.i++
+		val, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("'%s' is not a number", tok)
+		}
+		return &numNode{val}, false, nil
+	}
+	return nil, false, fmt.Errorf("unexpected token '%s'", tok)
+}
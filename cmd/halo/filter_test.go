@@ -0,0 +1,111 @@
+package halo
+
+import (
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr  string
+		ok    bool
+		names []string
+	}{
+		{"", true, nil},
+		{`""`, true, nil},
+		{"M200m > 1e13", true, []string{"M200m"}},
+		{`"M200m > 1e13 && Xoff < 0.07"`, true, []string{"M200m", "Xoff"}},
+		{"!(M200m >= 1e12) || M200m/M200c != 2", true,
+			[]string{"M200m", "M200c"}},
+		{"-X*2 + 3.5e-2 <= Y - Z", true, []string{"X", "Y", "Z"}},
+		{"M200m", false, nil},
+		{"M200m > 1e13 &&", false, nil},
+		{"(M200m > 1e13", false, nil},
+		{"M200m > 1e13)", false, nil},
+		{"M200m > 1e13 + (X < 1)", false, nil},
+		{"!M200m", false, nil},
+		{"M200m && X > 1", false, nil},
+		{"M200m $ 1", false, nil},
+		{"M200m > 1e1e1", false, nil},
+	}
+
+	for i, test := range tests {
+		f, err := ParseFilter(test.expr)
+		if (err == nil) != test.ok {
+			t.Errorf("%d) Expected ok = %v for '%s', got error %v.",
+				i, test.ok, test.expr, err)
+			continue
+		} else if !test.ok {
+			continue
+		}
+
+		names := f.Names()
+		if len(names) != len(test.names) {
+			t.Errorf("%d) Expected names %v for '%s', got %v.",
+				i, test.names, test.expr, names)
+			continue
+		}
+		for j := range names {
+			if names[j] != test.names[j] {
+				t.Errorf("%d) Expected names %v for '%s', got %v.",
+					i, test.names, test.expr, names)
+				break
+			}
+		}
+	}
+}
+
+func TestFilterSelect(t *testing.T) {
+	ms := []float64{1e12, 5e12, 2e13, 8e13}
+	xoffs := []float64{0.01, 0.10, 0.05, 0.20}
+
+	tests := []struct {
+		expr string
+		cols [][]float64
+		ok   []bool
+	}{
+		{"", [][]float64{ms}, []bool{true, true, true, true}},
+		{"M200m > 3e12", [][]float64{ms},
+			[]bool{false, true, true, true}},
+		{"M200m > 3e12 && Xoff < 0.07", [][]float64{ms, xoffs},
+			[]bool{false, false, true, false}},
+		{"M200m < 3e12 || Xoff > 0.15", [][]float64{ms, xoffs},
+			[]bool{true, false, false, true}},
+		{"!(M200m < 3e12 || Xoff > 0.15)", [][]float64{ms, xoffs},
+			[]bool{false, true, true, false}},
+		{"Xoff * 2 - 0.1 == 0 || -Xoff == -0.01", [][]float64{xoffs},
+			[]bool{true, false, true, false}},
+		{"M200m / 1e12 >= 5 && M200m / 1e12 <= 20", [][]float64{ms},
+			[]bool{false, true, true, false}},
+	}
+
+	for i, test := range tests {
+		f, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("%d) Could not parse '%s': %s",
+				i, test.expr, err.Error())
+			continue
+		}
+		ok := f.Select(test.cols)
+		if len(ok) != len(test.ok) {
+			t.Errorf("%d) Expected %v for '%s', got %v.",
+				i, test.ok, test.expr, ok)
+			continue
+		}
+		for j := range ok {
+			if ok[j] != test.ok[j] {
+				t.Errorf("%d) Expected %v for '%s', got %v.",
+					i, test.ok, test.expr, ok)
+				break
+			}
+		}
+	}
+}
+
+func TestSelectRows(t *testing.T) {
+	cols := [][]float64{{1, 2, 3, 4}, {5, 6, 7, 8}}
+	out := SelectRows(cols, []bool{true, false, false, true})
+	if len(out) != 2 || len(out[0]) != 2 || len(out[1]) != 2 ||
+		out[0][0] != 1 || out[0][1] != 4 || out[1][0] != 5 || out[1][1] != 8 {
+		t.Errorf("Expected [[1 4] [5 8]], got %v.", out)
+	}
+}
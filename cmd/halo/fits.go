@@ -0,0 +1,47 @@
+package halo
+
+import (
+	"math"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+// MoreRsp returns the More, Diemer, & Kravtsov (2015) fit to the median
+// R_sp/R200m of halos with accretion rate gamma in the given cosmology,
+// R_sp/R200m = 0.54 (1 + 0.53 Omega_m(z)) (1 + 1.36 exp(-Gamma / 3.04)).
+func MoreRsp(gamma float64, c *io.CosmologyHeader) float64 {
+	return SplashbackRelation(MoreRspParams, gamma, OmegaMZ(c), 1)
+}
+
+// MoreMsp returns the More, Diemer, & Kravtsov (2015) fit to the median
+// M_sp/M200m of halos with accretion rate gamma in the given cosmology,
+// M_sp/M200m = 0.59 (1 + 0.35 Omega_m(z)) (1 + 0.92 exp(-Gamma / 4.54)).
+func MoreMsp(gamma float64, c *io.CosmologyHeader) float64 {
+	return SplashbackRelation(MoreMspParams, gamma, OmegaMZ(c), 1)
+}
+
+// MoreRspParams and MoreMspParams are the parameters of SplashbackRelation
+// which give the More, Diemer, & Kravtsov (2015) fits.
+var (
+	MoreRspParams = []float64{0.54, 0.53, 1.36, 3.04}
+	MoreMspParams = []float64{0.59, 0.35, 0.92, 4.54}
+)
+
+// SplashbackRelation evaluates the relation
+// A (1 + B Omega_m(z)) (1 + C exp(-Gamma / D)) nu^E for a halo with accretion
+// rate gamma and peak height nu, where ps is {A, B, C, D, E}. If ps only has
+// four elements, the relation doesn't depend on nu.
+func SplashbackRelation(ps []float64, gamma, omegaM, nu float64) float64 {
+	y := ps[0] * (1 + ps[1]*omegaM) * (1 + ps[2]*math.Exp(-gamma/ps[3]))
+	if len(ps) > 4 {
+		y *= math.Pow(nu, ps[4])
+	}
+	return y
+}
+
+// OmegaMZ returns the matter density parameter of a flat universe at the
+// redshift of c.
+func OmegaMZ(c *io.CosmologyHeader) float64 {
+	m := c.OmegaM * math.Pow(1+c.Z, 3)
+	return m / (m + c.OmegaL)
+}
@@ -0,0 +1,48 @@
+package halo
+
+import (
+	"math"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+func TestMoreFits(t *testing.T) {
+	// At high redshift Omega_m(z) -> 1, and at Gamma = 0 the exponential
+	// terms are 1.
+	hiZ := &io.CosmologyHeader{Z: 1e6, OmegaM: 0.27, OmegaL: 0.73}
+	lowZ := &io.CosmologyHeader{Z: 0, OmegaM: 0.27, OmegaL: 0.73}
+
+	tests := []struct {
+		gamma    float64
+		c        *io.CosmologyHeader
+		rsp, msp float64
+	}{
+		{0, hiZ, 0.54 * 1.53 * 2.36, 0.59 * 1.35 * 1.92},
+		{3.04, lowZ, 0.54 * (1 + 0.53*0.27) * (1 + 1.36/math.E),
+			0.59 * (1 + 0.35*0.27) * (1 + 0.92*math.Exp(-3.04/4.54))},
+		{1e6, hiZ, 0.54 * 1.53, 0.59 * 1.35},
+	}
+
+	for i, test := range tests {
+		rsp, msp := MoreRsp(test.gamma, test.c), MoreMsp(test.gamma, test.c)
+		if math.Abs(rsp-test.rsp) > 1e-6 || math.Abs(msp-test.msp) > 1e-6 {
+			t.Errorf("%d) Expected (%g, %g), got (%g, %g).",
+				i, test.rsp, test.msp, rsp, msp)
+		}
+	}
+}
+
+func TestSplashbackRelation(t *testing.T) {
+	ps := []float64{0.5, 0.5, 1, 2}
+	expected := 0.5 * 1.2 * (1 + math.Exp(-1))
+	if y := SplashbackRelation(ps, 2, 0.4, 3); math.Abs(y-expected) > 1e-12 {
+		t.Errorf("Expected %g without a nu term, got %g.", expected, y)
+	}
+
+	// nu^0.5 = 2.
+	ps = append(ps, 0.5)
+	if y := SplashbackRelation(ps, 2, 0.4, 4); math.Abs(y-2*expected) > 1e-12 {
+		t.Errorf("Expected %g with a nu term, got %g.", 2*expected, y)
+	}
+}
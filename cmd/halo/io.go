@@ -1,9 +1,14 @@
 package halo
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/io"
@@ -23,6 +28,12 @@ type VarColumns struct {
 	Generator []string
 	NBinary int
 	RadiusUnits string
+	// Filter, if non-nil, is used to remove rows when the text catalog is
+	// first converted to a binary file.
+	Filter *Filter
+	// Fields are the CompaSO field specifiers corresponding to each name. If
+	// nil, the catalog is a text catalog and Columns is used instead.
+	Fields []string
 }
 
 func NewVarColumns(
@@ -39,8 +50,8 @@ func NewVarColumns(
 	vc.Generator = make([]string, len(vc.Names))
 	vc.NBinary = len(vc.Names)
 
-	mNames := []string{"M200m", "M200c", "M500c", "M2500c"}
-	rNames := []string{"R200m", "R200c", "R500c", "R2500c"}
+	mNames := []string{"M200m", "M200c", "M500c", "M2500c", "Mvir"}
+	rNames := []string{"R200m", "R200c", "R500c", "R2500c", "Rvir"}
 	for i, _ := range mNames {
 		_, rOk := vc.ColumnLookup[rNames[i]]
 		_, mOk := vc.ColumnLookup[mNames[i]]
@@ -78,6 +89,21 @@ func (vc *VarColumns) GetColumn(
 	return rs
 }
 
+// applyFilter removes all the rows of cols which don't pass vc.Filter.
+func (vc *VarColumns) applyFilter(
+	cols [][]float64, cosmo *io.CosmologyHeader,
+) [][]float64 {
+	if vc.Filter == nil { return cols }
+
+	names := vc.Filter.Names()
+	fCols := make([][]float64, len(names))
+	for i := range names {
+		fCols[i] = vc.GetColumn(cols, names[i], cosmo)
+	}
+
+	return SelectRows(cols, vc.Filter.Select(fCols))
+}
+
 func (vc *VarColumns) GetIDs(cols [][]float64) []int {
 	col, _ := vc.ColumnLookup["ID"]
 
@@ -108,10 +134,11 @@ func RockstarConvert(
 		}
 	}
 
-	cols, err := readTable(inFile, valIdxs)
+	cols, err := vars.readTable(inFile, valIdxs)
 	if err != nil {
 		return err
 	}
+	cols = vars.applyFilter(cols, cosmo)
 
 	f, err := os.Create(outFile)
 	if err != nil {
@@ -171,10 +198,11 @@ func RockstarConvertTopN(
 		}
 	}
 
-	cols, err := readTable(inFile, valIdxs)
+	cols, err := vars.readTable(inFile, valIdxs)
 	if err != nil {
 		return err
 	}
+	cols = vars.applyFilter(cols, cosmo)
 
 	if n > len(cols[0]) {
 		n = len(cols[0])
@@ -219,6 +247,17 @@ func ReadBinaryRockstar(
 	return readRockstarVals(file, binaryColGetter, vc)
 }
 
+// ReadBinaryRockstarBytes is ReadBinaryRockstar for the contents of a binary
+// catalog which have already been read into memory.
+func ReadBinaryRockstarBytes(
+	data []byte, vc *VarColumns,
+) (ids []int, rawCols [][]float64, err error) {
+	getter := func(_ string, colIdxs []int) ([][]float64, error) {
+		return readBinaryCols(bytes.NewReader(data), colIdxs)
+	}
+	return readRockstarVals("", getter, vc)
+}
+
 func readRockstarVals(
 	file string, getter colGetter, vc *VarColumns,
 ) (ids []int, rawCols [][]float64, err error) {
@@ -241,9 +280,21 @@ func binaryColGetter(file string, colIdxs []int) ([][]float64, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
+	return readBinaryCols(f, colIdxs)
+}
+
+// readSeeker is the part of os.File used to read binary catalogs.
+type readSeeker interface {
+	Read(p []byte) (int, error)
+	Seek(offset int64, whence int) (int64, error)
+}
+
+// readBinaryCols reads the given columns from a binary catalog.
+func readBinaryCols(f readSeeker, colIdxs []int) ([][]float64, error) {
 	n := int64(0)
-	err = binary.Read(f, binary.LittleEndian, &n)
+	err := binary.Read(f, binary.LittleEndian, &n)
 	if err != nil {
 		return nil, err
 	}
@@ -266,9 +317,99 @@ func binaryColGetter(file string, colIdxs []int) ([][]float64, error) {
 	return cols, nil
 }
 
+// readTable reads the given columns from a halo catalog. For CompaSO
+// catalogs, colIdxs index into vc.Fields.
+func (vc *VarColumns) readTable(
+	file string, colIdxs []int,
+) ([][]float64, error) {
+	if vc.Fields == nil { return readTable(file, colIdxs) }
+
+	fields := make([]string, len(colIdxs))
+	for i, idx := range colIdxs {
+		fields[i] = vc.Fields[idx]
+	}
+	cols, hd, err := ReadCompaSO(file, fields)
+	if err != nil { return nil, err }
+
+	// CompaSO positions run from -L/2 to +L/2.
+	for i, idx := range colIdxs {
+		switch vc.Names[idx] {
+		case "X", "Y", "Z":
+			for j := range cols[i] {
+				cols[i][j] += hd.BoxSize / 2
+			}
+		}
+	}
+
+	return cols, nil
+}
+
 func readTable(file string, colIdxs []int) ([][]float64, error) {
 	// TODO: Heavily optimize this.
 
 	_, floats, err := catalog.ReadFile(file, nil, colIdxs)
 	return floats, err
 }
+
+// ReadCatalogRows returns the leading comment lines of the text halo catalog
+// stored in file along with the full, unmodified line corresponding to each of
+// the given IDs. idCol is the 0-indexed column containing halo IDs.
+func ReadCatalogRows(
+	file string, idCol int, ids []int,
+) (header, rows []string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	idxs := make(map[int][]int)
+	for i, id := range ids {
+		idxs[id] = append(idxs[id], i)
+	}
+	rows = make([]string, len(ids))
+	inHeader := true
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<16), 1<<24)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 {
+			continue
+		} else if trimmed[0] == '#' {
+			if inHeader {
+				header = append(header, line)
+			}
+			continue
+		}
+		inHeader = false
+
+		words := strings.Fields(trimmed)
+		if idCol >= len(words) {
+			return nil, nil, fmt.Errorf("Line %d of %s has %d columns, "+
+				"but the ID column is %d.", lineNum, file, len(words), idCol)
+		}
+		x, err := strconv.ParseFloat(words[idCol], 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not parse the ID on line %d "+
+				"of %s: %s", lineNum, file, err.Error())
+		}
+
+		for _, i := range idxs[int(x)] {
+			rows[i] = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for i := range rows {
+		if rows[i] == "" {
+			return nil, nil, fmt.Errorf("Could not find ID %d in %s.",
+				ids[i], file)
+		}
+	}
+
+	return header, rows, nil
+}
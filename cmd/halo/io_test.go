@@ -0,0 +1,89 @@
+package halo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadCatalogRows(t *testing.T) {
+	text := `#ID DescID Mvir
+#a = 1.0
+  10  -1 1.5e12
+
+  11  -1 2.5e13
+# Inline comment.
+  12  11 3.5e11
+`
+	f, err := ioutil.TempFile("", "shellfish_catalog_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write([]byte(text)); err != nil {
+		t.Fatal(err.Error())
+	}
+	f.Close()
+
+	header, rows, err := ReadCatalogRows(f.Name(), 0, []int{12, 10, 12})
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(header) != 2 || header[0] != "#ID DescID Mvir" ||
+		header[1] != "#a = 1.0" {
+		t.Errorf("Got header %q.", header)
+	}
+	if len(rows) != 3 || rows[0] != "  12  11 3.5e11" ||
+		rows[1] != "  10  -1 1.5e12" || rows[2] != rows[0] {
+		t.Errorf("Got rows %q.", rows)
+	}
+
+	if _, _, err = ReadCatalogRows(f.Name(), 0, []int{13}); err == nil {
+		t.Errorf("Expected error for missing ID.")
+	}
+	if _, _, err = ReadCatalogRows(f.Name(), 3, []int{10}); err == nil {
+		t.Errorf("Expected error for out-of-range column.")
+	}
+}
+
+func TestReadBinaryRockstarBytes(t *testing.T) {
+	vc := NewVarColumns([]string{"ID", "X"}, []int64{0, 1}, "cMpc/h")
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, int64(2))
+	binary.Write(buf, binary.LittleEndian, []float64{10, 11})
+	binary.Write(buf, binary.LittleEndian, []float64{1.5, 2.5})
+
+	f, err := ioutil.TempFile("", "shellfish_binary_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		t.Fatal(err.Error())
+	}
+	f.Close()
+
+	fIDs, fCols, err := ReadBinaryRockstar(f.Name(), vc)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	ids, cols, err := ReadBinaryRockstarBytes(buf.Bytes(), vc)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+
+	if len(ids) != 2 || ids[0] != 10 || ids[1] != 11 ||
+		fIDs[0] != ids[0] || fIDs[1] != ids[1] {
+		t.Errorf("Got IDs %v from the file and %v from bytes.", fIDs, ids)
+	}
+	if len(cols) != 2 || cols[1][1] != 2.5 || fCols[1][1] != cols[1][1] {
+		t.Errorf("Got columns %v from the file and %v from bytes.",
+			fCols, cols)
+	}
+
+	if _, _, err = ReadBinaryRockstarBytes(buf.Bytes()[:20], vc); err == nil {
+		t.Errorf("Expected error for truncated catalog.")
+	}
+}
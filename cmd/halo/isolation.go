@@ -0,0 +1,48 @@
+package halo
+
+// FindNonIsolated flags each of the target halos which has a more massive
+// neighbor within mult times its own radius. xs, ys, zs, rs, and ms give the
+// positions, radii, and masses of every halo in the periodic box covered by g,
+// which must already have had these positions inserted into it. targets are
+// indices into these slices.
+func FindNonIsolated(
+	g *Grid, xs, ys, zs, rs, ms []float64, mult float64, targets []int,
+) []bool {
+	out := make([]bool, len(targets))
+	buf := make([]int, 0, g.MaxLength())
+	c, L := g.Cells, g.Width
+
+	for ti, i := range targets {
+		pos := [3]float64{xs[i], ys[i], zs[i]}
+		r := rs[i] * mult
+		b := periodicBounds(g, pos, r)
+
+	search:
+		for dz := 0; dz < b.Span[2]; dz++ {
+			z := (b.Origin[2] + dz) % c
+			for dy := 0; dy < b.Span[1]; dy++ {
+				y := (b.Origin[1] + dy) % c
+				for dx := 0; dx < b.Span[0]; dx++ {
+					x := (b.Origin[0] + dx) % c
+
+					buf = g.ReadIndexes(x+y*c+z*c*c, buf)
+					for _, j := range buf {
+						if j == i || ms[j] <= ms[i] {
+							continue
+						}
+
+						ddx := periodicDist(pos[0]-xs[j], L)
+						ddy := periodicDist(pos[1]-ys[j], L)
+						ddz := periodicDist(pos[2]-zs[j], L)
+						if ddx*ddx+ddy*ddy+ddz*ddz <= r*r {
+							out[ti] = true
+							break search
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,43 @@
+package halo
+
+import (
+	"testing"
+)
+
+func TestFindNonIsolated(t *testing.T) {
+	xs := []float64{10, 11.5, 50, 99.5, 0.5, 30}
+	ys := []float64{10, 10, 50, 50, 50, 30}
+	zs := []float64{10, 10, 50, 50, 50, 30}
+	rs := []float64{1, 0.5, 2, 1, 1, 1}
+	ms := []float64{1e13, 1e12, 1e14, 1e13, 2e13, 1e13}
+
+	g := NewGrid(10, 100, len(xs))
+	g.Insert(xs, ys, zs)
+
+	tests := []struct {
+		mult     float64
+		targets  []int
+		expected []bool
+	}{
+		// 1 is 1.5 from the more massive 0, 3 is 1 from 4 across the boundary.
+		{1, []int{0, 1, 2, 3, 4, 5}, []bool{false, false, false, true, false, false}},
+		{3, []int{0, 1, 2, 3, 4, 5}, []bool{false, true, false, true, false, false}},
+		{0.5, []int{3, 1}, []bool{false, false}},
+		// Search radius larger than the box.
+		{200, []int{5, 2}, []bool{true, false}},
+	}
+
+	for i, test := range tests {
+		out := FindNonIsolated(g, xs, ys, zs, rs, ms, test.mult, test.targets)
+		if len(out) != len(test.expected) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.expected, out)
+			continue
+		}
+		for j := range out {
+			if out[j] != test.expected[j] {
+				t.Errorf("%d) Expected %v, got %v.", i, test.expected, out)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package halo
+
+import (
+	"math"
+)
+
+// Jackknife combines a set of delete-one (or delete-one-group) estimates of a
+// quantity into their mean and the jackknife estimate of its standard error,
+// sqrt((n-1)/n * sum_i (x_i - mean)^2). NaNs are returned if fewer than two
+// estimates are given.
+func Jackknife(xs []float64) (mean, sigma float64) {
+	if len(xs) < 2 {
+		return math.NaN(), math.NaN()
+	}
+
+	for _, x := range xs {
+		mean += x
+	}
+	n := float64(len(xs))
+	mean /= n
+
+	sum := 0.0
+	for _, x := range xs {
+		sum += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt((n - 1) / n * sum)
+}
@@ -0,0 +1,50 @@
+package halo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestJackknife(t *testing.T) {
+	// The delete-one means of a sample reproduce the standard error of the
+	// mean of the full sample.
+	sample := []float64{1, 2, 4, 7, 11}
+	sum := 0.0
+	for _, x := range sample {
+		sum += x
+	}
+	n := float64(len(sample))
+	ests := make([]float64, len(sample))
+	for i := range sample {
+		ests[i] = (sum - sample[i]) / (n - 1)
+	}
+	sampleMean, sampleVar := sum/n, 0.0
+	for _, x := range sample {
+		sampleVar += (x - sampleMean) * (x - sampleMean)
+	}
+	sampleVar /= n - 1
+
+	tests := []struct {
+		xs          []float64
+		mean, sigma float64
+	}{
+		{[]float64{3, 3, 3}, 3, 0},
+		{[]float64{1, 3}, 2, 1},
+		{ests, sampleMean, math.Sqrt(sampleVar / n)},
+	}
+
+	for i, test := range tests {
+		mean, sigma := Jackknife(test.xs)
+		if math.Abs(mean-test.mean) > 1e-10 ||
+			math.Abs(sigma-test.sigma) > 1e-10 {
+			t.Errorf("%d) Expected (%g, %g), got (%g, %g).",
+				i, test.mean, test.sigma, mean, sigma)
+		}
+	}
+
+	if mean, sigma := Jackknife([]float64{1}); !math.IsNaN(mean) ||
+		!math.IsNaN(sigma) {
+		t.Errorf("Expected NaNs for a single estimate, got (%g, %g).",
+			mean, sigma)
+	}
+}
@@ -0,0 +1,43 @@
+package halo
+
+import (
+	"math"
+)
+
+// MassFunction bins masses into bins logarithmic bins between mMin and mMax
+// and returns the edges of the bins, the number of masses in each bin, and
+// the mass function, dn/dlog10(M), along with its Poisson error. volume is the
+// volume that the masses were drawn from. Masses outside the range are
+// ignored.
+func MassFunction(
+	ms []float64, mMin, mMax float64, bins int, volume float64,
+) (edges []float64, ns []int, dn, err []float64) {
+	logMin, logMax := math.Log10(mMin), math.Log10(mMax)
+	dlog := (logMax - logMin) / float64(bins)
+
+	edges = make([]float64, bins+1)
+	for i := range edges {
+		edges[i] = math.Pow(10, logMin+dlog*float64(i))
+	}
+
+	ns = make([]int, bins)
+	for _, m := range ms {
+		if !(m >= mMin && m < mMax) {
+			continue
+		}
+		i := int((math.Log10(m) - logMin) / dlog)
+		if i >= bins {
+			i = bins - 1
+		}
+		ns[i]++
+	}
+
+	dn, err = make([]float64, bins), make([]float64, bins)
+	for i := range ns {
+		n := float64(ns[i])
+		dn[i] = n / (volume * dlog)
+		err[i] = math.Sqrt(n) / (volume * dlog)
+	}
+
+	return edges, ns, dn, err
+}
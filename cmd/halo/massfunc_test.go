@@ -0,0 +1,37 @@
+package halo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMassFunction(t *testing.T) {
+	ms := []float64{1.5e10, 2e10, 5e11, 9.9e11, 1e12, 5e9, math.NaN()}
+	edges, ns, dn, err := MassFunction(ms, 1e10, 1e12, 2, 10)
+
+	expEdges := []float64{1e10, 1e11, 1e12}
+	expNs := []int{2, 2}
+	for i := range expEdges {
+		if math.Abs(edges[i]-expEdges[i]) > 1e-6*expEdges[i] {
+			t.Errorf("Expected edges %v, got %v.", expEdges, edges)
+			break
+		}
+	}
+	for i := range expNs {
+		if ns[i] != expNs[i] {
+			t.Errorf("Expected counts %v, got %v.", expNs, ns)
+			break
+		}
+	}
+
+	// Bins are 1 dex wide and the volume is 10.
+	for i := range dn {
+		if math.Abs(dn[i]-0.2) > 1e-10 {
+			t.Errorf("Expected dn/dlogM of 0.2, got %g.", dn[i])
+		}
+		if math.Abs(err[i]-math.Sqrt(2)/10) > 1e-10 {
+			t.Errorf("Expected an error of %g, got %g.",
+				math.Sqrt(2)/10, err[i])
+		}
+	}
+}
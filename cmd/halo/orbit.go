@@ -0,0 +1,98 @@
+package halo
+
+import (
+	"math"
+)
+
+const (
+	infalling = iota
+	orbiting
+	finished
+)
+
+// OrbitTracker follows the radial distances of a fixed set of particles from
+// a halo's center across a sequence of snapshots and records the first
+// apocenter that each particle reaches after its first pericenter passage.
+// Pericenters and apocenters are identified as local minima and maxima of
+// the sampled radii.
+type OrbitTracker struct {
+	index      map[int64]int
+	r0, r1     []float64 // Radii two snapshots ago and one snapshot ago.
+	phase      []uint8
+	prevR200m  float64
+	apocenters []float64
+	snaps      int
+}
+
+// NewOrbitTracker creates an OrbitTracker for the particles with the given
+// IDs.
+func NewOrbitTracker(ids []int64) *OrbitTracker {
+	ot := &OrbitTracker{
+		index: make(map[int64]int, len(ids)),
+		r0:    make([]float64, len(ids)),
+		r1:    make([]float64, len(ids)),
+		phase: make([]uint8, len(ids)),
+	}
+	for i, id := range ids {
+		ot.index[id] = i
+		ot.r0[i], ot.r1[i] = math.Inf(+1), math.Inf(+1)
+	}
+	return ot
+}
+
+// Update adds a new snapshot to the tracker. ids and rs are the IDs and
+// radial distances of the tracked particles which were found near the halo
+// in this snapshot; particles that weren't found are treated as being
+// infinitely far away. IDs which aren't being tracked are ignored. r200m is
+// the radius of the halo in this snapshot in the same units as rs.
+func (ot *OrbitTracker) Update(ids []int64, rs []float64, r200m float64) {
+	curr := make([]float64, len(ot.r1))
+	for i := range curr {
+		curr[i] = math.Inf(+1)
+	}
+	for i, id := range ids {
+		if j, ok := ot.index[id]; ok {
+			curr[j] = rs[i]
+		}
+	}
+
+	if ot.snaps >= 2 {
+		for i := range curr {
+			r0, r1, r2 := ot.r0[i], ot.r1[i], curr[i]
+			switch ot.phase[i] {
+			case infalling:
+				if r1 < r0 && r1 < r2 {
+					ot.phase[i] = orbiting
+				}
+			case orbiting:
+				if r1 > r0 && r1 > r2 && !math.IsInf(r1, 0) {
+					ot.apocenters = append(ot.apocenters, r1/ot.prevR200m)
+					ot.phase[i] = finished
+				}
+			}
+		}
+	}
+
+	ot.r0, ot.r1 = ot.r1, curr
+	ot.prevR200m = r200m
+	ot.snaps++
+}
+
+// Apocenters returns the radii of every first apocenter detected so far in
+// units of R200m at the time of the apocenter.
+func (ot *OrbitTracker) Apocenters() []float64 {
+	return ot.apocenters
+}
+
+// Orbiting returns the IDs of the tracked particles which have passed
+// through their first pericenter. All other tracked particles are still on
+// their first infall.
+func (ot *OrbitTracker) Orbiting() map[int64]bool {
+	orbiting := map[int64]bool{}
+	for id, i := range ot.index {
+		if ot.phase[i] != infalling {
+			orbiting[id] = true
+		}
+	}
+	return orbiting
+}
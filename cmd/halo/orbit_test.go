@@ -0,0 +1,51 @@
+package halo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOrbitTracker(t *testing.T) {
+	inf := math.Inf(+1)
+	ids := []int64{1, 2, 3}
+	r200ms := []float64{1, 1, 1, 1, 2, 2}
+	rs := [][]float64{
+		{3, 5, inf},
+		{2, 4, 2},
+		{1, 3, 1},
+		{2, 2.5, 1.8},
+		{3, 2, 1.2},
+		{2, 1.5, 1.4},
+	}
+
+	ot := NewOrbitTracker(ids)
+	for i := range rs {
+		// Include an untracked particle and drop particles at infinity.
+		snapIDs, snapRs := []int64{4}, []float64{0.5}
+		for j := range ids {
+			if !math.IsInf(rs[i][j], 0) {
+				snapIDs = append(snapIDs, ids[j])
+				snapRs = append(snapRs, rs[i][j])
+			}
+		}
+		ot.Update(snapIDs, snapRs, r200ms[i])
+	}
+
+	apo := ot.Apocenters()
+	expected := []float64{1.8, 1.5}
+	if len(apo) != len(expected) {
+		t.Fatalf("Expected apocenters %v, got %v.", expected, apo)
+	}
+	for i := range expected {
+		if math.Abs(apo[i]-expected[i]) > 1e-10 {
+			t.Errorf("Expected apocenters %v, got %v.", expected, apo)
+			break
+		}
+	}
+
+	orbiting := ot.Orbiting()
+	if len(orbiting) != 2 || !orbiting[1] || !orbiting[3] {
+		t.Errorf("Expected particles 1 and 3 to be orbiting, got %v.",
+			orbiting)
+	}
+}
@@ -0,0 +1,35 @@
+package halo
+
+import (
+	"math"
+)
+
+// SurfaceDensityProfile bins a set of projected radii and masses into a
+// surface density profile with logarithmic bins between rMin and rMax. The
+// geometric centers of the bins and the surface density within each bin are
+// returned. Particles outside [rMin, rMax) are ignored.
+func SurfaceDensityProfile(
+	rs, ms []float64, rMin, rMax float64, bins int,
+) (centers, sigmas []float64) {
+	centers, sigmas = make([]float64, bins), make([]float64, bins)
+	lrMin, dlr := math.Log(rMin), math.Log(rMax/rMin)/float64(bins)
+	for i := range rs {
+		if rs[i] < rMin || rs[i] >= rMax {
+			continue
+		}
+		j := int((math.Log(rs[i]) - lrMin) / dlr)
+		if j >= bins {
+			j = bins - 1
+		}
+		sigmas[j] += ms[i]
+	}
+
+	for j := range sigmas {
+		r0 := math.Exp(lrMin + float64(j)*dlr)
+		r1 := math.Exp(lrMin + float64(j+1)*dlr)
+		centers[j] = math.Exp(lrMin + (float64(j)+0.5)*dlr)
+		sigmas[j] /= math.Pi * (r1*r1 - r0*r0)
+	}
+
+	return centers, sigmas
+}
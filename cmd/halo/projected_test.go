@@ -0,0 +1,40 @@
+package halo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSurfaceDensityProfile(t *testing.T) {
+	rMin, rMax, bins := 1.0, 8.0, 3
+	// Bin edges: 1, 2, 4, 8.
+	areas := []float64{3 * math.Pi, 12 * math.Pi, 48 * math.Pi}
+	centers := []float64{math.Sqrt(2), 2 * math.Sqrt(2), 4 * math.Sqrt(2)}
+
+	tests := []struct {
+		rs, ms   []float64
+		expected []float64
+	}{
+		// One particle per bin with a mass equal to the bin's area.
+		{centers, areas, []float64{1, 1, 1}},
+		// Masses within a bin are summed.
+		{[]float64{1.1, 1.9, 3}, []float64{1, 2, 6 * math.Pi},
+			[]float64{1 / math.Pi, 0.5, 0}},
+		// Particles outside [rMin, rMax) are ignored.
+		{[]float64{0.5, 1.5, 8, 10}, []float64{1, areas[0], 1, 1},
+			[]float64{1, 0, 0}},
+	}
+
+	for i, test := range tests {
+		rs, sigmas := SurfaceDensityProfile(
+			test.rs, test.ms, rMin, rMax, bins,
+		)
+		for j := range rs {
+			if math.Abs(rs[j]-centers[j]) > 1e-10 ||
+				math.Abs(sigmas[j]-test.expected[j]) > 1e-10 {
+				t.Errorf("%d) Expected (%g, %g) in bin %d, got (%g, %g).",
+					i, centers[j], test.expected[j], j, rs[j], sigmas[j])
+			}
+		}
+	}
+}
@@ -15,6 +15,7 @@ const (
 	R200m
 	R500c
 	R2500c
+	Rvir
 )
 
 
@@ -28,6 +29,8 @@ func RadiusFromString(s string) (r Radius, ok bool) {
 		return R500c, true
 	case "R2500c":
 		return R2500c, true
+	case "Rvir":
+		return Rvir, true
 	}
 	return -1, false
 }
@@ -42,6 +45,8 @@ func (r Radius) MassString() string {
 		return "R500c"
 	case R2500c:
 		return "M2500c"
+	case Rvir:
+		return "Mvir"
 	}
 	panic(":3")
 }
@@ -57,6 +62,8 @@ func (r Radius) String() string {
 		return "R500c"
 	case R2500c:
 		return "R2500c"
+	case Rvir:
+		return "Rvir"
 	}
 	panic(":3")
 }
@@ -74,6 +81,9 @@ func (r Radius) Radius(c *io.CosmologyHeader, ms, out []float64) {
 		rho = 500 * cosmo.RhoCritical(h0, c.OmegaM, c.OmegaL, c.Z)
 	case R2500c:
 		rho = 2500 * cosmo.RhoCritical(h0, c.OmegaM, c.OmegaL, c.Z)
+	case Rvir:
+		rho = cosmo.VirialOverdensity(c.OmegaM, c.OmegaL, c.Z) *
+			cosmo.RhoCritical(h0, c.OmegaM, c.OmegaL, c.Z)
 	default:
 		panic(":3")
 	}
@@ -99,6 +109,9 @@ func (r Radius) Mass(c *io.CosmologyHeader, rs, out []float64) {
 		rho = 500 * cosmo.RhoCritical(h0, c.OmegaM, c.OmegaL, c.Z)
 	case R2500c:
 		rho = 2500 * cosmo.RhoCritical(h0, c.OmegaM, c.OmegaL, c.Z)
+	case Rvir:
+		rho = cosmo.VirialOverdensity(c.OmegaM, c.OmegaL, c.Z) *
+			cosmo.RhoCritical(h0, c.OmegaM, c.OmegaL, c.Z)
 	}
 
 	a := 1 / (1 + c.Z)
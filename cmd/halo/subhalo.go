@@ -0,0 +1,51 @@
+package halo
+
+import (
+	"fmt"
+)
+
+// FindHosts takes a list of halo IDs and the IDs of their parent halos (e.g.
+// Rockstar's UpID or PID column) and returns the ID of the top-level host of
+// each halo. Parent IDs of -1 indicate that a halo is not a subhalo, and such
+// halos have a host ID of -1. Parent chains are followed to the end, so
+// sub-subhalos are assigned to the host of their parent rather than to the
+// parent itself. If a parent is not in ids, it is treated as a host.
+//
+// An error is returned if the parent chains contain a cycle.
+func FindHosts(ids, parentIDs []int) ([]int, error) {
+	if len(ids) != len(parentIDs) {
+		panic(fmt.Sprintf("len(ids) = %d, but len(parentIDs) = %d.",
+			len(ids), len(parentIDs)))
+	}
+
+	idxs := make(map[int]int, len(ids))
+	for i, id := range ids {
+		idxs[id] = i
+	}
+
+	hosts := make([]int, len(ids))
+	for i := range hosts {
+		hosts[i] = -1
+		if parentIDs[i] == -1 {
+			continue
+		}
+
+		// A chain can be no longer than the catalog without looping.
+		host := parentIDs[i]
+		for step := 0; ; step++ {
+			if step > len(ids) {
+				return nil, fmt.Errorf("The parent IDs of halo %d form "+
+					"a cycle.", ids[i])
+			}
+
+			j, ok := idxs[host]
+			if !ok || parentIDs[j] == -1 {
+				break
+			}
+			host = parentIDs[j]
+		}
+		hosts[i] = host
+	}
+
+	return hosts, nil
+}
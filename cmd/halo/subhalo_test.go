@@ -0,0 +1,52 @@
+package halo
+
+import (
+	"testing"
+)
+
+func TestFindHosts(t *testing.T) {
+	tests := []struct {
+		ids, parentIDs []int
+		hosts          []int
+		ok             bool
+	}{
+		// No subhalos.
+		{[]int{1, 2, 3}, []int{-1, -1, -1}, []int{-1, -1, -1}, true},
+		// Single level of subhalos.
+		{[]int{1, 2, 3, 4}, []int{-1, 1, 1, -1}, []int{-1, 1, 1, -1}, true},
+		// Nested subhalos.
+		{[]int{1, 2, 3, 4}, []int{-1, 1, 2, 3}, []int{-1, 1, 1, 1}, true},
+		// Nested subhalos listed before their hosts.
+		{[]int{4, 3, 2, 1, 5}, []int{3, 2, 1, -1, 2},
+			[]int{1, 1, 1, -1, 1}, true},
+		// Multiple hosts with nested subhalos.
+		{[]int{10, 11, 12, 20, 21, 22}, []int{-1, 10, 11, -1, 20, 21},
+			[]int{-1, 10, 10, -1, 20, 20}, true},
+		// Parents which aren't in the catalog.
+		{[]int{1, 2}, []int{7, 1}, []int{7, 7}, true},
+		// Cycles.
+		{[]int{1, 2}, []int{2, 1}, nil, false},
+		{[]int{1, 2, 3}, []int{-1, 3, 3}, nil, false},
+	}
+
+	for i, test := range tests {
+		hosts, err := FindHosts(test.ids, test.parentIDs)
+		if (err == nil) != test.ok {
+			t.Errorf("%d) Expected ok = %v, got error %v.", i, test.ok, err)
+			continue
+		} else if !test.ok {
+			continue
+		}
+
+		if len(hosts) != len(test.hosts) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.hosts, hosts)
+			continue
+		}
+		for j := range hosts {
+			if hosts[j] != test.hosts[j] {
+				t.Errorf("%d) Expected %v, got %v.", i, test.hosts, hosts)
+				break
+			}
+		}
+	}
+}
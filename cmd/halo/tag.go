@@ -0,0 +1,97 @@
+package halo
+
+import (
+	"math"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+// ParticleTagger follows the radial distances of a fixed set of particles
+// from a halo's center across a sequence of snapshots, in the same way as
+// OrbitTracker, and records when each particle first fell into the halo and
+// how many pericenters it has passed through.
+type ParticleTagger struct {
+	ids         []int64
+	index       map[int64]int
+	r0, r1      []float64 // Radii two snapshots ago and one snapshot ago.
+	infallMult  float64
+	infallSnaps []int32
+	pericenters []uint16
+	snaps       int
+}
+
+// NewParticleTagger creates a ParticleTagger for the particles with the given
+// IDs. Particles have fallen into the halo once they are within
+// infallMult*R200m of its center.
+func NewParticleTagger(ids []int64, infallMult float64) *ParticleTagger {
+	pt := &ParticleTagger{
+		ids:         ids,
+		index:       make(map[int64]int, len(ids)),
+		r0:          make([]float64, len(ids)),
+		r1:          make([]float64, len(ids)),
+		infallMult:  infallMult,
+		infallSnaps: make([]int32, len(ids)),
+		pericenters: make([]uint16, len(ids)),
+	}
+	for i, id := range ids {
+		pt.index[id] = i
+		pt.r0[i], pt.r1[i] = math.Inf(+1), math.Inf(+1)
+		pt.infallSnaps[i] = -1
+	}
+	return pt
+}
+
+// Update adds snapshot snap to the tagger. ids and rs are the IDs and radial
+// distances of the tracked particles which were found near the halo in this
+// snapshot; particles that weren't found are treated as being infinitely far
+// away. IDs which aren't being tracked are ignored. r200m is the radius of
+// the halo in this snapshot in the same units as rs. Snapshots must be added
+// in order.
+func (pt *ParticleTagger) Update(
+	snap int, ids []int64, rs []float64, r200m float64,
+) {
+	curr := make([]float64, len(pt.r1))
+	for i := range curr {
+		curr[i] = math.Inf(+1)
+	}
+	for i, id := range ids {
+		if j, ok := pt.index[id]; ok {
+			curr[j] = rs[i]
+		}
+	}
+
+	for i := range curr {
+		if pt.infallSnaps[i] == -1 && curr[i] <= pt.infallMult*r200m {
+			pt.infallSnaps[i] = int32(snap)
+		}
+	}
+
+	if pt.snaps >= 2 {
+		for i := range curr {
+			r0, r1, r2 := pt.r0[i], pt.r1[i], curr[i]
+			if r1 < r0 && r1 < r2 && pt.pericenters[i] < math.MaxUint16 {
+				pt.pericenters[i]++
+			}
+		}
+	}
+
+	pt.r0, pt.r1 = pt.r1, curr
+	pt.snaps++
+}
+
+// Tags returns the tags of every tracked particle for the halo with the
+// given ID and snapshot.
+func (pt *ParticleTagger) Tags(haloID, snap int) *io.ParticleTags {
+	tags := &io.ParticleTags{
+		HaloID:      int64(haloID),
+		Snap:        int32(snap),
+		IDs:         pt.ids,
+		InfallSnaps: pt.infallSnaps,
+		Pericenters: pt.pericenters,
+		Orbiting:    make([]bool, len(pt.ids)),
+	}
+	for i := range tags.Orbiting {
+		tags.Orbiting[i] = pt.pericenters[i] > 0
+	}
+	return tags
+}
@@ -0,0 +1,78 @@
+package halo
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+func TestParticleTagger(t *testing.T) {
+	inf := math.Inf(+1)
+	ids := []int64{1, 2, 3}
+	r200ms := []float64{1, 1, 1, 1, 2, 2}
+	rs := [][]float64{
+		{3, 5, inf},
+		{2, 4, 2},
+		{1, 3, 1},
+		{2, 2.5, 1.8},
+		{3, 2, 1.2},
+		{2, 1.5, 1.4},
+	}
+
+	pt := NewParticleTagger(ids, 1)
+	for i := range rs {
+		// Include an untracked particle and drop particles at infinity.
+		snapIDs, snapRs := []int64{4}, []float64{0.5}
+		for j := range ids {
+			if !math.IsInf(rs[i][j], 0) {
+				snapIDs = append(snapIDs, ids[j])
+				snapRs = append(snapRs, rs[i][j])
+			}
+		}
+		pt.Update(10+i, snapIDs, snapRs, r200ms[i])
+	}
+
+	tags := pt.Tags(7, 15)
+	if tags.HaloID != 7 || tags.Snap != 15 {
+		t.Errorf("Expected halo 7 in snapshot 15, got halo %d in "+
+			"snapshot %d.", tags.HaloID, tags.Snap)
+	}
+
+	infall := []int32{12, 14, 12}
+	pericenters := []uint16{1, 0, 2}
+	orbiting := []bool{true, false, true}
+	for i := range ids {
+		if tags.IDs[i] != ids[i] || tags.InfallSnaps[i] != infall[i] ||
+			tags.Pericenters[i] != pericenters[i] ||
+			tags.Orbiting[i] != orbiting[i] {
+			t.Errorf("%d) Expected tags (%d, %d, %d, %v), got "+
+				"(%d, %d, %d, %v).", i, ids[i], infall[i], pericenters[i],
+				orbiting[i], tags.IDs[i], tags.InfallSnaps[i],
+				tags.Pericenters[i], tags.Orbiting[i])
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := io.WriteParticleTags(buf, tags); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	read, err := io.ReadParticleTags(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if read.HaloID != tags.HaloID || read.Snap != tags.Snap ||
+		len(read.IDs) != len(tags.IDs) {
+		t.Fatalf("Expected %v, got %v after writing tags.", tags, read)
+	}
+	for i := range read.IDs {
+		if read.IDs[i] != tags.IDs[i] ||
+			read.InfallSnaps[i] != tags.InfallSnaps[i] ||
+			read.Pericenters[i] != tags.Pericenters[i] ||
+			read.Orbiting[i] != tags.Orbiting[i] {
+			t.Errorf("Expected %v, got %v after writing tags.", tags, read)
+			break
+		}
+	}
+}
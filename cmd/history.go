@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// HistoryConfig contains the configuration fields for the 'history' mode of
+// the shellfish tool.
+type HistoryConfig struct {
+	files   []string
+	columns []string
+}
+
+var _ Mode = &HistoryConfig{}
+
+// ExampleConfig creates an example history.config file.
+func (config *HistoryConfig) ExampleConfig() string {
+	return `[history.config]
+
+#####################
+## Required Fields ##
+#####################
+
+# Files is a list of catalogs written by the shell or stats tools, usually one
+# for each snapshot. The rows of every main progenitor given to the history
+# tool are looked up in these files by ID and snapshot and gathered into a
+# single catalog, so that the evolution of each halo's splashback shell can be
+# read from one file. Every file must contain the columns listed in Columns.
+Files = snap_080.stats.txt, snap_090.stats.txt, snap_100.stats.txt
+
+#####################
+## Optional Fields ##
+#####################
+
+# Columns is a list of the columns which are copied from Files, named without
+# their units (e.g. R_sp, M_sp, or P_ijk). Defaults to every column in the
+# first file other than ID and Snapshot.
+# Columns = R_sp, M_sp`
+}
+
+// ReadConfig reads in a history.config file into config.
+func (config *HistoryConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("history.config")
+	vars.Strings(&config.files, "Files", []string{})
+	vars.Strings(&config.columns, "Columns", []string{})
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *HistoryConfig) validate() error {
+	if len(config.files) == 0 {
+		return fmt.Errorf("The variable 'Files' was not set.")
+	}
+	return nil
+}
+
+// Run executes the history mode of the shellfish tool.
+func (config *HistoryConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#######################
+## shellfish history ##
+#######################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, _, err := catalog.Parse(stdin, []int{0, 1, 2}, []int{})
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps, roots := intCols[0], intCols[1], intCols[2]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	cats := make([]*namedCatalog, len(config.files))
+	for i, fname := range config.files {
+		cats[i], err = readNamedCatalog(fname)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h, err := newHistoryCatalog(cats, config.columns)
+	if err != nil {
+		return nil, err
+	}
+	rows, missing := h.rows(ids, snaps, roots)
+	if missing > 0 && logging.Mode != logging.Nil {
+		log.Printf("%d main progenitors weren't in any of the Files.",
+			missing)
+	}
+
+	as, err := historyScales(rows.snaps, gConfig, e)
+	if err != nil {
+		return nil, err
+	}
+	lines := h.format(rows, as)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return lines, nil
+}
+
+// historyScales returns the scale factor of each snapshot in snaps.
+func historyScales(
+	snaps []int, gConfig *GlobalConfig, e *env.Environment,
+) ([]float64, error) {
+	if len(snaps) == 0 {
+		return []float64{}, nil
+	}
+
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+	scales := map[int]float64{}
+	as := make([]float64, len(snaps))
+	for i, snap := range snaps {
+		if _, ok := scales[snap]; !ok {
+			hds, _, err := memo.ReadHeaders(snap, buf, e)
+			if err != nil {
+				return nil, err
+			}
+			scales[snap] = 1 / (1 + hds[0].Cosmo.Z)
+		}
+		as[i] = scales[snap]
+	}
+	return as, nil
+}
+
+// historyCatalog gathers the rows of several catalogs with the same columns.
+type historyCatalog struct {
+	cats  []*namedCatalog
+	units string
+	// cols[i][k] is the k-th gathered column of cats[i].
+	cols [][]catalog.Column
+	// index maps an ID and snapshot onto a catalog and row.
+	index map[[2]int][2]int
+}
+
+// historyRows are the rows of a historyCatalog which belong to a set of main
+// branches.
+type historyRows struct {
+	roots, ids, snaps []int
+	vals              [][]float64
+}
+
+// newHistoryCatalog checks that every catalog has the named columns with the
+// same sizes and units. If names is empty, every column of the first catalog
+// other than ID and Snapshot is used.
+func newHistoryCatalog(
+	cats []*namedCatalog, names []string,
+) (*historyCatalog, error) {
+	if len(names) == 0 {
+		for _, col := range cats[0].cols[2:] {
+			names = append(names, baseColumnName(col.Name))
+		}
+	}
+
+	h := &historyCatalog{
+		cats: cats, units: cats[0].units,
+		cols:  make([][]catalog.Column, len(cats)),
+		index: map[[2]int][2]int{},
+	}
+
+	for i, c := range cats {
+		if c.units != h.units {
+			return nil, fmt.Errorf("%s has the units '%s', but %s has the "+
+				"units '%s'.", c.name, c.units, cats[0].name, h.units)
+		}
+
+		h.cols[i] = make([]catalog.Column, len(names))
+		for k, name := range names {
+			col, ok := c.column(name)
+			if !ok {
+				return nil, fmt.Errorf("The column '%s' isn't in %s.",
+					name, c.name)
+			}
+			col0 := h.cols[0][k]
+			if i > 0 && col.End-col.Start != col0.End-col0.Start {
+				return nil, fmt.Errorf("The column '%s' has %d elements in "+
+					"%s but %d in %s.", name, col.End-col.Start+1, c.name,
+					col0.End-col0.Start+1, cats[0].name)
+			}
+			h.cols[i][k] = col
+		}
+
+		for j := range c.ids {
+			key := [2]int{c.ids[j], c.snaps[j]}
+			if _, ok := h.index[key]; !ok {
+				h.index[key] = [2]int{i, j}
+			}
+		}
+	}
+
+	return h, nil
+}
+
+// rows returns the gathered rows of the halos with the given IDs and
+// snapshots, each of which belongs to the main branch of the halo with the
+// corresponding root ID. Halos which aren't in any catalog are skipped, and
+// the number of skipped halos is returned.
+func (h *historyCatalog) rows(
+	ids, snaps, roots []int,
+) (rows *historyRows, missing int) {
+	width := 0
+	for _, col := range h.cols[0] {
+		width += col.End - col.Start + 1
+	}
+
+	rows = &historyRows{vals: make([][]float64, width)}
+	for i := range ids {
+		if snaps[i] == -1 {
+			continue
+		}
+		loc, ok := h.index[[2]int{ids[i], snaps[i]}]
+		if !ok {
+			missing++
+			continue
+		}
+
+		rows.roots = append(rows.roots, roots[i])
+		rows.ids = append(rows.ids, ids[i])
+		rows.snaps = append(rows.snaps, snaps[i])
+
+		c, j, n := h.cats[loc[0]], loc[1], 0
+		for _, col := range h.cols[loc[0]] {
+			for k := col.Start; k <= col.End; k++ {
+				rows.vals[n] = append(rows.vals[n], c.vals[k][j])
+				n++
+			}
+		}
+	}
+
+	return rows, missing
+}
+
+// format returns the lines of a catalog containing the given rows and the
+// scale factor of each row.
+func (h *historyCatalog) format(rows *historyRows, as []float64) []string {
+	floatCols := append([][]float64{as}, rows.vals...)
+
+	order := make([]int, 3+len(floatCols))
+	for i := range order {
+		order[i] = i
+	}
+	lines := catalog.FormatCols(
+		[][]int{rows.roots, rows.ids, rows.snaps}, floatCols, order,
+	)
+
+	floatNames := []string{"Scale"}
+	sizes := []int{1, 1, 1, 1}
+	for _, col := range h.cols[0] {
+		floatNames = append(floatNames, col.Name)
+		sizes = append(sizes, col.End-col.Start+1)
+	}
+	cOrder := make([]int, len(sizes))
+	for i := range cOrder {
+		cOrder[i] = i
+	}
+	cString := catalog.CommentString(
+		[]string{"RootID", "ID", "Snapshot"}, floatNames, cOrder, sizes,
+	)
+
+	header := []string{cString}
+	if h.units != "" {
+		header = append([]string{catalog.UnitsString(h.units)}, header...)
+	}
+	return append(header, lines...)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestHistoryCatalog(t *testing.T) {
+	a, err := parseNamedCatalog("a.txt", []byte(
+		"# Column contents: ID(0) Snapshot(1) R_sp [cMpc/h](2) P(3-4)\n"+
+			"10 100 1.5 1 2\n"+
+			"11 100 2.5 3 4\n",
+	))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	b, err := parseNamedCatalog("b.txt", []byte(
+		"# Column contents: ID(0) Snapshot(1) P(2-3) R_sp [cMpc/h](4)\n"+
+			"5 90 5 6 1.25\n",
+	))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	h, err := newHistoryCatalog([]*namedCatalog{a, b}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	rows, missing := h.rows(
+		[]int{10, 5, 4, -1, 11}, []int{100, 90, 80, -1, 100},
+		[]int{10, 10, 10, -1, 11},
+	)
+	if missing != 1 {
+		t.Errorf("Expected 1 missing halo, got %d.", missing)
+	}
+
+	lines := h.format(rows, []float64{1, 0.5, 1})
+	expected := []string{
+		"# Column contents: RootID(0) ID(1) Snapshot(2) Scale(3) " +
+			"R_sp [cMpc/h](4) P(5-6)",
+		"10 10 100   1  1.5 1 2",
+		"10  5  90 0.5 1.25 5 6",
+		"11 11 100   1  2.5 3 4",
+	}
+	if !stringSlicesEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q.", expected, lines)
+	}
+
+	if _, err = newHistoryCatalog(
+		[]*namedCatalog{a, b}, []string{"M_sp"},
+	); err == nil {
+		t.Errorf("Expected an error for a missing column.")
+	}
+	b.units = "pMpc"
+	if _, err = newHistoryCatalog([]*namedCatalog{a, b}, nil); err == nil {
+		t.Errorf("Expected an error for mismatched units.")
+	}
+}
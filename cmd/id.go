@@ -2,15 +2,22 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
 	"github.com/phil-mansfield/shellfish/cmd/halo"
 	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/cosmo"
 	"github.com/phil-mansfield/shellfish/io"
 	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/los/geom"
+	"github.com/phil-mansfield/shellfish/math/rand"
 	"github.com/phil-mansfield/shellfish/parse"
 )
 
@@ -21,11 +28,35 @@ const finderCells = 150
 type IDConfig struct {
 	idType                     string
 	ids                        []int64
+	idFile                     string
+	duplicateIDs               string
 	idStart, idEnd, snap, mult int64
+	idRangeInclusive           bool
+	snaps                      []int64
+	treeSnap                   int64
 	m200mMax, m200mMin         float64
+	vmaxMax, vmaxMin           float64
+
+	concentrationMin, concentrationMax float64
+	spinMin, spinMax                   float64
+	xoffMin, xoffMax                   float64
+
+	environmentRadius                  float64
+	environmentCells                   int64
+	environmentPercentileMin           float64
+	environmentPercentileMax           float64
 
 	exclusionStrategy          string
 	exclusionRadiusMult        float64
+	boxEdgeRadiusMult          float64
+	majorMergerDynamicalTimes  float64
+
+	catalogOutput              string
+	outputValues               []string
+
+	sampleSize, randomSeed     int64
+	binsPerDex                 float64
+	halosPerBin                int64
 }
 
 var _ Mode = &IDConfig{}
@@ -40,6 +71,22 @@ func (config *IDConfig) ExampleConfig() string {
 # Index of the snapshot to be analyzed.
 Snap = 100
 
+# Alternatively, a list of snapshots can be given with Snaps, in which case
+# Snap is ignored. IDs are selected separately in each snapshot and an
+# (ID, Snapshot) pair is output for each of them. Ranges (inclusive) can be
+# written as start..end.
+#
+# Snaps = 90..100
+
+# TreeSnap maps the selected halos to the corresponding halos at a different
+# snapshot by following the merger tree in TreeDir. The output (ID, Snapshot)
+# pairs will be for the main progenitors or descendants of the selected halos
+# at TreeSnap. Halos without a counterpart at TreeSnap are removed. This is
+# applied after exclusions and sampling, so the selection is always based on
+# the halos at Snap. By default, IDs aren't mapped to a different snapshot.
+#
+# TreeSnap = 80
+
 # List of IDs to analyze.
 IDs = 10, 11, 12, 13, 14
 
@@ -52,6 +99,11 @@ IDs = 10, 11, 12, 13, 14
 # halo-id - The numeric IDs given in the halo catalog.
 # m200m   - The rank of the halos when sorted by M200m.
 #
+# IDType can also be set to the name of any other variable in HaloValueNames
+# (e.g. vmax or m500c, capitalization doesn't matter), in which case IDs are the
+# rank of the halos when sorted by that variable, from largest to smallest.
+# This is useful for matching the sample definitions used in other papers.
+#
 # Defaults to m200m if not set.
 # IDType = m200m
 
@@ -61,26 +113,106 @@ IDs = 10, 11, 12, 13, 14
 # IDStart = 10
 # IDEnd = 15
 
-# Yet another alternative way to select IDs is to specify the starting and
-# ending mass range (units are M_sun/h). IDType, IDs, IDStart, and IDEnd will
-# be ignored if these variables are set.
+# IDRangeInclusive determines whether IDEnd is included in the range given by
+# IDStart and IDEnd. If set to false, the range is [IDStart, IDEnd), as in
+# Python's range(). Defaults to true if not set.
+#
+# IDRangeInclusive = true
+
+# IDs can also be read from a text file with one ID per line. Lines starting
+# with '#' are treated as comments. If there are multiple columns, only the
+# first is read, so the output of a previous id run can be used directly.
+# This is only used if IDs, IDStart, and IDEnd aren't set.
+#
+# IDFile = path/to/ids.txt
+
+# DuplicateIDs determines what happens if the same halo is selected more than
+# once (e.g. because an ID was repeated in IDs or IDFile). It can be set to the
+# following modes:
+# error  - Shellfish stops and reports the duplicated ID.
+# remove - Only the first occurence of each halo is kept.
+# allow  - Duplicates are kept and processed as if they were different halos.
+#
+# Use Mult, not duplicate IDs, if you want to analyze halos multiple times.
+# DuplicateIDs defaults to error if not set.
+#
+# DuplicateIDs = error
+
+# Yet another alternative way to select IDs is to specify the minimum and
+# maximum (inclusive) mass of the halos (units are M_sun/h). Every halo in
+# this mass range will be selected, in order of decreasing M200m. If only one
+# of these is set, the range has no lower or upper limit, respectively. IDType,
+# IDs, IDStart, and IDEnd will be ignored if these variables are set.
 #
 # M200mMin = 1e12
 # M200mMax = 1e13
 
+# VmaxMin and VmaxMax work the same way as M200mMin and M200mMax, but select on
+# the Vmax column instead (units are whatever units your halo catalog uses).
+# This requires that Vmax is included in HaloValueNames. If both the M200m
+# and Vmax ranges are set, halos must fall in both of them.
+#
+# VmaxMin = 200
+# VmaxMax = 400
+
+# Selected halos can also be cut on secondary halo properties. Halos which
+# fall outside any of the ranges below are removed, in the same way as halos
+# removed by ExclusionStrategy. As above, each range is inclusive and only one
+# side of a range needs to be set. The corresponding variables must be
+# included in HaloValueNames: Concentration is computed as R200m/Rs and needs
+# Rs, Spin needs Spin, and Xoff needs Xoff (in the units of your halo catalog).
+#
+# ConcentrationMin = 4
+# ConcentrationMax = 8
+# SpinMin = 0.02
+# SpinMax = 0.05
+# XoffMin = 0
+# XoffMax = 50
+
+# Halos can also be selected by their large-scale environment. If
+# EnvironmentRadius is set, the particles in the snapshot are binned onto a
+# coarse grid with EnvironmentCells cells on each side, and the mean density
+# within EnvironmentRadius (in cMpc/h) of each halo is measured. Only halos
+# whose density is between the EnvironmentPercentileMin and
+# EnvironmentPercentileMax percentiles of the densities of all the selected
+# halos in the same snapshot are kept. This is useful for comparing splashback
+# shells in clusters and voids. EnvironmentRadius should be at least a few
+# times larger than the width of a grid cell. EnvironmentCells defaults to 64
+# and the percentiles default to 0 and 100. By default, halos aren't selected
+# by environment.
+#
+# EnvironmentRadius = 5
+# EnvironmentCells = 64
+# EnvironmentPercentileMin = 75
+# EnvironmentPercentileMax = 100
+
 # ExclusionStrategy determines how to exclude IDs from the given set. This is
 # useful because splashback shells are not particularly meaningful for
 # subhalos. It can be set to the following modes:
 # none      - No halos are removed
-# subhalo   - Halos flagged as subhalos in the catalog are removed (not yet
-#             implemented)
+# subhalo   - Halos flagged as subhalos in the catalog are removed. This
+#             requires that either UpID or PID (the ID of the halo's parent, or
+#             -1 for hosts) is included in HaloValueNames.
 # overlap   - Halos which have an R200m shell that overlaps with a larger halo's
 #             R200m shell are removed
 # neighbor  - Instead of removing halos, all neighboring halos within
 #             ExclusionRadiusMult*R200m are added to the list.
+# isolation - Halos which have a more massive neighbor within
+#             ExclusionRadiusMult*R200m of their center are removed. This
+#             matches the isolation criteria commonly used in the splashback
+#             literature.
+# contamination - Halos with any low-resolution particles (i.e. particles more
+#             massive than the lightest particles in the simulation) within
+#             ExclusionRadiusMult*R200m are removed. This is intended for
+#             zoom-in simulations.
 #
 # ExclusionStrategy defaults to overlap if not set.
 #
+# If ExclusionStrategy = none and IDType = halo-id (and none of the options
+# below which need halo properties are set), the id mode never reads the halo
+# catalog or the particle snapshots. This means that it can be run on machines
+# which don't have access to the particle data.
+#
 # ExclusionStrategy = overlap
 
 # ExclusionRadiusMult is a multiplier of R200m applied for the sake of
@@ -88,13 +220,85 @@ IDs = 10, 11, 12, 13, 14
 #
 # ExclusionRadiusMult = 0.8
 
+# BoxEdgeRadiusMult removes halos which are within BoxEdgeRadiusMult*R200m of
+# the edge of the simulation box. This is applied in addition to
+# ExclusionStrategy and is useful for non-periodic or resimulated volumes,
+# where shells which cross the box boundary would be fit to artificially
+# truncated particle distributions. Set it to the RMaxMult value used by the
+# shell mode to ensure that no halo's search radius crosses the boundary. By
+# default, halos are not removed based on their distance to the box edge.
+#
+# BoxEdgeRadiusMult = 3
+
+# MajorMergerDynamicalTimes removes halos which have had a major merger within
+# the last MajorMergerDynamicalTimes dynamical times, since the splashback
+# shells of these halos are unreliable. Here, a dynamical time is the
+# crossing time 2*R200m/V200m. This is applied in addition to
+# ExclusionStrategy and requires that the consistent-trees column giving the
+# scale factor of each halo's last major merger (scale_of_last_MM) is included
+# in HaloValueNames as ScaleOfLastMM. By default, halos are not removed based
+# on their merger history.
+#
+# MajorMergerDynamicalTimes = 1
+
+# SampleSize is the number of halos which should be randomly selected from the
+# IDs which remain after exclusions. The order of the selected halos is
+# preserved. This is useful for running quick convergence tests on large
+# boxes. By default, every halo is kept.
+#
+# SampleSize = 1000
+
+# BinsPerDex and HalosPerBin allow for stratified sampling: the halos which
+# remain after exclusions are split into logarithmic M200m bins, with
+# BinsPerDex bins per factor of ten in mass, and HalosPerBin halos are randomly
+# selected from each bin. Bins with fewer halos than this are kept in full.
+# This gives stacked measurements uniform coverage across the mass function
+# instead of being dominated by low-mass halos. If SampleSize is also set, it
+# is applied afterwards. By default, no stratified sampling is done.
+#
+# BinsPerDex = 4
+# HalosPerBin = 50
+
+# RandomSeed is the seed used when selecting halos with SampleSize or
+# HalosPerBin and when generating the Seed column (see Mult, below). Runs with
+# the same seed and the same input will select the same halos. Setting it here
+# makes the selection reproducible without changing the seeds used by the
+# other modes. Defaults to the RandomSeed variable in the global config file if
+# not set.
+#
+# RandomSeed = 1337
+
+# OutputValues is a list of halo catalog variables which should be appended as
+# extra columns to every output line. These can be any of the variables in
+# HaloValueNames. Positions and radii are converted to cMpc/h. This is useful
+# for quick sanity checks on a sample, and the extra columns are ignored by
+# the other Shellfish modes. By default, no extra columns are output.
+#
+# OutputValues = M200m, R200m, X, Y, Z
+
 # Mult is the number of times a given ID should be repeated. This is most useful
 # if you want to estimate the scatter in shell measurements for halos with a
 # given set of shell parameters.
 #
+# If Mult is larger than 1, a final Seed column is added to the output which
+# gives a distinct random seed to each repetition of a halo. The coord mode
+# passes this column through and the shell mode uses it to choose the
+# directions of its lines of sight, so repeated measurements are independent.
+# Seeds are generated from RandomSeed, so runs with the same RandomSeed are
+# reproducible.
+#
 # Mult defaults to 1 if not set.
 #
-# Mult = 1`
+# Mult = 1
+
+# CatalogOutput is the name of a file that the full rows of the halo catalog
+# (every column, not just the ones in HaloValueNames) should be written to for
+# each selected halo. Rows are written in the same order as the output IDs,
+# after exclusions and without repetitions from Mult, and the header comments
+# of the original catalog are kept. This is useful for passing a sample to
+# tools outside of Shellfish. By default, no catalog is written.
+#
+# CatalogOutput = path/to/sample_catalog.txt`
 }
 
 // ReadConfig reads in an id.config file into config.
@@ -103,14 +307,42 @@ func (config *IDConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("id.config")
 	vars.String(&config.idType, "IDType", "m200m")
 	vars.Ints(&config.ids, "IDs", []int64{})
+	vars.String(&config.idFile, "IDFile", "")
+	vars.String(&config.duplicateIDs, "DuplicateIDs", "error")
 	vars.Int(&config.idStart, "IDStart", -1)
 	vars.Int(&config.idEnd, "IDEnd", -1)
+	vars.Bool(&config.idRangeInclusive, "IDRangeInclusive", true)
 	vars.Int(&config.mult, "Mult", 1)
 	vars.Int(&config.snap, "Snap", -1)
+	vars.Ints(&config.snaps, "Snaps", []int64{})
+	vars.Int(&config.treeSnap, "TreeSnap", -1)
 	vars.String(&config.exclusionStrategy, "ExclusionStrategy", "overlap")
 	vars.Float(&config.exclusionRadiusMult, "ExclusionRadiusMult", 1)
-	vars.Float(&config.m200mMax, "M200mMax", 0)
-	vars.Float(&config.m200mMin, "M200mMin", 0)
+	vars.Float(&config.boxEdgeRadiusMult, "BoxEdgeRadiusMult", -1)
+	vars.Float(&config.majorMergerDynamicalTimes,
+		"MajorMergerDynamicalTimes", -1)
+	vars.Float(&config.m200mMax, "M200mMax", -1)
+	vars.Float(&config.m200mMin, "M200mMin", -1)
+	vars.Float(&config.vmaxMax, "VmaxMax", -1)
+	vars.Float(&config.vmaxMin, "VmaxMin", -1)
+	vars.Float(&config.concentrationMin, "ConcentrationMin", -1)
+	vars.Float(&config.concentrationMax, "ConcentrationMax", -1)
+	vars.Float(&config.spinMin, "SpinMin", -1)
+	vars.Float(&config.spinMax, "SpinMax", -1)
+	vars.Float(&config.xoffMin, "XoffMin", -1)
+	vars.Float(&config.xoffMax, "XoffMax", -1)
+	vars.Float(&config.environmentRadius, "EnvironmentRadius", -1)
+	vars.Int(&config.environmentCells, "EnvironmentCells", 64)
+	vars.Float(&config.environmentPercentileMin,
+		"EnvironmentPercentileMin", 0)
+	vars.Float(&config.environmentPercentileMax,
+		"EnvironmentPercentileMax", 100)
+	vars.String(&config.catalogOutput, "CatalogOutput", "")
+	vars.Strings(&config.outputValues, "OutputValues", []string{})
+	vars.Int(&config.sampleSize, "SampleSize", -1)
+	vars.Int(&config.randomSeed, "RandomSeed", -1)
+	vars.Float(&config.binsPerDex, "BinsPerDex", 4)
+	vars.Int(&config.halosPerBin, "HalosPerBin", -1)
 
 	if fname == "" {
 		if len(flags) == 0 {
@@ -134,16 +366,35 @@ func (config *IDConfig) ReadConfig(fname string, flags []string) error {
 
 // validate checks whether all the fields of config are valid.
 func (config *IDConfig) validate() error {
-	switch config.idType {
-	case "halo-id", "m200m":
+	// Other sort columns are checked against HaloValueNames in Run().
+	if config.idType == "" {
+		return fmt.Errorf("The 'IDType' variable is set to an empty string.")
+	}
+
+	switch {
+	case config.idStart == -1 && config.idEnd == -1:
+	case config.idStart < 0:
+		return fmt.Errorf("The 'IDEnd' variable is set, but 'IDStart' " +
+			"isn't.")
+	case config.idEnd < 0:
+		return fmt.Errorf("The 'IDStart' variable is set, but 'IDEnd' " +
+			"isn't.")
+	case config.idEnd < config.idStart:
+		return fmt.Errorf("The 'IDStart' variable is set to %d, which is "+
+			"larger than the 'IDEnd' variable, %d.",
+			config.idStart, config.idEnd)
+	}
+
+	switch config.duplicateIDs {
+	case "error", "remove", "allow":
 	default:
-		return fmt.Errorf("The 'IDType' variable is set to '%s', which I "+
-			"don't recognize.", config.idType)
+		return fmt.Errorf("The 'DuplicateIDs' variable is set to '%s', "+
+			"which I don't recognize.", config.duplicateIDs)
 	}
 
 	switch config.exclusionStrategy {
 	case "none", "subhalo", "neighbor":
-	case "overlap":
+	case "overlap", "isolation", "contamination":
 		if config.exclusionRadiusMult <= 0 {
 			return fmt.Errorf("The 'ExclusionRadiusMult' varaible is set to "+
 				"%g, but it needs to be positive.", config.exclusionRadiusMult)
@@ -153,7 +404,29 @@ func (config *IDConfig) validate() error {
 			"which I don't recognize.", config.exclusionStrategy)
 	}
 
+	if config.treeSnap < -1 {
+		return fmt.Errorf("'TreeSnap' variable set to %d.", config.treeSnap)
+	}
+
+	if config.majorMergerDynamicalTimes != -1 &&
+		config.majorMergerDynamicalTimes < 0 {
+		return fmt.Errorf("The 'MajorMergerDynamicalTimes' variable is set "+
+			"to %g, but it can't be negative.",
+			config.majorMergerDynamicalTimes)
+	}
+
+	if config.boxEdgeRadiusMult != -1 && config.boxEdgeRadiusMult < 0 {
+		return fmt.Errorf("The 'BoxEdgeRadiusMult' variable is set to %g, "+
+			"but it can't be negative.", config.boxEdgeRadiusMult)
+	}
+
 	switch {
+	case len(config.snaps) > 0:
+		for i, snap := range config.snaps {
+			if snap < 0 {
+				return fmt.Errorf("'Snaps'[%d] variable set to %d.", i, snap)
+			}
+		}
 	case config.snap == -1:
 		return fmt.Errorf("'Snap' variable not set.")
 	case config.snap < 0:
@@ -164,16 +437,76 @@ func (config *IDConfig) validate() error {
 		return fmt.Errorf("'Mult' variable set to %d", config.mult)
 	}
 
-	switch {
-	case config.m200mMax < 0:
-		return fmt.Errorf("M200mStart set to %g", config.m200mMax)
-	case config.m200mMax > config.m200mMin:
-		fmt.Errorf("M200mEnd smaller than M200mStart")
+	if config.sampleSize < -1 {
+		return fmt.Errorf("The 'SampleSize' variable is set to %d.",
+			config.sampleSize)
+	}
+
+	if config.halosPerBin < -1 {
+		return fmt.Errorf("The 'HalosPerBin' variable is set to %d.",
+			config.halosPerBin)
+	} else if config.binsPerDex <= 0 {
+		return fmt.Errorf("The 'BinsPerDex' variable is set to %g, but it "+
+			"needs to be positive.", config.binsPerDex)
+	}
+
+	if config.environmentRadius != -1 {
+		switch {
+		case config.environmentRadius <= 0:
+			return fmt.Errorf("The 'EnvironmentRadius' variable is set to "+
+				"%g, but it needs to be positive.", config.environmentRadius)
+		case config.environmentCells <= 0:
+			return fmt.Errorf("The 'EnvironmentCells' variable is set to "+
+				"%d, but it needs to be positive.", config.environmentCells)
+		case config.environmentPercentileMin < 0 ||
+			config.environmentPercentileMax > 100 ||
+			config.environmentPercentileMin > config.environmentPercentileMax:
+			return fmt.Errorf("'EnvironmentPercentileMin' and "+
+				"'EnvironmentPercentileMax' are set to %g and %g, but they "+
+				"must be within [0, 100] and in increasing order.",
+				config.environmentPercentileMin,
+				config.environmentPercentileMax)
+		}
+	}
+
+	ranges := append(config.valueRanges(), config.secondaryCuts()...)
+	for _, r := range ranges {
+		if r.max != -1 && r.min > r.max {
+			return fmt.Errorf("The '%sMin' variable is set to %g, which is "+
+				"larger than the '%sMax' variable, %g.",
+				r.name, r.min, r.name, r.max)
+		}
 	}
 
 	return nil
 }
 
+// valueRange is a range of catalog values used to select halos. A limit of -1
+// means that the range is unbounded on that side.
+type valueRange struct {
+	name     string
+	min, max float64
+}
+
+// contains returns true if x is within the (inclusive) range.
+func (r valueRange) contains(x float64) bool {
+	return (r.min == -1 || x >= r.min) && (r.max == -1 || x <= r.max)
+}
+
+// valueRanges returns the value ranges which have been set in config.
+func (config *IDConfig) valueRanges() []valueRange {
+	ranges := []valueRange{}
+	if config.m200mMin != -1 || config.m200mMax != -1 {
+		ranges = append(ranges,
+			valueRange{"M200m", config.m200mMin, config.m200mMax})
+	}
+	if config.vmaxMin != -1 || config.vmaxMax != -1 {
+		ranges = append(ranges,
+			valueRange{"Vmax", config.vmaxMin, config.vmaxMax})
+	}
+	return ranges
+}
+
 // Run executes the ID mode of shellfish tool.
 func (config *IDConfig) Run(
 	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
@@ -190,106 +523,142 @@ func (config *IDConfig) Run(
 	if logging.Mode == logging.Performance {
 		t = time.Now()
 	}
-	if config.snap == -1 {
+	if config.snap == -1 && len(config.snaps) == 0 {
 		return nil, fmt.Errorf("Either no id.config file was provided or " +
 			"the 'Snap' variable wasn't set.")
 	}
-	if config.snap < gConfig.SnapMin || config.snap > gConfig.SnapMax {
-		return nil, fmt.Errorf("'Snap' = %d, but 'SnapMin' = %d and "+
-			"'SnapMax = %d'", config.snap, gConfig.SnapMin, gConfig.SnapMax)
+	snapList := config.snapList()
+	for _, snap := range snapList {
+		if snap < int(gConfig.SnapMin) || snap > int(gConfig.SnapMax) {
+			return nil, fmt.Errorf("'Snap' = %d, but 'SnapMin' = %d and "+
+				"'SnapMax = %d'", snap, gConfig.SnapMin, gConfig.SnapMax)
+		}
 	}
 	// Get IDs and snapshots
 
-	vars := halo.NewVarColumns(
-		gConfig.HaloValueNames, gConfig.HaloValueColumns,
-		gConfig.HaloRadiusUnits,
-	)
-
-	if config.m200mMax > 0 {
-		getMassIDRange(gConfig, e, config, vars)
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range config.outputValues {
+		if _, ok := vars.ColumnLookup[name]; !ok {
+			return nil, fmt.Errorf("'OutputValues' contains the variable "+
+				"'%s', which isn't in 'HaloValueNames'.", name)
+		}
 	}
 
-	// This is kind of a hack to deal with the case where there are no IDs in
-	// the specified mass range.
-	var (
-		rawIds []int
-		err error
-	)
-	if config.idStart <= config.idEnd {
-		rawIds, err = getIDs(config.idStart, config.idEnd, config.ids, stdin)
+	// Opening a particle buffer reads from the snapshot files, so it's
+	// avoided when no halo properties are needed.
+	var buf io.VectorBuffer
+	if config.needsHaloCatalog() {
+		buf, err = getVectorBuffer(e.ParticleCatalog(snapList[0], 0), gConfig)
 		if err != nil {
 			return nil, err
-		} else if len(rawIds) == 0 {
-			return nil, nil
 		}
 	}
 
-	var (
-		ids, snaps []int
-		buf        io.VectorBuffer
-	)
-	switch config.idType {
-	case "halo-id":
-		snaps = make([]int, len(rawIds))
-		for i := range snaps {
-			snaps[i] = int(config.snap)
+	ids, snaps, err := config.selectSnapIDs(snapList, stdin, vars, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, snaps, err = config.handleDuplicates(ids, snaps)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// Tag subhalos, if neccessary.
+	exclude := make([]bool, len(ids))
+	switch config.exclusionStrategy {
+	case "none":
+	case "subhalo":
+		exclude, err = findUpIDSubs(ids, snaps, vars, buf, e)
+		if err != nil {
+			return nil, err
+		}
+	case "neighbor":
+		ids, snaps, err = readSubIDs(
+			ids, snaps, vars, buf, e, config, gConfig,
+		)
+		if err != nil {
+			return nil, err
 		}
-		ids = rawIds
 
+		exclude = make([]bool, len(ids))
+	case "overlap":
 		var err error
-		buf, err = getVectorBuffer(
-			e.ParticleCatalog(snaps[0], 0), gConfig,
+		exclude, err = findOverlapSubs(
+			ids, snaps, vars, buf, e, config, gConfig,
 		)
 		if err != nil {
 			return nil, err
 		}
-	case "m200m":
-		snaps = make([]int, len(rawIds))
-		for i := range snaps {
-			snaps[i] = int(config.snap)
+	case "isolation":
+		exclude, err = findNonIsolated(
+			ids, snaps, vars, buf, e, config, gConfig,
+		)
+		if err != nil {
+			return nil, err
 		}
-
-		var err error
-		buf, err = getVectorBuffer(
-			e.ParticleCatalog(snaps[0], 0), gConfig,
+	case "contamination":
+		exclude, err = findContaminatedHalos(
+			ids, snaps, vars, buf, e, config, gConfig,
 		)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		ids, err = convertSortedIDs(rawIds, int(config.snap), vars, buf, e)
+	if cuts := config.secondaryCuts(); len(cuts) > 0 {
+		cut, err := findSecondaryCuts(
+			cuts, ids, snaps, vars, buf, e, gConfig,
+		)
 		if err != nil {
 			return nil, err
 		}
-	default:
-		panic("Impossible")
+		for i := range exclude {
+			exclude[i] = exclude[i] || cut[i]
+		}
 	}
 
-	// Tag subhalos, if neccessary.
-	exclude := make([]bool, len(ids))
-	switch config.exclusionStrategy {
-	case "none":
-	case "subhalo":
-		panic("subhalo is not implemented")
-	case "neighbor":
-		ids, snaps, err = readSubIDs(
+	if config.environmentRadius != -1 {
+		envCut, err := findEnvironmentCuts(
 			ids, snaps, vars, buf, e, config, gConfig,
 		)
 		if err != nil {
 			return nil, err
 		}
+		for i := range exclude {
+			exclude[i] = exclude[i] || envCut[i]
+		}
+	}
 
-		exclude = make([]bool, len(ids))
-	case "overlap":
-		var err error
-		exclude, err = findOverlapSubs(
+	if config.majorMergerDynamicalTimes != -1 {
+		merger, err := findRecentMergers(ids, snaps, vars, buf, e, config)
+		if err != nil {
+			return nil, err
+		}
+		for i := range exclude {
+			exclude[i] = exclude[i] || merger[i]
+		}
+	}
+
+	if config.boxEdgeRadiusMult != -1 {
+		edge, err := findBoxEdgeHalos(
 			ids, snaps, vars, buf, e, config, gConfig,
 		)
 		if err != nil {
 			return nil, err
 		}
+		for i := range exclude {
+			exclude[i] = exclude[i] || edge[i]
+		}
 	}
-	
+
 	// Generate lines
 	intCols := [][]int{ids, snaps}
 	floatCols := [][]float64{}
@@ -297,24 +666,132 @@ func (config *IDConfig) Run(
 	lines := catalog.FormatCols(intCols, floatCols, colOrder)
 
 	// Filter
-	fLines := []string{}
+	fLines, fIDs, fSnaps := []string{}, []int{}, []int{}
 	for i := range lines {
 		if !exclude[i] {
 			fLines = append(fLines, lines[i])
+			fIDs = append(fIDs, ids[i])
+			fSnaps = append(fSnaps, snaps[i])
 		}
 	}
 
-	// Multiply
-	mLines := []string{}
-	for i := range fLines {
-		for j := 0; j < int(config.mult); j++ {
-			mLines = append(mLines, fLines[i])
+	// Subsample
+	var gen *rand.Generator
+	if config.halosPerBin != -1 || config.sampleSize != -1 {
+		seed := config.seed()
+		if logging.Mode != logging.Nil {
+			log.Println("Sampling RNG Seed is", seed)
 		}
+		gen = rand.New(rand.Xorshift, seed)
 	}
 
-	cString := catalog.CommentString(
-		[]string{"ID", "Snapshot"}, []string{}, []int{0, 1}, []int{1, 1},
-	)
+	if config.halosPerBin != -1 {
+		cols, err := readHaloCoords(
+			fIDs, fSnaps, []string{"M200m"}, vars, buf, e, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+		idxs := stratifiedIndices(
+			cols[0], config.binsPerDex, int(config.halosPerBin), gen,
+		)
+		fLines, fIDs, fSnaps = selectIndices(idxs, fLines, fIDs, fSnaps)
+	}
+
+	if config.sampleSize != -1 && int(config.sampleSize) < len(fLines) {
+		idxs := sampleIndices(len(fLines), int(config.sampleSize), gen)
+		fLines, fIDs, fSnaps = selectIndices(idxs, fLines, fIDs, fSnaps)
+	}
+
+	// Map to another snapshot
+	if config.treeSnap != -1 {
+		if config.treeSnap < gConfig.SnapMin ||
+			config.treeSnap > gConfig.SnapMax {
+			return nil, fmt.Errorf("'TreeSnap' = %d, but 'SnapMin' = %d "+
+				"and 'SnapMax = %d'", config.treeSnap, gConfig.SnapMin,
+				gConfig.SnapMax)
+		}
+
+		tIDs, err := treeMatchIDs(fIDs, int(config.treeSnap), gConfig, e)
+		if err != nil {
+			return nil, err
+		}
+
+		idxs := []int{}
+		for i := range tIDs {
+			if tIDs[i] != -1 {
+				idxs = append(idxs, i)
+			}
+		}
+		fLines, fIDs, fSnaps = selectIndices(idxs, fLines, tIDs, fSnaps)
+		for i := range fSnaps {
+			fSnaps[i] = int(config.treeSnap)
+		}
+		fLines = catalog.FormatCols(
+			[][]int{fIDs, fSnaps}, [][]float64{}, []int{0, 1},
+		)
+	}
+
+	if config.catalogOutput != "" {
+		if gConfig.HaloType != "Text" {
+			return nil, fmt.Errorf("'CatalogOutput' can only be used " +
+				"with text halo catalogs.")
+		} else if len(snapList) > 1 {
+			return nil, fmt.Errorf("'CatalogOutput' can only be used " +
+				"with a single snapshot.")
+		}
+		catSnap := snapList[0]
+		if config.treeSnap != -1 {
+			catSnap = int(config.treeSnap)
+		}
+		err = writeCatalogRows(
+			config.catalogOutput, e.HaloCatalog(catSnap), fIDs, vars,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Add halo properties
+	floatNames := make([]string, len(config.outputValues))
+	if len(config.outputValues) > 0 {
+		vals, err := readHaloCoords(
+			fIDs, fSnaps, config.outputValues, vars, buf, e, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+		colOrder := make([]int, len(vals)+2)
+		for i := range colOrder {
+			colOrder[i] = i
+		}
+		fLines = catalog.FormatCols([][]int{fIDs, fSnaps}, vals, colOrder)
+
+		for i, name := range config.outputValues {
+			floatNames[i] = outputValueName(name)
+		}
+	}
+
+	mLines := multiplyLines(fLines, int(config.mult), config.seed())
+
+	intNames := []string{"ID", "Snapshot"}
+	if config.mult > 1 && len(mLines) > 0 {
+		intNames = append(intNames, "Seed")
+	}
+
+	nCols := len(intNames) + len(floatNames)
+	order, sizes := make([]int, nCols), make([]int, nCols)
+	for i := range order {
+		order[i], sizes[i] = i, 1
+	}
+	// Seed is an int column, but it comes after all the float columns.
+	if len(intNames) == 3 {
+		for i := 2; i < nCols-1; i++ {
+			order[i] = i + 1
+		}
+		order[nCols-1] = 2
+	}
+	cString := catalog.CommentString(intNames, floatNames, order, sizes)
 	mLines = append([]string{cString}, mLines...)
 
 	if logging.Mode == logging.Performance {
@@ -325,116 +802,494 @@ func (config *IDConfig) Run(
 	return mLines, nil
 }
 
-// getMassRange updates config so that it points to an ID range that
-// corresponds to [M200mMin, M200mMax]
-func getMassIDRange(
-	gConfig *GlobalConfig, e *env.Environment, config *IDConfig,
-	vars *halo.VarColumns,
-) error {
-	config.idType = "m200m"
-	buf, err := getVectorBuffer(
-		e.ParticleCatalog(int(config.snap), 0), gConfig,
-	)
-
-	if err != nil { return err }
+// seed returns the base random seed of the run: RandomSeed if it was set in
+// the id config and the global seed otherwise.
+func (config *IDConfig) seed() uint64 {
+	if config.randomSeed != -1 {
+		return uint64(config.randomSeed)
+	}
+	return randSeed
+}
 
-	rids, err := memo.ReadSortedRockstarIDs(
-		int(config.snap), -1, "M200m", vars, buf, e,
-	)
-	if err != nil { return err }
-	_, vals, err := memo.ReadRockstar(
-		int(config.snap), []string{"M200m"}, rids, vars, buf, e,
-	)
-	if err != nil { return err }
+// multiplyLines repeats each line mult times. If mult > 1, a Seed column
+// generated from the given base seed is appended to every output line.
+func multiplyLines(lines []string, mult int, seed uint64) []string {
+	mLines := []string{}
+	for i := range lines {
+		for j := 0; j < mult; j++ {
+			mLines = append(mLines, lines[i])
+		}
+	}
 
-	ms := vals[0]
-	config.idStart, config.idEnd = -1, -1
-	for i := range ms {
-		if config.idStart == -1 && config.m200mMax >= ms[i] {
-			config.idStart = int64(i)
+	if mult > 1 && len(mLines) > 0 {
+		seeds := make([]int, len(mLines))
+		for i := range seeds {
+			seeds[i] = int(repetitionSeed(seed, i))
 		}
-		if config.m200mMin > ms[i] {
-			config.idEnd = int64(i-1)
-			return nil
+		seedLines := catalog.FormatCols([][]int{seeds}, nil, []int{0})
+		for i := range mLines {
+			mLines[i] = mLines[i] + " " + seedLines[i]
 		}
 	}
-
-	config.idEnd = int64(len(ms) - 1)
-	return nil
+	return mLines
 }
 
+// repetitionSeed returns the random seed used for the kth output line of a run
+// with the given base seed. Different lines always get different seeds, since
+// the mixing function (the finalizer of MurmurHash3) is a bijection.
+func repetitionSeed(base uint64, k int) uint32 {
+	h := uint32(base) + uint32(k)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
 
-func getIDs(idStart, idEnd int64, ids []int64, stdin []byte) ([]int, error) {
-	if idStart != -1 {
-		out := make([]int, idEnd-idStart)
-		for i := range out {
-			out[i] = int(idStart) + i
-		}
-		return out, nil
-	} else if len(ids) > 0 {
-		out := make([]int, len(ids))
-		for i := range out {
-			out[i] = int(ids[i])
-		}
-		return out, nil
-	} else {
-		intCols, _, err := catalog.Parse(stdin, []int{0}, []int{})
-		if err != nil {
-			return nil, err
-		}
-		return intCols[0], nil
+// outputValueName returns the column name used for the halo catalog variable
+// name in the output of id mode, including units when they're known.
+func outputValueName(name string) string {
+	switch name {
+	case "X", "Y", "Z", "R200m", "R200c", "R500c", "Rvir", "Rs":
+		return name + " [cMpc/h]"
+	case "M200m", "M200c", "M500c", "Mvir":
+		return name + " [Msun/h]"
 	}
+	return name
 }
 
-func convertSortedIDs(
-	rawIDs []int, snap int, vars *halo.VarColumns,
-	buf io.VectorBuffer, e *env.Environment,
+// treeMatchIDs returns the IDs of the halos in the main branches of the given
+// halos at snapshot snap. Halos without a counterpart at snap are given an ID
+// of -1.
+func treeMatchIDs(
+	ids []int, snap int, gConfig *GlobalConfig, e *env.Environment,
 ) ([]int, error) {
-	maxID := 0
-	for _, id := range rawIDs {
-		if id > maxID {
-			maxID = id
-		}
+	trees, err := treeFiles(gConfig)
+	if err != nil {
+		return nil, err
 	}
-
-	rids, err := memo.ReadSortedRockstarIDs(snap, maxID, "M200m", vars, buf, e)
+	idSets, snapSets, err := haloHistories(trees, ids, gConfig, e)
 	if err != nil {
 		return nil, err
 	}
 
-	ids := make([]int, len(rawIDs))
-	for i := range ids {
-		ids[i] = rids[rawIDs[i]]
+	out := make([]int, len(ids))
+	for i := range out {
+		out[i] = -1
+		for j := range snapSets[i] {
+			if snapSets[i][j] == snap {
+				out[i] = idSets[i][j]
+				break
+			}
+		}
 	}
-	return ids, nil
+	return out, nil
 }
 
-func findOverlapSubs(
-	rawIDs, snaps []int, vars *halo.VarColumns,
-	buf io.VectorBuffer, e *env.Environment, config *IDConfig,
-	gConfig *GlobalConfig,
-) ([]bool, error) {
-	isSub := make([]bool, len(rawIDs))
-
-	// Group by snapshot.
-	snapGroups := make(map[int][]int)
-	groupIdxs := make(map[int][]int)
-	for i, id := range rawIDs {
-		snap := snaps[i]
-		snapGroups[snap] = append(snapGroups[snap], id)
-		groupIdxs[snap] = append(groupIdxs[snap], i)
+// handleDuplicates applies the DuplicateIDs strategy to the selected IDs and
+// snapshots.
+func (config *IDConfig) handleDuplicates(
+	ids, snaps []int,
+) (uIDs, uSnaps []int, err error) {
+	if config.duplicateIDs == "allow" {
+		return ids, snaps, nil
 	}
 
-	// Load each snapshot.
-	hds, _, err := memo.ReadHeaders(snaps[0], buf, e)
-	if err != nil {
-		return nil, err
+	idxs, dupIdx := uniqueIndices(ids, snaps)
+	if dupIdx != -1 && config.duplicateIDs == "error" {
+		return nil, nil, fmt.Errorf("ID %d at snapshot %d was selected more "+
+			"than once. Set 'DuplicateIDs' to 'remove' or 'allow' if "+
+			"this is intentional.", ids[dupIdx], snaps[dupIdx])
 	}
-	hd := hds[0]
-	cosmo := &hd.Cosmo
+	uIDs, uSnaps = make([]int, len(idxs)), make([]int, len(idxs))
+	for i, j := range idxs {
+		uIDs[i], uSnaps[i] = ids[j], snaps[j]
+	}
+	return uIDs, uSnaps, nil
+}
 
-	for snap, group := range snapGroups {
-		rids, err := memo.ReadSortedRockstarIDs(
+// uniqueIndices returns the indices of the first occurrence of each (ID,
+// snapshot) pair and the index of the first duplicate. If there are no
+// duplicates, dupIdx is -1.
+func uniqueIndices(ids, snaps []int) (idxs []int, dupIdx int) {
+	type key struct{ id, snap int }
+	seen := make(map[key]bool)
+	idxs, dupIdx = []int{}, -1
+	for i := range ids {
+		k := key{ids[i], snaps[i]}
+		if seen[k] {
+			if dupIdx == -1 {
+				dupIdx = i
+			}
+			continue
+		}
+		seen[k] = true
+		idxs = append(idxs, i)
+	}
+	return idxs, dupIdx
+}
+
+// sampleIndices returns k distinct indices chosen uniformly at random from the
+// range [0, n). The indices are returned in increasing order.
+func sampleIndices(n, k int, gen *rand.Generator) []int {
+	idxs := make([]int, n)
+	for i := range idxs {
+		idxs[i] = i
+	}
+	for i := 0; i < k; i++ {
+		j := gen.UniformInt(i, n)
+		idxs[i], idxs[j] = idxs[j], idxs[i]
+	}
+	idxs = idxs[:k]
+	sort.Ints(idxs)
+	return idxs
+}
+
+// stratifiedIndices splits ms into logarithmic bins with binsPerDex bins per
+// dex and returns the indices of (at most) k randomly chosen elements from
+// each bin. Elements with non-positive masses are never chosen. The indices
+// are returned in increasing order.
+func stratifiedIndices(
+	ms []float64, binsPerDex float64, k int, gen *rand.Generator,
+) []int {
+	bins := make(map[int][]int)
+	binOrder := []int{}
+	for i, m := range ms {
+		if m <= 0 {
+			continue
+		}
+		bin := int(math.Floor(math.Log10(m) * binsPerDex))
+		if _, ok := bins[bin]; !ok {
+			binOrder = append(binOrder, bin)
+		}
+		bins[bin] = append(bins[bin], i)
+	}
+
+	// Bins are visited in a fixed order so results are reproducible.
+	sort.Ints(binOrder)
+	idxs := []int{}
+	for _, bin := range binOrder {
+		binIdxs := bins[bin]
+		if len(binIdxs) <= k {
+			idxs = append(idxs, binIdxs...)
+			continue
+		}
+		for _, j := range sampleIndices(len(binIdxs), k, gen) {
+			idxs = append(idxs, binIdxs[j])
+		}
+	}
+
+	sort.Ints(idxs)
+	return idxs
+}
+
+// selectIndices returns the elements of lines, ids, and snaps at the given
+// indices.
+func selectIndices(
+	idxs []int, lines []string, ids, snaps []int,
+) ([]string, []int, []int) {
+	sLines := make([]string, len(idxs))
+	sIDs, sSnaps := make([]int, len(idxs)), make([]int, len(idxs))
+	for i, j := range idxs {
+		sLines[i], sIDs[i], sSnaps[i] = lines[j], ids[j], snaps[j]
+	}
+	return sLines, sIDs, sSnaps
+}
+
+// writeCatalogRows writes the full rows of the halo catalog inFile which
+// correspond to the given IDs to outFile.
+func writeCatalogRows(
+	outFile, inFile string, ids []int, vars *halo.VarColumns,
+) error {
+	idCol := vars.Columns[vars.ColumnLookup["ID"]]
+	header, rows, err := halo.ReadCatalogRows(inFile, idCol, ids)
+	if err != nil {
+		return err
+	}
+
+	lines := append(header, rows...)
+	text := strings.Join(lines, "\n") + "\n"
+	return ioutil.WriteFile(outFile, []byte(text), 0666)
+}
+
+// needsHaloCatalog returns true if config requires that halo properties be
+// read from the halo catalog (which also requires reading particle headers).
+func (config *IDConfig) needsHaloCatalog() bool {
+	return config.idType != "halo-id" ||
+		len(config.valueRanges()) > 0 ||
+		config.exclusionStrategy != "none" ||
+		config.boxEdgeRadiusMult != -1 ||
+		config.majorMergerDynamicalTimes != -1 ||
+		len(config.secondaryCuts()) > 0 ||
+		config.environmentRadius != -1 ||
+		config.halosPerBin != -1 ||
+		len(config.outputValues) > 0
+}
+
+// secondaryCuts returns the cuts on secondary halo properties which have been
+// set in config.
+func (config *IDConfig) secondaryCuts() []valueRange {
+	cuts := []valueRange{
+		{"Concentration", config.concentrationMin, config.concentrationMax},
+		{"Spin", config.spinMin, config.spinMax},
+		{"Xoff", config.xoffMin, config.xoffMax},
+	}
+	out := []valueRange{}
+	for _, cut := range cuts {
+		if cut.min != -1 || cut.max != -1 {
+			out = append(out, cut)
+		}
+	}
+	return out
+}
+
+// snapList returns the snapshots that IDs should be selected from.
+func (config *IDConfig) snapList() []int {
+	if len(config.snaps) == 0 {
+		return []int{int(config.snap)}
+	}
+	snaps := make([]int, len(config.snaps))
+	for i := range snaps {
+		snaps[i] = int(config.snaps[i])
+	}
+	return snaps
+}
+
+// selectSnapIDs returns the IDs selected from each snapshot in snapList along
+// with the snapshot each ID was selected from. Rows are ordered by snapshot,
+// following the order of snapList.
+func (config *IDConfig) selectSnapIDs(
+	snapList []int, stdin []byte, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment,
+) (ids, snaps []int, err error) {
+	for _, snap := range snapList {
+		snapIDs, err := config.selectIDs(snap, stdin, vars, buf, e)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, snapIDs...)
+		for range snapIDs {
+			snaps = append(snaps, snap)
+		}
+	}
+	return ids, snaps, nil
+}
+
+// selectIDs returns the catalog IDs of the halos in the given snapshot which
+// are selected by config, prior to any exclusions.
+func (config *IDConfig) selectIDs(
+	snap int, stdin []byte, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment,
+) ([]int, error) {
+	if ranges := config.valueRanges(); len(ranges) > 0 {
+		return getRangeIDs(ranges, snap, vars, buf, e)
+	}
+
+	rawIDs, err := getIDs(
+		config.idStart, config.idEnd, config.idRangeInclusive,
+		config.ids, config.idFile, stdin,
+	)
+	if err != nil {
+		return nil, err
+	} else if len(rawIDs) == 0 {
+		return rawIDs, nil
+	} else if config.idType == "halo-id" {
+		// Without a particle buffer, the catalog can't be read.
+		if buf != nil {
+			err = checkHaloIDs(rawIDs, snap, vars, buf, e)
+		}
+		return rawIDs, err
+	}
+
+	valName, err := sortColumnName(config.idType, vars)
+	if err != nil {
+		return nil, err
+	}
+	return convertSortedIDs(rawIDs, snap, valName, vars, buf, e)
+}
+
+// getRangeIDs returns the IDs of every halo whose values fall within all the
+// given ranges. IDs are ordered by decreasing M200m.
+func getRangeIDs(
+	ranges []valueRange, snap int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment,
+) ([]int, error) {
+	names := make([]string, len(ranges))
+	for i := range ranges {
+		names[i] = ranges[i].name
+		if _, ok := vars.ColumnLookup[names[i]]; !ok {
+			return nil, fmt.Errorf("The '%sMin' or '%sMax' variable is "+
+				"set, but %s is not in HaloValueNames.",
+				names[i], names[i], names[i])
+		}
+	}
+
+	rids, err := memo.ReadSortedRockstarIDs(snap, -1, "M200m", vars, buf, e)
+	if err != nil {
+		return nil, err
+	}
+	_, vals, err := memo.ReadRockstar(snap, names, rids, vars, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+	for i := range rids {
+		ok := true
+		for j := range ranges {
+			if !ranges[j].contains(vals[j][i]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			ids = append(ids, rids[i])
+		}
+	}
+	return ids, nil
+}
+
+// getIDs returns the IDs given by the first of the following which is set: the
+// range [idStart, idEnd] (or [idStart, idEnd) if inclusive is false), ids,
+// idFile, or the first column of stdin.
+func getIDs(
+	idStart, idEnd int64, inclusive bool, ids []int64, idFile string,
+	stdin []byte,
+) ([]int, error) {
+	if idStart != -1 {
+		if inclusive {
+			idEnd++
+		}
+		out := make([]int, idEnd-idStart)
+		for i := range out {
+			out[i] = int(idStart) + i
+		}
+		return out, nil
+	} else if len(ids) > 0 {
+		out := make([]int, len(ids))
+		for i := range out {
+			out[i] = int(ids[i])
+		}
+		return out, nil
+	} else if idFile != "" {
+		intCols, _, err := catalog.ReadFile(idFile, []int{0}, []int{})
+		if err != nil {
+			return nil, err
+		}
+		return intCols[0], nil
+	} else {
+		intCols, _, err := catalog.Parse(stdin, []int{0}, []int{})
+		if err != nil {
+			return nil, err
+		}
+		return intCols[0], nil
+	}
+}
+
+// sortColumnName returns the name of the halo catalog variable that IDs of the
+// given IDType are ranked by. An exact match is preferred, and otherwise the
+// name may differ from IDType in case as long as only one variable matches.
+func sortColumnName(idType string, vars *halo.VarColumns) (string, error) {
+	if _, ok := vars.ColumnLookup[idType]; ok {
+		return idType, nil
+	}
+
+	matches := []string{}
+	for name := range vars.ColumnLookup {
+		if strings.ToLower(name) == strings.ToLower(idType) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("The 'IDType' variable is set to '%s', which "+
+			"isn't 'halo-id', 'm200m', or one of the variables in "+
+			"HaloValueNames.", idType)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("The 'IDType' variable is set to '%s', which "+
+			"could refer to any of the variables %s in HaloValueNames.",
+			idType, strings.Join(matches, ", "))
+	}
+}
+
+// checkHaloIDs returns an error if any of the given IDs aren't in the halo
+// catalog for the given snapshot.
+func checkHaloIDs(
+	ids []int, snap int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment,
+) error {
+	rids, err := memo.ReadSortedRockstarIDs(snap, -1, "M200m", vars, buf, e)
+	if err != nil {
+		return err
+	}
+	f := newIntFinder(rids)
+	for _, id := range ids {
+		if _, ok := f.find(id); !ok {
+			return fmt.Errorf("IDType = halo-id, but ID %d isn't in the "+
+				"halo catalog for snapshot %d.", id, snap)
+		}
+	}
+	return nil
+}
+
+func convertSortedIDs(
+	rawIDs []int, snap int, valName string, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment,
+) ([]int, error) {
+	maxID := 0
+	for _, id := range rawIDs {
+		if id < 0 {
+			return nil, fmt.Errorf("ID %d is negative, but IDs of IDType "+
+				"= %s are ranks, which start at 0.", id, valName)
+		}
+		if id > maxID {
+			maxID = id
+		}
+	}
+
+	rids, err := memo.ReadSortedRockstarIDs(snap, maxID, valName, vars, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, len(rawIDs))
+	for i := range ids {
+		ids[i] = rids[rawIDs[i]]
+	}
+	return ids, nil
+}
+
+func findOverlapSubs(
+	rawIDs, snaps []int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, config *IDConfig,
+	gConfig *GlobalConfig,
+) ([]bool, error) {
+	isSub := make([]bool, len(rawIDs))
+
+	// Group by snapshot.
+	snapGroups := make(map[int][]int)
+	groupIdxs := make(map[int][]int)
+	for i, id := range rawIDs {
+		snap := snaps[i]
+		snapGroups[snap] = append(snapGroups[snap], id)
+		groupIdxs[snap] = append(groupIdxs[snap], i)
+	}
+
+	// Load each snapshot.
+	for snap, group := range snapGroups {
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		hd := hds[0]
+		cosmo := &hd.Cosmo
+
+		rids, err := memo.ReadSortedRockstarIDs(
 			snap, -1, "M200m", vars, buf, e,
 		)
 		if err != nil {
@@ -461,18 +1316,508 @@ func findOverlapSubs(
 		sf := halo.NewSubhaloFinder(g)
 		sf.FindSubhalos(xs, ys, zs, rs, config.exclusionRadiusMult)
 		
+		f := newIntFinder(rids)
 		for i, id := range group {
 			origIdx := groupIdxs[snap][i]
-			// TODO: Holy linear search, batman! Fix this.
-			for j, checkID := range rids {
-				if checkID == id {
-					isSub[origIdx] = sf.HostCount(j) > 0
-					break
-				} else if j == len(rids)-1 {
-					return nil, fmt.Errorf("ID %d not in halo list.", id)
+			j, ok := f.find(id)
+			if !ok {
+				return nil, fmt.Errorf("ID %d not in halo list.", id)
+			}
+			isSub[origIdx] = sf.HostCount(j) > 0
+		}
+	}
+	return isSub, nil
+}
+
+// findNonIsolated flags every halo which has a more massive neighbor within
+// ExclusionRadiusMult*R200m.
+func findNonIsolated(
+	ids, snaps []int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, config *IDConfig,
+	gConfig *GlobalConfig,
+) ([]bool, error) {
+	isNeighbor := make([]bool, len(ids))
+
+	snapBins, idxBins := binBySnap(snaps, ids)
+	for snap, group := range snapBins {
+		if snap == -1 {
+			continue
+		}
+
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		hd := &hds[0]
+
+		rids, err := memo.ReadSortedRockstarIDs(
+			snap, -1, "M200m", vars, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+		_, vals, err := memo.ReadRockstar(
+			snap, []string{"X", "Y", "Z", "R200m", "M200m"}, rids, vars, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+		xs, ys, zs, rs, ms := vals[0], vals[1], vals[2], vals[3], vals[4]
+		rucf := halo.UnitConversionFactor(gConfig.HaloRadiusUnits, &hd.Cosmo)
+		pucf := halo.UnitConversionFactor(gConfig.HaloPositionUnits, &hd.Cosmo)
+		for i := range rs {
+			rs[i] *= rucf
+			xs[i] *= pucf
+			ys[i] *= pucf
+			zs[i] *= pucf
+		}
+
+		flags, err := flagNonIsolated(
+			group, rids, xs, ys, zs, rs, ms,
+			hd.TotalWidth, config.exclusionRadiusMult,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for i, idx := range idxBins[snap] {
+			isNeighbor[idx] = flags[i]
+		}
+	}
+
+	return isNeighbor, nil
+}
+
+// flagNonIsolated returns whether each ID in group has a more massive neighbor
+// within mult*R200m. rids, xs, ys, zs, rs, and ms describe every halo in a
+// periodic box of width L.
+func flagNonIsolated(
+	group, rids []int, xs, ys, zs, rs, ms []float64, L, mult float64,
+) ([]bool, error) {
+	f := newIntFinder(rids)
+	targets := make([]int, len(group))
+	for i, id := range group {
+		j, ok := f.find(id)
+		if !ok {
+			return nil, fmt.Errorf("ID %d not in halo list.", id)
+		}
+		targets[i] = j
+	}
+
+	g := halo.NewGrid(finderCells, L, len(xs))
+	g.Insert(xs, ys, zs)
+	return halo.FindNonIsolated(g, xs, ys, zs, rs, ms, mult, targets), nil
+}
+
+// findSecondaryCuts flags every halo which falls outside of any of the given
+// ranges of secondary halo properties.
+func findSecondaryCuts(
+	cuts []valueRange, ids, snaps []int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, gConfig *GlobalConfig,
+) ([]bool, error) {
+	isCut := make([]bool, len(ids))
+
+	for _, cut := range cuts {
+		valNames := []string{cut.name}
+		if cut.name == "Concentration" {
+			valNames = []string{"R200m", "Rs"}
+		}
+		for _, name := range valNames {
+			if _, ok := vars.ColumnLookup[name]; !ok {
+				return nil, fmt.Errorf("The '%sMin' or '%sMax' variable is "+
+					"set, but %s is not in HaloValueNames.",
+					cut.name, cut.name, name)
+			}
+		}
+
+		vals, err := readHaloCoords(
+			ids, snaps, valNames, vars, buf, e, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		flagSecondaryCut(cut, vals, isCut)
+	}
+
+	return isCut, nil
+}
+
+// flagSecondaryCut sets isCut[i] for every halo whose value falls outside of
+// cut. vals holds the columns read for cut, which are R200m and Rs for
+// Concentration.
+func flagSecondaryCut(cut valueRange, vals [][]float64, isCut []bool) {
+	for i := range isCut {
+		x := vals[0][i]
+		if cut.name == "Concentration" {
+			x = vals[0][i] / vals[1][i]
+		}
+		if !cut.contains(x) {
+			isCut[i] = true
+		}
+	}
+}
+
+// findEnvironmentCuts flags every halo whose large-scale density is outside
+// the percentile range given by config. Percentiles are computed separately
+// for each snapshot.
+func findEnvironmentCuts(
+	ids, snaps []int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, config *IDConfig,
+	gConfig *GlobalConfig,
+) ([]bool, error) {
+	isCut := make([]bool, len(ids))
+
+	coords, err := readHaloCoords(
+		ids, snaps, []string{"X", "Y", "Z"}, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, idxBins := binBySnap(snaps, ids)
+	for snap, idxs := range idxBins {
+		if snap == -1 {
+			continue
+		}
+
+		hds, files, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+
+		g := halo.NewDensityGrid(
+			int(config.environmentCells), hds[0].TotalWidth,
+		)
+		for i := range files {
+			xs, _, ms, _, err := buf.Read(files[i])
+			if err != nil {
+				return nil, err
+			}
+			g.Insert(xs, ms)
+			buf.Close()
+		}
+
+		flagEnvironmentCuts(
+			g, coords, idxs, config.environmentRadius,
+			config.environmentPercentileMin, config.environmentPercentileMax,
+			isCut,
+		)
+	}
+
+	return isCut, nil
+}
+
+// flagEnvironmentCuts sets isCut[i] for every index i in idxs whose
+// overdensity within a radius r is outside the percentile range [pMin, pMax]
+// of the overdensities of the halos in idxs. coords holds the X, Y, and Z
+// columns of every halo.
+func flagEnvironmentCuts(
+	g *halo.DensityGrid, coords [][]float64, idxs []int,
+	r, pMin, pMax float64, isCut []bool,
+) {
+	ods := make([]float64, len(idxs))
+	for j, i := range idxs {
+		pos := [3]float64{coords[0][i], coords[1][i], coords[2][i]}
+		ods[j] = g.Overdensity(pos, r)
+	}
+
+	ps := halo.Percentiles(ods)
+	for j, i := range idxs {
+		isCut[i] = ps[j] < pMin || ps[j] > pMax
+	}
+}
+
+// findRecentMergers flags every halo which has had a major merger within the
+// last MajorMergerDynamicalTimes dynamical times.
+func findRecentMergers(
+	ids, snaps []int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, config *IDConfig,
+) ([]bool, error) {
+	if _, ok := vars.ColumnLookup["ScaleOfLastMM"]; !ok {
+		return nil, fmt.Errorf("'MajorMergerDynamicalTimes' is set, but " +
+			"'ScaleOfLastMM' is not in 'HaloValueNames'.")
+	}
+
+	isMerger := make([]bool, len(ids))
+
+	snapBins, idxBins := binBySnap(snaps, ids)
+	for snap, group := range snapBins {
+		if snap == -1 {
+			continue
+		}
+
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		_, vals, err := memo.ReadRockstar(
+			snap, []string{"ScaleOfLastMM"}, group, vars, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		flags := flagRecentMergers(
+			vals[0], &hds[0].Cosmo, config.majorMergerDynamicalTimes,
+		)
+		for i, idx := range idxBins[snap] {
+			isMerger[idx] = flags[i]
+		}
+	}
+
+	return isMerger, nil
+}
+
+// flagRecentMergers returns whether each of the given ScaleOfLastMM values is
+// within dynTimes dynamical times of the snapshot with cosmology c.
+func flagRecentMergers(
+	scales []float64, c *io.CosmologyHeader, dynTimes float64,
+) []bool {
+	// Times are in units of 1/H0, which cancel out.
+	a := 1 / (1 + c.Z)
+	t := cosmo.Age(c.OmegaM, c.OmegaL, a)
+	tMin := t - dynTimes*cosmo.DynamicalTime(c.OmegaM, a)
+
+	isMerger := make([]bool, len(scales))
+	for i := range scales {
+		tMM := cosmo.Age(c.OmegaM, c.OmegaL, scales[i])
+		isMerger[i] = tMM > tMin
+	}
+	return isMerger
+}
+
+// findBoxEdgeHalos flags every halo which is within BoxEdgeRadiusMult*R200m
+// of the edge of the simulation box.
+func findBoxEdgeHalos(
+	ids, snaps []int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, config *IDConfig,
+	gConfig *GlobalConfig,
+) ([]bool, error) {
+	isEdge := make([]bool, len(ids))
+
+	coords, err := readHaloCoords(
+		ids, snaps, []string{"X", "Y", "Z", "R200m"}, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, idxBins := binBySnap(snaps, ids)
+	for snap, idxs := range idxBins {
+		if snap == -1 {
+			continue
+		}
+
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		L := hds[0].TotalWidth
+
+		for _, i := range idxs {
+			pos := [3]float64{coords[0][i], coords[1][i], coords[2][i]}
+			r := coords[3][i] * config.boxEdgeRadiusMult
+			isEdge[i] = nearBoxEdge(pos, r, L)
+		}
+	}
+
+	return isEdge, nil
+}
+
+// nearBoxEdge returns true if a sphere of radius r centered on pos extends
+// past the edge of a box of width L.
+func nearBoxEdge(pos [3]float64, r, L float64) bool {
+	for k := 0; k < 3; k++ {
+		if pos[k]-r < 0 || pos[k]+r > L {
+			return true
+		}
+	}
+	return false
+}
+
+// contaminationMassRatio is the factor by which a particle's mass must exceed
+// the minimum particle mass for it to be considered low-resolution. This
+// leaves some room for floating point errors in the particle catalogs.
+const contaminationMassRatio = 1.01
+
+// findContaminatedHalos flags every halo which has a low-resolution particle
+// within ExclusionRadiusMult*R200m of its center.
+func findContaminatedHalos(
+	ids, snaps []int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, config *IDConfig,
+	gConfig *GlobalConfig,
+) ([]bool, error) {
+	isContam := make([]bool, len(ids))
+
+	coords, err := readHaloCoords(
+		ids, snaps, []string{"X", "Y", "Z", "R200m"}, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	minMass := buf.MinMass()
+	snapBins, idxBins := binBySnap(snaps, ids)
+	for snap := range snapBins {
+		if snap == -1 {
+			continue
+		}
+
+		idxs := idxBins[snap]
+		spheres := make([]geom.Sphere, len(idxs))
+		for i, idx := range idxs {
+			spheres[i].C = [3]float32{
+				float32(coords[0][idx]), float32(coords[1][idx]),
+				float32(coords[2][idx]),
+			}
+			spheres[i].R = float32(coords[3][idx] * config.exclusionRadiusMult)
+		}
+
+		hds, files, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		_, intrIdxs := binSphereIntersections(hds, spheres)
+
+		sphContam := make([]bool, len(spheres))
+		for i := range hds {
+			if len(intrIdxs[i]) == 0 {
+				continue
+			}
+
+			xs, _, ms, _, err := buf.Read(files[i])
+			if err != nil {
+				return nil, err
+			}
+			flagContaminated(
+				xs, ms, minMass, float32(hds[i].TotalWidth),
+				spheres, intrIdxs[i], sphContam,
+			)
+			buf.Close()
+		}
+
+		for j := range idxs {
+			isContam[idxs[j]] = sphContam[j]
+		}
+	}
+
+	return isContam, nil
+}
+
+// flagContaminated sets isContam[j] for every sphere index j in check whose
+// sphere contains a particle more massive than minMass. The particles are in
+// a periodic box of width tw.
+func flagContaminated(
+	xs [][3]float32, ms []float32, minMass, tw float32,
+	spheres []geom.Sphere, check []int, isContam []bool,
+) {
+	lowRes := [][3]float32{}
+	for j := range xs {
+		if ms[j] > minMass*contaminationMassRatio {
+			lowRes = append(lowRes, xs[j])
+		}
+	}
+
+	for _, j := range check {
+		if isContam[j] {
+			continue
+		}
+		s := &spheres[j]
+		r2 := s.R * s.R
+		for _, x := range lowRes {
+			d2 := float32(0)
+			for k := 0; k < 3; k++ {
+				dx := x[k] - s.C[k]
+				if dx > tw/2 {
+					dx -= tw
+				} else if dx < -tw/2 {
+					dx += tw
 				}
+				d2 += dx * dx
 			}
+			if d2 <= r2 {
+				isContam[j] = true
+				break
+			}
+		}
+	}
+}
+
+// findUpIDSubs flags every halo which the halo catalog identifies as a
+// subhalo through its UpID (or PID) column. Nested subhalos are handled by
+// following parent IDs up to the top-level host.
+func findUpIDSubs(
+	ids, snaps []int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment,
+) ([]bool, error) {
+	parentName := ""
+	for _, name := range []string{"UpID", "PID"} {
+		if _, ok := vars.ColumnLookup[name]; ok {
+			parentName = name
+			break
+		}
+	}
+	if parentName == "" {
+		return nil, fmt.Errorf("ExclusionStrategy = subhalo requires that " +
+			"either 'UpID' or 'PID' is in 'HaloValueNames'.")
+	}
+
+	isSub := make([]bool, len(ids))
+
+	snapGroups := make(map[int][]int)
+	groupIdxs := make(map[int][]int)
+	for i, id := range ids {
+		snap := snaps[i]
+		snapGroups[snap] = append(snapGroups[snap], id)
+		groupIdxs[snap] = append(groupIdxs[snap], i)
+	}
+
+	for snap, group := range snapGroups {
+		rids, err := memo.ReadSortedRockstarIDs(
+			snap, -1, "M200m", vars, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+		_, vals, err := memo.ReadRockstar(
+			snap, []string{parentName}, rids, vars, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		pids := make([]int, len(rids))
+		for i := range pids {
+			pids[i] = int(vals[0][i])
+		}
+		flags, err := flagUpIDSubs(group, rids, pids)
+		if err != nil {
+			return nil, err
+		}
+		for i, idx := range groupIdxs[snap] {
+			isSub[idx] = flags[i]
+		}
+	}
+
+	return isSub, nil
+}
+
+// flagUpIDSubs returns whether each ID in group is a subhalo. rids and pids
+// are the IDs and parent IDs of every halo in the catalog.
+func flagUpIDSubs(group, rids, pids []int) ([]bool, error) {
+	hosts, err := halo.FindHosts(rids, pids)
+	if err != nil {
+		return nil, err
+	}
+
+	isSub := make([]bool, len(group))
+	f := newIntFinder(rids)
+	for i, id := range group {
+		j, ok := f.find(id)
+		if !ok {
+			return nil, fmt.Errorf("ID %d not in halo list.", id)
 		}
+		isSub[i] = hosts[j] != -1
 	}
 	return isSub, nil
 }
@@ -495,14 +1840,14 @@ func readSubIDs(
 	}
 	
 	// Load each snapshot.
-	hds, _, err := memo.ReadHeaders(snaps[0], buf, e)
-	if err != nil {
-		return nil, nil, err
-	}
-	hd := hds[0]
-	cosmo := &hd.Cosmo
-
 	for snap, group := range snapGroups {
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil {
+			return nil, nil, err
+		}
+		hd := hds[0]
+		cosmo := &hd.Cosmo
+
 		rids, err := memo.ReadSortedRockstarIDs(
 			snap, -1, "M200m", vars, buf, e,
 		)
@@ -0,0 +1,558 @@
+package cmd
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/los/geom"
+	"github.com/phil-mansfield/shellfish/math/rand"
+)
+
+func TestGetIDs(t *testing.T) {
+	tests := []struct {
+		start, end int64
+		inclusive  bool
+		ids        []int64
+		stdin      string
+		out        []int
+	}{
+		{10, 15, true, nil, "", []int{10, 11, 12, 13, 14, 15}},
+		{10, 15, false, nil, "", []int{10, 11, 12, 13, 14}},
+		{0, 0, true, nil, "", []int{0}},
+		{0, 0, false, nil, "", []int{}},
+		// IDStart takes precedence over IDs.
+		{3, 4, true, []int64{7, 8}, "", []int{3, 4}},
+		{-1, -1, true, []int64{7, 8, 7}, "", []int{7, 8, 7}},
+		{-1, -1, true, nil, "# ID(0) Snapshot(1)\n5 100\n6 100\n", []int{5, 6}},
+	}
+
+	for i, test := range tests {
+		out, err := getIDs(
+			test.start, test.end, test.inclusive, test.ids, "",
+			[]byte(test.stdin),
+		)
+		if err != nil {
+			t.Errorf("%d) Got error: %s", i, err.Error())
+			continue
+		}
+		if !intsEq(out, test.out) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.out, out)
+		}
+	}
+}
+
+func intsEq(xs, ys []int) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFlagContaminated(t *testing.T) {
+	// High-resolution particles have a mass of 1 and low-resolution
+	// particles have a mass of 8.
+	xs := [][3]float32{{1, 1, 1}, {7, 7, 7}, {5, 5, 5}, {0.2, 5, 5}}
+	ms := []float32{1, 1, 8, 8}
+	spheres := []geom.Sphere{
+		{C: [3]float32{1, 1, 1}, R: 1},
+		{C: [3]float32{5, 5.5, 5}, R: 1},
+		// Contaminated across the periodic boundary.
+		{C: [3]float32{9.5, 5, 5}, R: 1},
+		// Contaminated, but not checked.
+		{C: [3]float32{5, 5, 5}, R: 1},
+	}
+
+	isContam := make([]bool, len(spheres))
+	flagContaminated(xs, ms, 1, 10, spheres, []int{0, 1, 2}, isContam)
+	expected := []bool{false, true, true, false}
+	for i := range expected {
+		if isContam[i] != expected[i] {
+			t.Errorf("Expected sphere %d to have contamination %v, got %v.",
+				i, expected[i], isContam[i])
+		}
+	}
+
+	// If the heavy particles set the minimum mass, nothing is contaminated.
+	isContam = make([]bool, len(spheres))
+	flagContaminated(xs, ms, 8, 10, spheres, []int{0, 1, 2}, isContam)
+	for i := range isContam {
+		if isContam[i] {
+			t.Errorf("Expected no contamination when every particle is "+
+				"high-resolution, but sphere %d was flagged.", i)
+		}
+	}
+}
+
+func TestSortColumnName(t *testing.T) {
+	vars := &halo.VarColumns{ColumnLookup: map[string]int{
+		"Vmax": 0, "VMAX": 1, "vmax": 2, "Spin": 3,
+	}}
+
+	tests := []struct {
+		idType, name string
+		ok           bool
+	}{
+		{"VMAX", "VMAX", true},
+		{"vmax", "vmax", true},
+		{"spin", "Spin", true},
+		{"SPIN", "Spin", true},
+		{"vMax", "", false},
+		{"Xoff", "", false},
+	}
+
+	for i := range tests {
+		name, err := sortColumnName(tests[i].idType, vars)
+		if (err == nil) != tests[i].ok || name != tests[i].name {
+			t.Errorf("%d) Expected sortColumnName(%s) = (%s, %v), got "+
+				"(%s, %v).", i, tests[i].idType, tests[i].name,
+				tests[i].ok, name, err)
+		}
+	}
+}
+
+func TestStratifiedIndices(t *testing.T) {
+	// Five halos in [1e10, 1e11), two in [1e11, 1e12), one in [1e12, 1e13),
+	// and one without a mass.
+	ms := []float64{
+		1e10, 2e10, 3e10, 4e10, 5e10, 1e11, 5e11, 2e12, 0,
+	}
+
+	tests := []struct {
+		binsPerDex float64
+		k          int
+		counts     map[int]int
+	}{
+		{1, 2, map[int]int{10: 2, 11: 2, 12: 1}},
+		{1, 1, map[int]int{10: 1, 11: 1, 12: 1}},
+		{1, 10, map[int]int{10: 5, 11: 2, 12: 1}},
+		// Half-dex bins split [1e10, 1e11) at 10^10.5 ~ 3.16e10.
+		{2, 2, map[int]int{20: 2, 21: 2, 22: 1, 23: 1, 24: 1}},
+	}
+
+	for i, test := range tests {
+		gen := rand.New(rand.Xorshift, 1)
+		idxs := stratifiedIndices(ms, test.binsPerDex, test.k, gen)
+
+		counts := map[int]int{}
+		for j, idx := range idxs {
+			if j > 0 && idxs[j-1] >= idx {
+				t.Errorf("%d) Indices %v aren't increasing.", i, idxs)
+			}
+			if ms[idx] <= 0 {
+				t.Errorf("%d) Selected halo %d with mass %g.", i, idx, ms[idx])
+				continue
+			}
+			counts[int(math.Floor(math.Log10(ms[idx])*test.binsPerDex))]++
+		}
+		if !reflect.DeepEqual(counts, test.counts) {
+			t.Errorf("%d) Expected bin counts %v, got %v.",
+				i, test.counts, counts)
+		}
+
+		again := stratifiedIndices(
+			ms, test.binsPerDex, test.k, rand.New(rand.Xorshift, 1),
+		)
+		if !intsEq(idxs, again) {
+			t.Errorf("%d) Got %v and %v for the same seed.", i, idxs, again)
+		}
+	}
+}
+
+func TestSelectSnapIDs(t *testing.T) {
+	tests := []struct {
+		snap             int64
+		snaps            []int64
+		ids              []int64
+		outIDs, outSnaps []int
+	}{
+		{100, nil, []int64{3, 4}, []int{3, 4}, []int{100, 100}},
+		// Snaps takes precedence over Snap.
+		{100, []int64{90}, []int64{3, 4}, []int{3, 4}, []int{90, 90}},
+		{-1, []int64{100, 90, 80}, []int64{3, 4},
+			[]int{3, 4, 3, 4, 3, 4}, []int{100, 100, 90, 90, 80, 80}},
+		{-1, []int64{100, 90}, []int64{7}, []int{7, 7}, []int{100, 90}},
+	}
+
+	for i, test := range tests {
+		config := &IDConfig{
+			idStart: -1, idEnd: -1, idType: "halo-id", ids: test.ids,
+			snap: test.snap, snaps: test.snaps,
+			m200mMin: -1, m200mMax: -1, vmaxMin: -1, vmaxMax: -1,
+		}
+		ids, snaps, err := config.selectSnapIDs(
+			config.snapList(), nil, nil, nil, nil,
+		)
+		if err != nil {
+			t.Errorf("%d) Got error: %s", i, err.Error())
+			continue
+		}
+		if !intsEq(ids, test.outIDs) {
+			t.Errorf("%d) Expected IDs %v, got %v.", i, test.outIDs, ids)
+		}
+		if !intsEq(snaps, test.outSnaps) {
+			t.Errorf("%d) Expected snapshots %v, got %v.",
+				i, test.outSnaps, snaps)
+		}
+	}
+}
+
+func TestFlagUpIDSubs(t *testing.T) {
+	// Halo 1 is a host, 2 is its subhalo, and 3 is a sub-subhalo. Halo 4 is an
+	// isolated host and 5 is a subhalo of a halo outside the catalog.
+	rids := []int{1, 2, 3, 4, 5}
+	pids := []int{-1, 1, 2, -1, 100}
+
+	tests := []struct {
+		group []int
+		isSub []bool
+	}{
+		{[]int{1, 2, 3, 4, 5}, []bool{false, true, true, false, true}},
+		{[]int{4, 3}, []bool{false, true}},
+		{[]int{}, []bool{}},
+	}
+
+	for i, test := range tests {
+		isSub, err := flagUpIDSubs(test.group, rids, pids)
+		if err != nil {
+			t.Errorf("%d) Got error: %s", i, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(isSub, test.isSub) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.isSub, isSub)
+		}
+	}
+
+	if _, err := flagUpIDSubs([]int{6}, rids, pids); err == nil {
+		t.Errorf("Expected an error for an ID not in the catalog.")
+	}
+	if _, err := flagUpIDSubs(
+		[]int{1}, []int{1, 2}, []int{2, 1},
+	); err == nil {
+		t.Errorf("Expected an error for cyclic parent IDs.")
+	}
+}
+
+func TestFlagNonIsolated(t *testing.T) {
+	// Halo 11 is near the more massive halo 10, and halo 12 is near the more
+	// massive halo 13 across the periodic boundary.
+	rids := []int{10, 11, 12, 13}
+	xs := []float64{50, 50.8, 0.3, 99.5}
+	ys := []float64{50, 50, 50, 50}
+	zs := []float64{50, 50, 50, 50}
+	rs := []float64{1, 0.5, 0.5, 1}
+	ms := []float64{1e12, 1e11, 1e11, 1e12}
+
+	tests := []struct {
+		group []int
+		mult  float64
+		flags []bool
+	}{
+		{[]int{10, 11, 12, 13}, 2, []bool{false, true, true, false}},
+		{[]int{12, 11}, 2, []bool{true, true}},
+		{[]int{10, 11, 12, 13}, 1, []bool{false, false, false, false}},
+	}
+
+	for i, test := range tests {
+		flags, err := flagNonIsolated(
+			test.group, rids, xs, ys, zs, rs, ms, 100, test.mult,
+		)
+		if err != nil {
+			t.Errorf("%d) Got error: %s", i, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(flags, test.flags) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.flags, flags)
+		}
+	}
+
+	_, err := flagNonIsolated([]int{14}, rids, xs, ys, zs, rs, ms, 100, 2)
+	if err == nil {
+		t.Errorf("Expected an error for an ID not in the catalog.")
+	}
+}
+
+func TestNearBoxEdge(t *testing.T) {
+	tests := []struct {
+		pos  [3]float64
+		r    float64
+		edge bool
+	}{
+		{[3]float64{50, 50, 50}, 10, false},
+		{[3]float64{5, 50, 50}, 4, false},
+		{[3]float64{5, 50, 50}, 6, true},
+		{[3]float64{50, 97, 50}, 4, true},
+		{[3]float64{50, 50, 99}, 0.5, false},
+		{[3]float64{50, 50, 99}, 2, true},
+		{[3]float64{0, 50, 50}, 0, false},
+	}
+
+	for i := range tests {
+		edge := nearBoxEdge(tests[i].pos, tests[i].r, 100)
+		if edge != tests[i].edge {
+			t.Errorf("%d) Expected nearBoxEdge(%v, %g) = %v, got %v.",
+				i, tests[i].pos, tests[i].r, tests[i].edge, edge)
+		}
+	}
+}
+
+func TestFlagSecondaryCut(t *testing.T) {
+	spins := []float64{0.01, 0.03, 0.05, 0.1}
+	r200ms := []float64{1, 1, 0.5, 2}
+	rss := []float64{0.1, 0.25, 0.05, 0.1}
+
+	tests := []struct {
+		cut   valueRange
+		vals  [][]float64
+		isCut []bool
+	}{
+		{valueRange{"Spin", 0.02, 0.06}, [][]float64{spins},
+			[]bool{true, false, false, true}},
+		{valueRange{"Spin", -1, 0.04}, [][]float64{spins},
+			[]bool{false, false, true, true}},
+		{valueRange{"Spin", 0.05, -1}, [][]float64{spins},
+			[]bool{true, true, false, false}},
+		// Concentrations are 10, 4, 10, and 20.
+		{valueRange{"Concentration", 5, 15}, [][]float64{r200ms, rss},
+			[]bool{false, true, false, true}},
+	}
+
+	for i, test := range tests {
+		isCut := make([]bool, len(spins))
+		flagSecondaryCut(test.cut, test.vals, isCut)
+		if !reflect.DeepEqual(isCut, test.isCut) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.isCut, isCut)
+		}
+	}
+
+	// Cuts are combined, so halos which were already cut stay cut.
+	isCut := []bool{true, false, false, false}
+	flagSecondaryCut(valueRange{"Spin", -1, 0.04}, [][]float64{spins}, isCut)
+	expected := []bool{true, false, true, true}
+	if !reflect.DeepEqual(isCut, expected) {
+		t.Errorf("Expected combined cuts %v, got %v.", expected, isCut)
+	}
+}
+
+func TestFlagEnvironmentCuts(t *testing.T) {
+	// Each halo sits at the center of its own cell, and the cells have
+	// decreasing masses along the x-axis.
+	g := halo.NewDensityGrid(10, 100)
+	g.Insert(
+		[][3]float32{{5, 5, 5}, {15, 5, 5}, {25, 5, 5}, {35, 5, 5}},
+		[]float32{4, 3, 2, 1},
+	)
+	// Halo 1 is in a different snapshot and isn't in idxs.
+	coords := [][]float64{
+		{5, 55, 15, 25, 35},
+		{5, 55, 5, 5, 5},
+		{5, 55, 5, 5, 5},
+	}
+	idxs := []int{0, 2, 3, 4}
+
+	tests := []struct {
+		pMin, pMax float64
+		isCut      []bool
+	}{
+		{0, 100, []bool{false, false, false, false, false}},
+		{20, 80, []bool{true, false, false, false, true}},
+		{50, 100, []bool{false, false, false, true, true}},
+		{0, 50, []bool{true, false, true, false, false}},
+	}
+
+	for i, test := range tests {
+		isCut := make([]bool, len(coords[0]))
+		flagEnvironmentCuts(g, coords, idxs, 1, test.pMin, test.pMax, isCut)
+		if !reflect.DeepEqual(isCut, test.isCut) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.isCut, isCut)
+		}
+	}
+}
+
+func TestRepetitionSeed(t *testing.T) {
+	for _, base := range []uint64{0, 1, 12345} {
+		seen := make(map[uint32]int)
+		for k := 0; k < 1000; k++ {
+			seed := repetitionSeed(base, k)
+			if j, ok := seen[seed]; ok {
+				t.Errorf("Base seed %d gave seed %d to repetitions %d and %d.",
+					base, seed, j, k)
+			}
+			seen[seed] = k
+			if repetitionSeed(base, k) != seed {
+				t.Errorf("Base seed %d gave different seeds to repetition %d.",
+					base, k)
+			}
+		}
+	}
+
+	if repetitionSeed(1, 0) == repetitionSeed(2, 0) {
+		t.Errorf("Expected different base seeds to give different seeds.")
+	}
+}
+
+func TestIDConfigSeed(t *testing.T) {
+	defer func(seed uint64) { randSeed = seed }(randSeed)
+	randSeed = 42
+
+	tests := []struct {
+		randomSeed int64
+		expected   uint64
+	}{
+		{-1, 42},
+		{0, 0},
+		{1337, 1337},
+	}
+
+	for i, test := range tests {
+		config := &IDConfig{randomSeed: test.randomSeed}
+		if seed := config.seed(); seed != test.expected {
+			t.Errorf("%d) Expected seed %d for RandomSeed = %d, got %d.",
+				i, test.expected, test.randomSeed, seed)
+		}
+	}
+}
+
+func TestMultiplyLines(t *testing.T) {
+	lines := []string{"10 100", "11 100"}
+
+	out := multiplyLines(lines, 1, 7)
+	if !reflect.DeepEqual(out, lines) {
+		t.Errorf("Expected Mult = 1 to return %v, got %v.", lines, out)
+	}
+
+	out = multiplyLines(lines, 3, 7)
+	if len(out) != 6 {
+		t.Fatalf("Expected 6 lines, got %d.", len(out))
+	}
+	for i, line := range out {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Errorf("%d) Expected 3 columns in '%s', got %d.",
+				i, line, len(fields))
+			continue
+		}
+		if prefix := fields[0] + " " + fields[1]; prefix != lines[i/3] {
+			t.Errorf("%d) Expected line '%s', got '%s'.",
+				i, lines[i/3], prefix)
+		}
+		seed, err := strconv.Atoi(fields[2])
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if uint32(seed) != repetitionSeed(7, i) {
+			t.Errorf("%d) Expected seed %d, got %d.",
+				i, repetitionSeed(7, i), seed)
+		}
+	}
+
+	if again := multiplyLines(lines, 3, 7); !reflect.DeepEqual(again, out) {
+		t.Errorf("Expected the same seeds for the same base seed.")
+	}
+	if len(multiplyLines(nil, 3, 7)) != 0 {
+		t.Errorf("Expected no lines when there is no input.")
+	}
+}
+
+func TestFlagRecentMergers(t *testing.T) {
+	scales := []float64{0.3, 0.55, 0.8, 1}
+
+	tests := []struct {
+		z, dynTimes float64
+		isMerger    []bool
+	}{
+		// The dynamical time at z = 0 is about 0.37/H0 and the age of the
+		// universe is about 0.96/H0.
+		{0, 0, []bool{false, false, false, false}},
+		{0, 1, []bool{false, false, true, true}},
+		{0, 2, []bool{false, true, true, true}},
+		{0, 10, []bool{true, true, true, true}},
+		// At z = 1, the last three mergers are after the snapshot.
+		{1, 0, []bool{false, true, true, true}},
+	}
+
+	for i, test := range tests {
+		c := &io.CosmologyHeader{Z: test.z, OmegaM: 0.3, OmegaL: 0.7}
+		isMerger := flagRecentMergers(scales, c, test.dynTimes)
+		if !reflect.DeepEqual(isMerger, test.isMerger) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.isMerger, isMerger)
+		}
+	}
+}
+
+func TestHandleDuplicates(t *testing.T) {
+	// ID 5 appears twice at snapshot 100, but only once at snapshot 90.
+	ids := []int{5, 6, 5, 5, 7}
+	snaps := []int{100, 100, 100, 90, 100}
+
+	tests := []struct {
+		strategy         string
+		ids, snaps       []int
+		outIDs, outSnaps []int
+		err              bool
+	}{
+		{"remove", ids, snaps,
+			[]int{5, 6, 5, 7}, []int{100, 100, 90, 100}, false},
+		{"allow", ids, snaps, ids, snaps, false},
+		{"error", ids, snaps, nil, nil, true},
+		// Without duplicates, every strategy passes the IDs through.
+		{"remove", []int{5, 5, 6}, []int{100, 90, 100},
+			[]int{5, 5, 6}, []int{100, 90, 100}, false},
+		{"error", []int{5, 5, 6}, []int{100, 90, 100},
+			[]int{5, 5, 6}, []int{100, 90, 100}, false},
+		{"error", []int{}, []int{}, []int{}, []int{}, false},
+	}
+
+	for i, test := range tests {
+		config := &IDConfig{duplicateIDs: test.strategy}
+		outIDs, outSnaps, err := config.handleDuplicates(test.ids, test.snaps)
+		if test.err {
+			if err == nil {
+				t.Errorf("%d) Expected an error for DuplicateIDs = %s.",
+					i, test.strategy)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%d) Got error: %s", i, err.Error())
+			continue
+		}
+
+		if !intsEq(outIDs, test.outIDs) {
+			t.Errorf("%d) Expected IDs %v, got %v.", i, test.outIDs, outIDs)
+		}
+		if !intsEq(outSnaps, test.outSnaps) {
+			t.Errorf("%d) Expected snapshots %v, got %v.",
+				i, test.outSnaps, outSnaps)
+		}
+	}
+}
+
+func TestUniqueIndices(t *testing.T) {
+	tests := []struct {
+		ids, snaps []int
+		idxs       []int
+		dupIdx     int
+	}{
+		{[]int{1, 2, 3}, []int{0, 0, 0}, []int{0, 1, 2}, -1},
+		{[]int{1, 2, 1, 2}, []int{0, 0, 0, 0}, []int{0, 1}, 2},
+		{[]int{1, 1, 1}, []int{0, 1, 1}, []int{0, 1}, 2},
+		{[]int{}, []int{}, []int{}, -1},
+	}
+
+	for i, test := range tests {
+		idxs, dupIdx := uniqueIndices(test.ids, test.snaps)
+		if !intsEq(idxs, test.idxs) || dupIdx != test.dupIdx {
+			t.Errorf("%d) Expected %v and %d, got %v and %d.",
+				i, test.idxs, test.dupIdx, idxs, dupIdx)
+		}
+	}
+}
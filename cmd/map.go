@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/los/geom"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// MapConfig contains the configuration fields for the 'map' mode of the
+// shellfish tool.
+type MapConfig struct {
+	axis      string
+	pixels    int64
+	widthMult float64
+	depthMult float64
+	dir       string
+}
+
+var _ Mode = &MapConfig{}
+
+// ExampleConfig creates an example map.config file.
+func (config *MapConfig) ExampleConfig() string {
+	return `[map.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The map tool writes a projected surface density image of the particles
+# around each halo to Dir as a FITS file, so that unusual shells can be
+# inspected by eye in tools like DS9 or astropy. Files are named
+# map_<snap>_<id>.fits. Images are centered on the halo and their headers
+# record the comoving coordinates of each pixel.
+
+# Axis is the axis that particles are projected along. It can be x, y, or z.
+# Defaults to z.
+#
+# Axis = z
+
+# Pixels is the number of pixels along each side of the image. Defaults to
+# 256.
+#
+# Pixels = 256
+
+# WidthMult is the half-width of the image in units of R200m. Defaults to 3.
+#
+# WidthMult = 3
+
+# DepthMult is the half-length of the projected region along Axis in units of
+# R200m. Defaults to 3.
+#
+# DepthMult = 3
+
+# Dir is the directory that images are written to. Defaults to the current
+# directory.
+#
+# Dir = .`
+}
+
+// ReadConfig reads in a map.config file into config.
+func (config *MapConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("map.config")
+	vars.String(&config.axis, "Axis", "z")
+	vars.Int(&config.pixels, "Pixels", 256)
+	vars.Float(&config.widthMult, "WidthMult", 3)
+	vars.Float(&config.depthMult, "DepthMult", 3)
+	vars.String(&config.dir, "Dir", ".")
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *MapConfig) validate() error {
+	if _, ok := projectionAxes[config.axis]; !ok {
+		return fmt.Errorf("The 'Axis' variable is set to '%s', but it must "+
+			"be one of 'x', 'y', or 'z'.", config.axis)
+	}
+	if config.pixels <= 0 {
+		return fmt.Errorf("The 'Pixels' variable is set to %d, but it "+
+			"needs to be positive.", config.pixels)
+	}
+	if config.widthMult <= 0 {
+		return fmt.Errorf("The 'WidthMult' variable is set to %g, but it "+
+			"needs to be positive.", config.widthMult)
+	}
+	if config.depthMult <= 0 {
+		return fmt.Errorf("The 'DepthMult' variable is set to %g, but it "+
+			"needs to be positive.", config.depthMult)
+	}
+	return nil
+}
+
+// Run executes the map mode of the shellfish tool.
+func (config *MapConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+###################
+## shellfish map ##
+###################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, coords, err := catalog.Parse(
+		stdin, []int{0, 1}, []int{2, 3, 4, 5},
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = readInputUnits(
+		stdin, snaps, coords, repeatKind(lengthUnit, 4), buf, e,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sphere which bounds the projected box.
+	bound := math.Sqrt(2*config.widthMult*config.widthMult +
+		config.depthMult*config.depthMult)
+
+	particles := make([]int, len(ids))
+	_, idxBins := binBySnap(snaps, ids)
+	for snap, idxs := range idxBins {
+		if snap == -1 {
+			continue
+		}
+
+		spheres := make([]geom.Sphere, len(idxs))
+		for j, i := range idxs {
+			spheres[j] = geom.Sphere{
+				C: [3]float32{
+					float32(coords[0][i]), float32(coords[1][i]),
+					float32(coords[2][i]),
+				},
+				R: float32(coords[3][i] * bound),
+			}
+		}
+		ps, _, err := causticSphereParticles(snap, spheres, buf, e)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, i := range idxs {
+			r200m := coords[3][i]
+			if r200m <= 0 {
+				continue
+			}
+			center := [3]float64{coords[0][i], coords[1][i], coords[2][i]}
+
+			var img []float32
+			img, particles[i] = config.surfaceDensity(ps[j], r200m)
+			cards := config.fitsCards(ids[i], snap, center, r200m)
+
+			fname := path.Join(config.dir, fmt.Sprintf(
+				"map_%d_%d.fits", snap, ids[i],
+			))
+			f, err := os.Create(fname)
+			if err != nil {
+				return nil, err
+			}
+			n := int(config.pixels)
+			err = io.WriteFITSImage(f, img, n, n, cards)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	order := []int{0, 1, 2}
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps, particles}, [][]float64{}, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot", "Particles"}, []string{},
+		order, []int{1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
+
+// surfaceDensity projects the particles around a halo onto an image and
+// returns the surface density of each pixel in h Msun/cMpc^2 along with the
+// number of particles inside the image.
+func (config *MapConfig) surfaceDensity(
+	ps *causticParticles, r200m float64,
+) ([]float32, int) {
+	axes := projectionAxes[config.axis]
+	n := int(config.pixels)
+	width := r200m * config.widthMult
+	depth := float32(r200m * config.depthMult)
+	dx := 2 * width / float64(n)
+
+	img := make([]float32, n*n)
+	count := 0
+	for i, x := range ps.dxs {
+		if x[axes[0]] > depth || x[axes[0]] < -depth {
+			continue
+		}
+		ix := int(math.Floor((float64(x[axes[1]]) + width) / dx))
+		iy := int(math.Floor((float64(x[axes[2]]) + width) / dx))
+		if ix < 0 || ix >= n || iy < 0 || iy >= n {
+			continue
+		}
+		img[ix+iy*n] += ps.ms[i]
+		count++
+	}
+
+	area := float32(dx * dx)
+	for i := range img {
+		img[i] /= area
+	}
+	return img, count
+}
+
+// fitsCards returns the header keywords of a halo's image. The WCS keywords
+// give the comoving coordinates of each pixel's center.
+func (config *MapConfig) fitsCards(
+	id, snap int, center [3]float64, r200m float64,
+) []io.FITSCard {
+	axes := projectionAxes[config.axis]
+	names := []string{"X", "Y", "Z"}
+	dx := 2 * r200m * config.widthMult / float64(config.pixels)
+	crpix := float64(config.pixels+1) / 2
+
+	return []io.FITSCard{
+		{Key: "BUNIT", Value: "h Msun/cMpc^2", Comment: "surface density"},
+		{
+			Key: "CTYPE1", Value: names[axes[1]],
+			Comment: "comoving box coordinate",
+		},
+		{Key: "CUNIT1", Value: comovingLabels[lengthUnit]},
+		{Key: "CRPIX1", Value: crpix, Comment: "reference pixel"},
+		{Key: "CRVAL1", Value: center[axes[1]], Comment: "halo center"},
+		{Key: "CDELT1", Value: dx, Comment: "pixel width"},
+		{
+			Key: "CTYPE2", Value: names[axes[2]],
+			Comment: "comoving box coordinate",
+		},
+		{Key: "CUNIT2", Value: comovingLabels[lengthUnit]},
+		{Key: "CRPIX2", Value: crpix, Comment: "reference pixel"},
+		{Key: "CRVAL2", Value: center[axes[2]], Comment: "halo center"},
+		{Key: "CDELT2", Value: dx, Comment: "pixel width"},
+		{Key: "HALOID", Value: id, Comment: "halo catalog ID"},
+		{Key: "SNAPSHOT", Value: snap, Comment: "snapshot index"},
+		{Key: "R200M", Value: r200m, Comment: "halo radius [cMpc/h]"},
+		{Key: "AXIS", Value: names[axes[0]], Comment: "projection axis"},
+		{
+			Key: "DEPTH", Value: 2 * r200m * config.depthMult,
+			Comment: "projected depth [cMpc/h]",
+		},
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+func TestMapSurfaceDensity(t *testing.T) {
+	config := &MapConfig{axis: "z", pixels: 4, widthMult: 1, depthMult: 1}
+	ps := &causticParticles{
+		dxs: [][3]float32{
+			{0.1, 0.1, 0}, {0.2, 0.3, 0.5}, {-0.9, -0.9, 0},
+			{0.1, 0.1, 2}, {1.5, 0, 0},
+		},
+		ms: []float32{1, 2, 4, 8, 16},
+	}
+
+	img, n := config.surfaceDensity(ps, 1)
+	if n != 3 {
+		t.Errorf("Expected 3 particles in the image, got %d.", n)
+	}
+
+	// Pixels are 0.5 wide.
+	expected := make([]float32, 16)
+	expected[2+2*4] = 3 / 0.25
+	expected[0] = 4 / 0.25
+	for i := range img {
+		if math.Abs(float64(img[i]-expected[i])) > 1e-5 {
+			t.Errorf("Expected pixel %d to be %g, got %g.",
+				i, expected[i], img[i])
+		}
+	}
+}
+
+func TestMapFITS(t *testing.T) {
+	config := &MapConfig{axis: "x", pixels: 3, widthMult: 1.5, depthMult: 1}
+	cards := config.fitsCards(7, 100, [3]float64{1, 2, 3}, 1)
+	img := []float32{1, 2, 3, 4, 5, 6, 7, 8, 9}
+
+	buf := &bytes.Buffer{}
+	if err := io.WriteFITSImage(buf, img, 3, 3, cards); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	data := buf.Bytes()
+	if len(data) != 2*2880 {
+		t.Fatalf("Expected a FITS file of %d bytes, got %d.",
+			2*2880, len(data))
+	}
+
+	header := string(data[:2880])
+	for _, card := range []string{
+		"SIMPLE  =                    T",
+		"NAXIS1  =                    3",
+		"CTYPE1  = 'Y       '",
+		"CRVAL2  =                    3",
+		"HALOID  =                    7",
+		"END     ",
+	} {
+		if !strings.Contains(header, card) {
+			t.Errorf("Expected the header to contain %q.", card)
+		}
+	}
+
+	out := make([]float32, len(img))
+	err := binary.Read(
+		bytes.NewReader(data[2880:]), binary.BigEndian, out,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for i := range out {
+		if out[i] != img[i] {
+			t.Errorf("Expected pixel %d to be %g, got %g.", i, img[i], out[i])
+		}
+	}
+
+	if err := io.WriteFITSImage(buf, img, 2, 2, cards); err == nil {
+		t.Errorf("Expected an error for a mis-shaped image.")
+	}
+}
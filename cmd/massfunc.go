@@ -0,0 +1,337 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// MassFuncConfig contains the configuration fields for the 'massfunc' mode
+// of the shellfish tool.
+type MassFuncConfig struct {
+	massName         string
+	massMin, massMax float64
+	bins             int64
+	splashback       bool
+}
+
+var _ Mode = &MassFuncConfig{}
+
+// ExampleConfig creates an example massfunc.config file.
+func (config *MassFuncConfig) ExampleConfig() string {
+	return `[massfunc.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The massfunc tool measures the mass function, dn/dlog10(M), of the input
+# halos in each snapshot, as a quick check that halo catalogs and units are
+# being read correctly. The mass function is only complete if the input
+# contains every halo in the mass range (e.g. if it was generated by the id
+# tool with IDType = M200m and no other cuts).
+
+# MassName is the halo catalog variable which is used as the mass. It must be
+# in Msun/h. Defaults to M200m.
+#
+# MassName = M200m
+
+# MassMin and MassMax are the edges of the mass range in Msun/h. Default to
+# 1e10 and 1e16.
+#
+# MassMin = 1e10
+# MassMax = 1e16
+
+# Bins is the number of logarithmic mass bins. Defaults to 24.
+#
+# Bins = 24
+
+# If Splashback is true, the mass function of the M_sp column of the input
+# catalog is also measured. The input must then be the output of the stats
+# tool. Defaults to false.
+#
+# Splashback = false`
+}
+
+// ReadConfig reads in a massfunc.config file into config.
+func (config *MassFuncConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("massfunc.config")
+	vars.String(&config.massName, "MassName", "M200m")
+	vars.Float(&config.massMin, "MassMin", 1e10)
+	vars.Float(&config.massMax, "MassMax", 1e16)
+	vars.Int(&config.bins, "Bins", 24)
+	vars.Bool(&config.splashback, "Splashback", false)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *MassFuncConfig) validate() error {
+	if config.massName == "" {
+		return fmt.Errorf("The 'MassName' variable is empty.")
+	}
+	if config.massMin <= 0 {
+		return fmt.Errorf("The 'MassMin' variable is set to %g, but it "+
+			"needs to be positive.", config.massMin)
+	}
+	if config.massMax <= config.massMin {
+		return fmt.Errorf("The 'MassMax' variable is set to %g, but it "+
+			"needs to be larger than 'MassMin', %g.",
+			config.massMax, config.massMin)
+	}
+	if config.bins <= 0 {
+		return fmt.Errorf("The 'Bins' variable is set to %d, but it needs "+
+			"to be positive.", config.bins)
+	}
+	return nil
+}
+
+// Run executes the massfunc mode of the shellfish tool.
+func (config *MassFuncConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+########################
+## shellfish massfunc ##
+########################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, _, err := catalog.Parse(stdin, []int{0, 1}, []int{})
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cols, err := readHaloCoords(
+		ids, snaps, []string{config.massName}, vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+	ms := cols[0]
+
+	var msps []float64
+	if config.splashback {
+		msps, err = readSplashbackMasses(stdin, snaps, buf, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Repeated rows (e.g. from the Repeats variable of the id tool) are
+	// only counted once.
+	unique := uniqueHalos(ids, snaps)
+
+	out := &massFuncRows{}
+	_, idxBins := binBySnap(snaps, ids)
+	for _, snap := range sortedSnaps(idxBins) {
+		hd, err := snapHeader(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		volume := hd.TotalWidth * hd.TotalWidth * hd.TotalWidth
+
+		snapMs, snapMsps := []float64{}, []float64{}
+		for _, i := range idxBins[snap] {
+			if !unique[i] {
+				continue
+			}
+			snapMs = append(snapMs, ms[i])
+			if msps != nil {
+				snapMsps = append(snapMsps, msps[i])
+			}
+		}
+		out.add(snap, snapMs, snapMsps, config, volume)
+	}
+
+	lines, err := out.format(gConfig, config.splashback, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return lines, nil
+}
+
+// readSplashbackMasses reads the M_sp column of a catalog written by the stats
+// tool in comovingUnits.
+func readSplashbackMasses(
+	stdin []byte, snaps []int, buf io.VectorBuffer, e *env.Environment,
+) ([]float64, error) {
+	idx := -1
+	for _, col := range catalog.Columns(stdin) {
+		if baseColumnName(col.Name) == "M_sp" && col.Start == col.End {
+			idx = col.Start
+		}
+	}
+	if idx == -1 {
+		return nil, fmt.Errorf("'Splashback' is set, but the input " +
+			"catalog doesn't have an M_sp column.")
+	}
+
+	_, cols, err := catalog.Parse(stdin, []int{}, []int{idx})
+	if err != nil {
+		return nil, err
+	}
+	err = readInputUnits(stdin, snaps, cols, []unitKind{massUnit}, buf, e)
+	if err != nil {
+		return nil, err
+	}
+	return cols[0], nil
+}
+
+// uniqueHalos returns true for the first row of every distinct halo, ignoring
+// sentinel rows.
+func uniqueHalos(ids, snaps []int) []bool {
+	unique := make([]bool, len(ids))
+	seen := map[[2]int]bool{}
+	for i := range ids {
+		key := [2]int{ids[i], snaps[i]}
+		if snaps[i] != -1 && !seen[key] {
+			unique[i], seen[key] = true, true
+		}
+	}
+	return unique
+}
+
+// sortedSnaps returns the snapshots in idxBins in increasing order, without
+// the sentinel snapshot.
+func sortedSnaps(idxBins map[int][]int) []int {
+	snaps := []int{}
+	for snap := range idxBins {
+		if snap != -1 {
+			snaps = append(snaps, snap)
+		}
+	}
+	sort.Ints(snaps)
+	return snaps
+}
+
+// massFuncRows are the rows of the massfunc tool's output catalog.
+type massFuncRows struct {
+	snaps, ns, nsps          []int
+	mMins, mMaxes, dns, errs []float64
+	dnsps, errsps            []float64
+}
+
+// add adds the mass function of a single snapshot to the rows. msps is
+// ignored unless config.splashback is set.
+func (rows *massFuncRows) add(
+	snap int, ms, msps []float64, config *MassFuncConfig, volume float64,
+) {
+	bins := int(config.bins)
+	edges, ns, dn, err := halo.MassFunction(
+		ms, config.massMin, config.massMax, bins, volume,
+	)
+	for i := 0; i < bins; i++ {
+		rows.snaps = append(rows.snaps, snap)
+		rows.mMins = append(rows.mMins, edges[i])
+		rows.mMaxes = append(rows.mMaxes, edges[i+1])
+	}
+	rows.ns = append(rows.ns, ns...)
+	rows.dns = append(rows.dns, dn...)
+	rows.errs = append(rows.errs, err...)
+
+	if !config.splashback {
+		return
+	}
+	_, ns, dn, err = halo.MassFunction(
+		msps, config.massMin, config.massMax, bins, volume,
+	)
+	rows.nsps = append(rows.nsps, ns...)
+	rows.dnsps = append(rows.dnsps, dn...)
+	rows.errsps = append(rows.errsps, err...)
+}
+
+// format converts the rows to the global config's units and returns the
+// lines of the output catalog.
+func (rows *massFuncRows) format(
+	gConfig *GlobalConfig, splashback bool,
+	buf io.VectorBuffer, e *env.Environment,
+) ([]string, error) {
+	intNames := []string{"Snapshot", "N"}
+	intCols := [][]int{rows.snaps, rows.ns}
+	floatNames := []string{
+		"M_min [M_sun/h]", "M_max [M_sun/h]",
+		"dn/dlogM [h^3/cMpc^3]", "dn/dlogM_err [h^3/cMpc^3]",
+	}
+	floatCols := [][]float64{rows.mMins, rows.mMaxes, rows.dns, rows.errs}
+	kinds := []unitKind{
+		massUnit, massUnit, numberDensityUnit, numberDensityUnit,
+	}
+	order := []int{0, 2, 3, 1, 4, 5}
+
+	if splashback {
+		intNames = append(intNames, "N_sp")
+		intCols = append(intCols, rows.nsps)
+		floatNames = append(floatNames,
+			"dn_sp/dlogM [h^3/cMpc^3]", "dn_sp/dlogM_err [h^3/cMpc^3]",
+		)
+		floatCols = append(floatCols, rows.dnsps, rows.errsps)
+		kinds = append(kinds, numberDensityUnit, numberDensityUnit)
+		order = []int{0, 3, 4, 1, 5, 6, 2, 7, 8}
+	}
+
+	uc, err := newUnitConverter(gConfig.Units, rows.snaps, buf, e)
+	if err != nil {
+		return nil, err
+	}
+	uc.convert(rows.snaps, floatCols, kinds)
+	relabelColumns(gConfig.Units, floatNames)
+
+	sizes := make([]int, len(order))
+	for i := range sizes {
+		sizes[i] = 1
+	}
+	lines := catalog.FormatCols(intCols, floatCols, order)
+	cString := catalog.CommentString(intNames, floatNames, order, sizes)
+
+	return append([]string{uc.unitsString(), cString}, lines...), nil
+}
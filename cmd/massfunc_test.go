@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestUniqueHalos(t *testing.T) {
+	ids := []int{1, 2, 1, -1, 1}
+	snaps := []int{100, 100, 100, -1, 90}
+	expected := []bool{true, true, false, false, true}
+
+	unique := uniqueHalos(ids, snaps)
+	for i := range expected {
+		if unique[i] != expected[i] {
+			t.Errorf("Expected %v, got %v.", expected, unique)
+			break
+		}
+	}
+}
+
+func TestMassFuncRows(t *testing.T) {
+	config := &MassFuncConfig{
+		massMin: 1e10, massMax: 1e12, bins: 2, splashback: true,
+	}
+	gConfig := &GlobalConfig{Units: comovingUnits}
+
+	rows := &massFuncRows{}
+	rows.add(100, []float64{2e10, 3e11}, []float64{5e10, 6e10}, config, 10)
+	lines, err := rows.format(gConfig, true, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []string{
+		"# Units: cMpc/h",
+		"# Column contents: Snapshot(0) M_min [M_sun/h](1) " +
+			"M_max [M_sun/h](2) N(3) dn/dlogM [h^3/cMpc^3](4) " +
+			"dn/dlogM_err [h^3/cMpc^3](5) N_sp(6) " +
+			"dn_sp/dlogM [h^3/cMpc^3](7) dn_sp/dlogM_err [h^3/cMpc^3](8)",
+		"100 1e+10 1e+11 1 0.1 0.1 2 0.2 0.141421",
+		"100 1e+11 1e+12 1 0.1 0.1 0   0        0",
+	}
+	if !stringSlicesEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q.", expected, lines)
+	}
+}
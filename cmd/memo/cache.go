@@ -0,0 +1,111 @@
+package memo
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+// CacheKind is the type of a file in MemoDir.
+type CacheKind int
+
+const (
+	// HeaderFile is a memoized set of snapshot headers.
+	HeaderFile CacheKind = iota
+	// HaloFile is a memoized halo catalog, or its short version.
+	HaloFile
+	// OtherFile is any other file, including memo.config.
+	OtherFile
+)
+
+// CacheFile is a single file in MemoDir.
+type CacheFile struct {
+	Path  string
+	Snap  int // -1 if the file doesn't belong to a snapshot.
+	Kind  CacheKind
+	Bytes int64
+}
+
+// CacheFiles returns every file in memoDir, sorted by path.
+func CacheFiles(memoDir string) ([]CacheFile, error) {
+	files := []CacheFile{}
+	err := filepath.Walk(memoDir, func(
+		name string, info os.FileInfo, err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(memoDir, name)
+		if err != nil {
+			return err
+		}
+		snap, kind := classifyCacheFile(filepath.ToSlash(rel))
+		files = append(files, CacheFile{name, snap, kind, info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+// classifyCacheFile returns the snapshot and kind of a file in MemoDir from
+// its path relative to MemoDir. Files written both with and without keys are
+// recognized, and lock and temporary files have the same kind as the file
+// they belong to.
+func classifyCacheFile(rel string) (snap int, kind CacheKind) {
+	rel = unkeyedFile(BasePath(rel))
+	if matchSnapFile(rel, headerMemoFile, &snap) {
+		return snap, HeaderFile
+	}
+
+	dir, base := path.Split(rel)
+	if dir == rockstarMemoDir+"/" {
+		if matchSnapFile(base, rockstarMemoFile, &snap) ||
+			matchSnapFile(base, rockstarShortMemoFile, &snap) {
+			return snap, HaloFile
+		}
+	}
+	return -1, OtherFile
+}
+
+// matchSnapFile returns true if name was created by applying format to a
+// single snapshot index and writes that index to snap.
+func matchSnapFile(name, format string, snap *int) bool {
+	var s int
+	if _, err := fmt.Sscanf(name, format, &s); err != nil {
+		return false
+	}
+	if fmt.Sprintf(format, s) != name {
+		return false
+	}
+	*snap = s
+	return true
+}
+
+// RemoveCacheFiles deletes the given files from MemoDir and clears any copies
+// of them which are cached in memory.
+func RemoveCacheFiles(files []CacheFile) error {
+	for _, f := range files {
+		if err := os.Remove(f.Path); err != nil {
+			return err
+		}
+	}
+
+	cache.Lock()
+	cache.headers = map[string][]io.Header{}
+	cache.rockstar = map[string]rockstarCols{}
+	cache.Unlock()
+	return nil
+}
@@ -0,0 +1,77 @@
+package memo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestClassifyCacheFile(t *testing.T) {
+	tests := []struct {
+		rel  string
+		snap int
+		kind CacheKind
+	}{
+		{"hd_snap12.dat", 12, HeaderFile},
+		{"rockstar/halo_100.dat", 100, HaloFile},
+		{"rockstar/halo_short_7.dat", 7, HaloFile},
+		{"memo.config", -1, OtherFile},
+		{"halo_100.dat", -1, OtherFile},
+		{"rockstar/halo_100.dat.bak", -1, OtherFile},
+		{"hd_snap12x.dat", -1, OtherFile},
+		{"hd_snap12_00ff00ff00ff00ff.dat", 12, HeaderFile},
+		{"rockstar/halo_short_7_0123456789abcdef.dat", 7, HaloFile},
+		{"rockstar/halo_7_0123456789abcdef0.dat", -1, OtherFile},
+		{"rockstar/halo_7_0123456789abcdef.dat.lock", 7, HaloFile},
+		{"hd_snap3.dat.tmp98765", 3, HeaderFile},
+	}
+
+	for i, test := range tests {
+		snap, kind := classifyCacheFile(test.rel)
+		if snap != test.snap || kind != test.kind {
+			t.Errorf("%d) Expected %s to be (%d, %d), got (%d, %d).",
+				i, test.rel, test.snap, test.kind, snap, kind)
+		}
+	}
+}
+
+func TestCacheFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memo_cache")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(path.Join(dir, rockstarMemoDir), 0755); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	names := []string{"hd_snap3.dat", "memo.config", "rockstar/halo_3.dat"}
+	for i, name := range names {
+		data := make([]byte, 10*(i+1))
+		if err := ioutil.WriteFile(path.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+
+	files, err := CacheFiles(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 files, got %d.", len(files))
+	}
+	for i, f := range files {
+		if f.Path != path.Join(dir, names[i]) || f.Bytes != int64(10*(i+1)) {
+			t.Errorf("Expected file %d to be %s with %d bytes, got %+v.",
+				i, names[i], 10*(i+1), f)
+		}
+	}
+
+	if err := RemoveCacheFiles(files[:1]); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if files, _ = CacheFiles(dir); len(files) != 2 {
+		t.Errorf("Expected 2 files after removing one, got %d.", len(files))
+	}
+}
@@ -0,0 +1,186 @@
+package memo
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/phil-mansfield/shellfish/logging"
+)
+
+// Compression controls whether memoized binaries are compressed when they're
+// written. Files can be read regardless of how it's set.
+var Compression = false
+
+// Memoized binaries start with a fileHeader which records how the rest of the
+// file is stored and a checksum of its contents, so that damaged files are
+// detected and recreated instead of being read.
+
+const (
+	fileMagic      = "SFMEMO01"
+	flagCompressed = 1 << 0
+)
+
+// fileHeader is the header at the start of every memoized binary.
+type fileHeader struct {
+	Magic    [8]byte
+	Flags    uint32
+	Checksum uint32 // CRC-32 (IEEE) of the uncompressed contents.
+	Bytes    int64  // Length of the uncompressed contents.
+}
+
+// corruptFileError is returned when a memoized binary doesn't match its
+// header.
+type corruptFileError struct {
+	fname, reason string
+}
+
+func (err *corruptFileError) Error() string {
+	return fmt.Sprintf("The memoized file %s is corrupted: %s.",
+		err.fname, err.reason)
+}
+
+// loadMemoFile returns the contents of the memoized binary fname, calling
+// write to create it if it doesn't exist. write is given the name of a file
+// to write the uncompressed contents to. If fname is corrupted, it's deleted
+// and created again.
+func loadMemoFile(fname string, write func(raw string) error) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		err := CreateOnce(fname, func(tmp string) error {
+			return writeMemoFile(tmp, fname, write)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := readMemoFile(fname)
+		if _, ok := err.(*corruptFileError); ok && attempt == 0 {
+			if logging.Mode == logging.Debug {
+				log.Printf("%s Recreating it.", err.Error())
+			}
+			if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		return data, err
+	}
+}
+
+// writeMemoFile calls write to create the uncompressed contents of the
+// memoized binary fname and writes them to out along with a fileHeader.
+func writeMemoFile(out, fname string, write func(raw string) error) error {
+	raw, err := tempFile(fname)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(raw)
+	if err := write(raw); err != nil {
+		return err
+	}
+
+	rf, err := os.Open(raw)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	err = encodeMemoFile(f, rf, Compression)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// encodeMemoFile writes the contents of r to f as a memoized binary. The
+// header is written last, once the checksum is known.
+func encodeMemoFile(f io.WriteSeeker, r io.Reader, compress bool) error {
+	hd := fileHeader{}
+	copy(hd.Magic[:], fileMagic)
+	if compress {
+		hd.Flags |= flagCompressed
+	}
+	if err := binary.Write(f, binary.LittleEndian, &hd); err != nil {
+		return err
+	}
+
+	h := crc32.NewIEEE()
+	var w io.Writer = f
+	var fw *flate.Writer
+	if compress {
+		var err error
+		if fw, err = flate.NewWriter(f, flate.DefaultCompression); err != nil {
+			return err
+		}
+		w = fw
+	}
+
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return err
+	}
+	if fw != nil {
+		if err := fw.Close(); err != nil {
+			return err
+		}
+	}
+
+	hd.Checksum, hd.Bytes = h.Sum32(), n
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(f, binary.LittleEndian, &hd)
+}
+
+// readMemoFile returns the uncompressed contents of the memoized binary
+// fname, after checking them against its header.
+func readMemoFile(fname string) ([]byte, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeMemoFile(f, fname)
+}
+
+// decodeMemoFile is readMemoFile for the contents of an open file.
+func decodeMemoFile(r io.Reader, fname string) ([]byte, error) {
+	hd := fileHeader{}
+	if err := binary.Read(r, binary.LittleEndian, &hd); err != nil {
+		return nil, &corruptFileError{fname, "its header is incomplete"}
+	}
+	if string(hd.Magic[:]) != fileMagic {
+		return nil, &corruptFileError{fname, "it doesn't have a header"}
+	}
+
+	if hd.Flags&flagCompressed != 0 {
+		r = flate.NewReader(r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		// Errors from the decompressor mean the stream was damaged.
+		if hd.Flags&flagCompressed != 0 {
+			return nil, &corruptFileError{fname, err.Error()}
+		}
+		return nil, err
+	}
+
+	if int64(len(data)) != hd.Bytes {
+		return nil, &corruptFileError{fname, fmt.Sprintf(
+			"it contains %d bytes instead of %d", len(data), hd.Bytes,
+		)}
+	}
+	if crc32.ChecksumIEEE(data) != hd.Checksum {
+		return nil, &corruptFileError{fname, "its checksum doesn't match"}
+	}
+	return data, nil
+}
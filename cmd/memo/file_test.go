@@ -0,0 +1,103 @@
+package memo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMemoFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memo_file")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("shellfish"), 1000)
+	write := func(raw string) error {
+		return ioutil.WriteFile(raw, data, 0644)
+	}
+
+	defer func(c bool) { Compression = c }(Compression)
+	for i, compress := range []bool{false, true} {
+		Compression = compress
+		fname := path.Join(dir, "halo_3.dat")
+
+		out, err := loadMemoFile(fname, write)
+		if err != nil {
+			t.Fatalf("%d) Unexpected error: %s", i, err.Error())
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%d) Contents of %s changed after being written.",
+				i, fname)
+		}
+
+		info, err := os.Stat(fname)
+		if err != nil {
+			t.Fatalf("%d) Unexpected error: %s", i, err.Error())
+		}
+		if compress != (info.Size() < int64(len(data))) {
+			t.Errorf("%d) Expected compression to be %v, but the file has "+
+				"%d bytes.", i, compress, info.Size())
+		}
+		os.Remove(fname)
+	}
+}
+
+func TestMemoFileCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memo_file")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, 1000)
+	writes := 0
+	write := func(raw string) error {
+		writes++
+		return ioutil.WriteFile(raw, data, 0644)
+	}
+	fname := path.Join(dir, "hd_snap3.dat")
+	if _, err := loadMemoFile(fname, write); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	good, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	flipped := append([]byte{}, good...)
+	flipped[len(flipped)/2]++
+	tests := []struct {
+		name     string
+		contents []byte
+	}{
+		{"truncated", good[:len(good)/2]},
+		{"short header", good[:10]},
+		{"no header", data},
+		{"flipped", flipped},
+	}
+
+	for i, test := range tests {
+		err := ioutil.WriteFile(fname, test.contents, 0644)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		_, err = readMemoFile(fname)
+		if _, ok := err.(*corruptFileError); !ok {
+			t.Errorf("%d) Expected the %s file to be corrupted, got error %v.",
+				i, test.name, err)
+		}
+
+		writes = 0
+		out, err := loadMemoFile(fname, write)
+		if err != nil {
+			t.Fatalf("%d) Unexpected error: %s", i, err.Error())
+		}
+		if writes != 1 || !bytes.Equal(out, data) {
+			t.Errorf("%d) Expected the %s file to be recreated.", i, test.name)
+		}
+	}
+}
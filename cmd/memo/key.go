@@ -0,0 +1,77 @@
+package memo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/version"
+)
+
+// Memoized files are keyed on a hash of everything that their contents depend
+// on, so that switching to a different catalog, changing how its columns are
+// read, or upgrading Shellfish makes Shellfish write new files instead of
+// reading stale ones. Files written before keys were added are never read.
+
+// keyedFileRegexp matches the key at the end of a memoized file's name.
+var keyedFileRegexp = regexp.MustCompile(`^(.*)_[0-9a-f]{16}\.dat$`)
+
+// configKey returns a hash of the given fields.
+func configKey(fields ...string) uint64 {
+	h := fnv.New64a()
+	for _, field := range fields {
+		// The length prefix keeps ("ab", "c") and ("a", "bc") distinct.
+		fmt.Fprintf(h, "%d:%s;", len(field), field)
+	}
+	return h.Sum64()
+}
+
+// headerKey returns the key of the memoized headers of the given snapshot.
+func headerKey(snap int, e *env.Environment) uint64 {
+	fields := []string{
+		version.SourceVersion, fmt.Sprint(e.CatalogType),
+		fmt.Sprint(e.Blocks()),
+	}
+	for i := 0; i < e.Blocks(); i++ {
+		fields = append(fields, e.ParticleCatalog(snap, i))
+	}
+	return configKey(fields...)
+}
+
+// haloKey returns the key of the memoized halo catalog of the given snapshot.
+func haloKey(snap int, vars *halo.VarColumns, e *env.Environment) uint64 {
+	fields := []string{
+		version.SourceVersion, fmt.Sprint(e.HaloType), e.HaloCatalog(snap),
+		fmt.Sprintf("%016x", headerKey(snap, e)),
+	}
+	return configKey(append(fields, varsKeyFields(vars)...)...)
+}
+
+// varsKeyFields returns the fields of vars which change the contents of a
+// memoized halo catalog.
+func varsKeyFields(vars *halo.VarColumns) []string {
+	return []string{
+		strings.Join(vars.Names, ","), fmt.Sprint(vars.Columns),
+		strings.Join(vars.Generator, ","), vars.RadiusUnits,
+		vars.Filter.String(), strings.Join(vars.Fields, ","),
+	}
+}
+
+// keyedFile returns the name of the memoized file with the given format,
+// snapshot, and key.
+func keyedFile(format string, snap int, key uint64) string {
+	name := strings.TrimSuffix(fmt.Sprintf(format, snap), ".dat")
+	return fmt.Sprintf("%s_%016x.dat", name, key)
+}
+
+// unkeyedFile removes the key from the name of a memoized file. Names without
+// keys are returned unchanged.
+func unkeyedFile(name string) string {
+	if m := keyedFileRegexp.FindStringSubmatch(name); m != nil {
+		return m[1] + ".dat"
+	}
+	return name
+}
@@ -0,0 +1,47 @@
+package memo
+
+import (
+	"testing"
+)
+
+func TestConfigKey(t *testing.T) {
+	if configKey("a", "b") != configKey("a", "b") {
+		t.Errorf("Expected equal fields to have equal keys.")
+	}
+	if configKey("ab", "c") == configKey("a", "bc") {
+		t.Errorf("Expected fields split differently to have different keys.")
+	}
+	if configKey("a") == configKey("a", "") {
+		t.Errorf("Expected an empty field to change the key.")
+	}
+}
+
+func TestKeyedFile(t *testing.T) {
+	tests := []struct {
+		format      string
+		snap        int
+		key         uint64
+		name, unkey string
+	}{
+		{headerMemoFile, 12, 0xff, "hd_snap12_00000000000000ff.dat",
+			"hd_snap12.dat"},
+		{rockstarShortMemoFile, 7, 0x0123456789abcdef,
+			"halo_short_7_0123456789abcdef.dat", "halo_short_7.dat"},
+	}
+
+	for i, test := range tests {
+		name := keyedFile(test.format, test.snap, test.key)
+		if name != test.name {
+			t.Errorf("%d) Expected keyedFile to return %s, got %s.",
+				i, test.name, name)
+		}
+		if unkey := unkeyedFile(name); unkey != test.unkey {
+			t.Errorf("%d) Expected unkeyedFile(%s) to return %s, got %s.",
+				i, name, test.unkey, unkey)
+		}
+		if unkeyedFile(test.unkey) != test.unkey {
+			t.Errorf("%d) Expected %s to be unchanged by unkeyedFile.",
+				i, test.unkey)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package memo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+)
+
+// Multiple Shellfish processes (e.g. the tasks of a job array) can share a
+// MemoDir. Memoized files are written to temporary files and renamed into
+// place, so they never see each other's partially-written files, and each file
+// has an advisory lock so that only one process does the work of creating it.
+
+const (
+	lockSuffix = ".lock"
+	tempSuffix = ".tmp"
+	// fileMode is the permissions of memoized files. Temporary files are
+	// only readable by their owner, so they're changed to this before
+	// they're renamed.
+	fileMode = 0644
+)
+
+// sharedFileRegexp matches the suffixes of lock and temporary files.
+var sharedFileRegexp = regexp.MustCompile(`^(.*)(\.lock|\.tmp\d+)$`)
+
+// CreateOnce makes sure that the file fname exists, calling write to create it
+// if it doesn't. write is given the name of a temporary file in the same
+// directory, which is renamed to fname after write returns.
+func CreateOnce(fname string, write func(tmp string) error) error {
+	if _, err := os.Stat(fname); err == nil {
+		return nil
+	}
+
+	unlock, err := lockFile(fname + lockSuffix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Another process might have created the file while this one waited
+	// for the lock.
+	if _, err := os.Stat(fname); err == nil {
+		return nil
+	}
+
+	tmp, err := tempFile(fname)
+	if err != nil {
+		return err
+	}
+	if err := write(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, fileMode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// tempFile creates an empty temporary file in the same directory as fname and
+// returns its name.
+func tempFile(fname string) (string, error) {
+	dir, base := path.Split(fname)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, base+tempSuffix)
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// BasePath returns the path of the file that a lock or temporary file belongs
+// to. Other paths are returned unchanged.
+func BasePath(p string) string {
+	if m := sharedFileRegexp.FindStringSubmatch(p); m != nil {
+		return m[1]
+	}
+	return p
+}
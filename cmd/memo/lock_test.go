@@ -0,0 +1,93 @@
+package memo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCreateOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memo_lock")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	fname := path.Join(dir, "hd_snap3.dat")
+	data := make([]byte, 1<<16)
+	writes := int32(0)
+
+	wg := &sync.WaitGroup{}
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = CreateOnce(fname, func(tmp string) error {
+				atomic.AddInt32(&writes, 1)
+				return ioutil.WriteFile(tmp, data, 0644)
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range errs {
+		if errs[i] != nil {
+			t.Fatalf("Unexpected error: %s", errs[i].Error())
+		}
+	}
+	if writes != 1 {
+		t.Errorf("Expected the file to be written once, got %d.", writes)
+	}
+	if b, err := ioutil.ReadFile(fname); err != nil || len(b) != len(data) {
+		t.Errorf("Expected %d bytes in %s, got %d.", len(data), fname, len(b))
+	}
+	if info, err := os.Stat(fname); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	} else if info.Mode().Perm() != fileMode {
+		t.Errorf("Expected %s to have permissions %o, got %o.", fname,
+			fileMode, info.Mode().Perm())
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for _, info := range infos {
+		if BasePath(path.Join(dir, info.Name())) != fname {
+			t.Errorf("Unexpected file %s.", info.Name())
+		}
+	}
+
+	failed := path.Join(dir, "failed.dat")
+	err = CreateOnce(failed, func(tmp string) error {
+		return fmt.Errorf("Failed.")
+	})
+	if err == nil {
+		t.Errorf("Expected an error from a failed write.")
+	}
+	if _, err := os.Stat(failed); err == nil {
+		t.Errorf("Expected %s to not exist after a failed write.", failed)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	tests := []struct {
+		p, base string
+	}{
+		{"dir/memo.config", "dir/memo.config"},
+		{"dir/memo.config.lock", "dir/memo.config"},
+		{"rockstar/halo_3.dat.tmp123456", "rockstar/halo_3.dat"},
+		{"halo_3.dat.tmp", "halo_3.dat.tmp"},
+	}
+	for i := range tests {
+		if base := BasePath(tests[i].p); base != tests[i].base {
+			t.Errorf("%d) Expected BasePath(%s) = %s, got %s.",
+				i, tests[i].p, tests[i].base, base)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package memo
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile blocks until it holds an exclusive advisory lock on the file
+// fname, creating it if needed, and returns a function which releases the
+// lock. Some network filesystems don't support locks, in which case no lock is
+// taken.
+func lockFile(fname string) (unlock func(), err error) {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	switch err {
+	case nil:
+	case syscall.ENOLCK, syscall.EOPNOTSUPP:
+		f.Close()
+		return func() {}, nil
+	default:
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -2,11 +2,13 @@
 package memo
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"os"
 	"path"
 	"sort"
+	"sync"
 	
 	"github.com/phil-mansfield/shellfish/cmd/env"
 
@@ -24,6 +26,66 @@ const (
 	headerMemoFile = "hd_snap%d.dat"
 )
 
+// Caching keeps memoized headers and halo catalogs in memory after they're
+// first read, so that long-running modes (like serve) don't re-read them from
+// MemoDir for every request. Cached values are copied before they're
+// returned, so callers can still modify them.
+var Caching = false
+
+var cache = struct {
+	sync.Mutex
+	headers  map[string][]io.Header
+	rockstar map[string]rockstarCols
+}{
+	headers:  map[string][]io.Header{},
+	rockstar: map[string]rockstarCols{},
+}
+
+// rockstarCols are the contents of a binary halo catalog.
+type rockstarCols struct {
+	ids  []int
+	cols [][]float64
+}
+
+// readBinaryRockstar reads a binary halo catalog, using the cache if Caching
+// is true. write is used to create the catalog if it doesn't exist.
+func readBinaryRockstar(
+	binFile string, vars *halo.VarColumns, write func(raw string) error,
+) ([]int, [][]float64, error) {
+	if !Caching {
+		return loadBinaryRockstar(binFile, vars, write)
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	rc, ok := cache.rockstar[binFile]
+	if !ok {
+		ids, cols, err := loadBinaryRockstar(binFile, vars, write)
+		if err != nil {
+			return nil, nil, err
+		}
+		rc = rockstarCols{ids, cols}
+		cache.rockstar[binFile] = rc
+	}
+
+	cols := make([][]float64, len(rc.cols))
+	for i := range cols {
+		cols[i] = append([]float64{}, rc.cols[i]...)
+	}
+	return append([]int{}, rc.ids...), cols, nil
+}
+
+// loadBinaryRockstar is readBinaryRockstar without any caching.
+func loadBinaryRockstar(
+	binFile string, vars *halo.VarColumns, write func(raw string) error,
+) ([]int, [][]float64, error) {
+	data, err := loadMemoFile(binFile, write)
+	if err != nil {
+		return nil, nil, err
+	}
+	return halo.ReadBinaryRockstarBytes(data, vars)
+}
+
 // ReadSortedRockstarIDs returns a slice of IDs corresponding to the highest
 // values of some quantity in a particular snapshot. maxID is the number of
 // halos to return.
@@ -38,11 +100,8 @@ func ReadSortedRockstarIDs(
 	cosmo := &hds[0].Cosmo
 
 	dir := path.Join(e.MemoDir, rockstarMemoDir)
-	if _, err := os.Stat(dir); err != nil {
-		err = os.Mkdir(dir, 0777)
-		if err != nil {
-			return nil, err
-		}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
 	}
 
 	var (
@@ -51,8 +110,12 @@ func ReadSortedRockstarIDs(
 		ms  []float64
 	)
 
-	if maxID >= rockstarShortMemoNum || maxID == -1 {
-		file := path.Join(dir, fmt.Sprintf(rockstarMemoFile, snap))
+	// The short memo file only contains the largest halos by M200m, so it
+	// can't be used to rank halos by anything else.
+	if maxID >= rockstarShortMemoNum || maxID == -1 || valName != "M200m" {
+		file := path.Join(
+			dir, keyedFile(rockstarMemoFile, snap, haloKey(snap, vars, e)),
+		)
 		ids, vals, err = readRockstar(
 			file, []string{valName}, -1, snap, nil, vars, buf, e, cosmo,
 		)
@@ -61,7 +124,9 @@ func ReadSortedRockstarIDs(
 		}
 		ms = vals[0]
 	} else {
-		file := path.Join(dir, fmt.Sprintf(rockstarShortMemoFile, snap))
+		file := path.Join(dir, keyedFile(
+			rockstarShortMemoFile, snap, haloKey(snap, vars, e),
+		))
 		ids, vals, err = readRockstar(
 			file, []string{valName}, rockstarShortMemoNum,
 			snap, nil, vars, buf, e, cosmo,
@@ -72,9 +137,11 @@ func ReadSortedRockstarIDs(
 		ms = vals[0]
 	}
 
-	if len(ids) < maxID {
+	if maxID >= len(ids) {
 		return nil, fmt.Errorf(
-			"ID %d too large for snapshot %d", maxID, snap,
+			"ID %d is too large for snapshot %d, which only has %d "+
+				"halos. Valid IDs are between 0 and %d.",
+			maxID, snap, len(ids), len(ids)-1,
 		)
 	}
 
@@ -118,15 +185,13 @@ func ReadRockstar(
 
 	// Find binFile.
 	dir := path.Join(e.MemoDir, rockstarMemoDir)
-	if _, err := os.Stat(dir); err != nil {
-		err = os.Mkdir(dir, 0777)
-		if err != nil {
-			return nil, nil, err
-		}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, nil, err
 	}
 
-	binFile := path.Join(dir, fmt.Sprintf(rockstarMemoFile, snap))
-	shortBinFile := path.Join(dir, fmt.Sprintf(rockstarShortMemoFile, snap))
+	key := haloKey(snap, vars, e)
+	binFile := path.Join(dir, keyedFile(rockstarMemoFile, snap, key))
+	shortBinFile := path.Join(dir, keyedFile(rockstarShortMemoFile, snap, key))
 
 	// This wastes a read the first time it's called. You need to decide if you
 	// care. (Answer: probably not.)
@@ -161,26 +226,19 @@ func readRockstar(
 	}
 	hd := &hds[0]
 
-	// If binFile doesn't exist, create it.
-	if _, err := os.Stat(binFile); err != nil {
+	// Used if binFile doesn't exist.
+	write := func(raw string) error {
 		if n == -1 {
-			err = halo.RockstarConvert(
-				e.HaloCatalog(snap), binFile, vars, &hd.Cosmo,
-			)
-			if err != nil {
-				return nil, nil, err
-			}
-		} else {
-			err = halo.RockstarConvertTopN(
-				e.HaloCatalog(snap), binFile, n, vars, &hd.Cosmo,
+			return halo.RockstarConvert(
+				e.HaloCatalog(snap), raw, vars, &hd.Cosmo,
 			)
-			if err != nil {
-				return nil, nil, err
-			}
 		}
+		return halo.RockstarConvertTopN(
+			e.HaloCatalog(snap), raw, n, vars, &hd.Cosmo,
+		)
 	}
 
-	rids, rawCols, err := halo.ReadBinaryRockstar(binFile, vars)
+	rids, rawCols, err := readBinaryRockstar(binFile, vars, write)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -260,43 +318,73 @@ func readUnmemoizedHeaders(
 func ReadHeaders(
 	snap int, buf io.VectorBuffer, e *env.Environment,
 ) ([]io.Header, []string, error) {
-	if _, err := os.Stat(e.MemoDir); err != nil {
-		return nil, nil, err
+	if !Caching {
+		return readHeaders(snap, buf, e)
 	}
-	memoFile := path.Join(e.MemoDir, fmt.Sprintf(headerMemoFile, snap))
 
-	if _, err := os.Stat(memoFile); err != nil {
-		// File not written yet.
-		hds, files, err := readUnmemoizedHeaders(snap, buf, e)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		f, err := os.Create(memoFile)
+	key := path.Join(
+		e.MemoDir, keyedFile(headerMemoFile, snap, headerKey(snap, e)),
+	)
+	cache.Lock()
+	defer cache.Unlock()
+	hds, ok := cache.headers[key]
+	if !ok {
+		var err error
+		hds, _, err = readHeaders(snap, buf, e)
 		if err != nil {
 			return nil, nil, err
 		}
-		defer f.Close()
+		cache.headers[key] = hds
+	}
 
-		binary.Write(f, binary.LittleEndian, hds)
+	files := make([]string, e.Blocks())
+	for i := range files {
+		files[i] = e.ParticleCatalog(snap, i)
+	}
+	return append([]io.Header{}, hds...), files, nil
+}
 
-		return hds, files, nil
-	} else {
-		// File exists: read from it instead.
+// readHeaders is ReadHeaders without any caching.
+func readHeaders(
+	snap int, buf io.VectorBuffer, e *env.Environment,
+) ([]io.Header, []string, error) {
+	if _, err := os.Stat(e.MemoDir); err != nil {
+		return nil, nil, err
+	}
+	memoFile := path.Join(
+		e.MemoDir, keyedFile(headerMemoFile, snap, headerKey(snap, e)),
+	)
 
-		f, err := os.Open(memoFile)
+	// Write the file if it doesn't exist yet.
+	data, err := loadMemoFile(memoFile, func(raw string) error {
+		hds, _, err := readUnmemoizedHeaders(snap, buf, e)
 		if err != nil {
-			return nil, nil, err
+			return err
 		}
-		defer f.Close()
 
-		hds := make([]io.Header, e.Blocks())
-		binary.Read(f, binary.LittleEndian, hds)
-		files := make([]string, e.Blocks())
-		for i := range files {
-			files[i] = e.ParticleCatalog(snap, i)
+		f, err := os.Create(raw)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(f, binary.LittleEndian, hds); err != nil {
+			f.Close()
+			return err
 		}
+		return f.Close()
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-		return hds, files, nil
+	hds := make([]io.Header, e.Blocks())
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, hds)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make([]string, e.Blocks())
+	for i := range files {
+		files[i] = e.ParticleCatalog(snap, i)
 	}
+
+	return hds, files, nil
 }
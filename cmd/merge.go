@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// MergeConfig contains the configuration fields for the 'merge' mode of the
+// shellfish tool.
+type MergeConfig struct {
+	files       []string
+	deduplicate bool
+}
+
+var _ Mode = &MergeConfig{}
+
+// ExampleConfig creates an example merge.config file.
+func (config *MergeConfig) ExampleConfig() string {
+	return `[merge.config]
+
+#####################
+## Required Fields ##
+#####################
+
+# Files is a list of the catalogs that are merged, usually the outputs of the
+# shards of a run that used the --Shard flag. Glob patterns like * are
+# expanded, and the files that a pattern matches are merged in sorted order.
+Files = stats.shard*.txt
+
+#####################
+## Optional Fields ##
+#####################
+
+# Deduplicate removes every row which is identical to an earlier row. This
+# cleans up merges where some shards were run more than once. Defaults to
+# true.
+# Deduplicate = true`
+}
+
+// ReadConfig reads in a merge.config file into config.
+func (config *MergeConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("merge.config")
+	vars.Strings(&config.files, "Files", []string{})
+	vars.Bool(&config.deduplicate, "Deduplicate", true)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *MergeConfig) validate() error {
+	if len(config.files) == 0 {
+		return fmt.Errorf("The variable 'Files' was not set.")
+	}
+	return nil
+}
+
+// Run executes the merge mode of the shellfish tool.
+func (config *MergeConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#####################
+## shellfish merge ##
+#####################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	fnames, err := config.expandFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	texts := make([][]byte, len(fnames))
+	for i := range fnames {
+		texts[i], err = ioutil.ReadFile(fnames[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lines, err := mergeShards(fnames, texts, config.deduplicate)
+	if err != nil {
+		return nil, err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return lines, nil
+}
+
+// expandFiles expands the glob patterns in Files.
+func (config *MergeConfig) expandFiles() ([]string, error) {
+	fnames := []string{}
+	for _, pattern := range config.files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		} else if len(matches) == 0 {
+			return nil, fmt.Errorf("No files match '%s' in 'Files'.", pattern)
+		}
+		sort.Strings(matches)
+		fnames = append(fnames, matches...)
+	}
+	return fnames, nil
+}
+
+// mergeShards concatenates the rows of several catalogs, which must all have
+// the same comment lines. The comment lines are written once at the top. If
+// deduplicate is true, rows which are identical to earlier rows are removed.
+func mergeShards(
+	fnames []string, texts [][]byte, deduplicate bool,
+) ([]string, error) {
+	var header []string
+	rows, seen := []string{}, map[string]bool{}
+	for i, text := range texts {
+		fHeader := []string{}
+		for _, line := range bytes.Split(text, []byte{'\n'}) {
+			trimmed := bytes.TrimSpace(line)
+			if len(trimmed) == 0 {
+				continue
+			} else if trimmed[0] == '#' {
+				fHeader = append(fHeader, string(line))
+				continue
+			} else if bytes.HasPrefix(trimmed, []byte("Shellfish")) {
+				return nil, fmt.Errorf("The shard %s ended with the error "+
+					"'%s', so it can't be merged.", fnames[i], trimmed)
+			}
+
+			row := string(line)
+			if deduplicate && seen[row] {
+				continue
+			}
+			seen[row] = true
+			rows = append(rows, row)
+		}
+
+		// Shards with no rows (e.g. "No input IDs.") don't have headers.
+		if len(fHeader) == 0 {
+			continue
+		} else if header == nil {
+			header = fHeader
+		} else if !stringSlicesEqual(header, fHeader) {
+			return nil, fmt.Errorf("The header of %s doesn't match the "+
+				"header of the earlier files, so the catalogs can't be "+
+				"merged.", fnames[i])
+		}
+	}
+
+	return append(header, rows...), nil
+}
+
+func stringSlicesEqual(xs, ys []string) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestMergeShards(t *testing.T) {
+	fnames := []string{"a.txt", "b.txt", "c.txt"}
+	texts := [][]byte{
+		[]byte("# Column contents: ID(0)\n1 1.5\n2 2.5\n"),
+		[]byte(""),
+		[]byte("# Column contents: ID(0)\n3 3.5\n1 1.5\n"),
+	}
+
+	lines, err := mergeShards(fnames, texts, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := []string{"# Column contents: ID(0)", "1 1.5", "2 2.5", "3 3.5"}
+	if !stringSlicesEqual(lines, expected) {
+		t.Errorf("Expected %v, got %v.", expected, lines)
+	}
+
+	lines, err = mergeShards(fnames, texts, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected = append(expected, "1 1.5")
+	if !stringSlicesEqual(lines, expected) {
+		t.Errorf("Expected %v, got %v.", expected, lines)
+	}
+
+	texts[2] = []byte("# Column contents: ID(0) X(1)\n3 3.5\n")
+	if _, err = mergeShards(fnames, texts, true); err == nil {
+		t.Errorf("Expected an error for mismatched headers.")
+	}
+
+	texts[2] = []byte("Shellfish terminating.\n")
+	if _, err = mergeShards(fnames, texts, true); err == nil {
+		t.Errorf("Expected an error for a failed shard.")
+	}
+}
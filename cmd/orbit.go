@@ -0,0 +1,429 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/los/geom"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// OrbitConfig contains the configuration fields for the 'orbit' mode of the
+// shellfish tool.
+type OrbitConfig struct {
+	trackRadiusMult     float64
+	searchRadiusMult    float64
+	apocenterPercentile float64
+}
+
+var _ Mode = &OrbitConfig{}
+
+// ExampleConfig creates an example orbit.config file.
+func (config *OrbitConfig) ExampleConfig() string {
+	return `[orbit.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The orbit tool measures the splashback radius from particle orbits instead
+# of from the density field. The particles around each input halo are
+# followed along the halo's main branch from SnapMin to the halo's
+# snapshot. Each particle's first pericenter is found, followed by the
+# apocenter after it, and the splashback radius is a percentile of the
+# distribution of these apocenters. This is a cross-check on the shell
+# method and is far more expensive, since every snapshot has to be read.
+
+# TrackRadiusMult sets which particles are tracked: those within
+# TrackRadiusMult*R200m of the halo at its final snapshot. Defaults to 2.
+#
+# TrackRadiusMult = 2
+
+# SearchRadiusMult is the radius, in units of R200m, around the halo's main
+# progenitor that tracked particles are looked for in each snapshot. Particles
+# further away than this are assumed to be infalling. Must be at least as
+# large as TrackRadiusMult. Defaults to 4.
+#
+# SearchRadiusMult = 4
+
+# ApocenterPercentile is the percentile of the apocenter distribution
+# which is used as the splashback radius. Defaults to 75.
+#
+# ApocenterPercentile = 75`
+}
+
+// ReadConfig reads in an orbit.config file into config.
+func (config *OrbitConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("orbit.config")
+	vars.Float(&config.trackRadiusMult, "TrackRadiusMult", 2)
+	vars.Float(&config.searchRadiusMult, "SearchRadiusMult", 4)
+	vars.Float(&config.apocenterPercentile, "ApocenterPercentile", 75)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *OrbitConfig) validate() error {
+	if config.trackRadiusMult <= 0 {
+		return fmt.Errorf("The 'TrackRadiusMult' variable is set to %g, "+
+			"but it needs to be positive.", config.trackRadiusMult)
+	}
+	if config.searchRadiusMult < config.trackRadiusMult {
+		return fmt.Errorf("The 'SearchRadiusMult' variable is set to %g, "+
+			"but it can't be smaller than 'TrackRadiusMult', %g.",
+			config.searchRadiusMult, config.trackRadiusMult)
+	}
+	if config.apocenterPercentile < 0 || config.apocenterPercentile > 100 {
+		return fmt.Errorf("The 'ApocenterPercentile' variable is set to "+
+			"%g, but it must be between 0 and 100.",
+			config.apocenterPercentile)
+	}
+	return nil
+}
+
+// orbitBranch is the main branch of a single input halo.
+type orbitBranch struct {
+	ids, snaps     []int
+	xs, ys, zs, rs []float64
+}
+
+// Run executes the orbit mode of the shellfish tool.
+func (config *OrbitConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#####################
+## shellfish orbit ##
+#####################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, _, err := catalog.Parse(stdin, []int{0, 1}, []int{})
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	branches, trackers, err := trackOrbits(
+		ids, snaps, config.trackRadiusMult, config.searchRadiusMult,
+		vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rsps := make([]float64, len(ids))
+	ratios := make([]float64, len(ids))
+	counts := make([]int, len(ids))
+	for i := range ids {
+		rsps[i], ratios[i] = math.NaN(), math.NaN()
+		if trackers[i] == nil {
+			continue
+		}
+		apo := trackers[i].Apocenters()
+		counts[i] = len(apo)
+		if len(apo) == 0 {
+			continue
+		}
+		b := branches[i]
+		ratios[i] = percentile(apo, config.apocenterPercentile)
+		rsps[i] = ratios[i] * b.rs[len(b.rs)-1]
+	}
+
+	order := []int{0, 1, 3, 4, 2}
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps, counts}, [][]float64{rsps, ratios}, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot", "Apocenters"},
+		[]string{"R_sp [cMpc/h]", "R_sp/R200m"},
+		order, []int{1, 1, 1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
+
+// trackOrbits follows the particles within trackMult*R200m of each input
+// halo along the halo's main branch from SnapMin to the halo's snapshot.
+// Particles are looked for within searchMult*R200m of the main progenitor in
+// each snapshot. Sentinel halos and halos without a branch are given nil
+// branches and trackers.
+func trackOrbits(
+	ids, snaps []int, trackMult, searchMult float64, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, gConfig *GlobalConfig,
+) ([]*orbitBranch, []*halo.OrbitTracker, error) {
+	trackers := make([]*halo.OrbitTracker, len(ids))
+	branches, err := followParticles(
+		ids, snaps, trackMult, searchMult, vars, buf, e, gConfig,
+		func(i int, pIDs []int64) {
+			trackers[i] = halo.NewOrbitTracker(pIDs)
+		},
+		func(i, snap int, pIDs []int64, pRs []float64, r200m float64) {
+			trackers[i].Update(pIDs, pRs, r200m)
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return branches, trackers, nil
+}
+
+// followParticles finds the particles within trackMult*R200m of each input
+// halo and follows them along the halo's main branch from SnapMin to the
+// halo's snapshot. start is called with the IDs of the particles around the
+// i-th halo, and then update is called for every snapshot in its branch, in
+// order, with the IDs and radii of the particles found within
+// searchMult*R200m of the main progenitor. Sentinel halos and halos without a
+// branch are given nil branches and are never passed to start or update.
+func followParticles(
+	ids, snaps []int, trackMult, searchMult float64, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment, gConfig *GlobalConfig,
+	start func(i int, pIDs []int64),
+	update func(i, snap int, pIDs []int64, pRs []float64, r200m float64),
+) ([]*orbitBranch, error) {
+	branches, err := orbitBranches(ids, snaps, vars, buf, e, gConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the tracked particles at each halo's final snapshot.
+	finalSpheres := make([]geom.Sphere, len(ids))
+	for i, b := range branches {
+		if b == nil {
+			continue
+		}
+		n := len(b.snaps) - 1
+		finalSpheres[i] = branchSphere(b, n, trackMult)
+	}
+	snapBins, idxBins := binBySnap(snaps, ids)
+	for snap := range snapBins {
+		if snap == -1 {
+			continue
+		}
+		spheres := make([]geom.Sphere, len(idxBins[snap]))
+		for j, i := range idxBins[snap] {
+			spheres[j] = finalSpheres[i]
+		}
+		pIDs, _, err := sphereParticles(snap, spheres, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range idxBins[snap] {
+			if branches[i] != nil {
+				start(i, pIDs[j])
+			}
+		}
+	}
+
+	// Follow the tracked particles forward in time.
+	for snap := int(gConfig.SnapMin); snap <= int(gConfig.SnapMax); snap++ {
+		idxs, spheres, rs := []int{}, []geom.Sphere{}, []float64{}
+		for i, b := range branches {
+			if b == nil {
+				continue
+			}
+			for j := range b.snaps {
+				if b.snaps[j] == snap {
+					idxs = append(idxs, i)
+					spheres = append(
+						spheres, branchSphere(b, j, searchMult),
+					)
+					rs = append(rs, b.rs[j])
+				}
+			}
+		}
+		if len(idxs) == 0 {
+			continue
+		}
+
+		if logging.Mode == logging.Performance {
+			log.Printf("Tracking %d halos in snapshot %d.", len(idxs), snap)
+		}
+
+		pIDs, pRs, err := sphereParticles(snap, spheres, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range idxs {
+			update(i, snap, pIDs[j], pRs[j], rs[j])
+		}
+	}
+
+	return branches, nil
+}
+
+// orbitBranches returns the main branch of each input halo between SnapMin and
+// the halo's snapshot, along with the positions and radii of each halo in the
+// branch. Sentinel halos are given a nil branch.
+func orbitBranches(
+	ids, snaps []int, vars *halo.VarColumns, buf io.VectorBuffer,
+	e *env.Environment, gConfig *GlobalConfig,
+) ([]*orbitBranch, error) {
+	roots := []int{}
+	for i := range ids {
+		if snaps[i] != -1 {
+			roots = append(roots, ids[i])
+		}
+	}
+
+	trees, err := treeFiles(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	idSets, snapSets, err := haloHistories(trees, roots, gConfig, e)
+	if err != nil {
+		return nil, err
+	}
+
+	branches := make([]*orbitBranch, len(ids))
+	for i, j := 0, 0; i < len(ids); i++ {
+		if snaps[i] == -1 {
+			continue
+		}
+		b := &orbitBranch{}
+		for k := range idSets[j] {
+			snap := snapSets[j][k]
+			if snap >= int(gConfig.SnapMin) && snap <= snaps[i] {
+				b.ids = append(b.ids, idSets[j][k])
+				b.snaps = append(b.snaps, snap)
+			}
+		}
+		j++
+		if len(b.snaps) == 0 {
+			continue
+		}
+
+		cols, err := readHaloCoords(
+			b.ids, b.snaps, []string{"X", "Y", "Z", "R200m"},
+			vars, buf, e, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+		b.xs, b.ys, b.zs, b.rs = cols[0], cols[1], cols[2], cols[3]
+		branches[i] = b
+	}
+
+	return branches, nil
+}
+
+// branchSphere returns a sphere around the j-th halo in a branch with a radius
+// of mult*R200m.
+func branchSphere(b *orbitBranch, j int, mult float64) geom.Sphere {
+	return geom.Sphere{
+		C: [3]float32{float32(b.xs[j]), float32(b.ys[j]), float32(b.zs[j])},
+		R: float32(b.rs[j] * mult),
+	}
+}
+
+// sphereParticles returns the IDs of the particles inside each sphere in the
+// given snapshot along with their distances from the sphere's center.
+func sphereParticles(
+	snap int, spheres []geom.Sphere, buf io.VectorBuffer, e *env.Environment,
+) (ids [][]int64, rs [][]float64, err error) {
+	ids, rs = make([][]int64, len(spheres)), make([][]float64, len(spheres))
+
+	hds, files, err := memo.ReadHeaders(snap, buf, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, intrIdxs := binSphereIntersections(hds, spheres)
+
+	for i := range hds {
+		if len(intrIdxs[i]) == 0 {
+			continue
+		}
+
+		xs, _, _, pIDs, err := buf.Read(files[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		L := float32(hds[i].TotalWidth)
+
+		for _, si := range intrIdxs[i] {
+			s := spheres[si]
+			r2Max := s.R * s.R
+			for j := range xs {
+				dx := periodicDelta(xs[j][0]-s.C[0], L)
+				dy := periodicDelta(xs[j][1]-s.C[1], L)
+				dz := periodicDelta(xs[j][2]-s.C[2], L)
+				r2 := dx*dx + dy*dy + dz*dz
+				if r2 <= r2Max {
+					ids[si] = append(ids[si], pIDs[j])
+					rs[si] = append(rs[si], math.Sqrt(float64(r2)))
+				}
+			}
+		}
+		buf.Close()
+	}
+
+	return ids, rs, nil
+}
+
+// periodicDelta wraps a coordinate difference into the range [-L/2, L/2].
+func periodicDelta(dx, L float32) float32 {
+	if dx > L/2 {
+		return dx - L
+	} else if dx < -L/2 {
+		return dx + L
+	}
+	return dx
+}
+
+// percentile returns the p-th percentile (0 <= p <= 100) of xs. xs is not
+// modified.
+func percentile(xs []float64, p float64) float64 {
+	sorted := make([]float64, len(xs))
+	copy(sorted, xs)
+	sort.Float64s(sorted)
+	i := int(p / 100 * float64(len(sorted)-1))
+	return sorted[i]
+}
@@ -0,0 +1,321 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// PairsConfig contains the configuration fields for the 'pairs' mode of the
+// shellfish tool.
+type PairsConfig struct {
+	minSeparation, maxSeparation float64
+	statsFile                    string
+}
+
+var _ Mode = &PairsConfig{}
+
+// ExampleConfig creates an example pairs.config file.
+func (config *PairsConfig) ExampleConfig() string {
+	return `[pairs.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The pairs tool finds every pair of input halos in the same snapshot whose
+# separation is between MinSeparation and MaxSeparation, in units of the sum
+# of the two halos' radii. This can be used to select major mergers, whose
+# shells are likely to be deformed.
+
+# MinSeparation and MaxSeparation are the range of separations, in units of
+# R_1 + R_2. Default to 0 and 1, which selects every pair of halos whose
+# spheres overlap.
+#
+# MinSeparation = 0
+# MaxSeparation = 1
+
+# StatsFile is the name of a file containing the output of shellfish stats for
+# the input halos. If it's set, each halo's radius is its R_sp instead of its
+# R200m, and halos which aren't in it are skipped.
+#
+# StatsFile = stats.txt`
+}
+
+// ReadConfig reads in a pairs.config file into config.
+func (config *PairsConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("pairs.config")
+	vars.Float(&config.minSeparation, "MinSeparation", 0)
+	vars.Float(&config.maxSeparation, "MaxSeparation", 1)
+	vars.String(&config.statsFile, "StatsFile", "")
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *PairsConfig) validate() error {
+	if config.minSeparation < 0 {
+		return fmt.Errorf("The 'MinSeparation' variable is set to %g, but "+
+			"it can't be negative.", config.minSeparation)
+	}
+	if config.maxSeparation <= config.minSeparation {
+		return fmt.Errorf("The 'MaxSeparation' variable is set to %g, but "+
+			"it needs to be larger than 'MinSeparation', %g.",
+			config.maxSeparation, config.minSeparation)
+	}
+	return nil
+}
+
+// Run executes the pairs mode of the shellfish tool.
+func (config *PairsConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#####################
+## shellfish pairs ##
+#####################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, coords, err := catalog.Parse(
+		stdin, []int{0, 1}, []int{2, 3, 4, 5},
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = readInputUnits(
+		stdin, snaps, coords, repeatKind(lengthUnit, 4), buf, e,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := coords[3]
+	if config.statsFile != "" {
+		rs, err = readStatsRadii(config.statsFile, ids, snaps, buf, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := &haloPairs{}
+	_, idxBins := binBySnap(snaps, ids)
+	for _, snap := range sortedSnaps(idxBins) {
+		hd, err := snapHeader(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+
+		idxs := []int{}
+		for _, i := range idxBins[snap] {
+			if rs[i] > 0 {
+				idxs = append(idxs, i)
+			}
+		}
+
+		n := len(idxs)
+		xs, ys, zs := make([]float64, n), make([]float64, n), make([]float64, n)
+		snapRs := make([]float64, n)
+		for j, i := range idxs {
+			xs[j], ys[j], zs[j] = coords[0][i], coords[1][i], coords[2][i]
+			snapRs[j] = rs[i]
+		}
+
+		pairs, seps := findPairs(
+			xs, ys, zs, snapRs, hd.TotalWidth,
+			config.minSeparation, config.maxSeparation,
+		)
+		for k, p := range pairs {
+			out.add(idxs[p[0]], idxs[p[1]], seps[k], ids, snaps, rs)
+		}
+	}
+
+	lines, err := out.format(gConfig, config.statsFile != "", buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return lines, nil
+}
+
+// readStatsRadii reads the R_sp of each input halo from a catalog written by
+// shellfish stats, in comovingUnits. Halos which aren't in the catalog are
+// given NaN.
+func readStatsRadii(
+	fname string, ids, snaps []int, buf io.VectorBuffer, e *env.Environment,
+) ([]float64, error) {
+	text, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := -1
+	for _, col := range catalog.Columns(text) {
+		if baseColumnName(col.Name) == "R_sp" && col.Start == col.End {
+			idx = col.Start
+		}
+	}
+	if idx == -1 {
+		return nil, fmt.Errorf("%s doesn't have an R_sp column.", fname)
+	}
+
+	intCols, floatCols, err := catalog.Parse(text, []int{0, 1}, []int{idx})
+	if err != nil {
+		return nil, err
+	}
+	err = readInputUnits(
+		text, intCols[1], floatCols, []unitKind{lengthUnit}, buf, e,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := map[[2]int]float64{}
+	for i := range intCols[0] {
+		lookup[[2]int{intCols[0][i], intCols[1][i]}] = floatCols[0][i]
+	}
+
+	rs := make([]float64, len(ids))
+	for i := range ids {
+		r, ok := lookup[[2]int{ids[i], snaps[i]}]
+		if !ok {
+			r = math.NaN()
+		}
+		rs[i] = r
+	}
+	return rs, nil
+}
+
+// findPairs returns the indices of every pair of halos in a periodic box of
+// width L whose separation is between minSep and maxSep times the sum of
+// their radii, along with their separations. Each pair is returned once, with
+// the larger halo first.
+func findPairs(
+	xs, ys, zs, rs []float64, L, minSep, maxSep float64,
+) (pairs [][2]int, seps []float64) {
+	rMax := 0.0
+	for _, r := range rs {
+		rMax = math.Max(rMax, r)
+	}
+
+	mt := halo.NewMatcher(finderCells, L, xs, ys, zs, rs)
+	for j := range xs {
+		pos := [3]float64{xs[j], ys[j], zs[j]}
+		nIdxs, dists := mt.Neighbors(pos, maxSep*(rs[j]+rMax))
+		for k, nj := range nIdxs {
+			// Only count each pair once, from its larger halo.
+			if nj == j || rs[nj] > rs[j] || (rs[nj] == rs[j] && nj < j) {
+				continue
+			}
+			rSum := rs[j] + rs[nj]
+			if dists[k] >= minSep*rSum && dists[k] <= maxSep*rSum {
+				pairs = append(pairs, [2]int{j, nj})
+				seps = append(seps, dists[k])
+			}
+		}
+	}
+	return pairs, seps
+}
+
+// haloPairs are the rows of the pairs tool's output catalog.
+type haloPairs struct {
+	ids1, ids2, snaps []int
+	seps, r1s, r2s    []float64
+}
+
+// add adds the pair of halos with indices i1 and i2 to the rows.
+func (hp *haloPairs) add(
+	i1, i2 int, sep float64, ids, snaps []int, rs []float64,
+) {
+	hp.ids1 = append(hp.ids1, ids[i1])
+	hp.ids2 = append(hp.ids2, ids[i2])
+	hp.snaps = append(hp.snaps, snaps[i1])
+	hp.seps = append(hp.seps, sep)
+	hp.r1s = append(hp.r1s, rs[i1])
+	hp.r2s = append(hp.r2s, rs[i2])
+}
+
+// format converts the rows to the global config's units and returns the
+// lines of the output catalog. If rsp is true, the radii are splashback
+// radii.
+func (hp *haloPairs) format(
+	gConfig *GlobalConfig, rsp bool, buf io.VectorBuffer, e *env.Environment,
+) ([]string, error) {
+	ratios := make([]float64, len(hp.seps))
+	for i := range ratios {
+		ratios[i] = hp.seps[i] / (hp.r1s[i] + hp.r2s[i])
+	}
+
+	rName := "R200m"
+	if rsp {
+		rName = "R_sp"
+	}
+	floatNames := []string{
+		"Separation [cMpc/h]", rName + "_1 [cMpc/h]",
+		rName + "_2 [cMpc/h]", "Separation/R_sum",
+	}
+	floatCols := [][]float64{hp.seps, hp.r1s, hp.r2s, ratios}
+	kinds := []unitKind{lengthUnit, lengthUnit, lengthUnit, dimensionless}
+
+	uc, err := newUnitConverter(gConfig.Units, hp.snaps, buf, e)
+	if err != nil {
+		return nil, err
+	}
+	uc.convert(hp.snaps, floatCols, kinds)
+	relabelColumns(gConfig.Units, floatNames)
+
+	order := []int{0, 1, 2, 3, 4, 5, 6}
+	lines := catalog.FormatCols(
+		[][]int{hp.ids1, hp.ids2, hp.snaps}, floatCols, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"ID_1", "ID_2", "Snapshot"}, floatNames, order,
+		[]int{1, 1, 1, 1, 1, 1, 1},
+	)
+
+	return append([]string{uc.unitsString(), cString}, lines...), nil
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFindPairs(t *testing.T) {
+	// Halo 0 and 1 overlap, 2 is just outside of 0, and 3 overlaps with 0
+	// across the periodic boundary.
+	xs := []float64{1, 2, 4.5, 99}
+	ys := []float64{50, 50, 50, 50}
+	zs := []float64{50, 50, 50, 50}
+	rs := []float64{1, 0.5, 1, 1.5}
+
+	pairs, seps := findPairs(xs, ys, zs, rs, 100, 0, 1)
+	expected := map[[2]int]float64{{0, 1}: 1, {3, 0}: 2}
+	if len(pairs) != len(expected) {
+		t.Fatalf("Expected pairs %v, got %v.", expected, pairs)
+	}
+	for k, p := range pairs {
+		sep, ok := expected[p]
+		if !ok || math.Abs(seps[k]-sep) > 1e-9 {
+			t.Errorf("Expected pairs %v, got %v with separations %v.",
+				expected, pairs, seps)
+			break
+		}
+	}
+
+	// Pairs closer than MinSeparation are excluded, and each pair of
+	// equally sized halos is only found once.
+	pairs, _ = findPairs(xs, ys, zs, rs, 100, 0.7, 1.8)
+	expected = map[[2]int]float64{{3, 0}: 2, {3, 1}: 3, {0, 2}: 3.5, {2, 1}: 2.5}
+	if len(pairs) != len(expected) {
+		t.Fatalf("Expected pairs %v, got %v.", expected, pairs)
+	}
+	for _, p := range pairs {
+		if _, ok := expected[p]; !ok {
+			t.Errorf("Expected pairs %v, got %v.", expected, pairs)
+			break
+		}
+	}
+}
+
+func TestHaloPairsFormat(t *testing.T) {
+	hp := &haloPairs{}
+	hp.add(0, 1, 1.5, []int{10, 11}, []int{100, 100}, []float64{2, 1})
+	lines, err := hp.format(&GlobalConfig{Units: comovingUnits}, true, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []string{
+		"# Units: cMpc/h",
+		"# Column contents: ID_1(0) ID_2(1) Snapshot(2) " +
+			"Separation [cMpc/h](3) R_sp_1 [cMpc/h](4) " +
+			"R_sp_2 [cMpc/h](5) Separation/R_sum(6)",
+		"10 11 100 1.5 2 1 0.5",
+	}
+	if !stringSlicesEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q.", expected, lines)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"os"
 	"sort"
 	"time"
 
@@ -21,6 +22,7 @@ type PhaseConfig struct {
 	rMaxMult, vMaxMult float64
 	pType phaseProfileType
 	subHub bool
+	npzFile string
 }
 
 type phaseProfileType int
@@ -51,6 +53,15 @@ ProfileType = radial
 # VMaxMult = 3.0
 
 # SubtractHubble = false
+
+# NpzFile is the name of a numpy .npz file that the phase space histograms are
+# also written to. It contains the arrays id, snapshot, r [cMpc/h], v [pkm/s],
+# and rho, which has shape (haloes, RBins, VBins), along with a stacked
+# histogram, stacked, which has shape (RBins, VBins). Haloes are stacked in
+# units of R200m and V200m, so stacked is the mean of each halo's histogram
+# in units of M200m / (R200m^3 V200m) and is binned by r_scaled = r / R200m
+# and v_scaled = v / V200m. No file is written if NpzFile isn't set.
+# NpzFile = ""
 `
 }
 
@@ -63,6 +74,7 @@ func (config *PhaseConfig) ReadConfig(fname string, flags []string) error {
 	vars.Float(&config.rMaxMult, "RMaxMult", 3.0)
 	vars.Float(&config.vMaxMult, "VMaxMult", 3.0)
 	vars.Bool(&config.subHub, "SubtractHubble", false)
+	vars.String(&config.npzFile, "NpzFile", "")
 	
 	var pType string
 	vars.String(&pType, "ProfileType", "")
@@ -239,6 +251,13 @@ func (config *PhaseConfig) Run(
 		)
 	}
 
+	if config.npzFile != "" {
+		err = config.writeNpz(ids, snaps, rSets, vSets, rhoSets, hr, hvr, hm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	rSets = transpose(rSets)
 	vSets = transpose(vSets)
 	rhoSets = transpose(rhoSets)
@@ -347,3 +366,63 @@ func processPhaseProfile(
 		}
 	}
 }
+
+// stackPhaseProfiles returns the mean of the phase space histograms in
+// rhoSets after each is converted to units of M200m / (R200m^3 V200m).
+func stackPhaseProfiles(rhoSets [][]float64, rs, vs, ms []float64) []float64 {
+	stacked := make([]float64, len(rhoSets[0]))
+	for i := range rhoSets {
+		norm := rs[i]*rs[i]*rs[i]*vs[i] / ms[i] / float64(len(rhoSets))
+		for j := range stacked {
+			stacked[j] += rhoSets[i][j] * norm
+		}
+	}
+	return stacked
+}
+
+// writeNpz writes the phase space histograms of every halo and their stack
+// to config.npzFile. rs, vs, and ms are R200m, V200m, and M200m.
+func (config *PhaseConfig) writeNpz(
+	ids, snaps []int, rSets, vSets, rhoSets [][]float64, rs, vs, ms []float64,
+) error {
+	n, rBins, vBins := len(ids), int(config.rbins), int(config.vbins)
+
+	ids64, snaps64 := make([]int64, n), make([]int64, n)
+	rFlat := make([]float64, 0, n*rBins)
+	vFlat := make([]float64, 0, n*vBins)
+	rhoFlat := make([]float64, 0, n*rBins*vBins)
+	for i := range ids {
+		ids64[i], snaps64[i] = int64(ids[i]), int64(snaps[i])
+		rFlat = append(rFlat, rSets[i]...)
+		vFlat = append(vFlat, vSets[i]...)
+		rhoFlat = append(rhoFlat, rhoSets[i]...)
+	}
+
+	// Bins are the same fraction of R200m and V200m for every halo.
+	rScaled, vScaled := make([]float64, rBins), make([]float64, vBins)
+	for j := range rScaled {
+		rScaled[j] = rSets[0][j] / rs[0]
+	}
+	for j := range vScaled {
+		vScaled[j] = vSets[0][j] / vs[0]
+	}
+
+	arrays := []io.NpyArray{
+		{Name: "id", Shape: []int{n}, Data: ids64},
+		{Name: "snapshot", Shape: []int{n}, Data: snaps64},
+		{Name: "r", Shape: []int{n, rBins}, Data: rFlat},
+		{Name: "v", Shape: []int{n, vBins}, Data: vFlat},
+		{Name: "rho", Shape: []int{n, rBins, vBins}, Data: rhoFlat},
+		{Name: "r_scaled", Shape: []int{rBins}, Data: rScaled},
+		{Name: "v_scaled", Shape: []int{vBins}, Data: vScaled},
+		{Name: "stacked", Shape: []int{rBins, vBins},
+			Data: stackPhaseProfiles(rhoSets, rs, vs, ms)},
+	}
+
+	f, err := os.Create(config.npzFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return io.WriteNpz(f, arrays)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestStackPhaseProfiles(t *testing.T) {
+	rhoSets := [][]float64{{1, 2}, {4, 8}}
+	rs, vs, ms := []float64{1, 2}, []float64{1, 1}, []float64{1, 4}
+
+	// The second halo has the norm 2^3 * 1 / 4 = 2.
+	expected := []float64{4.5, 9}
+	stacked := stackPhaseProfiles(rhoSets, rs, vs, ms)
+	for i := range expected {
+		if math.Abs(stacked[i]-expected[i]) > 1e-10 {
+			t.Errorf("Expected stacked histogram %v, got %v.",
+				expected, stacked)
+			break
+		}
+	}
+}
+
+func TestPhaseWriteNpz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_phase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &PhaseConfig{
+		rbins: 2, vbins: 3, npzFile: path.Join(dir, "phase.npz"),
+	}
+	err = config.writeNpz(
+		[]int{7}, []int{100}, [][]float64{{0.5, 1.5}},
+		[][]float64{{-2, 0, 2}}, [][]float64{{1, 2, 3, 4, 5, 6}},
+		[]float64{2}, []float64{3}, []float64{1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.OpenReader(config.npzFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name != "rho.npy" {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headerLen := int(data[8]) + int(data[9])<<8
+		header := string(data[10 : 10+headerLen])
+		if (10+headerLen)%64 != 0 {
+			t.Errorf("rho.npy header isn't aligned: %q.", header)
+		}
+		if !strings.Contains(header, "'shape': (1, 2, 3,)") {
+			t.Errorf("rho.npy has the wrong shape: %q.", header)
+		}
+		if len(data) != 10+headerLen+6*8 {
+			t.Errorf("rho.npy has %d bytes.", len(data))
+		}
+	}
+
+	expected := "id.npy snapshot.npy r.npy v.npy rho.npy " +
+		"r_scaled.npy v_scaled.npy stacked.npy"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("Expected files %s, got %v.", expected, names)
+	}
+}
@@ -0,0 +1,453 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// PipelineConfig contains the configuration fields for the 'pipeline' mode of
+// the shellfish tool.
+type PipelineConfig struct {
+	modes           []string
+	inputFile       string
+	stateDir        string
+	checkpointHalos int64
+
+	// configHash identifies the config file that the pipeline was read from,
+	// so that state from a different pipeline isn't resumed.
+	configHash string
+	stages     []Mode
+}
+
+var _ Mode = &PipelineConfig{}
+
+// ExampleConfig creates an example pipeline.config file.
+func (config *PipelineConfig) ExampleConfig() string {
+	return `[pipeline.config]
+
+#####################
+## Required Fields ##
+#####################
+
+# Modes is the list of modes that are run, in order. The output catalog of
+# each mode is passed directly to the next one, so this is equivalent to
+#
+#     shellfish id | shellfish coord | shellfish shell | shellfish stats
+#
+# Each mode reads its variables from the section of this file with that mode's
+# usual header (e.g. [shell.config]). Modes without a section use their
+# default values. A mode can only appear once, and only the output catalog of
+# the last mode is written.
+Modes = id, coord, shell, stats
+
+#####################
+## Optional Fields ##
+#####################
+
+# InputFile is the name of a catalog which is used as the input to the first
+# mode. If it isn't set, the first mode must be id or check, since pipelines
+# don't read from stdin.
+# InputFile = ""
+
+# StateDir is a directory where the pipeline saves its progress. The output
+# catalog of each mode is saved there when the mode finishes, and if the
+# pipeline is rerun after a failure, finished modes are skipped and the
+# pipeline resumes with the mode that failed. Intermediate products saved in
+# the global config's MemoDir are reused as usual. StateDir also records which
+# config file the pipeline was run with, and a pipeline with a different config
+# file (or a different input catalog) won't resume from it. If you want to
+# start from scratch, delete the directory. No progress is saved if StateDir
+# isn't set.
+# StateDir = ""
+
+# CheckpointHalos is the number of halos that shell, which is by far the most
+# expensive mode, is run on at a time when StateDir is set. The output of each
+# batch is saved, so a pipeline which fails partway through shell resumes at
+# the first unfinished batch. Other modes are always rerun from their first
+# halo. Setting it to 0 runs shell on every halo at once.
+# CheckpointHalos = 1000
+
+[id.config]
+
+Snap = 100
+IDs = 10, 11, 12, 13, 14
+
+# [coord.config], [shell.config], and [stats.config] sections can be added in
+# the same way.`
+}
+
+// ReadConfig reads in a pipeline.config file into config, along with the
+// sections used by each of its modes.
+func (config *PipelineConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("pipeline.config")
+	vars.Strings(&config.modes, "Modes", []string{})
+	vars.String(&config.inputFile, "InputFile", "")
+	vars.String(&config.stateDir, "StateDir", "")
+	vars.Int(&config.checkpointHalos, "CheckpointHalos", 1000)
+
+	if fname == "" {
+		return fmt.Errorf("The pipeline mode must be given a config file.")
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	text, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	config.configHash = fmt.Sprintf("%x", sha1.Sum(text))
+
+	config.stages, err = readStages(fname, config.modes)
+	return err
+}
+
+// readStages reads the config of each of the named modes from the section of
+// fname with that mode's header. Modes without a section use their default
+// values.
+func readStages(fname string, modes []string) ([]Mode, error) {
+	stages := make([]Mode, len(modes))
+	for i, name := range modes {
+		stages[i] = newMode(name)
+
+		ok, err := parse.HasSection(fname, name+".config")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			err = stages[i].ReadConfig("", nil)
+		} else {
+			err = stages[i].ReadConfig(fname, nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the [%s.config] section "+
+				"of %s:\n%s", name, fname, err.Error())
+		}
+	}
+	return stages, nil
+}
+
+// newMode returns a copy of the mode registered under name, so that reading a
+// stage's config doesn't change the instance shared through ModeNames.
+func newMode(name string) Mode {
+	mode := ModeNames[name]
+	v := reflect.ValueOf(mode)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return mode
+	}
+	copied := reflect.New(v.Elem().Type())
+	copied.Elem().Set(v.Elem())
+	return copied.Interface().(Mode)
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *PipelineConfig) validate() error {
+	if err := validateStageNames(config.modes); err != nil {
+		return err
+	}
+
+	if config.checkpointHalos < 0 {
+		return fmt.Errorf("The variable '%s' was set to %d, but it can't "+
+			"be negative.", "CheckpointHalos", config.checkpointHalos)
+	}
+
+	switch config.modes[0] {
+	case "id", "check":
+	default:
+		if config.inputFile == "" {
+			return fmt.Errorf("The first mode in 'Modes' is %s, which "+
+				"needs an input catalog, but 'InputFile' wasn't set.",
+				config.modes[0])
+		}
+	}
+
+	return nil
+}
+
+// validateStageNames checks that the modes listed in a 'Modes' variable
+// exist, can be chained together, and aren't repeated.
+func validateStageNames(modes []string) error {
+	if len(modes) == 0 {
+		return fmt.Errorf("The variable 'Modes' was not set.")
+	}
+
+	for i, name := range modes {
+		_, ok := ModeNames[name]
+		if !ok || name == "pipeline" || name == "serve" {
+			return fmt.Errorf("The variable 'Modes' contains '%s', which "+
+				"isn't a mode that can be run in a pipeline.", name)
+		}
+		for j := 0; j < i; j++ {
+			if modes[j] == name {
+				return fmt.Errorf("The variable 'Modes' contains '%s' "+
+					"more than once.", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Stages returns the names of the modes run by the pipeline, in order.
+func (config *PipelineConfig) Stages() []string {
+	return config.modes
+}
+
+// Run executes the pipeline mode of the shellfish tool.
+func (config *PipelineConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+########################
+## shellfish pipeline ##
+########################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	var in []byte
+	if config.inputFile != "" {
+		var err error
+		in, err = ioutil.ReadFile(config.inputFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.stateDir != "" {
+		if err := config.checkState(in); err != nil {
+			return nil, err
+		}
+	}
+
+	var out []string
+	for i := range config.stages {
+		var err error
+		out, err = config.runStage(i, gConfig, e, in)
+		if err != nil {
+			return nil, fmt.Errorf("Error running mode %s:\n%s",
+				config.modes[i], err.Error())
+		}
+
+		in = pipelineLines(out)
+		if len(bytes.TrimSpace(in)) == 0 {
+			// Piped modes stop when they're given an empty catalog.
+			break
+		}
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return out, nil
+}
+
+// runStage runs the ith mode of the pipeline on the input catalog, in. If
+// StateDir is set, saved output is used instead of rerunning the mode, and
+// the output of the mode (and of each of its batches) is saved.
+func (config *PipelineConfig) runStage(
+	i int, gConfig *GlobalConfig, e *env.Environment, in []byte,
+) ([]string, error) {
+	stage := config.stages[i]
+	if config.stateDir == "" {
+		return stage.Run(gConfig, e, in)
+	}
+
+	fname := config.checkpointFile(i, -1)
+	if out, ok, err := readCheckpoint(fname); err != nil || ok {
+		if ok && logging.Mode != logging.Nil {
+			log.Printf("Resuming from the saved output of mode %s.",
+				config.modes[i])
+		}
+		return out, err
+	}
+
+	var out []string
+	if config.modes[i] == "shell" && config.checkpointHalos > 0 {
+		batches := splitCatalog(in, int(config.checkpointHalos))
+		outs := make([][]string, len(batches))
+		for j := range batches {
+			bName := config.checkpointFile(i, j)
+			bOut, ok, err := readCheckpoint(bName)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				bOut, err = stage.Run(gConfig, e, batches[j])
+				if err != nil {
+					return nil, err
+				}
+				if err = writeCheckpoint(bName, bOut); err != nil {
+					return nil, err
+				}
+			}
+			outs[j] = bOut
+		}
+		out = mergeCatalogs(outs)
+	} else {
+		var err error
+		out, err = stage.Run(gConfig, e, in)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, writeCheckpoint(fname, out)
+}
+
+// checkState checks that the state saved in StateDir belongs to the same
+// pipeline and input catalog as config. If StateDir is empty, the pipeline's
+// state is written to it.
+func (config *PipelineConfig) checkState(in []byte) error {
+	if err := os.MkdirAll(config.stateDir, 0777); err != nil {
+		return err
+	}
+
+	state := fmt.Sprintf("Modes = %s\nConfigHash = %s\nInputHash = %x\n",
+		strings.Join(config.modes, ", "), config.configHash, sha1.Sum(in))
+	fname := path.Join(config.stateDir, "pipeline.state")
+	saved, err := ioutil.ReadFile(fname)
+	if err != nil {
+		// No state file, so the directory is fresh.
+		return ioutil.WriteFile(fname, []byte(state), 0666)
+	}
+
+	if string(saved) != state {
+		return fmt.Errorf("The variable 'StateDir' was set to %s, but the "+
+			"progress saved there belongs to a different config file or "+
+			"input catalog. If you're SURE that you don't need it, type the "+
+			"command\n    $ rm -r %s\nand rerun shellfish.",
+			config.stateDir, config.stateDir)
+	}
+	return nil
+}
+
+// checkpointFile returns the name of the file that the output of the ith
+// mode is saved to. If batch isn't -1, it's the file that the output of that
+// batch of halos is saved to.
+func (config *PipelineConfig) checkpointFile(i, batch int) string {
+	name := fmt.Sprintf("%d.%s", i, config.modes[i])
+	if batch != -1 {
+		name = fmt.Sprintf("%s.batch%d", name, batch)
+	}
+	return path.Join(config.stateDir, name+".txt")
+}
+
+// readCheckpoint reads saved output lines. If the file doesn't exist, ok is
+// false.
+func readCheckpoint(fname string) (lines []string, ok bool, err error) {
+	text, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if len(text) == 0 {
+		return []string{}, true, nil
+	}
+	return strings.Split(strings.TrimSuffix(string(text), "\n"), "\n"),
+		true, nil
+}
+
+// writeCheckpoint saves output lines. The lines are written to a uniquely
+// named temporary file in the same directory which is then moved, so a failure
+// partway through writing never leaves a partial checkpoint behind.
+func writeCheckpoint(fname string, lines []string) error {
+	f, err := ioutil.TempFile(path.Dir(fname), path.Base(fname)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(pipelineLines(lines))
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		// TempFile only gives the owner access to the file.
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fname)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// splitCatalog splits a catalog into batches with at most n rows each. Every
+// batch keeps the catalog's comment lines.
+func splitCatalog(data []byte, n int) [][]byte {
+	header, rows := [][]byte{}, [][]byte{}
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		} else if line[0] == '#' {
+			header = append(header, line)
+		} else {
+			rows = append(rows, line)
+		}
+	}
+
+	batches := [][]byte{}
+	for start := 0; start < len(rows); start += n {
+		end := start + n
+		if end > len(rows) {
+			end = len(rows)
+		}
+		lines := append(append([][]byte{}, header...), rows[start:end]...)
+		batch := bytes.Join(lines, []byte{'\n'})
+		batches = append(batches, append(batch, '\n'))
+	}
+	return batches
+}
+
+// mergeCatalogs joins the output lines of several batches into a single
+// catalog. The comment lines of the first batch are kept and the comment
+// lines of the others are dropped.
+func mergeCatalogs(outs [][]string) []string {
+	merged := []string{}
+	for i, out := range outs {
+		for _, line := range out {
+			if i == 0 || len(line) == 0 || line[0] != '#' {
+				merged = append(merged, line)
+			}
+		}
+	}
+	return merged
+}
+
+// pipelineLines converts the output lines of one mode into the input of the
+// next, in the same way that printing them to a pipe would.
+func pipelineLines(lines []string) []byte {
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
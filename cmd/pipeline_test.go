@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPipelineValidate(t *testing.T) {
+	tests := []struct {
+		modes     []string
+		inputFile string
+		valid     bool
+	}{
+		{[]string{"id", "coord", "shell", "stats"}, "", true},
+		{[]string{"coord", "shell"}, "", false},
+		{[]string{"coord", "shell"}, "ids.txt", true},
+		{[]string{"id", "meow"}, "", false},
+		{[]string{"id", "pipeline"}, "", false},
+		{[]string{"id", "coord", "coord"}, "", false},
+		{[]string{}, "", false},
+	}
+
+	for i, test := range tests {
+		config := &PipelineConfig{modes: test.modes, inputFile: test.inputFile}
+		err := config.validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%d) Expected valid = %v for %v, got error %v.",
+				i, test.valid, test.modes, err)
+		}
+	}
+}
+
+func TestPipelineLines(t *testing.T) {
+	tests := []struct {
+		lines    []string
+		expected string
+	}{
+		{[]string{}, ""},
+		{[]string{"# ID Snapshot", "1 100"}, "# ID Snapshot\n1 100\n"},
+	}
+
+	for i, test := range tests {
+		out := string(pipelineLines(test.lines))
+		if out != test.expected {
+			t.Errorf("%d) Expected %q, got %q.", i, test.expected, out)
+		}
+	}
+}
+
+func TestSplitCatalog(t *testing.T) {
+	data := []byte("# Units: cMpc/h\n# Column contents: ID(0) Snap(1)\n" +
+		"1 100\n2 100\n\n3 100\n")
+	expected := []string{
+		"# Units: cMpc/h\n# Column contents: ID(0) Snap(1)\n1 100\n2 100\n",
+		"# Units: cMpc/h\n# Column contents: ID(0) Snap(1)\n3 100\n",
+	}
+
+	batches := splitCatalog(data, 2)
+	if len(batches) != len(expected) {
+		t.Fatalf("Expected %d batches, got %d.", len(expected), len(batches))
+	}
+	for i := range batches {
+		if string(batches[i]) != expected[i] {
+			t.Errorf("%d) Expected batch %q, got %q.",
+				i, expected[i], batches[i])
+		}
+	}
+
+	batches = splitCatalog([]byte("# Units: cMpc/h\n"), 2)
+	if len(batches) != 0 {
+		t.Errorf("Expected no batches for an empty catalog, got %q.", batches)
+	}
+}
+
+func TestMergeCatalogs(t *testing.T) {
+	outs := [][]string{
+		{"# Units: cMpc/h", "# Column contents: ID(0)", "1", "2"},
+		{"# Units: cMpc/h", "# Column contents: ID(0)", "3"},
+	}
+	expected := []string{
+		"# Units: cMpc/h", "# Column contents: ID(0)", "1", "2", "3",
+	}
+
+	merged := mergeCatalogs(outs)
+	if len(merged) != len(expected) {
+		t.Fatalf("Expected %v, got %v.", expected, merged)
+	}
+	for i := range merged {
+		if merged[i] != expected[i] {
+			t.Errorf("Expected %v, got %v.", expected, merged)
+			break
+		}
+	}
+}
+
+func TestPipelineCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_pipeline_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	config := &PipelineConfig{
+		modes: []string{"id", "shell"}, stateDir: dir, configHash: "abc",
+	}
+	name := config.checkpointFile(1, 3)
+	if name != path.Join(dir, "1.shell.batch3.txt") {
+		t.Errorf("Got checkpoint file %s.", name)
+	}
+
+	fname := config.checkpointFile(0, -1)
+	if _, ok, err := readCheckpoint(fname); ok || err != nil {
+		t.Errorf("Expected no checkpoint, got ok = %v, err = %v.", ok, err)
+	}
+	lines := []string{"# Column contents: ID(0) Snap(1)", "1 100"}
+	if err = writeCheckpoint(fname, lines); err != nil {
+		t.Fatal(err.Error())
+	}
+	if info, err := os.Stat(fname); err != nil {
+		t.Fatal(err.Error())
+	} else if info.Mode().Perm() != 0644 {
+		t.Errorf("Expected checkpoint permissions 0644, got %o.",
+			info.Mode().Perm())
+	}
+	if infos, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err.Error())
+	} else if len(infos) != 1 {
+		t.Errorf("Expected only the checkpoint in %s, got %d files.",
+			dir, len(infos))
+	}
+	out, ok, err := readCheckpoint(fname)
+	if !ok || err != nil || len(out) != 2 ||
+		out[0] != lines[0] || out[1] != lines[1] {
+		t.Errorf("Expected checkpoint %q, got %q (ok = %v, err = %v).",
+			lines, out, ok, err)
+	}
+
+	// State can only be resumed by the same pipeline and input.
+	if err = config.checkState([]byte("1 100\n")); err != nil {
+		t.Errorf("Got error %s for a fresh StateDir.", err.Error())
+	}
+	if err = config.checkState([]byte("1 100\n")); err != nil {
+		t.Errorf("Got error %s for a matching StateDir.", err.Error())
+	}
+	if err = config.checkState([]byte("2 100\n")); err == nil {
+		t.Errorf("Expected an error for a different input catalog.")
+	}
+	config.configHash = "def"
+	if err = config.checkState([]byte("1 100\n")); err == nil {
+		t.Errorf("Expected an error for a different config file.")
+	}
+}
+
+func TestNewMode(t *testing.T) {
+	mode, ok := newMode("shell").(*ShellConfig)
+	if !ok {
+		t.Fatalf("Expected newMode(\"shell\") to return a *ShellConfig.")
+	}
+	if mode == ModeNames["shell"] {
+		t.Errorf("Expected newMode to return a copy of ModeNames[\"shell\"].")
+	}
+
+	mode.rings = -1
+	if ModeNames["shell"].(*ShellConfig).rings == -1 {
+		t.Errorf("Changing a copy changed ModeNames[\"shell\"].")
+	}
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"sort"
+	"strings"
+)
+
+// ModeInfo describes what the shellfish tool needs to do before running a
+// mode which was added with RegisterMode.
+type ModeInfo struct {
+	// Stdin is true if the mode reads an input catalog from stdin.
+	Stdin bool
+	// Snapshots is true if the mode reads particle snapshots.
+	Snapshots bool
+	// Halos is true if the mode needs the halo catalogs and merger trees.
+	// If it's false, they're still initialized when HaloType isn't nil.
+	Halos bool
+	// Help is printed by "shellfish help <name>".
+	Help string
+}
+
+// registeredModes contains the ModeInfo of every mode added with
+// RegisterMode.
+var registeredModes = map[string]ModeInfo{}
+
+// reservedModeNames are the commands handled by the shellfish tool itself.
+var reservedModeNames = map[string]bool{
+	"help": true, "version": true, "hello": true,
+}
+
+// RegisterMode adds a new mode to the shellfish tool. It's meant to be called
+// from the init function of a plugin (see LoadPlugins). Once registered, the
+// mode is run exactly like the built-in modes: it's given the same
+// GlobalConfig and env.Environment, and can use the memo package.
+func RegisterMode(name string, mode Mode, info ModeInfo) error {
+	if name == "" || strings.ContainsAny(name, " \t\n/") {
+		return fmt.Errorf("'%s' isn't a valid mode name.", name)
+	} else if _, ok := ModeNames[name]; ok || reservedModeNames[name] {
+		return fmt.Errorf("There's already a mode named '%s'.", name)
+	}
+
+	ModeNames[name] = mode
+	registeredModes[name] = info
+	return nil
+}
+
+// RegisteredMode returns the ModeInfo of a mode added with RegisterMode. ok
+// is false for built-in modes and unknown names.
+func RegisteredMode(name string) (info ModeInfo, ok bool) {
+	info, ok = registeredModes[name]
+	return info, ok
+}
+
+// RegisteredModeNames returns the names of every mode added with
+// RegisterMode in alphabetical order.
+func RegisteredModeNames() []string {
+	names := []string{}
+	for name := range registeredModes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadPlugins opens the Go plugins given by a list of paths separated by the
+// OS's path list separator (':' on Unix), like $SHELLFISH_PLUGINS. Each path
+// is either a plugin file built with "go build -buildmode=plugin" or a
+// directory, in which case every .so file in it is opened. Plugins add their
+// modes by calling RegisterMode in their init functions.
+func LoadPlugins(paths string) error {
+	for _, p := range filepath.SplitList(paths) {
+		if p == "" {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+
+		fnames := []string{p}
+		if info.IsDir() {
+			fnames, err = filepath.Glob(filepath.Join(p, "*.so"))
+			if err != nil {
+				return err
+			}
+			sort.Strings(fnames)
+		}
+
+		for _, fname := range fnames {
+			if _, err := plugin.Open(fname); err != nil {
+				return fmt.Errorf("Could not load the plugin %s: %s",
+					fname, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// externalModePrefix is the prefix of executables which implement external
+// modes.
+const externalModePrefix = "shellfish-"
+
+// ExternalMode is a mode implemented by a separate executable named
+// shellfish-<name> somewhere in $PATH. These can be written in any language.
+// The executable must follow this protocol:
+//
+//	shellfish-<name> help              prints its help text.
+//	shellfish-<name> example-config    prints an example config file.
+//	shellfish-<name> [config] [flags]  runs the mode.
+//
+// When the mode is run, it inherits shellfish's stdin, stdout, stderr, and
+// environment, so it finds the global config file through
+// $SHELLFISH_GLOBAL_CONFIG and can share its MemoDir. It should exit with a
+// non-zero status if it fails.
+type ExternalMode struct {
+	Name, Path string
+}
+
+// FindExternalMode looks for an executable implementing the named mode in
+// $PATH.
+func FindExternalMode(name string) (*ExternalMode, bool) {
+	if name == "" || strings.ContainsAny(name, " \t\n/") {
+		return nil, false
+	}
+	path, err := exec.LookPath(externalModePrefix + name)
+	if err != nil {
+		return nil, false
+	}
+	return &ExternalMode{Name: name, Path: path}, true
+}
+
+// Help returns the help text of the mode.
+func (m *ExternalMode) Help() (string, error) {
+	return m.output("help")
+}
+
+// ExampleConfig returns the example config file of the mode.
+func (m *ExternalMode) ExampleConfig() (string, error) {
+	return m.output("example-config")
+}
+
+// output runs the executable with the given arguments and returns what it
+// printed.
+func (m *ExternalMode) output(args ...string) (string, error) {
+	out, err := exec.Command(m.Path, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("Running %s failed: %s", m.Path, err.Error())
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// Run runs the mode with the given command line arguments, connecting it
+// directly to shellfish's stdin, stdout, and stderr.
+func (m *ExternalMode) Run(args []string) error {
+	c := exec.Command(m.Path, args...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("The external mode %s (%s) failed: %s",
+			m.Name, m.Path, err.Error())
+	}
+	return nil
+}
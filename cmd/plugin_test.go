@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRegisterMode(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"my-plugin-mode", true},
+		{"my-plugin-mode", false},
+		{"shell", false},
+		{"help", false},
+		{"", false},
+		{"two words", false},
+	}
+
+	defer func() {
+		delete(ModeNames, "my-plugin-mode")
+		delete(registeredModes, "my-plugin-mode")
+	}()
+
+	for i, test := range tests {
+		err := RegisterMode(test.name, &MergeConfig{}, ModeInfo{Stdin: true})
+		if (err == nil) != test.valid {
+			t.Errorf("%d) Expected valid = %v for '%s', got error %v.",
+				i, test.valid, test.name, err)
+		}
+	}
+
+	if _, ok := ModeNames["my-plugin-mode"]; !ok {
+		t.Errorf("Registered mode wasn't added to ModeNames.")
+	}
+	if info, ok := RegisteredMode("my-plugin-mode"); !ok || !info.Stdin {
+		t.Errorf("Expected registered ModeInfo, got %v, %v.", info, ok)
+	}
+	if _, ok := RegisteredMode("shell"); ok {
+		t.Errorf("Built-in modes shouldn't have a registered ModeInfo.")
+	}
+	names := RegisteredModeNames()
+	if len(names) != 1 || names[0] != "my-plugin-mode" {
+		t.Errorf("Expected registered names [my-plugin-mode], got %v.", names)
+	}
+}
+
+func TestLoadPlugins(t *testing.T) {
+	if err := LoadPlugins(""); err != nil {
+		t.Errorf("Unexpected error for an empty plugin list: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "shellfish_plugins")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if err = LoadPlugins(dir); err != nil {
+		t.Errorf("Unexpected error for an empty plugin directory: %s", err)
+	}
+	if err = LoadPlugins(path.Join(dir, "missing.so")); err == nil {
+		t.Errorf("Expected an error for a missing plugin.")
+	}
+}
+
+func TestExternalMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_external")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	script := `#!/bin/sh
+case "$1" in
+help) echo "Meow help." ;;
+example-config) echo "[meow.config]" ;;
+*) exit 1 ;;
+esac
+`
+	fname := path.Join(dir, "shellfish-meow")
+	if err = ioutil.WriteFile(fname, []byte(script), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+
+	if _, ok := FindExternalMode("woof"); ok {
+		t.Errorf("Found an external mode that doesn't exist.")
+	}
+	m, ok := FindExternalMode("meow")
+	if !ok {
+		t.Fatalf("Couldn't find the external mode in $PATH.")
+	}
+
+	if help, err := m.Help(); err != nil || help != "Meow help." {
+		t.Errorf("Expected 'Meow help.', got '%s' and %v.", help, err)
+	}
+	if text, err := m.ExampleConfig(); err != nil || text != "[meow.config]" {
+		t.Errorf("Expected '[meow.config]', got '%s' and %v.", text, err)
+	}
+	if err = m.Run([]string{"run"}); err == nil {
+		t.Errorf("Expected an error when the external mode fails.")
+	}
+}
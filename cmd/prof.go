@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"os"
 	"sort"
+	"strings"
 	"time"
 	"math/rand"
 	"runtime"
@@ -14,17 +16,50 @@ import (
 	"github.com/phil-mansfield/shellfish/los/analyze"
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/lib"
 	"github.com/phil-mansfield/shellfish/logging"
 	"github.com/phil-mansfield/shellfish/parse"
 	"github.com/phil-mansfield/shellfish/io"
 	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/cosmo"
 )
 
 type ProfConfig struct {
 	bins, order, samples int64
 	rMaxMult, rMinMult float64
+	binType, binNormalization string
+	edgeMults []float64
+	rspColumn int64
 	medianPixelLevel int64
 	percentile float64
+	velocities bool
+	radialVelocity bool
+	restFrame string
+
+	slope bool
+	smoothingWindow int64
+	smoothingKernel string
+	smoothingSigma float64
+
+	dk14Fit bool
+	dk14Beta, dk14Gamma float64
+
+	projectionAxis string
+	projectionDepthMult float64
+
+	orbits bool
+	orbitSearchRadiusMult float64
+
+	stack bool
+	stackMassEdges, stackGammaEdges []float64
+	stackSamples int64
+	stackCovariance bool
+	stackJackknife string
+
+	subhaloVmaxMin float64
+
+	hdf5File string
 
 	pType profileType
 
@@ -38,6 +73,8 @@ const (
 	containedDensityProfile
 	angularFractionProfile
 	boundDensityProfile
+	projectedDensityProfile
+	subhaloDensityProfile
 )
 
 var _ Mode = &ProfConfig{}
@@ -55,12 +92,27 @@ func (config *ProfConfig) ExampleConfig() string {
 #                     know and love.
 # median-density -    A density profile created by binning particles into
 #                     equal solid-angle pixels and taking the median density
-#                     across the angular bins at each radius.
+#                     across the angular bins at each radius. This is the
+#                     median-of-wedges estimator: the median suppresses
+#                     substructure, which only occupies a few wedges, and so
+#                     gives a sharper splashback feature than density.
 # median-error -      Calculates error on the median through bootstrap sampling.
 # contained-densiy -  A density profile which only uses particles.
 # angular-fraction -  The angular fraction at each radius which is contained
 #                     within the shell.
 # bound-density -     The density of bound matter, assuming an NFW profile.
+# projected-density - The surface density, Sigma(R), and the excess surface
+#                     density measured by weak lensing,
+#                     DeltaSigma(R) = <Sigma>(<R) - Sigma(R), of matter
+#                     projected along ProjectionAxis. Both are in h Msun/pc^2
+#                     (or Msun/pc^2 in physical units).
+# subhalo-density -   The number density of the halos in the halo catalog with
+#                     Vmax >= SubhaloVmaxMin around each host, in h^3/cMpc^3.
+#                     This uses the halo catalog instead of particles, and
+#                     its splashback feature is the one that is seen in the
+#                     distributions of observed galaxies. Every halo other
+#                     than the host is counted, including halos outside of
+#                     it.
 ProfileType = median-density
 
 # Order is the order of the Penna-Dines shell fit that Shellfish uses. This
@@ -88,14 +140,181 @@ ProfileType = median-density
 # non-median percentiles can be measured.
 # Percentile = 50
 
-# Bins is the number of logarithmic radial bins used in a profile.
+# Bins is the number of radial bins used in a profile.
 # Bins = 150
 
-# RMaxMult is the maximum radius of the profile as a function of R_200m.
+# RMaxMult is the maximum radius of the profile in units of the normalization
+# radius set by BinNormalization.
 # RMaxMult = 3
 
-# RMinMult is the minimum radius of the profile as a function of R_200m.
+# RMinMult is the minimum radius of the profile in units of the normalization
+# radius set by BinNormalization. It can be zero if BinType is linear.
 # RMinMult = 0.03
+
+# BinType is the spacing of the radial bins. It can be set to log, which
+# spaces Bins bins logarithmically between RMinMult and RMaxMult, linear,
+# which spaces them linearly, or explicit, which uses the bin edges given by
+# BinEdges and ignores Bins, RMinMult, and RMaxMult. Bin radii are the
+# geometric centers of log bins and the arithmetic centers of other bins.
+# Slope and angular-fraction profiles require log bins. Defaults to log.
+# BinType = log
+
+# BinEdges are the increasing edges of the radial bins in units of the
+# normalization radius when BinType is explicit.
+# BinEdges = 0.1, 0.2, 0.5, 1, 1.5, 2, 3
+
+# BinNormalization is the radius that bins are measured relative to. It can be
+# set to R200m, Rsp, which reads each halo's splashback radius from column
+# RspColumn of the input catalog (e.g. from shellfish stats), or physical,
+# which measures RMinMult, RMaxMult, and BinEdges directly in the global
+# config's Units. Defaults to R200m.
+# BinNormalization = R200m
+
+# RspColumn is the 0-indexed column of the input catalog that contains R_sp
+# when BinNormalization is Rsp.
+# RspColumn = 6
+
+# Velocities adds velocity profiles to density, contained-density, and
+# bound-density profiles. If it is true, three more profiles are written after
+# the density profile: the radial velocity dispersion, sigma_r, the velocity
+# dispersion along each tangential direction, sigma_t, and the anisotropy
+# parameter, beta = 1 - sigma_t^2 / sigma_r^2. Velocities are measured
+# relative to the mean velocity of the particles inside R_200m and are in
+# whatever units the particle snapshots use. Bins without any particles are
+# set to NaN.
+# Velocities = false
+
+# RadialVelocity adds a profile of the mean radial velocity, <v_r>, to density,
+# contained-density, and bound-density profiles. It is written after any
+# profiles added by Velocities. The Hubble flow is included, so the infall
+# region is where <v_r> is negative and the zero-velocity surface is where it
+# first crosses zero outside the halo. Velocities are in km/s.
+# RadialVelocity = false
+
+# RestFrame is the frame that velocity profiles are measured in. It can be set
+# to particles, which uses the mean velocity of the particles inside R_200m,
+# or catalog, which uses the bulk velocity of each halo in the halo catalog.
+# catalog requires Vx, Vy, and Vz to be in the global config's HaloValueNames
+# and assumes that they're peculiar velocities in km/s. Defaults to particles.
+# RestFrame = particles
+
+# Slope adds the logarithmic slope of the density profile, dln(rho)/dln(r), to
+# every profile type except angular-fraction and median-error. If it is true,
+# the slope profile is written after any velocity profiles and is followed by
+# a single column giving the radius where the slope is most negative,
+# R_sp,prof. This is the profile-based splashback radius, which can be
+# compared to the shell-based R_sp from shellfish stats. Bins within half a
+# smoothing window of either end of the profile aren't considered when finding
+# R_sp,prof. Profiles with empty bins are given NaNs.
+# Slope = false
+
+# SmoothingWindow is the width of the smoothing window, in radial bins, used
+# to find the slope. It must be odd and smaller than Bins.
+# SmoothingWindow = 15
+
+# SmoothingKernel is the kernel used to smooth the log-density profile. It can
+# be set to savgol (a 4th order Savitzky-Golay filter), gaussian, or tophat.
+# SmoothingKernel = savgol
+
+# SmoothingSigma is the standard deviation of the Gaussian kernel in radial
+# bins. The kernel is truncated at SmoothingWindow. Only used when
+# SmoothingKernel = gaussian.
+# SmoothingSigma = 3
+
+# DK14Fit fits the profile of Diemer & Kravtsov (2014) to every profile type
+# except angular-fraction and median-error. This profile is an Einasto profile
+# multiplied by a steepening term, [1 + (r/r_t)^beta]^(-gamma/beta), plus an
+# outer term, rho_m [b_e (r / 5 R_200m)^(-s_e) + 1]. If it is true, the
+# best-fit rho_s, r_s, alpha, r_t, b_e, and s_e are written after any slope
+# profiles and are followed by a single column giving the radius where the
+# slope of the best-fit profile is most negative, R_sp,DK14. Fits are done in
+# ln(rho) with a Levenberg-Marquardt minimizer and empty bins are ignored.
+# Fits which fail are given NaNs.
+# DK14Fit = false
+
+# DK14Beta and DK14Gamma are the fixed values of beta and gamma used by DK14
+# fits. The defaults are the values recommended by Diemer & Kravtsov (2014).
+# DK14Beta = 4
+# DK14Gamma = 8
+
+# ProjectionAxis is the axis that projected-density profiles are projected
+# along. It can be set to x, y, z, or random, which projects each halo along a
+# different isotropically distributed direction.
+# ProjectionAxis = z
+
+# ProjectionDepthMult is half the length of the cylinder that is projected
+# when measuring projected-density profiles as a function of R_200m.
+# ProjectionDepthMult = 3
+
+# OrbitDecomposition splits density, contained-density, and bound-density
+# profiles into orbiting and infalling components. The particles within
+# RMaxMult*R200m of each halo are followed along its main branch from the
+# global config's SnapMin to the halo's snapshot in the same way as shellfish
+# orbit, and particles which have passed through a pericenter are orbiting.
+# Everything else is infalling. If it is true, the orbiting and infalling
+# density profiles are written after the profiles added by Velocities and
+# RadialVelocity, followed by orbiting and then infalling versions of each of
+# those velocity profiles. This requires merger trees and reads every
+# snapshot, so it is expensive. Halos without a main branch are given NaNs.
+# OrbitDecomposition = false
+
+# OrbitSearchRadiusMult is the radius, in units of R200m, around each main
+# progenitor that tracked particles are looked for. Particles further away
+# are assumed to be infalling. It can't be smaller than RMaxMult.
+# OrbitSearchRadiusMult = 4
+
+# Stack replaces the per-halo profiles with stacked profiles. Halos are
+# grouped by M200m and accretion rate, Gamma, and each line of the output
+# gives the mean and median density profiles of one group, along with
+# bootstrap errors on both. M200m is found from R200m. Profiles are stacked in
+# units of the normalization radius (see BinNormalization), so the R column is
+# in units of R200m or R_sp unless BinNormalization is physical. Stack can't be
+# combined with other options that add columns, and median-error and
+# angular-fraction profiles can't be stacked.
+# Stack = false
+
+# StackMassEdges and StackGammaEdges are the edges of the M200m and Gamma bins
+# used by Stack. Masses are in Msun/h. Every combination of a mass bin and a
+# Gamma bin is a group, and halos outside every bin are ignored. If either is
+# empty, halos aren't split along that axis. Binning by Gamma requires the
+# input catalog to have a Gamma column, such as the one added by shellfish
+# gamma.
+# StackMassEdges = 1e12, 1e13, 1e14, 1e15
+# StackGammaEdges = 0, 1, 2, 3, 6
+
+# StackSamples is the number of bootstrap samples used to find the errors on
+# stacked profiles.
+# StackSamples = 200
+
+# StackCovariance adds the covariance matrix of each group's mean profile to
+# stacked profiles. It is estimated by jackknifing over the regions set by
+# StackJackknife, and is written after the median profile's errors as a
+# row-major Bins x Bins block. The covariance is in the square of the units
+# of the mean profile. Groups with fewer than two regions are given NaNs.
+# StackCovariance = false
+
+# StackJackknife is the region removed from each jackknife sample when
+# StackCovariance is true. It can be set to halos, which leaves out one halo at
+# a time, or octants, which leaves out the halos in one octant of the box at a
+# time, so that halos which share large-scale structure aren't treated as
+# independent. Defaults to halos.
+# StackJackknife = halos
+
+# SubhaloVmaxMin is the minimum Vmax of the halos counted by subhalo-density
+# profiles, in whatever units your halo catalog uses. If it is positive, Vmax
+# must be included in HaloValueNames. Defaults to 0, which counts every halo.
+# SubhaloVmaxMin = 0
+
+# HDF5File is the name of an HDF5 file that per-halo profiles are also
+# written to, which is easier to work with than the wide rows of the text
+# output when there are many bins. The file contains the datasets id and
+# snapshot, and a group for each halo, halo_<ID>_<Snapshot>, which contains a
+# dataset for every other output column of the halo. Each dataset is named
+# after its column without its units (e.g. R, Rho, or Slope). Groups for
+# missing halos aren't written. Units are the same as in the text output. The
+# file can be read with h5py or version 1.8 or later of the HDF5 library. No
+# file is written if HDF5File isn't set or if Stack is true.
+# HDF5File = ""
 `
 }
 
@@ -108,8 +327,34 @@ func (config *ProfConfig) ReadConfig(fname string, flags []string) error {
 	vars.Int(&config.samples, "Samples", 50 * 1000)
 	vars.Float(&config.rMaxMult, "RMaxMult", 3.0)
 	vars.Float(&config.rMinMult, "RMinMult", 0.03)
+	vars.String(&config.binType, "BinType", "log")
+	vars.Floats(&config.edgeMults, "BinEdges", []float64{})
+	vars.String(&config.binNormalization, "BinNormalization", "R200m")
+	vars.Int(&config.rspColumn, "RspColumn", 6)
 	vars.Int(&config.medianPixelLevel, "MedianPixelLevel", 3)
 	vars.Float(&config.percentile, "Percentile", 50)
+	vars.Bool(&config.velocities, "Velocities", false)
+	vars.Bool(&config.radialVelocity, "RadialVelocity", false)
+	vars.String(&config.restFrame, "RestFrame", "particles")
+	vars.Bool(&config.slope, "Slope", false)
+	vars.Int(&config.smoothingWindow, "SmoothingWindow", 15)
+	vars.String(&config.smoothingKernel, "SmoothingKernel", "savgol")
+	vars.Float(&config.smoothingSigma, "SmoothingSigma", 3)
+	vars.Bool(&config.dk14Fit, "DK14Fit", false)
+	vars.Float(&config.dk14Beta, "DK14Beta", 4)
+	vars.Float(&config.dk14Gamma, "DK14Gamma", 8)
+	vars.String(&config.projectionAxis, "ProjectionAxis", "z")
+	vars.Float(&config.projectionDepthMult, "ProjectionDepthMult", 3)
+	vars.Bool(&config.orbits, "OrbitDecomposition", false)
+	vars.Float(&config.orbitSearchRadiusMult, "OrbitSearchRadiusMult", 4)
+	vars.Bool(&config.stack, "Stack", false)
+	vars.Floats(&config.stackMassEdges, "StackMassEdges", []float64{})
+	vars.Floats(&config.stackGammaEdges, "StackGammaEdges", []float64{})
+	vars.Int(&config.stackSamples, "StackSamples", 200)
+	vars.Bool(&config.stackCovariance, "StackCovariance", false)
+	vars.String(&config.stackJackknife, "StackJackknife", "halos")
+	vars.Float(&config.subhaloVmaxMin, "SubhaloVmaxMin", 0)
+	vars.String(&config.hdf5File, "HDF5File", "")
 	var pType string
 	vars.String(&pType, "ProfileType", "")
 
@@ -147,6 +392,10 @@ func (config *ProfConfig) ReadConfig(fname string, flags []string) error {
 		config.pType = angularFractionProfile
 	case "bound-density":
 		config.pType = boundDensityProfile
+	case "projected-density":
+		config.pType = projectedDensityProfile
+	case "subhalo-density":
+		config.pType = subhaloDensityProfile
 	default:
 		return fmt.Errorf("The varaiable 'ProfileType' was set to '%s'.", pType)
 	}
@@ -155,20 +404,228 @@ func (config *ProfConfig) ReadConfig(fname string, flags []string) error {
 }
 
 func (config *ProfConfig) validate() error {
+	if err := config.validateBins(); err != nil {
+		return err
+	}
+
 	if config.bins < 0 {
 		return fmt.Errorf("The variable '%s' was set to %d.",
 			"Bins", config.bins)
-	} else if config.rMinMult <= 0 {
+	} else if config.rMinMult < 0 ||
+		(config.rMinMult == 0 && config.binType == "log") {
 		return fmt.Errorf("The variable '%s' was set to %g.",
 			"RMinMult", config.rMinMult)
-	} else if config.rMaxMult <= 0 {
-		return fmt.Errorf("The variable '%s' was set to %g.",
+	} else if config.rMaxMult <= config.rMinMult {
+		return fmt.Errorf("The variable '%s' was set to %g, but it must "+
+			"be larger than '%s', which is %g.", "RMaxMult", config.rMaxMult,
 			"RMinMult", config.rMinMult)
 	} else if config.medianPixelLevel < 0 {
 		return fmt.Errorf("The variable '%s' was set to %g.",
 			"MedianPixelLevel", config.medianPixelLevel)
 	}
 
+	switch config.pType {
+	case densityProfile, containedDensityProfile, boundDensityProfile:
+	default:
+		if config.velocities || config.radialVelocity {
+			return fmt.Errorf("Velocity profiles were requested, but " +
+				"velocity profiles can only be measured when " +
+				"ProfileType is density, contained-density, or " +
+				"bound-density.")
+		}
+	}
+
+	switch config.pType {
+	case densityProfile, containedDensityProfile, boundDensityProfile:
+	default:
+		if config.orbits {
+			return fmt.Errorf("The variable 'OrbitDecomposition' was set " +
+				"to true, but profiles can only be decomposed when " +
+				"ProfileType is density, contained-density, or " +
+				"bound-density.")
+		}
+	}
+	if config.orbits && config.binNormalization == "R200m" &&
+		config.orbitSearchRadiusMult < config.rMaxMult {
+		return fmt.Errorf("The variable '%s' was set to %g, but it can't "+
+			"be smaller than '%s', which is %g.", "OrbitSearchRadiusMult",
+			config.orbitSearchRadiusMult, "RMaxMult", config.rMaxMult)
+	}
+
+	switch config.restFrame {
+	case "particles", "catalog":
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but the only "+
+			"supported values are particles and catalog.", "RestFrame",
+			config.restFrame)
+	}
+
+	switch config.projectionAxis {
+	case "x", "y", "z", "random":
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but the only "+
+			"supported values are x, y, z, and random.", "ProjectionAxis",
+			config.projectionAxis)
+	}
+	if config.projectionDepthMult <= 0 {
+		return fmt.Errorf("The variable '%s' was set to %g, but it must "+
+			"be positive.", "ProjectionDepthMult", config.projectionDepthMult)
+	}
+
+	if config.stack {
+		if err := config.validateStack(); err != nil {
+			return err
+		}
+	}
+
+	if config.dk14Fit {
+		switch {
+		case config.pType == angularFractionProfile ||
+			config.pType == medianErrorProfile ||
+			config.pType == projectedDensityProfile ||
+			config.pType == subhaloDensityProfile:
+			return fmt.Errorf("The variable 'DK14Fit' was set to true, but " +
+				"profiles can't be fit when ProfileType is angular-fraction, " +
+				"median-error, projected-density, or subhalo-density.")
+		case config.dk14Beta <= 0:
+			return fmt.Errorf("The variable '%s' was set to %g, but it must "+
+				"be positive.", "DK14Beta", config.dk14Beta)
+		case config.dk14Gamma <= 0:
+			return fmt.Errorf("The variable '%s' was set to %g, but it must "+
+				"be positive.", "DK14Gamma", config.dk14Gamma)
+		}
+	}
+
+	if !config.slope {
+		return nil
+	}
+
+	switch {
+	case config.pType == angularFractionProfile ||
+		config.pType == medianErrorProfile ||
+		config.pType == projectedDensityProfile:
+		return fmt.Errorf("The variable 'Slope' was set to true, but " +
+			"slopes can't be measured when ProfileType is angular-fraction, " +
+			"median-error, or projected-density.")
+	case config.binType != "log":
+		return fmt.Errorf("The variable 'Slope' was set to true, but " +
+			"slopes can only be measured when 'BinType' is log.")
+	case config.smoothingWindow <= 0 || config.smoothingWindow%2 != 1:
+		return fmt.Errorf("The variable '%s' was set to %d, but it must "+
+			"be odd and positive.", "SmoothingWindow", config.smoothingWindow)
+	case config.smoothingWindow >= config.bins:
+		return fmt.Errorf("The variable '%s' was set to %d, but it must "+
+			"be smaller than '%s', which is %d.", "SmoothingWindow",
+			config.smoothingWindow, "Bins", config.bins)
+	case config.smoothingSigma <= 0:
+		return fmt.Errorf("The variable '%s' was set to %g, but it must "+
+			"be positive.", "SmoothingSigma", config.smoothingSigma)
+	}
+
+	switch config.smoothingKernel {
+	case "savgol":
+		if config.smoothingWindow <= 4 {
+			return fmt.Errorf("The variable '%s' was set to %d, but it "+
+				"must be larger than 4 when '%s' is 'savgol'.",
+				"SmoothingWindow", config.smoothingWindow, "SmoothingKernel")
+		}
+	case "gaussian", "tophat":
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but it must "+
+			"be one of 'savgol', 'gaussian', or 'tophat'.",
+			"SmoothingKernel", config.smoothingKernel)
+	}
+
+	return nil
+}
+
+// validateStack checks the variables used by Stack.
+func (config *ProfConfig) validateStack() error {
+	switch {
+	case config.pType == angularFractionProfile ||
+		config.pType == medianErrorProfile:
+		return fmt.Errorf("The variable 'Stack' was set to true, but " +
+			"angular-fraction and median-error profiles can't be stacked.")
+	case config.velocities || config.radialVelocity || config.slope ||
+		config.dk14Fit || config.orbits:
+		return fmt.Errorf("The variable 'Stack' was set to true, but it " +
+			"can't be combined with Velocities, RadialVelocity, Slope, " +
+			"DK14Fit, or OrbitDecomposition.")
+	case config.stackSamples <= 0:
+		return fmt.Errorf("The variable '%s' was set to %d, but it must "+
+			"be positive.", "StackSamples", config.stackSamples)
+	}
+
+	switch config.stackJackknife {
+	case "halos", "octants":
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but the only "+
+			"supported values are halos and octants.", "StackJackknife",
+			config.stackJackknife)
+	}
+
+	edgeSets := [][]float64{config.stackMassEdges, config.stackGammaEdges}
+	for i, name := range []string{"StackMassEdges", "StackGammaEdges"} {
+		edges := edgeSets[i]
+		if len(edges) == 1 {
+			return fmt.Errorf("The variable '%s' was set to %g, but it "+
+				"must have at least two edges.", name, edges)
+		}
+		for j := 1; j < len(edges); j++ {
+			if edges[j] <= edges[j-1] {
+				return fmt.Errorf("The variable '%s' was set to %g, but "+
+					"the edges must be increasing.", name, edges)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateBins checks the binning variables and sets Bins, RMinMult, and
+// RMaxMult from BinEdges when BinType is explicit.
+func (config *ProfConfig) validateBins() error {
+	switch config.binType {
+	case "log", "linear":
+	case "explicit":
+		edges := config.edgeMults
+		if len(edges) < 2 {
+			return fmt.Errorf("The variable 'BinType' was set to " +
+				"explicit, but 'BinEdges' doesn't have at least two edges.")
+		}
+		for i := 1; i < len(edges); i++ {
+			if edges[i] <= edges[i-1] {
+				return fmt.Errorf("The variable 'BinEdges' was set to %g, "+
+					"but the edges must be increasing.", edges)
+			}
+		}
+		config.bins = int64(len(edges) - 1)
+		config.rMinMult, config.rMaxMult = edges[0], edges[len(edges)-1]
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but it must "+
+			"be one of 'log', 'linear', or 'explicit'.", "BinType",
+			config.binType)
+	}
+
+	switch config.binNormalization {
+	case "R200m", "physical":
+	case "Rsp":
+		if config.rspColumn < 2 {
+			return fmt.Errorf("The variable '%s' was set to %d, but "+
+				"columns 0 and 1 are the ID and snapshot.", "RspColumn",
+				config.rspColumn)
+		}
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but it must "+
+			"be one of 'R200m', 'Rsp', or 'physical'.", "BinNormalization",
+			config.binNormalization)
+	}
+
+	if config.pType == angularFractionProfile && config.binType != "log" {
+		return fmt.Errorf("The variable 'BinType' was set to '%s', but " +
+			"angular-fraction profiles require log bins.", config.binType)
+	}
+
 	return nil
 }
 
@@ -194,12 +651,14 @@ func (config *ProfConfig) Run(
 		vCoords [][]float64
 		scaleRs []float64
 		masses  []float64
+		coeffs [][]float64
 		shells []analyze.Shell
 		err error
 	)
 
 	switch config.pType {
-	case densityProfile, medianDensityProfile, medianErrorProfile:
+	case densityProfile, medianDensityProfile, medianErrorProfile,
+		projectedDensityProfile, subhaloDensityProfile:
 		intColIdxs := []int{0, 1}
 		floatColIdxs := []int{2, 3, 4, 5}
 		
@@ -235,16 +694,8 @@ func (config *ProfConfig) Run(
 		}
 
 		coords = floatCols[:4]
-		coeffs := floatCols[4:]
+		coeffs = floatCols[4:]
 		shells = make([]analyze.Shell, len(coords[0]))
-		for i := range shells {
-			coeffVec := make([]float64, len(coeffs))
-			for j := range coeffVec {
-				coeffVec[j] = coeffs[j][i]
-			}
-			order := int(config.order)
-			shells[i] = analyze.PennaFunc(coeffVec, order, order, 2)
-		}
 
 		scaleRs = make([]float64, len(coords[0]))
 		masses = make([]float64, len(coords[0]))
@@ -279,8 +730,55 @@ func (config *ProfConfig) Run(
 	ids, snaps := intCols[0], intCols[1]
 	snapBins, idxBins := binBySnap(snaps, ids)
 
+	buf, err := getVectorBuffer(
+		e.ParticleCatalog(snaps[0], 0), gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Positions, radii, and shell coefficients are all lengths.
+	inCols := append([][]float64{scaleRs}, coords...)
+	inCols = append(inCols, coeffs...)
+	inKinds := repeatKind(lengthUnit, len(inCols))
+	if config.pType == boundDensityProfile {
+		inCols, inKinds = append(inCols, masses), append(inKinds, massUnit)
+	}
+	err = readInputUnits(stdin, snaps, inCols, inKinds, buf, e)
+	if err != nil {
+		return nil, err
+	}
+	uc, err := newUnitConverter(gConfig.Units, snaps, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range shells {
+		if coeffs == nil {
+			break
+		}
+		coeffVec := make([]float64, len(coeffs))
+		for j := range coeffVec {
+			coeffVec[j] = coeffs[j][i]
+		}
+		order := int(config.order)
+		shells[i] = analyze.PennaFunc(coeffVec, order, order, 2)
+	}
+
+	norms, err := config.binNorms(stdin, snaps, coords[3], buf, e, uc)
+	if err != nil {
+		return nil, err
+	}
+
 	if config.pType == angularFractionProfile {
-		return angularFractionMain(ids, snaps, shells, coords[3], config)
+		return angularFractionMain(
+			ids, snaps, shells, norms, config, uc,
+		)
+	}
+
+	edgeSets := make([][]float64, len(ids))
+	for i := range edgeSets {
+		edgeSets[i] = config.binEdges(norms[i])
 	}
 
 	// Profiles for everyone
@@ -291,6 +789,60 @@ func (config *ProfConfig) Run(
 		rhoSets[i] = make([]float64, config.bins)
 	}
 
+	// Velocity sums for every radial bin and for the particles inside R200m,
+	// which give each halo's bulk velocity. hubbleFlows converts comoving
+	// distances to Hubble flow velocities at each halo's snapshot.
+	var vBinSets [][]velocityBin
+	var bulkBins []velocityBin
+	var hubbleFlows []float64
+	if config.velocities || config.radialVelocity {
+		vBinSets = make([][]velocityBin, len(ids))
+		bulkBins = make([]velocityBin, len(ids))
+		hubbleFlows = make([]float64, len(ids))
+		for i := range vBinSets {
+			vBinSets[i] = make([]velocityBin, config.bins)
+		}
+	}
+
+	// The orbiting particles around each halo and their profiles.
+	var orbSets []*orbitBins
+	if config.orbits {
+		orbSets, err = config.orbitBinSets(
+			ids, snaps, edgeSets, coords[3], vBinSets != nil, buf, e, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The comoving mean density at each halo's snapshot, for DK14 fits and
+	// for finding the masses of stacked halos.
+	var rhoMs []float64
+	if config.dk14Fit || config.stack {
+		rhoMs = make([]float64, len(ids))
+	}
+
+	// The jackknife region of each halo, for the covariances of stacked
+	// profiles.
+	var regions []int
+	if config.stack && config.stackCovariance {
+		regions = make([]int, len(ids))
+		for i := range regions {
+			regions[i] = i
+		}
+	}
+
+	// Projection axes and the mass projected inside rMin for the
+	// projected-density mode.
+	var (
+		axes [][3]float64
+		innerMasses []float64
+	)
+	if config.pType == projectedDensityProfile {
+		axes = config.projectionAxes(len(ids))
+		innerMasses = make([]float64, len(ids))
+	}
+
 	// Workspace buffers just for the median-density mode.
 	var (
 		medRhoSets [][][]float64
@@ -317,13 +869,6 @@ func (config *ProfConfig) Run(
 		sortedSnaps = append(sortedSnaps, snap)
 	}
 	sort.Ints(sortedSnaps)
-	
-	buf, err := getVectorBuffer(
-		e.ParticleCatalog(snaps[0], 0), gConfig,
-	)
-	if err != nil {
-		return nil, err
-	}
 
 	// Count number of workers
 
@@ -364,21 +909,67 @@ func (config *ProfConfig) Run(
 		if err != nil {
 			return nil, err
 		}
+		if hubbleFlows != nil {
+			c := &hds[0].Cosmo
+			h := 100 * cosmo.HubbleFrac(c.OmegaM, c.OmegaL, c.Z) / (1 + c.Z)
+			for _, idx := range idxs {
+				hubbleFlows[idx] = h
+			}
+		}
+		if rhoMs != nil {
+			c := &hds[0].Cosmo
+			rhoM := cosmo.RhoAverage(100, c.OmegaM, c.OmegaL, 0)
+			for _, idx := range idxs {
+				rhoMs[idx] = rhoM
+			}
+		}
+		if regions != nil && config.stackJackknife == "octants" {
+			for _, idx := range idxs {
+				regions[idx] = boxOctant(
+					coords[0][idx], coords[1][idx], coords[2][idx],
+					hds[0].TotalWidth,
+				)
+			}
+		}
+		if config.pType == subhaloDensityProfile {
+			err := config.insertSubhalos(
+				rhoSets, edgeSets, coords, ids, idxs, snap, &hds[0],
+				buf, e, gConfig,
+			)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		hBounds, err := extendedBoundingSpheres(snapCoords, &hds[0], e)
 		if err != nil {
 			return nil, err
 		}
 
-		for i := range hBounds { hBounds[i].S.R *= float32(config.rMaxMult) }
+		// Spheres are grown to contain the outermost bin. Projected profiles
+		// include particles out to the corners of the projected cylinder.
+		boundMults := make([]float32, len(idxs))
+		for i, idx := range idxs {
+			edges := edgeSets[idx]
+			mult := edges[len(edges)-1] / coords[3][idx]
+			if config.pType == projectedDensityProfile {
+				mult = math.Sqrt(mult*mult +
+					config.projectionDepthMult*config.projectionDepthMult)
+			}
+			boundMults[i] = float32(mult)
+		}
+
+		for i := range hBounds { hBounds[i].S.R *= boundMults[i] }
 		_, intrIdxs := binExtendedSphereIntersections(hds, hBounds)
-		for i := range hBounds { hBounds[i].S.R /= float32(config.rMaxMult) }
+		for i := range hBounds { hBounds[i].S.R /= boundMults[i] }
 		
 		for i := range hds {
 			if len(intrIdxs[i]) == 0 {
 				continue
 			}
 
-			xs, vs, ms, _, err := buf.Read(files[i])
+			xs, vs, ms, pIDs, err := buf.Read(files[i])
 			if err != nil { return nil, err }
 			
 			lg := NewLockGroup(workers)
@@ -390,18 +981,34 @@ func (config *ProfConfig) Run(
 						j := intrIdxs[i][jj]
 						
 						rhos := rhoSets[idxs[j]]
+						edges := edgeSets[idxs[j]]
 						s := hBounds[j]
 						
 						if config.pType == medianDensityProfile ||
 							config.pType == medianErrorProfile {
 							medRhos := medRhoSets[idxs[j]]
 							insertMedianPoints(
-								medRhos, s, xs, ms, config, &hds[i],
+								medRhos, edges, s, xs, ms, config, &hds[i],
+							)
+						} else if config.pType == projectedDensityProfile {
+							insertProjectedPoints(
+								rhos, &innerMasses[idxs[j]], edges, s, xs, ms,
+								axes[idxs[j]], config, &hds[i],
 							)
 						} else {
+							var vBins []velocityBin
+							var bulk *velocityBin
+							var orb *orbitBins
+							if vBinSets != nil {
+								vBins = vBinSets[idxs[j]]
+								bulk = &bulkBins[idxs[j]]
+							}
+							if orbSets != nil {
+								orb = orbSets[idxs[j]]
+							}
 							insertPoints(
-								rhos, s, xs, vs, ms,
-								shells[idxs[j]], config, &hds[i],
+								rhos, vBins, bulk, orb, edges, s, xs, vs, ms,
+								pIDs, shells[idxs[j]], config, &hds[i],
 							)
 						}
 					}
@@ -413,62 +1020,733 @@ func (config *ProfConfig) Run(
 			lg.Synchronize()
 			
 			buf.Close()
-
-			return nil, nil
 		}
 	}
 	
+	var deltaSigmaSets [][]float64
+	if config.pType == projectedDensityProfile {
+		deltaSigmaSets = make([][]float64, len(ids))
+		for i := range deltaSigmaSets {
+			deltaSigmaSets[i] = make([]float64, config.bins)
+		}
+	}
+
 	for i := range rSets {
-		rMax := coords[3][i]*config.rMaxMult
-		rMin := coords[3][i]*config.rMinMult
+		edges := edgeSets[i]
+		rSets[i] = config.binCenters(edges)
 		if config.pType == medianDensityProfile {
-			processMedianProfile(rSets[i], rhoSets[i],
-				medRhoSets[i], medScratchBuffer, rMin, rMax,
+			processMedianProfile(rhoSets[i],
+				medRhoSets[i], medScratchBuffer, edges,
 				config.percentile,
 			)
 		} else if config.pType == medianErrorProfile {
-			processMedianErrorProfile(rSets[i], rhoSets[i],
-				medRhoSets[i], medScratchBuffer, rMin, rMax,
+			processMedianErrorProfile(rhoSets[i],
+				medRhoSets[i], medScratchBuffer, edges,
 				config.percentile, config.samples,
 			)
+		} else if config.pType == projectedDensityProfile {
+			processProjectedProfile(rSets[i], rhoSets[i],
+				deltaSigmaSets[i], innerMasses[i], edges,
+			)
 		} else {
-			processProfile(rSets[i], rhoSets[i], rMin, rMax)
+			processProfile(rhoSets[i], edges)
 		}
 	}
 
+	if config.stack {
+		return config.stackMain(
+			ids, snaps, rhoSets, coords[3], rhoMs, regions, stdin, uc,
+		)
+	}
+
+	var orbRhoSets, infRhoSets [][]float64
+	if config.orbits {
+		orbRhoSets, infRhoSets = orbitDensityProfiles(
+			orbSets, rhoSets, edgeSets,
+		)
+	}
+
+	var slopeSets [][]float64
+	var rsps []float64
+	if config.slope {
+		slopeSets, rsps = config.slopeProfiles(rSets, rhoSets)
+	}
+	var dk14Cols [][]float64
+	if config.dk14Fit {
+		dk14Cols = config.dk14Fits(rSets, rhoSets, coords[3], rhoMs)
+	}
+
 	rSets = transpose(rSets)
 	rhoSets = transpose(rhoSets)
 
-	order := make([]int, len(rSets) + len(rhoSets) + 2)
-	for i := range order { order[i] = i }
-	lines := catalog.FormatCols(
-			[][]int{ids, snaps}, append(rSets, rhoSets...), order,
+	uc.convert(snaps, rSets, repeatKind(lengthUnit, len(rSets)))
+
+	bins := int(config.bins)
+	var (
+		cols [][]float64
+		names []string
+		sizes []int
 	)
+	if config.pType == projectedDensityProfile {
+		deltaSigmaSets = transpose(deltaSigmaSets)
+		kinds := repeatKind(surfaceDensityUnit, len(rhoSets))
+		uc.convert(snaps, rhoSets, kinds)
+		uc.convert(snaps, deltaSigmaSets, kinds)
+
+		cols = append(rSets, rhoSets...)
+		cols = append(cols, deltaSigmaSets...)
+		names = []string{
+			"ID", "Snapshot", "R [cMpc/h]", "Sigma [h Msun/cpc^2]",
+			"DeltaSigma [h Msun/cpc^2]",
+		}
+		sizes = []int{1, 1, bins, bins, bins}
+	} else if config.pType == subhaloDensityProfile {
+		kinds := repeatKind(numberDensityUnit, len(rhoSets))
+		uc.convert(snaps, rhoSets, kinds)
+
+		cols = append(rSets, rhoSets...)
+		names = []string{
+			"ID", "Snapshot", "R [cMpc/h]", "n_sub [h^3/cMpc^3]",
+		}
+		sizes = []int{1, 1, bins, bins}
+	} else {
+		uc.convert(snaps, rhoSets, repeatKind(densityUnit, len(rhoSets)))
+
+		cols = append(rSets, rhoSets...)
+		names = []string{
+			"ID", "Snapshot", "R [cMpc/h]", "Rho [h^2 Msun/cMpc^3]",
+		}
+		sizes = []int{1, 1, bins, bins}
+	}
+	var bulks [][3]float64
+	if vBinSets != nil {
+		bulks, err = config.restFrameVelocities(
+			ids, snaps, bulkBins, buf, e, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+		cols, names, sizes = config.appendVelocityProfiles(
+			cols, names, sizes, vBinSets, bulks, hubbleFlows, "",
+		)
+	}
+	if config.orbits {
+		orbRhoSets, infRhoSets = transpose(orbRhoSets), transpose(infRhoSets)
+		kinds := repeatKind(densityUnit, len(orbRhoSets))
+		uc.convert(snaps, orbRhoSets, kinds)
+		uc.convert(snaps, infRhoSets, kinds)
+
+		cols = append(cols, orbRhoSets...)
+		cols = append(cols, infRhoSets...)
+		names = append(names,
+			"Rho_orb [h^2 Msun/cMpc^3]", "Rho_inf [h^2 Msun/cMpc^3]",
+		)
+		sizes = append(sizes, bins, bins)
+
+		if vBinSets != nil {
+			orbVBinSets, infVBinSets := orbitVelocityBins(orbSets, vBinSets)
+			cols, names, sizes = config.appendVelocityProfiles(
+				cols, names, sizes, orbVBinSets, bulks, hubbleFlows, ",orb",
+			)
+			cols, names, sizes = config.appendVelocityProfiles(
+				cols, names, sizes, infVBinSets, bulks, hubbleFlows, ",inf",
+			)
+		}
+	}
+	if config.slope {
+		uc.convert(snaps, [][]float64{rsps}, []unitKind{lengthUnit})
+		cols = append(cols, transpose(slopeSets)...)
+		cols = append(cols, rsps)
+		names = append(names, "Slope", "R_sp,prof [cMpc/h]")
+		sizes = append(sizes, bins, 1)
+	}
+	if config.dk14Fit {
+		dk14Names := []string{
+			"rho_s [h^2 Msun/cMpc^3]", "r_s [cMpc/h]", "alpha",
+			"r_t [cMpc/h]", "b_e", "s_e", "R_sp,DK14 [cMpc/h]",
+		}
+		uc.convert(snaps, dk14Cols, labelKinds(dk14Names))
+		cols = append(cols, dk14Cols...)
+		names = append(names, dk14Names...)
+		for range dk14Names {
+			sizes = append(sizes, 1)
+		}
+	}
+
+	order := make([]int, len(cols) + 2)
+	for i := range order { order[i] = i }
+	lines := catalog.FormatCols([][]int{ids, snaps}, cols, order)
 	
-	cString := catalog.CommentString(
-		[]string{"ID", "Snapshot", "R [cMpc/h]", "Rho [h^2 Msun/cMpc^3]"},
-		[]string{}, []int{0, 1, 2, 3},
-		[]int{1, 1, int(config.bins), int(config.bins)},
-	)
+	nameOrder := make([]int, len(names))
+	for i := range names {
+		nameOrder[i] = i
+	}
+	relabelColumns(gConfig.Units, names)
+	cString := catalog.CommentString(names, []string{}, nameOrder, sizes)
+
+	if config.hdf5File != "" {
+		f, err := os.Create(config.hdf5File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		arrays := profileArrays(ids, snaps, cols, names, sizes)
+		if err = io.WriteHDF5(f, arrays); err != nil {
+			return nil, err
+		}
+	}
 
 	if logging.Mode == logging.Performance {
 		log.Printf("Time: %s", time.Since(t).String())
 		log.Printf("Memory:\n%s", logging.MemString())
 	}
 
-	return append([]string{cString}, lines...), nil
+	return append([]string{uc.unitsString(), cString}, lines...), nil
 }
 
-// rhos is a buffer and will be cleared before use
+// profileArrays splits the output columns of prof into one array for each
+// profile of each halo. names and sizes are the names and sizes of the ID and
+// Snapshot columns followed by those of each group of columns in cols.
+func profileArrays(
+	ids, snaps []int, cols [][]float64, names []string, sizes []int,
+) []io.NpyArray {
+	ids64, snaps64 := []int64{}, []int64{}
+	for i := range ids {
+		if snaps[i] != -1 {
+			ids64 = append(ids64, int64(ids[i]))
+			snaps64 = append(snaps64, int64(snaps[i]))
+		}
+	}
+
+	arrays := []io.NpyArray{
+		{Name: "id", Shape: []int{len(ids64)}, Data: ids64},
+		{Name: "snapshot", Shape: []int{len(snaps64)}, Data: snaps64},
+	}
+	for i := range ids {
+		if snaps[i] == -1 {
+			continue
+		}
+		col := 0
+		for k := 2; k < len(names); k++ {
+			name := names[k]
+			if end := strings.Index(name, " ["); end != -1 {
+				name = name[:end]
+			}
+
+			data := make([]float64, sizes[k])
+			for j := range data {
+				data[j] = cols[col+j][i]
+			}
+			col += sizes[k]
+
+			arrays = append(arrays, io.NpyArray{
+				Name:  fmt.Sprintf("halo_%d_%d/%s", ids[i], snaps[i], name),
+				Shape: []int{sizes[k]},
+				Data:  data,
+			})
+		}
+	}
+
+	return arrays
+}
+
+// appendVelocityProfiles appends the velocity profiles requested by
+// Velocities and RadialVelocity to the output columns, along with their names
+// and sizes. suffix is added to the name of each profile.
+func (config *ProfConfig) appendVelocityProfiles(
+	cols [][]float64, names []string, sizes []int,
+	vBinSets [][]velocityBin, bulks [][3]float64, hubbleFlows []float64,
+	suffix string,
+) ([][]float64, []string, []int) {
+	bins := int(config.bins)
+	vrSets, sigRSets, sigTSets, betaSets := velocityProfiles(
+		vBinSets, bulks, hubbleFlows,
+	)
+	if config.velocities {
+		cols = append(cols, transpose(sigRSets)...)
+		cols = append(cols, transpose(sigTSets)...)
+		cols = append(cols, transpose(betaSets)...)
+		names = append(names,
+			"Sigma_r"+suffix, "Sigma_t"+suffix, "Beta"+suffix,
+		)
+		sizes = append(sizes, bins, bins, bins)
+	}
+	if config.radialVelocity {
+		cols = append(cols, transpose(vrSets)...)
+		names = append(names, "V_r"+suffix+" [km/s]")
+		sizes = append(sizes, bins)
+	}
+	return cols, names, sizes
+}
+
+// orbitBins holds the profiles of the orbiting particles around a halo.
+// orbiting is nil if the halo's orbits couldn't be tracked.
+type orbitBins struct {
+	orbiting map[int64]bool
+	rhos     []float64
+	vBins    []velocityBin
+}
+
+// orbitBinSets tracks the orbits of the particles in the bins around each
+// halo and returns empty orbitBins for them. edgeSets are the halos' bin
+// edges and r200ms are their radii. Velocity bins are only allocated if
+// velocities is true.
+func (config *ProfConfig) orbitBinSets(
+	ids, snaps []int, edgeSets [][]float64, r200ms []float64,
+	velocities bool,
+	buf io.VectorBuffer, e *env.Environment, gConfig *GlobalConfig,
+) ([]*orbitBins, error) {
+	trackMult := 0.0
+	for i, edges := range edgeSets {
+		if snaps[i] != -1 {
+			trackMult = math.Max(trackMult, edges[len(edges)-1]/r200ms[i])
+		}
+	}
+	if config.orbitSearchRadiusMult < trackMult {
+		return nil, fmt.Errorf("The variable '%s' was set to %g, but "+
+			"the outermost bin extends to %g R200m.",
+			"OrbitSearchRadiusMult", config.orbitSearchRadiusMult, trackMult)
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	_, trackers, err := trackOrbits(
+		ids, snaps, trackMult, config.orbitSearchRadiusMult,
+		vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	orbSets := make([]*orbitBins, len(ids))
+	for i := range orbSets {
+		orbSets[i] = &orbitBins{rhos: make([]float64, config.bins)}
+		if trackers[i] != nil {
+			orbSets[i].orbiting = trackers[i].Orbiting()
+		}
+		if velocities {
+			orbSets[i].vBins = make([]velocityBin, config.bins)
+		}
+	}
+	return orbSets, nil
+}
+
+// orbitDensityProfiles returns the orbiting and infalling density profiles of
+// every halo. rhoSets are the processed density profiles of all the particles
+// and edgeSets are the halos' bin edges. Halos whose orbits weren't tracked
+// are given NaNs.
+func orbitDensityProfiles(
+	orbSets []*orbitBins, rhoSets, edgeSets [][]float64,
+) (orbRhoSets, infRhoSets [][]float64) {
+	orbRhoSets = make([][]float64, len(orbSets))
+	infRhoSets = make([][]float64, len(orbSets))
+	for i, orb := range orbSets {
+		orbRhoSets[i] = orb.rhos
+		infRhoSets[i] = make([]float64, len(rhoSets[i]))
+		if orb.orbiting == nil {
+			for j := range orbRhoSets[i] {
+				orbRhoSets[i][j], infRhoSets[i][j] = math.NaN(), math.NaN()
+			}
+			continue
+		}
+
+		processProfile(orbRhoSets[i], edgeSets[i])
+		for j := range infRhoSets[i] {
+			infRhoSets[i][j] = rhoSets[i][j] - orbRhoSets[i][j]
+		}
+	}
+	return orbRhoSets, infRhoSets
+}
+
+// orbitVelocityBins returns the velocity bins of the orbiting and infalling
+// particles around every halo. vBinSets are the velocity bins of all the
+// particles. Halos whose orbits weren't tracked are given empty bins.
+func orbitVelocityBins(
+	orbSets []*orbitBins, vBinSets [][]velocityBin,
+) (orbVBinSets, infVBinSets [][]velocityBin) {
+	orbVBinSets = make([][]velocityBin, len(orbSets))
+	infVBinSets = make([][]velocityBin, len(orbSets))
+	for i, orb := range orbSets {
+		n := len(vBinSets[i])
+		orbVBinSets[i] = make([]velocityBin, n)
+		infVBinSets[i] = make([]velocityBin, n)
+		if orb.orbiting == nil {
+			continue
+		}
+		copy(orbVBinSets[i], orb.vBins)
+		for j := range vBinSets[i] {
+			infVBinSets[i][j] = vBinSets[i][j]
+			infVBinSets[i][j].sub(&orb.vBins[j])
+		}
+	}
+	return orbVBinSets, infVBinSets
+}
+
+// slopeProfiles returns the logarithmic slope profile of every halo and the
+// radius where each slope profile is most negative. Profiles with empty bins
+// are given NaNs.
+func (config *ProfConfig) slopeProfiles(
+	rSets, rhoSets [][]float64,
+) (slopeSets [][]float64, rsps []float64) {
+	window := int(config.smoothingWindow)
+	kernel := analyze.Kernel(
+		smoothingKernelType(config.smoothingKernel), config.smoothingSigma,
+	)
+
+	slopeSets = make([][]float64, len(rSets))
+	rsps = make([]float64, len(rSets))
+	for i := range rSets {
+		rs, rhos := rSets[i], rhoSets[i]
+		slopeSets[i] = make([]float64, len(rs))
+		rsps[i] = math.NaN()
+
+		empty := false
+		for _, rho := range rhos {
+			empty = empty || !(rho > 0)
+		}
+		var derivs []float64
+		ok := !empty
+		if ok {
+			_, derivs, ok = analyze.Smooth(rs, rhos, window, kernel)
+		}
+		if !ok {
+			for j := range slopeSets[i] {
+				slopeSets[i][j] = math.NaN()
+			}
+			continue
+		}
+		copy(slopeSets[i], derivs)
+
+		// The smoothed slope is unreliable within half a window of the edges.
+		rLo, rHi := rs[window/2], rs[len(rs)-1-window/2]
+		if r, ok := analyze.MinimumSlopeRadius(rs, derivs, rLo, rHi); ok {
+			rsps[i] = r
+		}
+	}
+
+	return slopeSets, rsps
+}
+
+// stackMain groups halos into the mass and accretion rate bins given by
+// StackMassEdges and StackGammaEdges and writes the mean and median density
+// profiles of each group, along with their bootstrap errors. r200ms are the
+// halos' radii and rhoMs are the comoving mean densities at their snapshots.
+// regions are the halos' jackknife regions and are nil if StackCovariance
+// isn't set.
+func (config *ProfConfig) stackMain(
+	ids, snaps []int, rhoSets [][]float64, r200ms, rhoMs []float64,
+	regions []int, stdin []byte, uc *unitConverter,
+) ([]string, error) {
+	gammas := make([]float64, len(ids))
+	if len(config.stackGammaEdges) > 0 {
+		col := catalog.ColumnIndex(stdin, "Gamma")
+		if col == -1 {
+			return nil, fmt.Errorf("The variable 'StackGammaEdges' was " +
+				"set, but the input catalog doesn't have a 'Gamma' column.")
+		}
+		_, cols, err := catalog.Parse(stdin, []int{}, []int{col})
+		if err != nil {
+			return nil, err
+		}
+		gammas = cols[0]
+	}
+
+	mEdges, gEdges := config.stackMassEdges, config.stackGammaEdges
+	if len(mEdges) == 0 {
+		mEdges = []float64{0, math.Inf(+1)}
+	}
+	if len(gEdges) == 0 {
+		gEdges = []float64{math.Inf(-1), math.Inf(+1)}
+	}
+	nm, ng := len(mEdges)-1, len(gEdges)-1
+
+	kind := densityUnit
+	rhoName := "Rho"
+	if config.pType == projectedDensityProfile {
+		kind, rhoName = surfaceDensityUnit, "Sigma"
+	} else if config.pType == subhaloDensityProfile {
+		kind, rhoName = numberDensityUnit, "n_sub"
+	}
+
+	// Profiles are converted to the output units before they're stacked.
+	members := make([][][]float64, nm*ng)
+	memberRegions := make([][]int, nm*ng)
+	for i := range ids {
+		if snaps[i] == -1 {
+			continue
+		}
+		r := r200ms[i]
+		m := 200 * rhoMs[i] * 4 * math.Pi / 3 * r*r*r
+		im, ig := stackBin(mEdges, m), stackBin(gEdges, gammas[i])
+		if im == -1 || ig == -1 {
+			continue
+		}
+
+		rhos := make([]float64, len(rhoSets[i]))
+		factor := uc.factor(snaps[i], kind)
+		for j := range rhos {
+			rhos[j] = rhoSets[i][j] * factor
+		}
+		members[im*ng+ig] = append(members[im*ng+ig], rhos)
+		if regions != nil {
+			memberRegions[im*ng+ig] = append(
+				memberRegions[im*ng+ig], regions[i],
+			)
+		}
+	}
+
+	bins := int(config.bins)
+	rs := config.binCenters(config.binEdges(1))
+	binIDs, counts := make([]int, nm*ng), make([]int, nm*ng)
+	nCols := 4 + 5*bins
+	if regions != nil {
+		nCols += bins * bins
+	}
+	cols := make([][]float64, nCols)
+	for i := range cols {
+		cols[i] = make([]float64, nm*ng)
+	}
+
+	for im := 0; im < nm; im++ {
+		for ig := 0; ig < ng; ig++ {
+			b := im*ng + ig
+			binIDs[b], counts[b] = b, len(members[b])
+			cols[0][b], cols[1][b] = mEdges[im], mEdges[im+1]
+			cols[2][b], cols[3][b] = gEdges[ig], gEdges[ig+1]
+
+			mean, meanErr, med, medErr := stackProfiles(
+				members[b], bins, config.stackSamples,
+			)
+			for j := 0; j < bins; j++ {
+				cols[4+j][b] = rs[j]
+				cols[4+bins+j][b] = mean[j]
+				cols[4+2*bins+j][b] = meanErr[j]
+				cols[4+3*bins+j][b] = med[j]
+				cols[4+4*bins+j][b] = medErr[j]
+			}
+
+			if regions != nil {
+				cov := jackknifeCovariance(members[b], memberRegions[b], bins)
+				for j := range cov {
+					cols[4+5*bins+j][b] = cov[j]
+				}
+			}
+		}
+	}
+
+	order := make([]int, len(cols)+2)
+	for i := range order { order[i] = i }
+	lines := catalog.FormatCols([][]int{binIDs, counts}, cols, order)
+
+	rName := "R/" + config.binNormalization
+	if config.binNormalization == "physical" {
+		rName = "R [cMpc/h]"
+	}
+	rhoLabel := " [" + comovingLabels[kind] + "]"
+	profNames := []string{
+		rName, rhoName + "_mean" + rhoLabel, rhoName + "_mean_err" + rhoLabel,
+		rhoName + "_median" + rhoLabel, rhoName + "_median_err" + rhoLabel,
+	}
+	relabelColumns(uc.units, profNames)
+	names := append([]string{
+		"Bin", "N", "M200m_lo [M_sun/h]", "M200m_hi [M_sun/h]",
+		"Gamma_lo", "Gamma_hi",
+	}, profNames...)
+	nameOrder := make([]int, len(names))
+	for i := range nameOrder { nameOrder[i] = i }
+	sizes := []int{1, 1, 1, 1, 1, 1, bins, bins, bins, bins, bins}
+	if regions != nil {
+		names = append(names, rhoName+"_mean_cov")
+		sizes = append(sizes, bins*bins)
+	}
+	cString := catalog.CommentString(names, []string{}, nameOrder, sizes)
+
+	return append([]string{uc.unitsString(), cString}, lines...), nil
+}
+
+// stackBin returns the index of the bin with the given edges that x falls
+// in, or -1 if it isn't in any bin.
+func stackBin(edges []float64, x float64) int {
+	i := sort.Search(len(edges), func(i int) bool { return edges[i] > x }) - 1
+	if i < 0 || i >= len(edges)-1 {
+		return -1
+	}
+	return i
+}
+
+// stackProfiles returns the mean and median of a group of profiles with the
+// given number of bins, along with bootstrap errors on each. Empty groups are
+// given NaNs.
+func stackProfiles(
+	profiles [][]float64, bins int, samples int64,
+) (mean, meanErr, med, medErr []float64) {
+	mean, meanErr = make([]float64, bins), make([]float64, bins)
+	med, medErr = make([]float64, bins), make([]float64, bins)
+	if len(profiles) == 0 {
+		for j := 0; j < bins; j++ {
+			mean[j], meanErr[j] = math.NaN(), math.NaN()
+			med[j], medErr[j] = math.NaN(), math.NaN()
+		}
+		return mean, meanErr, med, medErr
+	}
+
+	n := len(profiles)
+	xs, sample := make([]float64, n), make([]float64, n)
+	for j := 0; j < bins; j++ {
+		for i := range profiles {
+			xs[i] = profiles[i][j]
+			mean[j] += xs[i] / float64(n)
+		}
+		med[j] = percentile(xs, 50)
+
+		meanSum, meanSqrSum, medSum, medSqrSum := 0.0, 0.0, 0.0, 0.0
+		for k := int64(0); k < samples; k++ {
+			m := 0.0
+			for i := range sample {
+				sample[i] = xs[rand.Intn(n)]
+				m += sample[i] / float64(n)
+			}
+			p := percentile(sample, 50)
+			meanSum, meanSqrSum = meanSum + m, meanSqrSum + m*m
+			medSum, medSqrSum = medSum + p, medSqrSum + p*p
+		}
+		meanErr[j] = bootstrapStdDev(meanSum, meanSqrSum, samples)
+		medErr[j] = bootstrapStdDev(medSum, medSqrSum, samples)
+	}
+
+	return mean, meanErr, med, medErr
+}
+
+// jackknifeCovariance returns the jackknife estimate of the covariance matrix
+// of the mean of a group of profiles with the given number of bins as a
+// row-major bins x bins slice. Each jackknife sample leaves out every profile
+// in one region, and regions gives the region of each profile. Groups with
+// fewer than two regions are given NaNs.
+func jackknifeCovariance(
+	profiles [][]float64, regions []int, bins int,
+) []float64 {
+	cov := make([]float64, bins*bins)
+
+	// Sums over each region and over the whole group.
+	sums, counts := map[int][]float64{}, map[int]int{}
+	total := make([]float64, bins)
+	for i, reg := range regions {
+		if _, ok := sums[reg]; !ok {
+			sums[reg] = make([]float64, bins)
+		}
+		for j := range total {
+			sums[reg][j] += profiles[i][j]
+			total[j] += profiles[i][j]
+		}
+		counts[reg]++
+	}
+
+	nr := len(sums)
+	if nr < 2 {
+		for j := range cov {
+			cov[j] = math.NaN()
+		}
+		return cov
+	}
+
+	// The mean profile of each jackknife sample, and the mean of those.
+	means := make([][]float64, 0, nr)
+	meanOfMeans := make([]float64, bins)
+	for reg, sum := range sums {
+		n := float64(len(profiles) - counts[reg])
+		mean := make([]float64, bins)
+		for j := range mean {
+			mean[j] = (total[j] - sum[j]) / n
+			meanOfMeans[j] += mean[j] / float64(nr)
+		}
+		means = append(means, mean)
+	}
+
+	norm := float64(nr-1) / float64(nr)
+	for _, mean := range means {
+		for j1 := 0; j1 < bins; j1++ {
+			d1 := mean[j1] - meanOfMeans[j1]
+			for j2 := 0; j2 < bins; j2++ {
+				d2 := mean[j2] - meanOfMeans[j2]
+				cov[j1*bins+j2] += norm * d1 * d2
+			}
+		}
+	}
+
+	return cov
+}
+
+// boxOctant returns the index of the octant of a box with width L that a
+// point falls in.
+func boxOctant(x, y, z, L float64) int {
+	oct := 0
+	if x >= L/2 {
+		oct += 4
+	}
+	if y >= L/2 {
+		oct += 2
+	}
+	if z >= L/2 {
+		oct++
+	}
+	return oct
+}
+
+// bootstrapStdDev returns the standard deviation of a bootstrap statistic
+// from its sum and sum of squares over all samples.
+func bootstrapStdDev(sum, sqrSum float64, samples int64) float64 {
+	sum /= float64(samples)
+	sqrSum /= float64(samples)
+	return math.Sqrt(math.Max(sqrSum - sum*sum, 0))
+}
+
+// dk14Fits fits a DK14 profile to every halo's density profile and returns
+// columns of rho_s, r_s, alpha, r_t, b_e, s_e, and R_sp,DK14. Failed fits are
+// given NaNs, as are fits whose slope has no minimum inside the profile.
+func (config *ProfConfig) dk14Fits(
+	rSets, rhoSets [][]float64, r200ms, rhoMs []float64,
+) [][]float64 {
+	cols := make([][]float64, dk14ParamNum+1)
+	for i := range cols {
+		cols[i] = make([]float64, len(rSets))
+	}
+
+	for i := range rSets {
+		rs := rSets[i]
+		p, ok := fitDK14(
+			rs, rhoSets[i], r200ms[i], rhoMs[i],
+			config.dk14Beta, config.dk14Gamma,
+		)
+		if !ok {
+			for j := range cols {
+				cols[j][i] = math.NaN()
+			}
+			continue
+		}
+
+		rsp, _ := p.splashbackRadius(rs[0], rs[len(rs)-1])
+		vals := []float64{p.rhoS, p.rS, p.alpha, p.rT, p.bE, p.sE, rsp}
+		for j := range cols {
+			cols[j][i] = vals[j]
+		}
+	}
+
+	return cols
+}
+
+// rhos is a buffer and will be cleared before use. If vBins is non-nil, the
+// velocities of the particles in each bin are added to it and the velocities
+// of the particles inside the sphere are added to bulk. If orb is non-nil, the
+// orbiting particles are also added to its profiles. pIDs are the particle IDs.
 func insertPoints(
-	rhos []float64, s ExtendedSphere, xs, vs [][3]float32,
-	ms []float32, shell analyze.Shell, config *ProfConfig, hd *io.Header,
+	rhos []float64, vBins []velocityBin, bulk *velocityBin, orb *orbitBins,
+	edges []float64, s ExtendedSphere, xs, vs [][3]float32, ms []float32,
+	pIDs []int64, shell analyze.Shell, config *ProfConfig, hd *io.Header,
 ) {
-	lrMax := math.Log(float64(s.S.R) * config.rMaxMult)
-	lrMin := math.Log(float64(s.S.R) * config.rMinMult)
-	dlr := (lrMax - lrMin) / float64(config.bins)
-	rMax2 := s.S.R * float32(config.rMaxMult)
-	rMin2 := s.S.R * float32(config.rMinMult)
+	rMax2 := float32(edges[len(edges)-1])
+	rMin2 := float32(edges[0])
 	rMax2 *= rMax2
 	rMin2 *= rMin2
 
@@ -488,6 +1766,9 @@ func insertPoints(
 		dz = wrap(dz, tw2)
 
 		r2 := dx*dx + dy*dy + dz*dz
+		if vBins != nil && r2 < s.S.R*s.S.R {
+			bulk.add(dx, dy, dz, vs[i], ms[i])
+		}
 		if r2 <= rMin2 || r2 >= rMax2 { continue }
 
 		if config.pType == containedDensityProfile &&
@@ -495,9 +1776,7 @@ func insertPoints(
 			continue
 		}
 
-		lr := math.Log(float64(r2)) / 2
-		ir := int(((lr) - lrMin) / dlr)
-		if ir == len(rhos) { ir-- }
+		ir := radialBin(edges, math.Sqrt(float64(r2)))
 
 		if config.pType == boundDensityProfile {
 			dr := float32(math.Sqrt(float64(r2)))
@@ -512,24 +1791,343 @@ func insertPoints(
 				float32(math.Log(float64(1 + cVir*x)))/x
 			vesc2 := phi * 2.0
 			
-			if vesc2 > dv2 {
-				rhos[ir] += float64(ms[i])
+			if vesc2 <= dv2 { continue }
+		}
+
+		rhos[ir] += float64(ms[i])
+		if vBins != nil {
+			vBins[ir].add(dx, dy, dz, vs[i], ms[i])
+		}
+		if orb != nil && orb.orbiting[pIDs[i]] {
+			orb.rhos[ir] += float64(ms[i])
+			if orb.vBins != nil {
+				orb.vBins[ir].add(dx, dy, dz, vs[i], ms[i])
+			}
+		}
+	}
+}
+
+// insertSubhalos adds the number of subhalos in each radial bin around the
+// halos at the given indices to their profiles in rhoSets. All of these halos
+// are in the given snapshot. Subhalos are read from the halo catalog and are
+// cut on SubhaloVmaxMin.
+func (config *ProfConfig) insertSubhalos(
+	rhoSets, edgeSets, coords [][]float64, ids, idxs []int, snap int,
+	hd *io.Header, buf io.VectorBuffer, e *env.Environment,
+	gConfig *GlobalConfig,
+) error {
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return err
+	}
+
+	valNames := []string{"X", "Y", "Z"}
+	if config.subhaloVmaxMin > 0 {
+		if _, ok := vars.ColumnLookup["Vmax"]; !ok {
+			return fmt.Errorf("The variable 'SubhaloVmaxMin' was set, but " +
+				"'Vmax' isn't in 'HaloValueNames'.")
+		}
+		valNames = append(valNames, "Vmax")
+	}
+
+	rids, err := memo.ReadSortedRockstarIDs(snap, -1, "M200m", vars, buf, e)
+	if err != nil {
+		return err
+	}
+	_, vals, err := memo.ReadRockstar(snap, valNames, rids, vars, buf, e)
+	if err != nil {
+		return err
+	}
+
+	// Only halos above the Vmax cut are put in the grid.
+	pucf := halo.UnitConversionFactor(gConfig.HaloPositionUnits, &hd.Cosmo)
+	subIDs := []int{}
+	xs, ys, zs := []float64{}, []float64{}, []float64{}
+	for i := range rids {
+		if config.subhaloVmaxMin > 0 && vals[3][i] < config.subhaloVmaxMin {
+			continue
+		}
+		subIDs = append(subIDs, rids[i])
+		xs = append(xs, vals[0][i]*pucf)
+		ys = append(ys, vals[1][i]*pucf)
+		zs = append(zs, vals[2][i]*pucf)
+	}
+
+	mt := halo.NewMatcher(finderCells, hd.TotalWidth, xs, ys, zs, nil)
+	for _, idx := range idxs {
+		edges := edgeSets[idx]
+		pos := [3]float64{coords[0][idx], coords[1][idx], coords[2][idx]}
+		nIdxs, dists := mt.Neighbors(pos, edges[len(edges)-1])
+		binSubhalos(rhoSets[idx], edges, ids[idx], subIDs, nIdxs, dists)
+	}
+
+	return nil
+}
+
+// binSubhalos adds the subhalos with the given indices and distances from a
+// host to the radial bins in counts, which have the given edges. subIDs are
+// the IDs of every subhalo, and the host itself is never counted.
+func binSubhalos(
+	counts, edges []float64, hostID int, subIDs, nIdxs []int,
+	dists []float64,
+) {
+	rMin, rMax := edges[0], edges[len(edges)-1]
+	for k, n := range nIdxs {
+		if subIDs[n] == hostID || dists[k] <= rMin || dists[k] >= rMax {
+			continue
+		}
+		counts[radialBin(edges, dists[k])]++
+	}
+}
+
+// insertProjectedPoints adds the masses of the particles in a cylinder around
+// the halo, s, to the projected radial bins in sigmas, which have the given
+// edges. The cylinder is aligned with axis and particles projected inside the
+// innermost edge are added to innerMass.
+func insertProjectedPoints(
+	sigmas []float64, innerMass *float64, edges []float64, s ExtendedSphere,
+	xs [][3]float32, ms []float32, axis [3]float64, config *ProfConfig,
+	hd *io.Header,
+) {
+	rMax2 := edges[len(edges)-1] * edges[len(edges)-1]
+	rMin2 := edges[0] * edges[0]
+	depth := float64(s.S.R) * config.projectionDepthMult
+
+	x0, y0, z0 := s.S.C[0], s.S.C[1], s.S.C[2]
+	tw2 := float32(hd.TotalWidth) / 2
+
+	for i := range xs {
+		dx := float64(wrap(xs[i][0] - x0, tw2))
+		dy := float64(wrap(xs[i][1] - y0, tw2))
+		dz := float64(wrap(xs[i][2] - z0, tw2))
+
+		los := dx*axis[0] + dy*axis[1] + dz*axis[2]
+		if los < -depth || los > depth { continue }
+
+		r2 := dx*dx + dy*dy + dz*dz - los*los
+		if r2 >= rMax2 { continue }
+		if r2 <= rMin2 {
+			*innerMass += float64(ms[i])
+			continue
+		}
+
+		sigmas[radialBin(edges, math.Sqrt(r2))] += float64(ms[i])
+	}
+}
+
+// processProjectedProfile converts the projected masses in each radial bin to
+// the surface density, Sigma, and excess surface density, DeltaSigma, at the
+// radii rs. Both are in h Msun/cpc^2. Sigma is assumed to be constant across
+// each bin when finding the mean surface density inside rs.
+func processProjectedProfile(
+	rs, sigmas, deltaSigmas []float64, innerMass float64, edges []float64,
+) {
+	// cpc^2 / cMpc^2
+	pc2 := 1e-12
+
+	mEnc := innerMass
+	for j := range rs {
+		rLo, rHi := edges[j], edges[j+1]
+		dA := (rHi*rHi - rLo*rLo) * math.Pi
+
+		m := sigmas[j]
+		sigmas[j] = m / dA * pc2
+
+		mMid := mEnc + m*(rs[j]*rs[j] - rLo*rLo)/(rHi*rHi - rLo*rLo)
+		meanSigma := mMid / (math.Pi * rs[j]*rs[j]) * pc2
+		deltaSigmas[j] = meanSigma - sigmas[j]
+
+		mEnc += m
+	}
+}
+
+// projectionAxes returns the unit vectors that each of n haloes are
+// projected along.
+func (config *ProfConfig) projectionAxes(n int) [][3]float64 {
+	axes := make([][3]float64, n)
+	for i := range axes {
+		switch config.projectionAxis {
+		case "x":
+			axes[i] = [3]float64{1, 0, 0}
+		case "y":
+			axes[i] = [3]float64{0, 1, 0}
+		case "z":
+			axes[i] = [3]float64{0, 0, 1}
+		case "random":
+			phi := 2 * math.Pi * rand.Float64()
+			cosTh := 2*rand.Float64() - 1
+			sinTh := math.Sqrt(1 - cosTh*cosTh)
+			axes[i] = [3]float64{
+				sinTh * math.Cos(phi), sinTh * math.Sin(phi), cosTh,
 			}
-		} else {
-			rhos[ir] += float64(ms[i])
 		}
 	}
+	return axes
+}
+
+// velocityBin holds mass-weighted sums over a set of particles which are
+// enough to find their velocity dispersions relative to any bulk velocity.
+// Radial velocities, vr, and unit vectors, rHat, are measured from the halo
+// center and don't have the bulk velocity subtracted.
+type velocityBin struct {
+	m, r, vr, vr2, v2 float64
+	v, rHat, vrRHat [3]float64
+	rHat2 [3][3]float64
+}
+
+// add adds a particle with the given offset from the halo center, velocity,
+// and mass to the bin.
+func (b *velocityBin) add(dx, dy, dz float32, v [3]float32, m float32) {
+	r := math.Sqrt(float64(dx*dx + dy*dy + dz*dz))
+	if r == 0 { return }
+	rHat := [3]float64{float64(dx)/r, float64(dy)/r, float64(dz)/r}
+	vel := [3]float64{float64(v[0]), float64(v[1]), float64(v[2])}
+	mm := float64(m)
+
+	vr := vel[0]*rHat[0] + vel[1]*rHat[1] + vel[2]*rHat[2]
+	b.m += mm
+	b.r += mm*r
+	b.vr += mm*vr
+	b.vr2 += mm*vr*vr
+	b.v2 += mm*(vel[0]*vel[0] + vel[1]*vel[1] + vel[2]*vel[2])
+	for k := 0; k < 3; k++ {
+		b.v[k] += mm*vel[k]
+		b.rHat[k] += mm*rHat[k]
+		b.vrRHat[k] += mm*vr*rHat[k]
+		for l := 0; l < 3; l++ {
+			b.rHat2[k][l] += mm*rHat[k]*rHat[l]
+		}
+	}
+}
+
+// sub removes the particles in c from the bin. c must only contain particles
+// which were also added to b.
+func (b *velocityBin) sub(c *velocityBin) {
+	b.m -= c.m
+	b.r -= c.r
+	b.vr -= c.vr
+	b.vr2 -= c.vr2
+	b.v2 -= c.v2
+	for k := 0; k < 3; k++ {
+		b.v[k] -= c.v[k]
+		b.rHat[k] -= c.rHat[k]
+		b.vrRHat[k] -= c.vrRHat[k]
+		for l := 0; l < 3; l++ {
+			b.rHat2[k][l] -= c.rHat2[k][l]
+		}
+	}
+}
+
+// mean returns the mass-weighted mean velocity of the particles in the bin.
+func (b *velocityBin) mean() [3]float64 {
+	if b.m == 0 { return [3]float64{} }
+	return [3]float64{b.v[0]/b.m, b.v[1]/b.m, b.v[2]/b.m}
+}
+
+// meanRadial returns the mass-weighted mean radial velocity of the particles
+// in the bin after the bulk velocity has been subtracted. The Hubble flow is
+// added using hubbleFlow, the ratio between Hubble flow velocities and
+// comoving distances. If the bin is empty, NaN is returned.
+func (b *velocityBin) meanRadial(bulk [3]float64, hubbleFlow float64) float64 {
+	if b.m == 0 { return math.NaN() }
+	vr := b.vr
+	for k := 0; k < 3; k++ {
+		vr -= bulk[k]*b.rHat[k]
+	}
+	return (vr + hubbleFlow*b.r) / b.m
+}
+
+// dispersions returns the radial velocity dispersion of the particles in the
+// bin and their velocity dispersion along each of the two tangential
+// directions after the bulk velocity has been subtracted. The mean tangential
+// velocity is assumed to be zero. If the bin is empty, NaNs are returned.
+func (b *velocityBin) dispersions(bulk [3]float64) (sigR, sigT float64) {
+	if b.m == 0 { return math.NaN(), math.NaN() }
+
+	// Sums of (v - bulk).rHat, ((v - bulk).rHat)^2, and |v - bulk|^2.
+	vr, vr2, v2 := b.vr, b.vr2, b.v2
+	for k := 0; k < 3; k++ {
+		vr -= bulk[k]*b.rHat[k]
+		v2 += b.m*bulk[k]*bulk[k]
+		vr2 -= 2*bulk[k]*b.vrRHat[k]
+		v2 -= 2*bulk[k]*b.v[k]
+		for l := 0; l < 3; l++ {
+			vr2 += bulk[k]*bulk[l]*b.rHat2[k][l]
+		}
+	}
+	vr, vr2, v2 = vr/b.m, vr2/b.m, v2/b.m
+
+	sigR2, sigT2 := vr2 - vr*vr, (v2 - vr2) / 2
+	return math.Sqrt(math.Max(sigR2, 0)), math.Sqrt(math.Max(sigT2, 0))
+}
+
+// velocityProfiles returns the <v_r>, sigma_r, sigma_t, and beta profiles of
+// every halo in the rest frame given by bulks.
+func velocityProfiles(
+	vBinSets [][]velocityBin, bulks [][3]float64, hubbleFlows []float64,
+) (vrSets, sigRSets, sigTSets, betaSets [][]float64) {
+	vrSets = make([][]float64, len(vBinSets))
+	sigRSets = make([][]float64, len(vBinSets))
+	sigTSets = make([][]float64, len(vBinSets))
+	betaSets = make([][]float64, len(vBinSets))
+	for i := range vBinSets {
+		n := len(vBinSets[i])
+		vrSets[i] = make([]float64, n)
+		sigRSets[i] = make([]float64, n)
+		sigTSets[i] = make([]float64, n)
+		betaSets[i] = make([]float64, n)
+		for j := range vBinSets[i] {
+			vrSets[i][j] = vBinSets[i][j].meanRadial(bulks[i], hubbleFlows[i])
+			sigR, sigT := vBinSets[i][j].dispersions(bulks[i])
+			sigRSets[i][j], sigTSets[i][j] = sigR, sigT
+			betaSets[i][j] = 1 - sigT*sigT/(sigR*sigR)
+		}
+	}
+	return vrSets, sigRSets, sigTSets, betaSets
+}
+
+// restFrameVelocities returns the bulk velocity of every halo in the frame
+// given by RestFrame. bulkBins holds the velocities of the particles inside
+// each halo's R200m.
+func (config *ProfConfig) restFrameVelocities(
+	ids, snaps []int, bulkBins []velocityBin, buf io.VectorBuffer,
+	e *env.Environment, gConfig *GlobalConfig,
+) ([][3]float64, error) {
+	bulks := make([][3]float64, len(ids))
+	if config.restFrame == "particles" {
+		for i := range bulks {
+			bulks[i] = bulkBins[i].mean()
+		}
+		return bulks, nil
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	vNames := []string{"Vx", "Vy", "Vz"}
+	for _, v := range vNames {
+		if _, ok := vars.ColumnLookup[v]; !ok {
+			return nil, fmt.Errorf("The variable 'RestFrame' was set to "+
+				"catalog, but '%s' isn't in HaloValueNames.", v)
+		}
+	}
+	vCols, err := readHaloCoords(ids, snaps, vNames, vars, buf, e, gConfig)
+	if err != nil {
+		return nil, err
+	}
+	for i := range bulks {
+		bulks[i] = [3]float64{vCols[0][i], vCols[1][i], vCols[2][i]}
+	}
+	return bulks, nil
 }
 
 func insertMedianPoints(
-	medRhos [][]float64, s ExtendedSphere,  xs [][3]float32,
+	medRhos [][]float64, edges []float64, s ExtendedSphere,  xs [][3]float32,
 	ms []float32, config *ProfConfig, hd *io.Header,
 ) {
-	lrMax := math.Log(float64(s.S.R) * config.rMaxMult)
-	lrMin := math.Log(float64(s.S.R) * config.rMinMult)
-	dlr := (lrMax - lrMin) / float64(config.bins)
-	rMax2 := s.S.R * float32(config.rMaxMult)
-	rMin2 := s.S.R * float32(config.rMinMult)
+	rMax2 := float32(edges[len(edges)-1])
+	rMin2 := float32(edges[0])
 	rMax2 *= rMax2
 	rMin2 *= rMin2
 
@@ -557,73 +2155,122 @@ func insertMedianPoints(
 		th := math.Acos(float64(dz) / r)
 		p := geom.SpherePixel(phi, th, int(config.medianPixelLevel))
 
-		lr := math.Log(r)
-		ir := int(((lr) - lrMin) / dlr)
-
-		if ir == len(medRhos) { ir-- }
+		ir := radialBin(edges, r)
 		medRhos[ir][p] += float64(ms[i])*float64(pixelNum)
 	}
 }
 
-func processProfile(rs, rhos []float64, rMin, rMax float64) {
-	n := len(rs)
-
-	dlr := (math.Log(rMax) - math.Log(rMin)) / float64(n)
-	lrMin := math.Log(rMin)
-
-	for j := range rs {
-		rs[j] = math.Exp(lrMin + dlr*(float64(j) + 0.5))
-
-		rLo := math.Exp(dlr*float64(j) + lrMin)
-		rHi := math.Exp(dlr*float64(j+1) + lrMin)
-		dV := (rHi*rHi*rHi - rLo*rLo*rLo) * 4 * math.Pi / 3
-
-		rhos[j] = rhos[j] / dV
+// processProfile converts the masses (or subhalo counts) in each bin to
+// densities. edges are the edges of the bins.
+func processProfile(rhos, edges []float64) {
+	for j := range rhos {
+		rhos[j] = rhos[j] / shellVolume(edges[j], edges[j+1])
 	}
 }
 
-func processMedianProfile(rs, rhos []float64, medRhos [][]float64,
-	medScratchBuffer []float64, rMin, rMax float64,
-	percentile float64,
+func processMedianProfile(rhos []float64, medRhos [][]float64,
+	medScratchBuffer, edges []float64, percentile float64,
 ) {
-	n := len(rs)
-
-	dlr := (math.Log(rMax) - math.Log(rMin)) / float64(n)
-	lrMin := math.Log(rMin)
-
-	for j := range rs {
-		rs[j] = math.Exp(lrMin + dlr*(float64(j) + 0.5))
-
-		rLo := math.Exp(dlr*float64(j) + lrMin)
-		rHi := math.Exp(dlr*float64(j+1) + lrMin)
-		dV := (rHi*rHi*rHi - rLo*rLo*rLo) * 4 * math.Pi / 3
-
+	for j := range rhos {
 		rhos[j] = msort.Percentile(
 			medRhos[j], percentile/100, medScratchBuffer,
-		) / dV
+		) / shellVolume(edges[j], edges[j+1])
 	}
 }
 
-func processMedianErrorProfile(rs, rhos []float64, medRhos [][]float64,
-	medScratchBuffer []float64, rMin, rMax float64,
-	percentile float64, samples int64,
+func processMedianErrorProfile(rhos []float64, medRhos [][]float64,
+	medScratchBuffer, edges []float64, percentile float64, samples int64,
 ) {
-	n := len(rs)
+	for j := range rhos {
+		rhos[j] = bootstrapErrorPercentile(
+			medRhos[j], percentile, medScratchBuffer, samples,
+		) / shellVolume(edges[j], edges[j+1])
+	}
+}
 
-	dlr := (math.Log(rMax) - math.Log(rMin)) / float64(n)
-	lrMin := math.Log(rMin)
+// shellVolume returns the volume of a spherical shell.
+func shellVolume(rLo, rHi float64) float64 {
+	return lib.ShellVolume(rLo, rHi)
+}
 
+// binEdges returns the edges of a halo's radial bins. norm is the radius that
+// the bins are measured relative to.
+func (config *ProfConfig) binEdges(norm float64) []float64 {
+	n := int(config.bins)
+	rMin, rMax := norm*config.rMinMult, norm*config.rMaxMult
+
+	edges := make([]float64, n+1)
+	switch config.binType {
+	case "log":
+		dlr := (math.Log(rMax) - math.Log(rMin)) / float64(n)
+		for j := range edges {
+			edges[j] = rMin * math.Exp(dlr*float64(j))
+		}
+	case "linear":
+		dr := (rMax - rMin) / float64(n)
+		for j := range edges {
+			edges[j] = rMin + dr*float64(j)
+		}
+	case "explicit":
+		for j := range edges {
+			edges[j] = norm * config.edgeMults[j]
+		}
+	}
+	edges[0], edges[n] = rMin, rMax
+
+	return edges
+}
+
+// binCenters returns the radii of the bins with the given edges. These are the
+// geometric centers of log bins and the arithmetic centers of other bins.
+func (config *ProfConfig) binCenters(edges []float64) []float64 {
+	rs := make([]float64, len(edges)-1)
 	for j := range rs {
-		rs[j] = math.Exp(lrMin + dlr*(float64(j) + 0.5))
+		if config.binType == "log" {
+			rs[j] = math.Sqrt(edges[j] * edges[j+1])
+		} else {
+			rs[j] = (edges[j] + edges[j+1]) / 2
+		}
+	}
+	return rs
+}
 
-		rLo := math.Exp(dlr*float64(j) + lrMin)
-		rHi := math.Exp(dlr*float64(j+1) + lrMin)
-		dV := (rHi*rHi*rHi - rLo*rLo*rLo) * 4 * math.Pi / 3
+// radialBin returns the index of the bin that r falls in. r must be between
+// the first and last edges.
+func radialBin(edges []float64, r float64) int {
+	return lib.RadialBin(edges, r)
+}
 
-		rhos[j] = bootstrapErrorPercentile(
-			medRhos[j], percentile, medScratchBuffer, samples,
-		) / dV
+// binNorms returns the radius that each halo's bins are measured relative
+// to. r200ms are the halos' radii.
+func (config *ProfConfig) binNorms(
+	stdin []byte, snaps []int, r200ms []float64,
+	buf io.VectorBuffer, e *env.Environment, uc *unitConverter,
+) ([]float64, error) {
+	norms := make([]float64, len(snaps))
+	switch config.binNormalization {
+	case "R200m":
+		copy(norms, r200ms)
+	case "Rsp":
+		_, cols, err := catalog.Parse(
+			stdin, []int{}, []int{int(config.rspColumn)},
+		)
+		if err != nil {
+			return nil, err
+		}
+		copy(norms, cols[0])
+		err = readInputUnits(
+			stdin, snaps, [][]float64{norms}, []unitKind{lengthUnit}, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+	case "physical":
+		for i := range norms {
+			norms[i] = 1 / uc.factor(snaps[i], lengthUnit)
+		}
 	}
+	return norms, nil
 }
 
 func bootstrapErrorPercentile(
@@ -651,6 +2298,7 @@ func bootstrapErrorPercentile(
 
 func angularFractionMain(
 	ids, snaps []int, shells []analyze.Shell, rs []float64, config *ProfConfig,
+	uc *unitConverter,
 ) ([]string, error) {
 	rCols := make([][]float64, config.bins)
 	fCols := make([][]float64, config.bins)
@@ -670,19 +2318,24 @@ func angularFractionMain(
 		}
 	}
 
+	uc.convert(snaps, rCols, repeatKind(lengthUnit, len(rCols)))
+
 	order := make([]int, len(rCols) + len(fCols) + 2)
 	for i := range order { order[i] = i }
 	lines := catalog.FormatCols(
 		[][]int{ids, snaps}, append(rCols, fCols...), order,
 	)
 
+	names := []string{
+		"ID", "Snapshot", "R [cMpc/h]", "Volume Fraction Contained",
+	}
+	relabelColumns(uc.units, names)
 	cString := catalog.CommentString(
-		[]string{"ID", "Snapshot", "R [cMpc/h]", "Volume Fraction Contained"},
-		[]string{}, []int{0, 1, 2, 3},
+		names, []string{}, []int{0, 1, 2, 3},
 		[]int{1, 1, int(config.bins), int(config.bins)},
 	)
 
-	return append([]string{cString}, lines...), nil
+	return append([]string{uc.unitsString(), cString}, lines...), nil
 }
 
 type ExtendedSphere struct {
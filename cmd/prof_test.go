@@ -0,0 +1,546 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+func TestVelocityBinDispersions(t *testing.T) {
+	bulk := [3]float32{5, -3, 2}
+	dirs := [][3]float32{
+		{1, 0, 0}, {-1, 0, 0}, {0, 1, 0}, {0, -1, 0}, {0, 0, 1}, {0, 0, -1},
+	}
+
+	// Particles moving radially at +/- 1 relative to the bulk velocity.
+	radial := &velocityBin{}
+	// Particles moving at sqrt(2) along a tangential direction.
+	tangential := &velocityBin{}
+	for _, d := range dirs {
+		for _, sign := range []float32{-1, 1} {
+			var v [3]float32
+			for k := range v {
+				v[k] = bulk[k] + sign*d[k]
+			}
+			radial.add(2*d[0], 2*d[1], 2*d[2], v, 1)
+
+			perp := [3]float32{d[1] + d[2], d[2] + d[0], d[0] + d[1]}
+			for k := range v {
+				v[k] = bulk[k] + sign*perp[k]
+			}
+			tangential.add(2*d[0], 2*d[1], 2*d[2], v, 1)
+		}
+	}
+
+	mean := radial.mean()
+	for k := range mean {
+		if math.Abs(mean[k]-float64(bulk[k])) > 1e-6 {
+			t.Errorf("Expected mean velocity %v, got %v.", bulk, mean)
+			break
+		}
+	}
+
+	tests := []struct {
+		b          *velocityBin
+		sigR, sigT float64
+	}{
+		{radial, 1, 0},
+		{tangential, 0, 1},
+	}
+
+	for i, test := range tests {
+		sigR, sigT := test.b.dispersions(mean)
+		if math.Abs(sigR-test.sigR) > 1e-6 || math.Abs(sigT-test.sigT) > 1e-6 {
+			t.Errorf("%d) Expected sigma_r = %g and sigma_t = %g, got %g "+
+				"and %g.", i, test.sigR, test.sigT, sigR, sigT)
+		}
+	}
+
+	sigR, sigT := (&velocityBin{}).dispersions(mean)
+	if !math.IsNaN(sigR) || !math.IsNaN(sigT) {
+		t.Errorf("Expected NaNs for an empty bin, got %g and %g.", sigR, sigT)
+	}
+}
+
+func TestVelocityBinMeanRadial(t *testing.T) {
+	bulk := [3]float64{5, -3, 2}
+	dirs := [][3]float32{{1, 0, 0}, {0, -1, 0}, {0, 0, 1}}
+
+	// Particles at r = 2 falling inwards at 1 relative to the bulk velocity.
+	b := &velocityBin{}
+	for _, d := range dirs {
+		var v [3]float32
+		for k := range v {
+			v[k] = float32(bulk[k]) - d[k]
+		}
+		b.add(2*d[0], 2*d[1], 2*d[2], v, 1)
+	}
+
+	tests := []struct {
+		hubbleFlow, vr float64
+	}{
+		{0, -1},
+		{0.5, 0},
+		{10, 19},
+	}
+
+	for i, test := range tests {
+		vr := b.meanRadial(bulk, test.hubbleFlow)
+		if math.Abs(vr-test.vr) > 1e-6 {
+			t.Errorf("%d) Expected <v_r> = %g, got %g.", i, test.vr, vr)
+		}
+	}
+
+	if vr := (&velocityBin{}).meanRadial(bulk, 1); !math.IsNaN(vr) {
+		t.Errorf("Expected NaN for an empty bin, got %g.", vr)
+	}
+}
+
+func TestSlopeProfiles(t *testing.T) {
+	config := &ProfConfig{
+		smoothingWindow: 9, smoothingKernel: "savgol", smoothingSigma: 3,
+	}
+
+	// ln(rho) = x^3/3 - x - 2 with x = ln(r) has a slope of x^2 - 1, which
+	// is most negative at r = 1.
+	bins := 41
+	dlr := math.Log(100) / float64(bins)
+	rs, rhos, empty := make([]float64, bins), make([]float64, bins),
+		make([]float64, bins)
+	for j := range rs {
+		x := math.Log(0.1) + dlr*(float64(j)+0.5)
+		rs[j], rhos[j] = math.Exp(x), math.Exp(x*x*x/3-x-2)
+		empty[j] = rhos[j]
+	}
+	empty[bins/2] = 0
+
+	slopeSets, rsps := config.slopeProfiles(
+		[][]float64{rs, rs}, [][]float64{rhos, empty},
+	)
+
+	for j := range rs {
+		x := math.Log(rs[j])
+		if j < 4 || j >= bins-4 {
+			continue
+		}
+		if math.Abs(slopeSets[0][j]-(x*x-1)) > 1e-6 {
+			t.Errorf("Expected slope %g at r = %g, got %g.",
+				x*x-1, rs[j], slopeSets[0][j])
+		}
+	}
+	if math.Abs(rsps[0]-1) > 1e-6 {
+		t.Errorf("Expected R_sp,prof = 1, got %g.", rsps[0])
+	}
+
+	if !math.IsNaN(rsps[1]) || !math.IsNaN(slopeSets[1][0]) {
+		t.Errorf("Expected NaNs for a profile with an empty bin, got "+
+			"R_sp,prof = %g and a slope of %g.", rsps[1], slopeSets[1][0])
+	}
+}
+
+func TestFitDK14(t *testing.T) {
+	r200m, rhoM := 1.0, 1.0
+	truth := &dk14Profile{
+		rhoS: 1e3, rS: 0.15, alpha: 0.18, rT: 1.3, bE: 1.5, sE: 1.4,
+		beta: 4, gamma: 8, rhoM: rhoM, r200m: r200m,
+	}
+
+	n := 100
+	rs, rhos := make([]float64, n), make([]float64, n)
+	for i := range rs {
+		rs[i] = 0.03 * math.Pow(100, float64(i)/float64(n-1))
+		rhos[i] = truth.rho(rs[i])
+	}
+	// Empty bins are ignored.
+	rhos[0], rhos[1] = 0, 0
+
+	p, ok := fitDK14(rs, rhos, r200m, rhoM, 4, 8)
+	if !ok {
+		t.Fatalf("DK14 fit didn't converge.")
+	}
+	for i := range rs {
+		if i < 2 {
+			continue
+		}
+		if math.Abs(p.rho(rs[i])/rhos[i]-1) > 1e-3 {
+			t.Errorf("Expected rho(%g) = %g, got %g.",
+				rs[i], rhos[i], p.rho(rs[i]))
+			break
+		}
+	}
+
+	rsp, ok := truth.splashbackRadius(rs[0], rs[n-1])
+	if !ok {
+		t.Fatalf("Expected the true profile to have a splashback radius.")
+	}
+	fitRsp, ok := p.splashbackRadius(rs[0], rs[n-1])
+	if !ok || math.Abs(fitRsp/rsp-1) > 0.01 {
+		t.Errorf("Expected R_sp,DK14 = %g, got %g.", rsp, fitRsp)
+	}
+
+	// The slope is steepest near r_t.
+	if rsp < 0.8 || rsp > 1.6 {
+		t.Errorf("Expected R_sp near r_t = %g, got %g.", truth.rT, rsp)
+	}
+	eps := 1e-5
+	for _, r := range []float64{0.1, 0.5, 1, 2} {
+		num := (math.Log(truth.rho(r*(1+eps))) -
+			math.Log(truth.rho(r*(1-eps)))) / (2 * eps)
+		if math.Abs(num-truth.slope(r)) > 1e-4 {
+			t.Errorf("Expected slope(%g) = %g, got %g.",
+				r, num, truth.slope(r))
+		}
+	}
+
+	if _, ok := fitDK14(rs[:5], rhos[:5], r200m, rhoM, 4, 8); ok {
+		t.Errorf("Expected a fit to too few bins to fail.")
+	}
+}
+
+func TestProcessProjectedProfile(t *testing.T) {
+	n, rMin := 20, 0.1
+	config := &ProfConfig{
+		bins: int64(n), rMinMult: rMin, rMaxMult: 2, binType: "log",
+	}
+	edges := config.binEdges(1)
+	rs := config.binCenters(edges)
+
+	// A point mass has Sigma = 0 and DeltaSigma = M / (pi R^2), while a
+	// uniform sheet has DeltaSigma = 0.
+	sigmas, deltaSigmas := make([]float64, n), make([]float64, n)
+	processProjectedProfile(rs, sigmas, deltaSigmas, 1e12, edges)
+	for j := range rs {
+		expected := 1 / (math.Pi * rs[j] * rs[j])
+		if sigmas[j] != 0 || math.Abs(deltaSigmas[j]/expected-1) > 1e-10 {
+			t.Errorf("Expected point mass Sigma(%g) = 0 and "+
+				"DeltaSigma(%g) = %g, got %g and %g.",
+				rs[j], rs[j], expected, sigmas[j], deltaSigmas[j])
+		}
+	}
+
+	sigma0 := 3e12
+	for j := range sigmas {
+		rLo, rHi := edges[j], edges[j+1]
+		sigmas[j] = sigma0 * math.Pi * (rHi*rHi - rLo*rLo)
+	}
+	processProjectedProfile(rs, sigmas, deltaSigmas,
+		sigma0*math.Pi*rMin*rMin, edges)
+	for j := range rs {
+		if math.Abs(sigmas[j]-3) > 1e-10 || math.Abs(deltaSigmas[j]) > 1e-10 {
+			t.Errorf("Expected sheet Sigma(%g) = 3 and DeltaSigma(%g) = 0, "+
+				"got %g and %g.", rs[j], rs[j], sigmas[j], deltaSigmas[j])
+		}
+	}
+}
+
+func TestInsertProjectedPoints(t *testing.T) {
+	config := &ProfConfig{
+		bins: 2, rMinMult: 0.1, rMaxMult: 1, projectionDepthMult: 2,
+	}
+	s := ExtendedSphere{}
+	s.S.C = [3]float32{1, 1, 1}
+	s.S.R = 1
+	hd := &io.Header{TotalWidth: 10}
+
+	xs := [][3]float32{
+		{1, 1, 1},   // inside rMin
+		{1, 1.2, 2}, // inner bin
+		{1, 1.5, 0}, // outer bin
+		{1, 1, 3.5}, // too deep
+		{1, 2.5, 1}, // too far
+	}
+	ms := []float32{1, 2, 4, 8, 16}
+
+	sigmas, inner := make([]float64, 2), 0.0
+	insertProjectedPoints(
+		sigmas, &inner, []float64{0.1, math.Sqrt(0.1), 1}, s, xs, ms,
+		[3]float64{0, 0, 1}, config, hd,
+	)
+	if inner != 1 || sigmas[0] != 2 || sigmas[1] != 4 {
+		t.Errorf("Expected inner mass 1 and masses [2 4], got %g and %v.",
+			inner, sigmas)
+	}
+}
+
+func TestOrbitProfiles(t *testing.T) {
+	edges := []float64{0.1, math.Sqrt(0.1), 1}
+	s := ExtendedSphere{}
+	s.S.C = [3]float32{1, 1, 1}
+	s.S.R = 1
+	hd := &io.Header{TotalWidth: 10}
+
+	xs := [][3]float32{{1, 1.2, 1}, {1, 1, 1.2}, {1.5, 1, 1}, {1, 1.6, 1}}
+	vs := [][3]float32{{0, 1, 0}, {0, 0, -3}, {2, 0, 0}, {0, 4, 0}}
+	ms := []float32{1, 2, 4, 8}
+	pIDs := []int64{10, 11, 12, 13}
+
+	rhos := make([]float64, 2)
+	vBins, bulk := make([]velocityBin, 2), &velocityBin{}
+	orb := &orbitBins{
+		orbiting: map[int64]bool{11: true, 12: true, 99: true},
+		rhos:     make([]float64, 2),
+		vBins:    make([]velocityBin, 2),
+	}
+	insertPoints(rhos, vBins, bulk, orb, edges, s, xs, vs, ms, pIDs,
+		nil, &ProfConfig{}, hd)
+	if orb.rhos[0] != 2 || orb.rhos[1] != 4 {
+		t.Errorf("Expected orbiting masses [2 4], got %v.", orb.rhos)
+	}
+
+	processProfile(rhos, edges)
+	orbRhoSets, infRhoSets := orbitDensityProfiles(
+		[]*orbitBins{orb, {rhos: make([]float64, 2)}},
+		[][]float64{rhos, rhos}, [][]float64{edges, edges},
+	)
+	for j := range rhos {
+		if math.Abs(orbRhoSets[0][j]+infRhoSets[0][j]-rhos[j]) > 1e-10 {
+			t.Errorf("Expected orbiting %v and infalling %v profiles to sum "+
+				"to %v.", orbRhoSets[0], infRhoSets[0], rhos)
+			break
+		}
+	}
+	if math.Abs(orbRhoSets[0][0]/rhos[0]-2.0/3) > 1e-10 {
+		t.Errorf("Expected the orbiting fraction of bin 0 to be 2/3, got %g.",
+			orbRhoSets[0][0]/rhos[0])
+	}
+	if !math.IsNaN(orbRhoSets[1][0]) || !math.IsNaN(infRhoSets[1][0]) {
+		t.Errorf("Expected NaNs for an untracked halo, got %v and %v.",
+			orbRhoSets[1], infRhoSets[1])
+	}
+
+	orbVBins, infVBins := orbitVelocityBins(
+		[]*orbitBins{orb}, [][]velocityBin{vBins},
+	)
+	bulk0 := [3]float64{}
+	tests := []struct {
+		b  velocityBin
+		vr float64
+	}{
+		{orbVBins[0][0], -3},
+		{infVBins[0][0], 1},
+		{orbVBins[0][1], 2},
+		{infVBins[0][1], 4},
+	}
+	for i, test := range tests {
+		if vr := test.b.meanRadial(bulk0, 0); math.Abs(vr-test.vr) > 1e-6 {
+			t.Errorf("%d) Expected <v_r> = %g, got %g.", i, test.vr, vr)
+		}
+	}
+}
+
+func TestBinEdges(t *testing.T) {
+	tests := []struct {
+		config  *ProfConfig
+		norm    float64
+		edges   []float64
+		centers []float64
+		r       float64
+		bin     int
+	}{
+		{&ProfConfig{bins: 2, rMinMult: 0.5, rMaxMult: 2, binType: "log",
+			binNormalization: "R200m"},
+			2, []float64{1, 2, 4}, []float64{math.Sqrt(2), math.Sqrt(8)},
+			2.5, 1},
+		{&ProfConfig{bins: 4, rMinMult: 0, rMaxMult: 1, binType: "linear",
+			binNormalization: "R200m"},
+			2, []float64{0, 0.5, 1, 1.5, 2}, []float64{0.25, 0.75, 1.25, 1.75},
+			0.6, 1},
+		{&ProfConfig{binType: "explicit", binNormalization: "R200m",
+			edgeMults: []float64{0.1, 0.5, 2}},
+			10, []float64{1, 5, 20}, []float64{3, 12.5}, 1.5, 0},
+	}
+
+	for i, test := range tests {
+		if err := test.config.validateBins(); err != nil {
+			t.Errorf("%d) Unexpected error: %s", i, err.Error())
+			continue
+		}
+		edges := test.config.binEdges(test.norm)
+		centers := test.config.binCenters(edges)
+		if !almostEq(edges, test.edges) || !almostEq(centers, test.centers) {
+			t.Errorf("%d) Expected edges %v and centers %v, got %v and %v.",
+				i, test.edges, test.centers, edges, centers)
+		}
+		if bin := radialBin(edges, test.r); bin != test.bin {
+			t.Errorf("%d) Expected r = %g in bin %d, got %d.",
+				i, test.r, test.bin, bin)
+		}
+	}
+
+	bad := []*ProfConfig{
+		{binType: "cubic", binNormalization: "R200m"},
+		{binType: "log", binNormalization: "R500c"},
+		{binType: "explicit", binNormalization: "R200m",
+			edgeMults: []float64{1, 0.5}},
+		{binType: "log", binNormalization: "Rsp", rspColumn: 1},
+	}
+	for i, config := range bad {
+		if err := config.validateBins(); err == nil {
+			t.Errorf("%d) Expected an error for %+v.", i, *config)
+		}
+	}
+}
+
+func almostEq(xs, ys []float64) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if math.Abs(xs[i]-ys[i]) > 1e-10 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStackBin(t *testing.T) {
+	edges := []float64{1, 2, 4}
+	tests := []struct {
+		x   float64
+		bin int
+	}{
+		{0.5, -1}, {1, 0}, {1.5, 0}, {2, 1}, {3.9, 1}, {4, -1},
+		{math.NaN(), -1},
+	}
+	for _, test := range tests {
+		if bin := stackBin(edges, test.x); bin != test.bin {
+			t.Errorf("Expected %g to be in bin %d, got %d.",
+				test.x, test.bin, bin)
+		}
+	}
+}
+
+func TestStackProfiles(t *testing.T) {
+	profiles := [][]float64{{1, 5}, {2, 5}, {6, 5}}
+	mean, meanErr, med, medErr := stackProfiles(profiles, 2, 100)
+
+	if !almostEq(mean, []float64{3, 5}) || !almostEq(med, []float64{2, 5}) {
+		t.Errorf("Expected mean [3 5] and median [2 5], got %v and %v.",
+			mean, med)
+	}
+	if !(meanErr[0] > 0) || !(medErr[0] > 0) {
+		t.Errorf("Expected positive errors in bin 0, got %g and %g.",
+			meanErr[0], medErr[0])
+	}
+	if math.Abs(meanErr[1]) > 1e-6 || math.Abs(medErr[1]) > 1e-6 {
+		t.Errorf("Expected zero errors for identical profiles, got %g "+
+			"and %g.", meanErr[1], medErr[1])
+	}
+
+	mean, _, _, _ = stackProfiles(nil, 2, 100)
+	if !math.IsNaN(mean[0]) || !math.IsNaN(mean[1]) {
+		t.Errorf("Expected NaNs for an empty stack, got %v.", mean)
+	}
+}
+
+func TestBinSubhalos(t *testing.T) {
+	edges := []float64{1, 2, 3}
+	subIDs := []int{10, 11, 12, 13, 14, 15}
+	// The host (ID 10) and subhalos outside the bins aren't counted.
+	nIdxs := []int{0, 1, 2, 3, 4, 5}
+	dists := []float64{0, 0.5, 1.5, 1.9, 2.5, 3}
+
+	counts := make([]float64, 2)
+	binSubhalos(counts, edges, 10, subIDs, nIdxs, dists)
+	if !almostEq(counts, []float64{2, 1}) {
+		t.Errorf("Expected counts [2 1], got %v.", counts)
+	}
+
+	processProfile(counts, edges)
+	expected := []float64{
+		2 / shellVolume(1, 2), 1 / shellVolume(2, 3),
+	}
+	if !almostEq(counts, expected) {
+		t.Errorf("Expected number densities %v, got %v.", expected, counts)
+	}
+}
+
+func TestJackknifeCovariance(t *testing.T) {
+	// Leaving out one halo at a time gives the standard error of the mean:
+	// the sample variance of {1, 2, 6} is 7.
+	profiles := [][]float64{{1, 2}, {2, 4}, {6, 12}}
+	cov := jackknifeCovariance(profiles, []int{0, 1, 2}, 2)
+	expected := []float64{7.0 / 3, 14.0 / 3, 14.0 / 3, 28.0 / 3}
+	if !almostEq(cov, expected) {
+		t.Errorf("Expected covariance %v, got %v.", expected, cov)
+	}
+
+	// Grouping the last two halos into one region leaves two samples with
+	// means of 4 and 1.
+	cov = jackknifeCovariance(profiles, []int{0, 1, 1}, 2)
+	expected = []float64{2.25, 4.5, 4.5, 9}
+	if !almostEq(cov, expected) {
+		t.Errorf("Expected covariance %v, got %v.", expected, cov)
+	}
+
+	cov = jackknifeCovariance(profiles, []int{3, 3, 3}, 2)
+	for j := range cov {
+		if !math.IsNaN(cov[j]) {
+			t.Errorf("Expected NaNs for one region, got %v.", cov)
+			break
+		}
+	}
+}
+
+func TestBoxOctant(t *testing.T) {
+	tests := []struct {
+		x, y, z float64
+		oct     int
+	}{
+		{1, 1, 1, 0}, {1, 1, 6, 1}, {1, 6, 1, 2}, {6, 1, 1, 4},
+		{6, 6, 6, 7}, {5, 0, 5, 5},
+	}
+	for _, test := range tests {
+		oct := boxOctant(test.x, test.y, test.z, 10)
+		if oct != test.oct {
+			t.Errorf("Expected (%g, %g, %g) to be in octant %d, got %d.",
+				test.x, test.y, test.z, test.oct, oct)
+		}
+	}
+}
+
+func TestProfileArrays(t *testing.T) {
+	ids, snaps := []int{7, 8, 9}, []int{100, -1, 100}
+	// Two bins of R and Rho, then a single R_sp column.
+	cols := [][]float64{
+		{1, 0, 10}, {2, 0, 20}, {3, 0, 30}, {4, 0, 40}, {5, 0, 50},
+	}
+	names := []string{
+		"ID", "Snapshot", "R [cMpc/h]", "Rho [h^2 Msun/cMpc^3]",
+		"R_sp,prof [cMpc/h]",
+	}
+	sizes := []int{1, 1, 2, 2, 1}
+
+	arrays := profileArrays(ids, snaps, cols, names, sizes)
+	expected := []struct {
+		name string
+		data []float64
+	}{
+		{"halo_7_100/R", []float64{1, 2}},
+		{"halo_7_100/Rho", []float64{3, 4}},
+		{"halo_7_100/R_sp,prof", []float64{5}},
+		{"halo_9_100/R", []float64{10, 20}},
+		{"halo_9_100/Rho", []float64{30, 40}},
+		{"halo_9_100/R_sp,prof", []float64{50}},
+	}
+
+	if len(arrays) != len(expected)+2 {
+		t.Fatalf("Expected %d arrays, got %d.", len(expected)+2, len(arrays))
+	}
+	outIDs := arrays[0].Data.([]int64)
+	if arrays[0].Name != "id" || len(outIDs) != 2 ||
+		outIDs[0] != 7 || outIDs[1] != 9 {
+		t.Errorf("Expected id array [7 9], got %s %v.",
+			arrays[0].Name, arrays[0].Data)
+	}
+	for i, exp := range expected {
+		arr := arrays[i+2]
+		data := arr.Data.([]float64)
+		if arr.Name != exp.name || arr.Shape[0] != len(exp.data) ||
+			!almostEq(data, exp.data) {
+			t.Errorf("%d) Expected array %s %v, got %s %v.",
+				i, exp.name, exp.data, arr.Name, data)
+		}
+	}
+}
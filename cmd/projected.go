@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/los/analyze"
+	"github.com/phil-mansfield/shellfish/los/geom"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// ProjectedConfig contains the configuration fields for the 'projected' mode
+// of the shellfish tool.
+type ProjectedConfig struct {
+	axis               string
+	radialBins         int64
+	rMinMult, rMaxMult float64
+	depthMult          float64
+	smoothingWindow    int64
+}
+
+var _ Mode = &ProjectedConfig{}
+
+// ExampleConfig creates an example projected.config file.
+func (config *ProjectedConfig) ExampleConfig() string {
+	return `[projected.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The projected tool measures the splashback radius from the projected surface
+# density around each halo, the way that it is measured in weak lensing and SZ
+# observations. Particles within a cylinder centered on the halo are projected
+# along Axis, their surface density profile is found, and the splashback radius
+# is the radius where the logarithmic slope of the smoothed profile is most
+# negative.
+
+# Axis is the axis that particles are projected along. It can be x, y, or z.
+# Defaults to z.
+#
+# Axis = z
+
+# RadialBins is the number of logarithmic radial bins in the surface density
+# profile. Defaults to 64.
+#
+# RadialBins = 64
+
+# RMinMult and RMaxMult are the minimum and maximum projected radii of the
+# profile in units of R200m. Default to 0.3 and 3.
+#
+# RMinMult = 0.3
+# RMaxMult = 3
+
+# DepthMult is the half-length of the projected cylinder in units of R200m.
+# Defaults to 5.
+#
+# DepthMult = 5
+
+# SmoothingWindow is the width of the Savitzky-Golay smoothing window applied
+# to the log of the profile, in radial bins. Must be odd, larger than 4, and
+# smaller than RadialBins. Defaults to 11.
+#
+# SmoothingWindow = 11`
+}
+
+// ReadConfig reads in a projected.config file into config.
+func (config *ProjectedConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("projected.config")
+	vars.String(&config.axis, "Axis", "z")
+	vars.Int(&config.radialBins, "RadialBins", 64)
+	vars.Float(&config.rMinMult, "RMinMult", 0.3)
+	vars.Float(&config.rMaxMult, "RMaxMult", 3)
+	vars.Float(&config.depthMult, "DepthMult", 5)
+	vars.Int(&config.smoothingWindow, "SmoothingWindow", 11)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *ProjectedConfig) validate() error {
+	if _, ok := projectionAxes[config.axis]; !ok {
+		return fmt.Errorf("The 'Axis' variable is set to '%s', but it must "+
+			"be one of 'x', 'y', or 'z'.", config.axis)
+	}
+	if config.rMinMult <= 0 {
+		return fmt.Errorf("The 'RMinMult' variable is set to %g, but it "+
+			"needs to be positive.", config.rMinMult)
+	}
+	if config.rMaxMult <= config.rMinMult {
+		return fmt.Errorf("The 'RMaxMult' variable is set to %g, but it "+
+			"needs to be larger than 'RMinMult', %g.",
+			config.rMaxMult, config.rMinMult)
+	}
+	if config.depthMult <= 0 {
+		return fmt.Errorf("The 'DepthMult' variable is set to %g, but it "+
+			"needs to be positive.", config.depthMult)
+	}
+	if config.smoothingWindow <= 4 || config.smoothingWindow%2 != 1 {
+		return fmt.Errorf("The 'SmoothingWindow' variable is set to %d, but "+
+			"it needs to be odd and larger than 4.", config.smoothingWindow)
+	}
+	if config.radialBins <= config.smoothingWindow {
+		return fmt.Errorf("The 'RadialBins' variable is set to %d, but it "+
+			"needs to be larger than 'SmoothingWindow', %d.",
+			config.radialBins, config.smoothingWindow)
+	}
+	return nil
+}
+
+// projectionAxes maps axis names onto the index of the projected axis and the
+// indices of the two axes in the plane of the sky.
+var projectionAxes = map[string][3]int{
+	"x": {0, 1, 2}, "y": {1, 2, 0}, "z": {2, 0, 1},
+}
+
+// Run executes the projected mode of the shellfish tool.
+func (config *ProjectedConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#########################
+## shellfish projected ##
+#########################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, coords, err := catalog.Parse(
+		stdin, []int{0, 1}, []int{2, 3, 4, 5},
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = readInputUnits(
+		stdin, snaps, coords, repeatKind(lengthUnit, 4), buf, e,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rsps := make([]float64, len(ids))
+	ratios := make([]float64, len(ids))
+	slopes := make([]float64, len(ids))
+	for i := range rsps {
+		rsps[i], ratios[i], slopes[i] = math.NaN(), math.NaN(), math.NaN()
+	}
+
+	// The sphere which bounds the projected cylinder.
+	bound := math.Sqrt(config.rMaxMult*config.rMaxMult +
+		config.depthMult*config.depthMult)
+
+	_, idxBins := binBySnap(snaps, ids)
+	for snap, idxs := range idxBins {
+		if snap == -1 {
+			continue
+		}
+
+		spheres := make([]geom.Sphere, len(idxs))
+		for j, i := range idxs {
+			spheres[j] = geom.Sphere{
+				C: [3]float32{
+					float32(coords[0][i]), float32(coords[1][i]),
+					float32(coords[2][i]),
+				},
+				R: float32(coords[3][i] * bound),
+			}
+		}
+		ps, _, err := causticSphereParticles(snap, spheres, buf, e)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, i := range idxs {
+			r200m := coords[3][i]
+			if r200m <= 0 {
+				continue
+			}
+			rsps[i], slopes[i] = config.projectedRadius(ps[j], r200m)
+			ratios[i] = rsps[i] / r200m
+		}
+	}
+
+	order := []int{0, 1, 2, 3, 4}
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps}, [][]float64{rsps, ratios, slopes}, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot"},
+		[]string{"R_sp,2D [cMpc/h]", "R_sp,2D/R200m", "Slope"},
+		order, []int{1, 1, 1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
+
+// projectedRadius returns the radius where the logarithmic slope of the
+// projected surface density profile of a halo is most negative, along with
+// that slope. NaNs are returned if any bin of the profile is empty.
+func (config *ProjectedConfig) projectedRadius(
+	ps *causticParticles, r200m float64,
+) (float64, float64) {
+	axes := projectionAxes[config.axis]
+	depth := float32(r200m * config.depthMult)
+
+	rs, ms := []float64{}, []float64{}
+	for i, dx := range ps.dxs {
+		if dx[axes[0]] > depth || dx[axes[0]] < -depth {
+			continue
+		}
+		x, y := float64(dx[axes[1]]), float64(dx[axes[2]])
+		rs = append(rs, math.Sqrt(x*x+y*y))
+		ms = append(ms, float64(ps.ms[i]))
+	}
+
+	rMin, rMax := r200m*config.rMinMult, r200m*config.rMaxMult
+	centers, sigmas := halo.SurfaceDensityProfile(
+		rs, ms, rMin, rMax, int(config.radialBins),
+	)
+	for _, sigma := range sigmas {
+		if sigma == 0 {
+			return math.NaN(), math.NaN()
+		}
+	}
+
+	_, derivs, ok := analyze.Smooth(
+		centers, sigmas, int(config.smoothingWindow),
+	)
+	if !ok {
+		return math.NaN(), math.NaN()
+	}
+	r, ok := analyze.MinimumSlopeRadius(centers, derivs, rMin, rMax)
+	if !ok {
+		return math.NaN(), math.NaN()
+	}
+
+	slope := math.NaN()
+	for j := range centers {
+		if centers[j] == r {
+			slope = derivs[j]
+		}
+	}
+	return r, slope
+}
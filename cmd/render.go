@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/los/analyze"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// RenderConfig contains the configuration fields for the 'render' mode of
+// the shellfish tool.
+type RenderConfig struct {
+	order        int64
+	fitBasis     string
+	harmonicLMax int64
+	format       string
+	dir          string
+	resolution   int64
+	centered     bool
+}
+
+var _ Mode = &RenderConfig{}
+
+// ExampleConfig creates an example render.config file.
+func (config *RenderConfig) ExampleConfig() string {
+	return `[render.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The render tool reads the shells output by the shell tool and writes a
+# triangulated mesh of each one to Dir so they can be viewed alongside particle
+# data in tools like ParaView and Blender. Files are named
+# shell_<snap>_<id>.<Format>.
+
+# Order, FitBasis, and HarmonicLMax must match the values used by the shell tool
+# when it generated the input shells. Default to 3, penna, and 6.
+#
+# Order = 3
+# FitBasis = penna
+# HarmonicLMax = 6
+
+# Format is the file format of the meshes. It can be set to obj (Wavefront
+# OBJ), ply (ASCII PLY), or vtk (legacy ASCII VTK). Defaults to obj.
+#
+# Format = obj
+
+# Dir is the directory that meshes are written to. Defaults to the current
+# directory.
+#
+# Dir = .
+
+# Resolution is the number of polar angles that each shell is evaluated at.
+# Twice as many azimuthal angles are used. Defaults to 32.
+#
+# Resolution = 32
+
+# By default, vertices are written in the comoving coordinates of the
+# simulation box, in cMpc/h, so meshes line up with particle data. If Centered
+# is true, vertices are instead relative to the center of the halo.
+#
+# Centered = false`
+}
+
+// ReadConfig reads in a render.config file into config.
+func (config *RenderConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("render.config")
+	vars.Int(&config.order, "Order", 3)
+	vars.String(&config.fitBasis, "FitBasis", "penna")
+	vars.Int(&config.harmonicLMax, "HarmonicLMax", 6)
+	vars.String(&config.format, "Format", "obj")
+	vars.String(&config.dir, "Dir", ".")
+	vars.Int(&config.resolution, "Resolution", 32)
+	vars.Bool(&config.centered, "Centered", false)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *RenderConfig) validate() error {
+	if config.order <= 0 {
+		return fmt.Errorf("The 'Order' variable is set to %d, but it "+
+			"needs to be positive.", config.order)
+	}
+	if config.harmonicLMax < 0 {
+		return fmt.Errorf("The 'HarmonicLMax' variable is set to %d, but "+
+			"it can't be negative.", config.harmonicLMax)
+	}
+	if config.resolution < 2 {
+		return fmt.Errorf("The 'Resolution' variable is set to %d, but it "+
+			"needs to be at least 2.", config.resolution)
+	}
+	switch config.fitBasis {
+	case "penna", "harmonic":
+	default:
+		return fmt.Errorf("The 'FitBasis' variable is set to '%s', but it "+
+			"must be either 'penna' or 'harmonic'.", config.fitBasis)
+	}
+	switch config.format {
+	case "obj", "ply", "vtk":
+	default:
+		return fmt.Errorf("The 'Format' variable is set to '%s', but it "+
+			"must be one of 'obj', 'ply', or 'vtk'.", config.format)
+	}
+	return nil
+}
+
+// Run executes the render mode of the shellfish tool.
+func (config *RenderConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+######################
+## shellfish render ##
+######################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	nCoeffs := int(2 * config.order * config.order)
+	if config.fitBasis == "harmonic" {
+		nCoeffs = int((config.harmonicLMax + 1) * (config.harmonicLMax + 1))
+	}
+	floatColIdxs := make([]int, 4+nCoeffs)
+	for i := range floatColIdxs {
+		floatColIdxs[i] = i + 2
+	}
+	intCols, floatCols, err := catalog.Parse(
+		stdin, []int{0, 1}, floatColIdxs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+	coords, coeffs := floatCols[:3], transpose(floatCols[4:])
+
+	vertices := make([]int, len(ids))
+	for i := range ids {
+		if snaps[i] == -1 || hasNaN(coeffs[i]) {
+			continue
+		}
+
+		var shell analyze.Shell
+		if config.fitBasis == "harmonic" {
+			shell = analyze.HarmonicFunc(coeffs[i], int(config.harmonicLMax))
+		} else {
+			order := int(config.order)
+			shell = analyze.PennaFunc(coeffs[i], order, order, 2)
+		}
+
+		vs, faces := shell.Mesh(int(config.resolution))
+		if !config.centered {
+			for j := range vs {
+				for k := 0; k < 3; k++ {
+					vs[j][k] += coords[k][i]
+				}
+			}
+		}
+
+		fname := path.Join(config.dir, fmt.Sprintf(
+			"shell_%d_%d.%s", snaps[i], ids[i], config.format,
+		))
+		f, err := os.Create(fname)
+		if err != nil {
+			return nil, err
+		}
+		err = io.WriteMesh(f, config.format, vs, faces)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		vertices[i] = len(vs)
+	}
+
+	order := []int{0, 1, 2}
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps, vertices}, [][]float64{}, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot", "Vertices"}, []string{},
+		order, []int{1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
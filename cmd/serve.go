@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// ServeConfig contains the configuration fields for the 'serve' mode of the
+// shellfish tool.
+type ServeConfig struct {
+	address string
+	modes   []string
+
+	stages []Mode
+}
+
+var _ Mode = &ServeConfig{}
+
+// ExampleConfig creates an example serve.config file.
+func (config *ServeConfig) ExampleConfig() string {
+	return `[serve.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# Address is the address that the server listens on for HTTP requests.
+# Defaults to localhost:8080, which only accepts requests from the same
+# machine. To accept requests from other machines, set it to a specific
+# network interface (e.g. 192.168.1.10:8080) or to :8080 for every interface.
+# The server has no authentication, so only do this on a trusted network.
+# Address = localhost:8080
+
+# Modes is the list of modes which are run on every requested halo, starting
+# from a catalog of IDs and snapshots. Each mode reads its variables from the
+# section of this file with that mode's usual header (e.g. [shell.config]), in
+# the same way as the pipeline mode. The first mode is usually coord. Defaults
+# to coord, shell.
+#
+# Snapshot headers, halo catalogs, and the particles of every snapshot file
+# that's read stay in memory between requests. If shell is one of the Modes
+# and its MemoryCap is set, the cached particles are kept under MemoryCap by
+# dropping the least recently used files.
+# Modes = coord, shell
+
+[shell.config]
+
+# Variables for each of the modes in Modes go in their own sections.
+# Rings = 50`
+}
+
+// ReadConfig reads in a serve.config file into config, along with the
+// sections used by each of its modes.
+func (config *ServeConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("serve.config")
+	vars.String(&config.address, "Address", "localhost:8080")
+	vars.Strings(&config.modes, "Modes", []string{"coord", "shell"})
+
+	if fname == "" {
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+		if err := config.validate(); err != nil {
+			return err
+		}
+		config.stages = make([]Mode, len(config.modes))
+		for i, name := range config.modes {
+			config.stages[i] = newMode(name)
+			if err := config.stages[i].ReadConfig("", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	var err error
+	config.stages, err = readStages(fname, config.modes)
+	return err
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *ServeConfig) validate() error {
+	if config.address == "" {
+		return fmt.Errorf("The variable 'Address' was not set.")
+	}
+	if err := validateStageNames(config.modes); err != nil {
+		return err
+	}
+	for _, name := range config.modes {
+		switch name {
+		case "id", "check", "merge":
+			return fmt.Errorf("The variable 'Modes' contains '%s', which "+
+				"can't be run on requested halos.", name)
+		}
+	}
+	return nil
+}
+
+// Stages returns the names of the modes run on each request, in order.
+func (config *ServeConfig) Stages() []string {
+	return config.modes
+}
+
+// Run executes the serve mode of the shellfish tool. It only returns if the
+// server fails.
+func (config *ServeConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#####################
+## shellfish serve ##
+#####################`,
+		)
+		log.Printf("Listening on %s.", config.address)
+	}
+
+	// Headers, halo catalogs, and particles are kept in memory between
+	// requests.
+	memo.Caching = true
+	particleCache = newParticleFileCache(config.particleCacheBytes())
+
+	s := &server{config: config, gConfig: gConfig, e: e}
+	return nil, http.ListenAndServe(config.address, s.handler())
+}
+
+// particleCacheBytes returns the largest amount of memory, in bytes, that
+// cached particles can use: the MemoryCap of the shell mode if it's one of the
+// stages, or -1 (no limit) otherwise.
+func (config *ServeConfig) particleCacheBytes() int64 {
+	for _, stage := range config.stages {
+		if shell, ok := stage.(*ShellConfig); ok && shell.memoryCap > 0 {
+			return int64(shell.memoryCap * 1e9)
+		}
+	}
+	return -1
+}
+
+// server answers measurement requests. Modes use global state (like
+// GOMAXPROCS and the memo cache), so only one request is run at a time.
+type server struct {
+	sync.Mutex
+	config  *ServeConfig
+	gConfig *GlobalConfig
+	e       *env.Environment
+}
+
+// serveHalo is a single requested halo.
+type serveHalo struct {
+	ID   int `json:"id"`
+	Snap int `json:"snap"`
+}
+
+// maxServeRequestBytes is the largest POST body that the server will read.
+const maxServeRequestBytes = 1 << 20
+
+// serveRequest is the body of a POST request to /measure.
+type serveRequest struct {
+	Halos []serveHalo `json:"halos"`
+}
+
+// serveResponse is the body of every response to /measure. Header contains
+// the comment lines of the output catalog and Rows contains its other lines.
+// Rows are strings because JSON can't represent NaNs.
+type serveResponse struct {
+	Header []string `json:"header,omitempty"`
+	Rows   []string `json:"rows,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// handler returns the server's HTTP handler:
+//
+//	GET  /health                 responds with "ok".
+//	GET  /measure?id=X&snap=Y    measures a single halo.
+//	POST /measure                measures every halo in a serveRequest.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/measure", s.handleMeasure)
+	return mux
+}
+
+// handleMeasure answers requests to /measure.
+func (s *server) handleMeasure(w http.ResponseWriter, r *http.Request) {
+	halos, err := parseServeRequest(w, r)
+	if err != nil {
+		writeServeResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	lines, err := s.measure(halos)
+	if err != nil {
+		writeServeResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	writeServeResponse(w, http.StatusOK, lines, nil)
+}
+
+// parseServeRequest reads the requested halos from either the query string
+// of a GET request or the JSON body of a POST request. Bodies longer than
+// maxServeRequestBytes are rejected.
+func parseServeRequest(
+	w http.ResponseWriter, r *http.Request,
+) ([]serveHalo, error) {
+	switch r.Method {
+	case http.MethodGet:
+		id, errID := strconv.Atoi(r.URL.Query().Get("id"))
+		snap, errSnap := strconv.Atoi(r.URL.Query().Get("snap"))
+		if errID != nil || errSnap != nil {
+			return nil, fmt.Errorf("GET requests must set integer 'id' " +
+				"and 'snap' parameters.")
+		}
+		return []serveHalo{{id, snap}}, nil
+	case http.MethodPost:
+		req := &serveRequest{}
+		body := http.MaxBytesReader(w, r.Body, maxServeRequestBytes)
+		if err := json.NewDecoder(body).Decode(req); err != nil {
+			return nil, fmt.Errorf("Could not parse the request body: %s",
+				err.Error())
+		} else if len(req.Halos) == 0 {
+			return nil, fmt.Errorf("The request didn't contain any halos.")
+		}
+		return req.Halos, nil
+	}
+	return nil, fmt.Errorf("Unsupported HTTP method %s.", r.Method)
+}
+
+// measure runs every mode on the requested halos and returns the output
+// catalog of the last one.
+func (s *server) measure(halos []serveHalo) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	lines := []string{"# Column contents: ID(0) Snapshot(1)"}
+	for _, h := range halos {
+		lines = append(lines, fmt.Sprintf("%d %d", h.ID, h.Snap))
+	}
+
+	var err error
+	for i, stage := range s.config.stages {
+		lines, err = stage.Run(s.gConfig, s.e, pipelineLines(lines))
+		if err != nil {
+			return nil, fmt.Errorf("Error running mode %s:\n%s",
+				s.config.modes[i], err.Error())
+		}
+	}
+	return lines, nil
+}
+
+// writeServeResponse writes a catalog or an error as JSON.
+func writeServeResponse(
+	w http.ResponseWriter, status int, lines []string, err error,
+) {
+	resp := &serveResponse{}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			resp.Header = append(resp.Header, line)
+		} else if len(strings.TrimSpace(line)) > 0 {
+			resp.Rows = append(resp.Rows, line)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+// doubleMode is a Mode which doubles the IDs of its input catalog.
+type doubleMode struct{}
+
+func (m *doubleMode) ExampleConfig() string                     { return "" }
+func (m *doubleMode) ReadConfig(fname string, f []string) error { return nil }
+func (m *doubleMode) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	cols, _, err := catalog.Parse(stdin, []int{0, 1}, []int{})
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{"# Column contents: ID(0) Snapshot(1)"}
+	for i := range cols[0] {
+		if cols[0][i] < 0 {
+			return nil, fmt.Errorf("Negative ID %d.", cols[0][i])
+		}
+		lines = append(lines, fmt.Sprintf("%d %d", 2*cols[0][i], cols[1][i]))
+	}
+	return lines, nil
+}
+
+func TestServeMeasure(t *testing.T) {
+	config := &ServeConfig{
+		modes:  []string{"double", "double"},
+		stages: []Mode{&doubleMode{}, &doubleMode{}},
+	}
+	s := &server{config: config}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		rows               []string
+	}{
+		{"GET", "/measure?id=3&snap=100", "", 200, []string{"12 100"}},
+		{"POST", "/measure",
+			`{"halos": [{"id": 1, "snap": 90}, {"id": 2, "snap": 100}]}`,
+			200, []string{"4 90", "8 100"}},
+		{"GET", "/measure?id=3", "", 400, nil},
+		{"POST", "/measure", `{"halos": []}`, 400, nil},
+		{"POST", "/measure", `meow`, 400, nil},
+		{"GET", "/measure?id=-1&snap=100", "", 500, nil},
+		{"POST", "/measure", `{"pad": "` +
+			strings.Repeat("a", maxServeRequestBytes) +
+			`", "halos": [{"id": 1, "snap": 90}]}`, 400, nil},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, ts.URL+test.path,
+			strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		out := &serveResponse{}
+		err = json.NewDecoder(resp.Body).Decode(out)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%d) Could not decode response: %s", i, err.Error())
+			continue
+		}
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%d) Expected status %d, got %d (error '%s').",
+				i, test.status, resp.StatusCode, out.Error)
+		} else if test.status == 200 {
+			if !stringSlicesEqual(out.Rows, test.rows) {
+				t.Errorf("%d) Expected rows %v, got %v.",
+					i, test.rows, out.Rows)
+			}
+			if len(out.Header) != 1 {
+				t.Errorf("%d) Expected one header line, got %v.",
+					i, out.Header)
+			}
+		} else if out.Error == "" {
+			t.Errorf("%d) Expected an error message.", i)
+		}
+	}
+}
+
+func TestServeValidate(t *testing.T) {
+	tests := []struct {
+		modes []string
+		valid bool
+	}{
+		{[]string{"coord", "shell"}, true},
+		{[]string{"coord", "shell", "stats"}, true},
+		{[]string{"id", "coord"}, false},
+		{[]string{"coord", "serve"}, false},
+		{[]string{"coord", "coord"}, false},
+	}
+
+	for i, test := range tests {
+		config := &ServeConfig{address: ":8080", modes: test.modes}
+		if err := config.validate(); (err == nil) != test.valid {
+			t.Errorf("%d) Expected valid = %v for %v, got error %v.",
+				i, test.valid, test.modes, err)
+		}
+	}
+}
+
+// countBuffer is a VectorBuffer which counts how many times each file is read.
+// Every file holds n particles with positions equal to the file's index.
+type countBuffer struct {
+	io.NilBuffer
+	files map[string]int
+	reads map[string]int
+	xs    [][3]float32
+	ms    []float32
+	open  bool
+}
+
+func (buf *countBuffer) Read(fname string) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	n, ok := buf.files[fname]
+	if !ok {
+		return nil, nil, nil, nil, fmt.Errorf("No file named %s.", fname)
+	}
+	buf.reads[fname]++
+	buf.open = true
+	buf.xs, buf.ms = buf.xs[:0], buf.ms[:0]
+	for i := 0; i < n; i++ {
+		x := float32(len(fname))
+		buf.xs = append(buf.xs, [3]float32{x, x, x})
+		buf.ms = append(buf.ms, 1)
+	}
+	return buf.xs, nil, buf.ms, nil, nil
+}
+
+func (buf *countBuffer) Close()           { buf.open = false }
+func (buf *countBuffer) IsOpen() bool     { return buf.open }
+func (buf *countBuffer) MinMass() float32 { return 1 }
+
+func TestCachingBuffer(t *testing.T) {
+	// Each 10-particle file uses 160 bytes, so two fit in the cache.
+	files := map[string]int{"a": 10, "bb": 10, "ccc": 10, "dddd": 30}
+	under := &countBuffer{files: files, reads: map[string]int{}}
+	buf := &cachingBuffer{VectorBuffer: under, cache: newParticleFileCache(320)}
+
+	tests := []struct {
+		fname string
+		reads int
+	}{
+		{"a", 1}, {"bb", 1}, {"a", 1}, {"ccc", 1}, {"a", 1}, {"bb", 2},
+		{"dddd", 1}, {"dddd", 2},
+	}
+
+	for i, test := range tests {
+		xs, _, ms, _, err := buf.Read(test.fname)
+		if err != nil {
+			t.Fatalf("%d) Unexpected error: %s", i, err.Error())
+		}
+		x := float32(len(test.fname))
+		if len(xs) != files[test.fname] || len(ms) != len(xs) ||
+			xs[0] != [3]float32{x, x, x} || buf.MinMass() != 1 {
+			t.Errorf("%d) Read the wrong particles from %s.", i, test.fname)
+		}
+		// Callers may modify the particles they're given.
+		xs[0][0], ms[0] = -1, -1
+		buf.Close()
+
+		if under.reads[test.fname] != test.reads {
+			t.Errorf("%d) Expected %s to be read %d times, got %d.",
+				i, test.fname, test.reads, under.reads[test.fname])
+		}
+		if under.open {
+			t.Errorf("%d) Underlying buffer wasn't closed.", i)
+		}
+		if buf.cache.bytes > buf.cache.capBytes {
+			t.Errorf("%d) Cache uses %d bytes, more than its cap of %d.",
+				i, buf.cache.bytes, buf.cache.capBytes)
+		}
+	}
+
+	if _, _, _, _, err := buf.Read("meow"); err == nil {
+		t.Errorf("Expected an error for a missing file.")
+	}
+}
+
+func TestParticleCacheBytes(t *testing.T) {
+	tests := []struct {
+		stages   []Mode
+		expected int64
+	}{
+		{[]Mode{&doubleMode{}}, -1},
+		{[]Mode{&doubleMode{}, &ShellConfig{memoryCap: -1}}, -1},
+		{[]Mode{&doubleMode{}, &ShellConfig{memoryCap: 2.5}}, 2500000000},
+	}
+
+	for i, test := range tests {
+		config := &ServeConfig{stages: test.stages}
+		if bytes := config.particleCacheBytes(); bytes != test.expected {
+			t.Errorf("%d) Expected %d bytes, got %d.",
+				i, test.expected, bytes)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// SplitShardFlag removes the --Shard flag and its value from a list of
+// command line flags. shard is "" if the flag wasn't given.
+func SplitShardFlag(flags []string) (rest []string, shard string, err error) {
+	return SplitFlag(flags, "Shard")
+}
+
+// SplitFlag removes the flag --<name> and its value from a list of command
+// line flags. Flag names are case insensitive. value is "" if the flag wasn't
+// given. This is used for flags which are handled by the shellfish tool
+// itself rather than by any of its modes.
+func SplitFlag(
+	flags []string, name string,
+) (rest []string, value string, err error) {
+	rest = []string{}
+	for i := 0; i < len(flags); i++ {
+		if strings.ToLower(flags[i]) != "--"+strings.ToLower(name) {
+			rest = append(rest, flags[i])
+			continue
+		}
+
+		if value != "" {
+			return nil, "", fmt.Errorf("The flag '%s' was assigned twice.",
+				name)
+		} else if i+1 >= len(flags) || strings.HasPrefix(flags[i+1], "--") {
+			return nil, "", fmt.Errorf("The flag '%s' was supplied, "+
+				"but wasn't set to a value.", name)
+		}
+		value = flags[i+1]
+		i++
+	}
+	return rest, value, nil
+}
+
+// ParseShard parses a shard of the form "i/N", where N is the number of
+// shards and i is the index of the shard, from 0 to N - 1.
+func ParseShard(shard string) (i, n int, err error) {
+	tok := strings.Split(shard, "/")
+	if len(tok) == 2 {
+		i, errI := strconv.Atoi(strings.TrimSpace(tok[0]))
+		n, errN := strconv.Atoi(strings.TrimSpace(tok[1]))
+		if errI == nil && errN == nil && n > 0 && i >= 0 && i < n {
+			return i, n, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("The flag 'Shard' was set to '%s', but it must "+
+		"have the form i/N, where 0 <= i < N.", shard)
+}
+
+// ShardCatalog returns the comment lines of a catalog along with the rows
+// that belong to shard i of n. Rows are assigned to shards by hashing their
+// first two columns (the ID and snapshot), so the same halo always ends up in
+// the same shard, and every row is in exactly one of the n shards.
+func ShardCatalog(data []byte, i, n int) []byte {
+	out := [][]byte{}
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 {
+			continue
+		} else if trimmed[0] == '#' || shardIndex(trimmed, n) == i {
+			out = append(out, line)
+		}
+	}
+
+	if len(out) == 0 {
+		return []byte{}
+	}
+	return append(bytes.Join(out, []byte{'\n'}), '\n')
+}
+
+// shardIndex returns the shard that a catalog row belongs to.
+func shardIndex(row []byte, n int) int {
+	fields := bytes.Fields(row)
+	if len(fields) > 2 {
+		fields = fields[:2]
+	}
+
+	h := fnv.New32a()
+	h.Write(bytes.Join(fields, []byte{' '}))
+	return int(h.Sum32() % uint32(n))
+}
+
+// HasRows returns true if a catalog has any lines which aren't comments.
+func HasRows(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && line[0] != '#' {
+			return true
+		}
+	}
+	return false
+}
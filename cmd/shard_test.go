@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestSplitShardFlag(t *testing.T) {
+	tests := []struct {
+		flags []string
+		rest  []string
+		shard string
+		valid bool
+	}{
+		{[]string{}, []string{}, "", true},
+		{[]string{"--Snap", "100"}, []string{"--Snap", "100"}, "", true},
+		{[]string{"--Shard", "3/8"}, []string{}, "3/8", true},
+		{[]string{"--Snap", "100", "--shard", "0/2"},
+			[]string{"--Snap", "100"}, "0/2", true},
+		{[]string{"--Shard"}, nil, "", false},
+		{[]string{"--Shard", "--Snap", "100"}, nil, "", false},
+		{[]string{"--Shard", "0/2", "--Shard", "1/2"}, nil, "", false},
+	}
+
+	for i, test := range tests {
+		rest, shard, err := SplitShardFlag(test.flags)
+		if (err == nil) != test.valid {
+			t.Errorf("%d) Expected valid = %v, got error %v.",
+				i, test.valid, err)
+		} else if test.valid &&
+			(shard != test.shard || !stringSlicesEqual(rest, test.rest)) {
+			t.Errorf("%d) Expected %v and '%s', got %v and '%s'.",
+				i, test.rest, test.shard, rest, shard)
+		}
+	}
+}
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		shard string
+		i, n  int
+		valid bool
+	}{
+		{"0/1", 0, 1, true},
+		{"3/8", 3, 8, true},
+		{"8/8", 0, 0, false},
+		{"-1/8", 0, 0, false},
+		{"0/0", 0, 0, false},
+		{"3", 0, 0, false},
+		{"a/b", 0, 0, false},
+	}
+
+	for j, test := range tests {
+		i, n, err := ParseShard(test.shard)
+		if (err == nil) != test.valid {
+			t.Errorf("%d) Expected valid = %v for '%s', got error %v.",
+				j, test.valid, test.shard, err)
+		} else if test.valid && (i != test.i || n != test.n) {
+			t.Errorf("%d) Expected %d/%d for '%s', got %d/%d.",
+				j, test.i, test.n, test.shard, i, n)
+		}
+	}
+}
+
+func TestShardCatalog(t *testing.T) {
+	header := "# Column contents: ID(0) Snapshot(1)\n"
+	data := header
+	for id := 0; id < 100; id++ {
+		data += fmt.Sprintf("%d 100\n", id)
+	}
+
+	n := 4
+	seen := map[string]int{}
+	for i := 0; i < n; i++ {
+		shard := ShardCatalog([]byte(data), i, n)
+		if !bytes.HasPrefix(shard, []byte(header)) {
+			t.Errorf("Shard %d doesn't start with the header.", i)
+		}
+
+		again := ShardCatalog([]byte(data), i, n)
+		if !bytes.Equal(shard, again) {
+			t.Errorf("Shard %d isn't deterministic.", i)
+		}
+
+		lines := bytes.Split(bytes.TrimSpace(shard), []byte{'\n'})
+		for _, line := range lines[1:] {
+			seen[string(line)]++
+		}
+	}
+
+	if len(seen) != 100 {
+		t.Errorf("Expected 100 rows across all shards, got %d.", len(seen))
+	}
+	for row, count := range seen {
+		if count != 1 {
+			t.Errorf("Row '%s' is in %d shards.", row, count)
+		}
+	}
+}
@@ -4,18 +4,23 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"os"
+	"path"
 	"runtime"
 	"sort"
 	"time"
 
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
 	"github.com/phil-mansfield/shellfish/cmd/memo"
 	"github.com/phil-mansfield/shellfish/cosmo"
 	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/lib"
 	"github.com/phil-mansfield/shellfish/logging"
 	"github.com/phil-mansfield/shellfish/los"
 	"github.com/phil-mansfield/shellfish/los/analyze"
+	"github.com/phil-mansfield/shellfish/los/geom"
 	"github.com/phil-mansfield/shellfish/math/rand"
 	"github.com/phil-mansfield/shellfish/parse"
 	msort "github.com/phil-mansfield/shellfish/math/sort"
@@ -29,6 +34,36 @@ type ShellConfig struct {
 	percentileProfile bool
 	percentile float64
 
+	ellipsoid       bool
+	particleSpecies string
+	bootstraps      int64
+
+	convergenceTolerance float64
+	maxRings             int64
+
+	fitBasis          string
+	harmonicLMax      int64
+	harmonicSmoothing float64
+
+	filamentSigma float64
+
+	exciseSubhalos    bool
+	subhaloMassRatio  float64
+	subhaloRadiusMult float64
+
+	healpixNside int64
+	healpixDir   string
+
+	smoothingKernel string
+	smoothingSigma  float64
+
+	shellDefinition              string
+	slopeRMinMult, slopeRMaxMult float64
+
+	memoryCap float64
+
+	massScaledKernels bool
+
 	eta                                             float64
 	order, smoothingWindow, levels, subsampleFactor int64
 	losSlopeCutoff, backgroundRhoMult               float64
@@ -76,19 +111,34 @@ RKernelMult = 0.2
 # complicated to be described here and can be found in the Shellfish paper.
 Eta = 10.0
 
-# Order indicates the order of the Penna function used to represent the
-# splashback shell.
+# Order indicates the order of the Penna-Dines function used to represent the
+# splashback shell. The shell has 2*Order^2 coefficients. Lower orders give
+# smoother shells, while higher orders can capture the strongly aspherical
+# shells of major mergers. Rings must be at least 2*Order^2 so that every
+# coefficient is constrained. If you change this, the Order variables used by
+# stats and prof must be changed to match.
 Order = 3
 
 # Levels is the number of recursive angular splittings that should be done when
 # filtering points.
 Levels = 3
 
-# SmoothingWindow is the width of the Savitzky-Golay smoothing window used
+# SmoothingWindow is the width of the smoothing window, in radial bins, used
 # when finding the point of steepest slope along lines of sight. Must be an odd
-# number.
+# number smaller than RadialBins.
 SmoothingWindow = 121
 
+# SmoothingKernel is the kernel used to smooth the log-density along lines of
+# sight. It can be set to savgol (a 4th order Savitzky-Golay filter), gaussian,
+# or tophat. The default window over-smooths the noisy profiles of low-mass
+# halos, where a narrower window or a Gaussian kernel can work better.
+SmoothingKernel = savgol
+
+# SmoothingSigma is the standard deviation of the Gaussian kernel in radial
+# bins. The kernel is truncated at SmoothingWindow. Only used when
+# SmoothingKernel = gaussian.
+SmoothingSigma = 20
+
 # Cutoff is the minimum slope allowed when finding the point of steepest slope
 # for individual lines of sight. Of all the parameters that should not be
 # changed, this is the one which should not be changed the most.
@@ -96,7 +146,117 @@ LOSSlopeCutoff = 0.0
 
 # BackgroundRhoMult is the density assigned to points which do not intersect
 # with any kernels as a multiple of the kernel density.
-BackgroundRhoMult = 0.5`
+BackgroundRhoMult = 0.5
+
+# Ellipsoid replaces the Penna-Dines shell with a triaxial ellipsoid fit to the
+# same points. Instead of Penna-Dines coefficients, each halo is followed by
+# the offset of the ellipsoid's center from the halo center, the three axis
+# lengths (A >= B >= C), the axis ratios B/A and C/A, and the unit vector
+# pointing along the major axis. stats and prof can't read this output.
+Ellipsoid = false
+
+# ParticleSpecies is the type of particle used to measure the shell. It can be
+# set to dm, gas, stars, or all. gas and stars correspond to Gadget particle
+# types 0 and 4 and are only supported when SnapshotType = Gadget-2. The
+# dark matter types are given by GadgetDMTypeIndices in the global config
+# file. Baryonic particles are weighted by their individual masses, so be sure
+# that GadgetSingleMassIndices is set correctly.
+ParticleSpecies = dm
+
+# Bootstraps is the number of times each shell is refit to a set of rings
+# resampled with replacement. If it is larger than zero, the Penna-Dines
+# coefficients of every bootstrap shell are written after the coefficients of
+# the main shell, and stats will use them to estimate uncertainties in R_sp and
+# M_sp. If you change this, the Bootstraps variable used by stats must be
+# changed to match.
+Bootstraps = 0
+
+# ConvergenceTolerance turns on automatic convergence checking when set to a
+# positive value. Each halo's shell is first measured with Rings rings, then the
+# number of rings is repeatedly doubled until the shell's volume-equivalent
+# radius changes by a fraction smaller than ConvergenceTolerance, or until the
+# number of rings would exceed MaxRings. The number of rings used for each halo
+# is added as a final column, Rings. Every doubling requires all the particles
+# around unconverged halos to be read again. Turned off by default.
+ConvergenceTolerance = -1
+
+# MaxRings is the largest number of rings which will be used when
+# ConvergenceTolerance is set.
+MaxRings = 1600
+
+# FitBasis is the set of functions used to fit the shell. It can be set to
+# penna, for the Penna-Dines basis, or harmonic, for a penalized fit of real
+# spherical harmonics. The harmonic basis can behave better for halos where
+# Penna-Dines fits oscillate. Harmonic shells are written as (HarmonicLMax+1)^2
+# coefficients, Y_lm, ordered by l and then m from -l to l. stats and prof
+# can't read these shells.
+FitBasis = penna
+
+# HarmonicLMax is the maximum degree of the harmonics used when
+# FitBasis = harmonic.
+HarmonicLMax = 6
+
+# HarmonicSmoothing is the strength of the smoothing penalty used when
+# FitBasis = harmonic. Each coefficient, a_lm, is penalized by
+# HarmonicSmoothing * (l(l+1))^2 * a_lm^2 per point, so larger values give
+# smoother shells.
+HarmonicSmoothing = 0.001
+
+# FilamentSigma turns on filament masking when set to a positive value.
+# Filaments make the shell too large along their directions. Each line of
+# sight is normalized by its mean log-density over the outer half of its
+# radial range, and lines of sight whose normalization is more than
+# FilamentSigma robust standard deviations above the halo's median are
+# ignored when fitting the shell. Turned off by default.
+FilamentSigma = -1
+
+# ExciseSubhalos removes the particles around massive subhalos before the
+# densities along each line of sight are computed, since large substructure
+# near the shell can create sharp false edges. Every halo in the halo catalog
+# which is within RMaxMult*R200m of the host, is less massive than the host,
+# and has an M200m of at least SubhaloMassRatio times the host's is excised.
+# Particles within SubhaloRadiusMult times the subhalo's R200m are removed.
+ExciseSubhalos = false
+SubhaloMassRatio = 0.01
+SubhaloRadiusMult = 1.0
+
+# HealpixNside turns on angular maps of the shell radius when set to a
+# positive power of two. For each halo, the fitted shell is evaluated at the
+# center of every pixel of a RING-ordered HEALPix map with this nside, and the
+# map is written to HealpixDir as a FITS file named shell_<snap>_<id>.fits.
+# Radii are in cMpc/h and are relative to the halo's center. Turned off by
+# default. Can't be used with PercentileProfile or Ellipsoid.
+HealpixNside = -1
+HealpixDir = 
+
+# ShellDefinition sets how the splashback radius is found along each line of
+# sight. steepest uses Shellfish's standard definition. minimum instead uses
+# the radius where the logarithmic slope of the smoothed density is most
+# negative between SlopeRMinMult*R200m and SlopeRMaxMult*R200m, with no other
+# constraints. This matches the definition used by most studies of averaged
+# profiles. both fits a shell with each definition and outputs the minimum
+# shell's coefficients, Minimum P_ijk, after the standard ones. both can't be
+# used with Ellipsoid, PercentileProfile, Bootstraps, or FitBasis = harmonic.
+ShellDefinition = steepest
+SlopeRMinMult = 0.5
+SlopeRMaxMult = 2.5
+
+# MemoryCap is the approximate maximum amount of memory, in GB, that the shell
+# tool will use. The LOS profiles of every halo in a snapshot are usually held
+# in memory at once, which can be very large. When MemoryCap is set, halos are
+# split into batches that fit within the cap, and each batch reads through
+# the snapshot separately. If even a single halo per worker doesn't fit, halos
+# are analyzed sequentially. This doesn't account for the memory used by the
+# halo catalogs. Turned off by default.
+MemoryCap = -1
+
+# MassScaledKernels grows the kernel of every particle heavier than the
+# lightest dark matter particle so that its volume is proportional to its
+# mass. Every kernel then has the same density, so the heavy low-resolution
+# particles of zoom-in and hydro snapshots are spread out over the same
+# volume as the high-resolution particles with the same total mass instead
+# of showing up as dense clumps along lines of sight.
+MassScaledKernels = false`
 }
 
 func (config *ShellConfig) ReadConfig(fname string, flags []string) error {
@@ -113,10 +273,31 @@ func (config *ShellConfig) ReadConfig(fname string, flags []string) error {
 	vars.Int(&config.order, "Order", 3)
 	vars.Int(&config.levels, "Levels", 3)
 	vars.Int(&config.smoothingWindow, "SmoothingWindow", 121)
+	vars.String(&config.smoothingKernel, "SmoothingKernel", "savgol")
+	vars.Float(&config.smoothingSigma, "SmoothingSigma", 20)
 	vars.Float(&config.losSlopeCutoff, "LOSSlopeCutoff", 0.0)
 	vars.Float(&config.backgroundRhoMult, "BackgroundRhoMult", 0.5)
 	vars.Bool(&config.percentileProfile, "PercentileProfile", false)
 	vars.Float(&config.percentile, "Percentile", 50.0)
+	vars.Bool(&config.ellipsoid, "Ellipsoid", false)
+	vars.Bool(&config.massScaledKernels, "MassScaledKernels", false)
+	vars.String(&config.particleSpecies, "ParticleSpecies", "dm")
+	vars.Int(&config.bootstraps, "Bootstraps", 0)
+	vars.Float(&config.convergenceTolerance, "ConvergenceTolerance", -1)
+	vars.Int(&config.maxRings, "MaxRings", 1600)
+	vars.String(&config.fitBasis, "FitBasis", "penna")
+	vars.Int(&config.harmonicLMax, "HarmonicLMax", 6)
+	vars.Float(&config.harmonicSmoothing, "HarmonicSmoothing", 0.001)
+	vars.Float(&config.filamentSigma, "FilamentSigma", -1)
+	vars.Bool(&config.exciseSubhalos, "ExciseSubhalos", false)
+	vars.Float(&config.subhaloMassRatio, "SubhaloMassRatio", 0.01)
+	vars.Float(&config.subhaloRadiusMult, "SubhaloRadiusMult", 1.0)
+	vars.Int(&config.healpixNside, "HealpixNside", -1)
+	vars.String(&config.healpixDir, "HealpixDir", "")
+	vars.String(&config.shellDefinition, "ShellDefinition", "steepest")
+	vars.Float(&config.slopeRMinMult, "SlopeRMinMult", 0.5)
+	vars.Float(&config.slopeRMaxMult, "SlopeRMaxMult", 2.5)
+	vars.Float(&config.memoryCap, "MemoryCap", -1)
 
 	if fname == "" {
 		if len(flags) == 0 {
@@ -175,6 +356,138 @@ func (config *ShellConfig) validate() error {
 	case config.smoothingWindow <= 0:
 		return fmt.Errorf("The variable '%s' was set to %d.",
 			"SmoothingWindow", config.smoothingWindow)
+	case config.smoothingWindow%2 != 1:
+		return fmt.Errorf("The variable '%s' was set to %d, but it must "+
+			"be odd.", "SmoothingWindow", config.smoothingWindow)
+	case config.smoothingWindow >= config.radialBins:
+		return fmt.Errorf("The variable '%s' was set to %d, but it must "+
+			"be smaller than '%s', %d.", "SmoothingWindow",
+			config.smoothingWindow, "RadialBins", config.radialBins)
+	case config.smoothingSigma <= 0:
+		return fmt.Errorf("The variable '%s' was set to %g.",
+			"SmoothingSigma", config.smoothingSigma)
+	case config.bootstraps < 0:
+		return fmt.Errorf("The variable '%s' was set to %d.",
+			"Bootstraps", config.bootstraps)
+	case config.harmonicLMax < 0:
+		return fmt.Errorf("The variable '%s' was set to %d.",
+			"HarmonicLMax", config.harmonicLMax)
+	case config.harmonicSmoothing < 0:
+		return fmt.Errorf("The variable '%s' was set to %g.",
+			"HarmonicSmoothing", config.harmonicSmoothing)
+	case config.subhaloMassRatio <= 0 || config.subhaloMassRatio >= 1:
+		return fmt.Errorf("The variable '%s' was set to %g, but it must "+
+			"be between 0 and 1.", "SubhaloMassRatio",
+			config.subhaloMassRatio)
+	case config.subhaloRadiusMult <= 0:
+		return fmt.Errorf("The variable '%s' was set to %g.",
+			"SubhaloRadiusMult", config.subhaloRadiusMult)
+	}
+
+	if config.healpixNside > 0 {
+		nside := config.healpixNside
+		switch {
+		case nside&(nside-1) != 0:
+			return fmt.Errorf("The variable '%s' was set to %d, but it "+
+				"must be a power of two.", "HealpixNside", nside)
+		case config.healpixDir == "":
+			return fmt.Errorf("The variable '%s' is set, so '%s' must "+
+				"also be set.", "HealpixNside", "HealpixDir")
+		case config.ellipsoid || config.percentileProfile:
+			return fmt.Errorf("The variable '%s' is set, so it can't be "+
+				"combined with '%s' or '%s'.", "HealpixNside",
+				"Ellipsoid", "PercentileProfile")
+		}
+	}
+
+	switch config.shellDefinition {
+	case "steepest":
+	case "minimum", "both":
+		if config.slopeRMinMult <= 0 ||
+			config.slopeRMaxMult <= config.slopeRMinMult {
+			return fmt.Errorf("The variables '%s' and '%s' were set to %g "+
+				"and %g, but they must be positive and '%s' must be larger.",
+				"SlopeRMinMult", "SlopeRMaxMult", config.slopeRMinMult,
+				config.slopeRMaxMult, "SlopeRMaxMult")
+		}
+		if config.shellDefinition == "both" && (config.ellipsoid ||
+			config.percentileProfile || config.bootstraps > 0 ||
+			config.fitBasis == "harmonic") {
+			return fmt.Errorf("The variable '%s' was set to '%s', which "+
+				"can't be combined with '%s', '%s', '%s', or '%s'.",
+				"ShellDefinition", config.shellDefinition, "Ellipsoid",
+				"PercentileProfile", "Bootstraps", "FitBasis")
+		}
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but it must "+
+			"be one of 'steepest', 'minimum', or 'both'.",
+			"ShellDefinition", config.shellDefinition)
+	}
+
+	switch config.smoothingKernel {
+	case "savgol":
+		if config.smoothingWindow <= 4 {
+			return fmt.Errorf("The variable '%s' was set to %d, but it "+
+				"must be larger than 4 when '%s' is 'savgol'.",
+				"SmoothingWindow", config.smoothingWindow, "SmoothingKernel")
+		}
+	case "gaussian", "tophat":
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but it must "+
+			"be one of 'savgol', 'gaussian', or 'tophat'.",
+			"SmoothingKernel", config.smoothingKernel)
+	}
+
+	switch config.fitBasis {
+	case "penna":
+	case "harmonic":
+		if config.ellipsoid || config.percentileProfile ||
+			config.bootstraps > 0 || config.convergenceTolerance > 0 {
+			return fmt.Errorf("The variable '%s' was set to '%s', which "+
+				"can't be combined with '%s', '%s', '%s', or '%s'.",
+				"FitBasis", config.fitBasis, "Ellipsoid",
+				"PercentileProfile", "Bootstraps", "ConvergenceTolerance")
+		}
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but it must "+
+			"be either 'penna' or 'harmonic'.", "FitBasis", config.fitBasis)
+	}
+
+	if coeffs := 2 * config.order * config.order; config.rings < coeffs {
+		return fmt.Errorf("The variable '%s' was set to %d, so the shell "+
+			"has %d coefficients, but the variable '%s' was only set to %d. "+
+			"There must be at least one ring per coefficient.", "Order",
+			config.order, coeffs, "Rings", config.rings)
+	}
+
+	switch config.particleSpecies {
+	case "dm", "gas", "stars", "all":
+	default:
+		return fmt.Errorf("The variable '%s' was set to '%s', but it must "+
+			"be one of 'dm', 'gas', 'stars', or 'all'.", "ParticleSpecies",
+			config.particleSpecies)
+	}
+
+	if config.ellipsoid && config.percentileProfile {
+		return fmt.Errorf("The variables '%s' and '%s' can't both be set.",
+			"Ellipsoid", "PercentileProfile")
+	}
+
+	if config.bootstraps > 0 && (config.ellipsoid || config.percentileProfile) {
+		return fmt.Errorf("The variable '%s' can only be set when fitting "+
+			"Penna-Dines shells.", "Bootstraps")
+	}
+
+	if config.convergenceTolerance > 0 {
+		if config.ellipsoid || config.percentileProfile {
+			return fmt.Errorf("The variable '%s' can only be set when "+
+				"fitting Penna-Dines shells.", "ConvergenceTolerance")
+		}
+		if config.maxRings < config.rings {
+			return fmt.Errorf("The variable '%s' was set to %d, but the "+
+				"variable '%s' was set to %d.", "MaxRings", config.maxRings,
+				"Rings", config.rings)
+		}
 	}
 
 	if config.rMinMult >= config.rMaxMult {
@@ -218,13 +531,37 @@ func (config *ShellConfig) Run(
 		return nil, fmt.Errorf("No input IDs.")
 	}
 
+	// Repeated halos from id mode carry their own seeds. Otherwise, each
+	// halo's seed is derived from its ID and snapshot.
+	seeds := make([]uint64, len(ids))
+	for i := range seeds {
+		seeds[i] = haloSeed(randSeed, ids[i], snaps[i])
+	}
+	if seedCol := catalog.ColumnIndex(stdin, "Seed"); seedCol != -1 {
+		seedCols, _, err := catalog.Parse(stdin, []int{seedCol}, []int{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range seeds {
+			seeds[i] = uint64(seedCols[0][i])
+		}
+	}
+
 	// Compute coefficients.
 	out := make([][]float64, len(ids))
-	rowLength := config.order * config.order * 2
+	rowLength := config.order * config.order * 2 * (1 + config.bootstraps)
+	if config.shellDefinition == "both" {
+		rowLength *= 2
+	}
 
 	for i := range out {
 		if config.percentileProfile {
 			out[i] = make([]float64, config.radialBins)
+		} else if config.ellipsoid {
+			out[i] = make([]float64, ellipsoidRowLength)
+		} else if config.fitBasis == "harmonic" {
+			lMax := config.harmonicLMax
+			out[i] = make([]float64, (lMax+1)*(lMax+1))
 		} else {
 			out[i] = make([]float64, rowLength)
 		}
@@ -238,7 +575,45 @@ func (config *ShellConfig) Run(
 		return nil, err
 	}
 
-	err = loop(ids, snaps, coords, config, buf, e, out, gConfig.Threads)
+	err = readInputUnits(
+		stdin, snaps, coords, repeatKind(lengthUnit, 4), buf, e,
+	)
+	if err != nil {
+		return nil, err
+	}
+	uc, err := newUnitConverter(gConfig.Units, snaps, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.particleSpecies != "dm" {
+		buf, err = config.speciesVectorBuffer(snaps, buf, gConfig, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var excised [][]geom.Sphere
+	if config.exciseSubhalos {
+		excised, err = config.subhaloSpheres(
+			ids, snaps, coords, buf, e, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rings []int
+	if config.convergenceTolerance > 0 {
+		rings, err = config.convergenceLoop(
+			ids, snaps, seeds, coords, excised, buf, e, out, gConfig.Threads,
+		)
+	} else {
+		err = loop(
+			ids, snaps, seeds, coords, excised, config, buf, e, out,
+			gConfig.Threads,
+		)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -246,27 +621,311 @@ func (config *ShellConfig) Run(
 	intNames := []string{"ID", "Snapshot"}
 	floatNames := []string{"X [cMpc/h]", "Y [cMpc/h]", "Z [cMpc/h]",
 		"R200m [cMpc/h]", "P_ijk"}
+	relabelColumns(gConfig.Units, floatNames)
 
 	colOrder := make([]int, 2+4+len(out[0]))
 	for i := range colOrder {
 		colOrder[i] = i
 	}
 
-	lines := catalog.FormatCols(
-		[][]int{ids, snaps}, append(coords, transpose(out)...), colOrder,
-	)
+	outCols := append(coords, transpose(out)...)
+	uc.convert(snaps, outCols, config.outputKinds(len(out[0])))
+	lines := catalog.FormatCols([][]int{ids, snaps}, outCols, colOrder)
+
+	var cString string
+	if config.ellipsoid {
+		floatNames = append(floatNames[:4],
+			"dX [cMpc/h]", "dY [cMpc/h]", "dZ [cMpc/h]",
+			"A [cMpc/h]", "B [cMpc/h]", "C [cMpc/h]", "B/A", "C/A",
+			"A_x", "A_y", "A_z")
+		relabelColumns(gConfig.Units, floatNames)
+		sizes := make([]int, len(colOrder))
+		for i := range sizes {
+			sizes[i] = 1
+		}
+		cString = catalog.CommentString(
+			intNames, floatNames, colOrder, sizes,
+		)
+	} else {
+		if config.fitBasis == "harmonic" {
+			floatNames[4] = "Y_lm"
+		}
+		cString = catalog.CommentString(
+			intNames, floatNames, []int{0, 1, 2, 3, 4, 5, 6},
+			[]int{1, 1, 1, 1, 1, 1, len(out[0])},
+		)
+		if config.bootstraps > 0 {
+			pSize := int(2 * config.order * config.order)
+			cString = catalog.CommentString(
+				intNames, append(floatNames, "Bootstrap P_ijk"),
+				[]int{0, 1, 2, 3, 4, 5, 6, 7},
+				[]int{1, 1, 1, 1, 1, 1, pSize, len(out[0]) - pSize},
+			)
+		} else if config.shellDefinition == "both" {
+			pSize := int(2 * config.order * config.order)
+			cString = catalog.CommentString(
+				intNames, append(floatNames, "Minimum P_ijk"),
+				[]int{0, 1, 2, 3, 4, 5, 6, 7},
+				[]int{1, 1, 1, 1, 1, 1, pSize, pSize},
+			)
+		}
+	}
 
-	cString := catalog.CommentString(
-		intNames, floatNames, []int{0, 1, 2, 3, 4, 5, 6},
-		[]int{1, 1, 1, 1, 1, 1, len(out[0])},
-	)
+	if config.healpixNside > 0 {
+		err = config.writeHealpixMaps(ids, snaps, out)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rings != nil {
+		ringLines := catalog.FormatCols([][]int{rings}, nil, []int{0})
+		for i := range lines {
+			lines[i] = lines[i] + " " + ringLines[i]
+		}
+		cString = fmt.Sprintf("%s Rings(%d)", cString, len(colOrder))
+	}
 
 	if logging.Mode == logging.Performance {
 		log.Printf("Time: %s", time.Since(t).String())
 		log.Printf("Memory: %s", logging.MemString())
 	}
 
-	return append([]string{cString}, lines...), nil
+	return append([]string{uc.unitsString(), cString}, lines...), nil
+}
+
+// outputKinds returns the kinds of units used by the position columns and
+// the rowLength columns of shell output which follow them.
+func (config *ShellConfig) outputKinds(rowLength int) []unitKind {
+	kinds := repeatKind(lengthUnit, 4+rowLength)
+	switch {
+	case config.percentileProfile:
+		for i := 4 + int(config.radialBins); i < len(kinds); i++ {
+			kinds[i] = densityUnit
+		}
+	case config.ellipsoid:
+		// Center offsets and axes are lengths, but the axis ratios and
+		// major axis direction aren't.
+		for i := 4 + 6; i < len(kinds); i++ {
+			kinds[i] = dimensionless
+		}
+	}
+	return kinds
+}
+
+// writeHealpixMaps writes a HEALPix map of the shell radius of every halo to
+// HealpixDir. Halos whose shells couldn't be fit are skipped.
+func (config *ShellConfig) writeHealpixMaps(
+	ids, snaps []int, out [][]float64,
+) error {
+	nside := int(config.healpixNside)
+	for i := range ids {
+		if snaps[i] == -1 || out[i] == nil || hasNaN(out[i]) {
+			continue
+		}
+
+		var shell analyze.Shell
+		if config.fitBasis == "harmonic" {
+			shell = analyze.HarmonicFunc(out[i], int(config.harmonicLMax))
+		} else {
+			order := int(config.order)
+			nCoeffs := 2 * order * order
+			shell = analyze.PennaFunc(out[i][:nCoeffs], order, order, 2)
+		}
+
+		fname := path.Join(config.healpixDir,
+			fmt.Sprintf("shell_%d_%d.fits", snaps[i], ids[i]))
+		f, err := os.Create(fname)
+		if err != nil {
+			return err
+		}
+		err = io.WriteHealpixFITS(
+			f, nside, analyze.HealpixMap(shell, nside), "cMpc/h",
+		)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kernelType returns the analyze.KernelType corresponding to SmoothingKernel.
+func (config *ShellConfig) kernelType() analyze.KernelType {
+	return smoothingKernelType(config.smoothingKernel)
+}
+
+// smoothingKernelType returns the analyze.KernelType corresponding to the
+// value of a SmoothingKernel variable.
+func smoothingKernelType(kernel string) analyze.KernelType {
+	switch kernel {
+	case "gaussian":
+		return analyze.GaussianKernel
+	case "tophat":
+		return analyze.TophatKernel
+	}
+	return analyze.SavGolKernel
+}
+
+// hasNaN returns true if any element of xs is NaN.
+func hasNaN(xs []float64) bool {
+	for _, x := range xs {
+		if math.IsNaN(x) {
+			return true
+		}
+	}
+	return false
+}
+
+// convergenceSamples is the number of Monte Carlo samples used to find the
+// volume of a shell when checking convergence.
+const convergenceSamples = 50 * 1000
+
+// convergenceLoop measures the shells of every halo, doubling the number of
+// rings used for each halo until its radius converges. The number of rings
+// used for each halo is returned.
+func (config *ShellConfig) convergenceLoop(
+	ids, snaps []int, seeds []uint64, coords [][]float64,
+	excised [][]geom.Sphere, buf io.VectorBuffer, e *env.Environment,
+	out [][]float64, threads int64,
+) ([]int, error) {
+	rings := make([]int, len(ids))
+	prevR := make([]float64, len(ids))
+	active := []int{}
+	for i := range ids {
+		prevR[i] = math.NaN()
+		if snaps[i] != -1 {
+			active = append(active, i)
+		}
+	}
+
+	c := *config
+	for len(active) > 0 {
+		aIDs, aSnaps := make([]int, len(active)), make([]int, len(active))
+		aSeeds := make([]uint64, len(active))
+		aCoords := make([][]float64, len(coords))
+		for j := range aCoords {
+			aCoords[j] = make([]float64, len(active))
+		}
+		aOut := make([][]float64, len(active))
+		var aExcised [][]geom.Sphere
+		if excised != nil {
+			aExcised = make([][]geom.Sphere, len(active))
+			for k, i := range active {
+				aExcised[k] = excised[i]
+			}
+		}
+		for k, i := range active {
+			aIDs[k], aSnaps[k], aSeeds[k] = ids[i], snaps[i], seeds[i]
+			for j := range coords {
+				aCoords[j][k] = coords[j][i]
+			}
+			aOut[k] = make([]float64, len(out[i]))
+		}
+
+		if logging.Mode == logging.Performance {
+			log.Printf("Measuring %d halos with %d rings.",
+				len(active), c.rings)
+		}
+
+		err := loop(
+			aIDs, aSnaps, aSeeds, aCoords, aExcised, &c, buf, e, aOut, threads,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		next := []int{}
+		nCoeffs := int(2 * c.order * c.order)
+		for k, i := range active {
+			out[i], rings[i] = aOut[k], int(c.rings)
+			if aOut[k] == nil {
+				continue
+			}
+
+			order := int(c.order)
+			shell := analyze.PennaFunc(aOut[k][:nCoeffs], order, order, 2)
+			vol := shell.Volume(convergenceSamples)
+			r := math.Pow(vol/(math.Pi*4/3), 1.0/3)
+			if math.IsNaN(prevR[i]) ||
+				math.Abs(r-prevR[i]) > c.convergenceTolerance*r {
+				next = append(next, i)
+			}
+			prevR[i] = r
+		}
+
+		if 2*c.rings > c.maxRings {
+			break
+		}
+		c.rings *= 2
+		active = next
+	}
+
+	return rings, nil
+}
+
+// Gadget particle types used by the gas and stars ParticleSpecies.
+const (
+	gadgetGasType  = 0
+	gadgetStarType = 4
+)
+
+// speciesVectorBuffer returns a buffer which reads the particles given by
+// ParticleSpecies instead of the dark matter particles.
+func (config *ShellConfig) speciesVectorBuffer(
+	snaps []int, dmBuf io.VectorBuffer, gConfig *GlobalConfig,
+	e *env.Environment,
+) (io.VectorBuffer, error) {
+	if gConfig.SnapshotType != "Gadget-2" {
+		return nil, fmt.Errorf("The variable '%s' was set to '%s', but "+
+			"this is only supported when SnapshotType = Gadget-2.",
+			"ParticleSpecies", config.particleSpecies)
+	}
+
+	return speciesBuffer(config.particleSpecies, snaps, dmBuf, gConfig, e)
+}
+
+// speciesBuffer returns a buffer which reads the given particle species, one
+// of dm, gas, stars, or all, from Gadget-2 snapshots. dmBuf is used to memoize
+// the headers of every snapshot first, so that other modes aren't given
+// headers describing the wrong particles.
+func speciesBuffer(
+	species string, snaps []int, dmBuf io.VectorBuffer, gConfig *GlobalConfig,
+	e *env.Environment,
+) (io.VectorBuffer, error) {
+	for _, snap := range snaps {
+		if snap == -1 {
+			continue
+		}
+		if _, _, err := memo.ReadHeaders(snap, dmBuf, e); err != nil {
+			return nil, err
+		}
+	}
+
+	var types []int64
+	switch species {
+	case "dm":
+		types = gConfig.GadgetDMTypeIndices
+	case "gas":
+		types = []int64{gadgetGasType}
+	case "stars":
+		types = []int64{gadgetStarType}
+	case "all":
+		types = append([]int64{}, gConfig.GadgetDMTypeIndices...)
+		for _, t := range []int64{gadgetGasType, gadgetStarType} {
+			found := false
+			for _, dmt := range types {
+				found = found || dmt == t
+			}
+			if !found {
+				types = append(types, t)
+			}
+		}
+	}
+
+	sConfig := *gConfig
+	sConfig.GadgetDMTypeIndices = types
+	return getVectorBuffer(e.ParticleCatalog(snaps[0], 0), &sConfig)
 }
 
 func transpose(in [][]float64) [][]float64 {
@@ -286,15 +945,11 @@ func transpose(in [][]float64) [][]float64 {
 }
 
 func loop(
-	ids, snaps []int, coords [][]float64, c *ShellConfig,
-	buf io.VectorBuffer, e *env.Environment, out [][]float64,
-	threads int64,
+	ids, snaps []int, seeds []uint64, coords [][]float64,
+	excised [][]geom.Sphere, c *ShellConfig, buf io.VectorBuffer,
+	e *env.Environment, out [][]float64, threads int64,
 ) error {
 	snapBins, idxBins := binBySnap(snaps, ids)
-	ringBuf := make([]analyze.RingBuffer, c.rings)
-	for i := range ringBuf {
-		ringBuf[i].Init(int(c.spokes), int(c.radialBins))
-	}
 
 	sortedSnaps := []int{}
 	for snap := range snapBins {
@@ -312,60 +967,118 @@ func loop(
 	if threads > 0 {
 		workers = int(threads)
 	}
+	batch := len(ids)
+	if c.memoryCap > 0 {
+		workers, batch = c.memoryBatches(hds, workers)
+		threads = int64(workers)
+	}
+
+	// Each worker analyzing halos needs its own ring buffers.
+	ringBufs := make([][]analyze.RingBuffer, workers)
+	for w := range ringBufs {
+		ringBufs[w] = make([]analyze.RingBuffer, c.rings)
+		for i := range ringBufs[w] {
+			ringBufs[w][i].Init(int(c.spokes), int(c.radialBins))
+		}
+	}
+
 	sphBuf := &sphBuffers{
 		intr:       make([]bool, hds[0].N),
 		xs:         [][3]float32{},
 		ms:         []float32{},
 		sphWorkers: make([]los.Halo, workers-1),
+		minMass:    minMass,
 	}
 
 	for _, snap := range sortedSnaps {
 		if snap == -1 {
 			continue
 		}
-		idxs := idxBins[snap]
-		snapCoords := [][]float64{
-			make([]float64, len(idxs)), make([]float64, len(idxs)),
-			make([]float64, len(idxs)), make([]float64, len(idxs)),
-		}
-		for i, idx := range idxs {
-			snapCoords[0][i] = coords[0][idx]
-			snapCoords[1][i] = coords[1][idx]
-			snapCoords[2][i] = coords[2][idx]
-			snapCoords[3][i] = coords[3][idx]
-		}
 
-		// Create Halos
-		runtime.GC()
-		halos, err := createHalos(snapCoords, &hds[0], c, e, minMass)
-		if err != nil {
-			return err
+		// Halos are processed in batches so that only a bounded number
+		// of them are held in memory at once. Each batch re-reads the
+		// snapshot.
+		snapIdxs := idxBins[snap]
+		for start := 0; start < len(snapIdxs); start += batch {
+			end := start + batch
+			if end > len(snapIdxs) {
+				end = len(snapIdxs)
+			}
+			err := batchLoop(
+				snap, ids, snapIdxs[start:end], seeds, coords, excised,
+				c, buf, e, sphBuf, ringBufs, &hds[0], minMass, threads, out,
+			)
+			if err != nil {
+				return err
+			}
 		}
+	}
 
-		// I'm so sorry about having ten arguments to this function.
-		if err = sphereLoop(snap, ids, idxs, halos, c,
-			buf, e, sphBuf, threads, out); err != nil {
+	return nil
+}
 
-			return err
-		}
+// batchLoop measures the LOS profiles of a batch of halos in a single
+// snapshot and fits their shells.
+func batchLoop(
+	snap int, ids, idxs []int, seeds []uint64, coords [][]float64,
+	excised [][]geom.Sphere, c *ShellConfig, buf io.VectorBuffer,
+	e *env.Environment, sphBuf *sphBuffers,
+	ringBufs [][]analyze.RingBuffer, hd *io.Header, minMass float32,
+	threads int64, out [][]float64,
+) error {
+	snapCoords := [][]float64{
+		make([]float64, len(idxs)), make([]float64, len(idxs)),
+		make([]float64, len(idxs)), make([]float64, len(idxs)),
+	}
+	snapSeeds := make([]uint64, len(idxs))
+	for i, idx := range idxs {
+		snapCoords[0][i] = coords[0][idx]
+		snapCoords[1][i] = coords[1][idx]
+		snapCoords[2][i] = coords[2][idx]
+		snapCoords[3][i] = coords[3][idx]
+		snapSeeds[i] = seeds[idx]
+	}
 
-		if logging.Mode == logging.Performance {
-			log.Printf("Snap %d, sphereLoop ended", snap)
-			log.Printf("Time: %s", time.Since(tStart).String())
-			log.Printf("Memory: %s", logging.MemString())
-		}
-		
-		// Analysis
-		if err = haloAnalysis(halos, idxs, c, ringBuf, out); err != nil {
-			return err
+	// Create Halos
+	runtime.GC()
+	halos, err := createHalos(
+		snapCoords, snapSeeds, hd, c, e, minMass,
+	)
+	if err != nil {
+		return err
+	}
+	sphBuf.excised = map[*los.Halo][]geom.Sphere{}
+	if excised != nil {
+		for i, idx := range idxs {
+			if halos[i] != nil {
+				sphBuf.excised[halos[i]] = excised[idx]
+			}
 		}
+	}
 
-		if logging.Mode == logging.Performance {
-			log.Printf("Snap %d, haloAnalysis ended", snap)
-			log.Printf("Time: %s", time.Since(tStart).String())
-			log.Printf("Memory: %s", logging.MemString())
-		}
+	// I'm so sorry about having ten arguments to this function.
+	if err = sphereLoop(snap, ids, idxs, halos, c,
+		buf, e, sphBuf, threads, out); err != nil {
 
+		return err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Snap %d, sphereLoop ended", snap)
+		log.Printf("Time: %s", time.Since(tStart).String())
+		log.Printf("Memory: %s", logging.MemString())
+	}
+	
+	// Analysis
+	err = haloAnalysis(halos, idxs, snapSeeds, c, ringBufs, out)
+	if err != nil {
+		return err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Snap %d, haloAnalysis ended", snap)
+		log.Printf("Time: %s", time.Since(tStart).String())
+		log.Printf("Memory: %s", logging.MemString())
 	}
 
 	return nil
@@ -418,6 +1131,10 @@ type sphBuffers struct {
 	xs         [][3]float32
 	ms         []float32
 	intr       []bool
+	minMass    float32
+	// excised maps halos onto the subhalo spheres whose particles are
+	// removed, relative to the halo's origin.
+	excised map[*los.Halo][]geom.Sphere
 }
 
 func loadSphereVecs(
@@ -440,6 +1157,9 @@ func loadSphereVecs(
 
 	h.Transform(xs, hd.TotalWidth)
 	rad := h.RMax() * c.rKernelMult / c.rMaxMult
+	if c.massScaledKernels {
+		rad *= maxKernelScale(ms, sphBuf.minMass)
+	}
 	h.Intersect(xs, rad, intr)
 	
 	numIntr := 0
@@ -449,13 +1169,20 @@ func loadSphereVecs(
 		}
 	}
 	
+	excised := sphBuf.excised[h]
 	h.Split(sphWorkers)
 
 	for i := range sphWorkers {
 		wh := &sphBuf.sphWorkers[i]
-		go chanLoadSphereVec(wh, xs, ms, intr, i, workers, hd, c, sync)
+		go chanLoadSphereVec(
+			wh, xs, ms, intr, excised, i, workers, sphBuf.minMass,
+			hd, c, sync,
+		)
 	}
-	chanLoadSphereVec(h, xs, ms, intr, workers-1, workers, hd, c, sync)
+	chanLoadSphereVec(
+		h, xs, ms, intr, excised, workers-1, workers, sphBuf.minMass,
+		hd, c, sync,
+	)
 
 	for i := 0; i < workers; i++ {
 		<-sync
@@ -464,6 +1191,21 @@ func loadSphereVecs(
 	h.Join(sphWorkers)
 }
 
+// maxKernelScale returns the factor by which MassScaledKernels grows the
+// kernel of the heaviest particle in ms.
+func maxKernelScale(ms []float32, minMass float32) float64 {
+	if minMass <= 0 {
+		return 1
+	}
+	max := minMass
+	for _, m := range ms {
+		if m > max {
+			max = m
+		}
+	}
+	return math.Cbrt(float64(max / minMass))
+}
+
 func expandBools(scalars []bool, n int) []bool {
 	switch {
 	case cap(scalars) >= n:
@@ -478,7 +1220,8 @@ func expandBools(scalars []bool, n int) []bool {
 
 func chanLoadSphereVec(
 	h *los.Halo, xs [][3]float32, ms []float32,
-	intr []bool, offset, workers int,
+	intr []bool, excised []geom.Sphere, offset, workers int,
+	minMass float32,
 	hd *io.Header, c *ShellConfig, sync chan bool,
 ) {
 	rad := h.RMax() * c.rKernelMult / c.rMaxMult
@@ -489,47 +1232,235 @@ func chanLoadSphereVec(
 	
 	sf := c.subsampleFactor
 	skip := workers * int(sf*sf*sf)
+	origin := h.Origin()
 	for i := offset * int(sf*sf*sf); i < len(xs); i += skip {
-		if intr[i] {
+		if !intr[i] || inExcised(xs[i], origin, excised) {
+			continue
+		}
+		if !c.massScaledKernels || minMass <= 0 || ms[i] <= minMass {
 			h.Insert(xs[i], rad, (float64(ms[i])*float64(sf*sf*sf)/
 				sphVol)/rhoM)
+			continue
 		}
+
+		// Heavy particles get kernels with the same density as the
+		// lightest particles, so their mass is spread over a larger volume.
+		scale := math.Cbrt(float64(ms[i] / minMass))
+		mRad := rad * scale
+		mVol := sphVol * scale * scale * scale
+		h.Insert(xs[i], mRad, (float64(ms[i])*float64(sf*sf*sf)/mVol)/rhoM)
 	}
 
 	sync <- true
 }
 
-func haloAnalysis(
-	halos []*los.Halo, idxs []int, c *ShellConfig,
-	ringBuf []analyze.RingBuffer, out [][]float64,
-) error {
-	// Calculate Penna coefficients.
-	for i := range halos {
-		runtime.GC()
-		
-		if logging.Mode == logging.Debug {
-			log.Printf("Halo %3d: %.4f %.4f", i,
-				halos[i].Origin(), halos[i].RMax())
+// inExcised returns true if the vector x is inside any of the excised
+// spheres, which are given relative to origin.
+func inExcised(x [3]float32, origin [3]float64, excised []geom.Sphere) bool {
+	for _, s := range excised {
+		dx := x[0] - float32(origin[0]) - s.C[0]
+		dy := x[1] - float32(origin[1]) - s.C[1]
+		dz := x[2] - float32(origin[2]) - s.C[2]
+		if dx*dx+dy*dy+dz*dz <= s.R*s.R {
+			return true
 		}
+	}
+	return false
+}
 
-		if c.percentileProfile {
-			out[idxs[i]] = calcPercentile(halos[i], c)
-		} else {
-			var ok bool
-			out[idxs[i]], ok = calcCoeffs(halos[i], ringBuf, c)
+// subhaloSpheres finds the subhalos which should be excised from around
+// each input halo. Sphere centers are given relative to the host.
+func (config *ShellConfig) subhaloSpheres(
+	ids, snaps []int, coords [][]float64, buf io.VectorBuffer,
+	e *env.Environment, gConfig *GlobalConfig,
+) ([][]geom.Sphere, error) {
+	excised := make([][]geom.Sphere, len(ids))
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	_, idxBins := binBySnap(snaps, ids)
+	for snap, idxs := range idxBins {
+		if snap == -1 {
+			continue
+		}
+
+		hd, err := snapHeader(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		rids, err := memo.ReadSortedRockstarIDs(
+			snap, -1, "M200m", vars, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+		_, vals, err := memo.ReadRockstar(
+			snap, []string{"X", "Y", "Z", "M200m", "R200m"},
+			rids, vars, buf, e,
+		)
+		if err != nil {
+			return nil, err
+		}
+		xs, ys, zs, ms, rs := vals[0], vals[1], vals[2], vals[3], vals[4]
+		pucf := halo.UnitConversionFactor(gConfig.HaloPositionUnits, &hd.Cosmo)
+		rucf := halo.UnitConversionFactor(gConfig.HaloRadiusUnits, &hd.Cosmo)
+		for i := range xs {
+			xs[i] *= pucf
+			ys[i] *= pucf
+			zs[i] *= pucf
+			rs[i] *= rucf
+		}
+
+		L := hd.TotalWidth
+		mt := halo.NewMatcher(finderCells, L, xs, ys, zs, ms)
+		f := newIntFinder(rids)
+		for _, i := range idxs {
+			j, ok := f.find(ids[i])
 			if !ok {
-				fmt.Errorf("Shell coefficients undetermined. The most likely " +
-				"explanation is that there is corruption in your particle " +
-				"snapshots.")
+				return nil, fmt.Errorf("ID %d not in halo list.", ids[i])
 			}
+
+			pos := [3]float64{coords[0][i], coords[1][i], coords[2][i]}
+			nIdxs, _ := mt.Neighbors(pos, coords[3][i]*config.rMaxMult)
+			excised[i] = config.hostSubhalos(
+				j, pos, nIdxs, xs, ys, zs, ms, rs, L,
+			)
+		}
+	}
+
+	return excised, nil
+}
+
+// hostSubhalos returns the excised spheres of the halos at the indices nIdxs
+// which are subhalos of the host at index j, which is located at pos. Sphere
+// centers are given relative to pos in a box of width L.
+func (config *ShellConfig) hostSubhalos(
+	j int, pos [3]float64, nIdxs []int, xs, ys, zs, ms, rs []float64,
+	L float64,
+) []geom.Sphere {
+	var excised []geom.Sphere
+	for _, n := range nIdxs {
+		if n == j || ms[n] >= ms[j] ||
+			ms[n] < config.subhaloMassRatio*ms[j] {
+			continue
+		}
+		excised = append(excised, geom.Sphere{
+			C: [3]float32{
+				float32(wrapDist(xs[n], pos[0], L)),
+				float32(wrapDist(ys[n], pos[1], L)),
+				float32(wrapDist(zs[n], pos[2], L)),
+			},
+			R: float32(rs[n] * config.subhaloRadiusMult),
+		})
+	}
+	return excised
+}
+
+// memoryBatches returns the number of workers and the number of halos per batch
+// that keep the memory used by loop below MemoryCap. hds are the headers of a
+// typical snapshot.
+func (c *ShellConfig) memoryBatches(hds []io.Header, workers int) (int, int) {
+	capBytes := c.memoryCap * 1e9
+
+	// Positions, velocities, masses, IDs, and intersection flags.
+	maxN := int64(0)
+	for i := range hds {
+		if hds[i].N > maxN {
+			maxN = hds[i].N
+		}
+	}
+	sheetBytes := float64(maxN) * (12 + 12 + 4 + 8 + 1)
+	haloBytes := float64(c.rings*c.spokes*c.radialBins) * 8
+	ringBufBytes := float64(c.rings*(9*c.spokes+4*c.radialBins)) * 8
+
+	// Each worker needs a set of ring buffers, and all but one need a copy
+	// of the halo being loaded.
+	batchBytes := func(workers int) float64 {
+		return capBytes - sheetBytes - float64(workers)*ringBufBytes -
+			float64(workers-1)*haloBytes
+	}
+
+	if batchBytes(workers) < haloBytes && workers > 1 {
+		workers = 1
+		if logging.Mode != logging.Nil {
+			log.Printf("MemoryCap is too small for multiple workers. " +
+				"Halos will be analyzed sequentially.")
 		}
 	}
+
+	batch := int(batchBytes(workers) / haloBytes)
+	if batch < 1 {
+		batch = 1
+		if logging.Mode != logging.Nil {
+			log.Printf("MemoryCap, %g GB, is too small to hold a single "+
+				"halo. It will be exceeded.", c.memoryCap)
+		}
+	}
+	return workers, batch
+}
+
+// haloAnalysis fits shells to every halo. Halos are split between one worker
+// per ring buffer, and each halo's result is written to its own row of out, so
+// the output doesn't depend on the number of workers.
+func haloAnalysis(
+	halos []*los.Halo, idxs []int, seeds []uint64, c *ShellConfig,
+	ringBufs [][]analyze.RingBuffer, out [][]float64,
+) error {
+	runtime.GC()
+
+	workers := len(ringBufs)
+	lg := NewLockGroup(workers)
+	for w := 0; w < workers; w++ {
+		go func(lock *Lock) {
+			ringBuf := ringBufs[lock.Idx]
+			for i := lock.Idx; i < len(halos); i += lock.Workers {
+				analyzeHalo(halos[i], idxs[i], seeds[i], c, ringBuf, out)
+			}
+			lock.Unlock()
+		}(lg.Lock(w))
+	}
+	lg.Synchronize()
+
 	return nil
 }
 
+// analyzeHalo fits a shell to a single halo and writes the result to
+// out[idx].
+func analyzeHalo(
+	halo *los.Halo, idx int, seed uint64, c *ShellConfig,
+	ringBuf []analyze.RingBuffer, out [][]float64,
+) {
+	if logging.Mode == logging.Debug {
+		log.Printf("Halo %3d: %.4f %.4f", idx, halo.Origin(), halo.RMax())
+	}
+
+	if c.percentileProfile {
+		out[idx] = calcPercentile(halo, c)
+	} else if c.ellipsoid {
+		var ok bool
+		out[idx], ok = calcEllipsoid(halo, ringBuf, c)
+		if !ok {
+			for j := range out[idx] {
+				out[idx][j] = math.NaN()
+			}
+		}
+	} else {
+		var ok bool
+		out[idx], ok = calcCoeffs(halo, ringBuf, seed, c)
+		if !ok && logging.Mode == logging.Debug {
+			log.Printf("Halo %3d: Shell coefficients undetermined. The "+
+				"most likely explanation is that there is corruption in "+
+				"your particle snapshots.", idx)
+		}
+	}
+}
+
 func createHalos(
-	coords [][]float64, hd *io.Header, c *ShellConfig, e *env.Environment,
-	minMass float32,
+	coords [][]float64, seeds []uint64, hd *io.Header, c *ShellConfig,
+	e *env.Environment, minMass float32,
 ) ([]*los.Halo, error) {
 
 	halos := make([]*los.Halo, len(coords[0]))
@@ -541,7 +1472,7 @@ func createHalos(
 			continue
 		}
 
-		norms := normVecs(int(c.rings))
+		norms := normVecs(int(c.rings), seeds[i])
 		origin := [3]float64{x, y, z}
 		rMax, rMin := r*c.rMaxMult, r*c.rMinMult
 		rad := r * c.rKernelMult
@@ -563,32 +1494,8 @@ func createHalos(
 	return halos, nil
 }
 
-func normVecs(n int) [][3]float32 {
-	var vecs [][3]float32
-	gen := rand.New(rand.Xorshift, randSeed)
-	switch n {
-	case 3:
-		vecs = [][3]float32{{0, 0, 1}, {0, 1, 0}, {1, 0, 0}}
-	default:
-		vecs = make([][3]float32, n)
-		for i := range vecs {
-			for {
-				x := gen.Uniform(-1, +1)
-				y := gen.Uniform(-1, +1)
-				z := gen.Uniform(-1, +1)
-				r := math.Sqrt(x*x + y*y + z*z)
-
-				if r < 1 {
-					vecs[i] = [3]float32{
-						float32(x / r), float32(y / r), float32(z / r),
-					}
-					break
-				}
-			}
-		}
-	}
-
-	return vecs
+func normVecs(n int, seed uint64) [][3]float32 {
+	return lib.RingNormals(n, seed)
 }
 
 type profileRange struct {
@@ -610,22 +1517,143 @@ func binIntersections(
 	return bins
 }
 
+// splashbackPoints finds the filtered splashback points of every ring of a
+// halo. If minimum is true, the minimum-slope definition of the splashback
+// radius is used along each line of sight.
+func splashbackPoints(
+	halo *los.Halo, buf []analyze.RingBuffer, c *ShellConfig, minimum bool,
+) (pxs, pys [][]float64, ok bool) {
+	return lib.SplashbackPoints(halo, buf, c.shellParams(minimum))
+}
+
+// shellParams returns the lib.ShellParams used to fit shells with config.
+func (config *ShellConfig) shellParams(minimum bool) *lib.ShellParams {
+	return &lib.ShellParams{
+		RadialBins:  int(config.radialBins),
+		Spokes:      int(config.spokes),
+		Rings:       int(config.rings),
+		RMaxMult:    config.rMaxMult,
+		RMinMult:    config.rMinMult,
+		RKernelMult: config.rKernelMult,
+
+		Order:           int(config.order),
+		Levels:          int(config.levels),
+		Eta:             config.eta,
+		SmoothingWindow: int(config.smoothingWindow),
+		SmoothingKernel: config.kernelType(),
+		SmoothingSigma:  config.smoothingSigma,
+		LOSSlopeCutoff:  config.losSlopeCutoff,
+
+		BackgroundRhoMult: config.backgroundRhoMult,
+		FilamentSigma:     config.filamentSigma,
+
+		Minimum:       minimum,
+		SlopeRMinMult: config.slopeRMinMult,
+		SlopeRMaxMult: config.slopeRMaxMult,
+	}
+}
+
 func calcCoeffs(
-	halo *los.Halo, buf []analyze.RingBuffer, c *ShellConfig,
+	halo *los.Halo, buf []analyze.RingBuffer, seed uint64, c *ShellConfig,
 ) ([]float64, bool) {
-	for i := range buf {
-		buf[i].Clear()
-		buf[i].Splashback(halo, i, int(c.smoothingWindow), c.losSlopeCutoff)
-	}
-	pxs, pys, ok := analyze.FilterPoints(buf, int(c.levels), halo.RMax()/c.eta)
+	pxs, pys, ok := splashbackPoints(
+		halo, buf, c, c.shellDefinition == "minimum",
+	)
 
 	if !ok {
 		return nil, false
 	}
+	if c.fitBasis == "harmonic" {
+		cs, _ := analyze.HarmonicVolumeFit(
+			pxs, pys, halo, int(c.harmonicLMax), c.harmonicSmoothing,
+		)
+		return cs, true
+	}
+
 	cs, _ := analyze.PennaVolumeFit(pxs, pys, halo, int(c.order), int(c.order))
+	if c.bootstraps > 0 {
+		cs = append(cs, bootstrapCoeffs(pxs, pys, halo, seed, c)...)
+	}
+	if c.shellDefinition == "both" {
+		mxs, mys, ok := splashbackPoints(halo, buf, c, true)
+		if !ok {
+			return nil, false
+		}
+		mcs, _ := analyze.PennaVolumeFit(
+			mxs, mys, halo, int(c.order), int(c.order),
+		)
+		cs = append(cs, mcs...)
+	}
 	return cs, true
 }
 
+// bootstrapCoeffs refits the Penna-Dines shell of a halo Bootstraps times,
+// each time to a set of rings drawn with replacement, and returns the
+// coefficients of every fit concatenated together.
+func bootstrapCoeffs(
+	pxs, pys [][]float64, halo *los.Halo, seed uint64, c *ShellConfig,
+) []float64 {
+	vxs := make([][]float64, len(pxs))
+	vys := make([][]float64, len(pxs))
+	vzs := make([][]float64, len(pxs))
+	for i := range pxs {
+		vxs[i] = make([]float64, len(pxs[i]))
+		vys[i] = make([]float64, len(pxs[i]))
+		vzs[i] = make([]float64, len(pxs[i]))
+		for j := range pxs[i] {
+			vxs[i][j], vys[i][j], vzs[i][j] =
+				halo.PlaneToVolume(i, pxs[i][j], pys[i][j])
+		}
+	}
+
+	gen := rand.New(rand.Xorshift, seed)
+	out := []float64{}
+	for b := 0; b < int(c.bootstraps); b++ {
+		fXs, fYs, fZs := []float64{}, []float64{}, []float64{}
+		for range pxs {
+			i := gen.UniformInt(0, len(pxs))
+			fXs = append(fXs, vxs[i]...)
+			fYs = append(fYs, vys[i]...)
+			fZs = append(fZs, vzs[i]...)
+		}
+		cs := analyze.PennaCoeffs(
+			fXs, fYs, fZs, int(c.order), int(c.order), 2,
+		)
+		out = append(out, cs...)
+	}
+	return out
+}
+
+// ellipsoidRowLength is the number of output columns used by an ellipsoid
+// fit.
+const ellipsoidRowLength = 11
+
+// calcEllipsoid fits an ellipsoid to the splashback points of a halo and
+// returns the center offset, axes, axis ratios, and major axis direction. If
+// the fit fails, the returned row is still allocated.
+func calcEllipsoid(
+	halo *los.Halo, buf []analyze.RingBuffer, c *ShellConfig,
+) ([]float64, bool) {
+	row := make([]float64, ellipsoidRowLength)
+	pxs, pys, ok := splashbackPoints(
+		halo, buf, c, c.shellDefinition == "minimum",
+	)
+	if !ok {
+		return row, false
+	}
+	el, ok := analyze.EllipsoidVolumeFit(pxs, pys, halo)
+	if !ok {
+		return row, false
+	}
+
+	a, b, cc := el.Axes[0], el.Axes[1], el.Axes[2]
+	copy(row[0:3], el.Center[:])
+	row[3], row[4], row[5] = a, b, cc
+	row[6], row[7] = b/a, cc/a
+	copy(row[8:11], el.Vecs[0][:])
+	return row, true
+}
+
 func calcPercentile(
 	halo *los.Halo, c *ShellConfig,
 ) []float64 {
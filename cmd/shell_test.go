@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/los/geom"
+)
+
+func TestHostSubhalos(t *testing.T) {
+	config := &ShellConfig{subhaloMassRatio: 0.01, subhaloRadiusMult: 2}
+
+	// Halo 0 is the host. Halo 1 is a subhalo across the periodic boundary,
+	// halo 2 is too small to be excised, and halo 3 is more massive than the
+	// host.
+	xs := []float64{1, 99, 2, 3}
+	ys := []float64{50, 51, 50, 50}
+	zs := []float64{50, 50, 49, 50}
+	ms := []float64{1e12, 1e11, 1e9, 1e13}
+	rs := []float64{0.2, 0.1, 0.02, 0.4}
+	pos := [3]float64{xs[0], ys[0], zs[0]}
+
+	excised := config.hostSubhalos(
+		0, pos, []int{0, 1, 2, 3}, xs, ys, zs, ms, rs, 100,
+	)
+	if len(excised) != 1 {
+		t.Fatalf("Expected 1 excised subhalo, got %d.", len(excised))
+	}
+	expected := geom.Sphere{C: [3]float32{-2, 1, 0}, R: 0.2}
+	if excised[0] != expected {
+		t.Errorf("Expected excised sphere %v, got %v.", expected, excised[0])
+	}
+}
+
+func TestInExcised(t *testing.T) {
+	origin := [3]float64{10, 10, 10}
+	excised := []geom.Sphere{
+		{C: [3]float32{1, 0, 0}, R: 0.5},
+		{C: [3]float32{0, -2, 0}, R: 1},
+	}
+
+	tests := []struct {
+		x   [3]float32
+		out bool
+	}{
+		{[3]float32{11, 10, 10}, true},
+		{[3]float32{11.4, 10, 10}, true},
+		{[3]float32{11.6, 10, 10}, false},
+		{[3]float32{10, 8.5, 10}, true},
+		{[3]float32{10, 10, 10}, false},
+	}
+
+	for i := range tests {
+		out := inExcised(tests[i].x, origin, excised)
+		if out != tests[i].out {
+			t.Errorf("%d) Expected inExcised(%v) = %v, got %v.",
+				i, tests[i].x, tests[i].out, out)
+		}
+	}
+	if inExcised([3]float32{11, 10, 10}, origin, nil) {
+		t.Errorf("Expected no excision without any spheres.")
+	}
+}
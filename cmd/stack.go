@@ -0,0 +1,380 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/los/analyze"
+	"github.com/phil-mansfield/shellfish/los/geom"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// StackConfig contains the configuration fields for the 'stack' mode of the
+// shellfish tool.
+type StackConfig struct {
+	order               int64
+	spokes, radialBins  int64
+	rMinMult, rMaxMult  float64
+	smoothingWindow     int64
+	jackknifeSubsamples int64
+}
+
+var _ Mode = &StackConfig{}
+
+// ExampleConfig creates an example stack.config file.
+func (config *StackConfig) ExampleConfig() string {
+	return `[stack.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The stack tool measures a single splashback shell for a whole sample of
+# halos. The particles around every input halo are rescaled by that halo's
+# R200m and weighted by 1/R200m^3, so each halo contributes equally at a fixed
+# overdensity, and then stacked on top of one another. The stacked particles
+# are split into lines of sight, the splashback point along each one is the
+# radius where the logarithmic slope of its smoothed density profile is
+# steepest, and a single Penna-Dines shell is fit to those points. The output is the volume-equivalent
+# radius of that shell in units of R200m.
+#
+# Errors come from jackknife resampling: the halos are split into
+# JackknifeSubsamples groups, the shell is refit with each group left out in
+# turn, and the scatter between the refits gives the error on the stacked
+# radius.
+
+# Order is the order of the Penna-Dines shell fit to the stacked halo.
+# Defaults to 3.
+#
+# Order = 3
+
+# Spokes is the number of lines of sight through the stacked halo. Defaults to
+# 256.
+#
+# Spokes = 256
+
+# RadialBins is the number of logarithmic radial bins along each line of sight.
+# Defaults to 64.
+#
+# RadialBins = 64
+
+# RMinMult and RMaxMult are the minimum and maximum radii of each line of sight
+# in units of R200m. Default to 0.5 and 3.
+#
+# RMinMult = 0.5
+# RMaxMult = 3
+
+# SmoothingWindow is the width of the Savitzky-Golay smoothing window applied
+# to the log of each density profile, in radial bins. Must be odd, larger than
+# 4, and smaller than RadialBins. Defaults to 11.
+#
+# SmoothingWindow = 11
+
+# JackknifeSubsamples is the number of groups that halos are split into when
+# estimating errors. If there are fewer halos than this, every halo is its own
+# group. Defaults to 10.
+#
+# JackknifeSubsamples = 10`
+}
+
+// ReadConfig reads in a stack.config file into config.
+func (config *StackConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("stack.config")
+	vars.Int(&config.order, "Order", 3)
+	vars.Int(&config.spokes, "Spokes", 256)
+	vars.Int(&config.radialBins, "RadialBins", 64)
+	vars.Float(&config.rMinMult, "RMinMult", 0.5)
+	vars.Float(&config.rMaxMult, "RMaxMult", 3)
+	vars.Int(&config.smoothingWindow, "SmoothingWindow", 11)
+	vars.Int(&config.jackknifeSubsamples, "JackknifeSubsamples", 10)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *StackConfig) validate() error {
+	if config.order < 2 {
+		return fmt.Errorf("The 'Order' variable is set to %d, but it "+
+			"needs to be at least 2.", config.order)
+	}
+	if config.spokes < 2*config.order*config.order {
+		return fmt.Errorf("The 'Spokes' variable is set to %d, but it "+
+			"needs to be at least 2 * Order^2, %d.",
+			config.spokes, 2*config.order*config.order)
+	}
+	if config.rMinMult <= 0 {
+		return fmt.Errorf("The 'RMinMult' variable is set to %g, but it "+
+			"needs to be positive.", config.rMinMult)
+	}
+	if config.rMaxMult <= config.rMinMult {
+		return fmt.Errorf("The 'RMaxMult' variable is set to %g, but it "+
+			"needs to be larger than 'RMinMult', %g.",
+			config.rMaxMult, config.rMinMult)
+	}
+	if config.smoothingWindow <= 4 || config.smoothingWindow%2 != 1 {
+		return fmt.Errorf("The 'SmoothingWindow' variable is set to %d, but "+
+			"it needs to be odd and larger than 4.", config.smoothingWindow)
+	}
+	if config.radialBins <= config.smoothingWindow {
+		return fmt.Errorf("The 'RadialBins' variable is set to %d, but it "+
+			"needs to be larger than 'SmoothingWindow', %d.",
+			config.radialBins, config.smoothingWindow)
+	}
+	if config.jackknifeSubsamples < 2 {
+		return fmt.Errorf("The 'JackknifeSubsamples' variable is set to %d, "+
+			"but it needs to be at least 2.", config.jackknifeSubsamples)
+	}
+	return nil
+}
+
+// stackSamples is the number of Monte Carlo samples used when finding the
+// volume of the stacked shell.
+const stackSamples = 50 * 1000
+
+// Run executes the stack mode of the shellfish tool.
+func (config *StackConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+#####################
+## shellfish stack ##
+#####################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, coords, err := catalog.Parse(
+		stdin, []int{0, 1}, []int{2, 3, 4, 5},
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	n := 0
+	for i := range ids {
+		if snaps[i] != -1 && coords[3][i] > 0 {
+			n++
+		}
+	}
+	groups := int(config.jackknifeSubsamples)
+	if n < groups {
+		groups = n
+	}
+	if groups < 2 {
+		return nil, fmt.Errorf("At least two halos with positive R200m " +
+			"are needed to make a stack.")
+	}
+
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = readInputUnits(
+		stdin, snaps, coords, repeatKind(lengthUnit, 4), buf, e,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// ms[g] is the rescaled mass in every radial bin of every line of sight
+	// contributed by jackknife group g.
+	dirs := normVecs(int(config.spokes), randSeed)
+	bins := int(config.spokes * config.radialBins)
+	ms := make([][]float64, groups)
+	for g := range ms {
+		ms[g] = make([]float64, bins)
+	}
+
+	k := 0
+	_, idxBins := binBySnap(snaps, ids)
+	for snap, idxs := range idxBins {
+		if snap == -1 {
+			continue
+		}
+
+		spheres := make([]geom.Sphere, len(idxs))
+		for j, i := range idxs {
+			spheres[j] = geom.Sphere{
+				C: [3]float32{
+					float32(coords[0][i]), float32(coords[1][i]),
+					float32(coords[2][i]),
+				},
+				R: float32(coords[3][i] * config.rMaxMult),
+			}
+		}
+		ps, _, err := causticSphereParticles(snap, spheres, buf, e)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, i := range idxs {
+			r200m := coords[3][i]
+			if r200m <= 0 {
+				continue
+			}
+			config.stackParticles(ps[j], r200m, dirs, ms[k%groups])
+			k++
+		}
+	}
+
+	total := make([]float64, bins)
+	for g := range ms {
+		for b := range total {
+			total[b] += ms[g][b]
+		}
+	}
+	rsp, spokes := config.stackedRadius(total, dirs)
+
+	// Refit the shell with each group left out.
+	rsps := make([]float64, groups)
+	sub := make([]float64, bins)
+	for g := range ms {
+		for b := range sub {
+			sub[b] = total[b] - ms[g][b]
+		}
+		rsps[g], _ = config.stackedRadius(sub, dirs)
+	}
+	_, sigma := halo.Jackknife(rsps)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	order := []int{0, 1, 2, 3}
+	lines := catalog.FormatCols(
+		[][]int{{n}, {spokes}}, [][]float64{{rsp}, {sigma}}, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"Halos", "Spokes"},
+		[]string{"R_sp/R200m", "Sigma(R_sp/R200m)"},
+		order, []int{1, 1, 1, 1},
+	)
+
+	return append([]string{cString}, lines...), nil
+}
+
+// stackParticles adds the particles around a single halo to a stacked set of
+// line of sight mass profiles. Radii are in units of R200m and masses are
+// divided by R200m^3.
+func (config *StackConfig) stackParticles(
+	ps *causticParticles, r200m float64, dirs [][3]float32, ms []float64,
+) {
+	bins := int(config.radialBins)
+	lrMin := math.Log(config.rMinMult)
+	dlr := math.Log(config.rMaxMult/config.rMinMult) / float64(bins)
+	w := 1 / (r200m * r200m * r200m)
+
+	for i, dx := range ps.dxs {
+		r := math.Sqrt(float64(dx[0]*dx[0]+dx[1]*dx[1]+dx[2]*dx[2])) / r200m
+		if r < config.rMinMult || r >= config.rMaxMult {
+			continue
+		}
+		b := int((math.Log(r) - lrMin) / dlr)
+		if b >= bins {
+			b = bins - 1
+		}
+
+		// Assign each particle to the closest line of sight.
+		jMax, dotMax := 0, float32(math.Inf(-1))
+		for j, d := range dirs {
+			dot := dx[0]*d[0] + dx[1]*d[1] + dx[2]*d[2]
+			if dot > dotMax {
+				jMax, dotMax = j, dot
+			}
+		}
+
+		ms[jMax*bins+b] += float64(ps.ms[i]) * w
+	}
+}
+
+// stackedRadius fits a Penna-Dines shell to the splashback points of a set
+// of stacked line of sight mass profiles and returns its volume-equivalent
+// radius along with the number of lines of sight where a splashback point was
+// found. NaN is returned if there are too few points to fit the shell.
+func (config *StackConfig) stackedRadius(
+	ms []float64, dirs [][3]float32,
+) (float64, int) {
+	bins := int(config.radialBins)
+	lrMin := math.Log(config.rMinMult)
+	dlr := math.Log(config.rMaxMult/config.rMinMult) / float64(bins)
+
+	rs, vols := make([]float64, bins), make([]float64, bins)
+	dOmega := 4 * math.Pi / float64(len(dirs))
+	for b := range rs {
+		r0 := math.Exp(lrMin + float64(b)*dlr)
+		r1 := math.Exp(lrMin + float64(b+1)*dlr)
+		rs[b] = math.Exp(lrMin + (float64(b)+0.5)*dlr)
+		vols[b] = dOmega / 3 * (r1*r1*r1 - r0*r0*r0)
+	}
+
+	// Bins within half a smoothing window of either edge are skipped, since
+	// the smoothed slope is unreliable there.
+	window := int(config.smoothingWindow)
+	rLo, rHi := rs[window/2], rs[bins-1-window/2]
+
+	xs, ys, zs := []float64{}, []float64{}, []float64{}
+	rhos := make([]float64, bins)
+	for j, d := range dirs {
+		empty := false
+		for b := range rhos {
+			rhos[b] = ms[j*bins+b] / vols[b]
+			empty = empty || rhos[b] == 0
+		}
+		if empty {
+			continue
+		}
+
+		_, derivs, ok := analyze.Smooth(rs, rhos, window)
+		if !ok {
+			continue
+		}
+		r, ok := analyze.MinimumSlopeRadius(rs, derivs, rLo, rHi)
+		if !ok {
+			continue
+		}
+
+		xs = append(xs, r*float64(d[0]))
+		ys = append(ys, r*float64(d[1]))
+		zs = append(zs, r*float64(d[2]))
+	}
+
+	order := int(config.order)
+	if len(xs) < 2*order*order {
+		return math.NaN(), len(xs)
+	}
+	cs := analyze.PennaCoeffs(xs, ys, zs, order, order, 2)
+	vol := analyze.PennaFunc(cs, order, order, 2).Volume(stackSamples)
+	return math.Pow(vol/(math.Pi*4/3), 0.33333), len(xs)
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
@@ -15,8 +16,10 @@ import (
 
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
 	"github.com/phil-mansfield/shellfish/cmd/memo"
 	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/math/rand"
 	"github.com/phil-mansfield/shellfish/parse"
 )
 
@@ -25,6 +28,22 @@ type StatsConfig struct {
 	monteCarloSamples int64
 	exclusionStrategy string
 	order             int64
+	bootstraps        int64
+	powerLMax         int64
+	radiusPercentiles []float64
+
+	normalizedColumns bool
+	include200c       bool
+
+	gammaFile string
+
+	freeCenter bool
+
+	neighborOverlap bool
+
+	combineRepeats bool
+
+	speciesMasses bool
 
 	skipMass          bool
 	
@@ -63,6 +82,80 @@ ExclusionStrategy = none
 # the same value used by the shell.config file. By default both are set to 3.
 Order = 3
 
+# Bootstraps is the number of bootstrap shells written after each halo's
+# coefficients by shell. It must be the same value used by the shell.config
+# file. If it is larger than zero, two columns are added to the end of the
+# output: the standard deviations of M_sp and R_sp across the bootstrap
+# shells. The cost of computing masses scales with Bootstraps + 1.
+Bootstraps = 0
+
+# PowerLMax is the largest spherical harmonic degree, l, used when measuring the
+# angular power spectrum of each shell's radius field, C_l. If it is larger than
+# zero, PowerLMax columns are added to the end of the output giving C_l / C_0
+# for l = 1 to PowerLMax. These measure how aspherical (low l) and how lumpy
+# (higher l) a shell is in a way that doesn't depend on its orientation.
+PowerLMax = 0
+
+# RadiusPercentiles is a list of percentiles of the distribution of the shell's
+# radius over all angles. For each percentile, p, a column is added to the end
+# of the output giving R_p in comoving Mpc/h, so the spread of radii around the
+# volume-equivalent radius can be compared to observations. Each value must be
+# between 0 and 100. By default, no percentiles are written. For example:
+#
+# RadiusPercentiles = 10, 50, 90
+
+# NormalizedColumns adds R_sp/R200m and M_sp/M200m columns to the output. R200m
+# is taken from the input catalog and M200m is read from the halo catalog, so
+# M200m must be one of the global config's HaloValueNames. If Include200c is
+# also true, R_sp/R200c and M_sp/M200c columns are added as well, which
+# requires M200c to be one of the HaloValueNames.
+NormalizedColumns = true
+Include200c = false
+
+# GammaFile is the name of a file containing the output of shellfish gamma for
+# the input halos. If it is set, each halo's R_sp/R200m and M_sp/M200m are
+# predicted from its accretion rate, Gamma, using the fitting functions of
+# More, Diemer, & Kravtsov (2015), and four columns are added to the output:
+# the predicted R_sp/R200m, the fractional residual of the measured R_sp
+# relative to the prediction, the predicted M_sp/M200m, and the fractional
+# residual of the measured M_sp. Halos which aren't in the file get NaNs. Here
+# M200m is computed from the input R200m.
+#
+# GammaFile = gamma.txt
+
+# The offset between the center of volume of each shell and the halo center in
+# the input catalog is always written in units of R200m. If FreeCenter is true,
+# each shell (and each of its bootstrap shells) is refit around its center of
+# volume before anything else is measured, so the masses, axes, and other
+# columns are computed with the shell's own center rather than the catalog's.
+# The new centers are added as three columns after the offset.
+FreeCenter = false
+
+# NeighborOverlap measures how each shell overlaps with the other halos in the
+# input catalog. If it is true, four columns are added to the output: the
+# number of other halos whose shells intersect the shell, the fraction of the
+# shell's volume inside any of those shells, the number of other halos whose
+# R200m spheres intersect the shell, and the fraction of the shell's volume
+# inside any of those spheres. Volumes are found by Monte Carlo integration
+# with MonteCarloSamples points per halo, so very small overlaps can be missed.
+NeighborOverlap = false
+
+# CombineRepeats merges rows which refer to the same halo (e.g. because the id
+# tool's Mult variable was larger than 1) into a single row. Every column of the
+# merged row is the mean over the repetitions, except for the axis directions,
+# which are flipped to point in the same direction before being averaged. If it
+# is true, three columns are added to the end of the output: the number of
+# repetitions and the standard deviations of M_sp and R_sp across them.
+CombineRepeats = true
+
+# SpeciesMasses splits the mass inside each shell by particle species. If it is
+# true, four columns are added to the output: the dark matter, gas, and stellar
+# masses inside the shell and the baryon fraction, (M_gas + M_star) /
+# (M_dm + M_gas + M_star). As with the shell tool's ParticleSpecies variable,
+# gas and stars are Gadget particle types 0 and 4 and are only supported when
+# SnapshotType = Gadget-2. The dark matter mass is the same as M_sp.
+SpeciesMasses = false
+
 # SkipMass indicates whether splashback masses should be calculated. This is the
 # most expensive part of calculating the stats catalog by several order of
 # magnitude.
@@ -111,6 +204,16 @@ func (config *StatsConfig) ReadConfig(fname string, flags []string) error {
 	vars.Int(&config.monteCarloSamples, "MonteCarloSamples", 50*1000)
 	vars.String(&config.exclusionStrategy, "ExclusionStrategy", "none")
 	vars.Int(&config.order, "Order", 3)
+	vars.Int(&config.bootstraps, "Bootstraps", 0)
+	vars.Int(&config.powerLMax, "PowerLMax", 0)
+	vars.Floats(&config.radiusPercentiles, "RadiusPercentiles", []float64{})
+	vars.Bool(&config.normalizedColumns, "NormalizedColumns", true)
+	vars.Bool(&config.include200c, "Include200c", false)
+	vars.String(&config.gammaFile, "GammaFile", "")
+	vars.Bool(&config.freeCenter, "FreeCenter", false)
+	vars.Bool(&config.neighborOverlap, "NeighborOverlap", false)
+	vars.Bool(&config.combineRepeats, "CombineRepeats", true)
+	vars.Bool(&config.speciesMasses, "SpeciesMasses", false)
 	vars.String(&config.shellParticleFile, "ShellParticleFile", "")
 	vars.Float(&config.shellWidth, "ShellWidth", 0)
 	vars.Bool(&config.skipMass, "SkipMass", false)
@@ -166,6 +269,19 @@ func (config *StatsConfig) validate() error {
 	case config.monteCarloSamples <= 0:
 		return fmt.Errorf("The variable '%s' was set to %g",
 			"MonteCarloSamples", config.monteCarloSamples)
+	case config.bootstraps < 0:
+		return fmt.Errorf("The variable '%s' was set to %d",
+			"Bootstraps", config.bootstraps)
+	case config.powerLMax < 0:
+		return fmt.Errorf("The variable '%s' was set to %d",
+			"PowerLMax", config.powerLMax)
+	}
+
+	for i, p := range config.radiusPercentiles {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("Item %d of variable 'RadiusPercentiles' is "+
+				"set to %g, but it must be between 0 and 100.", i, p)
+		}
 	}
 
 	return nil
@@ -188,7 +304,8 @@ func (config *StatsConfig) Run(
 	}
 
 	intColIdxs := []int{0, 1}
-	floatColIdxs := make([]int, 4+2*config.order*config.order)
+	nCoeffs := int(2 * config.order * config.order)
+	floatColIdxs := make([]int, 4+nCoeffs*int(1+config.bootstraps))
 	for i := range floatColIdxs {
 		floatColIdxs[i] = i + len(intColIdxs)
 	}
@@ -203,10 +320,50 @@ func (config *StatsConfig) Run(
 		return nil, fmt.Errorf("No input IDs.")
 	}
 	ids, snaps := intCols[0], intCols[1]
-	coords, coeffs := floatCols[:4], transpose(floatCols[4:])
+
+	buf, err := getVectorBuffer(
+		e.ParticleCatalog(snaps[0], 0), gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+	// Positions, radii, and shell coefficients are all lengths.
+	err = readInputUnits(
+		stdin, snaps, floatCols, repeatKind(lengthUnit, len(floatCols)),
+		buf, e,
+	)
+	if err != nil {
+		return nil, err
+	}
+	uc, err := newUnitConverter(gConfig.Units, snaps, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	coords, allCoeffs := floatCols[:4], transpose(floatCols[4:])
+	coeffs := make([][]float64, len(allCoeffs))
+	bootCoeffs := make([][][]float64, len(allCoeffs))
+	for i := range allCoeffs {
+		coeffs[i] = allCoeffs[i][:nCoeffs]
+		for b := 0; b < int(config.bootstraps); b++ {
+			start := nCoeffs * (b + 1)
+			bootCoeffs[i] = append(
+				bootCoeffs[i], allCoeffs[i][start:start+nCoeffs],
+			)
+		}
+	}
+
+	workers := runtime.NumCPU()
+	if gConfig.Threads > 0 {
+		workers = int(gConfig.Threads)
+	}
+
+	offsets := config.centerOffsets(coeffs, bootCoeffs, coords, workers)
+
 	snapBins, coeffBins, idxBins := binCoeffsBySnap(snaps, ids, coeffs)
 
 	masses := make([]float64, len(ids))
+	sphereMasses := make([]float64, len(ids))
 
 	rads := make([]float64, len(ids))
 	rmins := make([]float64, len(ids))
@@ -216,8 +373,18 @@ func (config *StatsConfig) Run(
 	as := make([]float64, len(ids))
 	bs := make([]float64, len(ids))
 	cs := make([]float64, len(ids))
-	aVecs := make([][3]float64, len(ids))
+	axisVecs := make([][3][3]float64, len(ids))
+	powers := make([][]float64, len(ids))
+	radPercentiles := make([][]float64, len(ids))
+	nShells, n200ms := make([]int, len(ids)), make([]int, len(ids))
+	fShells, f200ms := make([]float64, len(ids)), make([]float64, len(ids))
 	shellParticles := make([][]int64, len(ids))
+	bootMasses := make([][]float64, len(ids))
+	bootRads := make([][]float64, len(ids))
+	for i := range ids {
+		bootMasses[i] = make([]float64, config.bootstraps)
+		bootRads[i] = make([]float64, config.bootstraps)
+	}
 
 	sortedSnaps := []int{}
 	for snap := range snapBins {
@@ -229,9 +396,46 @@ func (config *StatsConfig) Run(
 		log.Println("Finished initial allocations")
 		log.Println(logging.MemString())
 	}
-	
-	buf, err := getVectorBuffer(
-		e.ParticleCatalog(snaps[0], 0), gConfig,
+
+	// speciesBufs read the baryonic particle species whose masses are
+	// written in addition to the dark matter mass, M_sp.
+	var speciesBufs []io.VectorBuffer
+	var speciesMasses [][]float64
+	if config.speciesMasses {
+		if gConfig.SnapshotType != "Gadget-2" {
+			return nil, fmt.Errorf("The variable '%s' was set to true, but "+
+				"this is only supported when SnapshotType = Gadget-2.",
+				"SpeciesMasses")
+		}
+		for _, species := range []string{"gas", "stars"} {
+			sBuf, err := speciesBuffer(species, snaps, buf, gConfig, e)
+			if err != nil {
+				return nil, err
+			}
+			speciesBufs = append(speciesBufs, sBuf)
+			speciesMasses = append(speciesMasses, make([]float64, len(ids)))
+		}
+	}
+
+	var gammas []float64
+	if config.gammaFile != "" {
+		gammas, err = readGammas(config.gammaFile, ids, snaps)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Predictions of the fitting functions and the M200m values used to
+	// normalize the measured masses. These depend on each snapshot's
+	// cosmology.
+	fitRsps, fitMsps := make([]float64, len(ids)), make([]float64, len(ids))
+	m200ms := make([]float64, len(ids))
+	for i := range ids {
+		fitRsps[i], fitMsps[i] = math.NaN(), math.NaN()
+	}
+
+	normNames := config.normalizationNames()
+	normCols, err := normalizationValues(
+		ids, snaps, normNames, buf, e, gConfig,
 	)
 	if err != nil {
 		return nil, err
@@ -241,7 +445,7 @@ func (config *StatsConfig) Run(
 		log.Println("Initialized VectorBuffer")
 		log.Println(logging.MemString())
 	}
-	
+
 	for _, snap := range sortedSnaps {
 		if snap == -1 {
 			continue
@@ -260,22 +464,50 @@ func (config *StatsConfig) Run(
 			snapCoords[3][i] = coords[3][idx]
 		}
 
+		// Halos are split between workers. Every halo writes to its own
+		// index, so the output doesn't depend on the number of workers.
 		samples := int(config.monteCarloSamples)
-		for j := range idxs {
-			order := findOrder(coeffs[idxs[j]])
-			shell := analyze.PennaFunc(coeffs[idxs[j]], order, order, 2)
-
-			vol := shell.Volume(samples)
-			r := math.Pow(vol/(math.Pi*4/3), 0.33333)
-
-			vols[idxs[j]] = vol
-			rads[idxs[j]] = r
-			sas[idxs[j]] = shell.SurfaceArea(samples)
-			as[idxs[j]], bs[idxs[j]], cs[idxs[j]], aVecs[idxs[j]] =
-				shell.Axes(samples)
-
-			rmins[idxs[j]], rmaxes[idxs[j]] = rangeSp(snapCoeffs[j], config)
+		lg := NewLockGroup(workers)
+		for w := 0; w < workers; w++ {
+			go func(lock *Lock) {
+				for j := lock.Idx; j < len(idxs); j += lock.Workers {
+					order := findOrder(coeffs[idxs[j]])
+					shell := analyze.PennaFunc(coeffs[idxs[j]], order, order, 2)
+
+					vol := shell.Volume(samples)
+					r := math.Pow(vol/(math.Pi*4/3), 0.33333)
+
+					vols[idxs[j]] = vol
+					rads[idxs[j]] = r
+					sas[idxs[j]] = shell.SurfaceArea(samples)
+					as[idxs[j]], bs[idxs[j]], cs[idxs[j]], axisVecs[idxs[j]] =
+						shell.PrincipalAxes(samples)
+
+					rmins[idxs[j]], rmaxes[idxs[j]] =
+						rangeSp(snapCoeffs[j], config)
+
+					if config.powerLMax > 0 {
+						powers[idxs[j]] = shell.PowerSpectrum(
+							int(config.powerLMax), samples,
+						)
+					}
+					if len(config.radiusPercentiles) > 0 {
+						radPercentiles[idxs[j]] = shell.RadiusPercentiles(
+							config.radiusPercentiles, samples,
+						)
+					}
+
+					for b, bc := range bootCoeffs[idxs[j]] {
+						bShell := analyze.PennaFunc(bc, order, order, 2)
+						bVol := bShell.Volume(samples)
+						bootRads[idxs[j]][b] =
+							math.Pow(bVol/(math.Pi*4/3), 0.33333)
+					}
+				}
+				lock.Unlock()
+			}(lg.Lock(w))
 		}
+		lg.Synchronize()
 
 		if logging.Mode == logging.Performance {
 			log.Println("Shell calculations.")
@@ -286,6 +518,25 @@ func (config *StatsConfig) Run(
 		if err != nil {
 			return nil, err
 		}
+
+		if gammas != nil {
+			c := &hds[0].Cosmo
+			snapM200ms := make([]float64, len(idxs))
+			halo.R200m.Mass(c, snapCoords[3], snapM200ms)
+			for j, idx := range idxs {
+				m200ms[idx] = snapM200ms[j]
+				fitRsps[idx] = halo.MoreRsp(gammas[idx], c)
+				fitMsps[idx] = halo.MoreMsp(gammas[idx], c)
+			}
+		}
+
+		if config.neighborOverlap {
+			config.neighborOverlaps(
+				snap, ids, idxs, snapCoeffs, coords, rmaxes,
+				hds[0].TotalWidth, workers, nShells, n200ms, fShells, f200ms,
+			)
+		}
+
 		hBounds, err := boundingSpheres(snapCoords, &hds[0], e)
 		
 		if err != nil {
@@ -317,11 +568,22 @@ func (config *StatsConfig) Run(
 			}
 
 			for j := range idxs {
-				masses[idxs[j]] += massContained(
+				mShell, mSphere := massContained(
 					&hds[i], xs, ms, snapCoeffs[j],
-					hBounds[j], rLows[j], rHighs[j],
+					hBounds[j], rLows[j], rHighs[j], rads[idxs[j]],
 					gConfig.Threads,
 				)
+				masses[idxs[j]] += mShell
+				sphereMasses[idxs[j]] += mSphere
+
+				for b, bc := range bootCoeffs[idxs[j]] {
+					bLow, bHigh := rangeSp(bc, config)
+					bMass, _ := massContained(
+						&hds[i], xs, ms, bc, hBounds[j], bLow, bHigh,
+						bootRads[idxs[j]][b], gConfig.Threads,
+					)
+					bootMasses[idxs[j]][b] += bMass
+				}
 
 				if config.shellFilter {
 					// This isn't the correct way to handle this for
@@ -339,37 +601,151 @@ func (config *StatsConfig) Run(
 			}
 			buf.Close()
 		}
+
+		for k, sBuf := range speciesBufs {
+			if config.skipMass { break }
+			for i := range hds {
+				if len(intrBins[i]) == 0 { continue }
+
+				xs, _, ms, _, err := sBuf.Read(files[i])
+				if err != nil {
+					return nil, err
+				}
+				for j := range idxs {
+					m, _ := massContained(
+						&hds[i], xs, ms, snapCoeffs[j],
+						hBounds[j], rLows[j], rHighs[j], rads[idxs[j]],
+						gConfig.Threads,
+					)
+					speciesMasses[k][idxs[j]] += m
+				}
+				sBuf.Close()
+			}
+		}
 	}
 
 	if config.shellFilter && !config.skipMass {
 		writeShellParticles(snaps, ids, shellParticles, gConfig, config)
 	}
 
-	axs := make([]float64, len(ids))
-	ays := make([]float64, len(ids))
-	azs := make([]float64, len(ids))
-	for i := range axs {
-		axs[i], ays[i], azs[i] = aVecs[i][0], aVecs[i][1], aVecs[i][2]
+	shapeCols, shapeNames := shapeColumns(as, bs, cs, rmins, rmaxes, axisVecs)
+	floatCols = append([][]float64{masses, rads, vols, sas}, shapeCols...)
+	floatCols = append(floatCols, sphereMasses, offsets)
+	floatNames := append([]string{"M_sp [M_sun/h]", "R_sp [cMpc/h]",
+		"Volume [cMpc^3/h^3]", "Surface Area [cMpc^2/h^2]",
+	}, shapeNames...)
+	floatNames = append(floatNames, "M_sphere [M_sun/h]", "Offset/R200m")
+	if config.freeCenter {
+		floatCols = append(floatCols, coords[0], coords[1], coords[2])
+		floatNames = append(floatNames,
+			"X_sp [cMpc/h]", "Y_sp [cMpc/h]", "Z_sp [cMpc/h]")
+	}
+	if config.bootstraps > 0 {
+		sigMs, sigRs := make([]float64, len(ids)), make([]float64, len(ids))
+		for i := range ids {
+			sigMs[i], sigRs[i] = stdDev(bootMasses[i]), stdDev(bootRads[i])
+		}
+		floatCols = append(floatCols, sigMs, sigRs)
+		floatNames = append(floatNames,
+			"Sigma_M_sp [M_sun/h]", "Sigma_R_sp [cMpc/h]")
+	}
+	if config.speciesMasses {
+		mGas, mStar := speciesMasses[0], speciesMasses[1]
+		fbs := make([]float64, len(ids))
+		for i := range ids {
+			fbs[i] = (mGas[i] + mStar[i]) / (masses[i] + mGas[i] + mStar[i])
+		}
+		floatCols = append(floatCols,
+			append([]float64{}, masses...), mGas, mStar, fbs)
+		floatNames = append(floatNames, "M_dm [M_sun/h]", "M_gas [M_sun/h]",
+			"M_star [M_sun/h]", "f_b")
+	}
+	if config.neighborOverlap {
+		nShellCol := make([]float64, len(ids))
+		n200mCol := make([]float64, len(ids))
+		for i := range ids {
+			nShellCol[i] = float64(nShells[i])
+			n200mCol[i] = float64(n200ms[i])
+		}
+		floatCols = append(floatCols, nShellCol, fShells, n200mCol, f200ms)
+		floatNames = append(floatNames,
+			"Shell Neighbors", "Shell Overlap Fraction",
+			"R200m Neighbors", "R200m Overlap Fraction")
+	}
+	if config.normalizedColumns {
+		// normCols[0] is M200m and normCols[1:] are R200c and M200c.
+		floatCols = append(floatCols,
+			ratioCol(rads, coords[3]), ratioCol(masses, normCols[0]))
+		floatNames = append(floatNames, "R_sp/R200m", "M_sp/M200m")
+		if config.include200c {
+			floatCols = append(floatCols,
+				ratioCol(rads, normCols[1]), ratioCol(masses, normCols[2]))
+			floatNames = append(floatNames, "R_sp/R200c", "M_sp/M200c")
+		}
+	}
+	if gammas != nil {
+		rResids := ratioCol(ratioCol(rads, coords[3]), fitRsps)
+		mResids := ratioCol(ratioCol(masses, m200ms), fitMsps)
+		for i := range ids {
+			rResids[i]--
+			mResids[i]--
+		}
+		floatCols = append(floatCols, fitRsps, rResids, fitMsps, mResids)
+		floatNames = append(floatNames,
+			"R_sp/R200m (MDK15)", "Delta R_sp/R_sp (MDK15)",
+			"M_sp/M200m (MDK15)", "Delta M_sp/M_sp (MDK15)")
+	}
+	for l := 1; l <= int(config.powerLMax); l++ {
+		ratios := make([]float64, len(ids))
+		for i := range ids {
+			if powers[i] == nil {
+				ratios[i] = math.NaN()
+			} else {
+				ratios[i] = powers[i][l] / powers[i][0]
+			}
+		}
+		floatCols = append(floatCols, ratios)
+		floatNames = append(floatNames, fmt.Sprintf("C_%d/C_0", l))
+	}
+	for k, p := range config.radiusPercentiles {
+		rps := make([]float64, len(ids))
+		for i := range ids {
+			if radPercentiles[i] == nil {
+				rps[i] = math.NaN()
+			} else {
+				rps[i] = radPercentiles[i][k]
+			}
+		}
+		floatCols = append(floatCols, rps)
+		floatNames = append(floatNames, fmt.Sprintf("R_%g [cMpc/h]", p))
 	}
 
-	lines := catalog.FormatCols(
-		[][]int{ids, snaps},
-		[][]float64{masses, rads, vols, sas,
-			as, bs, cs, axs, ays, azs, rmins, rmaxes},
-		[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13},
-	)
+	if config.combineRepeats {
+		var repeats []int
+		var sigmas [][]float64
+		ids, snaps, floatCols, repeats, sigmas = combineRepeats(
+			ids, snaps, floatCols, axisColumns(floatNames),
+		)
+		repeatCol := make([]float64, len(repeats))
+		for i := range repeats {
+			repeatCol[i] = float64(repeats[i])
+		}
+		floatCols = append(floatCols, repeatCol, sigmas[0], sigmas[1])
+		floatNames = append(floatNames, "Repeats",
+			"Sigma_M_sp,rep [M_sun/h]", "Sigma_R_sp,rep [cMpc/h]")
+	}
+
+	uc.convert(snaps, floatCols, labelKinds(floatNames))
+	relabelColumns(gConfig.Units, floatNames)
+
+	order := make([]int, 2+len(floatCols))
+	sizes := make([]int, len(order))
+	for i := range order {
+		order[i], sizes[i] = i, 1
+	}
+	lines := catalog.FormatCols([][]int{ids, snaps}, floatCols, order)
 	cString := catalog.CommentString(
-		[]string{"ID", "Snapshot"},
-		[]string{"M_sp [M_sun/h]", "R_sp [cMpc/h]",
-			"Volume [cMpc^3/h^3]", "Surface Area [cMpc^2/h^2]",
-			"Major Axis [cMpc/h]",
-			"Intermediate Axis [cMpc/h]",
-			"Minor Axis [cMpc/h]",
-			"Ax", "Ay", "Az",
-			"RMin [cMpc/h]", "RMax [cMpc/h]",
-		},
-		[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13},
-		[]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+		[]string{"ID", "Snapshot"}, floatNames, order, sizes,
 	)
 
 	if logging.Mode == logging.Performance {
@@ -377,7 +753,420 @@ func (config *StatsConfig) Run(
 		log.Printf("Memory:\n%s", logging.MemString())
 	}
 
-	return append([]string{cString}, lines...), nil
+	return append([]string{uc.unitsString(), cString}, lines...), nil
+}
+
+// neighborOverlaps finds how much the shell of each halo in a snapshot
+// overlaps with the shells and R200m spheres of the other halos in that
+// snapshot. The number of overlapping neighbors and the fraction of each
+// shell's volume which they cover are written to the output slices at the
+// halos' global indices, idxs.
+func (config *StatsConfig) neighborOverlaps(
+	snap int, ids, idxs []int, coeffs, coords [][]float64, rmaxes []float64,
+	L float64, workers int, nShells, n200ms []int, fShells, f200ms []float64,
+) {
+	n := len(idxs)
+	xs, ys, zs := make([]float64, n), make([]float64, n), make([]float64, n)
+	rs, r200ms := make([]float64, n), make([]float64, n)
+	reach := 0.0
+	for j, i := range idxs {
+		xs[j], ys[j], zs[j] = coords[0][i], coords[1][i], coords[2][i]
+		rs[j], r200ms[j] = rmaxes[i], coords[3][i]
+		reach = math.Max(reach, math.Max(rs[j], r200ms[j]))
+	}
+
+	// Matchers aren't thread safe, so candidate neighbors are found up front.
+	// A neighbor is a candidate if either its shell or its R200m sphere could
+	// reach this halo's shell.
+	mt := halo.NewMatcher(finderCells, L, xs, ys, zs, rs)
+	neighbors := make([][]int, n)
+	for j := range neighbors {
+		pos := [3]float64{xs[j], ys[j], zs[j]}
+		nIdxs, dists := mt.Neighbors(pos, rs[j]+reach)
+		for k, nj := range nIdxs {
+			if nj != j && dists[k] < rs[j]+math.Max(rs[nj], r200ms[nj]) {
+				neighbors[j] = append(neighbors[j], nj)
+			}
+		}
+	}
+
+	samples := int(config.monteCarloSamples)
+	lg := NewLockGroup(workers)
+	for w := 0; w < workers; w++ {
+		go func(lock *Lock) {
+			for j := lock.Idx; j < n; j += lock.Workers {
+				i := idxs[j]
+				nShells[i], n200ms[i], fShells[i], f200ms[i] = 0, 0, 0, 0
+				if len(neighbors[j]) == 0 {
+					continue
+				}
+
+				shell := penna(coeffs[j])
+				nShellList := make([]analyze.Shell, len(neighbors[j]))
+				offsets := make([][3]float64, len(neighbors[j]))
+				for k, nj := range neighbors[j] {
+					nShellList[k] = penna(coeffs[nj])
+					offsets[k] = [3]float64{
+						wrapDist(xs[nj], xs[j], L),
+						wrapDist(ys[nj], ys[j], L),
+						wrapDist(zs[nj], zs[j], L),
+					}
+				}
+				hitShell := make([]bool, len(neighbors[j]))
+				hit200m := make([]bool, len(neighbors[j]))
+
+				// Points are uniform in angle and weighted by r^3 so that
+				// they sample the shell's volume uniformly.
+				seed := haloSeed(randSeed, ids[i], snap)
+				gen := rand.New(rand.Xorshift, seed)
+				wTot, wShell, w200m := 0.0, 0.0, 0.0
+				for s := 0; s < samples; s++ {
+					phi := gen.Uniform(0, 2*math.Pi)
+					theta := math.Acos(gen.Uniform(-1, 1))
+					rSh := shell(phi, theta)
+					wt := rSh * rSh * rSh
+					r := rSh * math.Cbrt(gen.Uniform(0, 1))
+					sinP, cosP := math.Sincos(phi)
+					sinT, cosT := math.Sincos(theta)
+					x, y, z := r*sinT*cosP, r*sinT*sinP, r*cosT
+
+					inShell, in200m := false, false
+					for k, nj := range neighbors[j] {
+						dx := x - offsets[k][0]
+						dy := y - offsets[k][1]
+						dz := z - offsets[k][2]
+						if nShellList[k].Contains(dx, dy, dz) {
+							inShell, hitShell[k] = true, true
+						}
+						if dx*dx+dy*dy+dz*dz < r200ms[nj]*r200ms[nj] {
+							in200m, hit200m[k] = true, true
+						}
+					}
+
+					wTot += wt
+					if inShell {
+						wShell += wt
+					}
+					if in200m {
+						w200m += wt
+					}
+				}
+
+				for k := range neighbors[j] {
+					if hitShell[k] {
+						nShells[i]++
+					}
+					if hit200m[k] {
+						n200ms[i]++
+					}
+				}
+				fShells[i], f200ms[i] = wShell/wTot, w200m/wTot
+			}
+			lock.Unlock()
+		}(lg.Lock(w))
+	}
+	lg.Synchronize()
+}
+
+// penna returns the Penna-Dines shell corresponding to a set of coefficients.
+func penna(coeffs []float64) analyze.Shell {
+	order := findOrder(coeffs)
+	return analyze.PennaFunc(coeffs, order, order, 2)
+}
+
+// recenterPoints is the number of points on the surface of a shell used when
+// refitting it around a new center.
+const recenterPoints = 2000
+
+// centerOffsets returns the distance between the center of volume of each
+// shell and its halo's center in units of R200m. If config.freeCenter is set,
+// coeffs and bootCoeffs are replaced by shells refit around the center of
+// volume of the main shell and the halo centers in coords are moved there.
+func (config *StatsConfig) centerOffsets(
+	coeffs [][]float64, bootCoeffs [][][]float64, coords [][]float64,
+	workers int,
+) []float64 {
+	offsets := make([]float64, len(coeffs))
+	samples := int(config.monteCarloSamples)
+
+	lg := NewLockGroup(workers)
+	for w := 0; w < workers; w++ {
+		go func(lock *Lock) {
+			for i := lock.Idx; i < len(coeffs); i += lock.Workers {
+				order := findOrder(coeffs[i])
+				shell := analyze.PennaFunc(coeffs[i], order, order, 2)
+				dx := shell.Centroid(samples)
+				offsets[i] = math.Sqrt(dx[0]*dx[0]+dx[1]*dx[1]+dx[2]*dx[2]) /
+					coords[3][i]
+
+				if !config.freeCenter {
+					continue
+				}
+				coeffs[i] = recenterCoeffs(coeffs[i], dx)
+				for b := range bootCoeffs[i] {
+					bootCoeffs[i][b] = recenterCoeffs(bootCoeffs[i][b], dx)
+				}
+				for k := 0; k < 3; k++ {
+					coords[k][i] += dx[k]
+				}
+			}
+			lock.Unlock()
+		}(lg.Lock(w))
+	}
+	lg.Synchronize()
+
+	return offsets
+}
+
+// recenterCoeffs refits a Penna-Dines shell around the point dx, given
+// relative to the shell's current origin.
+func recenterCoeffs(coeffs []float64, dx [3]float64) []float64 {
+	order := findOrder(coeffs)
+	shell := analyze.PennaFunc(coeffs, order, order, 2)
+
+	xs := make([]float64, recenterPoints)
+	ys := make([]float64, recenterPoints)
+	zs := make([]float64, recenterPoints)
+	for i, d := range normVecs(recenterPoints, randSeed) {
+		x, y, z := float64(d[0]), float64(d[1]), float64(d[2])
+		r := shell(math.Atan2(y, x), math.Acos(z))
+		xs[i], ys[i], zs[i] = r*x-dx[0], r*y-dx[1], r*z-dx[2]
+	}
+
+	return analyze.PennaCoeffs(xs, ys, zs, order, order, 2)
+}
+
+// normalizationNames returns the halo catalog values needed to compute the
+// normalized columns requested by config.
+func (config *StatsConfig) normalizationNames() []string {
+	switch {
+	case !config.normalizedColumns:
+		return nil
+	case config.include200c:
+		return []string{"M200m", "R200c", "M200c"}
+	default:
+		return []string{"M200m"}
+	}
+}
+
+// normalizationValues reads the given values for every halo from the halo
+// catalog. Radii are converted to comoving Mpc/h.
+func normalizationValues(
+	ids, snaps []int, names []string, buf io.VectorBuffer,
+	e *env.Environment, gConfig *GlobalConfig,
+) ([][]float64, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if _, ok := vars.ColumnLookup[name]; !ok {
+			return nil, fmt.Errorf("The stats tool needs the value '%s' "+
+				"to compute normalized columns, but it isn't in "+
+				"'HaloValueNames'.", name)
+		}
+	}
+
+	return readHaloCoords(ids, snaps, names, vars, buf, e, gConfig)
+}
+
+// readGammas reads the accretion rate of each input halo from a catalog
+// written by shellfish gamma. Halos which aren't in the catalog are given NaN.
+func readGammas(fname string, ids, snaps []int) ([]float64, error) {
+	text, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	intCols, floatCols, err := catalog.Parse(text, []int{0, 1}, []int{2})
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := map[[2]int]float64{}
+	for i := range intCols[0] {
+		lookup[[2]int{intCols[0][i], intCols[1][i]}] = floatCols[0][i]
+	}
+
+	gammas := make([]float64, len(ids))
+	for i := range ids {
+		gamma, ok := lookup[[2]int{ids[i], snaps[i]}]
+		if !ok {
+			gamma = math.NaN()
+		}
+		gammas[i] = gamma
+	}
+	return gammas, nil
+}
+
+// ratioCol returns xs[i] / ys[i] for every element, or NaN if ys[i] isn't
+// positive.
+func ratioCol(xs, ys []float64) []float64 {
+	out := make([]float64, len(xs))
+	for i := range xs {
+		if ys[i] > 0 {
+			out[i] = xs[i] / ys[i]
+		} else {
+			out[i] = math.NaN()
+		}
+	}
+	return out
+}
+
+// shapeColumns returns the columns describing the shapes of the shells and
+// their names: the axis lengths, the major axis direction, the radius range,
+// the axis ratios, and the intermediate and minor axis directions.
+func shapeColumns(
+	as, bs, cs, rmins, rmaxes []float64, axisVecs [][3][3]float64,
+) ([][]float64, []string) {
+	// vecCols[3*k + d] is component d of axis k.
+	vecCols := make([][]float64, 9)
+	for k := range vecCols {
+		vecCols[k] = make([]float64, len(as))
+	}
+	bas, cas := make([]float64, len(as)), make([]float64, len(as))
+	for i := range as {
+		for k := 0; k < 3; k++ {
+			for d := 0; d < 3; d++ {
+				vecCols[3*k+d][i] = axisVecs[i][k][d]
+			}
+		}
+		bas[i], cas[i] = bs[i]/as[i], cs[i]/as[i]
+	}
+
+	cols := [][]float64{as, bs, cs, vecCols[0], vecCols[1], vecCols[2],
+		rmins, rmaxes, bas, cas, vecCols[3], vecCols[4], vecCols[5],
+		vecCols[6], vecCols[7], vecCols[8]}
+	names := []string{"Major Axis [cMpc/h]",
+		"Intermediate Axis [cMpc/h]",
+		"Minor Axis [cMpc/h]",
+		"Ax", "Ay", "Az",
+		"RMin [cMpc/h]", "RMax [cMpc/h]",
+		"b/a", "c/a", "Bx", "By", "Bz", "Cx", "Cy", "Cz",
+	}
+	return cols, names
+}
+
+// axisColumns returns the indices of the x, y, and z components of each axis
+// direction in a list of stats column names.
+func axisColumns(names []string) [][3]int {
+	out := [][3]int{}
+	for _, axis := range []string{"A", "B", "C"} {
+		idx := [3]int{-1, -1, -1}
+		for i, name := range names {
+			for k, dim := range []string{"x", "y", "z"} {
+				if name == axis+dim {
+					idx[k] = i
+				}
+			}
+		}
+		if idx[0] != -1 && idx[1] != -1 && idx[2] != -1 {
+			out = append(out, idx)
+		}
+	}
+	return out
+}
+
+// combineRepeats merges rows of a catalog with the same ID and snapshot into
+// a single row, in order of first appearance. Each column of a merged row is
+// the mean of that column over its repetitions. The columns listed in axes are
+// treated as unit vectors with arbitrary signs: they are flipped to point in
+// the same direction as the first repetition, averaged, and renormalized.
+//
+// The number of repetitions of each halo is returned along with the standard
+// deviations of the first two columns (M_sp and R_sp) across them, which are
+// NaN for halos with only one row.
+func combineRepeats(
+	ids, snaps []int, cols [][]float64, axes [][3]int,
+) (outIDs, outSnaps []int, outCols [][]float64, repeats []int,
+	sigmas [][]float64) {
+
+	groupIdx := map[[2]int]int{}
+	groups := [][]int{}
+	for i := range ids {
+		key := [2]int{ids[i], snaps[i]}
+		g, ok := groupIdx[key]
+		if !ok {
+			g = len(groups)
+			groupIdx[key] = g
+			groups = append(groups, nil)
+			outIDs, outSnaps = append(outIDs, ids[i]), append(outSnaps, snaps[i])
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	outCols = make([][]float64, len(cols))
+	for c := range cols {
+		outCols[c] = make([]float64, len(groups))
+		for g, rows := range groups {
+			for _, i := range rows {
+				outCols[c][g] += cols[c][i]
+			}
+			outCols[c][g] /= float64(len(rows))
+		}
+	}
+
+	for _, axis := range axes {
+		for g, rows := range groups {
+			ref, sum := rows[0], [3]float64{}
+			for _, i := range rows {
+				dot := 0.0
+				for k := 0; k < 3; k++ {
+					dot += cols[axis[k]][i] * cols[axis[k]][ref]
+				}
+				sign := 1.0
+				if dot < 0 {
+					sign = -1
+				}
+				for k := 0; k < 3; k++ {
+					sum[k] += sign * cols[axis[k]][i]
+				}
+			}
+			norm := math.Sqrt(sum[0]*sum[0] + sum[1]*sum[1] + sum[2]*sum[2])
+			for k := 0; k < 3; k++ {
+				outCols[axis[k]][g] = sum[k] / norm
+			}
+		}
+	}
+
+	repeats = make([]int, len(groups))
+	sigmas = [][]float64{
+		make([]float64, len(groups)), make([]float64, len(groups)),
+	}
+	for g, rows := range groups {
+		repeats[g] = len(rows)
+		for c := range sigmas {
+			xs := make([]float64, len(rows))
+			for j, i := range rows {
+				xs[j] = cols[c][i]
+			}
+			sigmas[c][g] = stdDev(xs)
+		}
+	}
+
+	return outIDs, outSnaps, outCols, repeats, sigmas
+}
+
+// stdDev returns the sample standard deviation of xs, or NaN if there are
+// fewer than two values.
+func stdDev(xs []float64) float64 {
+	if len(xs) < 2 {
+		return math.NaN()
+	}
+	mean := 0.0
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+
+	sum := 0.0
+	for _, x := range xs {
+		sum += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(sum / float64(len(xs)-1))
 }
 
 func wrapDist(x1, x2, width float64) float64 {
@@ -448,33 +1237,37 @@ func rangeSp(coeffs []float64, c *StatsConfig) (rmin, rmax float64) {
 	return shell.RadialRange(int(c.monteCarloSamples))
 }
 
+// massContained returns the mass inside the shell with the given coefficients
+// and the mass inside a sphere of radius rSphere around the same center.
 func massContained(
 	hd *io.Header, xs [][3]float32, ms []float32, coeffs []float64,
-	sphere geom.Sphere, rLow, rHigh float64, threads int64,
-) float64 {
+	sphere geom.Sphere, rLow, rHigh, rSphere float64, threads int64,
+) (mShell, mSphere float64) {
 	cpu := runtime.NumCPU()
 	if threads > 0 {
 		cpu = int(threads)
 	}
 	workers := int64(runtime.GOMAXPROCS(cpu))
-	outChan := make(chan float64, workers)
+	outChan := make(chan [2]float64, workers)
 	for i := int64(0); i < workers-1; i++ {
 		go massContainedChan(
-			hd, xs, ms, coeffs, sphere, rLow, rHigh, i, workers, outChan,
+			hd, xs, ms, coeffs, sphere, rLow, rHigh, rSphere,
+			i, workers, outChan,
 		)
 	}
 
 	massContainedChan(
-		hd, xs, ms, coeffs, sphere, rLow, rHigh,
+		hd, xs, ms, coeffs, sphere, rLow, rHigh, rSphere,
 		workers-1, workers, outChan,
 	)
 
-	sum := 0.0
 	for i := int64(0); i < workers; i++ {
-		sum += <-outChan
+		sums := <-outChan
+		mShell += sums[0]
+		mSphere += sums[1]
 	}
 
-	return sum
+	return mShell, mSphere
 }
 
 // TODO: Humans cannot remember this many parameters.
@@ -512,17 +1305,18 @@ func appendShellParticles(
 
 func massContainedChan(
 	hd *io.Header, xs [][3]float32, ms []float32, coeffs []float64,
-	sphere geom.Sphere, rLow, rHigh float64,
-	offset, workers int64, out chan float64,
+	sphere geom.Sphere, rLow, rHigh, rSphere float64,
+	offset, workers int64, out chan [2]float64,
 ) {
 	tw2 := float32(hd.TotalWidth) / 2
 
 	order := findOrder(coeffs)
 	shell := analyze.PennaFunc(coeffs, order, order, 2)
 	low2, high2 := float32(rLow*rLow), float32(rHigh*rHigh)
+	sphere2 := float32(rSphere * rSphere)
 
 	
-	sum := 0.0
+	sum, sphereSum := 0.0, 0.0
 	
 	for i := offset; i < int64(len(xs)); i += workers {
 		x, y, z := xs[i][0], xs[i][1], xs[i][2]
@@ -537,9 +1331,12 @@ func massContainedChan(
 		shell.Contains(float64(x), float64(y), float64(z))) {
 			sum += float64(ms[i])
 		}
+		if r2 < sphere2 {
+			sphereSum += float64(ms[i])
+		}
 	}
 
-	out <- sum
+	out <- [2]float64{sum, sphereSum}
 }
 
 func appendShellParticlesChan(
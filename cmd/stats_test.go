@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/los/analyze"
+)
+
+func TestCombineRepeats(t *testing.T) {
+	ids := []int{7, 3, 7, 7}
+	snaps := []int{100, 100, 100, 100}
+	cols := [][]float64{
+		{1, 10, 2, 3}, // M_sp
+		{4, 20, 4, 4}, // R_sp
+		{1, 0, -1, 1}, // Ax
+		{0, 1, 0, 0},  // Ay
+		{0, 0, 0, 0},  // Az
+	}
+
+	outIDs, outSnaps, outCols, repeats, sigmas := combineRepeats(
+		ids, snaps, cols, [][3]int{{2, 3, 4}},
+	)
+
+	if len(outIDs) != 2 || outIDs[0] != 7 || outIDs[1] != 3 ||
+		outSnaps[0] != 100 || outSnaps[1] != 100 {
+		t.Fatalf("Expected IDs [7 3], got %v.", outIDs)
+	}
+	if repeats[0] != 3 || repeats[1] != 1 {
+		t.Errorf("Expected repeats [3 1], got %v.", repeats)
+	}
+
+	expected := [][]float64{{2, 10}, {4, 20}, {1, 0}, {0, 1}, {0, 0}}
+	for c := range expected {
+		for g := range expected[c] {
+			if math.Abs(outCols[c][g]-expected[c][g]) > 1e-10 {
+				t.Errorf("Expected column %d to be %v, got %v.",
+					c, expected[c], outCols[c])
+				break
+			}
+		}
+	}
+
+	if math.Abs(sigmas[0][0]-1) > 1e-10 || sigmas[1][0] != 0 {
+		t.Errorf("Expected sigmas (1, 0) for the first halo, got (%g, %g).",
+			sigmas[0][0], sigmas[1][0])
+	}
+	if !math.IsNaN(sigmas[0][1]) || !math.IsNaN(sigmas[1][1]) {
+		t.Errorf("Expected NaN sigmas for the second halo, got (%g, %g).",
+			sigmas[0][1], sigmas[1][1])
+	}
+}
+
+func TestShapeColumns(t *testing.T) {
+	// An ellipsoid with its major, intermediate, and minor axes along y, z,
+	// and x.
+	a, b, c := 2.0, 4.0, 3.0
+	shell := analyze.Shell(func(phi, theta float64) float64 {
+		sp, cp := math.Sincos(phi)
+		st, ct := math.Sincos(theta)
+		return 1 / math.Sqrt(cp*cp*st*st/(a*a)+
+			sp*sp*st*st/(b*b)+ct*ct/(c*c))
+	})
+
+	as, bs, cs := make([]float64, 1), make([]float64, 1), make([]float64, 1)
+	axisVecs := make([][3][3]float64, 1)
+	as[0], bs[0], cs[0], axisVecs[0] = shell.PrincipalAxes(200 * 1000)
+	rmins, rmaxes := []float64{2}, []float64{4}
+
+	cols, names := shapeColumns(as, bs, cs, rmins, rmaxes, axisVecs)
+	if len(cols) != len(names) {
+		t.Fatalf("Got %d columns but %d names.", len(cols), len(names))
+	}
+	col := make(map[string]float64)
+	for i := range names {
+		col[names[i]] = cols[i][0]
+	}
+
+	tests := []struct {
+		name     string
+		expected float64
+		abs      bool
+	}{
+		{"Major Axis [cMpc/h]", 4, false},
+		{"Intermediate Axis [cMpc/h]", 3, false},
+		{"Minor Axis [cMpc/h]", 2, false},
+		{"RMin [cMpc/h]", 2, false},
+		{"RMax [cMpc/h]", 4, false},
+		{"b/a", 0.75, false},
+		{"c/a", 0.5, false},
+		{"Ax", 0, true}, {"Ay", 1, true}, {"Az", 0, true},
+		{"Bx", 0, true}, {"By", 0, true}, {"Bz", 1, true},
+		{"Cx", 1, true}, {"Cy", 0, true}, {"Cz", 0, true},
+	}
+
+	for i, test := range tests {
+		val, ok := col[test.name]
+		if !ok {
+			t.Errorf("%d) No column named %q.", i, test.name)
+			continue
+		}
+		if test.abs {
+			val = math.Abs(val)
+		}
+		tol := 0.02
+		if strings.HasSuffix(test.name, "[cMpc/h]") {
+			tol = 0.15
+		}
+		// NaNs fail every comparison, so they need to be checked for
+		// explicitly.
+		if math.IsNaN(val) || math.Abs(val-test.expected) > tol {
+			t.Errorf("%d) Expected %s = %g, got %g.",
+				i, test.name, test.expected, val)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// TagConfig contains the configuration fields for the 'tag' mode of the
+// shellfish tool.
+type TagConfig struct {
+	tagRadiusMult    float64
+	searchRadiusMult float64
+	infallRadiusMult float64
+	dir              string
+}
+
+var _ Mode = &TagConfig{}
+
+// ExampleConfig creates an example tag.config file.
+func (config *TagConfig) ExampleConfig() string {
+	return `[tag.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# The tag tool follows the particles around each input halo along the halo's
+# main branch from SnapMin to the halo's snapshot, in the same way as the orbit
+# tool, and writes three tags for every particle to Dir: the first snapshot
+# where it fell into the halo, the number of pericenters it has passed
+# through, and whether it's orbiting (i.e. has passed through at least one
+# pericenter) or is still on its first infall. Files are named
+# tags_<snap>_<id>.bin and can be read with io.ReadParticleTags. Like the orbit
+# tool, this requires reading every snapshot.
+
+# TagRadiusMult sets which particles are tagged: those within
+# TagRadiusMult*R200m of the halo at its final snapshot. Defaults to 2.
+#
+# TagRadiusMult = 2
+
+# SearchRadiusMult is the radius, in units of R200m, around the halo's main
+# progenitor that tagged particles are looked for in each snapshot. Particles
+# further away than this are assumed to be infalling. Must be at least as
+# large as TagRadiusMult. Defaults to 4.
+#
+# SearchRadiusMult = 4
+
+# InfallRadiusMult is the radius, in units of R200m, that a particle must come
+# within for it to have fallen into the main progenitor. Defaults to 1.
+#
+# InfallRadiusMult = 1
+
+# Dir is the directory that tag files are written to. Defaults to the current
+# directory.
+#
+# Dir = .`
+}
+
+// ReadConfig reads in a tag.config file into config.
+func (config *TagConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("tag.config")
+	vars.Float(&config.tagRadiusMult, "TagRadiusMult", 2)
+	vars.Float(&config.searchRadiusMult, "SearchRadiusMult", 4)
+	vars.Float(&config.infallRadiusMult, "InfallRadiusMult", 1)
+	vars.String(&config.dir, "Dir", ".")
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *TagConfig) validate() error {
+	if config.tagRadiusMult <= 0 {
+		return fmt.Errorf("The 'TagRadiusMult' variable is set to %g, "+
+			"but it needs to be positive.", config.tagRadiusMult)
+	}
+	if config.searchRadiusMult < config.tagRadiusMult {
+		return fmt.Errorf("The 'SearchRadiusMult' variable is set to %g, "+
+			"but it can't be smaller than 'TagRadiusMult', %g.",
+			config.searchRadiusMult, config.tagRadiusMult)
+	}
+	if config.infallRadiusMult <= 0 {
+		return fmt.Errorf("The 'InfallRadiusMult' variable is set to %g, "+
+			"but it needs to be positive.", config.infallRadiusMult)
+	}
+	return nil
+}
+
+// Run executes the tag mode of the shellfish tool.
+func (config *TagConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+###################
+## shellfish tag ##
+###################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, _, err := catalog.Parse(stdin, []int{0, 1}, []int{})
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := intCols[0], intCols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	taggers := make([]*halo.ParticleTagger, len(ids))
+	_, err = followParticles(
+		ids, snaps, config.tagRadiusMult, config.searchRadiusMult,
+		vars, buf, e, gConfig,
+		func(i int, pIDs []int64) {
+			taggers[i] = halo.NewParticleTagger(
+				pIDs, config.infallRadiusMult,
+			)
+		},
+		func(i, snap int, pIDs []int64, pRs []float64, r200m float64) {
+			taggers[i].Update(snap, pIDs, pRs, r200m)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	particles := make([]int, len(ids))
+	orbiting := make([]int, len(ids))
+	for i := range ids {
+		if taggers[i] == nil {
+			continue
+		}
+		tags := taggers[i].Tags(ids[i], snaps[i])
+		particles[i] = len(tags.IDs)
+		for _, orb := range tags.Orbiting {
+			if orb {
+				orbiting[i]++
+			}
+		}
+
+		fname := path.Join(config.dir, fmt.Sprintf(
+			"tags_%d_%d.bin", snaps[i], ids[i],
+		))
+		f, err := os.Create(fname)
+		if err != nil {
+			return nil, err
+		}
+		err = io.WriteParticleTags(f, tags)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order := []int{0, 1, 2, 3}
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps, particles, orbiting}, [][]float64{}, order,
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot", "Particles", "Orbiting"}, []string{},
+		order, []int{1, 1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
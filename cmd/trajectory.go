@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// TrajectoryConfig contains the configuration fields for the 'trajectory'
+// mode of the shellfish tool.
+type TrajectoryConfig struct {
+	snapStride int64
+}
+
+var _ Mode = &TrajectoryConfig{}
+
+// ExampleConfig creates an example trajectory.config file.
+func (config *TrajectoryConfig) ExampleConfig() string {
+	return `[trajectory.config]
+
+#####################
+## Optional Fields ##
+#####################
+
+# SnapStride is the spacing between output snapshots. Snapshots are counted
+# from SnapMax, so SnapMax is always included if the halo exists then.
+# Defaults to 1 if not set.
+#
+# SnapStride = 1`
+}
+
+// ReadConfig reads in a trajectory.config file into config.
+func (config *TrajectoryConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("trajectory.config")
+	vars.Int(&config.snapStride, "SnapStride", 1)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return nil
+		}
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+	if err := parse.ReadConfig(fname, vars); err != nil {
+		return err
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	return config.validate()
+}
+
+// validate checks whether all the fields of config are valid.
+func (config *TrajectoryConfig) validate() error {
+	if config.snapStride <= 0 {
+		return fmt.Errorf("The 'SnapStride' variable is set to %d, but it "+
+			"needs to be positive.", config.snapStride)
+	}
+	return nil
+}
+
+// Run executes the trajectory mode of the shellfish tool.
+func (config *TrajectoryConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+##########################
+## shellfish trajectory ##
+##########################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	intCols, _, err := catalog.Parse(stdin, []int{0, 1}, []int{})
+	if err != nil {
+		return nil, err
+	}
+	inputIDs, inputSnaps := []int{}, []int{}
+	for i := range intCols[0] {
+		if intCols[1][i] != -1 {
+			inputIDs = append(inputIDs, intCols[0][i])
+			inputSnaps = append(inputSnaps, intCols[1][i])
+		}
+	}
+	if len(inputIDs) == 0 {
+		return nil, fmt.Errorf("No input IDs.")
+	}
+
+	vars, err := haloVarColumns(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range []string{"Vx", "Vy", "Vz"} {
+		if _, ok := vars.ColumnLookup[v]; !ok {
+			return nil, fmt.Errorf("trajectory mode requires '%s', but "+
+				"it isn't in HaloValueNames.", v)
+		}
+	}
+	buf, err := getVectorBuffer(
+		e.ParticleCatalog(inputSnaps[0], 0), gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	trees, err := treeFiles(gConfig)
+	if err != nil {
+		return nil, err
+	}
+	idSets, snapSets, err := haloHistories(trees, inputIDs, gConfig, e)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, snaps, rootIDs := []int{}, []int{}, []int{}
+	for i := range idSets {
+		for j := range idSets[i] {
+			snap := snapSets[i][j]
+			if snap < int(gConfig.SnapMin) || snap > int(gConfig.SnapMax) ||
+				(int(gConfig.SnapMax)-snap)%int(config.snapStride) != 0 {
+				continue
+			}
+			ids = append(ids, idSets[i][j])
+			snaps = append(snaps, snap)
+			rootIDs = append(rootIDs, inputIDs[i])
+		}
+	}
+
+	cols, err := readHaloCoords(
+		ids, snaps, []string{"X", "Y", "Z", "Vx", "Vy", "Vz"},
+		vars, buf, e, gConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	scales := make([]float64, len(ids))
+	for i := range scales {
+		hd, err := snapHeader(snaps[i], buf, e)
+		if err != nil {
+			return nil, err
+		}
+		scales[i] = 1 / (1 + hd.Cosmo.Z)
+	}
+
+	fCols := append([][]float64{scales}, cols...)
+	order := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	lines := catalog.FormatCols([][]int{ids, snaps, rootIDs}, fCols, order)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot", "RootID"},
+		[]string{"Scale", "X [cMpc/h]", "Y [cMpc/h]", "Z [cMpc/h]",
+			"Vx [km/s]", "Vy [km/s]", "Vz [km/s]"},
+		order, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
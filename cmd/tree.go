@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"path"
@@ -14,7 +15,10 @@ import (
 )
 
 type TreeConfig struct {
-	selectSnaps []int64
+	selectSnaps     []int64
+	mainProgenitors    bool
+	descendants        bool
+	extrapolateOrphans bool
 }
 
 var _ Mode = &TreeConfig{}
@@ -29,12 +33,42 @@ func (config *TreeConfig) ExampleConfig() string {
 # SelectSnaps is a list of all the snapshots which halo IDs should be
 # output at. If not set, IDs will be output at all snapshots.
 #
-# SelectSnaps = 36, 47, 64, 77, 87, 100`
+# SelectSnaps = 36, 47, 64, 77, 87, 100
+
+# MainProgenitors restricts the output to each input halo and its main
+# progenitors (i.e. no descendants) and adds a RootID column giving the input
+# halo that each row belongs to. No sentinel rows are written between halos,
+# so the output can be piped directly into coord and shell to follow the
+# evolution of each halo between SnapMin and SnapMax. Defaults to false.
+#
+# MainProgenitors = false
+
+# Descendants is the forward-in-time counterpart of MainProgenitors: the output
+# is restricted to each input halo and its descendants, so a high-redshift halo
+# can be followed to the present day. A RootID column is added and no sentinel
+# rows are written, just like with MainProgenitors. The two options can't both
+# be set. Defaults to false.
+#
+# Descendants = false
+
+# ExtrapolateOrphans can only be used alongside Descendants. If the halo
+# finder loses a halo before SnapMax, its track is normally truncated. If this
+# is set, rows are instead added for every later snapshot using the ID of the
+# last halo in the branch, and an Extrapolated column is added. Extrapolated is
+# -1 for halos found in the tree and is the snapshot where the halo was last
+# seen otherwise. coord uses this column to extrapolate positions from the last
+# known positions and velocities, so Vx, Vy, and Vz must be in HaloValueNames.
+# Defaults to false.
+#
+# ExtrapolateOrphans = false`
 }
 
 func (config *TreeConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("tree.config")
 	vars.Ints(&config.selectSnaps, "SelectSnaps", []int64{})
+	vars.Bool(&config.mainProgenitors, "MainProgenitors", false)
+	vars.Bool(&config.descendants, "Descendants", false)
+	vars.Bool(&config.extrapolateOrphans, "ExtrapolateOrphans", false)
 
 	if fname == "" {
 		if len(flags) == 0 {
@@ -57,7 +91,18 @@ func (config *TreeConfig) ReadConfig(fname string, flags []string) error {
 	return config.validate()
 }
 
-func (config *TreeConfig) validate() error { return nil }
+func (config *TreeConfig) validate() error {
+	if config.mainProgenitors && config.descendants {
+		return fmt.Errorf("The 'MainProgenitors' and 'Descendants' " +
+			"variables are both set to true, but only one branch " +
+			"direction can be output at a time.")
+	}
+	if config.extrapolateOrphans && !config.descendants {
+		return fmt.Errorf("The 'ExtrapolateOrphans' variable is set to " +
+			"true, but 'Descendants' isn't.")
+	}
+	return nil
+}
 
 func (config *TreeConfig) Run(
 	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
@@ -85,13 +130,29 @@ func (config *TreeConfig) Run(
 		return nil, err
 	}
 
-	idSets, snapSets, err := tree.HaloHistories(
-		trees, inputIDs, e.SnapOffset(),
+	idSets, snapSets, err := haloHistories(
+		trees, inputIDs, gConfig, e,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.mainProgenitors || config.descendants {
+		lines, cString, err := config.branchLines(
+			inputIDs, idSets, snapSets, gConfig,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if logging.Mode == logging.Performance {
+			log.Printf("Time: %s", time.Since(t).String())
+			log.Printf("Memory:\n%s", logging.MemString())
+		}
+
+		return append([]string{cString}, lines...), nil
+	}
+
 	ids, snaps := []int{}, []int{}
 	for i := range idSets {
 		ids = append(ids, idSets[i]...)
@@ -108,18 +169,8 @@ func (config *TreeConfig) Run(
 	)
 	fLines := []string{}
 	for i := range lines {
-		if snaps[i] >= int(gConfig.SnapMin) &&
-			snaps[i] <= int(gConfig.SnapMax) {
-
-			if len(config.selectSnaps) > 0 {
-				for j := range config.selectSnaps {
-					if int(config.selectSnaps[j]) == snaps[i] {
-						fLines = append(fLines, lines[i])
-					}
-				}
-			} else {
-				fLines = append(fLines, lines[i])
-			}
+		if config.includeSnap(snaps[i], gConfig) {
+			fLines = append(fLines, lines[i])
 		}
 	}
 
@@ -135,6 +186,108 @@ func (config *TreeConfig) Run(
 	return append([]string{cString}, fLines...), nil
 }
 
+// branchLines formats the (ID, Snapshot, RootID) rows of the main progenitors
+// or descendants of each root halo that fall within the requested snapshots,
+// along with the corresponding comment string.
+func (config *TreeConfig) branchLines(
+	roots []int, idSets, snapSets [][]int, gConfig *GlobalConfig,
+) (lines []string, cString string, err error) {
+	ids, snaps, rootIDs, lastSnaps := []int{}, []int{}, []int{}, []int{}
+	for i := range idSets {
+		// Histories are ordered from earliest to latest, so everything
+		// before the root is a progenitor and everything after it is a
+		// descendant.
+		rootIdx := -1
+		for j := range idSets[i] {
+			if idSets[i][j] == roots[i] {
+				rootIdx = j
+				break
+			}
+		}
+		if rootIdx == -1 {
+			return nil, "", fmt.Errorf("The halo with ID %d isn't in its "+
+				"own merger tree history.", roots[i])
+		}
+		start, end := 0, rootIdx+1
+		if config.descendants {
+			start, end = rootIdx, len(idSets[i])
+		}
+
+		for j := start; j < end; j++ {
+			snap := snapSets[i][j]
+			if config.includeSnap(snap, gConfig) {
+				ids = append(ids, idSets[i][j])
+				snaps = append(snaps, snap)
+				rootIDs = append(rootIDs, roots[i])
+				lastSnaps = append(lastSnaps, -1)
+			}
+		}
+
+		if !config.extrapolateOrphans {
+			continue
+		}
+		// The halo finder lost this halo, so continue the track with the
+		// last halo in the branch.
+		lastID, lastSnap := idSets[i][end-1], snapSets[i][end-1]
+		for snap := lastSnap + 1; snap <= int(gConfig.SnapMax); snap++ {
+			if config.includeSnap(snap, gConfig) {
+				ids = append(ids, lastID)
+				snaps = append(snaps, snap)
+				rootIDs = append(rootIDs, roots[i])
+				lastSnaps = append(lastSnaps, lastSnap)
+			}
+		}
+	}
+
+	if config.extrapolateOrphans {
+		lines = catalog.FormatCols(
+			[][]int{ids, snaps, rootIDs, lastSnaps}, [][]float64{},
+			[]int{0, 1, 2, 3},
+		)
+		cString = catalog.CommentString(
+			[]string{"ID", "Snapshot", "RootID", "Extrapolated"},
+			[]string{}, []int{0, 1, 2, 3}, []int{1, 1, 1, 1},
+		)
+		return lines, cString, nil
+	}
+
+	lines = catalog.FormatCols(
+		[][]int{ids, snaps, rootIDs}, [][]float64{}, []int{0, 1, 2},
+	)
+	cString = catalog.CommentString(
+		[]string{"ID", "Snapshot", "RootID"}, []string{},
+		[]int{0, 1, 2}, []int{1, 1, 1},
+	)
+	return lines, cString, nil
+}
+
+// includeSnap returns true if rows at the given snapshot should be output.
+func (config *TreeConfig) includeSnap(snap int, gConfig *GlobalConfig) bool {
+	if snap < int(gConfig.SnapMin) || snap > int(gConfig.SnapMax) {
+		return false
+	}
+	if len(config.selectSnaps) == 0 {
+		return true
+	}
+	for j := range config.selectSnaps {
+		if int(config.selectSnaps[j]) == snap {
+			return true
+		}
+	}
+	return false
+}
+
+// haloHistories returns the main branches of the given halos using whichever
+// tree reader is specified by the TreeType variable.
+func haloHistories(
+	trees []string, ids []int, gConfig *GlobalConfig, e *env.Environment,
+) (idSets, snapSets [][]int, err error) {
+	if gConfig.TreeType == "consistent-trees-text" {
+		return tree.TextHaloHistories(trees, ids, e.SnapOffset())
+	}
+	return tree.HaloHistories(trees, ids, e.SnapOffset())
+}
+
 func treeFiles(gConfig *GlobalConfig) ([]string, error) {
 	infos, err := ioutil.ReadDir(gConfig.TreeDir)
 	if err != nil {
@@ -150,5 +303,9 @@ func treeFiles(gConfig *GlobalConfig) ([]string, error) {
 			names = append(names, path.Join(gConfig.TreeDir, name))
 		}
 	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No tree_*.dat files in the TreeDir %s.",
+			gConfig.TreeDir)
+	}
 	return names, nil
 }
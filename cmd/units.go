@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+// comovingUnits are the units which Shellfish uses internally. Lengths are in
+// cMpc/h and masses are in Msun/h.
+const comovingUnits = "cMpc/h"
+
+// unitKind is the dimension of a catalog column.
+type unitKind int
+
+const (
+	dimensionless unitKind = iota
+	lengthUnit
+	areaUnit
+	volumeUnit
+	massUnit
+	densityUnit
+	// surfaceDensityUnit is always labeled in parsecs, since that's what
+	// lensing measurements use.
+	surfaceDensityUnit
+	numberDensityUnit
+)
+
+// physicalMpcs is the length of each non-comoving unit in physical Mpc.
+var physicalMpcs = map[string]float64{"pMpc": 1, "pkpc": 1e-3}
+
+// comovingLabels are the labels that columns of each kind are given in
+// comovingUnits.
+var comovingLabels = map[unitKind]string{
+	lengthUnit:         "cMpc/h",
+	areaUnit:           "cMpc^2/h^2",
+	volumeUnit:         "cMpc^3/h^3",
+	massUnit:           "M_sun/h",
+	densityUnit:        "h^2 Msun/cMpc^3",
+	surfaceDensityUnit: "h Msun/cpc^2",
+	numberDensityUnit:  "h^3/cMpc^3",
+}
+
+// unitLabel returns the label of a column of the given kind when written in
+// the given units.
+func unitLabel(units string, kind unitKind) string {
+	if units == comovingUnits || kind == dimensionless {
+		return comovingLabels[kind]
+	}
+
+	switch kind {
+	case lengthUnit:
+		return units
+	case areaUnit:
+		return units + "^2"
+	case volumeUnit:
+		return units + "^3"
+	case massUnit:
+		return "M_sun"
+	case densityUnit:
+		return "Msun/" + units + "^3"
+	case surfaceDensityUnit:
+		return "Msun/pc^2"
+	case numberDensityUnit:
+		return "1/" + units + "^3"
+	}
+	panic("Impossible")
+}
+
+// relabelColumns replaces the comoving unit labels at the end of column names
+// like "R_sp [cMpc/h]" with the labels used by the given units.
+func relabelColumns(units string, names []string) {
+	for i := range names {
+		kind, base := labelKind(names[i])
+		if kind != dimensionless {
+			names[i] = fmt.Sprintf("%s [%s]", base, unitLabel(units, kind))
+		}
+	}
+}
+
+// labelKinds returns the kind of each named column, as given by the comoving
+// unit label at the end of its name.
+func labelKinds(names []string) []unitKind {
+	kinds := make([]unitKind, len(names))
+	for i := range names {
+		kinds[i], _ = labelKind(names[i])
+	}
+	return kinds
+}
+
+// labelKind splits a column name into its comoving unit label and the rest
+// of the name. Columns without a recognized label are dimensionless.
+func labelKind(name string) (unitKind, string) {
+	for kind, label := range comovingLabels {
+		suffix := " [" + label + "]"
+		if strings.HasSuffix(name, suffix) {
+			return kind, name[:len(name)-len(suffix)]
+		}
+	}
+	return dimensionless, name
+}
+
+// unitConverter converts columns between comovingUnits and the units of an
+// input or output catalog. Conversion factors depend on the redshift and
+// Hubble constant of each row's snapshot.
+type unitConverter struct {
+	units string
+	// lengths and masses map snapshots to the factors which convert
+	// comovingUnits to units.
+	lengths, masses map[int]float64
+}
+
+// newUnitConverter creates a unitConverter which can convert rows from any of
+// the given snapshots.
+func newUnitConverter(
+	units string, snaps []int, buf io.VectorBuffer, e *env.Environment,
+) (*unitConverter, error) {
+	uc := &unitConverter{
+		units: units, lengths: map[int]float64{}, masses: map[int]float64{},
+	}
+	if units == comovingUnits {
+		return uc, nil
+	}
+
+	for _, snap := range snaps {
+		if _, ok := uc.lengths[snap]; ok || snap == -1 {
+			continue
+		}
+		hd, err := snapHeader(snap, buf, e)
+		if err != nil {
+			return nil, err
+		}
+		uc.lengths[snap] = 1 / halo.UnitConversionFactor(units, &hd.Cosmo)
+		uc.masses[snap] = 1 / hd.Cosmo.H100
+	}
+
+	return uc, nil
+}
+
+// factor returns the number which converts a value of the given kind from
+// comovingUnits to the converter's units at the given snapshot.
+func (uc *unitConverter) factor(snap int, kind unitKind) float64 {
+	if uc.units == comovingUnits || snap == -1 {
+		return 1
+	}
+
+	l, m := uc.lengths[snap], uc.masses[snap]
+	switch kind {
+	case lengthUnit:
+		return l
+	case areaUnit:
+		return l * l
+	case volumeUnit:
+		return l * l * l
+	case massUnit:
+		return m
+	case densityUnit:
+		return m / (l * l * l)
+	case surfaceDensityUnit:
+		lp := l * physicalMpcs[uc.units]
+		return m / (lp * lp)
+	case numberDensityUnit:
+		return 1 / (l * l * l)
+	}
+	return 1
+}
+
+// convert converts cols in place from comovingUnits to the converter's units.
+// Each column has a kind, and each row has a snapshot.
+func (uc *unitConverter) convert(
+	snaps []int, cols [][]float64, kinds []unitKind,
+) {
+	for i := range cols {
+		for j := range cols[i] {
+			cols[i][j] *= uc.factor(snaps[j], kinds[i])
+		}
+	}
+}
+
+// unconvert converts cols in place from the converter's units back to
+// comovingUnits.
+func (uc *unitConverter) unconvert(
+	snaps []int, cols [][]float64, kinds []unitKind,
+) {
+	for i := range cols {
+		for j := range cols[i] {
+			cols[i][j] /= uc.factor(snaps[j], kinds[i])
+		}
+	}
+}
+
+// unitsString returns the header line which records the converter's units.
+func (uc *unitConverter) unitsString() string {
+	return catalog.UnitsString(uc.units)
+}
+
+// readInputUnits converts the columns of an input catalog to comovingUnits,
+// using the units recorded in its header. Catalogs without a header are
+// assumed to already be in comovingUnits.
+func readInputUnits(
+	stdin []byte, snaps []int, cols [][]float64, kinds []unitKind,
+	buf io.VectorBuffer, e *env.Environment,
+) error {
+	units := catalog.Units(stdin)
+	if units == "" || units == comovingUnits {
+		return nil
+	}
+	if err := validateUnits(units); err != nil {
+		return fmt.Errorf("The input catalog's units are '%s', but %s",
+			units, err.Error())
+	}
+
+	uc, err := newUnitConverter(units, snaps, buf, e)
+	if err != nil {
+		return err
+	}
+	uc.unconvert(snaps, cols, kinds)
+	return nil
+}
+
+// validateUnits returns an error if units isn't supported as output units.
+func validateUnits(units string) error {
+	switch units {
+	case "cMpc/h", "pMpc", "pkpc":
+		return nil
+	}
+	return fmt.Errorf("the only supported units are cMpc/h, pMpc, and pkpc.")
+}
+
+// repeatKind returns n copies of kind.
+func repeatKind(kind unitKind, n int) []unitKind {
+	kinds := make([]unitKind, n)
+	for i := range kinds {
+		kinds[i] = kind
+	}
+	return kinds
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRelabelColumns(t *testing.T) {
+	names := []string{"R_sp [cMpc/h]", "M_sp [M_sun/h]",
+		"Volume [cMpc^3/h^3]", "Rho [h^2 Msun/cMpc^3]", "b/a",
+		"Sigma [h Msun/cpc^2]", "n_sub [h^3/cMpc^3]"}
+	tests := []struct {
+		units    string
+		expected []string
+	}{
+		{"cMpc/h", names},
+		{"pkpc", []string{"R_sp [pkpc]", "M_sp [M_sun]",
+			"Volume [pkpc^3]", "Rho [Msun/pkpc^3]", "b/a",
+			"Sigma [Msun/pc^2]", "n_sub [1/pkpc^3]"}},
+	}
+
+	for i, test := range tests {
+		out := append([]string{}, names...)
+		relabelColumns(test.units, out)
+		for j := range out {
+			if out[j] != test.expected[j] {
+				t.Errorf("%d) Expected %v, got %v.", i, test.expected, out)
+				break
+			}
+		}
+	}
+}
+
+func TestUnitConverter(t *testing.T) {
+	// At z = 1 with h = 0.5, 1 cMpc/h is 1 pMpc and 1 Msun/h is 2 Msun.
+	uc := &unitConverter{
+		units:   "pMpc",
+		lengths: map[int]float64{10: 1.0, 20: 0.5},
+		masses:  map[int]float64{10: 2.0, 20: 2.0},
+	}
+
+	snaps := []int{10, 20, -1}
+	cols := [][]float64{
+		{1, 1, 1}, {1, 1, 1}, {1, 1, 1}, {1, 1, 1}, {1, 1, 1},
+	}
+	kinds := []unitKind{
+		lengthUnit, densityUnit, dimensionless, surfaceDensityUnit,
+		numberDensityUnit,
+	}
+	expected := [][]float64{
+		{1, 0.5, 1}, {2, 16, 1}, {1, 1, 1}, {2, 8, 1}, {1, 8, 1},
+	}
+
+	uc.convert(snaps, cols, kinds)
+	for i := range cols {
+		for j := range cols[i] {
+			if math.Abs(cols[i][j]-expected[i][j]) > 1e-10 {
+				t.Errorf("Expected converted columns %v, got %v.",
+					expected, cols)
+			}
+		}
+	}
+
+	uc.unconvert(snaps, cols, kinds)
+	for i := range cols {
+		for j := range cols[i] {
+			if math.Abs(cols[i][j]-1) > 1e-10 {
+				t.Errorf("Expected unconverted columns of 1, got %v.", cols)
+			}
+		}
+	}
+}
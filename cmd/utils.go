@@ -2,11 +2,26 @@ package cmd
 
 import (
 	"fmt"
+	"sync"
+
 	"github.com/phil-mansfield/shellfish/io"
 )
 
+// getVectorBuffer returns a buffer which reads the particles in files of the
+// given snapshot type. If particleCache has been set, the buffer reads
+// through it.
 func getVectorBuffer(
 	fname string, config *GlobalConfig,
+) (io.VectorBuffer, error) {
+	buf, err := newVectorBuffer(fname, config)
+	if err != nil || particleCache == nil {
+		return buf, err
+	}
+	return &cachingBuffer{VectorBuffer: buf, cache: particleCache}, nil
+}
+
+func newVectorBuffer(
+	fname string, config *GlobalConfig,
 ) (io.VectorBuffer, error) {
 	context := io.Context{
 		LGadgetNPartNum: config.LGadgetNpartNum,
@@ -44,6 +59,163 @@ func getVectorBuffer(
 	)
 }
 
+// particleCache is the cache used by every buffer returned by
+// getVectorBuffer, or nil if particles aren't cached. The serve mode sets it
+// so that particle files aren't re-read by every request.
+var particleCache *particleFileCache
+
+// particleFileCache keeps the particles of recently read files in memory.
+// When the cached particles would take up more than capBytes, the least
+// recently used files are dropped. If capBytes isn't positive, nothing is
+// dropped.
+type particleFileCache struct {
+	sync.Mutex
+	capBytes, bytes int64
+	files           map[string]*cachedParticles
+	// lru lists the names of the cached files, least recently used first.
+	lru []string
+}
+
+// cachedParticles are the contents of a single cached file.
+type cachedParticles struct {
+	xs, vs  [][3]float32
+	ms      []float32
+	ids     []int64
+	minMass float32
+	bytes   int64
+}
+
+func newParticleFileCache(capBytes int64) *particleFileCache {
+	return &particleFileCache{
+		capBytes: capBytes, files: map[string]*cachedParticles{},
+	}
+}
+
+// particleBytes returns the memory used by a file's particles.
+func particleBytes(
+	xs, vs [][3]float32, ms []float32, ids []int64,
+) int64 {
+	return int64(12*len(xs) + 12*len(vs) + 4*len(ms) + 8*len(ids))
+}
+
+// fits returns true if a file which uses the given number of bytes can be
+// cached.
+func (c *particleFileCache) fits(bytes int64) bool {
+	return c.capBytes <= 0 || bytes <= c.capBytes
+}
+
+// get returns the cached particles of fname, if there are any, and marks
+// them as the most recently used.
+func (c *particleFileCache) get(fname string) (*cachedParticles, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	p, ok := c.files[fname]
+	if ok {
+		c.touch(fname)
+	}
+	return p, ok
+}
+
+// add caches the particles of fname, dropping the least recently used files
+// until they fit.
+func (c *particleFileCache) add(fname string, p *cachedParticles) {
+	c.Lock()
+	defer c.Unlock()
+
+	if old, ok := c.files[fname]; ok {
+		c.bytes -= old.bytes
+		c.touch(fname)
+	} else {
+		c.lru = append(c.lru, fname)
+	}
+	c.files[fname] = p
+	c.bytes += p.bytes
+
+	for c.capBytes > 0 && c.bytes > c.capBytes && c.lru[0] != fname {
+		c.bytes -= c.files[c.lru[0]].bytes
+		delete(c.files, c.lru[0])
+		c.lru = c.lru[1:]
+	}
+}
+
+// touch moves fname to the end of c.lru.
+func (c *particleFileCache) touch(fname string) {
+	for i := range c.lru {
+		if c.lru[i] == fname {
+			c.lru = append(append(c.lru[:i:i], c.lru[i+1:]...), fname)
+			return
+		}
+	}
+}
+
+// cachingBuffer is a VectorBuffer which reads files through a
+// particleFileCache. Like other buffers, it returns arrays which it reuses on
+// the next call to Read, so callers can modify them without touching the
+// cache.
+type cachingBuffer struct {
+	io.VectorBuffer
+	cache *particleFileCache
+	// open is true if the last file was read by the underlying buffer,
+	// which still holds its particles.
+	open bool
+	last *cachedParticles
+
+	xs, vs [][3]float32
+	ms     []float32
+	ids    []int64
+}
+
+func (buf *cachingBuffer) Read(fname string) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	if p, ok := buf.cache.get(fname); ok {
+		buf.last = p
+		buf.xs = append(buf.xs[:0], p.xs...)
+		buf.vs = append(buf.vs[:0], p.vs...)
+		buf.ms = append(buf.ms[:0], p.ms...)
+		buf.ids = append(buf.ids[:0], p.ids...)
+		return buf.xs, buf.vs, buf.ms, buf.ids, nil
+	}
+
+	xs, vs, ms, ids, err = buf.VectorBuffer.Read(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	buf.open, buf.last = true, nil
+
+	bytes := particleBytes(xs, vs, ms, ids)
+	if buf.cache.fits(bytes) {
+		// The underlying buffer reuses its arrays, so they need to be copied.
+		buf.last = &cachedParticles{
+			xs:      append([][3]float32(nil), xs...),
+			vs:      append([][3]float32(nil), vs...),
+			ms:      append([]float32(nil), ms...),
+			ids:     append([]int64(nil), ids...),
+			minMass: buf.VectorBuffer.MinMass(),
+			bytes:   bytes,
+		}
+		buf.cache.add(fname, buf.last)
+	}
+	return xs, vs, ms, ids, nil
+}
+
+func (buf *cachingBuffer) Close() {
+	if buf.open {
+		buf.VectorBuffer.Close()
+		buf.open = false
+	}
+}
+
+func (buf *cachingBuffer) IsOpen() bool { return buf.open }
+
+func (buf *cachingBuffer) MinMass() float32 {
+	if buf.last != nil {
+		return buf.last.minMass
+	}
+	return buf.VectorBuffer.MinMass()
+}
+
 // How to use:
 //
 // lg := NewLockGroup(workers)
@@ -36,3 +36,24 @@ func RhoCritical(H0, omegaM, omegaL, z float64) float64 {
 func RhoAverage(H0, omegaM, omegaL, z float64) float64 {
 	return RhoCritical(H0, omegaM, omegaL, 0) * omegaM * math.Pow(1+z, 3.0)
 }
+
+// Age calculates the age of a flat universe at scale factor a in units of
+// 1/H0. Radiation is ignored.
+func Age(omegaM, omegaL, a float64) float64 {
+	return 2 / (3 * math.Sqrt(omegaL)) *
+		math.Asinh(math.Sqrt(omegaL/omegaM)*math.Pow(a, 1.5))
+}
+
+// DynamicalTime calculates the crossing time, 2 R200m / V200m, of a halo at
+// scale factor a in units of 1/H0. This is independent of the halo's mass.
+func DynamicalTime(omegaM, a float64) float64 {
+	return math.Pow(a, 1.5) / (5 * math.Sqrt(omegaM))
+}
+
+// VirialOverdensity calculates the Bryan & Norman (1998) virial overdensity
+// relative to the critical density of a flat universe at redshift z.
+func VirialOverdensity(omegaM, omegaL, z float64) float64 {
+	h := HubbleFrac(omegaM, omegaL, z)
+	x := omegaM*math.Pow(1+z, 3)/(h*h) - 1
+	return 18*math.Pi*math.Pi + 82*x - 39*x*x
+}
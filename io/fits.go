@@ -0,0 +1,103 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// fitsBlock is the size of a FITS block. Both the header and the data must be
+// padded to a multiple of it.
+const fitsBlock = 2880
+
+// FITSCard is a single keyword in a FITS header. Value must be a string,
+// bool, int, or float64.
+type FITSCard struct {
+	Key     string
+	Value   interface{}
+	Comment string
+}
+
+// WriteFITSImage writes a 2D image to wr as a FITS file with a single primary
+// HDU of 32-bit floats. img is stored in row-major order with nx columns and
+// ny rows, so that img[x + y*nx] is pixel (x + 1, y + 1) in FITS's 1-indexed
+// convention. cards are added to the header after the mandatory keywords.
+func WriteFITSImage(
+	wr io.Writer, img []float32, nx, ny int, cards []FITSCard,
+) error {
+	if len(img) != nx*ny {
+		return fmt.Errorf("An image with shape (%d, %d) was given %d "+
+			"pixels.", nx, ny, len(img))
+	}
+
+	header := []FITSCard{
+		{"SIMPLE", true, "conforms to FITS standard"},
+		{"BITPIX", -32, "32-bit floating point"},
+		{"NAXIS", 2, "number of axes"},
+		{"NAXIS1", nx, "pixels along x"},
+		{"NAXIS2", ny, "pixels along y"},
+	}
+	header = append(header, cards...)
+
+	buf := &bytes.Buffer{}
+	for _, card := range header {
+		s, err := formatFITSCard(card)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(s)
+	}
+	buf.WriteString(fmt.Sprintf("%-80s", "END"))
+	padFITS(buf, ' ')
+
+	if err := binary.Write(buf, binary.BigEndian, img); err != nil {
+		return err
+	}
+	padFITS(buf, 0)
+
+	_, err := wr.Write(buf.Bytes())
+	return err
+}
+
+// formatFITSCard formats a header keyword as an 80 character card.
+func formatFITSCard(card FITSCard) (string, error) {
+	if len(card.Key) > 8 || strings.ToUpper(card.Key) != card.Key {
+		return "", fmt.Errorf("'%s' isn't a valid FITS keyword.", card.Key)
+	}
+
+	var val string
+	switch v := card.Value.(type) {
+	case string:
+		val = fmt.Sprintf("'%-8s'", strings.Replace(v, "'", "''", -1))
+	case bool:
+		val = fmt.Sprintf("%20s", "F")
+		if v {
+			val = fmt.Sprintf("%20s", "T")
+		}
+	case int:
+		val = fmt.Sprintf("%20d", v)
+	case float64:
+		val = fmt.Sprintf("%20.12G", v)
+	default:
+		return "", fmt.Errorf("The FITS keyword %s has unsupported type %T.",
+			card.Key, card.Value)
+	}
+
+	s := fmt.Sprintf("%-8s= %s", card.Key, val)
+	if card.Comment != "" {
+		s += " / " + card.Comment
+	}
+	if len(s) > 80 {
+		s = s[:80]
+	}
+	return fmt.Sprintf("%-80s", s), nil
+}
+
+// padFITS pads buf to a multiple of fitsBlock with the given byte.
+func padFITS(buf *bytes.Buffer, b byte) {
+	if n := buf.Len() % fitsBlock; n != 0 {
+		buf.Write(bytes.Repeat([]byte{b}, fitsBlock-n))
+	}
+}
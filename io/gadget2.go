@@ -351,10 +351,58 @@ func NewGadget2Buffer(
 	if err != nil {
 		return nil, err
 	}
+	buf.mass, err = buf.minDMMass(path)
+	if err != nil {
+		return nil, err
+	}
 
 	return buf, nil
 }
 
+// minDMMass returns the smallest dark matter particle mass in the simulation.
+// It's taken from the header's mass table, which describes every file, so it
+// doesn't depend on which files have been read. Dark matter types with
+// individual particle masses (like the low-resolution particles in zoom-in
+// simulations) are assumed to be heavier than the types in the mass table. If
+// no dark matter type is in the mass table, the particles in the file at path
+// are used instead.
+func (buf *Gadget2Buffer) minDMMass(path string) (float32, error) {
+	if m, ok := minTableMass(&buf.hd, &buf.context); ok {
+		return m, nil
+	}
+
+	_, _, ms, _, err := buf.Read(path)
+	buf.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	min := float32(0)
+	for _, m := range ms {
+		if m > 0 && (min == 0 || m < min) {
+			min = m
+		}
+	}
+	return min, nil
+}
+
+// minTableMass returns the smallest mass table entry in gh for the dark matter
+// types which have particles, in Shellfish's mass units. false is returned if
+// none of them are in the mass table.
+func minTableMass(gh *gadget2Header, context *Context) (float32, bool) {
+	min, ok := 0.0, false
+	for _, i := range context.GadgetDMTypeIndices {
+		n := uint64(gh.NumPartTotal[i]) + uint64(gh.NumPartTotalHW[i])<<32
+		if n == 0 || gh.Mass[i] <= 0 {
+			continue
+		}
+		if !ok || gh.Mass[i] < min {
+			min, ok = gh.Mass[i], true
+		}
+	}
+	return float32(min * context.GadgetMassUnits), ok
+}
+
 func (buf *Gadget2Buffer) Read(fname string) (
 	xs, vs [][3]float32, ms []float32, ids []int64, err error,
 ) {
@@ -399,6 +447,7 @@ func (buf *Gadget2Buffer) ReadHeader(fname string, out *Header) error {
 	return nil
 }
 
+// MinMass returns the smallest dark matter particle mass in the simulation.
 func (buf *Gadget2Buffer) MinMass() float32 { return buf.mass }
 
 func (buf *Gadget2Buffer) TotalParticles(fname string) (int, error) {
@@ -0,0 +1,319 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+)
+
+// hdf5Undefined is the "undefined address" value of the HDF5 format.
+const hdf5Undefined = ^uint64(0)
+
+// Object header message types.
+const (
+	hdf5Dataspace = 0x01
+	hdf5LinkInfo  = 0x02
+	hdf5Datatype  = 0x03
+	hdf5FillValue = 0x05
+	hdf5Link      = 0x06
+	hdf5Layout    = 0x08
+	hdf5GroupInfo = 0x0a
+)
+
+// WriteHDF5 writes arrays to wr as an HDF5 file, which can be read with h5py
+// or any other HDF5 library (version 1.8 or later). Each array is written as
+// a one-dimensional dataset at the path given by its Name, and the groups
+// along that path are created as needed, so an array named "halo_7/R" is the
+// dataset R in the group halo_7. As in WriteNpz, Data must be either []float64
+// or []int64.
+//
+// The file is written without the HDF5 C library, so only the small part of
+// the format needed for groups of contiguous, little-endian datasets is
+// supported.
+func WriteHDF5(wr io.Writer, arrays []NpyArray) error {
+	root := newHDF5Group()
+	for i := range arrays {
+		if err := root.insert(&arrays[i]); err != nil {
+			return err
+		}
+	}
+
+	// The superblock is written last, once the root group's address is
+	// known, so its space is reserved here.
+	w := &hdf5Writer{buf: make([]byte, hdf5SuperblockSize)}
+	rootAddr := w.writeGroup(root)
+
+	sb := &bytes.Buffer{}
+	sb.WriteString("\x89HDF\r\n\x1a\n")
+	// Version, size of offsets, size of lengths, and consistency flags.
+	sb.Write([]byte{2, 8, 8, 0})
+	binary.Write(sb, binary.LittleEndian, []uint64{
+		0, hdf5Undefined, uint64(len(w.buf)), rootAddr,
+	})
+	binary.Write(sb, binary.LittleEndian, lookup3(sb.Bytes()))
+	copy(w.buf, sb.Bytes())
+
+	_, err := wr.Write(w.buf)
+	return err
+}
+
+// hdf5SuperblockSize is the size of a version 2 superblock with 8 byte
+// offsets and lengths.
+const hdf5SuperblockSize = 48
+
+// hdf5Group is a group which hasn't been written yet. names lists its links
+// in the order they were created.
+type hdf5Group struct {
+	names    []string
+	groups   map[string]*hdf5Group
+	datasets map[string]*NpyArray
+}
+
+func newHDF5Group() *hdf5Group {
+	return &hdf5Group{
+		groups: map[string]*hdf5Group{}, datasets: map[string]*NpyArray{},
+	}
+}
+
+// insert adds arr to the group at the path given by its name, creating
+// subgroups as needed.
+func (g *hdf5Group) insert(arr *NpyArray) error {
+	switch data := arr.Data.(type) {
+	case []float64, []int64:
+		if len(arr.Shape) != 1 || arr.Shape[0] != hdf5Len(data) {
+			return fmt.Errorf("Array '%s' has shape %v, but %d elements.",
+				arr.Name, arr.Shape, hdf5Len(data))
+		}
+	default:
+		return fmt.Errorf("Array '%s' has unsupported type %T.",
+			arr.Name, arr.Data)
+	}
+
+	path := strings.Split(arr.Name, "/")
+	for i, name := range path {
+		if name == "" || name == "." || len(name) > 0xffff {
+			return fmt.Errorf("Array name '%s' isn't a valid HDF5 path.",
+				arr.Name)
+		}
+		_, isGroup := g.groups[name]
+		_, isDataset := g.datasets[name]
+
+		if i == len(path)-1 {
+			if isGroup || isDataset {
+				return fmt.Errorf("Array '%s' was given twice.", arr.Name)
+			}
+			g.datasets[name] = arr
+			g.names = append(g.names, name)
+		} else if isDataset {
+			return fmt.Errorf("Array '%s' is inside of another array.",
+				arr.Name)
+		} else if !isGroup {
+			g.groups[name] = newHDF5Group()
+			g.names = append(g.names, name)
+		}
+		g = g.groups[name]
+	}
+	return nil
+}
+
+func hdf5Len(data interface{}) int {
+	switch data := data.(type) {
+	case []float64:
+		return len(data)
+	case []int64:
+		return len(data)
+	}
+	return 0
+}
+
+// hdf5Writer builds an HDF5 file in memory. Objects are appended to buf
+// children-first, so every address is known by the time it's needed.
+type hdf5Writer struct {
+	buf []byte
+}
+
+// writeGroup writes g and everything inside it and returns the address of
+// g's object header.
+func (w *hdf5Writer) writeGroup(g *hdf5Group) uint64 {
+	addrs := make([]uint64, len(g.names))
+	for i, name := range g.names {
+		if arr, ok := g.datasets[name]; ok {
+			addrs[i] = w.writeDataset(arr)
+		} else {
+			addrs[i] = w.writeGroup(g.groups[name])
+		}
+	}
+
+	msgs := []hdf5Message{
+		// Link info: no creation order, and no fractal heap or name index
+		// since every link is stored in the object header.
+		{hdf5LinkInfo, 0, hdf5Bytes(uint8(0), uint8(0),
+			hdf5Undefined, hdf5Undefined)},
+		// Group info: default link storage parameters.
+		{hdf5GroupInfo, 0, []byte{0, 0}},
+	}
+	for i, name := range g.names {
+		// A version 1 hard link with a one or two byte name length.
+		var flags uint8
+		var length interface{} = uint8(len(name))
+		if len(name) > 0xff {
+			flags, length = 1, uint16(len(name))
+		}
+		data := hdf5Bytes(uint8(1), flags, length)
+		data = append(data, name...)
+		data = append(data, hdf5Bytes(addrs[i])...)
+		msgs = append(msgs, hdf5Message{hdf5Link, 0, data})
+	}
+
+	return w.writeObjectHeader(msgs)
+}
+
+// writeDataset writes arr's data and object header and returns the address
+// of the object header.
+func (w *hdf5Writer) writeDataset(arr *NpyArray) uint64 {
+	n := uint64(arr.Shape[0])
+	dataAddr := hdf5Undefined
+	if n > 0 {
+		dataAddr = uint64(len(w.buf))
+		w.buf = append(w.buf, hdf5Bytes(arr.Data)...)
+	}
+
+	var dtype []byte
+	switch arr.Data.(type) {
+	case []float64:
+		// IEEE little-endian double: sign at bit 63, 11 exponent bits at
+		// bit 52 with a bias of 1023, and 52 mantissa bits at bit 0.
+		dtype = hdf5Bytes([]byte{0x11, 0x20, 63, 0}, uint32(8),
+			uint16(0), uint16(64), []byte{52, 11, 0, 52}, uint32(1023))
+	case []int64:
+		// Signed little-endian 64 bit integer.
+		dtype = hdf5Bytes([]byte{0x10, 0x08, 0, 0}, uint32(8),
+			uint16(0), uint16(64))
+	}
+
+	const constant = 0x01
+	return w.writeObjectHeader([]hdf5Message{
+		// Version 2 simple dataspace without maximum dimensions.
+		{hdf5Dataspace, 0, hdf5Bytes([]byte{2, 1, 0, 1}, n)},
+		{hdf5Datatype, constant, dtype},
+		// Version 3 fill value: early allocation, written if set, and no
+		// fill value defined.
+		{hdf5FillValue, constant, []byte{3, 0x09}},
+		// Version 3 contiguous layout.
+		{hdf5Layout, 0, hdf5Bytes([]byte{3, 1}, dataAddr, 8*n)},
+	})
+}
+
+// hdf5Message is a single message in an object header.
+type hdf5Message struct {
+	typ, flags uint8
+	data       []byte
+}
+
+// writeObjectHeader writes a version 2 object header containing msgs and
+// returns its address.
+func (w *hdf5Writer) writeObjectHeader(msgs []hdf5Message) uint64 {
+	chunk := []byte{}
+	for _, msg := range msgs {
+		chunk = append(chunk, msg.typ)
+		chunk = append(chunk, hdf5Bytes(uint16(len(msg.data)))...)
+		chunk = append(chunk, msg.flags)
+		chunk = append(chunk, msg.data...)
+	}
+
+	// The low two bits of the flags give the width of the chunk size.
+	var flags uint8
+	var size interface{}
+	switch {
+	case len(chunk) <= 0xff:
+		flags, size = 0, uint8(len(chunk))
+	case len(chunk) <= 0xffff:
+		flags, size = 1, uint16(len(chunk))
+	default:
+		flags, size = 2, uint32(len(chunk))
+	}
+
+	hdr := append([]byte("OHDR"), 2, flags)
+	hdr = append(hdr, hdf5Bytes(size)...)
+	hdr = append(hdr, chunk...)
+	hdr = append(hdr, hdf5Bytes(lookup3(hdr))...)
+
+	addr := uint64(len(w.buf))
+	w.buf = append(w.buf, hdr...)
+	return addr
+}
+
+// hdf5Bytes returns the little-endian encoding of vals, which must be
+// fixed-size values or slices of them.
+func hdf5Bytes(vals ...interface{}) []byte {
+	buf := &bytes.Buffer{}
+	for _, val := range vals {
+		if err := binary.Write(buf, binary.LittleEndian, val); err != nil {
+			panic(err.Error())
+		}
+	}
+	return buf.Bytes()
+}
+
+// lookup3 returns Bob Jenkins's lookup3 hash of key with an initial value of
+// 0, which is the checksum used by HDF5 metadata.
+func lookup3(key []byte) uint32 {
+	a := 0xdeadbeef + uint32(len(key))
+	b, c := a, a
+
+	for len(key) > 12 {
+		a += binary.LittleEndian.Uint32(key[0:])
+		b += binary.LittleEndian.Uint32(key[4:])
+		c += binary.LittleEndian.Uint32(key[8:])
+
+		a -= c
+		a ^= bits.RotateLeft32(c, 4)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 6)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 8)
+		b += a
+		a -= c
+		a ^= bits.RotateLeft32(c, 16)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 19)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 4)
+		b += a
+
+		key = key[12:]
+	}
+	if len(key) == 0 {
+		return c
+	}
+
+	// The last block is zero-padded.
+	tail := make([]byte, 12)
+	copy(tail, key)
+	a += binary.LittleEndian.Uint32(tail[0:])
+	b += binary.LittleEndian.Uint32(tail[4:])
+	c += binary.LittleEndian.Uint32(tail[8:])
+
+	c ^= b
+	c -= bits.RotateLeft32(b, 14)
+	a ^= c
+	a -= bits.RotateLeft32(c, 11)
+	b ^= a
+	b -= bits.RotateLeft32(a, 25)
+	c ^= b
+	c -= bits.RotateLeft32(b, 16)
+	a ^= c
+	a -= bits.RotateLeft32(c, 4)
+	b ^= a
+	b -= bits.RotateLeft32(a, 14)
+	c ^= b
+	c -= bits.RotateLeft32(b, 24)
+	return c
+}
@@ -0,0 +1,197 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestLookup3(t *testing.T) {
+	// Test vectors from Bob Jenkins's lookup3.c.
+	tests := []struct {
+		key      string
+		expected uint32
+	}{
+		{"", 0xdeadbeef},
+		{"Four score and seven years ago", 0x17770551},
+	}
+
+	for i, test := range tests {
+		hash := lookup3([]byte(test.key))
+		if hash != test.expected {
+			t.Errorf("%d) Expected lookup3(%q) = %08x, got %08x.",
+				i, test.key, test.expected, hash)
+		}
+	}
+}
+
+// hdf5Reader reads back the subset of HDF5 written by WriteHDF5.
+type hdf5Reader struct {
+	t    *testing.T
+	file []byte
+}
+
+// objectHeader checks the version 2 object header at addr and returns its
+// messages.
+func (r *hdf5Reader) objectHeader(addr uint64) []hdf5Message {
+	f := r.file[addr:]
+	if string(f[:4]) != "OHDR" || f[4] != 2 {
+		r.t.Fatalf("No version 2 object header at %d.", addr)
+	}
+	width := 1 << (f[5] & 3)
+	size := 0
+	for i := 0; i < width; i++ {
+		size += int(f[6+i]) << (8 * uint(i))
+	}
+	end := 6 + width + size
+	sum := binary.LittleEndian.Uint32(f[end:])
+	if sum != lookup3(f[:end]) {
+		r.t.Fatalf("Object header at %d has a bad checksum.", addr)
+	}
+
+	msgs := []hdf5Message{}
+	for chunk := f[6+width : end]; len(chunk) > 0; {
+		n := int(binary.LittleEndian.Uint16(chunk[1:]))
+		msgs = append(msgs, hdf5Message{chunk[0], chunk[3], chunk[4 : 4+n]})
+		chunk = chunk[4+n:]
+	}
+	return msgs
+}
+
+// walk returns every dataset reachable from the group at addr, keyed by path.
+func (r *hdf5Reader) walk(addr uint64, prefix string, out map[string][]float64) {
+	msgs := r.objectHeader(addr)
+	var dims []uint64
+	var class uint8
+	var dataAddr uint64
+	var links, layouts, linkInfos int
+	for _, msg := range msgs {
+		switch msg.typ {
+		case hdf5LinkInfo:
+			linkInfos++
+		case hdf5Link:
+			links++
+			n := int(msg.data[2])
+			if msg.data[1]&3 == 1 {
+				n = int(binary.LittleEndian.Uint16(msg.data[2:]))
+			}
+			start := 3 + int(msg.data[1]&3)
+			name := string(msg.data[start : start+n])
+			child := binary.LittleEndian.Uint64(msg.data[start+n:])
+			r.walk(child, prefix+name+"/", out)
+		case hdf5Dataspace:
+			dims = append(dims, binary.LittleEndian.Uint64(msg.data[4:]))
+		case hdf5Datatype:
+			class = msg.data[0] & 0xf
+		case hdf5Layout:
+			layouts++
+			dataAddr = binary.LittleEndian.Uint64(msg.data[2:])
+		}
+	}
+
+	if layouts == 0 {
+		if linkInfos != 1 {
+			r.t.Errorf("Group %s has no link info message.", prefix)
+		}
+		return
+	}
+
+	name := strings.TrimSuffix(prefix, "/")
+	data := make([]float64, dims[0])
+	for i := range data {
+		bits := binary.LittleEndian.Uint64(r.file[dataAddr+8*uint64(i):])
+		if class == 1 {
+			data[i] = math.Float64frombits(bits)
+		} else {
+			data[i] = float64(int64(bits))
+		}
+	}
+	out[name] = data
+}
+
+func TestWriteHDF5(t *testing.T) {
+	arrays := []NpyArray{
+		{Name: "id", Shape: []int{2}, Data: []int64{7, -9}},
+		{Name: "halo_7_100/R", Shape: []int{3}, Data: []float64{1, 2, 3}},
+		{Name: "halo_7_100/Rho", Shape: []int{3}, Data: []float64{4, 5, 6}},
+		{Name: "halo_9_100/R", Shape: []int{1}, Data: []float64{-0.5}},
+		{Name: "a/b/empty", Shape: []int{0}, Data: []float64{}},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteHDF5(buf, arrays); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	file := buf.Bytes()
+
+	if string(file[:8]) != "\x89HDF\r\n\x1a\n" || file[8] != 2 {
+		t.Fatalf("File doesn't start with a version 2 superblock.")
+	}
+	sb := file[:hdf5SuperblockSize]
+	if binary.LittleEndian.Uint32(sb[44:]) != lookup3(sb[:44]) {
+		t.Errorf("Superblock has a bad checksum.")
+	}
+	if eof := binary.LittleEndian.Uint64(sb[28:]); eof != uint64(len(file)) {
+		t.Errorf("Superblock gives an end of file of %d, but the file is "+
+			"%d bytes.", eof, len(file))
+	}
+
+	r := &hdf5Reader{t, file}
+	out := map[string][]float64{}
+	r.walk(binary.LittleEndian.Uint64(sb[36:]), "", out)
+
+	if len(out) != len(arrays) {
+		t.Errorf("Expected %d datasets, got %d.", len(arrays), len(out))
+	}
+	for _, arr := range arrays {
+		data, ok := out[arr.Name]
+		if !ok {
+			t.Errorf("Dataset %s wasn't written.", arr.Name)
+			continue
+		}
+		expected := []float64{}
+		switch x := arr.Data.(type) {
+		case []float64:
+			expected = x
+		case []int64:
+			for _, xi := range x {
+				expected = append(expected, float64(xi))
+			}
+		}
+		if len(data) != len(expected) {
+			t.Errorf("Expected %s = %v, got %v.", arr.Name, expected, data)
+			continue
+		}
+		for i := range data {
+			if data[i] != expected[i] {
+				t.Errorf("Expected %s = %v, got %v.",
+					arr.Name, expected, data)
+				break
+			}
+		}
+	}
+}
+
+func TestWriteHDF5Errors(t *testing.T) {
+	tests := [][]NpyArray{
+		{{Name: "x", Shape: []int{2}, Data: []float64{1}}},
+		{{Name: "x", Shape: []int{1}, Data: []float32{1}}},
+		{{Name: "a//x", Shape: []int{1}, Data: []float64{1}}},
+		{
+			{Name: "x", Shape: []int{1}, Data: []float64{1}},
+			{Name: "x", Shape: []int{1}, Data: []float64{1}},
+		},
+		{
+			{Name: "x", Shape: []int{1}, Data: []float64{1}},
+			{Name: "x/y", Shape: []int{1}, Data: []float64{1}},
+		},
+	}
+
+	for i, arrays := range tests {
+		if err := WriteHDF5(&bytes.Buffer{}, arrays); err == nil {
+			t.Errorf("%d) Expected an error.", i)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	fitsBlockSize = 2880
+	fitsCardSize  = 80
+)
+
+// WriteHealpixFITS writes a RING-ordered HEALPix map with the given nside to
+// wr as a FITS binary table with a single double precision column. This is the
+// layout expected by healpy and most other HEALPix tools.
+func WriteHealpixFITS(
+	wr io.Writer, nside int, signal []float64, unit string,
+) error {
+	npix := 12 * nside * nside
+	if len(signal) != npix {
+		return fmt.Errorf("A HEALPix map with nside %d must have %d "+
+			"pixels, but %d were given.", nside, npix, len(signal))
+	}
+
+	primary := []string{
+		fitsLogical("SIMPLE", true),
+		fitsInt("BITPIX", 8),
+		fitsInt("NAXIS", 0),
+		fitsLogical("EXTEND", true),
+	}
+	table := []string{
+		fitsString("XTENSION", "BINTABLE"),
+		fitsInt("BITPIX", 8),
+		fitsInt("NAXIS", 2),
+		fitsInt("NAXIS1", 8),
+		fitsInt("NAXIS2", npix),
+		fitsInt("PCOUNT", 0),
+		fitsInt("GCOUNT", 1),
+		fitsInt("TFIELDS", 1),
+		fitsString("TTYPE1", "SIGNAL"),
+		fitsString("TFORM1", "D"),
+		fitsString("TUNIT1", unit),
+		fitsString("PIXTYPE", "HEALPIX"),
+		fitsString("ORDERING", "RING"),
+		fitsInt("NSIDE", nside),
+		fitsInt("FIRSTPIX", 0),
+		fitsInt("LASTPIX", npix-1),
+		fitsString("INDXSCHM", "IMPLICIT"),
+		fitsString("OBJECT", "FULLSKY"),
+	}
+
+	if _, err := wr.Write(fitsHeader(primary)); err != nil {
+		return err
+	}
+	if _, err := wr.Write(fitsHeader(table)); err != nil {
+		return err
+	}
+
+	data := &bytes.Buffer{}
+	if err := binary.Write(data, binary.BigEndian, signal); err != nil {
+		return err
+	}
+	_, err := wr.Write(fitsPad(data.Bytes(), 0))
+	return err
+}
+
+// fitsHeader joins a set of header cards, adds the END card, and pads the
+// result out to a full FITS block.
+func fitsHeader(cards []string) []byte {
+	buf := &bytes.Buffer{}
+	for _, card := range cards {
+		buf.WriteString(card)
+	}
+	buf.WriteString(fmt.Sprintf("%-80s", "END"))
+	return fitsPad(buf.Bytes(), ' ')
+}
+
+// fitsPad pads b with the given byte until its length is a multiple of the
+// FITS block size.
+func fitsPad(b []byte, pad byte) []byte {
+	for len(b)%fitsBlockSize != 0 {
+		b = append(b, pad)
+	}
+	return b
+}
+
+func fitsInt(key string, val int) string {
+	return fmt.Sprintf("%-8s= %20d%-50s", key, val, "")
+}
+
+func fitsLogical(key string, val bool) string {
+	s := "F"
+	if val {
+		s = "T"
+	}
+	return fmt.Sprintf("%-8s= %20s%-50s", key, s, "")
+}
+
+func fitsString(key, val string) string {
+	card := fmt.Sprintf("%-8s= '%-8s'", key, val)
+	return fmt.Sprintf("%-*s", fitsCardSize, card)
+}
@@ -0,0 +1,58 @@
+package io
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// WriteMesh writes a triangulated mesh to wr in the given format. Supported
+// formats are "obj" (Wavefront OBJ), "ply" (ASCII PLY), and "vtk" (legacy
+// ASCII VTK polydata), all of which can be read by ParaView and Blender.
+// Faces are indices into vs.
+func WriteMesh(
+	wr io.Writer, format string, vs [][3]float64, faces [][3]int,
+) error {
+	bw := bufio.NewWriter(wr)
+
+	switch format {
+	case "obj":
+		for _, v := range vs {
+			fmt.Fprintf(bw, "v %.6g %.6g %.6g\n", v[0], v[1], v[2])
+		}
+		// OBJ indices start at 1.
+		for _, f := range faces {
+			fmt.Fprintf(bw, "f %d %d %d\n", f[0]+1, f[1]+1, f[2]+1)
+		}
+	case "ply":
+		fmt.Fprintf(bw, "ply\nformat ascii 1.0\n")
+		fmt.Fprintf(bw, "element vertex %d\n", len(vs))
+		fmt.Fprintf(bw, "property float x\nproperty float y\n")
+		fmt.Fprintf(bw, "property float z\n")
+		fmt.Fprintf(bw, "element face %d\n", len(faces))
+		fmt.Fprintf(bw, "property list uchar int vertex_indices\n")
+		fmt.Fprintf(bw, "end_header\n")
+		for _, v := range vs {
+			fmt.Fprintf(bw, "%.6g %.6g %.6g\n", v[0], v[1], v[2])
+		}
+		for _, f := range faces {
+			fmt.Fprintf(bw, "3 %d %d %d\n", f[0], f[1], f[2])
+		}
+	case "vtk":
+		fmt.Fprintf(bw, "# vtk DataFile Version 3.0\n")
+		fmt.Fprintf(bw, "Shellfish splashback shell\nASCII\n")
+		fmt.Fprintf(bw, "DATASET POLYDATA\n")
+		fmt.Fprintf(bw, "POINTS %d double\n", len(vs))
+		for _, v := range vs {
+			fmt.Fprintf(bw, "%.6g %.6g %.6g\n", v[0], v[1], v[2])
+		}
+		fmt.Fprintf(bw, "POLYGONS %d %d\n", len(faces), 4*len(faces))
+		for _, f := range faces {
+			fmt.Fprintf(bw, "3 %d %d %d\n", f[0], f[1], f[2])
+		}
+	default:
+		return fmt.Errorf("Unrecognized mesh format '%s'.", format)
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,86 @@
+package io
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// NpyArray is a named, multidimensional array which can be written to a numpy
+// .npz file. Data must be either []float64 or []int64 and is stored in
+// row-major order.
+type NpyArray struct {
+	Name  string
+	Shape []int
+	Data  interface{}
+}
+
+// WriteNpz writes arrays to wr as an .npz file, which can be read with
+// numpy.load. Each array is stored as "<Name>.npy" within the archive.
+func WriteNpz(wr io.Writer, arrays []NpyArray) error {
+	zw := zip.NewWriter(wr)
+	for _, arr := range arrays {
+		f, err := zw.Create(arr.Name + ".npy")
+		if err != nil {
+			return err
+		}
+		if err = writeNpy(f, arr); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeNpy writes a single array to wr in version 1.0 of the .npy format.
+func writeNpy(wr io.Writer, arr NpyArray) error {
+	var descr string
+	var n int
+	switch data := arr.Data.(type) {
+	case []float64:
+		descr, n = "<f8", len(data)
+	case []int64:
+		descr, n = "<i8", len(data)
+	default:
+		return fmt.Errorf("Array '%s' has unsupported type %T.",
+			arr.Name, arr.Data)
+	}
+
+	size := 1
+	dims := make([]string, len(arr.Shape))
+	for i, dim := range arr.Shape {
+		size *= dim
+		dims[i] = fmt.Sprintf("%d,", dim)
+	}
+	if size != n {
+		return fmt.Errorf("Array '%s' has shape %v, but %d elements.",
+			arr.Name, arr.Shape, n)
+	}
+
+	shape := "(" + strings.Join(dims, " ") + ")"
+	header := fmt.Sprintf(
+		"{'descr': '%s', 'fortran_order': False, 'shape': %s, }",
+		descr, shape,
+	)
+	// The magic string, version, and header length take 10 bytes, and the
+	// header must be padded so the data starts on a 64 byte boundary.
+	pad := 64 - (10+len(header)+1)%64
+	if pad == 64 {
+		pad = 0
+	}
+	header += strings.Repeat(" ", pad) + "\n"
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("\x93NUMPY")
+	buf.Write([]byte{1, 0})
+	binary.Write(buf, binary.LittleEndian, uint16(len(header)))
+	buf.WriteString(header)
+	if err := binary.Write(buf, binary.LittleEndian, arr.Data); err != nil {
+		return err
+	}
+
+	_, err := wr.Write(buf.Bytes())
+	return err
+}
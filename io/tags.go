@@ -0,0 +1,109 @@
+package io
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// particleTagsMagic identifies files written by WriteParticleTags.
+const particleTagsMagic = "SFTAGS"
+
+// particleTagsVersion is the version of the format written by
+// WriteParticleTags.
+const particleTagsVersion = 1
+
+// ParticleTags are the dynamical tags of the particles around a single halo.
+// Element i of each slice refers to the particle with ID IDs[i].
+type ParticleTags struct {
+	// HaloID and Snap identify the halo that the particles were tagged in.
+	HaloID int64
+	Snap   int32
+	IDs    []int64
+	// InfallSnaps is the first snapshot in which each particle was inside
+	// the halo, or -1 if it never was.
+	InfallSnaps []int32
+	// Pericenters is the number of pericenter passages of each particle.
+	Pericenters []uint16
+	// Orbiting is true for particles which have passed through at least
+	// one pericenter.
+	Orbiting []bool
+}
+
+// WriteParticleTags writes tags to wr in a compact little-endian binary
+// format: the magic string "SFTAGS", a uint16 version, HaloID as an int64,
+// Snap as an int32, the number of particles, n, as an int64, and then n
+// int64 IDs, n int32 infall snapshots, n uint16 pericenter counts, and n
+// uint8 orbiting flags.
+func WriteParticleTags(wr io.Writer, tags *ParticleTags) error {
+	n := len(tags.IDs)
+	if len(tags.InfallSnaps) != n || len(tags.Pericenters) != n ||
+		len(tags.Orbiting) != n {
+		return fmt.Errorf("The tags of halo %d have mismatched lengths.",
+			tags.HaloID)
+	}
+
+	orbiting := make([]uint8, n)
+	for i := range orbiting {
+		if tags.Orbiting[i] {
+			orbiting[i] = 1
+		}
+	}
+
+	bw := bufio.NewWriter(wr)
+	bw.WriteString(particleTagsMagic)
+	for _, x := range []interface{}{
+		uint16(particleTagsVersion), tags.HaloID, tags.Snap, int64(n),
+		tags.IDs, tags.InfallSnaps, tags.Pericenters, orbiting,
+	} {
+		if err := binary.Write(bw, binary.LittleEndian, x); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadParticleTags reads tags written by WriteParticleTags.
+func ReadParticleTags(rd io.Reader) (*ParticleTags, error) {
+	br := bufio.NewReader(rd)
+	magic := make([]byte, len(particleTagsMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	} else if string(magic) != particleTagsMagic {
+		return nil, fmt.Errorf("This isn't a particle tag file.")
+	}
+
+	var version uint16
+	var n int64
+	tags := &ParticleTags{}
+	for _, x := range []interface{}{&version, &tags.HaloID, &tags.Snap, &n} {
+		if err := binary.Read(br, binary.LittleEndian, x); err != nil {
+			return nil, err
+		}
+	}
+	if version != particleTagsVersion {
+		return nil, fmt.Errorf("Particle tag files with version %d aren't "+
+			"supported.", version)
+	} else if n < 0 {
+		return nil, fmt.Errorf("The particle tag file is corrupted.")
+	}
+
+	tags.IDs = make([]int64, n)
+	tags.InfallSnaps = make([]int32, n)
+	tags.Pericenters = make([]uint16, n)
+	orbiting := make([]uint8, n)
+	for _, x := range []interface{}{
+		tags.IDs, tags.InfallSnaps, tags.Pericenters, orbiting,
+	} {
+		if err := binary.Read(br, binary.LittleEndian, x); err != nil {
+			return nil, err
+		}
+	}
+
+	tags.Orbiting = make([]bool, n)
+	for i := range orbiting {
+		tags.Orbiting[i] = orbiting[i] != 0
+	}
+	return tags, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import "C"
+
+import (
+	"bytes"
+	"unsafe"
+)
+
+// measureShell calls shellfish_measure_shell on Go values and returns its
+// result along with the error message it wrote. It lets Go code, including
+// this package's tests, which can't use cgo, call through the exported
+// function. n and maxCoeffs are passed separately from len(xs) and
+// len(coeffs) so that invalid lengths can be checked. Empty slices and a nil
+// center are passed as NULL pointers.
+func measureShell(
+	xs [][3]float32, ms []float32, n int64, center *[3]float64,
+	r200m, boxWidth float64, seed uint64, coeffs []float64, maxCoeffs int,
+) (int, string) {
+	var cXs, cMs *C.float
+	if len(xs) > 0 {
+		cXs = (*C.float)(unsafe.Pointer(&xs[0][0]))
+	}
+	if len(ms) > 0 {
+		cMs = (*C.float)(unsafe.Pointer(&ms[0]))
+	}
+	var cCenter *C.double
+	if center != nil {
+		cCenter = (*C.double)(unsafe.Pointer(&center[0]))
+	}
+	var cCoeffs *C.double
+	if len(coeffs) > 0 {
+		cCoeffs = (*C.double)(unsafe.Pointer(&coeffs[0]))
+	}
+	errBuf := make([]byte, 256)
+
+	k := shellfish_measure_shell(
+		cXs, cMs, C.longlong(n), cCenter,
+		C.double(r200m), C.double(boxWidth), C.ulonglong(seed),
+		cCoeffs, C.int(maxCoeffs),
+		(*C.char)(unsafe.Pointer(&errBuf[0])), C.int(len(errBuf)),
+	)
+
+	if end := bytes.IndexByte(errBuf, 0); end >= 0 {
+		errBuf = errBuf[:end]
+	}
+	return int(k), string(errBuf)
+}
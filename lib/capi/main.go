@@ -0,0 +1,119 @@
+/*
+Command capi exports Shellfish's shell fitter through a C ABI, so that it can
+be called from C, Python, or any other language with a C foreign function
+interface. Build it as a shared library with
+
+	$ go build -buildmode=c-shared -o libshellfish.so \
+		github.com/phil-mansfield/shellfish/lib/capi
+
+which also writes the header libshellfish.h. shellfish.py in this directory
+is a Python wrapper around the library.
+*/
+package main
+
+/*
+#include <stdlib.h>
+#include <string.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/phil-mansfield/shellfish/lib"
+)
+
+// maxLen is the length of the arrays that C pointers are converted to. It's
+// only used for slicing, so it doesn't cost any memory.
+const maxLen = 1 << 30
+
+// shellfish_measure_shell fits a Penna-Dines shell to a halo using the shell
+// mode's default parameters. positions is an n x 3 array of particle
+// positions and masses is an array of n particle masses. center is the
+// halo's center and r200m is its radius. Positions are wrapped by the
+// periodic boundaries of a box with width box_width; if box_width is 0,
+// positions aren't wrapped.
+//
+// The coefficients are written to coeffs, which must be able to hold
+// max_coeffs values. The number of coefficients is returned. If there's an
+// error, including a NULL array, -1 is returned and an error message is
+// written to err, which must be able to hold err_len bytes.
+//
+//export shellfish_measure_shell
+func shellfish_measure_shell(
+	positions, masses *C.float, n C.longlong, center *C.double,
+	r200m, box_width C.double, seed C.ulonglong,
+	coeffs *C.double, max_coeffs C.int, err *C.char, err_len C.int,
+) C.int {
+	if n <= 0 {
+		writeError(err, err_len, "The number of particles, n, must be "+
+			"positive.")
+		return -1
+	} else if n > maxLen {
+		writeError(err, err_len, fmt.Sprintf("The number of particles, "+
+			"n, is %d, but at most %d particles are supported.", n, maxLen))
+		return -1
+	}
+
+	switch {
+	case positions == nil:
+		writeError(err, err_len, "positions is NULL.")
+		return -1
+	case masses == nil:
+		writeError(err, err_len, "masses is NULL.")
+		return -1
+	case center == nil:
+		writeError(err, err_len, "center is NULL.")
+		return -1
+	case coeffs == nil && max_coeffs > 0:
+		writeError(err, err_len, "coeffs is NULL, but max_coeffs is "+
+			"positive.")
+		return -1
+	}
+
+	xs := (*[maxLen][3]float32)(unsafe.Pointer(positions))[:n:n]
+	ms := (*[maxLen]float32)(unsafe.Pointer(masses))[:n:n]
+	cs := (*[3]float64)(unsafe.Pointer(center))
+	origin := [3]float64{cs[0], cs[1], cs[2]}
+
+	shell, e := lib.FitShell(xs, ms, origin, float64(r200m),
+		float64(box_width), uint64(seed), lib.DefaultShellParams())
+	if e != nil {
+		writeError(err, err_len, e.Error())
+		return -1
+	}
+
+	if len(shell.Coeffs) > int(max_coeffs) {
+		writeError(err, err_len, "coeffs is too small to hold the shell's "+
+			"coefficients.")
+		return -1
+	}
+	out := (*[maxLen]float64)(unsafe.Pointer(coeffs))[:max_coeffs:max_coeffs]
+	copy(out, shell.Coeffs)
+	return C.int(len(shell.Coeffs))
+}
+
+// shellfish_coeff_count returns the number of coefficients written by
+// shellfish_measure_shell.
+//
+//export shellfish_coeff_count
+func shellfish_coeff_count() C.int {
+	order := lib.DefaultShellParams().Order
+	return C.int(2 * order * order)
+}
+
+// writeError copies a null-terminated error message into a C buffer,
+// truncating it if needed.
+func writeError(buf *C.char, n C.int, msg string) {
+	if buf == nil || n <= 0 {
+		return
+	}
+	cMsg := C.CString(msg)
+	defer C.free(unsafe.Pointer(cMsg))
+	C.strncpy(buf, cMsg, C.size_t(n-1))
+	out := (*[maxLen]byte)(unsafe.Pointer(buf))[:n:n]
+	out[n-1] = 0
+}
+
+func main() {}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/lib"
+	"github.com/phil-mansfield/shellfish/math/rand"
+)
+
+// isothermalHalo returns particles with an isothermal profile which drops
+// steeply at rsp, embedded in a uniform background.
+func isothermalHalo(
+	origin [3]float64, rsp float64, n int, seed uint64,
+) ([][3]float32, []float32) {
+	gen := rand.New(rand.Xorshift, seed)
+	xs, ms := [][3]float32{}, []float32{}
+	add := func(r float64) {
+		for {
+			x, y, z := gen.Uniform(-1, 1), gen.Uniform(-1, 1), gen.Uniform(-1, 1)
+			norm := math.Sqrt(x*x + y*y + z*z)
+			if norm < 1 && norm > 0 {
+				xs = append(xs, [3]float32{
+					float32(origin[0] + r*x/norm),
+					float32(origin[1] + r*y/norm),
+					float32(origin[2] + r*z/norm),
+				})
+				ms = append(ms, 1)
+				return
+			}
+		}
+	}
+
+	// rho ~ r^-2 has uniformly distributed radii.
+	for i := 0; i < n; i++ {
+		add(gen.Uniform(0, rsp))
+	}
+	// Background particles with the same density as the halo at 1.5 rsp.
+	rOut := 3.5 * rsp / 1.5
+	rhoBg := float64(n) / (4 * math.Pi * rsp) / (1.5 * rsp * 1.5 * rsp)
+	nBg := int(rhoBg * 4 * math.Pi / 3 * rOut * rOut * rOut)
+	for i := 0; i < nBg; i++ {
+		add(rOut * math.Cbrt(gen.Uniform(0, 1)))
+	}
+
+	return xs, ms
+}
+
+func TestMeasureShell(t *testing.T) {
+	origin := [3]float64{50, 50, 50}
+	xs, ms := isothermalHalo(origin, 1.5, 5000, 1)
+	nCoeffs := int(shellfish_coeff_count())
+	coeffs := make([]float64, nCoeffs)
+
+	k, msg := measureShell(xs, ms, int64(len(xs)), &origin, 1, 100, 2,
+		coeffs, len(coeffs))
+	if k != nCoeffs {
+		t.Fatalf("Expected %d coefficients, got %d with error '%s'.",
+			nCoeffs, k, msg)
+	}
+	shell, err := lib.FitShell(xs, ms, origin, 1, 100, 2,
+		lib.DefaultShellParams())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for i := range coeffs {
+		if coeffs[i] != shell.Coeffs[i] {
+			t.Errorf("Expected coefficients %v, got %v.", shell.Coeffs, coeffs)
+			break
+		}
+	}
+
+	k, msg = measureShell(xs, ms, int64(len(xs)), &origin, 1, 100, 2,
+		coeffs[:nCoeffs-1], nCoeffs-1)
+	if k != -1 || !strings.Contains(msg, "coeffs is too small") {
+		t.Errorf("Expected an error for a small coeffs buffer, got %d "+
+			"and '%s'.", k, msg)
+	}
+}
+
+func TestMeasureShellLength(t *testing.T) {
+	xs, ms := [][3]float32{{1, 1, 1}}, []float32{1}
+	coeffs := make([]float64, shellfish_coeff_count())
+	center := &[3]float64{}
+
+	tests := []struct {
+		xs        [][3]float32
+		ms        []float32
+		n         int64
+		center    *[3]float64
+		coeffs    []float64
+		maxCoeffs int
+		msg       string
+	}{
+		{xs, ms, 0, center, coeffs, len(coeffs), "must be positive"},
+		{xs, ms, maxLen + 1, center, coeffs, len(coeffs),
+			"at most 1073741824 particles"},
+		{nil, ms, 1, center, coeffs, len(coeffs), "positions is NULL"},
+		{xs, nil, 1, center, coeffs, len(coeffs), "masses is NULL"},
+		{xs, ms, 1, nil, coeffs, len(coeffs), "center is NULL"},
+		{xs, ms, 1, center, nil, len(coeffs), "coeffs is NULL"},
+	}
+
+	for i, test := range tests {
+		k, msg := measureShell(test.xs, test.ms, test.n, test.center, 1, 0, 0,
+			test.coeffs, test.maxCoeffs)
+		if k != -1 || !strings.Contains(msg, test.msg) {
+			t.Errorf("%d) Expected an error containing '%s', got %d and "+
+				"'%s'.", i, test.msg, k, msg)
+		}
+	}
+}
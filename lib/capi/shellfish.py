@@ -0,0 +1,87 @@
+"""Python bindings for Shellfish's shell fitter.
+
+These call the shared library built from this directory with
+
+    $ go build -buildmode=c-shared -o libshellfish.so \\
+        github.com/phil-mansfield/shellfish/lib/capi
+
+The library is looked for next to this file unless the SHELLFISH_LIB
+environment variable gives its path.
+
+Example:
+
+    import shellfish
+    coeffs = shellfish.measure_shell(positions, masses, center, r200m)
+"""
+
+import ctypes
+import os
+
+import numpy as np
+
+_lib = None
+
+
+def _load():
+    global _lib
+    if _lib is not None:
+        return _lib
+
+    path = os.environ.get("SHELLFISH_LIB", os.path.join(
+        os.path.dirname(os.path.abspath(__file__)), "libshellfish.so"))
+    lib = ctypes.CDLL(path)
+
+    lib.shellfish_measure_shell.restype = ctypes.c_int
+    lib.shellfish_measure_shell.argtypes = [
+        ctypes.POINTER(ctypes.c_float), ctypes.POINTER(ctypes.c_float),
+        ctypes.c_longlong, ctypes.POINTER(ctypes.c_double),
+        ctypes.c_double, ctypes.c_double, ctypes.c_ulonglong,
+        ctypes.POINTER(ctypes.c_double), ctypes.c_int,
+        ctypes.c_char_p, ctypes.c_int,
+    ]
+    lib.shellfish_coeff_count.restype = ctypes.c_int
+    lib.shellfish_coeff_count.argtypes = []
+
+    _lib = lib
+    return lib
+
+
+def measure_shell(positions, masses, center, r200m, box_width=0.0, seed=0):
+    """Fits a splashback shell to a single halo and returns its Penna-Dines
+    coefficients, in the same order as the shellfish shell tool's output.
+
+    positions is an (n, 3) array of particle positions and masses is an array
+    of n particle masses. center is the halo's center and r200m is its radius.
+    If box_width is positive, positions are wrapped by the periodic boundaries
+    of a box with that width. seed sets the orientations of the lines of
+    sight. The shell mode's default parameters are used.
+
+    Raises ValueError if the shell can't be fit.
+    """
+    lib = _load()
+
+    positions = np.ascontiguousarray(positions, dtype=np.float32)
+    masses = np.ascontiguousarray(masses, dtype=np.float32)
+    center = np.ascontiguousarray(center, dtype=np.float64)
+    if positions.ndim != 2 or positions.shape[1] != 3:
+        raise ValueError("positions must have shape (n, 3).")
+    if masses.shape != (positions.shape[0],):
+        raise ValueError("masses must have shape (n,).")
+    if center.shape != (3,):
+        raise ValueError("center must have shape (3,).")
+
+    coeffs = np.zeros(lib.shellfish_coeff_count(), dtype=np.float64)
+    err = ctypes.create_string_buffer(1024)
+
+    n = lib.shellfish_measure_shell(
+        positions.ctypes.data_as(ctypes.POINTER(ctypes.c_float)),
+        masses.ctypes.data_as(ctypes.POINTER(ctypes.c_float)),
+        positions.shape[0],
+        center.ctypes.data_as(ctypes.POINTER(ctypes.c_double)),
+        r200m, box_width, seed,
+        coeffs.ctypes.data_as(ctypes.POINTER(ctypes.c_double)),
+        len(coeffs), err, len(err),
+    )
+    if n < 0:
+        raise ValueError(err.value.decode())
+    return coeffs[:n]
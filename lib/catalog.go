@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+)
+
+// ReadCatalog reads the given integer and float columns from a catalog file
+// written by the shellfish tool (or any whitespace-separated text file where
+// comment lines start with '#'). Columns are indexed from 0.
+func ReadCatalog(
+	fname string, intCols, floatCols []int,
+) ([][]int, [][]float64, error) {
+	return catalog.ReadFile(fname, intCols, floatCols)
+}
+
+// ParseCatalog is the same as ReadCatalog, but parses a catalog which has
+// already been read into memory.
+func ParseCatalog(
+	data []byte, intCols, floatCols []int,
+) ([][]int, [][]float64, error) {
+	return catalog.Parse(data, intCols, floatCols)
+}
+
+// ColumnIndex returns the index of the column with the given name in a
+// catalog written by the shellfish tool, or -1 if there's no such column.
+func ColumnIndex(data []byte, name string) int {
+	return catalog.ColumnIndex(data, name)
+}
+
+// WriteCatalog writes a catalog in the same format that the shellfish tool
+// uses, so it can be read by shellfish's modes. The integer columns are
+// written before the float columns, and the header names every column.
+func WriteCatalog(
+	w io.Writer, intNames, floatNames []string,
+	intCols [][]int, floatCols [][]float64,
+) error {
+	if len(intNames) != len(intCols) || len(floatNames) != len(floatCols) {
+		return fmt.Errorf("%d integer and %d float column names were "+
+			"given for %d integer and %d float columns.", len(intNames),
+			len(floatNames), len(intCols), len(floatCols))
+	}
+
+	height := -1
+	for _, col := range intCols {
+		if height == -1 {
+			height = len(col)
+		} else if len(col) != height {
+			return fmt.Errorf("The catalog's columns have unequal lengths.")
+		}
+	}
+	for _, col := range floatCols {
+		if height == -1 {
+			height = len(col)
+		} else if len(col) != height {
+			return fmt.Errorf("The catalog's columns have unequal lengths.")
+		}
+	}
+
+	n := len(intCols) + len(floatCols)
+	order, sizes := make([]int, n), make([]int, n)
+	for i := range order {
+		order[i], sizes[i] = i, 1
+	}
+
+	header := catalog.CommentString(intNames, floatNames, order, sizes)
+	lines := catalog.FormatCols(intCols, floatCols, order)
+	text := strings.Join(append([]string{header}, lines...), "\n")
+	_, err := fmt.Fprintln(w, text)
+	return err
+}
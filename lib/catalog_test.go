@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteCatalog(t *testing.T) {
+	ids, snaps := []int{10, 11}, []int{100, 100}
+	rs := []float64{0.5, 1.25}
+
+	buf := &bytes.Buffer{}
+	err := WriteCatalog(buf, []string{"ID", "Snapshot"},
+		[]string{"R_sp [cMpc/h]"}, [][]int{ids, snaps}, [][]float64{rs})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	data := buf.Bytes()
+	if col := ColumnIndex(data, "Snapshot"); col != 1 {
+		t.Errorf("Expected Snapshot to be column 1, got %d.", col)
+	}
+
+	intCols, floatCols, err := ParseCatalog(data, []int{0, 1}, []int{2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for i := range ids {
+		if intCols[0][i] != ids[i] || intCols[1][i] != snaps[i] ||
+			floatCols[0][i] != rs[i] {
+			t.Errorf("Row %d was read as %d %d %g, expected %d %d %g.", i,
+				intCols[0][i], intCols[1][i], floatCols[0][i],
+				ids[i], snaps[i], rs[i])
+		}
+	}
+
+	err = WriteCatalog(buf, []string{"ID"}, []string{"R"},
+		[][]int{ids}, [][]float64{rs[:1]})
+	if err == nil {
+		t.Errorf("Expected an error for columns of unequal lengths.")
+	}
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// LogEdges returns the edges of n logarithmically spaced radial bins between
+// rMin and rMax.
+func LogEdges(rMin, rMax float64, n int) []float64 {
+	edges := make([]float64, n+1)
+	dlr := (math.Log(rMax) - math.Log(rMin)) / float64(n)
+	for j := range edges {
+		edges[j] = rMin * math.Exp(dlr*float64(j))
+	}
+	edges[0], edges[n] = rMin, rMax
+	return edges
+}
+
+// DensityProfile returns the spherically averaged density of particles around
+// origin in the radial bins with the given edges. xs and ms are the particles'
+// positions and masses, and positions are wrapped by the periodic boundaries
+// of a box with width boxWidth. If shell isn't nil, only particles inside it
+// are counted, like the prof mode's contained-density profiles.
+func DensityProfile(
+	xs [][3]float32, ms []float32, origin [3]float64, edges []float64,
+	boxWidth float64, shell *Shell,
+) ([]float64, error) {
+	if len(xs) != len(ms) {
+		return nil, fmt.Errorf("There are %d positions, but %d masses.",
+			len(xs), len(ms))
+	} else if len(edges) < 2 {
+		return nil, fmt.Errorf("At least two bin edges are needed, but %d "+
+			"were given.", len(edges))
+	}
+
+	rMin, rMax := edges[0], edges[len(edges)-1]
+	rhos := make([]float64, len(edges)-1)
+	for i := range xs {
+		dx := wrapDist(float64(xs[i][0]), origin[0], boxWidth)
+		dy := wrapDist(float64(xs[i][1]), origin[1], boxWidth)
+		dz := wrapDist(float64(xs[i][2]), origin[2], boxWidth)
+
+		r := math.Sqrt(dx*dx + dy*dy + dz*dz)
+		if r <= rMin || r >= rMax {
+			continue
+		} else if shell != nil && !shell.Contains(dx, dy, dz) {
+			continue
+		}
+		rhos[RadialBin(edges, r)] += float64(ms[i])
+	}
+
+	for j := range rhos {
+		rhos[j] /= ShellVolume(edges[j], edges[j+1])
+	}
+	return rhos, nil
+}
+
+// ShellVolume returns the volume of a spherical shell.
+func ShellVolume(rLo, rHi float64) float64 {
+	return (rHi*rHi*rHi - rLo*rLo*rLo) * 4 * math.Pi / 3
+}
+
+// RadialBin returns the index of the bin that r falls in. r must be between
+// the first and last edges.
+func RadialBin(edges []float64, r float64) int {
+	ir := sort.SearchFloat64s(edges, r) - 1
+	if ir < 0 {
+		return 0
+	} else if ir >= len(edges)-1 {
+		return len(edges) - 2
+	}
+	return ir
+}
+
+// wrapDist returns x1 - x2 in a periodic box with the given width.
+func wrapDist(x1, x2, width float64) float64 {
+	dist := x1 - x2
+	if dist > width/2 {
+		return dist - width
+	} else if dist < width/-2 {
+		return dist + width
+	}
+	return dist
+}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDensityProfile(t *testing.T) {
+	// A uniform lattice with unit spacing, centered on the box's corner so
+	// that the profile has to wrap around the periodic boundaries.
+	L := 20
+	xs, ms := [][3]float32{}, []float32{}
+	for x := 0; x < L; x++ {
+		for y := 0; y < L; y++ {
+			for z := 0; z < L; z++ {
+				xs = append(xs, [3]float32{
+					float32(x) + 0.5, float32(y) + 0.5, float32(z) + 0.5,
+				})
+				ms = append(ms, 2)
+			}
+		}
+	}
+
+	edges := LogEdges(3, 9, 2)
+	rhos, err := DensityProfile(xs, ms, [3]float64{0, 0, 0}, edges,
+		float64(L), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for i := range rhos {
+		if math.Abs(rhos[i]-2) > 0.2 {
+			t.Errorf("Bin %d has density %g, expected 2.", i, rhos[i])
+		}
+	}
+
+	if _, err = DensityProfile(xs, ms[:1], [3]float64{}, edges,
+		float64(L), nil); err == nil {
+		t.Errorf("Expected an error for mismatched masses.")
+	}
+}
+
+func TestLogEdges(t *testing.T) {
+	edges := LogEdges(1, 100, 2)
+	expected := []float64{1, 10, 100}
+	for i := range expected {
+		if math.Abs(edges[i]-expected[i]) > 1e-10 {
+			t.Errorf("Expected edges %v, got %v.", expected, edges)
+			break
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Package lib exposes Shellfish's shell fitting, density profiles, and catalog
+IO as a Go API, so that other Go analysis tools can embed Shellfish instead of
+running the shellfish tool and parsing its output.
+
+Unlike the shellfish tool, nothing in lib reads config files or snapshots:
+callers pass in particle positions and masses that they've already loaded
+from their own simulations, and options are set with ordinary structs. All
+lengths are in whatever units the particles use, as long as they're
+consistent.
+
+A minimal shell fit looks like
+
+	p := lib.DefaultShellParams()
+	shell, err := lib.FitShell(xs, ms, origin, r200m, boxWidth, seed, p)
+	if err != nil {
+		...
+	}
+	rsp := shell.MeanRadius(10 * 1000)
+*/
+package lib
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/los"
+	"github.com/phil-mansfield/shellfish/los/analyze"
+	"github.com/phil-mansfield/shellfish/math/rand"
+)
+
+// ShellParams contains the parameters used when fitting a shell to a halo.
+// They have the same meanings as the shell.config variables with the same
+// names. Use DefaultShellParams to get the shellfish tool's defaults.
+type ShellParams struct {
+	RadialBins, Spokes, Rings int
+	// RMaxMult, RMinMult, and RKernelMult are multiples of R200m.
+	RMaxMult, RMinMult, RKernelMult float64
+
+	Order, Levels   int
+	Eta             float64
+	SmoothingWindow int
+	SmoothingKernel analyze.KernelType
+	SmoothingSigma  float64
+	LOSSlopeCutoff  float64
+
+	BackgroundRhoMult float64
+	// FilamentSigma masks filament lines of sight if it's positive.
+	FilamentSigma float64
+
+	// Minimum uses the minimum-slope definition of the splashback radius
+	// along each line of sight, searched for between SlopeRMinMult and
+	// SlopeRMaxMult (multiples of R200m), instead of the steepest drop.
+	Minimum                      bool
+	SlopeRMinMult, SlopeRMaxMult float64
+}
+
+// DefaultShellParams returns the default parameters of the shellfish tool's
+// shell mode.
+func DefaultShellParams() *ShellParams {
+	return &ShellParams{
+		RadialBins: 256, Spokes: 256, Rings: 100,
+		RMaxMult: 3, RMinMult: 0.3, RKernelMult: 0.2,
+
+		Order: 3, Levels: 3, Eta: 10,
+		SmoothingWindow: 121, SmoothingKernel: analyze.SavGolKernel,
+		SmoothingSigma: 20, LOSSlopeCutoff: 0,
+
+		BackgroundRhoMult: 0.5, FilamentSigma: -1,
+
+		Minimum: false, SlopeRMinMult: 0.5, SlopeRMaxMult: 2.5,
+	}
+}
+
+// Shell is a fitted Penna-Dines shell. Its radius in any direction is given
+// by calling it (or any of analyze.Shell's methods) with coordinates relative
+// to the halo's origin.
+type Shell struct {
+	analyze.Shell
+	// Coeffs are the Penna-Dines coefficients, P_ijk, in the same order as
+	// the shellfish tool's output catalogs.
+	Coeffs []float64
+	Order  int
+}
+
+// FitShell fits a Penna-Dines shell to the splashback points of a single
+// halo. xs and ms are the positions and masses of the particles around the
+// halo, which is centered on origin and has radius r200m. Positions are
+// wrapped by the periodic boundaries of a box with width boxWidth, or aren't
+// wrapped if boxWidth is 0. xs isn't modified. seed sets the orientations of
+// the halo's rings.
+func FitShell(
+	xs [][3]float32, ms []float32, origin [3]float64,
+	r200m, boxWidth float64, seed uint64, p *ShellParams,
+) (*Shell, error) {
+	if len(xs) != len(ms) {
+		return nil, fmt.Errorf("There are %d positions, but %d masses.",
+			len(xs), len(ms))
+	} else if len(xs) == 0 {
+		return nil, fmt.Errorf("No particles were given.")
+	} else if r200m <= 0 {
+		return nil, fmt.Errorf("r200m was set to %g, but it must be "+
+			"positive.", r200m)
+	}
+
+	h := NewHalo(origin, r200m, seed, minMass(ms), p)
+	InsertParticles(h, xs, ms, boxWidth, p)
+
+	buf := make([]analyze.RingBuffer, p.Rings)
+	for i := range buf {
+		buf[i].Init(p.Spokes, p.RadialBins)
+	}
+	pxs, pys, ok := SplashbackPoints(h, buf, p)
+	if !ok {
+		return nil, fmt.Errorf("The shell's coefficients are " +
+			"undetermined. This usually means that there are too few " +
+			"particles around the halo.")
+	}
+
+	cs, shell := analyze.PennaVolumeFit(pxs, pys, h, p.Order, p.Order)
+	return &Shell{Shell: shell, Coeffs: cs, Order: p.Order}, nil
+}
+
+// NewHalo creates the lines of sight used to fit a shell to a halo. minMass
+// is the smallest particle mass, which sets the density of empty bins.
+// Densities are in units where a particle of mass m spread over a kernel of
+// volume V has density m/V.
+func NewHalo(
+	origin [3]float64, r200m float64, seed uint64, minMass float32,
+	p *ShellParams,
+) *los.Halo {
+	rMax, rMin := r200m*p.RMaxMult, r200m*p.RMinMult
+	rho := float64(minMass) / kernelVolume(r200m, p)
+
+	h := &los.Halo{}
+	h.Init(RingNormals(p.Rings, seed), origin, rMin, rMax,
+		p.RadialBins, p.Spokes, rho*p.BackgroundRhoMult)
+	return h
+}
+
+// InsertParticles adds particles to the lines of sight of a halo created by
+// NewHalo. xs isn't modified.
+func InsertParticles(
+	h *los.Halo, xs [][3]float32, ms []float32, boxWidth float64,
+	p *ShellParams,
+) {
+	r200m := h.RMax() / p.RMaxMult
+	rad := r200m * p.RKernelMult
+	vol := kernelVolume(r200m, p)
+
+	local := make([][3]float32, len(xs))
+	copy(local, xs)
+	h.Transform(local, boxWidth)
+
+	intr := make([]bool, len(local))
+	h.Intersect(local, rad, intr)
+	for i := range local {
+		if intr[i] {
+			h.Insert(local[i], rad, float64(ms[i])/vol)
+		}
+	}
+}
+
+// kernelVolume returns the volume of the kernel used for each particle.
+func kernelVolume(r200m float64, p *ShellParams) float64 {
+	rad := r200m * p.RKernelMult
+	return 4 * math.Pi / 3 * rad * rad * rad
+}
+
+// minMass returns the smallest mass in ms.
+func minMass(ms []float32) float32 {
+	min := ms[0]
+	for _, m := range ms {
+		if m < min {
+			min = m
+		}
+	}
+	return min
+}
+
+// SplashbackPoints finds the filtered splashback points of every ring of a
+// halo whose lines of sight have already been filled with particles. buf
+// must have one RingBuffer for each ring.
+func SplashbackPoints(
+	h *los.Halo, buf []analyze.RingBuffer, p *ShellParams,
+) (pxs, pys [][]float64, ok bool) {
+	kernel := analyze.Kernel(p.SmoothingKernel, p.SmoothingSigma)
+	r200m := h.RMax() / p.RMaxMult
+	for i := range buf {
+		buf[i].Clear()
+		if p.Minimum {
+			buf[i].MinimumSlope(
+				h, i, p.SmoothingWindow,
+				r200m*p.SlopeRMinMult, r200m*p.SlopeRMaxMult, kernel,
+			)
+		} else {
+			buf[i].Splashback(
+				h, i, p.SmoothingWindow, p.LOSSlopeCutoff, kernel,
+			)
+		}
+	}
+
+	if p.FilamentSigma > 0 {
+		masked := analyze.MaskFilaments(buf, h, p.FilamentSigma)
+		if logging.Mode == logging.Debug {
+			log.Printf("Masked %d filament lines of sight.", masked)
+		}
+	}
+
+	return analyze.FilterPoints(buf, p.Levels, h.RMax()/p.Eta)
+}
+
+// RingNormals returns the normal vectors of n rings. If n is 3, the rings
+// are aligned with the coordinate axes. Otherwise, they're oriented randomly
+// using the given seed.
+func RingNormals(n int, seed uint64) [][3]float32 {
+	var vecs [][3]float32
+	gen := rand.New(rand.Xorshift, seed)
+	switch n {
+	case 3:
+		vecs = [][3]float32{{0, 0, 1}, {0, 1, 0}, {1, 0, 0}}
+	default:
+		vecs = make([][3]float32, n)
+		for i := range vecs {
+			for {
+				x := gen.Uniform(-1, +1)
+				y := gen.Uniform(-1, +1)
+				z := gen.Uniform(-1, +1)
+				r := math.Sqrt(x*x + y*y + z*z)
+
+				if r < 1 {
+					vecs[i] = [3]float32{
+						float32(x / r), float32(y / r), float32(z / r),
+					}
+					break
+				}
+			}
+		}
+	}
+
+	return vecs
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/los/analyze"
+	"github.com/phil-mansfield/shellfish/math/rand"
+)
+
+// splashbackHalo returns particles with an isothermal profile which drops
+// steeply at rsp, embedded in a uniform background.
+func splashbackHalo(
+	origin [3]float64, rsp float64, n int, seed uint64,
+) ([][3]float32, []float32) {
+	gen := rand.New(rand.Xorshift, seed)
+	xs, ms := [][3]float32{}, []float32{}
+	for i := 0; i < n; i++ {
+		// rho ~ r^-2 has uniformly distributed radii.
+		r := gen.Uniform(0, rsp)
+		xs = append(xs, randomPoint(gen, origin, r))
+		ms = append(ms, 1)
+	}
+
+	// Background particles with the same density as the halo at 1.5 rsp.
+	rOut := 3.5 * rsp / 1.5
+	rhoBg := float64(n) / (4 * math.Pi * rsp) / (1.5 * rsp * 1.5 * rsp)
+	nBg := int(rhoBg * 4 * math.Pi / 3 * rOut * rOut * rOut)
+	for i := 0; i < nBg; i++ {
+		r := rOut * math.Cbrt(gen.Uniform(0, 1))
+		xs = append(xs, randomPoint(gen, origin, r))
+		ms = append(ms, 1)
+	}
+
+	return xs, ms
+}
+
+func randomPoint(gen *rand.Generator, origin [3]float64, r float64) [3]float32 {
+	for {
+		x, y, z := gen.Uniform(-1, 1), gen.Uniform(-1, 1), gen.Uniform(-1, 1)
+		norm := math.Sqrt(x*x + y*y + z*z)
+		if norm < 1 && norm > 0 {
+			return [3]float32{
+				float32(origin[0] + r*x/norm),
+				float32(origin[1] + r*y/norm),
+				float32(origin[2] + r*z/norm),
+			}
+		}
+	}
+}
+
+func TestFitShell(t *testing.T) {
+	p := DefaultShellParams()
+	p.Rings, p.Spokes, p.RadialBins = 10, 64, 128
+	p.SmoothingWindow = 31
+
+	// The halo straddles the box's edge.
+	origin, L := [3]float64{0.5, 50, 50}, 100.0
+	xs, ms := splashbackHalo(origin, 1.5, 20000, 1)
+	for i := range xs {
+		if xs[i][0] < 0 {
+			xs[i][0] += float32(L)
+		}
+	}
+	x0 := xs[0]
+
+	shell, err := FitShell(xs, ms, origin, 1, L, 2, p)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if xs[0] != x0 {
+		t.Errorf("FitShell modified the input particles.")
+	}
+	if len(shell.Coeffs) != 2*p.Order*p.Order {
+		t.Errorf("Expected %d coefficients, got %d.",
+			2*p.Order*p.Order, len(shell.Coeffs))
+	}
+
+	if _, err = FitShell(xs, ms[:10], origin, 1, L, 2, p); err == nil {
+		t.Errorf("Expected an error for mismatched masses.")
+	}
+	if _, err = FitShell(xs, ms, origin, -1, L, 2, p); err == nil {
+		t.Errorf("Expected an error for a negative radius.")
+	}
+}
+
+func TestSplashbackPoints(t *testing.T) {
+	p := DefaultShellParams()
+	p.Rings, p.Spokes, p.RadialBins = 10, 64, 128
+	p.SmoothingWindow = 31
+
+	origin := [3]float64{50, 50, 50}
+	xs, ms := splashbackHalo(origin, 1.5, 20000, 1)
+	h := NewHalo(origin, 1, 2, minMass(ms), p)
+	InsertParticles(h, xs, ms, 100, p)
+
+	buf := make([]analyze.RingBuffer, p.Rings)
+	for i := range buf {
+		buf[i].Init(p.Spokes, p.RadialBins)
+	}
+	pxs, pys, ok := SplashbackPoints(h, buf, p)
+	if !ok {
+		t.Fatalf("Expected splashback points to be found.")
+	}
+
+	rs := []float64{}
+	for i := range pxs {
+		for j := range pxs[i] {
+			rs = append(rs, math.Sqrt(pxs[i][j]*pxs[i][j]+pys[i][j]*pys[i][j]))
+		}
+	}
+	sort.Float64s(rs)
+	if med := rs[len(rs)/2]; math.Abs(med-1.5) > 0.1 {
+		t.Errorf("Expected the median splashback point to be at 1.5, "+
+			"got %g.", med)
+	}
+}
+
+func TestRingNormals(t *testing.T) {
+	axes := RingNormals(3, 0)
+	if axes[0] != [3]float32{0, 0, 1} || axes[2] != [3]float32{1, 0, 0} {
+		t.Errorf("Expected three rings to be axis-aligned, got %v.", axes)
+	}
+
+	vecs := RingNormals(20, 7)
+	for i, v := range vecs {
+		norm := math.Sqrt(float64(v[0]*v[0] + v[1]*v[1] + v[2]*v[2]))
+		if math.Abs(norm-1) > 1e-5 {
+			t.Errorf("Normal %d has length %g.", i, norm)
+		}
+	}
+	again := RingNormals(20, 7)
+	for i := range vecs {
+		if vecs[i] != again[i] {
+			t.Errorf("RingNormals isn't deterministic for a fixed seed.")
+			break
+		}
+	}
+}
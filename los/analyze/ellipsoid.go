@@ -0,0 +1,164 @@
+package analyze
+
+import (
+	"math"
+
+	"github.com/phil-mansfield/shellfish/los"
+	"github.com/phil-mansfield/shellfish/math/mat"
+)
+
+// Ellipsoid is a triaxial ellipsoid. Axes are sorted so that
+// Axes[0] >= Axes[1] >= Axes[2] and Vecs[i] is the unit vector pointing along
+// Axes[i].
+type Ellipsoid struct {
+	Center [3]float64
+	Axes   [3]float64
+	Vecs   [3][3]float64
+}
+
+// EllipsoidCoeffs fits a triaxial ellipsoid to a set of points by linear
+// least squares on the general quadric
+//
+//	A x^2 + B y^2 + C z^2 + 2D xy + 2E xz + 2F yz + 2G x + 2H y + 2I z = 1.
+//
+// ok is false if there are too few points or if the best fit quadric is not
+// an ellipsoid.
+func EllipsoidCoeffs(xs, ys, zs []float64) (e Ellipsoid, ok bool) {
+	if len(xs) < 9 {
+		return e, false
+	}
+
+	// Build the normal equations.
+	ns, rhs := make([]float64, 9*9), make([]float64, 9)
+	row := make([]float64, 9)
+	for n := range xs {
+		x, y, z := xs[n], ys[n], zs[n]
+		row[0], row[1], row[2] = x*x, y*y, z*z
+		row[3], row[4], row[5] = 2*x*y, 2*x*z, 2*y*z
+		row[6], row[7], row[8] = 2*x, 2*y, 2*z
+		for i := 0; i < 9; i++ {
+			rhs[i] += row[i]
+			for j := 0; j < 9; j++ {
+				ns[i*9+j] += row[i] * row[j]
+			}
+		}
+	}
+	q := mat.NewMatrix(ns, 9, 9).SolveVector(rhs)
+
+	m := [3][3]float64{
+		{q[0], q[3], q[4]},
+		{q[3], q[1], q[5]},
+		{q[4], q[5], q[2]},
+	}
+	g := []float64{-q[6], -q[7], -q[8]}
+	c := mat.NewMatrix([]float64{
+		m[0][0], m[0][1], m[0][2],
+		m[1][0], m[1][1], m[1][2],
+		m[2][0], m[2][1], m[2][2],
+	}, 3, 3).SolveVector(g)
+
+	// Moving to the center gives (x - c)^T M (x - c) = 1 + c^T M c.
+	k := 1.0
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			k += c[i] * m[i][j] * c[j]
+		}
+	}
+
+	vals, vecs := symEigen3(m)
+	for i := 0; i < 3; i++ {
+		if vals[i]/k <= 0 || math.IsNaN(vals[i]/k) {
+			return e, false
+		}
+		e.Axes[i] = math.Sqrt(k / vals[i])
+		e.Vecs[i] = vecs[i]
+	}
+	e.Center = [3]float64{c[0], c[1], c[2]}
+
+	// Sort from the major axis to the minor axis.
+	for i := 0; i < 3; i++ {
+		for j := i + 1; j < 3; j++ {
+			if e.Axes[j] > e.Axes[i] {
+				e.Axes[i], e.Axes[j] = e.Axes[j], e.Axes[i]
+				e.Vecs[i], e.Vecs[j] = e.Vecs[j], e.Vecs[i]
+			}
+		}
+	}
+
+	return e, true
+}
+
+// EllipsoidVolumeFit fits an ellipsoid to a set of points constrained to a
+// collection of planes belonging to an los.Halo object. The center of the
+// ellipsoid is relative to the origin of the halo.
+//
+// This function is essentially just a wrapper around EllipsoidCoeffs.
+func EllipsoidVolumeFit(
+	xs, ys [][]float64, h *los.Halo,
+) (e Ellipsoid, ok bool) {
+	n := 0
+	for i := range xs {
+		n += len(xs[i])
+	}
+	fXs, fYs, fZs := make([]float64, n), make([]float64, n), make([]float64, n)
+
+	idx := 0
+	for i := range xs {
+		for j := range xs[i] {
+			fXs[idx], fYs[idx], fZs[idx] =
+				h.PlaneToVolume(i, xs[i][j], ys[i][j])
+			idx++
+		}
+	}
+
+	return EllipsoidCoeffs(fXs, fYs, fZs)
+}
+
+// symEigen3 computes the eigenvalues and unit eigenvectors of a symmetric
+// 3x3 matrix with cyclic Jacobi rotations. vecs[i] corresponds to vals[i].
+func symEigen3(m [3][3]float64) (vals [3]float64, vecs [3][3]float64) {
+	a := m
+	v := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+	for sweep := 0; sweep < 50; sweep++ {
+		off := a[0][1]*a[0][1] + a[0][2]*a[0][2] + a[1][2]*a[1][2]
+		if off == 0 {
+			break
+		}
+
+		for p := 0; p < 2; p++ {
+			for q := p + 1; q < 3; q++ {
+				if a[p][q] == 0 {
+					continue
+				}
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := 1 / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				if theta < 0 {
+					t = -t
+				}
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+
+				// a <- J^T a J, v <- v J
+				for k := 0; k < 3; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p], a[k][q] = c*akp-s*akq, s*akp+c*akq
+				}
+				for k := 0; k < 3; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k], a[q][k] = c*apk-s*aqk, s*apk+c*aqk
+				}
+				for k := 0; k < 3; k++ {
+					vkp, vkq := v[k][p], v[k][q]
+					v[k][p], v[k][q] = c*vkp-s*vkq, s*vkp+c*vkq
+				}
+			}
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		vals[i] = a[i][i]
+		vecs[i] = [3]float64{v[0][i], v[1][i], v[2][i]}
+	}
+	return vals, vecs
+}
@@ -0,0 +1,58 @@
+package analyze
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestEllipsoidCoeffs(t *testing.T) {
+	// A rotated ellipsoid with a = 3, b = 2, c = 1 and an offset center.
+	axes := [3]float64{3, 2, 1}
+	center := [3]float64{0.5, -0.25, 0.1}
+	s, c := math.Sincos(math.Pi / 6)
+	vecs := [3][3]float64{{c, s, 0}, {-s, c, 0}, {0, 0, 1}}
+
+	n := 200
+	xs, ys, zs := make([]float64, n), make([]float64, n), make([]float64, n)
+	for i := 0; i < n; i++ {
+		phi := 2 * math.Pi * rand.Float64()
+		th := math.Acos(2*rand.Float64() - 1)
+		u := [3]float64{
+			math.Sin(th) * math.Cos(phi), math.Sin(th) * math.Sin(phi),
+			math.Cos(th),
+		}
+		p := center
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				p[k] += axes[j] * u[j] * vecs[j][k]
+			}
+		}
+		xs[i], ys[i], zs[i] = p[0], p[1], p[2]
+	}
+
+	e, ok := EllipsoidCoeffs(xs, ys, zs)
+	if !ok {
+		t.Fatalf("EllipsoidCoeffs failed to fit an ellipsoid.")
+	}
+	for i := 0; i < 3; i++ {
+		if math.Abs(e.Axes[i]-axes[i]) > 1e-6 {
+			t.Errorf("Expected axes %v, got %v.", axes, e.Axes)
+		}
+		if math.Abs(e.Center[i]-center[i]) > 1e-6 {
+			t.Errorf("Expected center %v, got %v.", center, e.Center)
+		}
+		dot := 0.0
+		for k := 0; k < 3; k++ {
+			dot += e.Vecs[i][k] * vecs[i][k]
+		}
+		if math.Abs(math.Abs(dot)-1) > 1e-6 {
+			t.Errorf("Expected axis %d along %v, got %v.",
+				i, vecs[i], e.Vecs[i])
+		}
+	}
+
+	if _, ok := EllipsoidCoeffs(xs[:5], ys[:5], zs[:5]); ok {
+		t.Errorf("Expected fit with 5 points to fail.")
+	}
+}
@@ -0,0 +1,68 @@
+package analyze
+
+import (
+	"math"
+
+	"github.com/phil-mansfield/shellfish/los"
+	"github.com/phil-mansfield/shellfish/math/sort"
+)
+
+// MaskFilaments finds lines of sight which pass through filaments and marks
+// their splashback points as invalid. Each line of sight is normalized by the
+// mean of its log-density over the outer half of its radial bins, and lines of
+// sight whose normalization is more than sigma robust standard deviations
+// above the median are taken to be filaments. rs must already have had
+// Splashback called on them. The number of masked lines of sight is returned.
+func MaskFilaments(rs []RingBuffer, h *los.Halo, sigma float64) int {
+	norms := []float64{}
+	for ring := range rs {
+		r := &rs[ring]
+		for i := 0; i < r.N; i++ {
+			h.GetRhos(ring, i, r.profRhos)
+			sum := 0.0
+			for j := r.Bins / 2; j < r.Bins; j++ {
+				sum += math.Log(r.profRhos[j])
+			}
+			norms = append(norms, sum/float64(r.Bins-r.Bins/2))
+		}
+	}
+
+	outliers := filamentOutliers(norms, sigma)
+	masked, idx := 0, 0
+	for ring := range rs {
+		r := &rs[ring]
+		for i := 0; i < r.N; i++ {
+			if outliers[idx] {
+				if r.Oks[i] {
+					masked++
+				}
+				r.Oks[i] = false
+			}
+			idx++
+		}
+	}
+
+	return masked
+}
+
+// filamentOutliers returns a flag for each element of norms which is more
+// than sigma robust standard deviations above the median. The robust standard
+// deviation is estimated from the median absolute deviation.
+func filamentOutliers(norms []float64, sigma float64) []bool {
+	out := make([]bool, len(norms))
+	if len(norms) < 3 {
+		return out
+	}
+
+	med := sort.Median(norms)
+	devs := make([]float64, len(norms))
+	for i := range norms {
+		devs[i] = math.Abs(norms[i] - med)
+	}
+	std := 1.4826 * sort.Median(devs)
+
+	for i := range norms {
+		out[i] = norms[i] > med+sigma*std
+	}
+	return out
+}
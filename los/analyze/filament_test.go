@@ -0,0 +1,32 @@
+package analyze
+
+import (
+	"testing"
+)
+
+func TestFilamentOutliers(t *testing.T) {
+	tests := []struct {
+		norms    []float64
+		sigma    float64
+		expected []bool
+	}{
+		{[]float64{1, 1}, 1, []bool{false, false}},
+		{[]float64{1, 2, 3, 2, 1, 2, 10}, 3,
+			[]bool{false, false, false, false, false, false, true}},
+		// Underdense lines of sight are never masked.
+		{[]float64{-10, 1, 2, 3, 2, 1, 2}, 3,
+			[]bool{false, false, false, false, false, false, false}},
+		{[]float64{1, 2, 3, 2, 1, 2, 10}, 20,
+			[]bool{false, false, false, false, false, false, false}},
+	}
+
+	for i, test := range tests {
+		out := filamentOutliers(test.norms, test.sigma)
+		for j := range out {
+			if out[j] != test.expected[j] {
+				t.Errorf("%d) Expected %v, got %v.", i, test.expected, out)
+				break
+			}
+		}
+	}
+}
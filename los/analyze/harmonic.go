@@ -0,0 +1,180 @@
+package analyze
+
+import (
+	"math"
+
+	"github.com/phil-mansfield/shellfish/los"
+	"github.com/phil-mansfield/shellfish/math/mat"
+)
+
+// HarmonicCoeffs fits a shell made of real spherical harmonics up to degree
+// lMax to a set of input points. The fit is a penalized least squares fit
+// where each coefficient a_lm is penalized by lambda * N * (l(l+1))^2 * a_lm^2,
+// with N the number of points. Larger values of lambda give smoother shells.
+//
+// Coefficients are ordered by l and then by m from -l to l, so there are
+// (lMax + 1)^2 of them.
+func HarmonicCoeffs(xs, ys, zs []float64, lMax int, lambda float64) []float64 {
+	n := (lMax + 1) * (lMax + 1)
+	ns, rhs := make([]float64, n*n), make([]float64, n)
+	row := make([]float64, n)
+
+	for i := range xs {
+		r := math.Sqrt(xs[i]*xs[i] + ys[i]*ys[i] + zs[i]*zs[i])
+		phi, theta := math.Atan2(ys[i], xs[i]), math.Acos(zs[i]/r)
+		realHarmonics(phi, theta, lMax, row)
+		for j := 0; j < n; j++ {
+			rhs[j] += row[j] * r
+			for k := 0; k < n; k++ {
+				ns[j*n+k] += row[j] * row[k]
+			}
+		}
+	}
+
+	for l := 0; l <= lMax; l++ {
+		ll := float64(l * (l + 1))
+		for j := l * l; j < (l+1)*(l+1); j++ {
+			ns[j*n+j] += lambda * float64(len(xs)) * ll * ll
+		}
+	}
+
+	return mat.NewMatrix(ns, n, n).SolveVector(rhs)
+}
+
+// HarmonicFunc returns a shell function corresponding to a particular set of
+// spherical harmonic coefficients.
+func HarmonicFunc(cs []float64, lMax int) Shell {
+	return func(phi, theta float64) float64 {
+		ys := make([]float64, len(cs))
+		realHarmonics(phi, theta, lMax, ys)
+		sum := 0.0
+		for i := range cs {
+			sum += cs[i] * ys[i]
+		}
+		return sum
+	}
+}
+
+// HarmonicVolumeFit fits a spherical harmonic shell to a set of points
+// constrained to a collection of planes belonging to an los.Halo object.
+//
+// This function is essentially just a wrapper around HarmonicCoeffs.
+func HarmonicVolumeFit(
+	xs, ys [][]float64, h *los.Halo, lMax int, lambda float64,
+) (cs []float64, shell Shell) {
+	n := 0
+	for i := range xs {
+		n += len(xs[i])
+	}
+	fXs, fYs, fZs := make([]float64, n), make([]float64, n), make([]float64, n)
+
+	idx := 0
+	for i := range xs {
+		for j := range xs[i] {
+			fXs[idx], fYs[idx], fZs[idx] =
+				h.PlaneToVolume(i, xs[i][j], ys[i][j])
+			idx++
+		}
+	}
+
+	cs = HarmonicCoeffs(fXs, fYs, fZs, lMax, lambda)
+	return cs, HarmonicFunc(cs, lMax)
+}
+
+// PowerSpectrum returns the angular power spectrum of a shell's radius field,
+// C_l = sum_m a_lm^2 / (2l + 1), for every degree from 0 to lMax. The a_lm are
+// found by integrating the shell against the real spherical harmonics on a
+// grid of roughly the given number of points which is uniform in cos(theta)
+// and phi. Since C_l is invariant under rotations, it doesn't depend on how
+// the shell is oriented.
+func (s Shell) PowerSpectrum(lMax, samples int) []float64 {
+	n := int(math.Ceil(math.Sqrt(float64(samples) / 2)))
+	size := (lMax + 1) * (lMax + 1)
+	as, ys := make([]float64, size), make([]float64, size)
+
+	// Midpoint quadrature in cos(theta) and phi.
+	dMu, dPhi := 2/float64(n), math.Pi/float64(n)
+	for i := 0; i < n; i++ {
+		theta := math.Acos(-1 + (float64(i)+0.5)*dMu)
+		for j := 0; j < 2*n; j++ {
+			phi := (float64(j) + 0.5) * dPhi
+			r := s(phi, theta)
+			realHarmonics(phi, theta, lMax, ys)
+			for k := range as {
+				as[k] += r * ys[k] * dMu * dPhi
+			}
+		}
+	}
+
+	cls := make([]float64, lMax+1)
+	for l := range cls {
+		for k := l * l; k < (l+1)*(l+1); k++ {
+			cls[l] += as[k] * as[k]
+		}
+		cls[l] /= float64(2*l + 1)
+	}
+	return cls
+}
+
+// realHarmonics writes the orthonormal real spherical harmonics up to degree
+// lMax at the given angle to out in the same order as HarmonicCoeffs.
+func realHarmonics(phi, theta float64, lMax int, out []float64) {
+	x := math.Cos(theta)
+	for l := 0; l <= lMax; l++ {
+		for m := 0; m <= l; m++ {
+			// Normalization of the complex harmonic with order m.
+			norm := math.Sqrt(float64(2*l+1) / (4 * math.Pi) *
+				factorialRatio(l-m, l+m))
+			p := norm * assocLegendre(l, m, x)
+			if m == 0 {
+				out[l*l+l] = p
+			} else {
+				sin, cos := math.Sincos(float64(m) * phi)
+				out[l*l+l+m] = math.Sqrt2 * p * cos
+				out[l*l+l-m] = math.Sqrt2 * p * sin
+			}
+		}
+	}
+}
+
+// factorialRatio returns a! / b!.
+func factorialRatio(a, b int) float64 {
+	out := 1.0
+	for i := a + 1; i <= b; i++ {
+		out /= float64(i)
+	}
+	for i := b + 1; i <= a; i++ {
+		out *= float64(i)
+	}
+	return out
+}
+
+// assocLegendre returns the associated Legendre polynomial P_l^m(x) without
+// the Condon-Shortley phase for 0 <= m <= l.
+func assocLegendre(l, m int, x float64) float64 {
+	pmm := 1.0
+	if m > 0 {
+		somx2 := math.Sqrt((1 - x) * (1 + x))
+		fact := 1.0
+		for i := 1; i <= m; i++ {
+			pmm *= fact * somx2
+			fact += 2
+		}
+	}
+	if l == m {
+		return pmm
+	}
+
+	pmmp1 := x * float64(2*m+1) * pmm
+	if l == m+1 {
+		return pmmp1
+	}
+
+	pll := 0.0
+	for ll := m + 2; ll <= l; ll++ {
+		pll = (x*float64(2*ll-1)*pmmp1 - float64(ll+m-1)*pmm) /
+			float64(ll-m)
+		pmm, pmmp1 = pmmp1, pll
+	}
+	return pll
+}
@@ -0,0 +1,111 @@
+package analyze
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestRealHarmonicsOrthonormal(t *testing.T) {
+	lMax, n := 3, 200
+	size := (lMax + 1) * (lMax + 1)
+	sums := make([]float64, size*size)
+	ys := make([]float64, size)
+
+	// Midpoint quadrature in cos(theta) and phi.
+	dMu, dPhi := 2/float64(n), 2*math.Pi/float64(n)
+	for i := 0; i < n; i++ {
+		theta := math.Acos(-1 + (float64(i)+0.5)*dMu)
+		for j := 0; j < n; j++ {
+			phi := (float64(j) + 0.5) * dPhi
+			realHarmonics(phi, theta, lMax, ys)
+			for a := 0; a < size; a++ {
+				for b := 0; b < size; b++ {
+					sums[a*size+b] += ys[a] * ys[b] * dMu * dPhi
+				}
+			}
+		}
+	}
+
+	for a := 0; a < size; a++ {
+		for b := 0; b < size; b++ {
+			expected := 0.0
+			if a == b {
+				expected = 1
+			}
+			if math.Abs(sums[a*size+b]-expected) > 1e-3 {
+				t.Errorf("<Y_%d, Y_%d> = %g, expected %g.",
+					a, b, sums[a*size+b], expected)
+			}
+		}
+	}
+}
+
+func TestHarmonicCoeffs(t *testing.T) {
+	// r = 2 + 0.3 cos(theta) + 0.1 sin^2(theta) cos(2 phi) is exactly
+	// representable with lMax = 2.
+	rFunc := func(phi, theta float64) float64 {
+		st, ct := math.Sincos(theta)
+		return 2 + 0.3*ct + 0.1*st*st*math.Cos(2*phi)
+	}
+
+	n := 500
+	xs, ys, zs := make([]float64, n), make([]float64, n), make([]float64, n)
+	for i := 0; i < n; i++ {
+		phi := 2 * math.Pi * rand.Float64()
+		theta := math.Acos(2*rand.Float64() - 1)
+		r := rFunc(phi, theta)
+		st, ct := math.Sincos(theta)
+		sp, cp := math.Sincos(phi)
+		xs[i], ys[i], zs[i] = r*st*cp, r*st*sp, r*ct
+	}
+
+	cs := HarmonicCoeffs(xs, ys, zs, 2, 0)
+	shell := HarmonicFunc(cs, 2)
+	for i := 0; i < 20; i++ {
+		phi := 2 * math.Pi * rand.Float64()
+		theta := math.Acos(2*rand.Float64() - 1)
+		r, expected := shell(phi, theta), rFunc(phi, theta)
+		if math.Abs(r-expected) > 1e-8 {
+			t.Errorf("shell(%g, %g) = %g, expected %g.",
+				phi, theta, r, expected)
+		}
+	}
+
+	// Heavy smoothing should leave only the monopole.
+	cs = HarmonicCoeffs(xs, ys, zs, 2, 1e6)
+	for i := 1; i < len(cs); i++ {
+		if math.Abs(cs[i]) > 1e-4 {
+			t.Errorf("Expected smoothed coefficient %d to vanish, got %g.",
+				i, cs[i])
+		}
+	}
+}
+
+func TestPowerSpectrum(t *testing.T) {
+	// r = 2 + 0.3 cos(theta) has a_00 = 2 sqrt(4 pi) and
+	// a_10 = 0.3 sqrt(4 pi / 3).
+	shell := func(phi, theta float64) float64 {
+		return 2 + 0.3*math.Cos(theta)
+	}
+	expected := []float64{16 * math.Pi, 0.04 * math.Pi, 0}
+
+	cls := Shell(shell).PowerSpectrum(2, 20000)
+	for l := range expected {
+		if math.Abs(cls[l]-expected[l]) > 1e-3 {
+			t.Errorf("C_%d = %g, expected %g.", l, cls[l], expected[l])
+		}
+	}
+
+	// Rotating the shell doesn't change its power spectrum.
+	rotated := func(phi, theta float64) float64 {
+		return 2 + 0.3*math.Sin(theta)*math.Cos(phi)
+	}
+	rCls := Shell(rotated).PowerSpectrum(2, 20000)
+	for l := range cls {
+		if math.Abs(cls[l]-rCls[l]) > 1e-3 {
+			t.Errorf("C_%d = %g for the rotated shell, expected %g.",
+				l, rCls[l], cls[l])
+		}
+	}
+}
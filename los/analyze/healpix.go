@@ -0,0 +1,66 @@
+package analyze
+
+import (
+	"math"
+)
+
+// HealpixMap evaluates a shell at the center of every pixel of a HEALPix map
+// with the given nside. Pixels are in the RING ordering scheme, so the returned
+// slice has 12 * nside^2 elements.
+func HealpixMap(s Shell, nside int) []float64 {
+	out := make([]float64, 12*nside*nside)
+	for pix := range out {
+		theta, phi := HealpixAngle(nside, pix)
+		out[pix] = s(phi, theta)
+	}
+	return out
+}
+
+// HealpixAngle returns the polar and azimuthal angles of the center of a pixel
+// in a RING-ordered HEALPix map with the given nside.
+func HealpixAngle(nside, pix int) (theta, phi float64) {
+	npix, ncap := 12*nside*nside, 2*nside*(nside-1)
+	fNside := float64(nside)
+
+	var z float64
+	switch {
+	case pix < ncap:
+		// North polar cap.
+		iring := (1 + isqrt(1+2*pix)) / 2
+		iphi := pix + 1 - 2*iring*(iring-1)
+		z = 1 - float64(iring*iring)/(3*fNside*fNside)
+		phi = (float64(iphi) - 0.5) * math.Pi / float64(2*iring)
+	case pix < npix-ncap:
+		// Equatorial belt.
+		ip := pix - ncap
+		iring := ip/(4*nside) + nside
+		iphi := ip%(4*nside) + 1
+		fodd := 0.5
+		if (iring+nside)%2 == 1 {
+			fodd = 1
+		}
+		z = float64(2*nside-iring) * 2 / (3 * fNside)
+		phi = (float64(iphi) - fodd) * math.Pi / (2 * fNside)
+	default:
+		// South polar cap.
+		ip := npix - pix
+		iring := (1 + isqrt(2*ip-1)) / 2
+		iphi := 4*iring + 1 - (ip - 2*iring*(iring-1))
+		z = -1 + float64(iring*iring)/(3*fNside*fNside)
+		phi = (float64(iphi) - 0.5) * math.Pi / float64(2*iring)
+	}
+
+	return math.Acos(z), phi
+}
+
+// isqrt returns the largest integer whose square is no larger than x.
+func isqrt(x int) int {
+	r := int(math.Sqrt(float64(x)))
+	for r*r > x {
+		r--
+	}
+	for (r+1)*(r+1) <= x {
+		r++
+	}
+	return r
+}
@@ -0,0 +1,60 @@
+package analyze
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHealpixAngle(t *testing.T) {
+	tests := []struct {
+		nside, pix int
+		theta, phi float64
+	}{
+		{1, 0, math.Acos(2.0 / 3), math.Pi / 4},
+		{1, 4, math.Pi / 2, 0},
+		{1, 11, math.Acos(-2.0 / 3), 7 * math.Pi / 4},
+		{2, 0, math.Acos(11.0 / 12), math.Pi / 4},
+		{2, 47, math.Acos(-11.0 / 12), 7 * math.Pi / 4},
+	}
+
+	for i, test := range tests {
+		theta, phi := HealpixAngle(test.nside, test.pix)
+		if math.Abs(theta-test.theta) > 1e-10 ||
+			math.Abs(phi-test.phi) > 1e-10 {
+			t.Errorf("%d) Expected HealpixAngle(%d, %d) = (%g, %g), got "+
+				"(%g, %g).", i, test.nside, test.pix, test.theta, test.phi,
+				theta, phi)
+		}
+	}
+}
+
+func TestHealpixMap(t *testing.T) {
+	// HEALPix pixels have equal areas, so the mean of z over the sphere
+	// should vanish and the mean of z^2 should be 1/3.
+	zShell := func(phi, theta float64) float64 { return math.Cos(theta) }
+	z2Shell := func(phi, theta float64) float64 {
+		return math.Cos(theta) * math.Cos(theta)
+	}
+
+	for _, nside := range []int{1, 2, 4, 16} {
+		zs, z2s := HealpixMap(zShell, nside), HealpixMap(z2Shell, nside)
+		if len(zs) != 12*nside*nside {
+			t.Errorf("Expected %d pixels for nside = %d, got %d.",
+				12*nside*nside, nside, len(zs))
+		}
+
+		zSum, z2Sum := 0.0, 0.0
+		for i := range zs {
+			zSum += zs[i]
+			z2Sum += z2s[i]
+		}
+		zMean, z2Mean := zSum/float64(len(zs)), z2Sum/float64(len(zs))
+		if math.Abs(zMean) > 1e-10 {
+			t.Errorf("Expected <z> = 0 for nside = %d, got %g.", nside, zMean)
+		}
+		if math.Abs(z2Mean-1.0/3) > 0.1/float64(nside*nside) {
+			t.Errorf("Expected <z^2> = 1/3 for nside = %d, got %g.",
+				nside, z2Mean)
+		}
+	}
+}
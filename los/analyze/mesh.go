@@ -0,0 +1,51 @@
+package analyze
+
+import (
+	"math"
+)
+
+// Mesh returns a triangulated surface for a shell. Vertices are placed on a
+// grid of nTheta polar angles and 2*nTheta azimuthal angles, plus one vertex
+// at each pole, and are moved out to the radius of the shell along their
+// direction. Faces are given as indices into vs and are wound so that their
+// normals point outwards.
+func (s Shell) Mesh(nTheta int) (vs [][3]float64, faces [][3]int) {
+	nPhi := 2 * nTheta
+	vs = make([][3]float64, 0, 2+(nTheta-1)*nPhi)
+
+	addVertex := func(phi, theta float64) {
+		x, y, z := cartesian(phi, theta, s(phi, theta))
+		vs = append(vs, [3]float64{x, y, z})
+	}
+
+	addVertex(0, 0)
+	for i := 1; i < nTheta; i++ {
+		theta := math.Pi * float64(i) / float64(nTheta)
+		for j := 0; j < nPhi; j++ {
+			addVertex(2*math.Pi*float64(j)/float64(nPhi), theta)
+		}
+	}
+	addVertex(0, math.Pi)
+
+	// ring returns the index of the jth vertex in the ith ring, starting
+	// from 1.
+	ring := func(i, j int) int { return 1 + (i-1)*nPhi + j%nPhi }
+	south := len(vs) - 1
+
+	for j := 0; j < nPhi; j++ {
+		faces = append(faces, [3]int{0, ring(1, j), ring(1, j+1)})
+	}
+	for i := 1; i < nTheta-1; i++ {
+		for j := 0; j < nPhi; j++ {
+			a, b := ring(i, j), ring(i, j+1)
+			c, d := ring(i+1, j), ring(i+1, j+1)
+			faces = append(faces, [3]int{a, c, d}, [3]int{a, d, b})
+		}
+	}
+	for j := 0; j < nPhi; j++ {
+		faces = append(faces,
+			[3]int{south, ring(nTheta-1, j+1), ring(nTheta-1, j)})
+	}
+
+	return vs, faces
+}
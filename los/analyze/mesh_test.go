@@ -0,0 +1,61 @@
+package analyze
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMesh(t *testing.T) {
+	s := Shell(func(phi, theta float64) float64 {
+		return 1 + 0.2*math.Cos(theta)
+	})
+
+	for _, nTheta := range []int{2, 3, 8} {
+		vs, faces := s.Mesh(nTheta)
+
+		nPhi := 2 * nTheta
+		if len(vs) != 2+(nTheta-1)*nPhi {
+			t.Errorf("nTheta = %d: expected %d vertices, got %d.",
+				nTheta, 2+(nTheta-1)*nPhi, len(vs))
+		}
+
+		// A closed triangulated surface with the topology of a sphere has
+		// V - E + F = 2, with E = 3F/2.
+		if 2*len(vs)-len(faces) != 4 {
+			t.Errorf("nTheta = %d: %d vertices and %d faces don't form a "+
+				"closed surface.", nTheta, len(vs), len(faces))
+		}
+
+		for i, v := range vs {
+			r := math.Sqrt(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])
+			if math.Abs(r-(1+0.2*v[2]/r)) > 1e-10 {
+				t.Errorf("nTheta = %d: vertex %d, %v, is not on the shell.",
+					nTheta, i, v)
+			}
+		}
+
+		// Every face should point away from the origin.
+		for i, f := range faces {
+			a, b, c := vs[f[0]], vs[f[1]], vs[f[2]]
+			n := cross(sub(b, a), sub(c, a))
+			center := [3]float64{
+				(a[0] + b[0] + c[0]) / 3, (a[1] + b[1] + c[1]) / 3,
+				(a[2] + b[2] + c[2]) / 3,
+			}
+			if n[0]*center[0]+n[1]*center[1]+n[2]*center[2] <= 0 {
+				t.Errorf("nTheta = %d: face %d, %v, points inwards.",
+					nTheta, i, f)
+			}
+		}
+	}
+}
+
+func sub(a, b [3]float64) [3]float64 {
+	return [3]float64{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+func cross(a, b [3]float64) [3]float64 {
+	return [3]float64{
+		a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0],
+	}
+}
@@ -53,9 +53,10 @@ func (r *RingBuffer) Clear() {
 }
 
 // Splashback calculates the candidate splashback radius for a given line of
-// sight and stores the relevant information in the RingBuffer.
+// sight and stores the relevant information in the RingBuffer. Any opts are
+// passed on to Smooth.
 func (r *RingBuffer) Splashback(
-	h *los.Halo, ring int, window int, dLim float64,
+	h *los.Halo, ring int, window int, dLim float64, opts ...SmoothOption,
 ) {
 	h.GetRs(r.profRs)
 	ls := new(geom.LineSegment)
@@ -63,8 +64,10 @@ func (r *RingBuffer) Splashback(
 		h.GetRhos(ring, i, r.profRhos)
 
 		_, _, r.Oks[i] = Smooth(
-			r.profRs, r.profRhos, window,
-			Vals(r.smoothRhos), Derivs(r.smoothDerivs),
+			r.profRs, r.profRhos, window, append(
+				[]SmoothOption{Vals(r.smoothRhos), Derivs(r.smoothDerivs)},
+				opts...,
+			)...,
 		)
 
 		if !r.Oks[i] {
@@ -77,21 +80,61 @@ func (r *RingBuffer) Splashback(
 		if !r.Oks[i] {
 			continue
 		}
+		r.setCoords(h, ring, i, ls)
+	}
+}
+
+// MinimumSlope calculates the radius where the logarithmic slope of the
+// density is most negative between rMin and rMax for a given line of sight
+// and stores the relevant information in the RingBuffer. This is an
+// alternative to Splashback. Any opts are passed on to Smooth.
+func (r *RingBuffer) MinimumSlope(
+	h *los.Halo, ring int, window int, rMin, rMax float64,
+	opts ...SmoothOption,
+) {
+	h.GetRs(r.profRs)
+	ls := new(geom.LineSegment)
+	for i := 0; i < r.N; i++ {
+		h.GetRhos(ring, i, r.profRhos)
+
+		_, _, r.Oks[i] = Smooth(
+			r.profRs, r.profRhos, window, append(
+				[]SmoothOption{Vals(r.smoothRhos), Derivs(r.smoothDerivs)},
+				opts...,
+			)...,
+		)
 
-		r.Phis[i] = float64(h.Phi(i))
-		if r.Phis[i] < 0 {
-			r.Phis[i] += math.Pi
+		if !r.Oks[i] {
+			continue
 		}
-		sin, cos := math.Sincos(r.Phis[i])
-		r.PlaneXs[i], r.PlaneYs[i] = cos*r.Rs[i], sin*r.Rs[i]
+		r.Rs[i], r.Oks[i] = MinimumSlopeRadius(
+			r.profRs, r.smoothDerivs, rMin, rMax,
+		)
 
-		h.LineSegment(ring, i, ls)
-		r.Xs[i] = r.Rs[i] * float64(ls.Dir[0])
-		r.Ys[i] = r.Rs[i] * float64(ls.Dir[1])
-		r.Zs[i] = r.Rs[i] * float64(ls.Dir[2])
+		if !r.Oks[i] {
+			continue
+		}
+		r.setCoords(h, ring, i, ls)
 	}
 }
 
+// setCoords sets the coordinates of the ith line of sight from its radius.
+func (r *RingBuffer) setCoords(
+	h *los.Halo, ring, i int, ls *geom.LineSegment,
+) {
+	r.Phis[i] = float64(h.Phi(i))
+	if r.Phis[i] < 0 {
+		r.Phis[i] += math.Pi
+	}
+	sin, cos := math.Sincos(r.Phis[i])
+	r.PlaneXs[i], r.PlaneYs[i] = cos*r.Rs[i], sin*r.Rs[i]
+
+	h.LineSegment(ring, i, ls)
+	r.Xs[i] = r.Rs[i] * float64(ls.Dir[0])
+	r.Ys[i] = r.Rs[i] * float64(ls.Dir[1])
+	r.Zs[i] = r.Rs[i] * float64(ls.Dir[2])
+}
+
 // OkPlaneCoords returns the within-plane x and y coordinates where r.Oks
 // is true.
 func (r *RingBuffer) OkPlaneCoords(xs, ys []float64) (okXs, okYs []float64) {
@@ -7,6 +7,7 @@ import (
 	"github.com/gonum/matrix/mat64"
 	grid "github.com/phil-mansfield/shellfish/los/analyze/ellipse_grid"
 	intr "github.com/phil-mansfield/shellfish/math/interpolate"
+	srand "github.com/phil-mansfield/shellfish/math/rand"
 	"github.com/phil-mansfield/shellfish/math/sort"
 )
 
@@ -23,6 +24,42 @@ func randomAngle() (phi, theta float64) {
 	return 2 * math.Pi * u, math.Acos(2*v - 1)
 }
 
+// monteCarloSeed is the seed used by the Monte Carlo methods of Shell, or -1
+// if they use the global random number generator.
+var monteCarloSeed int64 = -1
+
+// SetMonteCarloSeed makes the Monte Carlo methods of Shell deterministic. Each
+// call draws its samples from its own generator initialized with seed, so
+// results don't depend on the order shells are processed in or on the number
+// of threads processing them. It should be called before any goroutines use
+// Shell methods.
+func SetMonteCarloSeed(seed uint64) {
+	monteCarloSeed = int64(seed >> 1)
+}
+
+// uniformSource returns a function which generates uniform random numbers in
+// [0, 1) for a single Monte Carlo calculation.
+func uniformSource() func() float64 {
+	if monteCarloSeed < 0 {
+		return rand.Float64
+	}
+	gen := srand.New(srand.Xorshift, uint64(monteCarloSeed))
+	return func() float64 { return gen.Uniform(0, 1) }
+}
+
+// angleSource returns a function which generates angles uniformly at random
+// for a single Monte Carlo calculation.
+func angleSource() func() (phi, theta float64) {
+	if monteCarloSeed < 0 {
+		return randomAngle
+	}
+	uniform := uniformSource()
+	return func() (phi, theta float64) {
+		u, v := uniform(), uniform()
+		return 2 * math.Pi * u, math.Acos(2*v - 1)
+	}
+}
+
 // cartesian converts a tuple of radial coordinates to cartesian coordinates.
 func cartesian(phi, theta, r float64) (x, y, z float64) {
 	sinP, cosP := math.Sincos(phi)
@@ -35,11 +72,12 @@ func cartesian(phi, theta, r float64) (x, y, z float64) {
 //
 // This is slower than Volume for most shell shapes.
 func (s Shell) CartesianSampledVolume(samples int, rMax float64) float64 {
+	uniform := uniformSource()
 	inside := 0
 	for i := 0; i < samples; i++ {
-		x := rand.Float64()*(2*rMax) - rMax
-		y := rand.Float64()*(2*rMax) - rMax
-		z := rand.Float64()*(2*rMax) - rMax
+		x := uniform()*(2*rMax) - rMax
+		y := uniform()*(2*rMax) - rMax
+		z := uniform()*(2*rMax) - rMax
 
 		r := math.Sqrt(x*x + y*y + z*z)
 		phi := math.Atan2(y, x)
@@ -56,9 +94,10 @@ func (s Shell) CartesianSampledVolume(samples int, rMax float64) float64 {
 
 // Volume returns the volume of Shell.
 func (s Shell) Volume(samples int) float64 {
+	angle := angleSource()
 	sum := 0.0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := angle()
 		r := s(phi, theta)
 		sum += r * r * r
 	}
@@ -68,48 +107,106 @@ func (s Shell) Volume(samples int) float64 {
 
 // MeanRadius returns the angle-weighted mean radius of a Shell.
 func (s Shell) MeanRadius(samples int) float64 {
+	angle := angleSource()
 	sum := 0.0
 	for i := 0; i < samples; i++ {
-		phi, th := randomAngle()
+		phi, th := angle()
 		r := s(phi, th)
 		sum += r
 	}
 	return sum / float64(samples)
 }
 
+// Centroid returns the center of volume of a Shell relative to the origin
+// that the Shell is defined around.
+func (s Shell) Centroid(samples int) [3]float64 {
+	angle := angleSource()
+	sum, r3Sum := [3]float64{}, 0.0
+	for i := 0; i < samples; i++ {
+		phi, theta := angle()
+		r := s(phi, theta)
+		x, y, z := cartesian(phi, theta, 1)
+		r4 := r * r * r * r
+		sum[0] += r4 * x
+		sum[1] += r4 * y
+		sum[2] += r4 * z
+		r3Sum += r * r * r
+	}
+
+	// The volume of a cone of length r is r^3/3 dOmega and its centroid is
+	// 3/4 of the way along it.
+	for k := range sum {
+		sum[k] *= 0.75 / r3Sum
+	}
+	return sum
+}
+
 // MedianRadius returns the angle-weighted median radius of a Shell.
 func (s Shell) MedianRadius(samples int) float64 {
+	angle := angleSource()
 	rs := make([]float64, samples)
 	for i := range rs {
-		phi, th := randomAngle()
+		phi, th := angle()
 		rs[i] = s(phi, th)
 	}
 	return sort.Median(rs, rs)
 }
 
-// triSort returns x, y, and z in sorted order and returns the argument
-// index of the largest value.
-func trisort(x, y, z float64) (a, b, c float64, aIdx int) {
+// RadiusPercentiles returns angle-weighted percentiles of the radius of a
+// Shell. Each element of ps must be in the range [0, 100].
+func (s Shell) RadiusPercentiles(ps []float64, samples int) []float64 {
+	angle := angleSource()
+	rs := make([]float64, samples)
+	for i := range rs {
+		phi, th := angle()
+		rs[i] = s(phi, th)
+	}
+	sort.Quick(rs)
+
+	out := make([]float64, len(ps))
+	for i, p := range ps {
+		out[i] = rs[int(p/100*float64(len(rs)-1))]
+	}
+	return out
+}
+
+// triSort returns x, y, and z in descending order along with the argument
+// indices of each value.
+func trisort(x, y, z float64) (a, b, c float64, idxs [3]int) {
 	var p, q float64
+	var pIdx, qIdx int
 	switch {
 	case x > y && x > z:
-		a, p, q, aIdx = x, y, z, 0
+		a, p, q, idxs[0], pIdx, qIdx = x, y, z, 0, 1, 2
 	case y > x && y > z:
-		a, p, q, aIdx = y, z, x, 1
+		a, p, q, idxs[0], pIdx, qIdx = y, z, x, 1, 2, 0
 	default:
-		a, p, q, aIdx = z, x, y, 2
+		a, p, q, idxs[0], pIdx, qIdx = z, x, y, 2, 0, 1
 	}
 
 	if p > q {
-		return a, p, q, aIdx
+		idxs[1], idxs[2] = pIdx, qIdx
+		return a, p, q, idxs
 	} else {
-		return a, q, p, aIdx
+		idxs[1], idxs[2] = qIdx, pIdx
+		return a, q, p, idxs
 	}
 }
 
 // Axes calculates the moment of inertia-equivalent axes of a Shell as well
 // as the direction of the major axis.
 func (s Shell) Axes(samples int) (a, b, c float64, aVec [3]float64) {
+	a, b, c, vecs := s.PrincipalAxes(samples)
+	return a, b, c, vecs[0]
+}
+
+// PrincipalAxes calculates the moment of inertia-equivalent axes of a Shell
+// along with unit vectors pointing along the major, intermediate, and minor
+// axes, in that order. The signs of the vectors are arbitrary.
+func (s Shell) PrincipalAxes(
+	samples int,
+) (a, b, c float64, vecs [3][3]float64) {
+	angle := angleSource()
 
 	// Temporarily approximate a constant-density ellipsoidal shell as
 	// a homoeoid.
@@ -120,7 +217,7 @@ func (s Shell) Axes(samples int) (a, b, c float64, aVec [3]float64) {
 	norm := 0.0
 
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := angle()
 		r := s(phi, theta)
 		area := r * r / cosNorm(s, phi, theta)
 		x, y, z := cartesian(phi, theta, r)
@@ -155,36 +252,38 @@ func (s Shell) Axes(samples int) (a, b, c float64, aVec [3]float64) {
 	}
 
 	vals := eigen.Values(nil)
-	vecs := eigen.Vectors()
+	eVecs := eigen.Vectors()
 
 	Ix, Iy, Iz := real(vals[0]), real(vals[1]), real(vals[2])
+	// Each squared axis length goes with the eigenvector of its own
+	// eigenvalue so that the axis directions can be looked up by index.
 	ax2 := 3 * (Iy + Iz - Ix) / 2
-	ay2 := 3*Iy - ax2
-	az2 := 3*Iz - ax2
+	ay2 := 3 * (Iz + Ix - Iy) / 2
+	az2 := 3 * (Ix + Iy - Iz) / 2
 
 	// Correct the axis ratios via empirically derived tables.
 
 	// TODO: Fix naming conventions.
 
-	c, b, a, aIdx := trisort(math.Sqrt(ax2), math.Sqrt(ay2), math.Sqrt(az2))
+	c, b, a, idxs := trisort(math.Sqrt(ax2), math.Sqrt(ay2), math.Sqrt(az2))
 	ac, bc := a/c, b/c
 
-	// TODO: This function is just barely not thread safe.
-
-	acRatio := axisInterpolators.acRatio.Eval(ac, bc)
-	bcRatio := axisInterpolators.bcRatio.Eval(ac, bc)
-	cRatio := axisInterpolators.cRatio.Eval(ac, bc)
+	// The interpolators cache their last lookup, so each call needs its own
+	// reference to be thread safe.
+	acRatio := axisInterpolators.acRatio.Ref().Eval(ac, bc)
+	bcRatio := axisInterpolators.bcRatio.Ref().Eval(ac, bc)
+	cRatio := axisInterpolators.cRatio.Ref().Eval(ac, bc)
 
-	aVec = [3]float64{
-		vecs.At(0, aIdx), vecs.At(1, aIdx), vecs.At(2, aIdx),
+	for i, idx := range idxs {
+		v := [3]float64{
+			eVecs.At(0, idx), eVecs.At(1, idx), eVecs.At(2, idx),
+		}
+		norm = math.Sqrt(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])
+		vecs[i] = [3]float64{v[0] / norm, v[1] / norm, v[2] / norm}
 	}
-	norm = math.Sqrt(aVec[0]*aVec[0] + aVec[1]*aVec[1] + aVec[2]*aVec[2])
-	aVec[0] = aVec[0] / norm
-	aVec[1] = aVec[1] / norm
-	aVec[2] = aVec[2] / norm
 
 	c = cRatio * c
-	return c, bcRatio * bc * c, acRatio * ac * c, aVec
+	return c, bcRatio * bc * c, acRatio * ac * c, vecs
 }
 
 // cosNorm reutrns the cosine of the angle between \hat{r} and the normal
@@ -216,9 +315,10 @@ func cosNorm(s Shell, phi, theta float64) float64 {
 
 // SurfaceArea returns the surface area of a shell.
 func (s Shell) SurfaceArea(samples int) float64 {
+	angle := angleSource()
 	sum := 0.0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := angle()
 		r := s(phi, theta)
 		sum += r * r / cosNorm(s, phi, theta)
 	}
@@ -227,9 +327,10 @@ func (s Shell) SurfaceArea(samples int) float64 {
 
 // DiffVolume returns the volume of the space between two Shells, s1 and s2.
 func (s1 Shell) DiffVolume(s2 Shell, samples int) float64 {
+	angle := angleSource()
 	sum := 0.0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := angle()
 		r1, r2 := s1(phi, theta), s2(phi, theta)
 		r := (r1 + r2) / 2
 		dr := math.Abs(r1 - r2)
@@ -241,9 +342,10 @@ func (s1 Shell) DiffVolume(s2 Shell, samples int) float64 {
 // MaxDiff returns the maximum radial distance between two Shells along
 // any line of sight.
 func (s1 Shell) MaxDiff(s2 Shell, samples int) float64 {
+	angle := angleSource()
 	max := 0.0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := angle()
 		r1, r2 := s1(phi, theta), s2(phi, theta)
 		dr := math.Abs(r1 - r2)
 		if dr > max {
@@ -255,11 +357,12 @@ func (s1 Shell) MaxDiff(s2 Shell, samples int) float64 {
 
 // RadialRange returns the maximum and minimum radius of a Shell.
 func (s Shell) RadialRange(samples int) (low, high float64) {
-	phi, theta := randomAngle()
+	angle := angleSource()
+	phi, theta := angle()
 	low = s(phi, theta)
 	high = low
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := angle()
 		r := s(phi, theta)
 		if r > high {
 			high = r
@@ -276,6 +379,7 @@ func (s Shell) RadialRange(samples int) (low, high float64) {
 func (s Shell) RadiusHistogram(
 	samples, bins int, rMin, rMax float64,
 ) (rs, ns []float64) {
+	angle := angleSource()
 	rs, ns = make([]float64, bins), make([]float64, bins)
 	dr := (rMax - rMin) / float64(bins)
 	for i := range rs {
@@ -284,7 +388,7 @@ func (s Shell) RadiusHistogram(
 
 	count := 0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := angle()
 		r := s(phi, theta)
 		ri := (r - rMin) / dr
 		if ri < 0 {
@@ -312,6 +416,7 @@ func (s Shell) RadiusHistogram(
 func (s Shell) AngularFractionProfile(
 	samples, bins int, rMin, rMax float64,
 ) (rs, fs []float64) {
+	angle := angleSource()
 	rs, fs = make([]float64, bins), make([]float64, bins)
 	ns := make([]int, bins)
 
@@ -323,7 +428,7 @@ func (s Shell) AngularFractionProfile(
 	}
 
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := angle()
 		lr := math.Log(s(phi, theta))
 		lri := int((lr - lrMin) / dlr)
 		if lri < 0 || lri >= bins {
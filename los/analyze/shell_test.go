@@ -49,3 +49,157 @@ func TestEverything(t *testing.T) {
 	fmt.Printf("Printiple Axis: %8.4g\n", aVec)
 	fmt.Printf("Area: %8.4g\n", s.SurfaceArea(samples))
 }
+
+func TestTrisort(t *testing.T) {
+	tests := []struct {
+		x, y, z float64
+		idxs    [3]int
+	}{
+		{3, 2, 1, [3]int{0, 1, 2}},
+		{1, 3, 2, [3]int{1, 2, 0}},
+		{2, 1, 3, [3]int{2, 0, 1}},
+		{1, 2, 3, [3]int{2, 1, 0}},
+	}
+
+	for i, test := range tests {
+		a, b, c, idxs := trisort(test.x, test.y, test.z)
+		vals := [3]float64{test.x, test.y, test.z}
+		if a != 3 || b != 2 || c != 1 || idxs != test.idxs {
+			t.Errorf("%d) Expected (3, 2, 1, %v), got (%g, %g, %g, %v).",
+				i, test.idxs, a, b, c, idxs)
+		}
+		for j, v := range []float64{a, b, c} {
+			if vals[idxs[j]] != v {
+				t.Errorf("%d) Index %d points to %g, not %g.",
+					i, j, vals[idxs[j]], v)
+			}
+		}
+	}
+}
+
+func TestRadiusPercentiles(t *testing.T) {
+	tests := []struct {
+		s        Shell
+		ps       []float64
+		expected []float64
+	}{
+		{sphere(2), []float64{0, 50, 100}, []float64{2, 2, 2}},
+		{brokenSphere(1, 3), []float64{0, 25, 75, 100},
+			[]float64{1, 1, 3, 3}},
+	}
+
+	for i, test := range tests {
+		rs := test.s.RadiusPercentiles(test.ps, 10000)
+		for j := range rs {
+			if rs[j] != test.expected[j] {
+				t.Errorf("%d) Expected percentiles %v, got %v.",
+					i, test.expected, rs)
+				break
+			}
+		}
+	}
+}
+
+func TestCentroid(t *testing.T) {
+	// A sphere of radius R centered at (d, 0, 0).
+	R, d := 2.0, 0.5
+	offset := func(phi, theta float64) float64 {
+		mu := math.Sin(theta) * math.Cos(phi)
+		return d*mu + math.Sqrt(R*R-d*d*(1-mu*mu))
+	}
+
+	tests := []struct {
+		s        Shell
+		expected [3]float64
+	}{
+		{sphere(2), [3]float64{0, 0, 0}},
+		{Shell(offset), [3]float64{d, 0, 0}},
+	}
+
+	for i, test := range tests {
+		c := test.s.Centroid(200 * 1000)
+		for k := range c {
+			if math.Abs(c[k]-test.expected[k]) > 0.02 {
+				t.Errorf("%d) Expected centroid %v, got %v.",
+					i, test.expected, c)
+				break
+			}
+		}
+	}
+}
+
+func TestPrincipalAxes(t *testing.T) {
+	// The major, intermediate, and minor axes are along y, z, and x.
+	s := ellipsoid(2, 4, 3)
+	a, b, c, vecs := s.PrincipalAxes(200 * 1000)
+
+	// NaNs fail every comparison, so they would slip past the tolerance
+	// checks below.
+	if math.IsNaN(a) || math.IsNaN(b) || math.IsNaN(c) {
+		t.Fatalf("Expected axes (4, 3, 2), got (%g, %g, %g).", a, b, c)
+	}
+	for k := range vecs {
+		for d := range vecs[k] {
+			if math.IsNaN(vecs[k][d]) {
+				t.Fatalf("Axis %d has a NaN component: %v.", k, vecs[k])
+			}
+		}
+	}
+
+	if math.Abs(a-4) > 0.15 || math.Abs(b-3) > 0.15 || math.Abs(c-2) > 0.15 {
+		t.Errorf("Expected axes (4, 3, 2), got (%g, %g, %g).", a, b, c)
+	}
+	if math.Abs(b/a-0.75) > 0.02 || math.Abs(c/a-0.5) > 0.02 {
+		t.Errorf("Expected b/a = 0.75 and c/a = 0.5, got %g and %g.",
+			b/a, c/a)
+	}
+
+	dirs := [3]int{1, 2, 0}
+	for k, d := range dirs {
+		if math.Abs(vecs[k][d]) < 0.99 {
+			t.Errorf("Expected axis %d to point along dimension %d, got %v.",
+				k, d, vecs[k])
+		}
+	}
+}
+
+func TestAxesConcurrent(t *testing.T) {
+	SetMonteCarloSeed(1337)
+	defer func() { monteCarloSeed = -1 }()
+
+	s := ellipsoid(2, 4, 3)
+	samples := 10 * 1000
+	a, b, c, aVec := s.Axes(samples)
+
+	workers := 8
+	type axes struct {
+		a, b, c float64
+		aVec    [3]float64
+	}
+	out := make(chan axes, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			a, b, c, aVec := s.Axes(samples)
+			out <- axes{a, b, c, aVec}
+		}()
+	}
+
+	for i := 0; i < workers; i++ {
+		res := <-out
+		same := sameFloat(res.a, a) && sameFloat(res.b, b) &&
+			sameFloat(res.c, c)
+		for k := range aVec {
+			same = same && sameFloat(res.aVec[k], aVec[k])
+		}
+		if !same {
+			t.Errorf("%d) Expected axes (%g, %g, %g, %v), got "+
+				"(%g, %g, %g, %v).", i, a, b, c, aVec,
+				res.a, res.b, res.c, res.aVec)
+		}
+	}
+}
+
+// sameFloat returns true if x and y are equal or are both NaN.
+func sameFloat(x, y float64) bool {
+	return x == y || (math.IsNaN(x) && math.IsNaN(y))
+}
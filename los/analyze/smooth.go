@@ -2,17 +2,40 @@ package analyze
 
 import (
 	"math"
+	"sync"
 
 	intr "github.com/phil-mansfield/shellfish/math/interpolate"
 )
 
+// KernelType is a flag representing the type of kernel used by Smooth.
+type KernelType int
+
+const (
+	// SavGolKernel smooths with a 4th order Savitzky-Golay filter. This is
+	// the default.
+	SavGolKernel KernelType = iota
+	// GaussianKernel smooths with a truncated Gaussian.
+	GaussianKernel
+	// TophatKernel smooths with a running mean.
+	TophatKernel
+)
+
+type kernelKey struct {
+	kt        KernelType
+	window    int
+	sigma, dx float64
+}
+
 var (
-	kernels      = make(map[int]*intr.Kernel)
-	derivKernels = make(map[int]*intr.Kernel)
+	kernels      = make(map[kernelKey]*intr.Kernel)
+	derivKernels = make(map[kernelKey]*intr.Kernel)
+	kernelMutex  = &sync.Mutex{}
 )
 
 type smoothParams struct {
 	vals, derivs []float64
+	kt           KernelType
+	sigma        float64
 }
 
 type internalSmoothOption func(*smoothParams)
@@ -40,9 +63,17 @@ func Derivs(derivs []float64) SmoothOption {
 }
 
 
+// Kernel tells Smooth to use a kernel of the given type. sigma is the
+// standard deviation of GaussianKernel in units of bins and is ignored by the
+// other kernel types.
+func Kernel(kt KernelType, sigma float64) SmoothOption {
+	return func(p *smoothParams) { p.kt, p.sigma = kt, sigma }
+}
+
 // Smooth returns a smoothed 1D series as well as the derivative of that series
-// using a Savitzky-Golay filter of the given size. It also takes optional
-// arguments which allow the smoothing to be done in-place.
+// using a filter of the given size. By default this is a Savitzky-Golay filter.
+// It also takes optional arguments which allow the smoothing to be done
+// in-place or with a different kernel.
 func Smooth(
 	xs, ys []float64, window int, opts ...SmoothOption,
 ) (vals, derivs []float64, ok bool) {
@@ -64,12 +95,16 @@ func Smooth(
 	}
 
 	dx := math.Log(xs[1]) - math.Log(xs[0])
-	k, kd := getSmoothingKernel(window, dx)
+	k, kd := getSmoothingKernel(p.kt, window, p.sigma, dx)
 	for i := range ys {
 		ys[i] = math.Log(ys[i])
 	}
 	k.ConvolveAt(ys, intr.Extension, vals)
-	kd.ConvolveAt(ys, intr.Extension, derivs)
+	if kd != nil {
+		kd.ConvolveAt(ys, intr.Extension, derivs)
+	} else {
+		finiteDiff(vals, dx, derivs)
+	}
 	for i := range ys {
 		ys[i] = math.Exp(ys[i])
 	}
@@ -80,17 +115,47 @@ func Smooth(
 	return vals, derivs, true
 }
 
-// TODO: mutexes
-func getSmoothingKernel(window int, dx float64) (k, kd *intr.Kernel) {
-	k, ok := kernels[window]
-	kd, _ = derivKernels[window]
+// finiteDiff writes the derivative of a uniformly spaced series to out. Central
+// differences are used on the interior and one-sided differences are used at
+// the edges.
+func finiteDiff(ys []float64, dx float64, out []float64) {
+	n := len(ys)
+	out[0] = (ys[1] - ys[0]) / dx
+	out[n-1] = (ys[n-1] - ys[n-2]) / dx
+	for i := 1; i < n-1; i++ {
+		out[i] = (ys[i+1] - ys[i-1]) / (2 * dx)
+	}
+}
+
+// getSmoothingKernel returns the smoothing kernel of the given type along with
+// its derivative kernel. Kernels without analytic derivatives return a nil
+// derivative kernel. It is safe to call from multiple goroutines.
+func getSmoothingKernel(
+	kt KernelType, window int, sigma, dx float64,
+) (k, kd *intr.Kernel) {
+	kernelMutex.Lock()
+	defer kernelMutex.Unlock()
+
+	key := kernelKey{kt, window, sigma, dx}
+	k, ok := kernels[key]
+	kd, _ = derivKernels[key]
 	if ok {
 		return k, kd
 	}
-	k = intr.NewSavGolKernel(4, window)
-	kd = intr.NewSavGolDerivKernel(dx, 1, 4, window)
-	kernels[window] = k
-	derivKernels[window] = kd
+
+	switch kt {
+	case SavGolKernel:
+		k = intr.NewSavGolKernel(4, window)
+		kd = intr.NewSavGolDerivKernel(dx, 1, 4, window)
+	case GaussianKernel:
+		k = intr.NewGaussianKernel(window, sigma, 1)
+	case TophatKernel:
+		k = intr.NewTophatKernel(window)
+	default:
+		panic("Unrecognized KernelType.")
+	}
+	kernels[key] = k
+	derivKernels[key] = kd
 
 	return k, kd
 }
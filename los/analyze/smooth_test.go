@@ -0,0 +1,51 @@
+package analyze
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSmoothKernels(t *testing.T) {
+	// A power law is a straight line in log-log space, so every kernel
+	// should recover its slope away from the edges.
+	n, window := 200, 21
+	xs, ys := make([]float64, n), make([]float64, n)
+	for i := range xs {
+		xs[i] = math.Pow(10, -1+2*float64(i)/float64(n-1))
+		ys[i] = math.Pow(xs[i], -2)
+	}
+
+	tests := []struct {
+		kt    KernelType
+		sigma float64
+	}{
+		{SavGolKernel, 0},
+		{GaussianKernel, 5},
+		{TophatKernel, 0},
+	}
+
+	for i, test := range tests {
+		vals, derivs, ok := Smooth(xs, ys, window, Kernel(test.kt, test.sigma))
+		if !ok {
+			t.Errorf("%d) Smooth failed.", i)
+			continue
+		}
+		for j := window; j < n-window; j++ {
+			if math.Abs(vals[j]-ys[j]) > 1e-6*ys[j] {
+				t.Errorf("%d) Expected vals[%d] = %g, got %g.",
+					i, j, ys[j], vals[j])
+				break
+			}
+			if math.Abs(derivs[j]+2) > 1e-6 {
+				t.Errorf("%d) Expected derivs[%d] = -2, got %g.",
+					i, j, derivs[j])
+				break
+			}
+		}
+	}
+
+	if _, _, ok := Smooth(xs[:window], ys[:window], window); ok {
+		t.Errorf("Expected Smooth to fail when window isn't smaller than " +
+			"the series.")
+	}
+}
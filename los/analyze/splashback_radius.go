@@ -57,6 +57,33 @@ func SplashbackRadius(
 	return rs[iMin], true
 }
 
+// MinimumSlopeRadius returns the radius where the logarithmic slope of a
+// density profile is most negative within the window [rMin, rMax]. Unlike
+// SplashbackRadius, no other constraints are placed on the point, which
+// matches the definition commonly used for averaged radial profiles.
+func MinimumSlopeRadius(
+	rs, derivs []float64, rMin, rMax float64,
+) (r float64, ok bool) {
+	if len(rs) != len(derivs) {
+		panic("len(rs) != len(derivs)")
+	}
+
+	iMin := -1
+	for i := range rs {
+		if rs[i] < rMin || rs[i] > rMax {
+			continue
+		}
+		if iMin == -1 || derivs[i] < derivs[iMin] {
+			iMin = i
+		}
+	}
+
+	if iMin == -1 {
+		return 0, false
+	}
+	return rs[iMin], true
+}
+
 // Read as: "is [local] minimum"
 func isMinimum(xs []float64, i int) bool {
 	return xs[i] < xs[i+1] && xs[i] < xs[i-1]
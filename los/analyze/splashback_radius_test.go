@@ -0,0 +1,31 @@
+package analyze
+
+import (
+	"testing"
+)
+
+func TestMinimumSlopeRadius(t *testing.T) {
+	rs := []float64{1, 2, 3, 4, 5, 6}
+	derivs := []float64{-5, -1, -3, -2, -4, -1}
+
+	tests := []struct {
+		rMin, rMax float64
+		r          float64
+		ok         bool
+	}{
+		{0, 10, 1, true},
+		{2, 10, 5, true},
+		{2, 4, 3, true},
+		{1.5, 2.5, 2, true},
+		{7, 10, 0, false},
+	}
+
+	for i, test := range tests {
+		r, ok := MinimumSlopeRadius(rs, derivs, test.rMin, test.rMax)
+		if r != test.r || ok != test.ok {
+			t.Errorf("%d) Expected MinimumSlopeRadius(%g, %g) = (%g, %v), "+
+				"got (%g, %v).", i, test.rMin, test.rMax, test.r, test.ok,
+				r, ok)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package tree
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Column indices of the fields that are needed from consistent-trees'
+// tree_X_Y_Z.dat files.
+const (
+	textScaleCol  = 0
+	textIDCol     = 1
+	textDescIDCol = 3
+	textMMPCol    = 14
+	textMinCols   = textMMPCol + 1
+)
+
+// textHalo is the subset of a consistent-trees halo needed to walk its
+// main branch.
+type textHalo struct {
+	id, descID int
+	scale      float64
+	mmp        bool
+}
+
+// textForest is a parsed tree_X_Y_Z.dat file.
+type textForest struct {
+	halos  []textHalo
+	index  map[int]int // halo ID -> index into halos
+	prog   map[int]int // descendant ID -> index of main progenitor
+	scales []float64   // unique scale factors in decreasing order
+}
+
+// TextHaloHistories does the same thing as HaloHistories, but parses the
+// ASCII tree_X_Y_Z.dat files written by consistent-trees directly instead of
+// going through the consistent_trees library. This means it only needs the
+// raw tree files, and not the hlists or locations.dat.
+func TextHaloHistories(
+	files []string, roots []int, snapOffset int,
+) (ids [][]int, snaps [][]int, err error) {
+	if len(roots) == 0 {
+		return [][]int{}, [][]int{}, nil
+	}
+
+	ids, snaps = make([][]int, len(roots)), make([][]int, len(roots))
+
+	foundCount := 0
+	for _, file := range files {
+		f, err := readTextForest(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		var ok bool
+		for i, id := range roots {
+			if ids[i] != nil {
+				continue
+			}
+			if ids[i], snaps[i], ok = f.findHistory(id); ok {
+				foundCount++
+			}
+		}
+		if foundCount == len(roots) {
+			break
+		}
+	}
+
+	for i, idSnaps := range snaps {
+		if idSnaps == nil {
+			return nil, nil, fmt.Errorf(
+				"Halo %d not found in given files.", roots[i],
+			)
+		}
+	}
+
+	for i := range snaps {
+		for j := range snaps[i] {
+			snaps[i][j] += snapOffset
+		}
+	}
+	return ids, snaps, nil
+}
+
+// readTextForest reads the halos in a consistent-trees tree_X_Y_Z.dat file.
+func readTextForest(fname string) (*textForest, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	halos := []textHalo{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1<<16), 1<<24)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) == 1 {
+			// The number of trees in the file.
+			continue
+		} else if len(tokens) < textMinCols {
+			return nil, fmt.Errorf("Line %d of the tree file %s has %d "+
+				"columns, but consistent-trees halos have at least %d.",
+				lineNum, fname, len(tokens), textMinCols)
+		}
+
+		h, err := parseTextHalo(tokens)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of the tree file %s: %s",
+				lineNum, fname, err.Error())
+		}
+		halos = append(halos, h)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return newTextForest(halos), nil
+}
+
+func parseTextHalo(tokens []string) (textHalo, error) {
+	h := textHalo{}
+	var err error
+	if h.scale, err = strconv.ParseFloat(tokens[textScaleCol], 64); err != nil {
+		return h, err
+	}
+	if h.id, err = strconv.Atoi(tokens[textIDCol]); err != nil {
+		return h, err
+	}
+	if h.descID, err = strconv.Atoi(tokens[textDescIDCol]); err != nil {
+		return h, err
+	}
+	mmp, err := strconv.Atoi(tokens[textMMPCol])
+	if err != nil {
+		return h, err
+	}
+	h.mmp = mmp != 0
+	return h, nil
+}
+
+func newTextForest(halos []textHalo) *textForest {
+	f := &textForest{
+		halos: halos,
+		index: make(map[int]int, len(halos)),
+		prog:  make(map[int]int),
+	}
+
+	scaleSet := make(map[float64]bool)
+	for i, h := range halos {
+		f.index[h.id] = i
+		if h.mmp && h.descID != -1 {
+			f.prog[h.descID] = i
+		}
+		scaleSet[h.scale] = true
+	}
+
+	for scale := range scaleSet {
+		f.scales = append(f.scales, scale)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(f.scales)))
+
+	return f
+}
+
+// snap returns the snapshot of a halo with the given scale factor, using the
+// same convention as the consistent_trees library: the latest scale factor
+// in the file is snapshot len(scales) and the earliest is snapshot 1.
+func (f *textForest) snap(scale float64) int {
+	i := sort.Search(len(f.scales), func(i int) bool {
+		return f.scales[i] <= scale
+	})
+	return len(f.scales) - i
+}
+
+func (f *textForest) findHistory(id int) (ids, snaps []int, ok bool) {
+	i, ok := f.index[id]
+	if !ok {
+		return nil, nil, false
+	}
+	h := f.halos[i]
+
+	desc, descSnaps := []int{}, []int{}
+	for d := h; d.descID != -1; {
+		j, ok := f.index[d.descID]
+		if !ok {
+			break
+		}
+		d = f.halos[j]
+		desc = append(desc, d.id)
+		descSnaps = append(descSnaps, f.snap(d.scale))
+	}
+
+	prog, progSnaps := []int{}, []int{}
+	for p := h; ; {
+		j, ok := f.prog[p.id]
+		if !ok {
+			break
+		}
+		p = f.halos[j]
+		prog = append(prog, p.id)
+		progSnaps = append(progSnaps, f.snap(p.scale))
+	}
+
+	ids = combine(reverse(prog), []int{id}, desc)
+	snaps = combine(reverse(progSnaps), []int{f.snap(h.scale)}, descSnaps)
+	return ids, snaps, true
+}
@@ -0,0 +1,66 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// Halo 30 is the main progenitor of 20, which is the main progenitor of 10.
+// Halo 31 also merges into 20, but isn't its main progenitor.
+const testTreeFile = `#scale(0) id(1) desc_scale(2) desc_id(3) num_prog(4) pid(5) upid(6) desc_pid(7) phantom(8) sam_mvir(9) mvir(10) rvir(11) rs(12) vrms(13) mmp?(14)
+#Omega_M = 0.27; Omega_L = 0.73; h0 = 0.70
+2
+#tree 10
+1.0 10 0.0 -1 1 -1 -1 -1 0 1e12 1e12 200 20 100 1
+0.5 20 1.0 10 2 -1 -1 -1 0 5e11 5e11 150 15 80 1
+0.25 30 0.5 20 0 -1 -1 -1 0 3e11 3e11 100 10 60 1
+0.25 31 0.5 20 0 -1 -1 -1 0 1e11 1e11 50 5 40 0
+#tree 11
+1.0 11 0.0 -1 0 -1 -1 -1 0 1e11 1e11 100 10 50 1
+`
+
+func TestTextHaloHistories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_tree_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "tree_0_0_0.dat")
+	if err = ioutil.WriteFile(file, []byte(testTreeFile), 0666); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ids, snaps, err := TextHaloHistories(
+		[]string{file}, []int{20, 31, 11}, 5,
+	)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+
+	expIDs := [][]int{{30, 20, 10}, {31, 20, 10}, {11}}
+	expSnaps := [][]int{{6, 7, 8}, {6, 7, 8}, {8}}
+	for i := range expIDs {
+		if !intsEq(ids[i], expIDs[i]) || !intsEq(snaps[i], expSnaps[i]) {
+			t.Errorf("%d) Expected IDs %v and snaps %v, got %v and %v.",
+				i, expIDs[i], expSnaps[i], ids[i], snaps[i])
+		}
+	}
+
+	if _, _, err = TextHaloHistories([]string{file}, []int{40}, 0); err == nil {
+		t.Errorf("Expected error for missing halo.")
+	}
+}
+
+func intsEq(xs, ys []int) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -112,23 +112,60 @@ func (bi *BiCubic) EvalAll(xs, ys []float64, out ...[]float64) []float64 {
 	return out[0]
 }
 
+// Ref returns a reference to the interpolator which shares its splines along
+// lines of constant x but has its own cached spline along y. Different refs
+// can be evaluated from different threads at the same time.
 func (bi *BiCubic) Ref() BiInterpolator {
-	panic("NYI")
+	return newBiCubicRef(bi)
 }
 
 type biCubicRef struct {
+	bi *BiCubic
+
+	lastY       float64
+	xSplineVals []float64
+	xSpline     *Spline
 }
 
-func (bi *biCubicRef) Eval(x, y float64) float64 {
-	panic("NYI")
+func newBiCubicRef(bi *BiCubic) *biCubicRef {
+	ref := &biCubicRef{bi: bi}
+
+	ref.lastY = bi.ys[0]
+	ref.xSplineVals = make([]float64, len(bi.xs))
+	for i := range ref.xSplineVals {
+		ref.xSplineVals[i] = bi.ySplines[i].Eval(ref.lastY)
+	}
+
+	ref.xSpline = NewSpline(bi.xs, ref.xSplineVals)
+
+	return ref
 }
 
-func (bi *biCubicRef) EvalAll(xs, ys []float64, out ...[]float64) []float64 {
-	panic("NYI")
+func (ref *biCubicRef) Eval(x, y float64) float64 {
+	if y != ref.lastY {
+		ref.lastY = y
+		for i := range ref.xSplineVals {
+			ref.xSplineVals[i] = ref.bi.ySplines[i].Eval(y)
+		}
+
+		ref.xSpline.Init(ref.bi.xs, ref.xSplineVals)
+	}
+
+	return ref.xSpline.Eval(x)
 }
 
-func (bi *biCubicRef) Ref() BiInterpolator {
-	panic("NYI")
+func (ref *biCubicRef) EvalAll(xs, ys []float64, out ...[]float64) []float64 {
+	if len(out) == 0 {
+		out = [][]float64{make([]float64, len(xs))}
+	}
+	for i := range xs {
+		out[0][i] = ref.Eval(xs[i], ys[i])
+	}
+	return out[0]
+}
+
+func (ref *biCubicRef) Ref() BiInterpolator {
+	return newBiCubicRef(ref.bi)
 }
 
 /////////////////////////////
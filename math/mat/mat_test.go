@@ -1,6 +1,7 @@
 package mat
 
 import (
+	"math"
 	"math/rand"
 	"testing"
 )
@@ -245,3 +246,32 @@ func BenchmarkTransposeAt12800_1280(b *testing.B) {
 		m.TransposeAt(out)
 	}
 }
+
+func TestSolveVector(t *testing.T) {
+	gen := rand.New(rand.NewSource(1))
+	for n := 1; n <= 10; n++ {
+		for trial := 0; trial < 100; trial++ {
+			m := NewMatrix(make([]float64, n*n), n, n)
+			xs, bs := make([]float64, n), make([]float64, n)
+			for i := range m.Vals {
+				m.Vals[i] = gen.Float64() - 0.5
+			}
+			for i := range xs {
+				xs[i] = gen.Float64() - 0.5
+			}
+			for i := 0; i < n; i++ {
+				for j := 0; j < n; j++ {
+					bs[i] += m.Vals[i*n+j] * xs[j]
+				}
+			}
+
+			out := m.SolveVector(bs)
+			for i := range xs {
+				if math.Abs(out[i]-xs[i]) > 1e-6 {
+					t.Fatalf("%d x %d trial %d) Expected %v, got %v.",
+						n, n, trial, xs, out)
+				}
+			}
+		}
+	}
+}
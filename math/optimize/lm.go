@@ -0,0 +1,152 @@
+/*package optimize provides routines for fitting models to data.
+ */
+package optimize
+
+import (
+	"math"
+
+	"github.com/phil-mansfield/shellfish/math/mat"
+)
+
+// Residuals writes the residuals of a model with the given parameters to out.
+// The fit minimizes the sum of the squares of these residuals.
+type Residuals func(params, out []float64)
+
+type lmParams struct {
+	maxIter int
+	tol     float64
+}
+
+type internalLMOption func(*lmParams)
+
+// LMOption is an abstract data type which allows for the customization of
+// calls to LevenbergMarquardt without cluttering the call signature in the
+// common case.
+type LMOption internalLMOption
+
+// MaxIter sets the maximum number of iterations LevenbergMarquardt will take.
+// The default is 200.
+func MaxIter(n int) LMOption {
+	return func(p *lmParams) { p.maxIter = n }
+}
+
+// Tolerance sets the relative change in the sum of squared residuals below
+// which LevenbergMarquardt considers the fit converged. The default is 1e-8.
+func Tolerance(tol float64) LMOption {
+	return func(p *lmParams) { p.tol = tol }
+}
+
+func (p *lmParams) loadOptions(opts []LMOption) {
+	for _, opt := range opts {
+		opt(p)
+	}
+}
+
+// LevenbergMarquardt finds the parameters which minimize the sum of the
+// squares of n residuals, starting from the guess p0. Derivatives are found
+// with finite differences. The best-fit parameters and their sum of squared
+// residuals are returned. ok is false if the fit didn't converge or if the
+// residuals at p0 weren't finite.
+func LevenbergMarquardt(
+	f Residuals, p0 []float64, n int, opts ...LMOption,
+) (params []float64, chi2 float64, ok bool) {
+	p := &lmParams{maxIter: 200, tol: 1e-8}
+	p.loadOptions(opts)
+
+	m := len(p0)
+	params = append([]float64{}, p0...)
+	trial := make([]float64, m)
+	res, trialRes := make([]float64, n), make([]float64, n)
+	jac := make([]float64, n*m)
+	jtj, jtr := make([]float64, m*m), make([]float64, m)
+	step := make([]float64, m)
+
+	f(params, res)
+	chi2 = sumSqr(res)
+	if math.IsNaN(chi2) || math.IsInf(chi2, 0) {
+		return params, chi2, false
+	}
+
+	lambda := 1e-3
+	for iter := 0; iter < p.maxIter; iter++ {
+		jacobian(f, params, res, trial, trialRes, jac)
+
+		for i := 0; i < m; i++ {
+			jtr[i] = 0
+			for k := 0; k < n; k++ {
+				jtr[i] += jac[k*m+i] * res[k]
+			}
+			for j := 0; j < m; j++ {
+				jtj[i*m+j] = 0
+				for k := 0; k < n; k++ {
+					jtj[i*m+j] += jac[k*m+i] * jac[k*m+j]
+				}
+			}
+		}
+
+		// Increase the damping until a step reduces chi^2.
+		improved := false
+		for lambda < 1e12 {
+			a := make([]float64, m*m)
+			copy(a, jtj)
+			for i := 0; i < m; i++ {
+				a[i*m+i] += lambda * math.Max(jtj[i*m+i], 1e-12)
+				step[i] = -jtr[i]
+			}
+			mat.NewMatrix(a, m, m).LU().SolveVector(step, step)
+
+			for i := range trial {
+				trial[i] = params[i] + step[i]
+			}
+			f(trial, trialRes)
+			trialChi2 := sumSqr(trialRes)
+
+			if trialChi2 < chi2 {
+				converged := chi2-trialChi2 <= p.tol*chi2
+				copy(params, trial)
+				copy(res, trialRes)
+				chi2 = trialChi2
+				lambda /= 10
+				improved = true
+				if converged {
+					return params, chi2, true
+				}
+				break
+			}
+			lambda *= 10
+		}
+
+		// No step can reduce chi^2, so we're at a minimum.
+		if !improved {
+			return params, chi2, true
+		}
+	}
+
+	return params, chi2, false
+}
+
+// jacobian writes the finite difference derivatives of the residuals at
+// params to jac, where jac[k*len(params) + i] is the derivative of residual k
+// with respect to parameter i. res are the residuals at params. trial and
+// trialRes are buffers.
+func jacobian(f Residuals, params, res, trial, trialRes, jac []float64) {
+	m := len(params)
+	copy(trial, params)
+	for i := range params {
+		h := 1e-6 * math.Max(math.Abs(params[i]), 1e-3)
+		trial[i] = params[i] + h
+		f(trial, trialRes)
+		for k := range res {
+			jac[k*m+i] = (trialRes[k] - res[k]) / h
+		}
+		trial[i] = params[i]
+	}
+}
+
+func sumSqr(xs []float64) float64 {
+	sum := 0.0
+	for _, x := range xs {
+		sum += x * x
+	}
+	return sum
+}
@@ -0,0 +1,57 @@
+package optimize
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLevenbergMarquardt(t *testing.T) {
+	// y = a exp(b x) + c
+	xs := make([]float64, 30)
+	ys := make([]float64, len(xs))
+	for i := range xs {
+		xs[i] = float64(i) / 10
+		ys[i] = 2.5*math.Exp(-1.3*xs[i]) + 0.5
+	}
+	f := func(params, out []float64) {
+		for i := range xs {
+			out[i] = params[0]*math.Exp(params[1]*xs[i]) + params[2] - ys[i]
+		}
+	}
+
+	params, chi2, ok := LevenbergMarquardt(f, []float64{1, -0.5, 0}, len(xs))
+	if !ok {
+		t.Errorf("Exponential fit didn't converge.")
+	}
+	expected := []float64{2.5, -1.3, 0.5}
+	for i := range expected {
+		if math.Abs(params[i]-expected[i]) > 1e-4 {
+			t.Errorf("Expected parameters %v, got %v.", expected, params)
+			break
+		}
+	}
+	if chi2 > 1e-10 {
+		t.Errorf("Expected chi^2 of 0, got %g.", chi2)
+	}
+
+	// The Rosenbrock function has a narrow curved valley with its minimum at
+	// (1, 1).
+	rosenbrock := func(params, out []float64) {
+		out[0] = 10 * (params[1] - params[0]*params[0])
+		out[1] = 1 - params[0]
+	}
+	params, _, ok = LevenbergMarquardt(
+		rosenbrock, []float64{-1.2, 1}, 2, MaxIter(1000), Tolerance(1e-14),
+	)
+	if !ok {
+		t.Errorf("Rosenbrock fit didn't converge.")
+	}
+	if math.Abs(params[0]-1) > 1e-4 || math.Abs(params[1]-1) > 1e-4 {
+		t.Errorf("Expected Rosenbrock minimum at [1 1], got %v.", params)
+	}
+
+	bad := func(params, out []float64) { out[0] = math.NaN() }
+	if _, _, ok := LevenbergMarquardt(bad, []float64{1}, 1); ok {
+		t.Errorf("Expected a NaN residual to fail.")
+	}
+}
@@ -163,6 +163,22 @@ func intsConv(ptr *[]int64) conversionFunc {
 		toks := strToList(s)
 		*ptr = []int64{}
 		for j := range toks {
+			// Inclusive ranges are written as start..end.
+			if bounds := strings.Split(toks[j], ".."); len(bounds) == 2 {
+				start, err := strconv.Atoi(strings.Trim(bounds[0], " "))
+				if err != nil {
+					return false
+				}
+				end, err := strconv.Atoi(strings.Trim(bounds[1], " "))
+				if err != nil || end < start {
+					return false
+				}
+				for i := start; i <= end; i++ {
+					*ptr = append(*ptr, int64(i))
+				}
+				continue
+			}
+
 			i, err := strconv.Atoi(toks[j])
 			if err != nil {
 				return false
@@ -297,13 +313,23 @@ func ReadConfig(fname string, vars *ConfigVars) error {
 		lineNums[i]++
 	}
 
-	if len(lines) == 0 || lines[0] != fmt.Sprintf("[%s]", vars.name) {
+	if len(lines) == 0 || !isHeader(lines[0]) {
 		return fmt.Errorf(
 			"I expected the config file %s to have the header "+
 				"[%s] at the top, but didn't find it.", fname, vars.name,
 		)
 	}
-	lines = lines[1:]
+
+	// Files can contain several sections, each with their own header. Only
+	// the section belonging to vars is read.
+	start, end := configSection(lines, vars.name)
+	if start == -1 {
+		return fmt.Errorf(
+			"I expected the config file %s to have the header "+
+				"[%s], but didn't find it.", fname, vars.name,
+		)
+	}
+	lines, lineNums = lines[start+1:end], lineNums[start:end]
 
 	// Create association list and check for name-based errors
 
@@ -487,6 +513,60 @@ func removeComments(lines []string) ([]string, []int) {
 	return out, lineNums
 }
 
+func isHeader(line string) bool {
+	return len(line) >= 2 && line[0] == '[' && line[len(line)-1] == ']'
+}
+
+func configSection(lines []string, name string) (start, end int) {
+	header := fmt.Sprintf("[%s]", name)
+	start = -1
+	for i := range lines {
+		if lines[i] == header {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		return -1, -1
+	}
+
+	for end = start + 1; end < len(lines); end++ {
+		if isHeader(lines[end]) {
+			break
+		}
+	}
+	return start, end
+}
+
+// HasSection returns true if the config file fname contains a section with
+// the given header name.
+func HasSection(fname, name string) (bool, error) {
+	bs, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return false, err
+	}
+	lines, _ := removeComments(strings.Split(string(bs), "\n"))
+	start, _ := configSection(lines, name)
+	return start != -1, nil
+}
+
+// Sections returns the header names of every section in the config file
+// fname, in order.
+func Sections(fname string) ([]string, error) {
+	bs, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	lines, _ := removeComments(strings.Split(string(bs), "\n"))
+	names := []string{}
+	for _, line := range lines {
+		if isHeader(line) {
+			names = append(names, line[1:len(line)-1])
+		}
+	}
+	return names, nil
+}
+
 func associationList(lines []string) ([]string, []string, int) {
 	names, vals := []string{}, []string{}
 	for i := range lines {
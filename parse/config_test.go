@@ -75,6 +75,19 @@ func TestIntsConv(t *testing.T) {
 	if ok {
 		t.Errorf("intsConv successful on invalid input.")
 	}
+	ok = intsConv(&x)("1, 4..6, 9")
+	if !ok {
+		t.Errorf("intsConv unsuccesful on valid range input.")
+	}
+	if len(x) != 5 || x[0] != 1 || x[1] != 4 || x[2] != 5 ||
+		x[3] != 6 || x[4] != 9 {
+		t.Errorf("intsConv did not expand range, got %v.", x)
+	}
+	for _, s := range []string{"6..4", "1..", "..3", "1..2..3"} {
+		if intsConv(&x)(s) {
+			t.Errorf("intsConv successful on invalid range input %s.", s)
+		}
+	}
 }
 
 func TestFloatsConv(t *testing.T) {
@@ -379,6 +392,49 @@ func TestValidConfig(t *testing.T) {
 	}
 }
 
+func TestConfigSections(t *testing.T) {
+	config, vars := makeTestConfig()
+	err := ReadConfig("config_test_files/sections.config", vars)
+	if err != nil {
+		t.Errorf("Expected successful read of config file, but got "+
+			"error:\n %s", err.Error())
+	}
+	if config.num != 3 || config.word != "meow" {
+		t.Errorf("Expected num = 3 and word = meow, but got %d and %s.",
+			config.num, config.word)
+	}
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"other", true}, {"config", true}, {"another", true}, {"meow", false},
+	}
+	for _, test := range tests {
+		ok, err := HasSection("config_test_files/sections.config", test.name)
+		if err != nil {
+			t.Errorf("Got error %s.", err.Error())
+		} else if ok != test.ok {
+			t.Errorf("Expected HasSection(%s) = %v, got %v.",
+				test.name, test.ok, ok)
+		}
+	}
+
+	names, err := Sections("config_test_files/sections.config")
+	if err != nil {
+		t.Errorf("Got error %s.", err.Error())
+	} else if len(names) != 3 || names[0] != "other" ||
+		names[1] != "config" || names[2] != "another" {
+		t.Errorf("Expected sections [other config another], got %v.", names)
+	}
+
+	_, vars = makeTestConfig()
+	vars.name = "meow"
+	if err = ReadConfig("config_test_files/sections.config", vars); err == nil {
+		t.Errorf("No error was reported when reading a missing section.")
+	}
+}
+
 func TestInvalidConfig(t *testing.T) {
 	_, vars := makeTestConfig()
 
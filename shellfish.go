@@ -10,9 +10,11 @@ import (
 	"os"
 	"path"
 	"bytes"
+	"strings"
 
 	"github.com/phil-mansfield/shellfish/cmd"
 	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
 	"github.com/phil-mansfield/shellfish/version"
 	"github.com/phil-mansfield/shellfish/logging"
 )
@@ -25,6 +27,11 @@ The check tool does some basic sanity checks on the snapshot values read from
 disk. The goal of this mode is to rule out the possibility of non-compliant
 snapshot formats or I/O bugs in Shellfish.
 
+If DryRun is set, the check tool instead validates your setup without doing
+any computation: it reads the config files listed in Configs, checks that every
+snapshot, halo catalog, and merger tree file exists and can be read, and prints
+a summary of everything that it checked.
+
 For a documented example of an check config file, type:
 
      shellfish help check.config
@@ -57,6 +64,662 @@ Column 0 - ID: The subhalo's catalog ID.
 Column 1 - Snap: Index of the halo's snapshot
 
 (This can be fed directly to shellfish tree and shellfish coord.)`,
+// crossmatch mode
+	"crossmatch": `Type "shellfish help" for basic information on invoking the crossmatch tool.
+
+The crossmatch tool matches halos in the halo catalog to halos in a second
+catalog of the same simulation (e.g. one generated by a different halo finder)
+based on their positions and masses. This allows shell measurements to be
+compared across halo finders.
+
+For a documented example of a crossmatch config file, type:
+
+     shellfish help crossmatch.config
+
+The crossmatch tool takes the following input from stdin:
+
+Column 0 - ID:   The halo's catalog ID.
+Column 1 - Snap: Index of the halo's snapshot.
+
+(This input can be generated by shellfish id or shellfish tree.)
+
+The crossmatch tool prints the following catalog to stdout:
+
+Column 0 - ID:         The halo's catalog ID.
+Column 1 - Snap:       Index of the halo's snapshot.
+Column 2 - Match ID:   The ID of the matched halo in the second catalog, or -1
+                       if no match was found.
+Column 3 - Distance:   The distance between the two halos in comoving Mpc/h,
+                       or -1 if no match was found.
+Column 4 - Mass Ratio: The M200m of the matched halo divided by the M200m of
+                       the input halo, or -1 if no match was found.`,
+// gamma mode
+	"gamma": `Type "shellfish help" for basic information on invoking the gamma tool.
+
+The gamma tool uses the merger tree to compute the mass accretion rate of each
+input halo, Gamma = Delta log(M200m) / Delta log(a), between the halo's
+snapshot and an earlier snapshot of its main progenitor. The splashback radius
+depends primarily on Gamma.
+
+For a documented example of a gamma config file, type:
+
+     shellfish help gamma.config
+
+The gamma tool takes the following input from stdin:
+
+Column 0 - ID:   The halo's catalog ID.
+Column 1 - Snap: Index of the halo's snapshot.
+
+(This input can be generated by shellfish id or shellfish tree.)
+
+The gamma tool prints the following catalog to stdout:
+
+Column 0 - ID:    The halo's catalog ID.
+Column 1 - Snap:  Index of the halo's snapshot.
+Column 2 - Gamma: The accretion rate of the halo, or NaN if its main
+                  progenitor couldn't be found at an earlier snapshot.`,
+// trajectory mode
+	"trajectory": `Type "shellfish help" for basic information on invoking the trajectory tool.
+
+The trajectory tool follows the main branch of every input halo through the
+merger tree and outputs its comoving position and velocity at every snapshot
+between SnapMin and SnapMax. This is useful for debugging shell evolution runs
+and for analyzing the orbits of backsplash halos. Vx, Vy, and Vz must be in
+HaloValueNames.
+
+For a documented example of a trajectory config file, type:
+
+     shellfish help trajectory.config
+
+The trajectory tool takes the following input from stdin:
+
+Column 0 - ID:   The halo's catalog ID.
+Column 1 - Snap: Index of the halo's snapshot.
+
+(This input can be generated by shellfish id.)
+
+The trajectory tool prints the following catalog to stdout:
+
+Column 0 - ID:     The catalog ID of the halo in the main branch.
+Column 1 - Snap:   Index of the snapshot.
+Column 2 - RootID: The ID of the input halo that the row belongs to.
+Column 3 - Scale:  The scale factor of the snapshot.
+Column 4 - X:      X coordinate of the halo in comoving Mpc/h
+Column 5 - Y:      Y coordinate of the halo in comoving Mpc/h
+Column 6 - Z:      Z coordinate of the halo in comoving Mpc/h
+Column 7 - Vx:     X component of the halo's velocity in km/s
+Column 8 - Vy:     Y component of the halo's velocity in km/s
+Column 9 - Vz:     Z component of the halo's velocity in km/s`,
+// orbit mode
+	"orbit": `Type "shellfish help" for basic information on invoking the orbit tool.
+
+The orbit tool measures the splashback radius of each input halo from the
+orbits of its particles rather than from the density field. Particles are
+tracked by ID along the halo's main branch, the first apocenter after each
+particle's first pericenter is recorded, and the splashback radius is a
+percentile of the resulting apocenter distribution. This is intended as a
+cross-check on shell mode. It reads every snapshot between SnapMin and the
+halo's snapshot, so it is much slower than the other tools.
+
+For a documented example of an orbit config file, type:
+
+     shellfish help orbit.config
+
+The orbit tool takes the following input from stdin:
+
+Column 0 - ID:   The halo's catalog ID.
+Column 1 - Snap: Index of the halo's snapshot.
+
+(This input can be generated by shellfish id.)
+
+The orbit tool prints the following catalog to stdout:
+
+Column 0 - ID:         The halo's catalog ID.
+Column 1 - Snap:       Index of the halo's snapshot.
+Column 2 - R_sp:       The splashback radius in comoving Mpc/h, or NaN if no
+                       apocenters were found.
+Column 3 - R_sp/R200m: The splashback radius in units of R200m.
+Column 4 - Apocenters: The number of apocenters that R_sp was measured from.`,
+// tag mode
+	"tag": `Type "shellfish help" for basic information on invoking the tag tool.
+
+The tag tool follows the particles around each input halo along the halo's
+main branch, in the same way as the orbit tool, and tags each one with the
+first snapshot where it fell into the halo, the number of pericenters it has
+passed through, and whether it's orbiting the halo or still on its first
+infall. The tags of each halo's particles are written to a compact binary
+file, which can be read with the io.ReadParticleTags function, as a starting
+point for dynamical analyses of the splashback radius. Like the orbit tool, it
+reads every snapshot between SnapMin and the halo's snapshot.
+
+For a documented example of a tag config file, type:
+
+     shellfish help tag.config
+
+The tag tool takes the following input from stdin:
+
+Column 0 - ID:   The halo's catalog ID.
+Column 1 - Snap: Index of the halo's snapshot.
+
+(This input can be generated by shellfish id.)
+
+The tag tool prints the following catalog to stdout:
+
+Column 0 - ID:        The halo's catalog ID.
+Column 1 - Snap:      Index of the halo's snapshot.
+Column 2 - Particles: The number of tagged particles.
+Column 3 - Orbiting:  The number of tagged particles which are orbiting.`,
+// backsplash mode
+	"backsplash": `Type "shellfish help" for basic information on invoking the backsplash tool.
+
+The backsplash tool finds backsplash halos: halos which are currently outside
+the splashback radius of a more massive host, but whose main branch passed
+inside it at an earlier snapshot. The host's splashback radius at earlier
+times is assumed to scale with its R200m.
+
+For a documented example of a backsplash config file, type:
+
+     shellfish help backsplash.config
+
+The backsplash tool takes the following input from stdin:
+
+Column 0 - ID:   The host's catalog ID.
+Column 1 - Snap: Index of the host's snapshot.
+Column RspColumn - R_sp: The host's splashback radius in comoving Mpc/h.
+
+(This input can be generated by shellfish orbit or shellfish stats.)
+
+The backsplash tool prints the following catalog to stdout:
+
+Column 0 - ID:                 The backsplash halo's catalog ID.
+Column 1 - Snap:               Index of the halo's snapshot.
+Column 2 - HostID:             The catalog ID of the host.
+Column 3 - PericenterSnapshot: The snapshot where the halo was closest to
+                               its host.
+Column 4 - R/R_sp:             The current distance to the host in units of
+                               the host's R_sp.
+Column 5 - RMin/R_sp:          The closest distance to the host in units of
+                               the host's R_sp at that time.`,
+// caustic mode
+	"caustic": `Type "shellfish help" for basic information on invoking the caustic tool.
+
+The caustic tool estimates the splashback radius of each input halo in
+velocity space instead of from the density field. Particles are split into
+lines of sight, and along each line of sight the radius where the mean radial
+velocity profile drops below a threshold is found. This marks the edge of the
+infall region, and the median over all lines of sight is reported. Comparing
+this to the shell tool's estimate gives a velocity-space cross-check.
+
+For a documented example of a caustic config file, type:
+
+     shellfish help caustic.config
+
+The caustic tool takes the following input from stdin:
+
+Column 0 - ID:    The halo's catalog ID.
+Column 1 - Snap:  Index of the halo's snapshot.
+Column 2 - X:     X coordinate of the halo in comoving Mpc/h.
+Column 3 - Y:     Y coordinate of the halo in comoving Mpc/h.
+Column 4 - Z:     Z coordinate of the halo in comoving Mpc/h.
+Column 5 - R200m: Size of the halo in comoving Mpc/h.
+
+(This input can be generated by shellfish coord.)
+
+The caustic tool prints the following catalog to stdout:
+
+Column 0 - ID:         The halo's catalog ID.
+Column 1 - Snap:       Index of the halo's snapshot.
+Column 2 - R_sp:       The velocity-space splashback radius in comoving
+                       Mpc/h, or NaN if it couldn't be measured along any
+                       line of sight.
+Column 3 - R_sp/R200m: The splashback radius in units of R200m.
+Column 4 - Spokes:     The number of lines of sight that R_sp was measured
+                       from.`,
+// render mode
+	"render": `Type "shellfish help" for basic information on invoking the render tool.
+
+The render tool writes the splashback shells of the input halos as 3D meshes
+so that they can be visualized alongside particle data in tools like ParaView
+and Blender. Each shell is evaluated on a grid of angles and written to its own
+OBJ, PLY, or VTK file.
+
+For a documented example of a render config file, type:
+
+     shellfish help render.config
+
+The render tool takes the following input from stdin:
+
+Column 0 - ID:                The halo's catalog ID.
+Column 1 - Snap:              Index of the halo's snapshot.
+Column 2 - X:                 X coordinate of the halo in comoving Mpc/h
+Column 3 - Y:                 Y coordinate of the halo in comoving Mpc/h
+Column 4 - Z:                 Z coordinate of the halo in comoving Mpc/h
+Column 5 - R200m:             The radius of the halo in comoving Mpc/h
+Column 6 to 6 + 2P^2 - P_ijk: The Penna-Dines coefficients of the splashback
+                              shell.
+
+(This input can be generated by shellfish shell.)
+
+The render tool prints the following catalog to stdout:
+
+Column 0 - ID:       The halo's catalog ID.
+Column 1 - Snap:     Index of the halo's snapshot.
+Column 2 - Vertices: The number of vertices in the halo's mesh, or 0 if no
+                     mesh was written.`,
+// projected mode
+	"projected": `Type "shellfish help" for basic information on invoking the projected tool.
+
+The projected tool measures the splashback radius of each input halo from its
+projected surface density profile, mimicking weak lensing and SZ measurements.
+Particles are projected along a chosen axis and the splashback radius is the
+radius where the logarithmic slope of the smoothed surface density profile is
+most negative.
+
+For a documented example of a projected config file, type:
+
+     shellfish help projected.config
+
+The projected tool takes the following input from stdin:
+
+Column 0 - ID:    The halo's catalog ID.
+Column 1 - Snap:  Index of the halo's snapshot.
+Column 2 - X:     X coordinate of the halo in comoving Mpc/h.
+Column 3 - Y:     Y coordinate of the halo in comoving Mpc/h.
+Column 4 - Z:     Z coordinate of the halo in comoving Mpc/h.
+Column 5 - R200m: Size of the halo in comoving Mpc/h.
+
+(This input can be generated by shellfish coord.)
+
+The projected tool prints the following catalog to stdout:
+
+Column 0 - ID:            The halo's catalog ID.
+Column 1 - Snap:          Index of the halo's snapshot.
+Column 2 - R_sp,2D:       The projected splashback radius in comoving Mpc/h,
+                          or NaN if the profile had empty bins.
+Column 3 - R_sp,2D/R200m: The projected splashback radius in units of R200m.
+Column 4 - Slope:         The logarithmic slope of the surface density
+                          profile at R_sp,2D.`,
+// stack mode
+	"stack": `Type "shellfish help" for basic information on invoking the stack tool.
+
+The stack tool rescales the particles around every input halo by R200m, stacks
+them, and fits a single splashback shell to the stacked halo. Errors on the
+stacked splashback radius are estimated with jackknife resampling over halos.
+
+For a documented example of a stack config file, type:
+
+     shellfish help stack.config
+
+The stack tool takes the following input from stdin:
+
+Column 0 - ID:    The halo's catalog ID.
+Column 1 - Snap:  Index of the halo's snapshot.
+Column 2 - X:     X coordinate of the halo in comoving Mpc/h.
+Column 3 - Y:     Y coordinate of the halo in comoving Mpc/h.
+Column 4 - Z:     Z coordinate of the halo in comoving Mpc/h.
+Column 5 - R200m: Size of the halo in comoving Mpc/h.
+
+(This input can be generated by shellfish coord.)
+
+The stack tool prints a single-line catalog to stdout:
+
+Column 0 - Halos:             The number of halos in the stack.
+Column 1 - Spokes:            The number of lines of sight where a splashback
+                              point was found.
+Column 2 - R_sp/R200m:        The volume-equivalent splashback radius of the
+                              stacked halo in units of R200m, or NaN if too
+                              few splashback points were found.
+Column 3 - Sigma(R_sp/R200m): The jackknife error on R_sp/R200m.`,
+// pipeline mode
+	"pipeline": `Type "shellfish help" for basic information on invoking the pipeline tool.
+
+The pipeline tool runs a chain of other tools, like id, coord, shell, and
+stats, from a single config file. The output catalog of each tool is passed
+directly to the next one in memory instead of through a shell pipe, and the
+variables of each tool are read from sections of the pipeline's config file
+with that tool's usual header, e.g. [shell.config].
+
+For a documented example of a pipeline config file, type:
+
+     shellfish help pipeline.config
+
+Unlike the other tools, the pipeline tool must be given a config file. It
+takes no input from stdin. If the first tool in the pipeline needs an input
+catalog, it is read from the file given by InputFile.
+
+The pipeline tool prints the output catalog of the last tool in the pipeline to
+stdout.`,
+// merge mode
+	"merge": `Type "shellfish help" for basic information on invoking the merge tool.
+
+The merge tool combines the output catalogs of runs that were split into
+shards with the --Shard flag. Any tool which reads a catalog from stdin can be
+given the flag --Shard i/N, which makes it only analyze the halos in shard i
+out of N (counting from 0). Halos are assigned to shards by their IDs and
+snapshots, so running every shard from 0 to N-1 (e.g. as a SLURM job array)
+analyzes every halo exactly once. The shards' output files can then be merged
+with this tool, which concatenates their rows and removes duplicate rows.
+
+For a documented example of a merge config file, type:
+
+     shellfish help merge.config
+
+The merge tool takes no input from stdin.
+
+The merge tool prints the merged catalog to stdout. It has the same columns as
+the shards' catalogs.
+
+Runs can also be distributed across several nodes without writing any shard
+files. One node, rank 0, reads the input catalog and is started with
+
+    shellfish shell --Serve :5000 --Ranks N < coord.txt > shell.txt
+
+and the other N - 1 nodes are started with
+
+    shellfish shell --Connect <rank 0's hostname>:5000
+
+Rank 0 sends every node the input catalog, each node analyzes one shard of
+it, and rank 0 gathers their output into a single catalog, in the same way as
+the merge tool. Every node must be able to read the same snapshot and halo
+files and must be given identical config files and flags. Any tool which
+reads from stdin can be distributed this way.`,
+// massfunc mode
+	"massfunc": `Type "shellfish help" for basic information on invoking the massfunc tool.
+
+The massfunc tool measures the halo mass function, dn/dlog10(M), of the input
+halos in each of their snapshots, along with its Poisson error. It's meant as
+a quick check that halo catalogs, snapshot headers, and units are being read
+correctly, so the input should contain every halo in the mass range. If
+Splashback is set, the mass function of the splashback masses measured by the
+stats tool is also computed.
+
+For a documented example of a massfunc config file, type:
+
+     shellfish help massfunc.config
+
+The massfunc tool takes the following input from stdin:
+
+Column 0 - ID:   The halo's catalog ID.
+Column 1 - Snap: Index of the halo's snapshot.
+
+(This input can be generated by shellfish id, or by shellfish stats if
+Splashback is set.)
+
+The massfunc tool prints the following catalog to stdout, with one row for
+each mass bin in each snapshot:
+
+Column 0 - Snap:         Index of the snapshot.
+Column 1 - M_min:        The lower edge of the mass bin in Msun/h.
+Column 2 - M_max:        The upper edge of the mass bin in Msun/h.
+Column 3 - N:            The number of halos in the bin.
+Column 4 - dn/dlogM:     The mass function in comoving h^3/Mpc^3.
+Column 5 - dn/dlogM_err: The Poisson error on the mass function.
+
+If Splashback is set, three more columns, N_sp, dn_sp/dlogM, and
+dn_sp/dlogM_err, give the same quantities for M_sp.`,
+// benchmark mode
+	"benchmark": `Type "shellfish help" for basic information on invoking the benchmark tool.
+
+The benchmark tool generates synthetic halos with known splashback radii, fits
+shells to them in the same way as the shell tool, and reports the accuracy and
+timing of each fit. It doesn't read any snapshots, halo catalogs, or input
+from stdin, so it can be used to check that Shellfish was installed correctly
+and to compare the speed of different machines. The shell tool's variables
+can be set in a [shell.config] section of the benchmark config file.
+
+For a documented example of a benchmark config file, type:
+
+     shellfish help benchmark.config
+
+The benchmark tool prints the following catalog to stdout, with one row for
+each halo:
+
+Column 0 - ID:        Index of the synthetic halo.
+Column 1 - Particles: The number of particles generated around the halo.
+Column 2 - R200m:     R200m of the halo in comoving Mpc/h.
+Column 3 - R_sp_true: The true splashback radius in comoving Mpc/h.
+Column 4 - R_sp:      The volume-weighted splashback radius of the fitted
+                      shell in comoving Mpc/h.
+Column 5 - R_sp_err:  The fractional error, R_sp / R_sp_true - 1.
+Column 6 - Time:      The time taken to fit the shell in seconds.
+
+The catalog's header also records the number of threads, the total and mean
+fit times, the median absolute error, and the number of failed fits.`,
+// fit mode
+	"fit": `Type "shellfish help" for basic information on invoking the fit tool.
+
+The fit tool fits the relation
+
+    Quantity = A (1 + B Omega_m(z)) (1 + C exp(-Gamma / D)) nu^E
+
+to a catalog written by the stats tool, where Gamma is each halo's accretion
+rate, as measured by the gamma tool, and nu is its peak height, which is read
+from the halo catalogs if NuName is set. By default, Quantity is R_sp/R200m.
+The fit minimizes the squared difference in ln(Quantity) and starts from the
+fits of More, Diemer, & Kravtsov (2015). Parameter uncertainties are estimated
+by refitting to bootstrap resamplings of the input halos.
+
+For a documented example of a fit config file, type:
+
+     shellfish help fit.config
+
+The fit tool takes the output of shellfish stats, run with
+NormalizedColumns = true, as input.
+
+The fit tool prints a catalog with a single row to stdout:
+
+Column 0 - N:           The number of halos in the fit.
+Column 1 - A:           The best-fit value of A.
+Column 2 - A_err:       The bootstrap uncertainty in A.
+...                     The same two columns for B, C, D, and, if NuName is
+                        set, E.
+Last Column - Scatter:  The standard deviation of ln(Quantity) around the
+                        best fit.`,
+// pairs mode
+	"pairs": `Type "shellfish help" for basic information on invoking the pairs tool.
+
+The pairs tool finds every pair of input halos in the same snapshot whose
+separation is within a range of multiples of the sum of their radii. By
+default the radii are R200m, but the R_sp values written by the stats tool can
+be used instead. This can be used to find major mergers, whose shells are
+likely to be deformed.
+
+For a documented example of a pairs config file, type:
+
+     shellfish help pairs.config
+
+The pairs tool takes the following input from stdin:
+
+Column 0 - ID:    The halo's catalog ID.
+Column 1 - Snap:  Index of the halo's snapshot.
+Column 2 - X:     X coordinate of the halo in comoving Mpc/h.
+Column 3 - Y:     Y coordinate of the halo in comoving Mpc/h.
+Column 4 - Z:     Z coordinate of the halo in comoving Mpc/h.
+Column 5 - R200m: Radius of the halo in comoving Mpc/h.
+
+(This input can be generated by shellfish coord.)
+
+The pairs tool prints the following catalog to stdout, with one row for each
+pair. The halo with the larger radius is always halo 1.
+
+Column 0 - ID_1:             The catalog ID of halo 1.
+Column 1 - ID_2:             The catalog ID of halo 2.
+Column 2 - Snapshot:         Index of the halos' snapshot.
+Column 3 - Separation:       The distance between the halos in comoving
+                             Mpc/h.
+Column 4 - R_1:              The radius of halo 1 in comoving Mpc/h.
+Column 5 - R_2:              The radius of halo 2 in comoving Mpc/h.
+Column 6 - Separation/R_sum: The separation in units of R_1 + R_2.`,
+// cache mode
+	"cache": `Type "shellfish help" for basic information on invoking the cache tool.
+
+The cache tool lists, measures, and clears the files which Shellfish caches in
+the global config's MemoDir. These are copies of snapshot headers and halo
+catalogs which can grow to hundreds of GB for large simulations. They're
+recreated when they're needed, so clearing them is always safe.
+
+For a documented example of a cache config file, type:
+
+     shellfish help cache.config
+
+The cache tool doesn't take any input from stdin.
+
+The cache tool prints the following catalog to stdout, with one row for each
+snapshot. Files which don't belong to a snapshot, like memo.config, are in a
+row with Snapshot = -1. If Operation = size, there is a single row and no
+Snapshot column. If Operation = clear, only the deleted files are counted.
+
+Column 0 - Snapshot:     Index of the snapshot.
+Column 1 - Files:        The number of files.
+Column 2 - Header_Bytes: The size of the cached snapshot headers in bytes.
+Column 3 - Halo_Bytes:   The size of the cached halo catalogs in bytes.
+Column 4 - Other_Bytes:  The size of every other file in bytes.
+Column 5 - Total_Bytes:  The size of every file in bytes.`,
+// history mode
+	"history": `Type "shellfish help" for basic information on invoking the history tool.
+
+The history tool gathers the output of the shell or stats tools from many
+snapshots into a single catalog which follows each halo along its main branch,
+so that tracks like R_sp(z) can be read from one file. Rows are looked up by
+halo ID and snapshot in the catalogs listed in the Files variable.
+
+For a documented example of a history config file, type:
+
+     shellfish help history.config
+
+The history tool takes the following input from stdin:
+
+Column 0 - ID:     The catalog ID of a halo in a main branch.
+Column 1 - Snap:   Index of the halo's snapshot.
+Column 2 - RootID: The ID of the halo at the root of the branch.
+
+(This input can be generated by shellfish tree with MainProgenitors set.)
+
+The history tool prints the following catalog to stdout:
+
+Column 0 - RootID: The ID of the halo at the root of the branch.
+Column 1 - ID:     The halo's catalog ID.
+Column 2 - Snap:   Index of the halo's snapshot.
+Column 3 - Scale:  The scale factor of the halo's snapshot.
+
+These are followed by the columns listed in the Columns variable, copied from
+Files. Halos which aren't in any of the Files are skipped.`,
+// environment mode
+	"environment": `Type "shellfish help" for basic information on invoking the environment tool.
+
+The environment tool measures the large-scale overdensity around each input
+halo, delta(R) = rho(< R) / rho_mean - 1, at several smoothing radii, R. The
+particles of each snapshot are binned onto a coarse grid, so this is much
+cheaper than measuring profiles out to large radii. The splashback radius
+depends on environment, so these columns can be used to split samples or as
+additional parameters in fits.
+
+For a documented example of an environment config file, type:
+
+     shellfish help environment.config
+
+The environment tool takes any catalog from stdin whose first columns are:
+
+Column 0 - ID:   The halo's catalog ID.
+Column 1 - Snap: Index of the halo's snapshot.
+Column 2 - X:    X coordinate of the halo in comoving Mpc/h.
+Column 3 - Y:    Y coordinate of the halo in comoving Mpc/h.
+Column 4 - Z:    Z coordinate of the halo in comoving Mpc/h.
+
+(This input can be generated by shellfish coord or shellfish shell.)
+
+The environment tool prints its input catalog to stdout with one column
+added to the end of each row for every radius in Radii. The columns are named
+delta_<R>, with R in comoving Mpc/h.`,
+// map mode
+	"map": `Type "shellfish help" for basic information on invoking the map tool.
+
+The map tool writes an image of the projected surface density around each
+input halo to a FITS file, for visually inspecting halos whose shells look
+unusual. Images are centered on the halo and their headers contain WCS
+keywords giving the comoving coordinates of every pixel, along with the
+halo's ID, snapshot, and R200m.
+
+For a documented example of a map config file, type:
+
+     shellfish help map.config
+
+The map tool takes the following input from stdin:
+
+Column 0 - ID:    The halo's catalog ID.
+Column 1 - Snap:  Index of the halo's snapshot.
+Column 2 - X:     X coordinate of the halo in comoving Mpc/h.
+Column 3 - Y:     Y coordinate of the halo in comoving Mpc/h.
+Column 4 - Z:     Z coordinate of the halo in comoving Mpc/h.
+Column 5 - R200m: Size of the halo in comoving Mpc/h.
+
+(This input can be generated by shellfish coord or shellfish shell.)
+
+The map tool prints the following catalog to stdout:
+
+Column 0 - ID:        The halo's catalog ID.
+Column 1 - Snap:      Index of the halo's snapshot.
+Column 2 - Particles: The number of particles in the halo's image.`,
+// diff mode
+	"diff": `Type "shellfish help" for basic information on invoking the diff tool.
+
+The diff tool compares two catalogs written by Shellfish, e.g. the output of
+two Shellfish versions or of two sets of config variables, to check whether
+a change altered the results. Rows are matched by halo ID and snapshot and
+columns are matched by the names in the catalogs' headers, so the two
+catalogs can contain different halos and columns in different orders.
+
+For a documented example of a diff config file, type:
+
+     shellfish help diff.config
+
+The diff tool takes no input from stdin.
+
+The diff tool prints the following catalog to stdout:
+
+Column 0 - ID:   The halo's catalog ID.
+Column 1 - Snap: Index of the halo's snapshot.
+
+Each following column gives the difference between the two catalogs in one of
+the compared columns, relative to the first catalog by default. Columns with
+several elements, like the Penna-Dines coefficients, P_ijk, are compared by
+the length of their difference vector. Comment lines before the catalog
+summarize how many halos were matched and the mean and maximum size of each
+column's differences.`,
+// serve mode
+	"serve": `Type "shellfish help" for basic information on invoking the serve tool.
+
+The serve tool starts an HTTP server which measures halos on request. It keeps
+running until it's killed, and it keeps snapshot headers and halo catalogs in
+memory between requests, so it avoids the startup and caching costs of running
+the other tools over and over during interactive exploration. Particles are not
+cached: every request re-reads the snapshot files it needs.
+
+Every request runs a list of tools (coord and shell, by default) on the
+requested halos, exactly as if their IDs and snapshots had been piped into
+them. The config variables of these tools are set in sections of the serve
+config file, in the same way as the pipeline tool. For a documented example of
+a serve config file, type:
+
+     shellfish help serve.config
+
+By default, the server only accepts requests from the same machine. Set
+Address in the serve config file to accept requests from other machines.
+
+The server answers three kinds of requests:
+
+    GET  /health                 responds with "ok".
+    GET  /measure?id=X&snap=Y    measures the halo with ID X in snapshot Y.
+    POST /measure                measures every halo in a JSON body like
+                                 {"halos": [{"id": 10, "snap": 100}, ...]}
+
+Responses to /measure are JSON objects. "header" contains the comment lines of
+the last tool's output catalog and "rows" contains its other lines. If there's
+an error, "error" contains its message. For example:
+
+    curl 'localhost:8080/measure?id=10&snap=100'
+
+The serve tool takes no input from stdin and prints nothing to stdout.`,
 // tree mode
 	"tree":  `Type "shellfish help" for basic information on invoking the tree tool.
 
@@ -84,6 +747,18 @@ For conveinece of automated reading, the trees belonging to different halos
 will be separated by a line reading "-1 -1". Other Shellfish modes will ignore
 these lines and propagate them forward.
 
+If MainProgenitors (or Descendants) is set, only the input halos and their main
+progenitors (or descendants) are output, no separator lines are written, and a
+third column is added:
+
+Column 2 - RootID: The ID of the input halo that the row belongs to.
+
+If ExtrapolateOrphans is also set, a fourth column is added:
+
+Column 3 - Extrapolated: -1 for halos found in the tree. Otherwise, the
+                         snapshot where the halo was last seen. coord will
+                         extrapolate these halos' positions.
+
 (This output can be fed directly to shellfish coord.)`,
 // coord
 	"coord": `Type "shellfish help" for basic information on invoking the coord tool.
@@ -112,7 +787,14 @@ Column 1 - Snap:  Index of the halo's snapshot.
 Column 2 - X:     X coordinate of the halo in comoving Mpc/h
 Column 3 - Y:     Y coordinate of the halo in comoving Mpc/h
 Column 4 - Z:     Z coordinate of the halo in comoving Mpc/h
-Column 5 - R200m: The radius of the halo in comoving Mpc/h
+Column 5 - R200m: The radius of the halo in comoving Mpc/h (or whichever
+                  radius is chosen by RadiusDefinition)
+
+If Velocities is set, the halo's bulk velocity is given in three additional
+columns, Vx, Vy, and Vz, after R200m.
+
+If the input has RootID, Extrapolated, or Seed columns, they are copied to the
+final columns of the output.
 
 (This output can be fed directly to shellfish shell or shellfish prof.)`,
 // prof
@@ -175,6 +857,9 @@ Column 3 - Y:     Y coordinate of the halo in comoving Mpc/h
 Column 4 - Z:     Z coordinate of the halo in comoving Mpc/h
 Column 5 - R200m: The radius of the halo in comoving Mpc/h
 
+If the input has a column labeled Seed in its header (which shellfish id adds
+when Mult > 1), it is used as the random seed for each halo's lines of sight.
+
 (This input can be generated by shellfish coord.)
 
 The shell tool prints the following catalog to stdout:
@@ -221,8 +906,8 @@ The stats tool prints the following catalog to stdout:
 
 Column 0  - ID:      The halo's catalog ID.
 Column 1  - Snap:    Index of the halo's snapshot.
-Column 2  - R_sp:    The volume-equivalent splashback radius in comoving Mpc/h.
-Column 3  - M_sp:    The mass contained within the splashback shell in Msun/h.
+Column 2  - M_sp:    The mass contained within the splashback shell in Msun/h.
+Column 3  - R_sp:    The volume-equivalent splashback radius in comoving Mpc/h.
 Column 4  - V_sp:    The volume of the splashback shell in comoving (Mpc/h)^3.
 Column 5  - SA_sp:   The surface area of the splashback shell in comoving
                      (Mpc/h)^2.
@@ -232,8 +917,60 @@ Column 7  - b_sp:    The length of the intermediate axis of the splashback shell
                      in comoving Mpc/h.
 Column 8  - c_sp:    The length of the minor axis of the splashback shell in
                      comoving Mpc/h.
-Column 9 to 11 - A: The x, y, and z components of the major axis of the
-                    splashback in arbitrary units.
+Column 9 to 11 - A: The x, y, and z components of a unit vector along the
+                     major axis of the splashback shell.
+Column 12 - R_min:   The smallest radius of the splashback shell in comoving
+                     Mpc/h.
+Column 13 - R_max:   The largest radius of the splashback shell in comoving
+                     Mpc/h.
+Column 14 - b/a:     The ratio of the intermediate axis to the major axis.
+Column 15 - c/a:     The ratio of the minor axis to the major axis.
+Column 16 to 18 - B: The x, y, and z components of a unit vector along the
+                     intermediate axis of the splashback shell.
+Column 19 to 21 - C: The x, y, and z components of a unit vector along the
+                     minor axis of the splashback shell.
+Column 22 - M_sphere: The mass contained within a sphere with the shell's
+                     volume-equivalent radius in Msun/h. Comparing this to
+                     M_sp shows how much the shell's asphericity changes its
+                     mass.
+Column 23 - Offset/R200m: The distance between the shell's center of volume
+                         and the input halo center in units of R200m.
+
+If FreeCenter is true, the shell is refit around its center of volume before
+any other columns are computed, and three columns giving the X, Y, and Z
+coordinates of the new center in comoving Mpc/h follow column 23.
+
+If Bootstraps is positive, the standard deviations of M_sp and R_sp across the
+bootstrap shells come next. If SpeciesMasses is true, four columns follow: the
+dark matter, gas, and stellar masses inside the shell in Msun/h and the baryon
+fraction, (M_gas + M_star) / (M_dm + M_gas + M_star).
+
+If NeighborOverlap is true, four columns come next: the number of other input
+halos whose shells intersect the shell, the fraction of the shell's volume
+inside those shells, the number of other input halos whose R200m spheres
+intersect the shell, and the fraction of the shell's volume inside those
+spheres.
+
+If NormalizedColumns is true (the default), R_sp/R200m and M_sp/M200m come
+next. R200m is the input R200m and M200m is read from the halo catalog. If
+Include200c is also true, R_sp/R200c and M_sp/M200c follow them.
+If GammaFile is set, four columns follow: the More, Diemer, & Kravtsov (2015)
+predictions for R_sp/R200m and M_sp/M200m given each halo's accretion rate,
+each followed by the fractional residual of the measured value.
+
+After these, if PowerLMax is positive, PowerLMax more columns give the angular
+power spectrum of the shell's radius field, C_l / C_0, for l = 1 to PowerLMax.
+Then one column is added for each value in RadiusPercentiles giving that
+percentile of the shell's radius over all angles in comoving Mpc/h.
+
+If CombineRepeats is true (the default), rows which refer to the same halo are
+merged into a single row of mean values, and three final columns give the
+number of repetitions and the standard deviations of M_sp and R_sp across them.
+
+All of the units above are the defaults. If the Units variable in the global
+config file is set to pMpc or pkpc, lengths, areas, volumes, and masses are
+written in physical units without factors of h instead, and the header of the
+catalog records which units were used.
 `,
 
 	"config":       new(cmd.GlobalConfig).ExampleConfig(),
@@ -246,6 +983,28 @@ Column 9 to 11 - A: The x, y, and z components of the major axis of the
 	"phase.config": cmd.ModeNames["phase"].ExampleConfig(),
 	"potential.config": cmd.ModeNames["potential"].ExampleConfig(),
 	"check.config": cmd.ModeNames["check"].ExampleConfig(),
+	"crossmatch.config": cmd.ModeNames["crossmatch"].ExampleConfig(),
+	"gamma.config": cmd.ModeNames["gamma"].ExampleConfig(),
+	"trajectory.config": cmd.ModeNames["trajectory"].ExampleConfig(),
+	"orbit.config": cmd.ModeNames["orbit"].ExampleConfig(),
+	"backsplash.config": cmd.ModeNames["backsplash"].ExampleConfig(),
+	"caustic.config": cmd.ModeNames["caustic"].ExampleConfig(),
+	"render.config": cmd.ModeNames["render"].ExampleConfig(),
+	"projected.config": cmd.ModeNames["projected"].ExampleConfig(),
+	"stack.config": cmd.ModeNames["stack"].ExampleConfig(),
+	"pipeline.config": cmd.ModeNames["pipeline"].ExampleConfig(),
+	"merge.config": cmd.ModeNames["merge"].ExampleConfig(),
+	"serve.config": cmd.ModeNames["serve"].ExampleConfig(),
+	"diff.config": cmd.ModeNames["diff"].ExampleConfig(),
+	"map.config": cmd.ModeNames["map"].ExampleConfig(),
+	"tag.config": cmd.ModeNames["tag"].ExampleConfig(),
+	"environment.config": cmd.ModeNames["environment"].ExampleConfig(),
+	"history.config": cmd.ModeNames["history"].ExampleConfig(),
+	"massfunc.config": cmd.ModeNames["massfunc"].ExampleConfig(),
+	"benchmark.config": cmd.ModeNames["benchmark"].ExampleConfig(),
+	"fit.config": cmd.ModeNames["fit"].ExampleConfig(),
+	"pairs.config": cmd.ModeNames["pairs"].ExampleConfig(),
+	"cache.config": cmd.ModeNames["cache"].ExampleConfig(),
 }
 
 var modeDescriptions = `The best way to learn how to use shellfish is the tutorial on its github page:
@@ -264,6 +1023,28 @@ The different tools in the Shellfish toolchain are:
     shellfish stats     [____.stats.config]     [flags]
     shellfish phase     [____.stats.config]     [flags]
     shellfish potential [____.potential.config] [flags]
+    shellfish crossmatch [____.crossmatch.config] [flags]
+    shellfish gamma     [____.gamma.config]     [flags]
+    shellfish trajectory [____.trajectory.config] [flags]
+    shellfish orbit     [____.orbit.config]     [flags]
+    shellfish backsplash [____.backsplash.config] [flags]
+    shellfish caustic   [____.caustic.config]   [flags]
+    shellfish render    [____.render.config]    [flags]
+    shellfish projected [____.projected.config] [flags]
+    shellfish stack     [____.stack.config]     [flags]
+    shellfish pipeline  ____.pipeline.config    [flags]
+    shellfish merge     [____.merge.config]     [flags]
+    shellfish serve     [____.serve.config]     [flags]
+    shellfish diff      [____.diff.config]      [flags]
+    shellfish map       [____.map.config]       [flags]
+    shellfish tag       [____.tag.config]       [flags]
+    shellfish environment [____.environment.config] [flags]
+    shellfish history   [____.history.config]   [flags]
+    shellfish massfunc  [____.massfunc.config]  [flags]
+    shellfish benchmark [____.benchmark.config] [flags]
+    shellfish fit       [____.fit.config]       [flags]
+    shellfish pairs     [____.pairs.config]     [flags]
+    shellfish cache     [____.cache.config]     [flags]
 
 (Arguments in brackets are optional.)
 
@@ -280,7 +1061,16 @@ For documented example config files, type any of:
 
     shellfish help [ check.config | id.config | prof.config |shell.config |
                      stats.config | tree.config | phase.config |
-                     potenial.config ]
+                     potenial.config | crossmatch.config | gamma.config |
+                     trajectory.config | orbit.config |
+                     backsplash.config | caustic.config |
+                     render.config | projected.config |
+                     stack.config | pipeline.config | merge.config |
+                     serve.config | diff.config | map.config |
+                     tag.config | environment.config |
+                     history.config | massfunc.config |
+                     benchmark.config | fit.config | pairs.config |
+                     cache.config ]
 
 In addition to any arguments passed at the command line, before calling
 Shellfish rountines you will need to specify a "global" config file (it
@@ -300,7 +1090,25 @@ For more information on the input and output that a given tool expects, type
 any of:
 
     shellfish help [ check | id | tree | coord | prof | shell | stats | phase |
-                     potential ]`
+                     potential | crossmatch | gamma | trajectory | orbit |
+                     backsplash | caustic | render | projected | stack |
+                     pipeline | merge | serve | diff | map | tag |
+                     environment | history | massfunc | benchmark |
+                     fit | pairs | cache ]
+
+New modes can be added without modifying Shellfish in two ways. Go plugins
+(built with "go build -buildmode=plugin") which call cmd.RegisterMode in their
+init functions are loaded from the files and directories listed in the
+$SHELLFISH_PLUGINS environment variable. Modes written in any language can be
+added as executables named shellfish-<mode> in your $PATH; the cmd.ExternalMode
+documentation describes the protocol they follow.
+
+Large runs can be split across several independent jobs by passing the flag
+--Shard i/N to any tool that reads from stdin, or distributed across several
+nodes with the flags --Serve, --Ranks, and --Connect. For more information,
+type
+
+    shellfish help merge`
 
 func main() {
 	args := os.Args
@@ -312,13 +1120,26 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := cmd.LoadPlugins(os.Getenv("SHELLFISH_PLUGINS")); err != nil {
+		log.Printf("Error loading plugins:\n%s\n", err.Error())
+		fmt.Println("Shellfish terminating.")
+		os.Exit(1)
+	}
+
 	switch args[1] {
 	case "help":
 		switch len(args) - 2 {
 		case 0:
 			fmt.Println(modeDescriptions)
+			if names := cmd.RegisteredModeNames(); len(names) > 0 {
+				fmt.Printf("\nModes added by plugins: %s\n",
+					strings.Join(names, ", "))
+			}
 		case 1:
 			text, ok := helpStrings[args[2]]
+			if !ok {
+				text, ok = pluginHelp(args[2])
+			}
 			if !ok {
 				fmt.Printf("I don't recognize the help target '%s'\n", args[2])
 			} else {
@@ -339,6 +1160,24 @@ func main() {
 
 	mode, ok := cmd.ModeNames[args[1]]
 	
+	if ext, isExt := cmd.FindExternalMode(args[1]); !ok && isExt {
+		// External modes read the global config themselves, but it's
+		// checked here so that they fail in the same way as built-in modes.
+		gConfigName, gConfig, err := getGlobalConfig(args[:2])
+		if err == nil {
+			err = checkMemoDir(gConfig.MemoDir, gConfigName)
+		}
+		if err == nil {
+			err = ext.Run(args[2:])
+		}
+		if err != nil {
+			log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
+			fmt.Println("Shellfish terminating.")
+			os.Exit(1)
+		}
+		return
+	}
+
 	if !ok {
 		fmt.Fprintf(
 			os.Stderr, "You passed me the mode '%s', which I don't "+
@@ -348,10 +1187,29 @@ func main() {
 		os.Exit(1)
 	}
 
+	var dist *cmd.Distribution
+	flags, shard, err := cmd.SplitShardFlag(getFlags(args[2:]))
+	if err == nil {
+		flags, dist, err = cmd.SplitDistributionFlags(flags)
+	}
+	if err == nil && shard != "" && dist != nil {
+		err = fmt.Errorf("The flag 'Shard' can't be used in a " +
+			"distributed run.")
+	}
+	if err != nil {
+		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
+		fmt.Println("Shellfish terminating.")
+		os.Exit(1)
+	}
+	// Workers get their input catalog from the coordinator.
+	isWorker := dist != nil && dist.Connect != ""
+
 	var stdinData []byte
-	switch args[1] {
-	case "tree", "coord", "prof", "shell", "stats", "phase", "potential":
-		var err error
+	switch {
+	case readsStdin(args[1]):
+		if isWorker {
+			break
+		}
 		stdinData, err = ioutil.ReadAll(os.Stdin)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, err.Error())
@@ -359,7 +1217,9 @@ func main() {
 			os.Exit(1)
 		}
 
-		if len(stdinData) == 0 {
+		// A coordinator still needs to tell its workers that there's
+		// nothing to do.
+		if len(stdinData) == 0 && dist == nil {
 			return
 		}
 
@@ -370,9 +1230,29 @@ func main() {
 			fmt.Println(string(stdinData)[:lineEnd])
 			os.Exit(1)
 		}
+
+		if shard != "" {
+			i, n, err := cmd.ParseShard(shard)
+			if err != nil {
+				log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
+				fmt.Println("Shellfish terminating.")
+				os.Exit(1)
+			}
+			stdinData = cmd.ShardCatalog(stdinData, i, n)
+			if !cmd.HasRows(stdinData) {
+				return
+			}
+		}
+	default:
+		if shard != "" || dist != nil {
+			log.Printf("Error running mode %s:\nThe flags 'Shard', "+
+				"'Serve', 'Ranks', and 'Connect' can only be used by modes "+
+				"which read from stdin.\n", args[1])
+			fmt.Println("Shellfish terminating.")
+			os.Exit(1)
+		}
 	}
 	
-	flags := getFlags(args[2:])
 	config, ok := getConfig(args[2:])
 	gConfigName, gConfig, err := getGlobalConfig(args[:2])
 	if err != nil {
@@ -395,16 +1275,26 @@ func main() {
 		}
 	}
 
-	if err = checkMemoDir(gConfig.MemoDir, gConfigName); err != nil {
-		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
-		fmt.Println("Shellfish terminating.")
-		os.Exit(1)
+	// The cache tool needs to be able to clear a MemoDir which was created
+	// with a different global config.
+	if args[1] != "cache" {
+		if err = checkMemoDir(gConfig.MemoDir, gConfigName); err != nil {
+			log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
+			fmt.Println("Shellfish terminating.")
+			os.Exit(1)
+		}
 	}
+	memo.Compression = gConfig.MemoCompression
 
-	switch args[1] {
-	case "shell", "stats", "prof", "check", "phase", "potential":
-		if gConfig.SnapshotType == "nil" {
-			log.Printf("Cannot run mode %s with SnapshotType = nil", args[1])
+	// Pipelines and servers run every one of their stages.
+	stages := []string{args[1]}
+	if p, ok := mode.(interface{ Stages() []string }); ok {
+		stages = p.Stages()
+	}
+
+	for _, stage := range stages {
+		if needsSnapshots(stage) && gConfig.SnapshotType == "nil" {
+			log.Printf("Cannot run mode %s with SnapshotType = nil", stage)
 			fmt.Println("Shellfish terminating")
 			os.Exit(1)
 		}
@@ -418,11 +1308,13 @@ func main() {
 		os.Exit(1)
 	}
 	
-	err = initHalos(args[1], gConfig, e)
-	if err != nil {
-		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
-		fmt.Println("Shellfish terminating.")
-		os.Exit(1)
+	for _, stage := range stages {
+		err = initHalos(stage, gConfig, e)
+		if err != nil {
+			log.Printf("Error running mode %s:\n%s\n", stage, err.Error())
+			fmt.Println("Shellfish terminating.")
+			os.Exit(1)
+		}
 	}
 
 	switch gConfig.Logging {
@@ -437,7 +1329,26 @@ func main() {
 		os.Exit(1)
 	}
 	
-	out, err := mode.Run(gConfig, e, stdinData)
+	run := func(in []byte) ([]string, error) {
+		return mode.Run(gConfig, e, in)
+	}
+
+	var out []string
+	if dist == nil {
+		out, err = run(stdinData)
+	} else {
+		var hash string
+		hashNames := []string{gConfigName}
+		if ok {
+			hashNames = append(hashNames, config)
+		}
+		hash, err = cmd.DistributionHash(hashNames, flags)
+		if err == nil && isWorker {
+			err = cmd.RunWorker(dist, args[1], hash, run)
+		} else if err == nil {
+			out, err = cmd.RunCoordinator(dist, args[1], hash, stdinData, run)
+		}
+	}
 	if err != nil {
 		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
 		fmt.Println("Shellfish terminating.")
@@ -449,6 +1360,62 @@ func main() {
 	}
 }
 
+// readsStdin returns true if the named mode reads an input catalog from
+// stdin.
+func readsStdin(mode string) bool {
+	switch mode {
+	case "tree", "coord", "prof", "shell", "stats", "phase", "potential",
+		"crossmatch", "gamma", "trajectory", "orbit", "backsplash",
+		"caustic", "render", "projected", "stack", "map", "tag",
+		"environment", "history", "massfunc", "fit", "pairs":
+		return true
+	}
+	info, ok := cmd.RegisteredMode(mode)
+	return ok && info.Stdin
+}
+
+// needsSnapshots returns true if the named mode reads particle snapshots.
+func needsSnapshots(mode string) bool {
+	switch mode {
+	case "shell", "stats", "prof", "check", "phase", "potential", "map",
+		"environment", "orbit", "caustic",
+		"projected", "stack", "tag":
+		return true
+	}
+	info, ok := cmd.RegisteredMode(mode)
+	return ok && info.Snapshots
+}
+
+// pluginHelp returns the help text for a mode added by a plugin or an
+// external executable, or for its config file if target ends in ".config".
+func pluginHelp(target string) (string, bool) {
+	name := strings.TrimSuffix(target, ".config")
+	isConfig := name != target
+
+	if info, ok := cmd.RegisteredMode(name); ok {
+		if isConfig {
+			return cmd.ModeNames[name].ExampleConfig(), true
+		}
+		return info.Help, true
+	}
+
+	if ext, ok := cmd.FindExternalMode(name); ok {
+		var text string
+		var err error
+		if isConfig {
+			text, err = ext.ExampleConfig()
+		} else {
+			text, err = ext.Help()
+		}
+		if err != nil {
+			return err.Error(), true
+		}
+		return text, true
+	}
+
+	return "", false
+}
+
 // getFlags reutrns the flag tokens from the command line arguments.
 func getFlags(args []string) []string {
 	if len(args) == 0 || len(args[0]) == 0 || args[0][0] == '-' {
@@ -491,9 +1458,13 @@ func getConfig(args []string) (string, bool) {
 func checkMemoDir(memoDir, configFile string) error {
 	memoConfigFile := path.Join(memoDir, "memo.config")
 
-	if _, err := os.Stat(memoConfigFile); err != nil {
-		// File doesn't exist, directory is clean.
-		err = copyFile(memoConfigFile, configFile)
+	// If the file doesn't exist, the directory is clean. Several jobs might
+	// be started in the same clean directory at once, so only one of them
+	// copies the file.
+	err := memo.CreateOnce(memoConfigFile, func(tmp string) error {
+		return copyFile(tmp, configFile)
+	})
+	if err != nil {
 		return err
 	}
 
@@ -509,13 +1480,13 @@ func checkMemoDir(memoDir, configFile string) error {
 		return fmt.Errorf(`You've changed the variables in the config file %s in a way that would invlalidate the files Shellfish cached in %s (i.e. MemoDir) to speed up performance. Maybe you wanted this (e.g. there was a mistake in the old config file), but maybe you didn't.
 
 If you wanted to make the change and you're SURE there's nothing that you care about in MemoDir, type the command
-    $ rm -r %s/*
+    $ shellfish cache --Operation clear
 and rerun shellfish. (Shellfish could do this for you automatically, but I don't want to accidentally delete something you care about.)
 
 If you want to check what the change is, or if you lost the old config file and want it back, you can find a copy in %s
 
 If you accidentally wrote down the wrong path in the MemoDir variable in %s, you should change it.
-` , configFile, memoDir, memoDir, memoConfigFile, configFile)
+` , configFile, memoDir, memoConfigFile, configFile)
 	}
 	return nil
 }
@@ -557,6 +1528,8 @@ func configEqual(m, c *cmd.GlobalConfig) bool {
 		stringsEqual(c.SnapshotFormatMeanings, m.SnapshotFormatMeanings) &&
 		stringsEqual(c.HaloValueNames, m.HaloValueNames) &&
 		int64sEqual(c.HaloValueColumns, m.HaloValueColumns) &&
+		c.HaloFilter == m.HaloFilter &&
+		stringsEqual(c.CompaSOFields, m.CompaSOFields) &&
 		c.HaloPositionUnits == m.HaloPositionUnits &&
 		c.HaloMassUnits == m.HaloMassUnits &&
 		int64sEqual(c.HaloValueColumns, m.HaloValueColumns) &&
@@ -591,18 +1564,32 @@ func stringsEqual(xs, ys []string) bool {
 func initHalos(
 	mode string, gConfig *cmd.GlobalConfig, e *env.Environment,
 ) error {
+	info, registered := cmd.RegisteredMode(mode)
+	if registered && !info.Halos && gConfig.HaloType == "nil" {
+		return nil
+	}
+
 	switch mode {
-	case "shell", "stats", "prof", "check", "phase", "potential":
+	case "merge", "diff", "history", "benchmark", "pairs", "cache":
 		return nil
+	case "shell", "stats", "prof", "check", "phase", "potential", "fit":
+		// These modes only read halo catalogs for optional features, like
+		// subhalo excision.
+		if gConfig.HaloType == "nil" {
+			return nil
+		}
 	}
 
 	switch gConfig.HaloType {
 	case "nil":
 		return fmt.Errorf("You may not use nil as a HaloType for the "+
 			"mode '%s.'\n", mode)
+	case "CompaSO":
+		return e.InitCompaSOHalo(&gConfig.HaloInfo)
 	case "Text":
 		return e.InitTextHalo(&gConfig.HaloInfo)
-		if gConfig.TreeType != "consistent-trees" {
+		if gConfig.TreeType != "consistent-trees" &&
+			gConfig.TreeType != "consistent-trees-text" {
 			return fmt.Errorf("You're trying to use the '%s' TreeType with " +
 				"the 'Text' HaloType.")
 		}
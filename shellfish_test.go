@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/cmd"
+)
+
+// readsParticles lists whether each mode reads particles from the snapshot
+// files. Every mode in cmd.ModeNames must be listed here.
+var readsParticles = map[string]bool{
+	"id":          false,
+	"tree":        false,
+	"coord":       false,
+	"prof":        true,
+	"shell":       true,
+	"stats":       true,
+	"phase":       true,
+	"check":       true,
+	"potential":   true,
+	"crossmatch":  false,
+	"gamma":       false,
+	"trajectory":  false,
+	"orbit":       true,
+	"backsplash":  false,
+	"caustic":     true,
+	"render":      false,
+	"projected":   true,
+	"stack":       true,
+	"pipeline":    false,
+	"merge":       false,
+	"serve":       false,
+	"diff":        false,
+	"map":         true,
+	"tag":         true,
+	"environment": true,
+	"history":     false,
+	"massfunc":    false,
+	"benchmark":   false,
+	"fit":         false,
+	"pairs":       false,
+	"cache":       false,
+}
+
+func TestNeedsSnapshots(t *testing.T) {
+	for mode := range cmd.ModeNames {
+		reads, ok := readsParticles[mode]
+		if !ok {
+			t.Errorf("Mode %s is not in readsParticles. Add it, and add it "+
+				"to needsSnapshots if it reads particles.", mode)
+			continue
+		}
+		if needsSnapshots(mode) != reads {
+			t.Errorf("Expected needsSnapshots(%s) = %v, got %v.",
+				mode, reads, needsSnapshots(mode))
+		}
+	}
+
+	for mode := range readsParticles {
+		if _, ok := cmd.ModeNames[mode]; !ok {
+			t.Errorf("readsParticles contains %s, which isn't in "+
+				"cmd.ModeNames.", mode)
+		}
+	}
+}